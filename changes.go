@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// parseSince parses the "-since" argument: a sequence number from an earlier
+// "-changes" call, a time in RFC 3339 format, or "@" followed by a Unix time.
+// An empty string means since the mount.
+func parseSince(s string) (seq uint64, t int64, err error) {
+	switch {
+	case s == "":
+		return 0, 0, nil
+	case strings.HasPrefix(s, "@"):
+		t, err = strconv.ParseInt(s[1:], 10, 64)
+		return 0, t, err
+	case strings.Contains(s, "T"):
+		tt, err := time.Parse(time.RFC3339, s)
+		return 0, tt.Unix(), err
+	}
+	seq, err = strconv.ParseUint(s, 10, 64)
+	if err == nil && seq == 0 {
+		err = fmt.Errorf("the sequence number must be positive")
+	}
+	return seq, 0, err
+}
+
+// doChanges handles "-changes [-since SINCE] [-json] {MOUNTPOINT | -ctlsock
+// SOCKET}": it lists the ciphertext paths that have been changed through the
+// mount, for incremental backups of CIPHERDIR. Returns the exit code.
+func doChanges(args *argContainer) int {
+	usageErr := flagSet.NArg() != 1 || args.ctlsock != ""
+	if args.ctlsock != "" {
+		usageErr = flagSet.NArg() != 0
+	}
+	if usageErr {
+		tlog.Fatal.Printf("Usage: %s -changes [-since SEQ|TIME] [-json] {MOUNTPOINT | -ctlsock SOCKET}",
+			tlog.ProgramName)
+		return exitcodes.Usage
+	}
+	seq, t, err := parseSince(args.since)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid -since %q: %v", args.since, err)
+		return exitcodes.Usage
+	}
+	sock := args.ctlsock
+	if sock == "" {
+		_, sock, err = findMount(flagSet.Arg(0))
+		if err != nil {
+			tlog.Fatal.Printf("%v", err)
+			return exitcodes.MountPoint
+		}
+		if sock == "" {
+			tlog.Fatal.Printf("Could not find the control socket of %q. -changes needs a mount with -ctlsock.",
+				flagSet.Arg(0))
+			return exitcodes.CtlSock
+		}
+	}
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		return exitcodes.CtlSock
+	}
+	defer c.Close()
+	resp, err := c.Query(&ctlsock.RequestStruct{Changes: true, ChangesSinceSeq: seq, ChangesSinceTime: t})
+	if err == nil && resp.Changes == nil {
+		err = fmt.Errorf("%s: no Changes in response", sock)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		return exitcodes.CtlSock
+	}
+	ch := resp.Changes
+	if args.json {
+		out, _ := json.MarshalIndent(ch, "", "\t")
+		fmt.Println(string(out))
+	} else {
+		for _, e := range ch.Changes {
+			op := "M"
+			if e.Deleted {
+				op = "D"
+			}
+			fmt.Printf("%s\t%s\n", op, e.Path)
+		}
+		// Goes to stderr so that stdout only contains paths
+		fmt.Fprintf(os.Stderr, "Seq %d. Use -since %d to get the changes after this one.\n", ch.Seq, ch.Seq)
+	}
+	if !ch.Complete {
+		tlog.Warn.Printf("The list is incomplete: the mount is younger than -since, or the oldest changes " +
+			"have been dropped. Scan the whole CIPHERDIR instead.")
+		return exitcodes.ChangesIncomplete
+	}
+	return 0
+}
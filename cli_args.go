@@ -12,14 +12,21 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	flag "github.com/spf13/pflag"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/auditlog"
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/faultinject"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/policy"
+	"github.com/rfjakob/gocryptfs/v2/internal/progress"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -31,22 +38,78 @@ type argContainer struct {
 	longnames, allow_other, reverse, aessiv, nonempty, raw64,
 	noprealloc, speed, hkdf, serialize_reads, hh, info,
 	sharedstorage, fsck, one_file_system, deterministic_names,
-	xchacha bool
+	xchacha, aegis, aes128, journal, sync, fsync_on_close,
+	noatime, relatime, unmount, when_idle, create_mountpoint, force,
+	list, userns, seccomp, root_squash, auditlog, manifest, merkle,
+	bindpath, hctr2, encfs, wizard, json, nodefaults, health, top,
+	changes, new_key_epoch, reencrypt, worm, make_readonly,
+	append_only, flat, repair, notify, compact, rescue,
+	migrate_config, warmup, argon2id, tpm2_enroll, tpm2_remove,
+	pkcs11, pkcs11_remove, rekey, immutable bool
 	// Mount options with opposites
 	dev, nodev, suid, nosuid, exec, noexec, rw, ro, kernel_cache, acl bool
 	masterkey, mountpoint, cipherdir, cpuprofile,
-	memprofile, ko, ctlsock, fsname, force_owner, trace, fido2 string
-	// -extpass, -badname, -passfile can be passed multiple times
-	extpass, badname, passfile []string
-	// For reverse mode, several ways to specify exclusions. All can be specified multiple times.
-	exclude, excludeWildcard, excludeFrom []string
+	memprofile, ko, ctlsock, fsname, force_owner, trace, fido2, policy,
+	union_create, replica, cachedir, sandbox_user, manifest_anchor,
+	pqkey, longnamehash, export_fscrypt, fscrypt_key, label,
+	description, mount_defaults, image, container, since,
+	verify, fault_inject, downgrade, add_subvolume, lock_subvolume,
+	unlock_subvolume, prealloc, progress, cgroup, tpm2_pcrs,
+	pkcs11_enroll, pkcs11_id string
+	// SELinux context mount options, passed on to the kernel
+	context, fscontext, defcontext, rootcontext string
+	// -extpass, -badname, -passfile, -union, -unlock can be passed multiple times
+	extpass, badname, passfile, union, unlock []string
+	// -loglevel, -cachemem, -idle, -bwlimit, -ioplimit and the exclusions
+	// of reverse mode, which a reload can change
+	reloadOpts
 	// Configuration file name override
 	config             string
 	notifypid, scryptn int
-	// Idle time before autounmount
-	idle time.Duration
+	// -scryptr (scrypt block size) and -scryptp (number of scrypt lanes) for
+	// -init and -passwd
+	scryptr, scryptp int
+	// -argon2id-memory (MiB) and -argon2id-time (passes) for -argon2id
+	argon2id_memory, argon2id_time uint
+	// -require-entropy (minimum estimated password strength in bits)
+	require_entropy int
+	// -progress-fd (where "-progress json" goes)
+	progress_fd int
+	// -io_timeout (deadline for backing storage accesses)
+	io_timeout time.Duration
+	// -retry_count and -retry_interval (retry failed writes and fsyncs)
+	retry_count    int
+	retry_interval time.Duration
+	// -fsync_interval (sync CIPHERDIR periodically)
+	fsync_interval time.Duration
+	// -reencrypt-idle (idle time before -reencrypt starts) and
+	// -reencrypt-rate (bytes per second)
+	reencrypt_idle time.Duration
+	reencrypt_rate uint64
+	// -kdfcache (how long the key derived from the password is cached)
+	kdfcache time.Duration
+	// -worm-retention (how long sealed files cannot be deleted)
+	worm_retention time.Duration
 	// -longnamemax (hash encrypted names that are longer than this)
 	longnamemax uint8
+	// -max_size (plaintext quota in bytes)
+	max_size uint64
+	// -max_file_size (plaintext size limit per file in bytes)
+	max_file_size uint64
+	// -cachesize (size limit of -cachedir in bytes)
+	cachesize int64
+	// -memory_max (bytes) and -cpu_max (percent of one CPU) cap the
+	// resource usage of the daemon
+	memory_max, cpu_max uint64
+	// -threads (requests processed at the same time), -max_background
+	// (asynchronous requests the kernel queues) and -write_threads
+	// (goroutines encrypting one write). 0 means auto-detect. -max_queue
+	// (requests that may wait for a -threads slot, 0 means no limit).
+	threads, max_background, write_threads, max_queue int
+	// -image_size (size of the image file -init creates in bytes)
+	image_size uint64
+	// -size (size limit of the -container file in bytes)
+	size uint64
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
@@ -56,6 +119,44 @@ type argContainer struct {
 	_forceOwner *fuse.Owner
 	// _explicitScryptn is true then the user passed "-scryptn=xyz"
 	_explicitScryptn bool
+	// _explicitScryptr and _explicitScryptp are true when the user passed
+	// "-scryptr=xyz" and "-scryptp=xyz"
+	_explicitScryptr, _explicitScryptp bool
+	// _explicitArgon2idMemory and _explicitArgon2idTime are true when the
+	// user passed "-argon2id-memory" and "-argon2id-time"
+	_explicitArgon2idMemory, _explicitArgon2idTime bool
+	// _mountDefaults is true when the user passed "-mount-defaults", which
+	// may be empty to remove the saved options
+	_mountDefaults bool
+	// _sandboxUid and _sandboxGid belong to the "-sandbox-user"
+	_sandboxUid, _sandboxGid int
+	// _auditLog is set up by initFuseFrontend() for "-auditlog" and "-fsck"
+	_auditLog *auditlog.Log
+	// _manifestKey is derived by initFuseFrontend() for "-manifest" and "-fsck"
+	_manifestKey []byte
+	// _policy is, if non-nil, the parsed "-policy" file
+	_policy *policy.Policy
+	// _createdMountpoint is true if we have created the mountpoint because
+	// of "-create-mountpoint"
+	_createdMountpoint bool
+	// _flatImage is true if the -flat filesystem is stored in
+	// CIPHERDIR/gocryptfs.image
+	_flatImage bool
+	// _imageMaxSize is the size limit of a -container image, from the
+	// config file
+	_imageMaxSize uint64
+	// _password is, if non-nil, used instead of asking for the password.
+	// Set by "-downgrade" for mounting the new filesystem.
+	_password []byte
+	// _faults is, if non-nil, the parsed "-fault_inject" specification
+	_faults *faultinject.Injector
+	// _mountConf and _mountDefaultsKey are set by initFuseFrontend() when
+	// the config file has been unlocked, so that the mount defaults can be
+	// read again on reload
+	_mountConf        *configfile.ConfFile
+	_mountDefaultsKey []byte
+	// _reloader handles SIGHUP and ctlsock Reload requests. Set by doMount().
+	_reloader *reloader
 }
 
 var flagSet *flag.FlagSet
@@ -156,25 +257,46 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.BoolVar(&args.fusedebug, "fusedebug", false, "Enable fuse library debug output")
 	flagSet.BoolVar(&args.init, "init", false, "Initialize encrypted directory")
 	flagSet.BoolVar(&args.zerokey, "zerokey", false, "Use all-zero dummy master key")
+	flagSet.BoolVar(&args.rescue, "rescue", false, "Salvage data from a damaged CIPHERDIR: mount read-only "+
+		"with -masterkey, ignore a damaged config file and skip what cannot be read")
+	flagSet.BoolVar(&args.wizard, "wizard", false, "With -init: ask a few questions and pick the options accordingly")
 	// Tri-state true/false/auto
 	flagSet.StringVar(&opensslAuto, "openssl", "auto", "Use OpenSSL instead of built-in Go crypto")
 	flagSet.BoolVar(&args.passwd, "passwd", false, "Change password")
+	flagSet.BoolVar(&args.make_readonly, "make-readonly", false, "Make the filesystem read-only for good")
+	flagSet.BoolVar(&args.migrate_config, "migrate-config", false, "Upgrade the config file to the current "+
+		"schema, keeping a backup")
+	flagSet.BoolVar(&args.new_key_epoch, "new-key-epoch", false, "Encrypt new files with a new key, keep the old keys for the existing files")
+	flagSet.BoolVar(&args.tpm2_enroll, "tpm2-enroll", false, "Seal a key to the TPM of this machine that unlocks "+
+		"the filesystem without the password")
+	flagSet.BoolVar(&args.tpm2_remove, "tpm2-remove", false, "Remove the key slot of -tpm2-enroll")
+	flagSet.BoolVar(&args.pkcs11, "pkcs11", false, "Unlock the masterkey with the PKCS#11 token of -pkcs11-enroll "+
+		"and its PIN instead of the password")
+	flagSet.BoolVar(&args.pkcs11_remove, "pkcs11-remove", false, "Remove the key slot of -pkcs11-enroll")
+	flagSet.BoolVar(&args.rekey, "rekey", false, "Replace the master key and re-encrypt all files with the new one")
 	flagSet.BoolVar(&args.fg, "f", false, "")
 	flagSet.BoolVar(&args.fg, "fg", false, "Stay in the foreground")
 	flagSet.BoolVar(&args.version, "version", false, "Print version and exit")
+	flagSet.BoolVar(&args.nodefaults, "nodefaults", false, "Ignore the defaults file and the GOCRYPTFS_* environment variables")
+	flagSet.BoolVar(&args.json, "json", false, "With -version, -health, -changes or -fsck: print the result as JSON")
 	flagSet.BoolVar(&args.plaintextnames, "plaintextnames", false, "Do not encrypt file names")
 	flagSet.BoolVar(&args.quiet, "q", false, "")
 	flagSet.BoolVar(&args.quiet, "quiet", false, "Quiet - silence informational messages")
 	flagSet.BoolVar(&args.nosyslog, "nosyslog", false, "Do not redirect output to syslog when running in the background")
 	flagSet.BoolVar(&args.wpanic, "wpanic", false, "When encountering a warning, panic and exit immediately")
 	flagSet.BoolVar(&args.longnames, "longnames", true, "Store names longer than 175 bytes in extra files")
+	flagSet.BoolVar(&args.userns, "userns", false, "Mount inside a new unprivileged user namespace")
+	flagSet.BoolVar(&args.seccomp, "seccomp", false, "Restrict the syscalls the process can use after mounting")
 	flagSet.BoolVar(&args.allow_other, "allow_other", false, "Allow other users to access the filesystem. "+
 		"Only works if user_allow_other is set in /etc/fuse.conf.")
 	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode")
 	flagSet.BoolVar(&args.aessiv, "aessiv", false, "AES-SIV encryption")
 	flagSet.BoolVar(&args.nonempty, "nonempty", false, "Allow mounting over non-empty directories")
+	flagSet.BoolVar(&args.force, "force", false, "Skip the mountpoint sanity checks and the CIPHERDIR lock")
 	flagSet.BoolVar(&args.raw64, "raw64", true, "Use unpadded base64 for file names")
-	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing")
+	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing. Same as -prealloc=none.")
+	flagSet.StringVar(&args.prealloc, "prealloc", fusefrontend.PreallocAuto,
+		"Preallocation before writing: auto, full, header or none")
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
 	flagSet.BoolVar(&args.hkdf, "hkdf", true, "Use HKDF as an additional key derivation step")
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
@@ -182,9 +304,43 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.BoolVar(&args.repair, "repair", false, "With -fsck: quarantine corrupt files, fix dirivs, delete broken hard links and orphaned .name files")
 	flagSet.BoolVar(&args.one_file_system, "one-file-system", false, "Don't cross filesystem boundaries")
 	flagSet.BoolVar(&args.deterministic_names, "deterministic-names", false, "Disable diriv file name randomisation")
+	flagSet.BoolVar(&args.unmount, "unmount", false, "Sync and unmount MOUNTPOINT")
+	flagSet.BoolVar(&args.when_idle, "when-idle", false, "With -unmount: wait until no file is open instead of unmounting lazily")
+	flagSet.BoolVar(&args.health, "health", false, "Check that MOUNTPOINT works, for monitoring")
+	flagSet.BoolVar(&args.warmup, "warmup", false, "Walk MOUNTPOINT [PATH] to fill the caches")
+	flagSet.BoolVar(&args.top, "top", false, "Show live statistics of MOUNTPOINT")
+	flagSet.BoolVar(&args.changes, "changes", false, "List the encrypted paths changed through MOUNTPOINT, for incremental backups")
+	flagSet.StringVar(&args.since, "since", "", "With -changes: only list the changes after this sequence number or time")
+	flagSet.BoolVar(&args.list, "list", false, "List mounted gocryptfs filesystems")
+	flagSet.BoolVar(&args.create_mountpoint, "create-mountpoint", false, "Create MOUNTPOINT if it does not exist, and remove it after unmount")
 	flagSet.BoolVar(&args.xchacha, "xchacha", false, "Use XChaCha20-Poly1305 file content encryption")
+	flagSet.BoolVar(&args.aegis, "aegis", false, "Use AEGIS-256 file content encryption")
+	flagSet.BoolVar(&args.aes128, "aes128", false, "Use AES-128-GCM file content encryption")
+	flagSet.BoolVar(&args.hctr2, "hctr2", false, "Use HCTR2 instead of EME for filename encryption")
+	flagSet.BoolVar(&args.encfs, "encfs", false, "CIPHERDIR is an EncFS volume. Mount it read-only")
+	flagSet.BoolVar(&args.merkle, "merkle", false, "Keep a hash tree for every file to detect truncation")
+	flagSet.BoolVar(&args.bindpath, "bindpath", false, "Bind file contents to the directory they are stored in")
+	flagSet.BoolVar(&args.flat, "flat", false, "Store file contents in a flat blob directory and the directory tree in an encrypted index")
+	flagSet.StringVar(&args.image, "image", "", "With -flat: store the filesystem in this block device or file instead of in CIPHERDIR")
+	flagSet.Uint64Var(&args.image_size, "image_size", 0, "With -flat: store the filesystem in a new image file of this many bytes in CIPHERDIR")
+	flagSet.StringVar(&args.container, "container", "", "Store the filesystem in this container file, which grows up to -size bytes. Implies -flat")
+	flagSet.Uint64Var(&args.size, "size", 0, "With -container: size limit of the container file in bytes")
+	flagSet.BoolVar(&args.compact, "compact", false, "Move the data in the -container file to its start and shrink it")
+	flagSet.BoolVar(&args.worm, "worm", false, "Write once, read many: files cannot be modified or deleted after they are closed")
+	flagSet.BoolVar(&args.immutable, "immutable", false, "Allow marking files immutable through the user.gocryptfs.immutable xattr")
+	flagSet.BoolVar(&args.append_only, "append_only", false, "Allow appending to files, but not overwriting, truncating or deleting them")
+	flagSet.BoolVar(&args.journal, "journal", false, "Journal overwrites so that they can be rolled back after a crash")
+	flagSet.BoolVar(&args.auditlog, "auditlog", false, "Log unlink, rmdir, rename and truncate to a tamper-evident log in CIPHERDIR")
+	flagSet.BoolVar(&args.manifest, "manifest", false, "Record all files in CIPHERDIR in an authenticated manifest to detect deletions and rollbacks")
+	flagSet.BoolVar(&args.notify, "notify", false, "Forward changes made directly in CIPHERDIR or through other mounts to inotify watchers")
+	flagSet.BoolVar(&args.sync, "sync", false, "Write all file contents synchronously (O_SYNC)")
+	flagSet.BoolVar(&args.fsync_on_close, "fsync_on_close", false, "Sync files to disk when they are closed")
+	flagSet.BoolVar(&args.noatime, "noatime", false, "Do not update the access time of backing files on reads")
+	flagSet.BoolVar(&args.relatime, "relatime", false, "Update the access time of backing files only once per day or after changes")
+	flagSet.BoolVar(&args.reencrypt, "reencrypt", false, "Re-encrypt the files of older key epochs with the newest key while the filesystem is idle")
 
 	// Mount options with opposites
 	flagSet.BoolVar(&args.dev, "dev", false, "Allow device files")
@@ -197,6 +353,11 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.BoolVar(&args.ro, "ro", false, "Mount the filesystem read-only")
 	flagSet.BoolVar(&args.kernel_cache, "kernel_cache", false, "Enable the FUSE kernel_cache option")
 	flagSet.BoolVar(&args.acl, "acl", false, "Enforce ACLs")
+	flagSet.BoolVar(&args.root_squash, "root_squash", false, "Handle accesses by root as coming from nobody")
+	flagSet.StringVar(&args.context, "context", "", "SELinux context for all files in the filesystem")
+	flagSet.StringVar(&args.fscontext, "fscontext", "", "SELinux context for the filesystem itself")
+	flagSet.StringVar(&args.defcontext, "defcontext", "", "SELinux context for unlabeled files")
+	flagSet.StringVar(&args.rootcontext, "rootcontext", "", "SELinux context for the root directory")
 
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "Mount with explicit master key")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
@@ -207,31 +368,99 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
+	flagSet.StringVar(&args.label, "label", "", "With -init: store a short name for the filesystem in the config file")
+	flagSet.StringVar(&args.description, "description", "", "With -init: store a description of the filesystem in the config file")
+	flagSet.StringVar(&args.mount_defaults, "mount-defaults", "", "Save these comma-separated mount options in the config file "+
+		"and apply them to every mount")
+	addReloadFlags(flagSet, &args.reloadOpts)
 	flagSet.StringVar(&args.fido2, "fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
+	flagSet.StringVar(&args.export_fscrypt, "export-fscrypt", "", "Copy the plaintext of CIPHERDIR into this new directory encrypted with kernel fscrypt")
+	flagSet.StringVar(&args.verify, "verify", "", "Check that CIPHERDIR decrypts exactly to this plaintext directory")
+	flagSet.StringVar(&args.downgrade, "downgrade", "", "Copy CIPHERDIR into this new directory as a filesystem "+
+		"that older gocryptfs versions can mount")
+	flagSet.StringVar(&args.add_subvolume, "add-subvolume", "", "Give this directory of CIPHERDIR its own key, "+
+		"unlocked with its own password")
+	flagSet.StringVar(&args.lock_subvolume, "lock-subvolume", "", "Lock this subvolume of a mounted filesystem")
+	flagSet.StringVar(&args.unlock_subvolume, "unlock-subvolume", "", "Unlock this subvolume of a mounted filesystem")
+	flagSet.StringVar(&args.fscrypt_key, "fscrypt-key", "", "fscrypt master key file for -export-fscrypt, created if it does not exist")
+	flagSet.StringVar(&args.tpm2_pcrs, "tpm2-pcrs", "", "With -tpm2-enroll: bind the sealed key to these "+
+		"comma-separated PCRs, like \"0,7\"")
+	flagSet.StringVar(&args.pkcs11_enroll, "pkcs11-enroll", "", "Protect the masterkey additionally with an RSA key "+
+		"on a PKCS#11 token, using this PKCS#11 module")
+	flagSet.StringVar(&args.pkcs11_id, "pkcs11-id", "", "With -pkcs11-enroll: the hex ID of the RSA key on the token")
+	flagSet.StringVar(&args.pqkey, "pqkey", "", "Additionally protect the masterkey using a hybrid X25519+ML-KEM-768 key file")
+	flagSet.StringVar(&args.policy, "policy", "", "Read per-directory rules (plaintext, readonly, exclude) from file")
+	flagSet.StringVar(&args.replica, "replica", "", "Repair corrupt blocks from this copy of CIPHERDIR")
+	flagSet.StringVar(&args.cachedir, "cachedir", "", "Cache recently used blocks in this directory")
+	flagSet.Int64Var(&args.cachesize, "cachesize", 1<<30, "Size limit of -cachedir in bytes")
+	flagSet.IntVar(&args.threads, "threads", 0, "Maximum number of requests processed at the same time (0 = auto)")
+	flagSet.IntVar(&args.max_background, "max_background", 0,
+		"Maximum number of asynchronous requests the kernel queues (0 = auto)")
+	flagSet.IntVar(&args.write_threads, "write_threads", 0, "Number of goroutines encrypting one write (0 = auto)")
+	flagSet.IntVar(&args.max_queue, "max_queue", 0,
+		"Fail requests with EBUSY when this many are waiting for a -threads slot (0 = no limit)")
+	flagSet.StringVar(&args.sandbox_user, "sandbox-user", "", "Chroot into CIPHERDIR and switch to this user after mounting")
+	flagSet.StringVar(&args.manifest_anchor, "manifest_anchor", "", "Store the generation of the latest -manifest in this file outside CIPHERDIR")
 
 	// Exclusion options
-	flagSet.StringArrayVar(&args.exclude, "e", nil, "Alias for -exclude")
-	flagSet.StringArrayVar(&args.exclude, "exclude", nil, "Exclude relative path from reverse view")
-	flagSet.StringArrayVar(&args.excludeWildcard, "ew", nil, "Alias for -exclude-wildcard")
-	flagSet.StringArrayVar(&args.excludeWildcard, "exclude-wildcard", nil, "Exclude path from reverse view, supporting wildcards")
-	flagSet.StringArrayVar(&args.excludeFrom, "exclude-from", nil, "File from which to read exclusion patterns (with -exclude-wildcard syntax)")
 
 	// multipleStrings options ([]string)
 	flagSet.StringArrayVar(&args.extpass, "extpass", nil, "Use external program for the password prompt")
 	flagSet.StringArrayVar(&args.badname, "badname", nil, "Glob pattern invalid file names that should be shown")
 	flagSet.StringArrayVar(&args.passfile, "passfile", nil, "Read password from file")
+	flagSet.StringArrayVar(&args.union, "union", nil, "Merge additional CIPHERDIR into the mount")
+	flagSet.StringArrayVar(&args.unlock, "unlock", nil, "Unlock the subvolume at this path")
+	flagSet.StringVar(&args.union_create, "union-create", fusefrontend.UnionCreateFirst,
+		"Where -union puts new files: \"first\" or \"mfs\" (most free space)")
 
 	flagSet.Uint8Var(&args.longnamemax, "longnamemax", 255, "Hash encrypted names that are longer than this")
+	flagSet.StringVar(&args.longnamehash, "longnamehash", nametransform.LongNameHashSHA256,
+		"Hash function for long encrypted names: sha256 or blake3")
+	flagSet.Uint64Var(&args.max_size, "max_size", 0, "Limit the total plaintext size to this many bytes")
+	flagSet.Uint64Var(&args.max_file_size, "max_file_size", 0, "Limit the plaintext size of each file to this many bytes")
+	flagSet.StringVar(&args.cgroup, "cgroup", "", "Move the daemon into this cgroup v2 directory, "+
+		"which enforces -memory_max and -cpu_max")
+	flagSet.Uint64Var(&args.memory_max, "memory_max", 0, "Limit the memory usage of the daemon to this many bytes")
+	flagSet.Uint64Var(&args.cpu_max, "cpu_max", 0, "Limit the CPU usage of the daemon to this many percent of one CPU")
+	flagSet.Uint64Var(&args.reencrypt_rate, "reencrypt-rate", 10000000, "Limit -reencrypt to this many bytes per second. "+
+		"0 means unlimited.")
 
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
 	const scryptn = "scryptn"
 	flagSet.IntVar(&args.scryptn, scryptn, configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
+	flagSet.IntVar(&args.scryptr, "scryptr", 8, "scrypt block size parameter r. Possible values: 8-32. "+
+		"Multiplies the memory and time scrypt needs.")
+	flagSet.IntVar(&args.scryptp, "scryptp", 1, "scrypt parallelization parameter. The lanes are computed "+
+		"in parallel on multiple cores, each needing the full scrypt memory")
+	flagSet.BoolVar(&args.argon2id, "argon2id", false, "Use Argon2id instead of scrypt to derive the key "+
+		"that locks the master key. Filesystems created with it cannot be opened by older gocryptfs versions.")
+	flagSet.UintVar(&args.argon2id_memory, "argon2id-memory", configfile.Argon2idDefaultMemory/1024,
+		"Argon2id memory cost in MiB")
+	flagSet.UintVar(&args.argon2id_time, "argon2id-time", configfile.Argon2idDefaultTime,
+		"Argon2id time cost (passes over the memory)")
+	flagSet.DurationVar(&args.kdfcache, "kdfcache", 0, "Keep the key derived from the password in the kernel keyring "+
+		"for this duration, so that unlocking again skips scrypt")
+	flagSet.IntVar(&args.require_entropy, "require-entropy", 0, "Reject new passwords (-init, -passwd) "+
+		"with an estimated entropy below this many bits")
+	flagSet.StringVar(&args.progress, "progress", progress.ModeAuto, "Progress reports of long operations: "+
+		"\"auto\" (status line on a terminal), \"json\" or \"none\"")
+	flagSet.IntVar(&args.progress_fd, "progress-fd", 2, "Write \"-progress json\" to this file descriptor")
 
-	flagSet.DurationVar(&args.idle, "i", 0, "Alias for -idle")
-	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
-		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
+	flagSet.DurationVar(&args.io_timeout, "io_timeout", 0, "Fail backing storage accesses with EIO after this duration. "+
+		"0 means wait indefinitely.")
+	flagSet.IntVar(&args.retry_count, "retry_count", 0, "Retry writes and fsyncs that fail with EIO this many times")
+	flagSet.DurationVar(&args.retry_interval, "retry_interval", 100*time.Millisecond,
+		"Wait before the first retry, doubles for each further retry")
+	flagSet.StringVar(&args.fault_inject, "fault_inject", "", "Inject faults into backing storage accesses, "+
+		"for testing. Example: \"eio_write=10,short_read=5\"")
+	flagSet.DurationVar(&args.fsync_interval, "fsync_interval", 0, "Sync CIPHERDIR to disk after this duration. "+
+		"0 means leave it to the kernel.")
+	flagSet.DurationVar(&args.reencrypt_idle, "reencrypt-idle", time.Minute, "-reencrypt works after the filesystem "+
+		"has been idle for this duration")
+	flagSet.DurationVar(&args.worm_retention, "worm-retention", 0, "-worm files can be deleted after this duration. "+
+		"0 means never.")
 
 	var dummyString string
 	flagSet.StringVar(&dummyString, "o", "", "For compatibility with mount(1), options can be also passed as a comma-separated list to -o on the end.")
@@ -258,6 +487,11 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	if isFlagPassed(flagSet, scryptn) {
 		args._explicitScryptn = true
 	}
+	args._explicitScryptr = isFlagPassed(flagSet, "scryptr")
+	args._explicitScryptp = isFlagPassed(flagSet, "scryptp")
+	args._explicitArgon2idMemory = isFlagPassed(flagSet, "argon2id-memory")
+	args._explicitArgon2idTime = isFlagPassed(flagSet, "argon2id-time")
+	args._mountDefaults = isFlagPassed(flagSet, "mount-defaults")
 	// "-openssl" needs some post-processing
 	if opensslAuto == "auto" {
 		if args.xchacha {
@@ -292,6 +526,26 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 		tlog.Fatal.Printf("Idle timeout cannot be less than 0")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.io_timeout < 0 {
+		tlog.Fatal.Printf("-io_timeout cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.retry_count < 0 || args.retry_interval < 0 {
+		tlog.Fatal.Printf("-retry_count and -retry_interval cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fsync_interval < 0 {
+		tlog.Fatal.Printf("-fsync_interval cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reencrypt_idle < 0 {
+		tlog.Fatal.Printf("-reencrypt-idle cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.worm_retention < 0 {
+		tlog.Fatal.Printf("-worm-retention cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
 	// Make sure all badname patterns are valid
 	for _, pattern := range args.badname {
 		_, err := filepath.Match(pattern, "")
@@ -300,14 +554,67 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	if args.union_create != fusefrontend.UnionCreateFirst && args.union_create != fusefrontend.UnionCreateMfs {
+		tlog.Fatal.Printf("-union-create: invalid value %q, must be %q or %q",
+			args.union_create, fusefrontend.UnionCreateFirst, fusefrontend.UnionCreateMfs)
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.prealloc {
+	case fusefrontend.PreallocAuto, fusefrontend.PreallocFull, fusefrontend.PreallocHeader, fusefrontend.PreallocNone:
+	default:
+		tlog.Fatal.Printf("-prealloc: invalid value %q, must be %q, %q, %q or %q", args.prealloc,
+			fusefrontend.PreallocAuto, fusefrontend.PreallocFull, fusefrontend.PreallocHeader, fusefrontend.PreallocNone)
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.progress {
+	case progress.ModeAuto, progress.ModeJSON, progress.ModeNone:
+	default:
+		tlog.Fatal.Printf("-progress: invalid value %q, must be %q, %q or %q", args.progress,
+			progress.ModeAuto, progress.ModeJSON, progress.ModeNone)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.progress == progress.ModeJSON {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(args.progress_fd, &st); err != nil {
+			tlog.Fatal.Printf("-progress-fd %d: %v", args.progress_fd, err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-noprealloc" is the old name of "-prealloc=none"
+	if args.noprealloc {
+		args.prealloc = fusefrontend.PreallocNone
+	}
 	if args.longnamemax > 0 && args.longnamemax < 62 {
 		tlog.Fatal.Printf("-longnamemax: value %d is outside allowed range 62 ... 255", args.longnamemax)
 		os.Exit(exitcodes.Usage)
 	}
+	if args.longnamehash != nametransform.LongNameHashSHA256 && args.longnamehash != nametransform.LongNameHashBLAKE3 {
+		tlog.Fatal.Printf("-longnamehash: invalid value %q, must be %q or %q",
+			args.longnamehash, nametransform.LongNameHashSHA256, nametransform.LongNameHashBLAKE3)
+		os.Exit(exitcodes.Usage)
+	}
 
 	return args
 }
 
+// addReloadFlags registers the options in reloadOpts on "flags", storing
+// them in "o". Used by parseCliOpts() and reloadFlagSet(), so that a reload
+// parses them with the same names and defaults as the mount.
+func addReloadFlags(flags *flag.FlagSet, o *reloadOpts) {
+	flags.StringVar(&o.loglevel, "loglevel", "", "Set log levels per module, like \"fusefrontend=debug,ctlsock=info\"")
+	flags.Int64Var(&o.cachemem, "cachemem", 64<<20, "Memory budget of the caches in bytes")
+	flags.DurationVar(&o.idle, "i", 0, "Alias for -idle")
+	flags.DurationVar(&o.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
+		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
+	flags.Uint64Var(&o.bwlimit, "bwlimit", 0, "Limit file reads and writes to this many bytes per second")
+	flags.Uint64Var(&o.ioplimit, "ioplimit", 0, "Limit file reads and writes to this many operations per second")
+	flags.StringArrayVar(&o.exclude, "e", nil, "Alias for -exclude")
+	flags.StringArrayVar(&o.exclude, "exclude", nil, "Exclude relative path from reverse view")
+	flags.StringArrayVar(&o.excludeWildcard, "ew", nil, "Alias for -exclude-wildcard")
+	flags.StringArrayVar(&o.excludeWildcard, "exclude-wildcard", nil, "Exclude path from reverse view, supporting wildcards")
+	flags.StringArrayVar(&o.excludeFrom, "exclude-from", nil, "File from which to read exclusion patterns (with -exclude-wildcard syntax)")
+}
+
 // prettyArgs pretty-prints the command-line arguments.
 func prettyArgs() string {
 	pa := fmt.Sprintf("%q", os.Args)
@@ -331,6 +638,49 @@ func countOpFlags(args *argContainer) int {
 	if args.fsck {
 		count++
 	}
+	if args.export_fscrypt != "" {
+		count++
+	}
+	if args.new_key_epoch {
+		count++
+	}
+	if args.make_readonly {
+		count++
+	}
+	if args.compact {
+		count++
+	}
+	if args.verify != "" {
+		count++
+	}
+	if args.migrate_config {
+		count++
+	}
+	if args.downgrade != "" {
+		count++
+	}
+	if args.add_subvolume != "" {
+		count++
+	}
+	if args.tpm2_enroll {
+		count++
+	}
+	if args.tpm2_remove {
+		count++
+	}
+	if args.pkcs11_enroll != "" {
+		count++
+	}
+	if args.pkcs11_remove {
+		count++
+	}
+	if args.rekey {
+		count++
+	}
+	// Together with "-init", "-mount-defaults" is an option of "-init"
+	if args._mountDefaults && !args.init {
+		count++
+	}
 	return count
 }
 
@@ -3,6 +3,7 @@ package main
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 )
@@ -116,12 +117,26 @@ func TestConvertToDoubleDash(t *testing.T) {
 
 func TestParseCliOpts(t *testing.T) {
 	defaultArgs := argContainer{
-		longnames:   true,
-		longnamemax: 255,
-		raw64:       true,
-		hkdf:        true,
-		openssl:     stupidgcm.PreferOpenSSLAES256GCM(), // depends on CPU and build flags
-		scryptn:     16,
+		longnames:       true,
+		longnamemax:     255,
+		longnamehash:    "sha256",
+		raw64:           true,
+		hkdf:            true,
+		openssl:         stupidgcm.PreferOpenSSLAES256GCM(), // depends on CPU and build flags
+		scryptn:         16,
+		scryptr:         8,
+		scryptp:         1,
+		argon2id_memory: 64,
+		argon2id_time:   3,
+		union_create:    "first",
+		prealloc:        "auto",
+		progress:        "auto",
+		progress_fd:     2,
+		retry_interval:  100 * time.Millisecond,
+		cachesize:       1 << 30,
+		reloadOpts:      reloadOpts{cachemem: 64 << 20},
+		reencrypt_idle:  time.Minute,
+		reencrypt_rate:  10000000,
 	}
 
 	type testcaseContainer struct {
@@ -171,6 +186,31 @@ func TestParseCliOpts(t *testing.T) {
 		},*/
 	}...)
 
+	o = defaultArgs
+	o.context = "system_u:object_r:httpd_sys_content_t:s0"
+	testcases = append(testcases, []testcaseContainer{
+		{
+			i: []string{"gocryptfs", "-context", "system_u:object_r:httpd_sys_content_t:s0"},
+			o: o,
+		}, {
+			i: []string{"gocryptfs", "-o", "context=system_u:object_r:httpd_sys_content_t:s0"},
+			o: o,
+		},
+	}...)
+
+	o = defaultArgs
+	o.noprealloc = true
+	o.prealloc = "none"
+	testcases = append(testcases, []testcaseContainer{
+		{
+			i: []string{"gocryptfs", "-noprealloc"},
+			o: o,
+		}, {
+			i: []string{"gocryptfs", "-prealloc=full", "-noprealloc"},
+			o: o,
+		},
+	}...)
+
 	for _, tc := range testcases {
 		o := parseCliOpts(tc.i)
 		if !reflect.DeepEqual(o, tc.o) {
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// completionFlag is a command line option as the completion scripts see it
+type completionFlag struct {
+	name  string
+	usage string
+	// hasValue is true if the option takes an argument
+	hasValue bool
+	// repeatable is true if the option can be given several times
+	repeatable bool
+}
+
+// completionFlags returns all command line options, sorted by name
+func completionFlags() (flags []completionFlag) {
+	parseCliOpts([]string{os.Args[0]})
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if f.Hidden {
+			return
+		}
+		usage := f.Usage
+		if usage == "" {
+			// Short aliases like "-d" have no usage text of their own
+			usage = aliasUsage(f)
+		}
+		flags = append(flags, completionFlag{
+			name:       f.Name,
+			usage:      strings.Join(strings.Fields(usage), " "),
+			hasValue:   f.Value.Type() != "bool",
+			repeatable: strings.HasSuffix(f.Value.Type(), "Array"),
+		})
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].name < flags[j].name })
+	return flags
+}
+
+// aliasUsage returns the usage text of the option that "alias" is a short
+// form of
+func aliasUsage(alias *flag.Flag) (usage string) {
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if f != alias && f.Value == alias.Value && f.Usage != "" {
+			usage = f.Usage
+		}
+	})
+	return usage
+}
+
+// completion handles "gocryptfs completion SHELL" and returns the exit code.
+// "gocryptfs completion mountpoints" lists the gocryptfs mounts for the
+// completion of "-unmount".
+func completion(osArgs []string) int {
+	if len(osArgs) != 1 {
+		tlog.Fatal.Printf("Usage: %s completion bash|zsh|fish", tlog.ProgramName)
+		return exitcodes.Usage
+	}
+	switch osArgs[0] {
+	case "bash":
+		fmt.Print(completionBash(completionFlags()))
+	case "zsh":
+		fmt.Print(completionZsh(completionFlags()))
+	case "fish":
+		fmt.Print(completionFish(completionFlags()))
+	case "mountpoints":
+		mounts, err := gocryptfsMounts()
+		if err != nil {
+			tlog.Fatal.Println(err)
+			return exitcodes.Usage
+		}
+		for _, m := range mounts {
+			fmt.Println(m.mountpoint)
+		}
+	default:
+		tlog.Fatal.Printf("Unknown shell %q, supported are bash, zsh and fish", osArgs[0])
+		return exitcodes.Usage
+	}
+	return 0
+}
+
+func completionBash(flags []completionFlag) string {
+	var all, withValue []string
+	for _, f := range flags {
+		all = append(all, "-"+f.name)
+		if f.hasValue {
+			withValue = append(withValue, "-"+f.name, "--"+f.name)
+		}
+	}
+	return `# bash completion for gocryptfs, generated by "gocryptfs completion bash"
+_gocryptfs() {
+	local cur prev w
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+	if [[ $COMP_CWORD -eq 2 && $prev == completion ]]; then
+		COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+		return
+	fi
+	case "$prev" in
+	` + strings.Join(withValue, "|") + `)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return;;
+	esac
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "` + strings.Join(all, " ") + `" -- "$cur"))
+		return
+	fi
+	for w in "${COMP_WORDS[@]}"; do
+		if [[ $w == -unmount || $w == --unmount ]]; then
+			local IFS=$'\n'
+			COMPREPLY=($(compgen -W "$(gocryptfs completion mountpoints 2>/dev/null)" -- "$cur"))
+			return
+		fi
+	done
+	COMPREPLY=($(compgen -d -- "$cur"))
+}
+complete -o filenames -F _gocryptfs gocryptfs
+`
+}
+
+func completionZsh(flags []completionFlag) string {
+	// Characters with a special meaning in _arguments specs
+	esc := strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+	var specs []string
+	for _, f := range flags {
+		spec := "-" + f.name + "[" + esc.Replace(f.usage) + "]"
+		if f.repeatable {
+			spec = "*" + spec
+		}
+		if f.hasValue {
+			spec += ":" + f.name + ":_files"
+		}
+		specs = append(specs, "\t\t'"+spec+"'")
+	}
+	return `#compdef gocryptfs
+# zsh completion for gocryptfs, generated by "gocryptfs completion zsh"
+_gocryptfs() {
+	if (( CURRENT == 3 )) && [[ $words[2] == completion ]]; then
+		compadd bash zsh fish
+		return
+	fi
+	if (( ${words[(I)-unmount]} )); then
+		compadd -f -- ${(f)"$(gocryptfs completion mountpoints 2>/dev/null)"}
+		return
+	fi
+	_arguments \
+` + strings.Join(specs, " \\\n") + ` \
+		'*:directory:_files -/'
+}
+if [[ $funcstack[1] == _gocryptfs ]]; then
+	_gocryptfs "$@"
+else
+	compdef _gocryptfs gocryptfs
+fi
+`
+}
+
+func completionFish(flags []completionFlag) string {
+	esc := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	var b strings.Builder
+	b.WriteString(`# fish completion for gocryptfs, generated by "gocryptfs completion fish"
+function __gocryptfs_unmounting
+	contains -- -unmount (commandline -opc)
+end
+complete -c gocryptfs -n '__fish_seen_subcommand_from completion' -f -a 'bash zsh fish'
+complete -c gocryptfs -n __gocryptfs_unmounting -f -a '(gocryptfs completion mountpoints 2>/dev/null)'
+`)
+	for _, f := range flags {
+		b.WriteString("complete -c gocryptfs -o " + f.name)
+		if f.hasValue {
+			b.WriteString(" -r")
+		}
+		b.WriteString(" -d '" + esc.Replace(f.usage) + "'\n")
+	}
+	return b.String()
+}
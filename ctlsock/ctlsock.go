@@ -45,14 +45,13 @@ func (c *CtlSock) Query(req *RequestStruct) (*ResponseStruct, error) {
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, 5000)
-	n, err := c.Conn.Read(buf)
+	// Responses can be bigger than one read, like the Stats response with
+	// long file names. The decoder reads until the JSON object is complete.
+	var resp ResponseStruct
+	err = json.NewDecoder(c.Conn).Decode(&resp)
 	if err != nil {
 		return nil, err
 	}
-	buf = buf[:n]
-	var resp ResponseStruct
-	json.Unmarshal(buf, &resp)
 	if resp.ErrNo != 0 {
 		return nil, &resp
 	}
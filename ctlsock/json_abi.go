@@ -7,6 +7,70 @@ type RequestStruct struct {
 	EncryptPath string
 	// DecryptPath is the path that should be decrypted.
 	DecryptPath string
+	// UnmountWhenIdle makes gocryptfs reject new opens and unmount once
+	// the last open file is closed. Cannot be combined with the other
+	// fields.
+	UnmountWhenIdle bool
+	// Info requests information about the mount, which is returned in
+	// ResponseStruct.Info. Cannot be combined with the other fields.
+	Info bool
+	// Sync makes gocryptfs write all data to disk. Cannot be combined with
+	// the other fields.
+	Sync bool
+	// LogLevels sets the log level of the modules given as keys, for example
+	// {"fusefrontend": "debug"}. The modules are "fusefrontend",
+	// "nametransform", "contentenc" and "ctlsock", the levels "default",
+	// "debug", "info" and "warn". An empty object only queries the levels.
+	// The resulting levels of all modules are returned in
+	// ResponseStruct.LogLevels. Cannot be combined with the other fields.
+	LogLevels map[string]string
+	// Stats requests the statistics of the mount, which are returned in
+	// ResponseStruct.Stats. Cannot be combined with the other fields.
+	Stats bool
+	// Changes requests the ciphertext paths that have been changed through
+	// the mount after ChangesSinceSeq, or, if ChangesSinceSeq is 0, after
+	// the Unix time ChangesSinceTime. They are returned in
+	// ResponseStruct.Changes. Cannot be combined with the other fields.
+	Changes          bool
+	ChangesSinceSeq  uint64
+	ChangesSinceTime int64
+	// LockSubvolume wipes the key of the subvolume at this plaintext path
+	// ("-add-subvolume"), so that its contents cannot be accessed anymore.
+	// Fails with EBUSY while files in the subvolume are open.
+	// UnlockSubvolume unlocks the subvolume at this path with Password.
+	// Cannot be combined with the other fields.
+	LockSubvolume   string
+	UnlockSubvolume string
+	Password        string
+	// Reload makes gocryptfs read the defaults file and the mount defaults
+	// in the config file again, and apply the settings that can change
+	// while mounted. The changed options are returned in
+	// ResponseStruct.Result, comma-separated, and changes that need a
+	// remount in ResponseStruct.WarnText. Same as sending SIGHUP. Cannot be
+	// combined with the other fields.
+	Reload bool
+	// Resources requests the resource usage and limits of the gocryptfs
+	// process ("-cgroup", "-memory-max", "-cpu-max"), which are returned in
+	// ResponseStruct.Resources. Cannot be combined with the other fields.
+	Resources bool
+	// ChangePassword changes the password in the config file of the mounted
+	// filesystem from Password to NewPassword, like "-passwd" does. The KDF
+	// cost stays the same. Warnings about the new password are returned in
+	// ResponseStruct.WarnText. Cannot be combined with the other fields.
+	ChangePassword bool
+	NewPassword    string
+	// Lock makes all access to the filesystem fail with EACCES and wipes
+	// the keys of the content and file name encryption, and those of the
+	// unlocked subvolumes, from memory. Fails with EBUSY while files are
+	// open. Unlock unlocks the filesystem with Password; the subvolumes stay
+	// locked. Cannot be combined with the other fields.
+	Lock   bool
+	Unlock bool
+	// SetReadOnly makes all writes fail with EROFS, SetReadWrite allows
+	// them again. Files that are open for writing stay open, but cannot be
+	// written to. Cannot be combined with the other fields.
+	SetReadOnly  bool
+	SetReadWrite bool
 }
 
 // ResponseStruct is sent by the server in response to a request
@@ -23,4 +87,169 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// Info is only set in response to RequestStruct.Info.
+	Info *InfoStruct `json:",omitempty"`
+	// LogLevels is only set in response to RequestStruct.LogLevels.
+	LogLevels map[string]string `json:",omitempty"`
+	// Stats is only set in response to RequestStruct.Stats.
+	Stats *StatsStruct `json:",omitempty"`
+	// Changes is only set in response to RequestStruct.Changes.
+	Changes *ChangesStruct `json:",omitempty"`
+	// Resources is only set in response to RequestStruct.Resources.
+	Resources *ResourcesStruct `json:",omitempty"`
+}
+
+// InfoStruct describes a mounted filesystem. It is sent by the server in
+// response to RequestStruct.Info.
+type InfoStruct struct {
+	// Pid is the process ID of the gocryptfs process that serves the mount.
+	Pid int
+	// Cipherdir is the absolute path of the backing directory.
+	Cipherdir string
+	// Mountpoint is the absolute path of the mountpoint.
+	Mountpoint string
+	// Reverse is true for "-reverse" mounts.
+	Reverse bool
+	// ReadOnly is true for "-ro" and "-reverse" mounts, and after a
+	// SetReadOnly request.
+	ReadOnly bool
+	// Locked is true after a Lock request, until the filesystem is
+	// unlocked again.
+	Locked bool
+	// Started is the mount time in Unix seconds.
+	Started int64
+	// LastAccess is the time of the last filesystem operation in Unix
+	// seconds. 0 means that it is not known.
+	LastAccess int64
+}
+
+// StatsStruct contains the statistics of a mount. It is sent by the server in
+// response to RequestStruct.Stats. The counters count from the start of the
+// mount; clients compute rates from the difference between two responses.
+type StatsStruct struct {
+	// OpenFiles is the number of files that are open right now.
+	OpenFiles uint64
+	// Ops counts the filesystem operations by type, like "read" or "lookup".
+	Ops map[string]uint64
+	// BytesRead and BytesWritten count the plaintext bytes.
+	BytesRead    uint64
+	BytesWritten uint64
+	// DirCacheHits and DirCacheMisses count the lookups in the cache of
+	// open directories.
+	DirCacheHits   uint64
+	DirCacheMisses uint64
+	// BlockCacheHits and BlockCacheMisses count the reads from the
+	// "-cachedir" block cache. Both are 0 without "-cachedir".
+	BlockCacheHits   uint64
+	BlockCacheMisses uint64
+	// CacheMemLimit is the "-cachemem" memory budget in bytes. CacheMem is
+	// the memory charged to it, by cache: "dircache" (directory fds and
+	// IVs), "longnames" (contents of the gocryptfs.longname.*.name files)
+	// and "blockcache" (bookkeeping of the "-cachedir" block cache).
+	CacheMemLimit uint64
+	CacheMem      map[string]StatsCacheMem
+	// RequestsRunning and RequestsWaiting count the FUSE requests being
+	// processed and the ones waiting for a free "-threads" slot.
+	// OldestRequestSeconds is the age of the oldest of them.
+	// RequestsRejected counts the requests that failed with EBUSY because
+	// "-max_queue" requests were waiting. All four are 0 without "-threads"
+	// and "-max_queue".
+	RequestsRunning      uint64
+	RequestsWaiting      uint64
+	OldestRequestSeconds float64
+	RequestsRejected     uint64
+	// RecentSeconds is the length of the recent period that Files and
+	// Processes cover.
+	RecentSeconds float64
+	// Files are the open files with the most bytes read and written in the
+	// recent period, busiest first.
+	Files []StatsFile
+	// Processes are the processes with the most bytes read and written in
+	// the recent period, busiest first.
+	Processes []StatsProcess
+}
+
+// ResourcesStruct contains the resource usage and the limits of the
+// gocryptfs process that serves a mount. It is sent by the server in
+// response to RequestStruct.Resources.
+type ResourcesStruct struct {
+	// Cgroup is the "-cgroup" directory the process has moved into, or
+	// empty.
+	Cgroup string
+	// MemoryMax is the "-memory-max" limit in bytes, 0 means unlimited.
+	// MemoryCurrent is the memory usage of the cgroup with "-cgroup",
+	// which includes the page cache and other processes in it, or else the
+	// memory that the Go runtime has obtained from the operating system.
+	MemoryMax     uint64
+	MemoryCurrent uint64
+	// GoHeapBytes is the memory of the live and not yet collected objects.
+	GoHeapBytes uint64
+	// MaxRSS is the largest resident set size so far in bytes.
+	MaxRSS uint64
+	// CPUMaxPercent is the "-cpu-max" limit in percent of one CPU, 0 means
+	// unlimited.
+	CPUMaxPercent uint64
+	// UserCPUSeconds and SystemCPUSeconds are the CPU time used by the
+	// process.
+	UserCPUSeconds   float64
+	SystemCPUSeconds float64
+	// CgroupCPUSeconds is the CPU time used by the cgroup, and
+	// CPUThrottledSeconds how long it has been held back by "-cpu-max".
+	// Both are 0 without "-cgroup".
+	CgroupCPUSeconds    float64
+	CPUThrottledSeconds float64
+	// Goroutines is the number of goroutines.
+	Goroutines int
+}
+
+// StatsCacheMem is an entry in StatsStruct.CacheMem.
+type StatsCacheMem struct {
+	// Bytes and Entries are the current memory use and number of entries.
+	Bytes   uint64
+	Entries uint64
+	// Evictions counts the entries evicted to stay within the budget.
+	Evictions uint64
+}
+
+// StatsFile is an entry in StatsStruct.Files.
+type StatsFile struct {
+	// Path is the plaintext path relative to the mountpoint.
+	Path         string
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// StatsProcess is an entry in StatsStruct.Processes.
+type StatsProcess struct {
+	// Pid is the process ID, not the ID of the thread that made the request.
+	Pid uint32
+	// Comm is the command name from /proc/PID/comm. Empty if the process
+	// has exited.
+	Comm         string
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// ChangesStruct lists the changed files of a mount. It is sent by the server
+// in response to RequestStruct.Changes.
+type ChangesStruct struct {
+	// Seq is the sequence number of the latest change. Pass it as
+	// RequestStruct.ChangesSinceSeq to get the changes after this response.
+	Seq uint64
+	// Complete is false if changes may be missing: the mount is younger than
+	// the requested point, or the oldest changes have been dropped. The
+	// client should scan the whole cipherdir in this case.
+	Complete bool
+	// Changes are the changed paths, oldest change first. Every path is
+	// listed once.
+	Changes []Change
+}
+
+// Change is an entry in ChangesStruct.Changes.
+type Change struct {
+	// Path is the ciphertext path relative to the cipherdir. A changed
+	// directory also stands for everything below it.
+	Path string
+	// Deleted is true if the path has been deleted or renamed away.
+	Deleted bool
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// downgradeFlags are the feature flags of the baseline format that
+// "-downgrade" writes: what "gocryptfs -init" has created since v1.3, and
+// "-plaintextnames"
+var downgradeFlags = map[string]bool{
+	"GCMIV128":       true,
+	"HKDF":           true,
+	"DirIV":          true,
+	"EMENames":       true,
+	"LongNames":      true,
+	"Raw64":          true,
+	"PlaintextNames": true,
+}
+
+// initDowngradeDir creates the baseline filesystem in "dir", with the
+// password "pw". It keeps "-plaintextnames", the label and the description
+// of "src".
+func initDowngradeDir(args *argContainer, dir string, src *configfile.ConfFile, pw []byte) error {
+	plaintextNames := src.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+	err := configfile.Create(&configfile.CreateArgs{
+		Filename:       filepath.Join(dir, configfile.ConfDefaultName),
+		Password:       pw,
+		PlaintextNames: plaintextNames,
+		LogN:           args.scryptn,
+		Creator:        tlog.ProgramName + " " + GitVersion + " -downgrade",
+		Label:          src.Label,
+		Description:    src.Description,
+	})
+	if err != nil || plaintextNames {
+		return err
+	}
+	dirfd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	return nametransform.WriteDirIVAt(dirfd)
+}
+
+// mountTemp mounts the filesystem described by "args" on a new temporary
+// directory for the operation "op". The returned function unmounts it and
+// wipes the keys.
+func mountTemp(args *argContainer, op string) (mnt string, cleanup func()) {
+	var err error
+	args.mountpoint, err = ioutil.TempDir("", "gocryptfs."+op+".")
+	if err != nil {
+		tlog.Fatal.Printf("%s: TmpDir: %v", op, err)
+		os.Exit(exitcodes.MountPoint)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	srv := initGoFuse(pfs, args)
+	return args.mountpoint, func() {
+		unmountTemp(srv, args.mountpoint)
+		wipeKeys()
+	}
+}
+
+func unmountTemp(srv *fuse.Server, mnt string) {
+	if err := srv.Unmount(); err != nil {
+		tlog.Warn.Printf("failed to unmount %q: %v", mnt, err)
+	} else if err := syscall.Rmdir(mnt); err != nil {
+		tlog.Warn.Printf("cleaning up %q failed: %v", mnt, err)
+	}
+}
+
+// downgrade handles "gocryptfs -downgrade DEST CIPHERDIR": it copies the
+// plaintext of CIPHERDIR into a new filesystem in DEST that only uses the
+// baseline format, so that older gocryptfs versions can mount it.
+// Returns the exit code.
+func downgrade(args *argContainer) (exitcode int) {
+	if args.reverse {
+		tlog.Fatal.Printf("Running -downgrade with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	dst := args.downgrade
+	realDst, realSrc := realPath(dst), realPath(args.cipherdir)
+	if isSubdir(realDst, realSrc) || isSubdir(realSrc, realDst) {
+		tlog.Fatal.Printf("downgrade: %q and CIPHERDIR %q must not contain each other", dst, args.cipherdir)
+		os.Exit(exitcodes.Usage)
+	}
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		err = os.Mkdir(dst, 0700)
+		if err != nil {
+			tlog.Fatal.Printf("downgrade: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+	} else if err = isEmptyDir(dst); err != nil {
+		tlog.Fatal.Printf("downgrade: %v", err)
+		os.Exit(exitcodes.Init)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	var dropped []string
+	for _, f := range cf.FeatureFlags {
+		if !downgradeFlags[f] {
+			dropped = append(dropped, f)
+		}
+	}
+	if len(dropped) > 0 {
+		tlog.Info.Printf("Dropping feature flags: %s", strings.Join(dropped, " "))
+	}
+	// The destination is mounted with the settings from its config file,
+	// not with those that were derived from the source config
+	dstArgs := *args
+	dstArgs.cipherdir = dst
+	dstArgs.config = filepath.Join(dst, configfile.ConfDefaultName)
+	dstArgs.allow_other = false
+	dstArgs.ro = false
+	dstArgs.pqkey = ""
+	dstArgs.fido2 = ""
+	// Mount the source read-only. Asks for its password.
+	args.allow_other = false
+	args.ro = true
+	srcMnt, srcCleanup := mountTemp(args, "downgrade")
+	defer srcCleanup()
+	// Create and mount the destination
+	if len(args.extpass) == 0 && len(args.passfile) == 0 {
+		tlog.Info.Printf("Choose a password for the downgraded filesystem.")
+	}
+	pw, err := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return exitcodes.ReadPassword
+	}
+	err = initDowngradeDir(args, dst, cf, pw)
+	if err != nil {
+		tlog.Fatal.Printf("downgrade: %v", err)
+		return exitcodes.Init
+	}
+	dstArgs._password = pw
+	dstMnt, dstCleanup := mountTemp(&dstArgs, "downgrade")
+	defer dstCleanup()
+	for i := range pw {
+		pw[i] = 0
+	}
+	ex := exportObj{
+		op:        "downgrade",
+		mnt:       srcMnt,
+		dst:       dstMnt,
+		hardlinks: make(map[uint64]string),
+		chown:     os.Geteuid() == 0,
+		progress:  startProgress(args, "downgrade"),
+	}
+	ex.progress.ScanTotal(ex.mnt, nil)
+	defer abortOnSignal(&ex.abort)()
+	ex.dir("")
+	ex.progress.Stop()
+	// Deepest directories first, like in exportFscrypt()
+	for i := len(ex.dirs) - 1; i >= 0; i-- {
+		d := ex.dirs[i]
+		if err := ex.setAttr(d.path, &d.st); err != nil {
+			ex.fail(d.path, err)
+		}
+	}
+	if ex.abort {
+		tlog.Info.Printf("downgrade: aborted")
+		return exitcodes.Other
+	}
+	if ex.failed > 0 {
+		tlog.Info.Printf("downgrade summary: %d files copied, %d failed", ex.copied, ex.failed)
+		return exitcodes.Downgrade
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"downgrade summary: %d files copied to %q"+tlog.ColorReset, ex.copied, dst)
+	return 0
+}
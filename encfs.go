@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/encfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_encfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// initEncfsFrontend is initFuseFrontend for "-encfs": it loads the EncFS
+// config file, asks for the password and returns the read-only frontend.
+// On error, it calls os.Exit and does not return.
+func initEncfsFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys func()) {
+	cf, err := encfs.LoadConfig(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot load EncFS config file: %v", err)
+		removeMountpoint(args)
+		exitcodes.Exit(exitcodes.NewErr("", exitcodes.EncFS))
+	}
+	tlog.Debug.Printf("EncFS config: %s", tlog.JSONDump(cf))
+	pw, err := readpassword.Once([]string(args.extpass), []string(args.passfile), "")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		removeMountpoint(args)
+		exitcodes.Exit(exitcodes.NewErr("", exitcodes.ReadPassword))
+	}
+	tlog.Info.Println("Decrypting EncFS volume key")
+	vol, err := cf.Unlock(pw)
+	for i := range pw {
+		pw[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		removeMountpoint(args)
+		exitcodes.Exit(err)
+	}
+	return fusefrontend_encfs.NewRootNode(args.cipherdir, vol), vol.Wipe
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fscrypt"
+	"github.com/rfjakob/gocryptfs/v2/internal/progress"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+type exportObj struct {
+	// op is the name of the operation for messages, like "export-fscrypt"
+	op string
+	// mnt is the mountpoint of the temporary mount
+	mnt string
+	// dst is the destination directory, fscrypt-encrypted for
+	// "-export-fscrypt"
+	dst string
+	// Destination paths of hard-linked files (Nlink > 1) by inode number
+	hardlinks map[uint64]string
+	// Directories whose mode and timestamps are set after their contents
+	// have been copied
+	dirs []exportDir
+	// Chown files to their original owner? Only possible as root.
+	chown bool
+	// Number of files copied, and of files that failed
+	copied, failed int
+	// abort the running export? Checked in a few long-running loops.
+	abort bool
+	// progress reports the files and bytes copied ("-progress")
+	progress *progress.Reporter
+}
+
+type exportDir struct {
+	path string
+	st   unix.Stat_t
+}
+
+func (ex *exportObj) fail(relPath string, err error) {
+	fmt.Printf("%s: %q: %v\n", ex.op, relPath, err)
+	ex.failed++
+}
+
+// Recursively copy the directory "relPath" to the destination
+func (ex *exportObj) dir(relPath string) {
+	f, err := os.Open(filepath.Join(ex.mnt, relPath))
+	if err != nil {
+		ex.fail(relPath, err)
+		return
+	}
+	entries, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		ex.fail(relPath, err)
+		return
+	}
+	// Sort alphabetically to make the order of hard links deterministic
+	sort.Strings(entries)
+	for _, entry := range entries {
+		if ex.abort {
+			return
+		}
+		ex.entry(filepath.Join(relPath, entry))
+	}
+}
+
+// Copy a single directory entry to the destination
+func (ex *exportObj) entry(relPath string) {
+	src := filepath.Join(ex.mnt, relPath)
+	dst := filepath.Join(ex.dst, relPath)
+	var st unix.Stat_t
+	if err := unix.Lstat(src, &st); err != nil {
+		ex.fail(relPath, err)
+		return
+	}
+	var err error
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		if err = os.Mkdir(dst, 0700); err != nil {
+			ex.fail(relPath, err)
+			return
+		}
+		ex.dirs = append(ex.dirs, exportDir{path: dst, st: st})
+		ex.dir(relPath)
+		return
+	case syscall.S_IFREG:
+		if st.Nlink > 1 {
+			if first, ok := ex.hardlinks[st.Ino]; ok {
+				if err = os.Link(first, dst); err != nil {
+					ex.fail(relPath, err)
+				} else {
+					ex.copied++
+				}
+				return
+			}
+			ex.hardlinks[st.Ino] = dst
+		}
+		err = ex.file(src, dst)
+	case syscall.S_IFLNK:
+		var target string
+		target, err = os.Readlink(src)
+		if err == nil {
+			err = os.Symlink(target, dst)
+		}
+	case syscall.S_IFSOCK:
+		// Sockets are only meaningful while their server is running
+		tlog.Info.Printf("%s: skipping socket %q", ex.op, relPath)
+		return
+	default:
+		// Device nodes and FIFOs
+		err = syscall.Mknod(dst, uint32(st.Mode), int(st.Rdev))
+	}
+	if err == nil {
+		err = ex.setAttr(dst, &st)
+	}
+	if err != nil {
+		ex.fail(relPath, err)
+		return
+	}
+	ex.copied++
+}
+
+// Copy the contents of the regular file "src" to the new file "dst"
+func (ex *exportObj) file(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, ex.progress.Reader(in))
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		ex.progress.Add(1, 0)
+	}
+	return err
+}
+
+// Set owner, mode and timestamps of "dst" from "st"
+func (ex *exportObj) setAttr(dst string, st *unix.Stat_t) error {
+	if ex.chown {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		// Chmod after chown, which clears the suid and sgid bits
+		if err := os.Chmod(dst, os.FileMode(st.Mode&07777)|modeBits(uint32(st.Mode))); err != nil {
+			return err
+		}
+	}
+	atime := time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+	mtime := time.Unix(int64(st.Mtim.Sec), int64(st.Mtim.Nsec))
+	return syscallcompat.UtimesNanoAtNofollow(unix.AT_FDCWD, dst, &atime, &mtime)
+}
+
+// modeBits converts the setuid, setgid and sticky bits in "mode" to
+// their os.FileMode equivalents
+func modeBits(mode uint32) (fm os.FileMode) {
+	if mode&syscall.S_ISUID != 0 {
+		fm |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		fm |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		fm |= os.ModeSticky
+	}
+	return fm
+}
+
+// setupFscryptDir creates the destination directory "dst", if needed, loads
+// the key from "keyFile" (or creates a new one) and sets up an encryption
+// policy on "dst"
+func setupFscryptDir(dst string, keyFile string) error {
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		if err = os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+	} else if err = isEmptyDir(dst); err != nil {
+		return err
+	}
+	var key []byte
+	var err error
+	if _, err = os.Stat(keyFile); err == nil {
+		tlog.Info.Printf("Using existing key file %q", keyFile)
+		key, err = fscrypt.ReadKeyFile(keyFile)
+	} else {
+		tlog.Info.Printf("Creating new key file %q", keyFile)
+		key, err = fscrypt.CreateKeyFile(keyFile)
+	}
+	if err != nil {
+		return err
+	}
+	defer fscrypt.Wipe(key)
+	id, err := fscrypt.AddKey(dst, key)
+	if err != nil {
+		return err
+	}
+	return fscrypt.SetPolicy(dst, id)
+}
+
+// entrypoint from main()
+func exportFscrypt(args *argContainer) (exitcode int) {
+	if args.reverse {
+		tlog.Fatal.Printf("Running -export-fscrypt with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	if err := setupFscryptDir(args.export_fscrypt, args.fscrypt_key); err != nil {
+		tlog.Fatal.Printf("export-fscrypt: setting up %q failed: %v", args.export_fscrypt, err)
+		os.Exit(exitcodes.Fscrypt)
+	}
+	args.allow_other = false
+	args.ro = true
+	var err error
+	args.mountpoint, err = ioutil.TempDir("", "gocryptfs.export.")
+	if err != nil {
+		tlog.Fatal.Printf("export-fscrypt: TmpDir: %v", err)
+		os.Exit(exitcodes.MountPoint)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	ex := exportObj{
+		op:        "export-fscrypt",
+		mnt:       args.mountpoint,
+		dst:       args.export_fscrypt,
+		hardlinks: make(map[uint64]string),
+		chown:     os.Geteuid() == 0,
+		progress:  startProgress(args, "export-fscrypt"),
+	}
+	// Mount
+	srv := initGoFuse(pfs, args)
+	ex.progress.ScanTotal(ex.mnt, nil)
+	defer abortOnSignal(&ex.abort)()
+	defer func() {
+		err = srv.Unmount()
+		if err != nil {
+			tlog.Warn.Printf("failed to unmount %q: %v", ex.mnt, err)
+		} else {
+			if err := syscall.Rmdir(ex.mnt); err != nil {
+				tlog.Warn.Printf("cleaning up %q failed: %v", ex.mnt, err)
+			}
+		}
+	}()
+	ex.dir("")
+	ex.progress.Stop()
+	// Deepest directories first, so that setting the timestamps of a
+	// directory is not undone by changes to its children
+	for i := len(ex.dirs) - 1; i >= 0; i-- {
+		d := ex.dirs[i]
+		if err := ex.setAttr(d.path, &d.st); err != nil {
+			ex.fail(d.path, err)
+		}
+	}
+	wipeKeys()
+	if ex.abort {
+		tlog.Info.Printf("export-fscrypt: aborted")
+		return exitcodes.Other
+	}
+	if ex.failed > 0 {
+		fmt.Printf("export-fscrypt summary: %d files copied, %d failed\n", ex.copied, ex.failed)
+		return exitcodes.Fscrypt
+	}
+	tlog.Info.Printf("export-fscrypt summary: %d files copied to %q", ex.copied, ex.dst)
+	tlog.Info.Printf("Unlock it after a reboot using: fscryptctl add_key %s < %s", ex.dst, args.fscrypt_key)
+	return 0
+}
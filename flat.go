@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/dirlock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_flat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// initFlatFrontend is the part of initFuseFrontend for filesystems created
+// with "-flat": it loads the directory index and wipes the master key.
+// On error, it calls os.Exit and does not return.
+func initFlatFrontend(args *argContainer, cEnc *contentenc.ContentEnc, masterkey []byte) fs.InodeEmbedder {
+	// These work on the mirrored directory tree, which the flat layout
+	// does not have
+	if len(args.union) > 0 || args.sharedstorage || args.ctlsock != "" || args.idle > 0 || args.journal ||
+		args.auditlog || args.manifest || args.reencrypt || args.notify || args.fsck || args.export_fscrypt != "" {
+		tlog.Fatal.Printf("Filesystems created with -flat cannot be used with -union, -sharedstorage, -ctlsock, " +
+			"-idle, -journal, -auditlog, -manifest, -reencrypt, -notify, -fsck or -export-fscrypt")
+		if args._ctlsockFd != nil {
+			// Close the socket file (which also deletes it)
+			args._ctlsockFd.Close()
+		}
+		removeMountpoint(args)
+		os.Exit(exitcodes.Usage)
+	}
+	if !args._flatImage && (args.masterkey != "" || args.zerokey) {
+		// Mounted with -masterkey or -zerokey. There is no feature flag, so
+		// look for the image.
+		_, err := os.Lstat(filepath.Join(args.cipherdir, fusefrontend_flat.ImageName))
+		args._flatImage = err == nil
+	}
+	rn, err := fusefrontend_flat.NewRootNode(args.cipherdir, cEnc, masterkey, args._flatImage, args._imageMaxSize)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-flat: %v", err)
+		removeMountpoint(args)
+		os.Exit(exitcodes.CipherDir)
+	}
+	return rn
+}
+
+// initImage is the part of initDir for "-image", "-image_size" and
+// "-container": it creates CIPHERDIR/gocryptfs.image, either as a sparse
+// file or as a symlink to the block device or file given to "-image" or
+// to the new container file, and clears its superblocks.
+func initImage(args *argContainer) error {
+	path := filepath.Join(args.cipherdir, fusefrontend_flat.ImageName)
+	if args.container != "" {
+		// The container starts small and grows on demand
+		fd, err := os.OpenFile(args.container, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		err = fd.Truncate(fusefrontend_flat.MinImageSize)
+		if err2 := fd.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return err
+		}
+		args.image = args.container
+	}
+	if args.image != "" {
+		target, err := filepath.Abs(args.image)
+		if err != nil {
+			return err
+		}
+		if err = os.Symlink(target, path); err != nil {
+			return err
+		}
+	} else {
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		err = fd.Truncate(int64(args.image_size))
+		if err2 := fd.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fusefrontend_flat.FormatImage(path)
+}
+
+// compactContainer handles "gocryptfs -compact CIPHERDIR": it moves the data
+// in the "-container" file to its start and shrinks the file.
+// Does not return (calls os.Exit both on success and on error).
+func compactContainer(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-compact does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	lock, err := dirlock.Lock(args.cipherdir, lockTimeout)
+	if err == syscall.EWOULDBLOCK {
+		tlog.Fatal.Printf("%s is mounted read-write. Unmount it before running -compact.", args.cipherdir)
+		os.Exit(exitcodes.Locked)
+	} else if err != nil {
+		tlog.Fatal.Printf("-compact: %v", err)
+		os.Exit(exitcodes.Locked)
+	}
+	defer lock.Unlock()
+	pfs, wipeKeys := initFuseFrontend(args)
+	rn, ok := pfs.(*fusefrontend_flat.RootNode)
+	if !ok || !args._flatImage {
+		wipeKeys()
+		tlog.Fatal.Printf("-compact only works on filesystems created with -container")
+		os.Exit(exitcodes.Usage)
+	}
+	oldSize, newSize, err := rn.Compact()
+	wipeKeys()
+	if err != nil {
+		tlog.Fatal.Printf("-compact: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"The container has been compacted from %d to %d bytes."+tlog.ColorReset,
+		oldSize, newSize)
+	os.Exit(0)
+}
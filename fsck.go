@@ -2,11 +2,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"sort"
 	"sync"
@@ -14,21 +14,61 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/auditlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/dirlock"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/manifest"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/progress"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
+// fsckProblem is a corrupt or skipped file. It is part of the "-fsck -json"
+// output.
+type fsckProblem struct {
+	// Kind is what is broken: "dir", "diriv", "name", "file", "header",
+	// "content", "symlink", "xattr", "link", "auditlog" or "manifest"
+	Kind string
+	// Path is the plaintext path, or the ciphertext path for "link"
+	Path    string
+	Message string
+}
+
+// fsckReport is the "-fsck -json" output
+type fsckReport struct {
+	Cipherdir string
+	// Files is the number of files checked
+	Files    uint64
+	Corrupt  []fsckProblem
+	Skipped  []fsckProblem
+	Repaired []string
+	// Quarantine is the contents of gocryptfs.quarantine
+	Quarantine []quarantineEntry
+	Aborted    bool
+}
+
 type fsckObj struct {
 	rootNode *fusefrontend.RootNode
 	// mnt is the mountpoint of the temporary mount
 	mnt string
+	// cipherdir is CIPHERDIR, to look at the ciphertext of broken files
+	cipherdir string
+	// json suppresses the messages, the report is printed at the end
+	json bool
+	// files is the number of files checked
+	files uint64
 	// List of corrupt files
-	corruptList []string
+	corruptList []fsckProblem
 	// List of skipped files
-	skippedList []string
-	// Protects corruptList
+	skippedList []fsckProblem
+	// Files deleted or moved by "-repair"
+	repairedList []string
+	// Contents of gocryptfs.quarantine
+	quarantineList []quarantineEntry
+	// Protects corruptList and skippedList
 	listLock sync.Mutex
 	// stop a running watchMitigatedCorruptions thread
 	watchDone chan struct{}
@@ -36,21 +76,36 @@ type fsckObj struct {
 	seenInodes map[uint64]struct{}
 	// abort the running fsck operation? Checked in a few long-running loops.
 	abort bool
+	// progress reports the files and bytes checked ("-progress")
+	progress *progress.Reporter
 }
 
 func runsAsRoot() bool {
 	return syscall.Geteuid() == 0
 }
 
-func (ck *fsckObj) markCorrupt(path string) {
+// printf prints an "fsck: " message, unless the report goes out as JSON
+func (ck *fsckObj) printf(format string, a ...interface{}) {
+	if !ck.json {
+		fmt.Printf("fsck: "+format+"\n", a...)
+	}
+}
+
+// markCorrupt reports the problem "kind" at "path", described by "format"
+func (ck *fsckObj) markCorrupt(kind string, path string, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	ck.printf("%s", msg)
 	ck.listLock.Lock()
-	ck.corruptList = append(ck.corruptList, path)
+	ck.corruptList = append(ck.corruptList, fsckProblem{Kind: kind, Path: path, Message: msg})
 	ck.listLock.Unlock()
 }
 
-func (ck *fsckObj) markSkipped(path string) {
+// markSkipped reports that "path" could not be checked
+func (ck *fsckObj) markSkipped(kind string, path string, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	ck.printf("%s", msg)
 	ck.listLock.Lock()
-	ck.skippedList = append(ck.skippedList, path)
+	ck.skippedList = append(ck.skippedList, fsckProblem{Kind: kind, Path: path, Message: msg})
 	ck.listLock.Unlock()
 }
 
@@ -63,8 +118,7 @@ func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string) {
 	for {
 		select {
 		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt entry in dir %q: %q\n", path, item)
-			ck.markCorrupt(filepath.Join(path, item))
+			ck.markCorrupt("name", filepath.Join(path, item), "corrupt entry in dir %q: %q", path, item)
 		case <-ck.watchDone:
 			return
 		}
@@ -80,11 +134,12 @@ func (ck *fsckObj) dir(relPath string) {
 	f, err := os.Open(ck.abs(relPath))
 	ck.watchDone <- struct{}{}
 	if err != nil {
-		fmt.Printf("fsck: error opening dir %q: %v\n", relPath, err)
 		if err == os.ErrPermission && !runsAsRoot() {
-			ck.markSkipped(relPath)
+			ck.markSkipped("dir", relPath, "error opening dir %q: %v", relPath, err)
+		} else if msg := ck.dirIVProblem(relPath); msg != "" {
+			ck.markCorrupt("diriv", relPath, "error opening dir %q: %s", relPath, msg)
 		} else {
-			ck.markCorrupt(relPath)
+			ck.markCorrupt("dir", relPath, "error opening dir %q: %v", relPath, err)
 		}
 		return
 	}
@@ -92,8 +147,11 @@ func (ck *fsckObj) dir(relPath string) {
 	entries, err := f.Readdirnames(0)
 	ck.watchDone <- struct{}{}
 	if err != nil {
-		fmt.Printf("fsck: error reading dir %q: %v\n", relPath, err)
-		ck.markCorrupt(relPath)
+		if msg := ck.dirIVProblem(relPath); msg != "" {
+			ck.markCorrupt("diriv", relPath, "error reading dir %q: %s", relPath, msg)
+		} else {
+			ck.markCorrupt("dir", relPath, "error reading dir %q: %v", relPath, err)
+		}
 		return
 	}
 	// Sort alphabetically to make fsck runs deterministic
@@ -109,7 +167,7 @@ func (ck *fsckObj) dir(relPath string) {
 		var st syscall.Stat_t
 		err := syscall.Lstat(ck.abs(nextPath), &st)
 		if err != nil {
-			ck.markCorrupt(filepath.Join(relPath, entry))
+			ck.markCorrupt("name", nextPath, "error stating %q: %v", nextPath, err)
 			continue
 		}
 		filetype := st.Mode & syscall.S_IFMT
@@ -124,7 +182,7 @@ func (ck *fsckObj) dir(relPath string) {
 		case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFBLK, syscall.S_IFCHR:
 			// nothing to check
 		default:
-			fmt.Printf("fsck: unhandled file type %x\n", filetype)
+			ck.printf("unhandled file type %x", filetype)
 		}
 	}
 }
@@ -132,8 +190,7 @@ func (ck *fsckObj) dir(relPath string) {
 func (ck *fsckObj) symlink(relPath string) {
 	_, err := os.Readlink(ck.abs(relPath))
 	if err != nil {
-		ck.markCorrupt(relPath)
-		fmt.Printf("fsck: error reading symlink %q: %v\n", relPath, err)
+		ck.markCorrupt("symlink", relPath, "error reading symlink %q: %v", relPath, err)
 	}
 }
 
@@ -142,8 +199,7 @@ func (ck *fsckObj) watchMitigatedCorruptionsRead(path string) {
 	for {
 		select {
 		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt file %q (inode %s)\n", path, item)
-			ck.markCorrupt(path)
+			ck.markCorrupt("content", path, "corrupt file %q (inode %s)", path, item)
 		case <-ck.watchDone:
 			return
 		}
@@ -156,8 +212,7 @@ func (ck *fsckObj) file(relPath string) {
 	var st syscall.Stat_t
 	err := syscall.Lstat(ck.abs(relPath), &st)
 	if err != nil {
-		ck.markCorrupt(relPath)
-		fmt.Printf("fsck: error stating file %q: %v\n", relPath, err)
+		ck.markCorrupt("file", relPath, "error stating file %q: %v", relPath, err)
 		return
 	}
 	if st.Nlink > 1 {
@@ -168,14 +223,17 @@ func (ck *fsckObj) file(relPath string) {
 		}
 		ck.seenInodes[st.Ino] = struct{}{}
 	}
+	ck.files++
+	ck.progress.Add(1, 0)
 	ck.xattrs(relPath)
 	f, err := os.Open(ck.abs(relPath))
 	if err != nil {
-		fmt.Printf("fsck: error opening file %q: %v\n", relPath, err)
 		if err == os.ErrPermission && !runsAsRoot() {
-			ck.markSkipped(relPath)
+			ck.markSkipped("file", relPath, "error opening file %q: %v", relPath, err)
+		} else if msg := ck.headerProblem(relPath); msg != "" {
+			ck.markCorrupt("header", relPath, "error opening file %q: %s", relPath, msg)
 		} else {
-			ck.markCorrupt(relPath)
+			ck.markCorrupt("file", relPath, "error opening file %q: %v", relPath, err)
 		}
 		return
 	}
@@ -193,9 +251,13 @@ func (ck *fsckObj) file(relPath string) {
 		}
 		tlog.Debug.Printf("ck.file: read %d bytes from offset %d\n", len(buf), off)
 		n, err := f.ReadAt(buf, off)
+		ck.progress.Add(0, uint64(n))
 		if err != nil && err != io.EOF {
-			ck.markCorrupt(relPath)
-			fmt.Printf("fsck: error reading file %q (inum %d): %v\n", relPath, inum(f), err)
+			if msg := ck.headerProblem(relPath); msg != "" {
+				ck.markCorrupt("header", relPath, "error reading file %q (inum %d): %s", relPath, inum(f), msg)
+			} else {
+				ck.markCorrupt("content", relPath, "error reading file %q (inum %d): %v", relPath, inum(f), err)
+			}
 			return
 		}
 		// EOF
@@ -222,8 +284,7 @@ func (ck *fsckObj) watchMitigatedCorruptionsListXAttr(path string) {
 	for {
 		select {
 		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt xattr name on file %q: %q\n", path, item)
-			ck.markCorrupt(path + " xattr:" + item)
+			ck.markCorrupt("xattr", path, "corrupt xattr name on file %q: %q", path, item)
 		case <-ck.watchDone:
 			return
 		}
@@ -237,19 +298,17 @@ func (ck *fsckObj) xattrs(relPath string) {
 	attrs, err := syscallcompat.Llistxattr(ck.abs(relPath))
 	ck.watchDone <- struct{}{}
 	if err != nil {
-		fmt.Printf("fsck: error listing xattrs on %q: %v\n", relPath, err)
-		ck.markCorrupt(relPath)
+		ck.markCorrupt("xattr", relPath, "error listing xattrs on %q: %v", relPath, err)
 		return
 	}
 	// Try to read all xattr values
 	for _, a := range attrs {
 		_, err := syscallcompat.Lgetxattr(ck.abs(relPath), a)
 		if err != nil {
-			fmt.Printf("fsck: error reading xattr %q from %q: %v\n", a, relPath, err)
 			if err == syscall.EACCES && !runsAsRoot() {
-				ck.markSkipped(relPath)
+				ck.markSkipped("xattr", relPath, "error reading xattr %q from %q: %v", a, relPath, err)
 			} else {
-				ck.markCorrupt(relPath)
+				ck.markCorrupt("xattr", relPath, "error reading xattr %q from %q: %v", a, relPath, err)
 			}
 		}
 	}
@@ -263,7 +322,25 @@ func fsck(args *argContainer) (exitcode int) {
 	}
 	args.allow_other = false
 	args.ro = true
+	if args.json {
+		// Only the report goes to stdout
+		tlog.Info.Enabled = false
+	}
 	var err error
+	// "-repair" changes CIPHERDIR behind the back of the read-only mount.
+	// Nobody else must be writing to it.
+	if args.repair {
+		checkReservedNames(args.cipherdir)
+		lock, err := dirlock.Lock(args.cipherdir, lockTimeout)
+		if err == syscall.EWOULDBLOCK {
+			tlog.Fatal.Printf("%s is mounted read-write. Unmount it before running -fsck -repair.", args.cipherdir)
+			os.Exit(exitcodes.Locked)
+		} else if err != nil {
+			tlog.Fatal.Printf("fsck: %v", err)
+			os.Exit(exitcodes.Locked)
+		}
+		defer lock.Unlock()
+	}
 	args.mountpoint, err = ioutil.TempDir("", "gocryptfs.fsck.")
 	if err != nil {
 		tlog.Fatal.Printf("fsck: TmpDir: %v", err)
@@ -274,10 +351,16 @@ func fsck(args *argContainer) (exitcode int) {
 	rn.MitigatedCorruptions = make(chan string)
 	ck := fsckObj{
 		mnt:        args.mountpoint,
+		cipherdir:  args.cipherdir,
+		json:       args.json,
 		rootNode:   rn,
 		watchDone:  make(chan struct{}),
 		seenInodes: make(map[uint64]struct{}),
+		progress:   startProgress(args, "fsck"),
 	}
+	// Count the files in CIPHERDIR, not in the mount, so that the
+	// corruptions are only reported to the checks
+	ck.progress.ScanTotal(args.cipherdir, rn.IsInternalPath)
 	if args.quiet {
 		// go-fuse throws a lot of these:
 		//   writer: Write/Writev failed, err: 2=no such file or directory. opcode: INTERRUPT
@@ -286,14 +369,7 @@ func fsck(args *argContainer) (exitcode int) {
 	}
 	// Mount
 	srv := initGoFuse(pfs, args)
-	// Handle SIGINT & SIGTERM
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-	signal.Notify(ch, syscall.SIGTERM)
-	go func() {
-		<-ch
-		ck.abort = true
-	}()
+	defer abortOnSignal(&ck.abort)()
 	defer func() {
 		err = srv.Unmount()
 		if err != nil {
@@ -306,8 +382,19 @@ func fsck(args *argContainer) (exitcode int) {
 	}()
 	// Recursively check the root dir
 	ck.dir("")
+	ck.progress.Stop()
+	if args.repair && !ck.abort {
+		ck.quarantine()
+	}
+	ck.links(args.cipherdir, args.repair)
+	ck.auditLog(args)
+	ck.manifest(args)
+	ck.quarantineList = ck.listQuarantine()
 	// Report results
 	wipeKeys()
+	if ck.json {
+		ck.printJSON()
+	}
 	if ck.abort {
 		tlog.Info.Printf("fsck: aborted")
 		return exitcodes.Other
@@ -319,10 +406,115 @@ func fsck(args *argContainer) (exitcode int) {
 	if len(ck.skippedList) > 0 {
 		tlog.Warn.Printf("fsck: re-run this program as root to check all files!\n")
 	}
-	fmt.Printf("fsck summary: %d corrupt files, %d files skipped\n", len(ck.corruptList), len(ck.skippedList))
+	if !ck.json {
+		fmt.Printf("fsck summary: %d corrupt files, %d files skipped\n", len(ck.corruptList), len(ck.skippedList))
+	}
 	return exitcodes.FsckErrors
 }
 
+// printJSON prints the "-fsck -json" report to stdout
+func (ck *fsckObj) printJSON() {
+	r := fsckReport{
+		Cipherdir:  ck.cipherdir,
+		Files:      ck.files,
+		Corrupt:    ck.corruptList,
+		Skipped:    ck.skippedList,
+		Repaired:   ck.repairedList,
+		Quarantine: ck.quarantineList,
+		Aborted:    ck.abort,
+	}
+	// Empty lists instead of null
+	if r.Corrupt == nil {
+		r.Corrupt = []fsckProblem{}
+	}
+	if r.Skipped == nil {
+		r.Skipped = []fsckProblem{}
+	}
+	if r.Repaired == nil {
+		r.Repaired = []string{}
+	}
+	if r.Quarantine == nil {
+		r.Quarantine = []quarantineEntry{}
+	}
+	out, _ := json.MarshalIndent(r, "", "\t")
+	fmt.Println(string(out))
+}
+
+// dirIVProblem looks at the gocryptfs.diriv file of the directory "relPath"
+// in CIPHERDIR and describes what is wrong with it. Returns "" if it is
+// fine, or if the filesystem does not use per-directory IVs.
+func (ck *fsckObj) dirIVProblem(relPath string) string {
+	if _, err := os.Stat(filepath.Join(ck.cipherdir, nametransform.DirIVFilename)); err != nil {
+		// No diriv in the root dir: -plaintextnames or -deterministic-names
+		return ""
+	}
+	cPath, err := ck.rootNode.EncryptPath(relPath)
+	if err != nil {
+		return ""
+	}
+	iv, err := ioutil.ReadFile(filepath.Join(ck.cipherdir, cPath, nametransform.DirIVFilename))
+	if os.IsNotExist(err) {
+		return nametransform.DirIVFilename + " is missing"
+	} else if err != nil {
+		return fmt.Sprintf("%s: %v", nametransform.DirIVFilename, err)
+	}
+	if len(iv) != nametransform.DirIVLen {
+		return fmt.Sprintf("%s has %d bytes instead of %d", nametransform.DirIVFilename, len(iv), nametransform.DirIVLen)
+	}
+	return ""
+}
+
+// headerProblem looks at the file header of the file "relPath" in CIPHERDIR
+// and describes what is wrong with it. Returns "" if it is fine.
+func (ck *fsckObj) headerProblem(relPath string) string {
+	cPath, err := ck.rootNode.EncryptPath(relPath)
+	if err != nil {
+		return ""
+	}
+	f, err := os.Open(filepath.Join(ck.cipherdir, cPath))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, contentenc.HeaderLen)
+	n, err := io.ReadFull(f, buf)
+	if err == io.EOF {
+		// Empty files have no header
+		return ""
+	} else if err != nil {
+		return fmt.Sprintf("file header is truncated to %d bytes", n)
+	}
+	if _, err := contentenc.ParseHeader(buf, ck.rootNode.HeaderFeatures()); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// auditLog verifies the "-auditlog" file, if there is one
+func (ck *fsckObj) auditLog(args *argContainer) {
+	n, err := args._auditLog.Verify()
+	if err != nil {
+		ck.markCorrupt("auditlog", auditlog.FileName, "%s: %v", auditlog.FileName, err)
+	} else if n > 0 {
+		tlog.Info.Printf("fsck: %s: %d records verified", auditlog.FileName, n)
+	}
+}
+
+// manifest compares CIPHERDIR with the "-manifest" file, if there is one
+func (ck *fsckObj) manifest(args *argContainer) {
+	diffs, m, err := verifyManifest(args)
+	if err != nil {
+		ck.markCorrupt("manifest", manifest.FileName, "%v", err)
+		return
+	}
+	for _, d := range diffs {
+		ck.markCorrupt("manifest", d, "%s: %s", manifest.FileName, d)
+	}
+	if m != nil && len(diffs) == 0 {
+		tlog.Info.Printf("fsck: %s: generation %d verified", manifest.FileName, m.Generation)
+	}
+}
+
 func inum(f *os.File) uint64 {
 	var st syscall.Stat_t
 	err := syscall.Fstat(int(f.Fd()), &st)
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// linkInode is a hard-linked file in CIPHERDIR
+type linkInode struct {
+	ino   uint64
+	nlink uint64
+	// links are all names of the file in CIPHERDIR, relative to it
+	links []string
+	// broken are the links that cannot be reached through the mount,
+	// because their ".name" file is missing or belongs to another link
+	broken []string
+}
+
+// links checks the hard links in CIPHERDIR. It builds a map of all hard-linked
+// files, reports the links whose long name pair is broken, and compares the
+// number of links found with the link count. With "-repair", it deletes
+// broken links of files that can still be reached under another name, and
+// ".name" files whose file is missing.
+//
+// This looks at CIPHERDIR directly, as the broken links are invisible in the
+// mount.
+func (ck *fsckObj) links(cipherdir string, repair bool) {
+	type devIno struct{ dev, ino uint64 }
+	inodes := make(map[devIno]*linkInode)
+	// In -plaintextnames mode, "gocryptfs.longname.*" are normal files
+	long := ck.rootNode.HashLongName("") != ""
+	errAbort := errors.New("aborted")
+	err := filepath.Walk(cipherdir, func(path string, fi os.FileInfo, err error) error {
+		if ck.abort {
+			return errAbort
+		}
+		rel, _ := filepath.Rel(cipherdir, path)
+		if rel == fusefrontend.QuarantineDirName {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			ck.markCorrupt("link", rel, "error scanning %q: %v", rel, err)
+			return nil
+		}
+		name := fi.Name()
+		if long && nametransform.NameType(name) == nametransform.LongNameFilename {
+			if _, err := os.Lstat(nametransform.RemoveLongNameSuffix(path)); os.IsNotExist(err) {
+				ck.markCorrupt("link", rel, "orphaned %q: the file it names is missing", rel)
+				if repair {
+					ck.repairRemove(path, rel)
+				}
+			}
+			return nil
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || !fi.Mode().IsRegular() || st.Nlink <= 1 {
+			return nil
+		}
+		key := devIno{uint64(st.Dev), uint64(st.Ino)}
+		in := inodes[key]
+		if in == nil {
+			in = &linkInode{ino: uint64(st.Ino), nlink: uint64(st.Nlink)}
+			inodes[key] = in
+		}
+		in.links = append(in.links, rel)
+		if long && nametransform.IsLongContent(name) {
+			cNameLong, err := ioutil.ReadFile(path + nametransform.LongNameSuffix)
+			if err != nil || ck.rootNode.HashLongName(string(cNameLong)) != name {
+				in.broken = append(in.broken, rel)
+			}
+		}
+		return nil
+	})
+	if err == errAbort {
+		return
+	} else if err != nil {
+		ck.markCorrupt("link", "", "error scanning CIPHERDIR: %v", err)
+		return
+	}
+	// Sort to make fsck runs deterministic
+	sorted := make([]*linkInode, 0, len(inodes))
+	for _, in := range inodes {
+		sorted = append(sorted, in)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].links[0] < sorted[j].links[0] })
+	for _, in := range sorted {
+		reachable := len(in.links) - len(in.broken)
+		for _, rel := range in.broken {
+			ck.markCorrupt("link", rel, "hard link %q (inode %d) is broken: its .name file is missing or belongs to another link",
+				rel, in.ino)
+			if repair && reachable > 0 {
+				path := filepath.Join(cipherdir, rel)
+				ck.repairRemove(path+nametransform.LongNameSuffix, rel+nametransform.LongNameSuffix)
+				ck.repairRemove(path, rel)
+			}
+		}
+		if repair && reachable == 0 && len(in.broken) > 0 {
+			tlog.Warn.Printf("fsck: inode %d cannot be reached under any name, not deleting its links", in.ino)
+		}
+		if n := uint64(len(in.links)); n < in.nlink {
+			// Not an error: the other links may be anywhere on the same
+			// filesystem
+			tlog.Info.Printf("fsck: %q (inode %d) has %d links, %d of them are outside of CIPHERDIR",
+				in.links[0], in.ino, in.nlink, in.nlink-n)
+		}
+	}
+}
+
+// repairRemove deletes "path" for "-fsck -repair". "rel" is the path
+// relative to CIPHERDIR, for messages.
+func (ck *fsckObj) repairRemove(path string, rel string) {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		tlog.Warn.Printf("fsck: repair: deleting %q failed: %v", rel, err)
+		return
+	}
+	ck.printf("repair: deleted %q", rel)
+	ck.repairedList = append(ck.repairedList, rel)
+}
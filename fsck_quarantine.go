@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/reserveddir"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// quarantineIndexName is the list of quarantined files in
+// gocryptfs.quarantine
+const quarantineIndexName = "index.json"
+
+// quarantineEntry is a file or directory that "-fsck -repair" has moved into
+// gocryptfs.quarantine. It is part of the "-fsck -json" output.
+type quarantineEntry struct {
+	// Name in gocryptfs.quarantine
+	Name string
+	// CipherPath is where it was, relative to CIPHERDIR
+	CipherPath string
+	// Path is where it was in the plaintext view. Encrypted with the
+	// master key in index.json, "" if it cannot be decrypted.
+	Path string
+	// Kind of the problem, see fsckProblem
+	Kind string
+	Time time.Time
+}
+
+// loadQuarantine reads gocryptfs.quarantine/index.json. Returns nil if there
+// is none.
+func (ck *fsckObj) loadQuarantine() ([]quarantineEntry, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(ck.cipherdir, fusefrontend.QuarantineDirName, quarantineIndexName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var index []quarantineEntry
+	err = json.Unmarshal(buf, &index)
+	return index, err
+}
+
+// saveQuarantine replaces gocryptfs.quarantine/index.json atomically
+func (ck *fsckObj) saveQuarantine(index []quarantineEntry) error {
+	buf, err := json.MarshalIndent(index, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(ck.cipherdir, fusefrontend.QuarantineDirName, quarantineIndexName)
+	f, err := os.OpenFile(path+".new", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(path+".new", path)
+	}
+	return err
+}
+
+// quarantine implements the second part of "-fsck -repair": files whose
+// header or contents are corrupt are moved into gocryptfs.quarantine, so
+// that the rest of the filesystem can be read and backed up without errors.
+// A directory whose gocryptfs.diriv is missing or broken gets a new one if
+// it is empty. Otherwise the names in it cannot be decrypted, and it is
+// moved into gocryptfs.quarantine as well.
+func (ck *fsckObj) quarantine() {
+	qDir := filepath.Join(ck.cipherdir, fusefrontend.QuarantineDirName)
+	index, err := ck.loadQuarantine()
+	if err != nil {
+		tlog.Warn.Printf("fsck: repair: %s/%s: %v", fusefrontend.QuarantineDirName, quarantineIndexName, err)
+		return
+	}
+	n := len(index)
+	for _, p := range ck.corruptList {
+		if p.Kind != "header" && p.Kind != "content" && p.Kind != "diriv" {
+			continue
+		}
+		if p.Path == "" {
+			tlog.Warn.Printf("fsck: repair: the root directory cannot be quarantined")
+			continue
+		}
+		cPath, err := ck.rootNode.EncryptPath(p.Path)
+		if err != nil {
+			tlog.Warn.Printf("fsck: repair: %q: %v", p.Path, err)
+			continue
+		}
+		src := filepath.Join(ck.cipherdir, cPath)
+		if _, err = os.Lstat(src); os.IsNotExist(err) {
+			// Reported twice, already moved
+			continue
+		}
+		if p.Kind == "diriv" {
+			fixed, err := ck.repairDirIV(src)
+			if err != nil {
+				tlog.Warn.Printf("fsck: repair: %q: %v", p.Path, err)
+				continue
+			} else if fixed {
+				ck.printf("repair: created a new %s in %q", nametransform.DirIVFilename, p.Path)
+				ck.repairedList = append(ck.repairedList, filepath.Join(cPath, nametransform.DirIVFilename))
+				continue
+			}
+		}
+		if err = reserveddir.Mkdir(qDir); err != nil {
+			tlog.Warn.Printf("fsck: repair: %v", err)
+			return
+		}
+		name := fmt.Sprintf("%d.%s", len(index)+1, filepath.Base(cPath))
+		if err = os.Rename(src, filepath.Join(qDir, name)); err != nil {
+			tlog.Warn.Printf("fsck: repair: moving %q failed: %v", p.Path, err)
+			continue
+		}
+		if nametransform.IsLongContent(filepath.Base(cPath)) {
+			err = os.Rename(src+nametransform.LongNameSuffix, filepath.Join(qDir, name+nametransform.LongNameSuffix))
+			if err != nil && !os.IsNotExist(err) {
+				tlog.Warn.Printf("fsck: repair: %q: %v", p.Path, err)
+			}
+		}
+		index = append(index, quarantineEntry{
+			Name:       name,
+			CipherPath: cPath,
+			Path:       ck.rootNode.EncryptString(p.Path),
+			Kind:       p.Kind,
+			Time:       time.Now(),
+		})
+		ck.printf("repair: moved %q to %s/%s", p.Path, fusefrontend.QuarantineDirName, name)
+		ck.repairedList = append(ck.repairedList, cPath)
+	}
+	if len(index) == n {
+		return
+	}
+	if err = ck.saveQuarantine(index); err != nil {
+		tlog.Warn.Printf("fsck: repair: %s/%s: %v", fusefrontend.QuarantineDirName, quarantineIndexName, err)
+	}
+}
+
+// repairDirIV writes a new gocryptfs.diriv into the directory "dir" if
+// there is nothing else in it. Returns false if there is.
+func (ck *fsckObj) repairDirIV(dir string) (bool, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Name() != nametransform.DirIVFilename {
+			return false, nil
+		}
+	}
+	err = os.Remove(filepath.Join(dir, nametransform.DirIVFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+	return true, nametransform.WriteDirIVAt(fd)
+}
+
+// listQuarantine returns the contents of gocryptfs.quarantine with the
+// plaintext paths decrypted, and prints them
+func (ck *fsckObj) listQuarantine() []quarantineEntry {
+	index, err := ck.loadQuarantine()
+	if err != nil {
+		tlog.Warn.Printf("fsck: %s/%s: %v", fusefrontend.QuarantineDirName, quarantineIndexName, err)
+		return nil
+	}
+	for i := range index {
+		path, err := ck.rootNode.DecryptString(index[i].Path)
+		if err != nil {
+			path = ""
+		}
+		index[i].Path = path
+		tlog.Info.Printf("fsck: %s/%s is %q (%s), quarantined on %s", fusefrontend.QuarantineDirName,
+			index[i].Name, path, index[i].Kind, index[i].Time.Format(time.RFC3339))
+	}
+	return index
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/merkle"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// decryptChunk is the number of blocks decrypted at once
+const decryptChunk = 32
+
+// findConfig looks for gocryptfs.conf in the directory of "fn" and in the
+// directories above it. Returns "" if there is none.
+func findConfig(fn string) string {
+	dir, err := filepath.Abs(filepath.Dir(fn))
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, configfile.ConfDefaultName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadKey loads the config file (-config, or the one found above "fn") and
+// returns it with the master key from "-masterkey" or the password. "cf" is
+// nil with "-masterkey" if there is no config file.
+func loadKey(args *argContainer, fn string) (cf *configfile.ConfFile, masterkey []byte) {
+	// Only the plaintext goes to stdout
+	tlog.Info.Enabled = false
+	confPath := *args.config
+	if confPath == "" {
+		confPath = findConfig(fn)
+	}
+	if confPath != "" {
+		var err error
+		cf, err = configfile.Load(confPath)
+		if err != nil {
+			errExitStderr(fmt.Errorf("%s: %v", confPath, err))
+		}
+		if cf.IsFeatureFlagSet(configfile.FlagFlatLayout) {
+			errExitStderr(fmt.Errorf("-flat filesystems are not supported"))
+		}
+	}
+	if *args.masterkey != "" {
+		var err error
+		masterkey, err = hex.DecodeString(strings.Replace(*args.masterkey, "-", "", -1))
+		if err == nil && len(masterkey) != cryptocore.KeyLen {
+			err = fmt.Errorf("master key has length %d but we require length %d", len(masterkey), cryptocore.KeyLen)
+		}
+		if err != nil {
+			errExitStderr(err)
+		}
+	} else if cf != nil {
+		masterkey = unlockConfig(cf, *args.fido2, *args.pqkey)
+	} else {
+		errExitStderr(fmt.Errorf("no %s found above %s. Use -config or -masterkey.",
+			configfile.ConfDefaultName, fn))
+	}
+	return cf, masterkey
+}
+
+// decryptFile handles "-decrypt FILE": it decrypts the contents of the
+// ciphertext file "fd" and writes them to stdout, without mounting anything.
+// The settings come from the config file. With "-masterkey" and no config
+// file, the content encryption is selected by -aessiv, -xchacha, ... like
+// for the default mode.
+func decryptFile(args *argContainer, fd *os.File) {
+	cf, masterkey := loadKey(args, fd.Name())
+	algo := cryptocore.BackendGoGCM
+	hkdf := true
+	if cf != nil {
+		var err error
+		if algo, err = cf.ContentEncryption(); err != nil {
+			errExitStderr(err)
+		}
+		hkdf = cf.IsFeatureFlagSet(configfile.FlagHKDF)
+	} else if *args.aessiv {
+		algo = cryptocore.BackendAESSIV
+	} else if *args.xchacha {
+		algo = cryptocore.BackendXChaCha20Poly1305
+	} else if *args.aegis {
+		algo = cryptocore.BackendAEGIS256
+	}
+	cc := cryptocore.New(masterkey, algo, algo.NonceSize*8, hkdf)
+	defer cc.Wipe()
+	ce := contentenc.New(cc, contentenc.DefaultBS)
+	if *args.masterkey == "" && cf != nil {
+		// -masterkey is only the key of epoch 0
+		var cores []*cryptocore.CryptoCore
+		for _, key := range cf.EpochKeys() {
+			cores = append(cores, cryptocore.New(key, algo, algo.NonceSize*8, hkdf))
+			for i := range key {
+				key[i] = 0
+			}
+		}
+		if len(cores) > 0 {
+			ce.SetKeyEpochs(cores)
+		}
+		defer func() {
+			for _, c := range cores {
+				c.Wipe()
+			}
+		}()
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+
+	if cf != nil && cf.IsFeatureFlagSet(configfile.FlagMerkleTree) {
+		// The hash tree state follows the header
+		ce.SetHeaderExt(merkle.StateLen)
+	}
+	headerBytes := make([]byte, ce.HeaderLen())
+	n, err := io.ReadFull(fd, headerBytes)
+	if err == io.EOF {
+		// Empty file
+		return
+	} else if err != nil {
+		errExitStderr(fmt.Errorf("incomplete file header: read %d bytes, want %d", n, ce.HeaderLen()))
+	}
+	headerBytes = headerBytes[:contentenc.HeaderLen]
+	// Without a config file, we do not know the feature flags. The key epoch
+	// is checked below.
+	feat := contentenc.HeaderFeatures{KeyEpochs: true, Immutable: true}
+	if cf != nil {
+		feat = contentenc.HeaderFeatures{
+			KeyEpochs: cf.IsFeatureFlagSet(configfile.FlagKeyEpochs),
+			Immutable: cf.IsFeatureFlagSet(configfile.FlagImmutable),
+		}
+	}
+	header, err := contentenc.ParseHeader(headerBytes, feat)
+	if err != nil {
+		errExitStderr(err)
+	}
+	if header.KeyEpoch > ce.CurrentKeyEpoch() {
+		errExitStderr(fmt.Errorf("the file was encrypted in key epoch %d, but only the keys up to epoch %d are known",
+			header.KeyEpoch, ce.CurrentKeyEpoch()))
+	}
+	ce = ce.KeyEpoch(header.KeyEpoch)
+	ad := header.ID
+	if cf != nil && cf.IsFeatureFlagSet(configfile.FlagBindPath) {
+		// "-bindpath" binds the contents to the DirIV of the directory and
+		// the name of the file
+		dirIV, err := ioutil.ReadFile(filepath.Join(filepath.Dir(fd.Name()), nametransform.DirIVFilename))
+		if err == nil && len(dirIV) != nametransform.DirIVLen {
+			err = fmt.Errorf("invalid length %d", len(dirIV))
+		}
+		if err != nil {
+			errExitStderr(fmt.Errorf("-bindpath needs the %s next to the file: %v", nametransform.DirIVFilename, err))
+		}
+		ad = contentenc.BindPath(ad, contentenc.PathBinding(dirIV, filepath.Base(fd.Name())))
+	}
+	if header.Immutable {
+		ad = contentenc.Immutable(ad)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	buf := make([]byte, decryptChunk*ce.CipherBS())
+	var blockNo uint64
+	for {
+		n, err := io.ReadFull(fd, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			errExitStderr(err)
+		}
+		plaintext, err := ce.DecryptBlocks(buf[:n], blockNo, ad)
+		// Write what could be decrypted before the bad block
+		out.Write(plaintext)
+		if err != nil {
+			out.Flush()
+			bad := blockNo + uint64(len(plaintext))/ce.PlainBS()
+			errExitStderr(fmt.Errorf("block %d (ciphertext offset %d): %v", bad,
+				ce.BlockNoToCipherOff(bad), err))
+		}
+		blockNo += uint64(n) / ce.CipherBS()
+		if n < len(buf) {
+			break
+		}
+	}
+	if err := out.Flush(); err != nil {
+		errExitStderr(err)
+	}
+}
+
+// errExitStderr is errExit for -decrypt, where stdout carries the plaintext
+func errExitStderr(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", myName, err)
+	os.Exit(1)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+// nameDumper walks CIPHERDIR for "-dump-names"
+type nameDumper struct {
+	cipherdir string
+	nt        *nametransform.NameTransform
+	// plaintextNames: file names are not encrypted
+	plaintextNames bool
+	out            *bufio.Writer
+	sep            byte
+	// errors is the number of names that could not be decrypted
+	errors int
+}
+
+// dumpNames handles "-dump-names CIPHERDIR": it prints the ciphertext path
+// and the plaintext path of every file and directory in CIPHERDIR, separated
+// by a tab. Ciphertext names cannot contain tabs, so everything after the
+// first tab is the plaintext path.
+func dumpNames(args *argContainer, cipherdir string) {
+	cf, masterkey := loadKey(args, filepath.Join(cipherdir, configfile.ConfDefaultName))
+	d := nameDumper{
+		cipherdir: cipherdir,
+		out:       bufio.NewWriter(os.Stdout),
+		sep:       '\n',
+	}
+	if *args.sep0 {
+		d.sep = 0
+	}
+	// Defaults of "gocryptfs -init" when there is no config file
+	longNames, longNameMax, raw64, hctr2, deterministic, blake3 := true, uint8(0), true, false, false, false
+	if cf != nil {
+		if cf.IsFeatureFlagSet(configfile.FlagFlatLayout) {
+			errExitStderr(fmt.Errorf("-flat filesystems are not supported"))
+		}
+		d.plaintextNames = cf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+		longNames = cf.IsFeatureFlagSet(configfile.FlagLongNames)
+		longNameMax = cf.LongNameMax
+		raw64 = cf.IsFeatureFlagSet(configfile.FlagRaw64)
+		hctr2 = cf.IsFeatureFlagSet(configfile.FlagHCTR2Names)
+		deterministic = !cf.IsFeatureFlagSet(configfile.FlagDirIV)
+		blake3 = cf.IsFeatureFlagSet(configfile.FlagLongNameBLAKE3)
+	}
+	if !d.plaintextNames {
+		var nameCipher nametransform.WideBlockCipher
+		if hctr2 {
+			nameCipher = cryptocore.NewHCTR2(masterkey)
+		} else {
+			// The EME cipher does not depend on the content encryption
+			cc := cryptocore.New(masterkey, cryptocore.BackendGoGCM, 128, cf == nil || cf.IsFeatureFlagSet(configfile.FlagHKDF))
+			defer cc.Wipe()
+			nameCipher = cc.EMECipher
+		}
+		d.nt = nametransform.New(nameCipher, longNames, longNameMax, raw64, nil, deterministic)
+		if blake3 {
+			d.nt.SetLongNameKey(cryptocore.LongNameKey(masterkey))
+		}
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	d.dir("", "")
+	if err := d.out.Flush(); err != nil {
+		errExitStderr(err)
+	}
+	if d.errors > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d names could not be decrypted\n", myName, d.errors)
+		os.Exit(1)
+	}
+}
+
+// dir prints the entries of the directory "cDir", relative to CIPHERDIR,
+// whose plaintext path is "pDir", and descends into the subdirectories
+func (d *nameDumper) dir(cDir string, pDir string) {
+	abs := filepath.Join(d.cipherdir, cDir)
+	entries, err := ioutil.ReadDir(abs)
+	if err != nil {
+		d.fail(cDir, err)
+		return
+	}
+	var iv []byte
+	if d.nt != nil {
+		fd, err := syscall.Open(abs, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err == nil {
+			iv, err = d.nt.ReadDirIVAt(fd)
+			syscall.Close(fd)
+		}
+		if err != nil {
+			d.fail(filepath.Join(cDir, nametransform.DirIVFilename), err)
+			return
+		}
+	}
+	for _, e := range entries {
+		cName := e.Name()
+		if cDir == "" && fusefrontend.IsReservedName(cName) {
+			continue
+		}
+		pName := cName
+		if d.nt != nil {
+			if cName == nametransform.DirIVFilename || nametransform.NameType(cName) == nametransform.LongNameFilename {
+				continue
+			}
+			pName, err = d.decryptName(abs, cName, iv)
+			if err != nil {
+				d.fail(filepath.Join(cDir, cName), err)
+				continue
+			}
+		}
+		cPath, pPath := filepath.Join(cDir, cName), filepath.Join(pDir, pName)
+		fmt.Fprintf(d.out, "%s\t%s%c", cPath, pPath, d.sep)
+		if e.IsDir() {
+			d.dir(cPath, pPath)
+		}
+	}
+}
+
+// decryptName decrypts the name "cName" in the directory "dir". Long names
+// are read from their ".name" file.
+func (d *nameDumper) decryptName(dir string, cName string, iv []byte) (string, error) {
+	if nametransform.IsLongContent(cName) {
+		fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			return "", err
+		}
+		defer syscall.Close(fd)
+		if cName, err = nametransform.ReadLongNameAt(fd, cName); err != nil {
+			return "", err
+		}
+	}
+	return d.nt.DecryptName(cName, iv)
+}
+
+// fail reports that the name at "cPath" could not be decrypted
+func (d *nameDumper) fail(cPath string, err error) {
+	fmt.Fprintf(os.Stderr, "%s: %s: %v\n", myName, cPath, err)
+	d.errors++
+}
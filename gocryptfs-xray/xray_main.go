@@ -13,6 +13,7 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
+	"github.com/rfjakob/gocryptfs/v2/internal/hybridkem"
 	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -38,8 +39,14 @@ func errExit(err error) {
 }
 
 func prettyPrintHeader(h *contentenc.FileHeader, algo cryptocore.AEADTypeEnum) {
-	id := hex.EncodeToString(h.ID)
-	fmt.Printf("Header: Version: %d, Id: %s, assuming %s mode\n", h.Version, id, algo.Algo)
+	out := fmt.Sprintf("Header: Version: %d, Id: %s", h.Version, hex.EncodeToString(h.ID))
+	if h.KeyEpoch != 0 {
+		out += fmt.Sprintf(", KeyEpoch: %d", h.KeyEpoch)
+	}
+	if h.Immutable {
+		out += ", Immutable"
+	}
+	fmt.Printf("%s, assuming %s mode\n", out, algo.Algo)
 }
 
 // printVersion prints a version string like this:
@@ -62,6 +69,8 @@ func usage() {
 		"Examples:\n"+
 		"  gocryptfs-xray myfs/mCXnISiv7nEmyc0glGuhTQ\n"+
 		"  gocryptfs-xray -dumpmasterkey myfs/gocryptfs.conf\n"+
+		"  gocryptfs-xray -decrypt myfs/mCXnISiv7nEmyc0glGuhTQ > plain.txt\n"+
+		"  gocryptfs-xray -dump-names myfs\n"+
 		"  gocryptfs-xray -encrypt-paths myfs.sock\n")
 }
 
@@ -77,24 +86,37 @@ func sum(x ...*bool) (s int) {
 
 type argContainer struct {
 	dumpmasterkey *bool
+	decrypt       *bool
+	dumpNames     *bool
+	masterkey     *string
+	config        *string
 	decryptPaths  *bool
 	encryptPaths  *bool
 	aessiv        *bool
 	xchacha       *bool
+	aegis         *bool
 	sep0          *bool
 	fido2         *string
+	pqkey         *string
 	version       *bool
 }
 
 func main() {
 	var args argContainer
 	args.dumpmasterkey = flag.Bool("dumpmasterkey", false, "Decrypt and dump the master key")
+	args.decrypt = flag.Bool("decrypt", false, "Decrypt the contents of the ciphertext FILE to stdout")
+	args.dumpNames = flag.Bool("dump-names", false, "Print the ciphertext and plaintext path of every file in CIPHERDIR")
+	args.masterkey = flag.String("masterkey", "", "With -decrypt or -dump-names: use this master key instead of the password")
+	args.config = flag.String("config", "", "With -decrypt or -dump-names: use this config file instead of the "+
+		"gocryptfs.conf found above FILE")
 	args.decryptPaths = flag.Bool("decrypt-paths", false, "Decrypt file paths using gocryptfs control socket")
 	args.encryptPaths = flag.Bool("encrypt-paths", false, "Encrypt file paths using gocryptfs control socket")
 	args.sep0 = flag.Bool("0", false, "Use \\0 instead of \\n as separator")
 	args.aessiv = flag.Bool("aessiv", false, "Assume AES-SIV mode instead of AES-GCM")
 	args.xchacha = flag.Bool("xchacha", false, "Assume XChaCha20-Poly1305 mode instead of AES-GCM")
+	args.aegis = flag.Bool("aegis", false, "Assume AEGIS-256 mode instead of AES-GCM")
 	args.fido2 = flag.String("fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
+	args.pqkey = flag.String("pqkey", "", "Key file for a filesystem created with -pqkey")
 	args.version = flag.Bool("version", false, "Print version information")
 
 	flag.Usage = usage
@@ -105,7 +127,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	s := sum(args.dumpmasterkey, args.decryptPaths, args.encryptPaths)
+	s := sum(args.dumpmasterkey, args.decrypt, args.dumpNames, args.decryptPaths, args.encryptPaths)
 	if s > 1 {
 		fmt.Printf("fatal: %d operations were requested\n", s)
 		os.Exit(1)
@@ -121,25 +143,57 @@ func main() {
 	if *args.encryptPaths {
 		encryptPaths(fn, *args.sep0)
 	}
+	if *args.dumpNames {
+		dumpNames(&args, fn)
+		os.Exit(0)
+	}
 	f, err := os.Open(fn)
 	if err != nil {
 		errExit(err)
 	}
 	defer f.Close()
 	if *args.dumpmasterkey {
-		dumpMasterKey(fn, *args.fido2)
+		dumpMasterKey(fn, *args.fido2, *args.pqkey)
+	} else if *args.decrypt {
+		decryptFile(&args, f)
 	} else {
 		inspectCiphertext(&args, f)
 	}
 }
 
-func dumpMasterKey(fn string, fido2Path string) {
+func dumpMasterKey(fn string, fido2Path string, pqkeyPath string) {
 	tlog.Info.Enabled = false
 	cf, err := configfile.Load(fn)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		exitcodes.Exit(err)
 	}
+	masterkey := unlockConfig(cf, fido2Path, pqkeyPath)
+	fmt.Println(hex.EncodeToString(masterkey))
+	// Purge masterkey from memory
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+}
+
+// unlockConfig asks for the password, or uses the FIDO2 token, and returns
+// the master key. Exits on failure.
+func unlockConfig(cf *configfile.ConfFile, fido2Path string, pqkeyPath string) (masterkey []byte) {
+	var err error
+	if cf.IsFeatureFlagSet(configfile.FlagPQHybrid) {
+		if pqkeyPath == "" {
+			tlog.Fatal.Printf("Masterkey protected by a -pqkey key file; need to use the -pqkey option.")
+			os.Exit(exitcodes.Usage)
+		}
+		seed, err := hybridkem.ReadKeyFile(pqkeyPath)
+		if err == nil {
+			err = cf.UnlockPQHybrid(seed)
+		}
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.PQKey)
+		}
+	}
 	var pw []byte
 	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
 		if fido2Path == "" {
@@ -154,7 +208,7 @@ func dumpMasterKey(fn string, fido2Path string) {
 			os.Exit(exitcodes.ReadPassword)
 		}
 	}
-	masterkey, err := cf.DecryptMasterKey(pw)
+	masterkey, err = cf.DecryptMasterKey(pw)
 	// Purge password from memory
 	for i := range pw {
 		pw[i] = 0
@@ -163,11 +217,7 @@ func dumpMasterKey(fn string, fido2Path string) {
 		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.LoadConf)
 	}
-	fmt.Println(hex.EncodeToString(masterkey))
-	// Purge masterkey from memory
-	for i := range masterkey {
-		masterkey[i] = 0
-	}
+	return masterkey
 }
 
 func inspectCiphertext(args *argContainer, fd *os.File) {
@@ -176,6 +226,8 @@ func inspectCiphertext(args *argContainer, fd *os.File) {
 		algo = cryptocore.BackendAESSIV
 	} else if *args.xchacha {
 		algo = cryptocore.BackendXChaCha20Poly1305
+	} else if *args.aegis {
+		algo = cryptocore.BackendAEGIS256
 	}
 	headerBytes := make([]byte, contentenc.HeaderLen)
 	n, err := fd.ReadAt(headerBytes, 0)
@@ -188,7 +240,8 @@ func inspectCiphertext(args *argContainer, fd *os.File) {
 	} else if err != nil {
 		errExit(err)
 	}
-	header, err := contentenc.ParseHeader(headerBytes)
+	// Show whatever is in the header, we do not know the feature flags here
+	header, err := contentenc.ParseHeader(headerBytes, contentenc.HeaderFeatures{KeyEpochs: true, Immutable: true})
 	if err != nil {
 		errExit(err)
 	}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
@@ -108,3 +111,116 @@ func TestEncryptPaths(t *testing.T) {
 		}
 	}
 }
+
+// TestDecrypt checks that "-decrypt" writes the plaintext of a ciphertext
+// file to stdout, with the password or with -masterkey
+func TestDecrypt(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(pDir+"/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	matches, err := filepath.Glob(cDir + "/[^g]*")
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("want one ciphertext file, have %v, %v", matches, err)
+	}
+	cFile := matches[0]
+
+	cmd := exec.Command("../gocryptfs-xray", "-decrypt", cFile)
+	cmd.Stdin = bytes.NewBuffer([]byte("test"))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, content) {
+		t.Errorf("wrong plaintext, len=%d", len(out))
+	}
+
+	cmd = exec.Command("../gocryptfs-xray", "-dumpmasterkey", cDir+"/gocryptfs.conf")
+	cmd.Stdin = bytes.NewBuffer([]byte("test"))
+	key, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = exec.Command("../gocryptfs-xray", "-decrypt", "-masterkey", strings.TrimSpace(string(key)), cFile).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, content) {
+		t.Errorf("-masterkey: wrong plaintext, len=%d", len(out))
+	}
+
+	// Corrupt the second block: the first one is still written
+	f, err := os.OpenFile(cFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff}, 18+4128+100)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = exec.Command("../gocryptfs-xray", "-decrypt", "-masterkey", strings.TrimSpace(string(key)), cFile).Output()
+	if err == nil {
+		t.Error("corrupt block should fail")
+	}
+	if !bytes.Equal(out, content[:4096]) {
+		t.Errorf("corrupt block: wrong plaintext, len=%d", len(out))
+	}
+}
+
+// TestDumpNames checks that "-dump-names" lists every file with its
+// ciphertext and plaintext path
+func TestDumpNames(t *testing.T) {
+	for _, initArgs := range [][]string{nil, {"-deterministic-names"}} {
+		cDir := test_helpers.InitFS(t, initArgs...)
+		pDir := cDir + ".mnt"
+		test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+		long := strings.Repeat("x", 200)
+		want := []string{"dir", "dir/" + long, "dir/sub", "dir/sub/file", "file"}
+		for _, p := range want {
+			var err error
+			if p == "dir" || p == "dir/sub" {
+				err = os.Mkdir(pDir+"/"+p, 0700)
+			} else {
+				err = ioutil.WriteFile(pDir+"/"+p, nil, 0600)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		test_helpers.UnmountPanic(pDir)
+
+		cmd := exec.Command("../gocryptfs-xray", "-dump-names", cDir)
+		cmd.Stdin = bytes.NewBuffer([]byte("test"))
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		have := make(map[string]bool)
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			fields := strings.SplitN(line, "\t", 2)
+			if len(fields) != 2 {
+				t.Fatalf("%v: malformed line %q", initArgs, line)
+			}
+			if _, err := os.Lstat(filepath.Join(cDir, fields[0])); err != nil {
+				t.Errorf("%v: %v", initArgs, err)
+			}
+			have[fields[1]] = true
+		}
+		for _, p := range want {
+			if !have[p] {
+				t.Errorf("%v: %q is missing:\n%s", initArgs, p, out)
+			}
+		}
+		if len(have) != len(want) {
+			t.Errorf("%v: want %d entries, have:\n%s", initArgs, len(want), out)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// healthCheckTimeout is how long a single check of "-health" may take. A
+// hanging FUSE mount blocks forever otherwise.
+const healthCheckTimeout = 10 * time.Second
+
+// Results of a health check
+const (
+	healthOK      = "ok"
+	healthFail    = "fail"
+	healthSkipped = "skipped"
+)
+
+// healthCheck is the result of one check. It is part of the "-health -json"
+// output.
+type healthCheck struct {
+	Name         string
+	Status       string
+	Message      string
+	Milliseconds int64
+}
+
+// healthReport is the "-health -json" output
+type healthReport struct {
+	Mountpoint string
+	Healthy    bool
+	Checks     []healthCheck
+}
+
+// healthTarget is what the checks know about the mount
+type healthTarget struct {
+	mountpoint string
+	cipherdir  string
+	sock       string
+	ro         bool
+}
+
+// run runs the check "f" with a timeout and records the result
+func (r *healthReport) run(name string, f func() (status string, msg string)) {
+	start := time.Now()
+	type result struct{ status, msg string }
+	ch := make(chan result, 1)
+	go func() {
+		status, msg := f()
+		ch <- result{status, msg}
+	}()
+	var res result
+	select {
+	case res = <-ch:
+	case <-time.After(healthCheckTimeout):
+		res = result{healthFail, fmt.Sprintf("no response after %v", healthCheckTimeout)}
+	}
+	if res.status == healthFail {
+		r.Healthy = false
+	}
+	r.Checks = append(r.Checks, healthCheck{
+		Name:         name,
+		Status:       res.status,
+		Message:      res.msg,
+		Milliseconds: time.Since(start).Milliseconds(),
+	})
+}
+
+// healthFindMount checks that "dir" is a gocryptfs mountpoint and returns
+// what the other checks need to know about it
+func healthFindMount(dir string) (t healthTarget, err error) {
+	t.mountpoint, err = filepath.Abs(dir)
+	if err != nil {
+		return t, err
+	}
+	t.mountpoint = realPath(t.mountpoint)
+	mounts, err := gocryptfsMounts()
+	if err != nil {
+		return t, err
+	}
+	for _, m := range mounts {
+		if m.mountpoint != t.mountpoint {
+			continue
+		}
+		t.ro = m.ro || m.reverse
+		// The source is CIPHERDIR unless "-fsname" was used. The control
+		// socket knows for sure.
+		t.cipherdir = m.source
+		if ci, ok := ctlsockInfos()[t.mountpoint]; ok {
+			t.sock = ci.sock
+			t.cipherdir = ci.info.Cipherdir
+		}
+		return t, nil
+	}
+	return t, fmt.Errorf("%q is not a gocryptfs mountpoint", dir)
+}
+
+// healthProbe writes a file through the mount, reads it back and deletes it.
+// Read-only mounts are only listed.
+func healthProbe(t healthTarget) (string, string) {
+	entries, err := ioutil.ReadDir(t.mountpoint)
+	if err != nil {
+		return healthFail, err.Error()
+	}
+	if t.ro {
+		return healthOK, fmt.Sprintf("read-only mount, listed %d entries", len(entries))
+	}
+	probe := filepath.Join(t.mountpoint, fmt.Sprintf(".gocryptfs-health.%d", os.Getpid()))
+	// More than one block, so that the block boundary is exercised as well
+	content := cryptocore.RandBytes(4096 + 100)
+	f, err := os.OpenFile(probe, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return healthFail, err.Error()
+	}
+	defer os.Remove(probe)
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return healthFail, err.Error()
+	}
+	readBack, err := ioutil.ReadFile(probe)
+	if err != nil {
+		return healthFail, err.Error()
+	}
+	if !bytes.Equal(readBack, content) {
+		return healthFail, "the probe file has been read back with different content"
+	}
+	if err = os.Remove(probe); err != nil {
+		return healthFail, err.Error()
+	}
+	return healthOK, fmt.Sprintf("wrote, read back and deleted %d bytes", len(content))
+}
+
+// healthCtlsock checks that the control socket answers
+func healthCtlsock(t healthTarget) (string, string) {
+	if t.sock == "" {
+		return healthSkipped, "no control socket found, mount with -ctlsock to check it"
+	}
+	info, err := queryInfo(t.sock)
+	if err != nil {
+		return healthFail, err.Error()
+	}
+	return healthOK, fmt.Sprintf("%s answers, pid %d", t.sock, info.Pid)
+}
+
+// healthBacking checks that CIPHERDIR is writable and has free space
+func healthBacking(t healthTarget) (string, string) {
+	if !filepath.IsAbs(t.cipherdir) {
+		return healthSkipped, "CIPHERDIR not known, mount with -ctlsock to check it"
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(t.cipherdir, &st); err != nil {
+		return healthFail, err.Error()
+	}
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	if t.ro {
+		return healthOK, fmt.Sprintf("read-only mount, %d MiB free", free>>20)
+	}
+	// Also fails with EROFS on a read-only filesystem
+	if err := unix.Access(t.cipherdir, unix.W_OK); err != nil {
+		return healthFail, fmt.Sprintf("%s: %v", t.cipherdir, err)
+	}
+	if st.Bavail == 0 {
+		return healthFail, fmt.Sprintf("%s: no space left", t.cipherdir)
+	}
+	return healthOK, fmt.Sprintf("%s is writable, %d MiB free", t.cipherdir, free>>20)
+}
+
+// healthRun runs all checks on "dir"
+func healthRun(dir string) *healthReport {
+	r := &healthReport{Mountpoint: dir, Healthy: true}
+	var t healthTarget
+	r.run("mount", func() (string, string) {
+		var err error
+		if t, err = healthFindMount(dir); err != nil {
+			return healthFail, err.Error()
+		}
+		return healthOK, "mounted at " + t.mountpoint
+	})
+	if !r.Healthy {
+		return r
+	}
+	r.Mountpoint = t.mountpoint
+	r.run("probe", func() (string, string) { return healthProbe(t) })
+	r.run("ctlsock", func() (string, string) { return healthCtlsock(t) })
+	r.run("backing", func() (string, string) { return healthBacking(t) })
+	return r
+}
+
+// print writes the report to stdout, as JSON with "-json"
+func (r *healthReport) print(asJSON bool) {
+	if asJSON {
+		out, _ := json.MarshalIndent(r, "", "\t")
+		fmt.Println(string(out))
+		return
+	}
+	for _, c := range r.Checks {
+		fmt.Printf("%-8s %-8s %s (%dms)\n", c.Status, c.Name, c.Message, c.Milliseconds)
+	}
+}
+
+// sdNotify sends "state" to systemd if we run as a Type=notify service
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// Abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns half of the systemd watchdog timeout, or 0 if
+// the watchdog is not enabled for us
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// doHealth handles "-health MOUNTPOINT". Returns the exit code. When started
+// by systemd with a watchdog, it keeps checking and pets the watchdog after
+// every successful round instead.
+func doHealth(args *argContainer) int {
+	if flagSet.NArg() != 1 {
+		tlog.Fatal.Printf("Usage: %s -health [-json] MOUNTPOINT", tlog.ProgramName)
+		return exitcodes.Usage
+	}
+	dir := flagSet.Arg(0)
+	interval := watchdogInterval()
+	if interval == 0 {
+		r := healthRun(dir)
+		r.print(args.json)
+		if !r.Healthy {
+			return exitcodes.Unhealthy
+		}
+		return 0
+	}
+	tlog.Info.Printf("Checking %s every %v for the systemd watchdog", dir, interval)
+	ready := false
+	for {
+		r := healthRun(dir)
+		if r.Healthy {
+			state := "WATCHDOG=1"
+			if !ready {
+				state = "READY=1\n" + state
+				ready = true
+			}
+			if err := sdNotify(state); err != nil {
+				tlog.Warn.Printf("sd_notify: %v", err)
+			}
+		} else {
+			// systemd acts when the watchdog runs out
+			r.print(args.json)
+		}
+		time.Sleep(interval)
+	}
+}
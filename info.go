@@ -23,8 +23,58 @@ func info(filename string) {
 	// Pretty-print
 	fmt.Printf("Creator:           %s\n", cf.Creator)
 	fmt.Printf("FeatureFlags:      %s\n", strings.Join(cf.FeatureFlags, " "))
+	if n := len(cf.Migrations()); n > 0 {
+		fmt.Printf("SchemaVersion:     %d (upgraded from %d, see -migrate-config)\n", cf.SchemaVersion, cf.SchemaVersion-uint16(n))
+	} else {
+		fmt.Printf("SchemaVersion:     %d\n", cf.SchemaVersion)
+	}
 	fmt.Printf("EncryptedKey:      %dB\n", len(cf.EncryptedKey))
-	fmt.Printf("ScryptObject:      Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
-		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+	if a := cf.Argon2idObject; a != nil {
+		fmt.Printf("Argon2idObject:    Salt=%dB Memory=%dKiB Time=%d Threads=%d KeyLen=%d\n",
+			len(a.Salt), a.Memory, a.Time, a.Threads, a.KeyLen)
+	} else {
+		fmt.Printf("ScryptObject:      Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
+			len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+	}
+	if t := cf.TPM2; t != nil {
+		pcrs := t.PCRs
+		if pcrs == "" {
+			pcrs = "none"
+		}
+		fmt.Printf("TPM2:              key slot present, PCRs=%s\n", pcrs)
+	}
+	if p := cf.PKCS11; p != nil {
+		fmt.Printf("PKCS11:            key slot present, Module=%s KeyID=%x\n", p.Module, p.KeyID)
+	}
 	fmt.Printf("contentEncryption: %s\n", algo.Algo) // lowercase because not in JSON
+	if cf.Profile != "" {
+		fmt.Printf("Profile:           %s\n", cf.Profile)
+	}
+	if cf.Label != "" {
+		fmt.Printf("Label:             %s\n", cf.Label)
+	}
+	if cf.Description != "" {
+		fmt.Printf("Description:       %s\n", cf.Description)
+	}
+	if cf.Created != "" {
+		fmt.Printf("Created:           %s\n", cf.Created)
+	}
+	if cf.CreatorHost != "" {
+		fmt.Printf("CreatorHost:       %s\n", cf.CreatorHost)
+	}
+	if len(cf.MountDefaults) > 0 {
+		fmt.Printf("MountDefaults:     %s\n", strings.Join(cf.MountDefaults, ","))
+	}
+	if cf.KeyEpoch > 0 {
+		fmt.Printf("KeyEpoch:          %d\n", cf.KeyEpoch)
+	}
+	if cf.WORMRetention != "" {
+		fmt.Printf("WORMRetention:     %s\n", cf.WORMRetention)
+	}
+	if cf.ImageMaxSize != 0 {
+		fmt.Printf("ImageMaxSize:      %d\n", cf.ImageMaxSize)
+	}
+	for _, sv := range cf.Subvolumes {
+		fmt.Printf("Subvolume:         %s\n", sv.Path)
+	}
 }
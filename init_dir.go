@@ -8,11 +8,14 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/aegis"
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
+	"github.com/rfjakob/gocryptfs/v2/internal/hybridkem"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/pwstrength"
 	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
@@ -48,6 +51,30 @@ func isDir(dir string) error {
 	return nil
 }
 
+// weakPasswordSeconds: we warn about passwords that an offline attack on the
+// config file could guess in less than this (100 years)
+const weakPasswordSeconds = 100 * 365 * 24 * 3600
+
+// checkPasswordStrength estimates how long an offline attack on a config
+// file protected by "password" and scrypt cost "logN" would take. It warns
+// about weak passwords, and exits if "-require-entropy" is not met.
+func checkPasswordStrength(args *argContainer, password []byte, logN int, cost string) {
+	bits := pwstrength.Entropy(password)
+	if args.require_entropy > 0 && bits < float64(args.require_entropy) {
+		tlog.Fatal.Printf("Password rejected: its estimated entropy is %.0f bits, -require-entropy demands %d bits.",
+			bits, args.require_entropy)
+		os.Exit(exitcodes.PasswordWeak)
+	}
+	secs := pwstrength.CrackSeconds(bits, logN)
+	tlog.Info.Printf("Password strength: about %.0f bits. With %s, guessing it would take %s on average.",
+		bits, cost, pwstrength.FormatSeconds(secs))
+	if secs < weakPasswordSeconds {
+		tlog.Info.Printf(tlog.ColorYellow +
+			"Warning: this password is weak. Use a longer password, for example several random words, " +
+			"or a higher KDF cost (-scryptn, -argon2id-memory)." + tlog.ColorReset)
+	}
+}
+
 // initDir handles "gocryptfs -init". It prepares a directory for use as a
 // gocryptfs storage directory.
 // In forward mode, this means creating the gocryptfs.conf and gocryptfs.diriv
@@ -56,6 +83,10 @@ func isDir(dir string) error {
 // not need to be empty.
 func initDir(args *argContainer) {
 	var err error
+	// profile is the summary of "-wizard"
+	var profile string
+	// "-mount-defaults"
+	mountDefaults := parseMountDefaults(args.mount_defaults)
 	if args.reverse {
 		_, err = os.Stat(args.config)
 		if err == nil {
@@ -68,11 +99,39 @@ func initDir(args *argContainer) {
 			tlog.Fatal.Printf("Invalid cipherdir: %v", err)
 			os.Exit(exitcodes.CipherDir)
 		}
+		if args.wizard {
+			profile = initWizard(args)
+		}
 		if !args.xchacha && !stupidgcm.CpuHasAES() {
 			tlog.Info.Printf(tlog.ColorYellow +
 				"Notice: Your CPU does not have AES acceleration. Consider using -xchacha for better performance." +
 				tlog.ColorReset)
 		}
+		if args.aegis && !aegis.Accelerated() {
+			tlog.Fatal.Printf("AEGIS-256 needs a CPU with AES instructions, and is only accelerated on amd64. " +
+				"Use -xchacha on this machine.")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-pqkey": use an existing key file, or create a new one
+	var pqKeySeed []byte
+	if args.pqkey != "" {
+		if _, err = os.Stat(args.pqkey); err == nil {
+			tlog.Info.Printf("Using existing -pqkey key file %q", args.pqkey)
+			pqKeySeed, err = hybridkem.ReadKeyFile(args.pqkey)
+		} else {
+			pqKeySeed, err = hybridkem.CreateKeyFile(args.pqkey)
+			if err == nil {
+				tlog.Info.Printf(tlog.ColorYellow+
+					"Created -pqkey key file %q. You need it, in addition to the password, "+
+					"to unlock the filesystem. Keep a backup copy in a safe place."+
+					tlog.ColorReset, args.pqkey)
+			}
+		}
+		if err != nil {
+			tlog.Fatal.Printf("-pqkey: %v", err)
+			os.Exit(exitcodes.PQKey)
+		}
 	}
 	// Choose password for config file
 	if len(args.extpass) == 0 && args.fido2 == "" {
@@ -92,6 +151,13 @@ func initDir(args *argContainer) {
 				tlog.Fatal.Println(err)
 				os.Exit(exitcodes.ReadPassword)
 			}
+			if args.argon2id {
+				a := configfile.NewArgon2idKDF(uint32(args.argon2id_memory*1024), uint32(args.argon2id_time))
+				checkPasswordStrength(args, password, a.EquivalentLogN(),
+					fmt.Sprintf("-argon2id-memory=%d -argon2id-time=%d", args.argon2id_memory, args.argon2id_time))
+			} else {
+				checkPasswordStrength(args, password, args.scryptn, fmt.Sprintf("-scryptn=%d", args.scryptn))
+			}
 			fido2CredentialID = nil
 			fido2HmacSalt = nil
 		}
@@ -101,13 +167,35 @@ func initDir(args *argContainer) {
 			Password:           password,
 			PlaintextNames:     args.plaintextnames,
 			LogN:               args.scryptn,
+			ScryptR:            args.scryptr,
+			ScryptP:            args.scryptp,
+			Argon2id:           args.argon2id,
+			Argon2idMemory:     uint32(args.argon2id_memory * 1024),
+			Argon2idTime:       uint32(args.argon2id_time),
 			Creator:            creator,
 			AESSIV:             args.aessiv,
 			Fido2CredentialID:  fido2CredentialID,
 			Fido2HmacSalt:      fido2HmacSalt,
 			DeterministicNames: args.deterministic_names,
 			XChaCha20Poly1305:  args.xchacha,
+			AEGIS256:           args.aegis,
+			AES128:             args.aes128,
 			LongNameMax:        args.longnamemax,
+			LongNameBLAKE3:     args.longnamehash == nametransform.LongNameHashBLAKE3,
+			HCTR2Names:         args.hctr2,
+			MerkleTree:         args.merkle,
+			BindPath:           args.bindpath,
+			FlatLayout:         args.flat,
+			FlatImage:          args.image != "" || args.image_size > 0 || args.container != "",
+			ImageMaxSize:       args.size,
+			WORM:               args.worm,
+			WORMRetention:      args.worm_retention,
+			Immutable:          args.immutable,
+			PQKeySeed:          pqKeySeed,
+			Profile:            profile,
+			Label:              args.label,
+			Description:        args.description,
+			MountDefaults:      mountDefaults,
 		})
 		if err != nil {
 			tlog.Fatal.Println(err)
@@ -116,11 +204,20 @@ func initDir(args *argContainer) {
 		for i := range password {
 			password[i] = 0
 		}
+		for i := range pqKeySeed {
+			pqKeySeed[i] = 0
+		}
 		// password runs out of scope here
 	}
+	if args.image != "" || args.image_size > 0 || args.container != "" {
+		if err := initImage(args); err != nil {
+			tlog.Fatal.Printf("-image: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+	}
 	// Forward mode with filename encryption enabled needs a gocryptfs.diriv file
-	// in the root dir
-	if !args.plaintextnames && !args.reverse && !args.deterministic_names {
+	// in the root dir. The flat layout has no encrypted names on disk.
+	if !args.plaintextnames && !args.reverse && !args.deterministic_names && !args.flat {
 		// Open cipherdir (following symlinks)
 		dirfd, err := syscall.Open(args.cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 		if err == nil {
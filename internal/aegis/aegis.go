@@ -0,0 +1,212 @@
+// Package aegis implements the AEGIS-256 authenticated cipher with 128-bit
+// tags, as specified in draft-irtf-cfrg-aegis-aead, in a cipher.AEAD
+// interface.
+//
+// AEGIS-256 is built from the AES round function. On amd64 CPUs with AES
+// instructions, it runs in assembly and is considerably faster than AES-GCM.
+// Elsewhere, a portable implementation is used that is slow and, like all
+// table-based AES implementations, not constant-time.
+package aegis
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// KeySize is the key length in bytes
+	KeySize = 32
+	// NonceSize is the nonce length in bytes
+	NonceSize = 32
+	// TagSize is the length of the authentication tag in bytes
+	TagSize = 16
+)
+
+// block is one AES block
+type block = [16]byte
+
+// state is the AEGIS-256 state S0...S5
+type state [6]block
+
+// The constants C0 and C1 (Fibonacci numbers mod 256)
+var (
+	c0 = block{0x00, 0x01, 0x01, 0x02, 0x03, 0x05, 0x08, 0x0d, 0x15, 0x22, 0x37, 0x59, 0x90, 0xe9, 0x79, 0x62}
+	c1 = block{0xdb, 0x3d, 0x18, 0x55, 0x6d, 0xc2, 0x2f, 0xf1, 0x20, 0x11, 0x31, 0x42, 0x73, 0xb5, 0x28, 0xdd}
+)
+
+var errOpen = errors.New("aegis: message authentication failed")
+
+type aegis256 struct {
+	key [KeySize]byte
+}
+
+var _ cipher.AEAD = &aegis256{}
+
+// New returns a new AEGIS-256 cipher.AEAD. The key is copied.
+func New(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("aegis: key must be %d bytes long, have %d", KeySize, len(key))
+	}
+	a := &aegis256{}
+	copy(a.key[:], key)
+	return a, nil
+}
+
+func (a *aegis256) NonceSize() int {
+	return NonceSize
+}
+
+func (a *aegis256) Overhead() int {
+	return TagSize
+}
+
+// Seal encrypts and authenticates "plaintext", authenticates
+// "additionalData" and appends the result to "dst"
+func (a *aegis256) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != NonceSize {
+		panic("aegis: wrong nonce length")
+	}
+	ret, out := sliceForAppend(dst, len(plaintext)+TagSize)
+	var s state
+	s.init(a.key[:], nonce)
+	s.absorb(additionalData)
+	full := len(plaintext) &^ 15
+	encBlocks(&s, out, plaintext[:full])
+	if full < len(plaintext) {
+		var tmp block
+		copy(tmp[:], plaintext[full:])
+		encBlocks(&s, tmp[:], tmp[:])
+		copy(out[full:], tmp[:len(plaintext)-full])
+	}
+	tag := s.finalize(len(additionalData), len(plaintext))
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+// Open authenticates and decrypts "ciphertext", authenticates
+// "additionalData" and, if successful, appends the plaintext to "dst"
+func (a *aegis256) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != NonceSize {
+		panic("aegis: wrong nonce length")
+	}
+	if len(ciphertext) < TagSize {
+		return nil, errOpen
+	}
+	tagIn := ciphertext[len(ciphertext)-TagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-TagSize]
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	var s state
+	s.init(a.key[:], nonce)
+	s.absorb(additionalData)
+	full := len(ciphertext) &^ 15
+	decBlocks(&s, out, ciphertext[:full])
+	if full < len(ciphertext) {
+		// Only the real plaintext bytes go into the state, padded with zeros
+		var tmp block
+		copy(tmp[:], ciphertext[full:])
+		z := s.keystream()
+		n := len(ciphertext) - full
+		for i := 0; i < n; i++ {
+			tmp[i] ^= z[i]
+		}
+		for i := n; i < len(tmp); i++ {
+			tmp[i] = 0
+		}
+		copy(out[full:], tmp[:n])
+		absorbBlocks(&s, tmp[:])
+	}
+	tag := s.finalize(len(additionalData), len(ciphertext))
+	if subtle.ConstantTimeCompare(tag[:], tagIn) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// init loads key and nonce into the state
+func (s *state) init(key []byte, nonce []byte) {
+	var k0, k1, n0, n1 block
+	copy(k0[:], key[:16])
+	copy(k1[:], key[16:])
+	copy(n0[:], nonce[:16])
+	copy(n1[:], nonce[16:])
+	s[0] = xor(k0, n0)
+	s[1] = xor(k1, n1)
+	s[2] = c1
+	s[3] = c0
+	s[4] = xor(k0, c0)
+	s[5] = xor(k1, c1)
+	// 4 rounds of Update(k0), Update(k1), Update(k0^n0), Update(k1^n1)
+	var buf [4 * 4 * 16]byte
+	for i := 0; i < 4; i++ {
+		copy(buf[64*i:], k0[:])
+		copy(buf[64*i+16:], k1[:])
+		copy(buf[64*i+32:], s[0][:])
+		copy(buf[64*i+48:], s[1][:])
+	}
+	absorbBlocks(s, buf[:])
+}
+
+// absorb feeds the associated data "ad", padded with zeros, into the state
+func (s *state) absorb(ad []byte) {
+	full := len(ad) &^ 15
+	absorbBlocks(s, ad[:full])
+	if full < len(ad) {
+		var tmp block
+		copy(tmp[:], ad[full:])
+		absorbBlocks(s, tmp[:])
+	}
+}
+
+// keystream returns S1 ^ S4 ^ S5 ^ (S2 & S3)
+func (s *state) keystream() (z block) {
+	for i := range z {
+		z[i] = s[1][i] ^ s[4][i] ^ s[5][i] ^ (s[2][i] & s[3][i])
+	}
+	return z
+}
+
+// finalize returns the tag for "adLen" bytes of associated data and "msgLen"
+// bytes of message
+func (s *state) finalize(adLen int, msgLen int) (tag block) {
+	var t block
+	binary.LittleEndian.PutUint64(t[:], uint64(adLen)*8)
+	binary.LittleEndian.PutUint64(t[8:], uint64(msgLen)*8)
+	t = xor(t, s[3])
+	var buf [7 * 16]byte
+	for i := 0; i < 7; i++ {
+		copy(buf[16*i:], t[:])
+	}
+	absorbBlocks(s, buf[:])
+	for i := range s {
+		tag = xor(tag, s[i])
+	}
+	return tag
+}
+
+func xor(a block, b block) (out block) {
+	for i := range out {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// sliceForAppend takes a slice and a requested number of bytes. It returns a
+// slice with the contents of the given slice followed by that many bytes and
+// a second slice that aliases into it and contains only the extra bytes.
+// Copied from crypto/cipher.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,49 @@
+package aegis
+
+import (
+	"golang.org/x/sys/cpu"
+)
+
+// useAsm is set if the CPU has the AES instructions the assembly needs
+var useAsm = cpu.X86.HasAES
+
+// Accelerated tells you if AEGIS-256 runs with AES instructions on this
+// machine
+func Accelerated() bool {
+	return useAsm
+}
+
+// Implemented in aegis_amd64.s
+//
+//go:noescape
+func absorbBlocksAsm(s *state, src []byte)
+
+//go:noescape
+func encBlocksAsm(s *state, dst []byte, src []byte)
+
+//go:noescape
+func decBlocksAsm(s *state, dst []byte, src []byte)
+
+func absorbBlocks(s *state, src []byte) {
+	if useAsm {
+		absorbBlocksAsm(s, src)
+		return
+	}
+	absorbBlocksGeneric(s, src)
+}
+
+func encBlocks(s *state, dst []byte, src []byte) {
+	if useAsm {
+		encBlocksAsm(s, dst, src)
+		return
+	}
+	encBlocksGeneric(s, dst, src)
+}
+
+func decBlocks(s *state, dst []byte, src []byte) {
+	if useAsm {
+		decBlocksAsm(s, dst, src)
+		return
+	}
+	decBlocksGeneric(s, dst, src)
+}
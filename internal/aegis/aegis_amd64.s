@@ -0,0 +1,108 @@
+#include "textflag.h"
+
+// The state S0...S5 is kept in X0...X5 while processing a buffer.
+
+#define LOAD_STATE(p) \
+	MOVOU 0(p), X0; \
+	MOVOU 16(p), X1; \
+	MOVOU 32(p), X2; \
+	MOVOU 48(p), X3; \
+	MOVOU 64(p), X4; \
+	MOVOU 80(p), X5
+
+#define STORE_STATE(p) \
+	MOVOU X0, 0(p); \
+	MOVOU X1, 16(p); \
+	MOVOU X2, 32(p); \
+	MOVOU X3, 48(p); \
+	MOVOU X4, 64(p); \
+	MOVOU X5, 80(p)
+
+// UPDATE is Update(M). S(i) becomes AESRound(S(i-1), S(i)), S0 becomes
+// AESRound(S5, S0 ^ M). Clobbers X7 and X8.
+#define UPDATE(M) \
+	MOVO X5, X8; \
+	MOVO X4, X7; AESENC X5, X7; MOVO X7, X5; \
+	MOVO X3, X7; AESENC X4, X7; MOVO X7, X4; \
+	MOVO X2, X7; AESENC X3, X7; MOVO X7, X3; \
+	MOVO X1, X7; AESENC X2, X7; MOVO X7, X2; \
+	MOVO X0, X7; AESENC X1, X7; MOVO X7, X1; \
+	PXOR M, X0; AESENC X0, X8; MOVO X8, X0
+
+// KEYSTREAM computes S1 ^ S4 ^ S5 ^ (S2 & S3) into Z
+#define KEYSTREAM(Z) \
+	MOVO X2, Z; \
+	PAND X3, Z; \
+	PXOR X1, Z; \
+	PXOR X4, Z; \
+	PXOR X5, Z
+
+// func absorbBlocksAsm(s *state, src []byte)
+TEXT ·absorbBlocksAsm(SB), NOSPLIT, $0-32
+	MOVQ s+0(FP), AX
+	MOVQ src_base+8(FP), SI
+	MOVQ src_len+16(FP), CX
+	LOAD_STATE(AX)
+
+loop:
+	CMPQ CX, $16
+	JB   done
+	MOVOU (SI), X6
+	UPDATE(X6)
+	ADDQ $16, SI
+	SUBQ $16, CX
+	JMP  loop
+
+done:
+	STORE_STATE(AX)
+	RET
+
+// func encBlocksAsm(s *state, dst []byte, src []byte)
+TEXT ·encBlocksAsm(SB), NOSPLIT, $0-56
+	MOVQ s+0(FP), AX
+	MOVQ dst_base+8(FP), DI
+	MOVQ src_base+32(FP), SI
+	MOVQ src_len+40(FP), CX
+	LOAD_STATE(AX)
+
+loop:
+	CMPQ CX, $16
+	JB   done
+	MOVOU (SI), X6
+	KEYSTREAM(X9)
+	PXOR X6, X9
+	MOVOU X9, (DI)
+	UPDATE(X6)
+	ADDQ $16, SI
+	ADDQ $16, DI
+	SUBQ $16, CX
+	JMP  loop
+
+done:
+	STORE_STATE(AX)
+	RET
+
+// func decBlocksAsm(s *state, dst []byte, src []byte)
+TEXT ·decBlocksAsm(SB), NOSPLIT, $0-56
+	MOVQ s+0(FP), AX
+	MOVQ dst_base+8(FP), DI
+	MOVQ src_base+32(FP), SI
+	MOVQ src_len+40(FP), CX
+	LOAD_STATE(AX)
+
+loop:
+	CMPQ CX, $16
+	JB   done
+	MOVOU (SI), X6
+	KEYSTREAM(X9)
+	PXOR X9, X6
+	MOVOU X6, (DI)
+	UPDATE(X6)
+	ADDQ $16, SI
+	ADDQ $16, DI
+	SUBQ $16, CX
+	JMP  loop
+
+done:
+	STORE_STATE(AX)
+	RET
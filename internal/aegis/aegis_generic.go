@@ -0,0 +1,115 @@
+package aegis
+
+// Portable implementation of the state update, using lookup tables for the
+// AES round function
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// sbox is the AES S-box, te0 the first of the usual "T-tables" that combine
+// SubBytes and MixColumns. Row 0 of a column is in the lowest byte.
+var (
+	sbox [256]byte
+	te0  [256]uint32
+)
+
+func init() {
+	// Walk the multiplicative group with generator 3, computing the
+	// inverse along the way, and apply the affine transformation
+	p, q := byte(1), byte(1)
+	for {
+		p = p ^ p<<1 ^ xtimeCarry(p)
+		q ^= q << 1
+		q ^= q << 2
+		q ^= q << 4
+		if q&0x80 != 0 {
+			q ^= 0x09
+		}
+		sbox[p] = q ^ bits.RotateLeft8(q, 1) ^ bits.RotateLeft8(q, 2) ^
+			bits.RotateLeft8(q, 3) ^ bits.RotateLeft8(q, 4) ^ 0x63
+		if p == 1 {
+			break
+		}
+	}
+	sbox[0] = 0x63
+	for i, s := range sbox {
+		s2 := s<<1 ^ xtimeCarry(s)
+		te0[i] = uint32(s2) | uint32(s)<<8 | uint32(s)<<16 | uint32(s2^s)<<24
+	}
+}
+
+// xtimeCarry returns the reduction that has to be applied when multiplying
+// "b" by 2 in GF(2^8)
+func xtimeCarry(b byte) byte {
+	if b&0x80 != 0 {
+		return 0x1b
+	}
+	return 0
+}
+
+// aesRound computes one AES encryption round (SubBytes, ShiftRows,
+// MixColumns, AddRoundKey) of "in" with the round key "rk", like the AESENC
+// instruction. "out" may alias "in" or "rk".
+func aesRound(out *block, in *block, rk *block) {
+	var t [4]uint32
+	for c := 0; c < 4; c++ {
+		t[c] = te0[in[4*c]] ^
+			bits.RotateLeft32(te0[in[4*((c+1)%4)+1]], 8) ^
+			bits.RotateLeft32(te0[in[4*((c+2)%4)+2]], 16) ^
+			bits.RotateLeft32(te0[in[4*((c+3)%4)+3]], 24) ^
+			binary.LittleEndian.Uint32(rk[4*c:])
+	}
+	for c := 0; c < 4; c++ {
+		binary.LittleEndian.PutUint32(out[4*c:], t[c])
+	}
+}
+
+// updateGeneric is the AEGIS-256 Update(M) function
+func (s *state) updateGeneric(m *block) {
+	old5 := s[5]
+	for i := 5; i > 0; i-- {
+		aesRound(&s[i], &s[i-1], &s[i])
+	}
+	rk := xor(s[0], *m)
+	aesRound(&s[0], &old5, &rk)
+}
+
+// absorbBlocksGeneric updates the state with every 16-byte block in "src"
+func absorbBlocksGeneric(s *state, src []byte) {
+	var m block
+	for len(src) >= 16 {
+		copy(m[:], src)
+		s.updateGeneric(&m)
+		src = src[16:]
+	}
+}
+
+// encBlocksGeneric encrypts the 16-byte blocks in "src" to "dst"
+func encBlocksGeneric(s *state, dst []byte, src []byte) {
+	var m block
+	for len(src) >= 16 {
+		copy(m[:], src)
+		z := s.keystream()
+		for i := range z {
+			dst[i] = m[i] ^ z[i]
+		}
+		s.updateGeneric(&m)
+		src, dst = src[16:], dst[16:]
+	}
+}
+
+// decBlocksGeneric decrypts the 16-byte blocks in "src" to "dst"
+func decBlocksGeneric(s *state, dst []byte, src []byte) {
+	var m block
+	for len(src) >= 16 {
+		z := s.keystream()
+		for i := range m {
+			m[i] = src[i] ^ z[i]
+		}
+		copy(dst, m[:])
+		s.updateGeneric(&m)
+		src, dst = src[16:], dst[16:]
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !amd64
+// +build !amd64
+
+package aegis
+
+// useAsm is always false, there is no assembly for this architecture
+var useAsm = false
+
+// Accelerated tells you if AEGIS-256 runs with AES instructions on this
+// machine
+func Accelerated() bool {
+	return useAsm
+}
+
+func absorbBlocks(s *state, src []byte) {
+	absorbBlocksGeneric(s, src)
+}
+
+func encBlocks(s *state, dst []byte, src []byte) {
+	encBlocksGeneric(s, dst, src)
+}
+
+func decBlocks(s *state, dst []byte, src []byte) {
+	decBlocksGeneric(s, dst, src)
+}
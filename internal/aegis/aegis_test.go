@@ -0,0 +1,103 @@
+package aegis
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Test vectors from draft-irtf-cfrg-aegis-aead, appendix A.3
+var vectors = []struct {
+	ad, msg, ct, tag string
+}{
+	{"", "00000000000000000000000000000000", "754fc3d8c973246dcc6d741412a4b236", "3fe91994768b332ed7f570a19ec5896e"},
+	{"", "", "", "e3def978a0f054afd1e761d7553afba3"},
+	{"0001020304050607", "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		"f373079ed84b2709faee373584585d60accd191db310ef5d8b11833df9dec711", "8d86f91ee606e9ff26a01b64ccbdd91d"},
+	{"0001020304050607", "000102030405060708090a0b0c0d", "f373079ed84b2709faee37358458", "c60b9c2d33ceb058f96e6dd03c215652"},
+}
+
+func TestVectors(t *testing.T) {
+	key := unhex("1001000000000000000000000000000000000000000000000000000000000000")
+	nonce := unhex("1000020000000000000000000000000000000000000000000000000000000000")
+	a, err := New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range vectors {
+		want := unhex(v.ct + v.tag)
+		have := a.Seal(nil, nonce, unhex(v.msg), unhex(v.ad))
+		if !bytes.Equal(have, want) {
+			t.Errorf("vector %d: want %x, have %x", i, want, have)
+		}
+		msg, err := a.Open(nil, nonce, want, unhex(v.ad))
+		if err != nil || !bytes.Equal(msg, unhex(v.msg)) {
+			t.Errorf("vector %d: Open: %x, %v", i, msg, err)
+		}
+		want[0] ^= 1
+		if _, err = a.Open(nil, nonce, want, unhex(v.ad)); err == nil {
+			t.Errorf("vector %d: tampered ciphertext was accepted", i)
+		}
+	}
+}
+
+// The assembly and the portable implementation must agree
+func TestGeneric(t *testing.T) {
+	if !Accelerated() {
+		t.Skip("no assembly on this machine")
+	}
+	defer func() { useAsm = true }()
+	key := make([]byte, KeySize)
+	nonce := make([]byte, NonceSize)
+	rand.Read(key)
+	rand.Read(nonce)
+	a, _ := New(key)
+	for _, n := range []int{0, 1, 15, 16, 17, 100, 4096} {
+		msg := make([]byte, n)
+		ad := make([]byte, n/3)
+		rand.Read(msg)
+		rand.Read(ad)
+		useAsm = true
+		ct := a.Seal(nil, nonce, msg, ad)
+		useAsm = false
+		if ct2 := a.Seal(nil, nonce, msg, ad); !bytes.Equal(ct, ct2) {
+			t.Fatalf("n=%d: assembly and generic code disagree", n)
+		}
+		if msg2, err := a.Open(nil, nonce, ct, ad); err != nil || !bytes.Equal(msg, msg2) {
+			t.Fatalf("n=%d: generic Open failed: %v", n, err)
+		}
+	}
+}
+
+// Seal and Open must work in place
+func TestInPlace(t *testing.T) {
+	a, _ := New(make([]byte, KeySize))
+	nonce := make([]byte, NonceSize)
+	msg := []byte("hello world, this is more than one block")
+	buf := append([]byte{}, msg...)
+	ct := a.Seal(buf[:0], nonce, buf, nil)
+	pt, err := a.Open(ct[:0], nonce, ct, nil)
+	if err != nil || !bytes.Equal(pt, msg) {
+		t.Errorf("in-place round trip failed: %q, %v", pt, err)
+	}
+}
+
+func BenchmarkSeal4K(b *testing.B) {
+	a, _ := New(make([]byte, KeySize))
+	nonce := make([]byte, NonceSize)
+	in := make([]byte, 4096)
+	out := make([]byte, 0, 4096+TagSize)
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		a.Seal(out, nonce, in, nil)
+	}
+}
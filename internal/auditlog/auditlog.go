@@ -0,0 +1,250 @@
+// Package auditlog implements the "-auditlog" log of destructive operations.
+//
+// The log is a file in the root of CIPHERDIR with one JSON record per line.
+// Each record carries an HMAC-SHA256 over its contents and the MAC of the
+// previous record, keyed with a key derived from the master key. Changing,
+// inserting, deleting or reordering records without the master key breaks
+// the chain. Removing records from the end of the log cannot be detected
+// from the log alone, compare the record count with an earlier one for that.
+package auditlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// FileName is the name of the log in the root of CIPHERDIR
+const FileName = "gocryptfs.auditlog"
+
+// Operations that are logged
+const (
+	OpUnlink   = "unlink"
+	OpRmdir    = "rmdir"
+	OpRename   = "rename"
+	OpTruncate = "truncate"
+)
+
+// Record is one line in the log. Paths are ciphertext paths relative to
+// CIPHERDIR, so the log does not reveal file names.
+type Record struct {
+	// Seq counts the records, starting at 1
+	Seq uint64
+	// Time in Unix seconds
+	Time int64
+	// Op is one of the Op* constants
+	Op   string
+	Path string
+	// NewPath is the target of a rename
+	NewPath string `json:",omitempty"`
+	// Size is the new plaintext size after a truncate
+	Size uint64 `json:",omitempty"`
+	// MAC authenticates the record and the previous MAC
+	MAC []byte `json:",omitempty"`
+}
+
+// mac computes the MAC of "r" chained to "prev". r.MAC is ignored.
+func (r Record) mac(key []byte, prev []byte) []byte {
+	r.MAC = nil
+	buf, err := json.Marshal(r)
+	if err != nil {
+		// Cannot happen for this struct
+		panic(err)
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(prev)
+	h.Write(buf)
+	return h.Sum(nil)
+}
+
+// Log is the audit log of a CIPHERDIR. All methods are safe for concurrent
+// use. A nil *Log logs nothing.
+type Log struct {
+	path string
+	key  []byte
+	// mu protects the fields below
+	mu sync.Mutex
+	// f is the log file opened for appending, nil before Open()
+	f *os.File
+	// size is the length of the log file
+	size int64
+	// seq and lastMAC belong to the last record in the log
+	seq     uint64
+	lastMAC []byte
+}
+
+// New returns the Log of "cipherdir", authenticated with "key". It does not
+// touch the file, call Open() to append to it or Verify() to check it.
+func New(cipherdir string, key []byte) *Log {
+	return &Log{
+		path: filepath.Join(cipherdir, FileName),
+		key:  key,
+	}
+}
+
+// verify reads and checks the records in "r". It returns the number of
+// records, the MAC of the last one, and the length of the valid part. An
+// incomplete last line, as left by a crash, is not an error, but is not
+// included in "validLen".
+func verify(r io.Reader, key []byte) (seq uint64, lastMAC []byte, validLen int64, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				tlog.Warn.Printf("auditlog: ignoring incomplete record %d", seq+1)
+			}
+			return seq, lastMAC, validLen, nil
+		} else if err != nil {
+			return 0, nil, 0, err
+		}
+		var rec Record
+		if err = json.Unmarshal(line, &rec); err != nil {
+			return 0, nil, 0, fmt.Errorf("record %d: %v", seq+1, err)
+		}
+		if rec.Seq != seq+1 {
+			return 0, nil, 0, fmt.Errorf("record %d: has sequence number %d", seq+1, rec.Seq)
+		}
+		mac := rec.mac(key, lastMAC)
+		if !hmac.Equal(mac, rec.MAC) {
+			return 0, nil, 0, fmt.Errorf("record %d: MAC mismatch, the log has been tampered with", rec.Seq)
+		}
+		seq = rec.Seq
+		lastMAC = mac
+		validLen += int64(len(line))
+	}
+}
+
+// CheckFormat returns an error if the file "path" does not look like a log.
+// The MACs cannot be checked without the key. With "-plaintextnames", a user
+// file in CIPHERDIR can have the name of the log, and Open() would cut it
+// off.
+func CheckFormat(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	for seq := uint64(1); ; seq++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// An incomplete last record, see verify()
+			if len(line) > 0 && !bytes.HasPrefix(line, []byte(`{"Seq":`)) {
+				return fmt.Errorf("%s is not an audit log", path)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var rec Record
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&rec); err != nil || rec.Seq != seq || len(rec.MAC) != sha256.Size {
+			return fmt.Errorf("%s is not an audit log", path)
+		}
+	}
+}
+
+// Verify checks the whole log and returns the number of records. A missing
+// log has zero records.
+func (l *Log) Verify() (n uint64, err error) {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, _, _, err = verify(f, l.key)
+	return n, err
+}
+
+// Open verifies the log, creating it if it does not exist, and opens it for
+// appending. An incomplete last record is cut off.
+func (l *Log) Open() error {
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	seq, lastMAC, validLen, err := verify(f, l.key)
+	if err == nil {
+		err = f.Truncate(validLen)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v", l.path, err)
+	}
+	l.mu.Lock()
+	l.f = f
+	l.size = validLen
+	l.seq = seq
+	l.lastMAC = lastMAC
+	l.mu.Unlock()
+	return nil
+}
+
+// Add durably appends a record for operation "op" on the ciphertext path
+// "path". "newPath" and "size" are only used by renames and truncates.
+func (l *Log) Add(op string, path string, newPath string, size uint64) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return fmt.Errorf("auditlog: not open")
+	}
+	rec := Record{
+		Seq:     l.seq + 1,
+		Time:    time.Now().Unix(),
+		Op:      op,
+		Path:    path,
+		NewPath: newPath,
+		Size:    size,
+	}
+	rec.MAC = rec.mac(l.key, l.lastMAC)
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	if _, err = l.f.WriteAt(buf, l.size); err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		// Cut off what we may have written, so the next record still
+		// continues the chain
+		l.f.Truncate(l.size)
+		return err
+	}
+	l.size += int64(len(buf))
+	l.seq = rec.Seq
+	l.lastMAC = rec.MAC
+	return nil
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,110 @@
+package auditlog
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{1}, 32)
+
+// newTestLog creates a log with three records
+func newTestLog(t *testing.T) (l *Log, path string) {
+	dir := t.TempDir()
+	l = New(dir, testKey)
+	if err := l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add(OpUnlink, "a", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add(OpRename, "b", "c/d", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Add(OpTruncate, "e", "", 123); err != nil {
+		t.Fatal(err)
+	}
+	return l, filepath.Join(dir, FileName)
+}
+
+func TestAddVerify(t *testing.T) {
+	l, _ := newTestLog(t)
+	l.Close()
+	n, err := l.Verify()
+	if err != nil || n != 3 {
+		t.Fatalf("Verify: n=%d err=%v", n, err)
+	}
+	// Reopening continues the chain
+	if err = l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Add(OpRmdir, "f", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if n, err = l.Verify(); err != nil || n != 4 {
+		t.Errorf("Verify after reopen: n=%d err=%v", n, err)
+	}
+	// A different key does not verify
+	if _, err = New(filepath.Dir(l.path), bytes.Repeat([]byte{2}, 32)).Verify(); err == nil {
+		t.Error("Verify with wrong key should have failed")
+	}
+}
+
+func TestTamper(t *testing.T) {
+	l, path := newTestLog(t)
+	l.Close()
+	orig, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(orig), "\n")
+	testcases := map[string]string{
+		"modified": strings.Replace(string(orig), `"Path":"b"`, `"Path":"x"`, 1),
+		"deleted":  lines[0] + lines[2],
+		"swapped":  lines[1] + lines[0] + lines[2],
+	}
+	for name, content := range testcases {
+		if err = os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = l.Verify(); err == nil {
+			t.Errorf("%s: Verify should have failed", name)
+		}
+		if err = l.Open(); err == nil {
+			t.Errorf("%s: Open should have failed", name)
+			l.Close()
+		}
+	}
+}
+
+// An incomplete record after a crash is cut off
+func TestIncomplete(t *testing.T) {
+	l, path := newTestLog(t)
+	l.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"Seq":4,"Ti`))
+	f.Close()
+	if err = l.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Add(OpUnlink, "g", "", 0); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if n, err := l.Verify(); err != nil || n != 4 {
+		t.Errorf("Verify: n=%d err=%v", n, err)
+	}
+}
+
+func TestNil(t *testing.T) {
+	var l *Log
+	if l.Add(OpUnlink, "a", "", 0) != nil || l.Close() != nil {
+		t.Error("nil Log should do nothing")
+	}
+}
@@ -0,0 +1,185 @@
+// Package blake3 implements the BLAKE3 hash function in its hash and keyed
+// hash modes, with a 256-bit output.
+//
+// Only what gocryptfs needs is implemented: one-shot hashing of short
+// inputs, without SIMD and without extendable output.
+package blake3
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	// Size is the length of the hash in bytes
+	Size = 32
+	// KeySize is the length of the key in bytes
+	KeySize = 32
+
+	blockLen = 64
+	chunkLen = 1024
+)
+
+// Domain separation flags
+const (
+	flagChunkStart = 1 << iota
+	flagChunkEnd
+	flagParent
+	flagRoot
+	flagKeyedHash
+)
+
+var iv = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+// schedule holds the message word order for each of the 7 rounds, that is,
+// the message permutation applied 0 to 6 times
+var schedule [7][16]uint8
+
+func init() {
+	perm := [16]uint8{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+	for i := range schedule[0] {
+		schedule[0][i] = uint8(i)
+	}
+	for r := 1; r < len(schedule); r++ {
+		for i := range schedule[r] {
+			schedule[r][i] = schedule[r-1][perm[i]]
+		}
+	}
+}
+
+// Sum256 returns the BLAKE3 hash of "data"
+func Sum256(data []byte) [Size]byte {
+	return hash(&iv, 0, data)
+}
+
+// SumKeyed256 returns the BLAKE3 keyed hash of "data" under "key"
+func SumKeyed256(key *[KeySize]byte, data []byte) [Size]byte {
+	var k [8]uint32
+	for i := range k {
+		k[i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	return hash(&k, flagKeyedHash, data)
+}
+
+// hash splits "data" into chunks and reduces their chaining values to the
+// root, merging subtrees as soon as they are complete
+func hash(key *[8]uint32, flags uint32, data []byte) [Size]byte {
+	var stack [][8]uint32
+	var counter uint64
+	for len(data) > chunkLen {
+		o := chunkOutput(key, flags, counter, data[:chunkLen])
+		cv := o.chainingValue()
+		data = data[chunkLen:]
+		counter++
+		for total := counter; total&1 == 0; total >>= 1 {
+			o = parentOutput(key, flags, &stack[len(stack)-1], &cv)
+			cv = o.chainingValue()
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, cv)
+	}
+	out := chunkOutput(key, flags, counter, data)
+	for i := len(stack) - 1; i >= 0; i-- {
+		cv := out.chainingValue()
+		out = parentOutput(key, flags, &stack[i], &cv)
+	}
+	return out.root()
+}
+
+// output is a compression that has not been carried out yet, because its
+// flags depend on whether it is the root
+type output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *output) chainingValue() (cv [8]uint32) {
+	s := compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+	copy(cv[:], s[:8])
+	return cv
+}
+
+func (o *output) root() (out [Size]byte) {
+	s := compress(&o.cv, &o.block, 0, o.blockLen, o.flags|flagRoot)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(out[4*i:], s[i])
+	}
+	return out
+}
+
+// chunkOutput compresses all but the last block of the chunk "data"
+func chunkOutput(key *[8]uint32, flags uint32, counter uint64, data []byte) output {
+	o := output{cv: *key, counter: counter, flags: flags | flagChunkStart}
+	for len(data) > blockLen {
+		loadBlock(&o.block, data[:blockLen])
+		s := compress(&o.cv, &o.block, counter, blockLen, o.flags)
+		copy(o.cv[:], s[:8])
+		o.flags = flags
+		data = data[blockLen:]
+	}
+	loadBlock(&o.block, data)
+	o.blockLen = uint32(len(data))
+	o.flags |= flagChunkEnd
+	return o
+}
+
+// parentOutput combines the chaining values of two subtrees
+func parentOutput(key *[8]uint32, flags uint32, left *[8]uint32, right *[8]uint32) output {
+	o := output{cv: *key, blockLen: blockLen, flags: flags | flagParent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+// loadBlock reads up to 64 bytes into "block", padded with zeros
+func loadBlock(block *[16]uint32, data []byte) {
+	var buf [blockLen]byte
+	copy(buf[:], data)
+	for i := range block {
+		block[i] = binary.LittleEndian.Uint32(buf[4*i:])
+	}
+}
+
+// compress is the BLAKE3 compression function. The rounds are unrolled and
+// the state is kept in local variables, which makes it several times faster
+// than a loop over an array.
+func compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen uint32, flags uint32) (out [16]uint32) {
+	s0, s1, s2, s3, s4, s5, s6, s7 := cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7]
+	s8, s9, s10, s11 := iv[0], iv[1], iv[2], iv[3]
+	s12, s13, s14, s15 := uint32(counter), uint32(counter>>32), blockLen, flags
+	m := block
+	for r := range schedule {
+		x := &schedule[r]
+		s0, s4, s8, s12 = g(s0, s4, s8, s12, m[x[0]], m[x[1]])
+		s1, s5, s9, s13 = g(s1, s5, s9, s13, m[x[2]], m[x[3]])
+		s2, s6, s10, s14 = g(s2, s6, s10, s14, m[x[4]], m[x[5]])
+		s3, s7, s11, s15 = g(s3, s7, s11, s15, m[x[6]], m[x[7]])
+		s0, s5, s10, s15 = g(s0, s5, s10, s15, m[x[8]], m[x[9]])
+		s1, s6, s11, s12 = g(s1, s6, s11, s12, m[x[10]], m[x[11]])
+		s2, s7, s8, s13 = g(s2, s7, s8, s13, m[x[12]], m[x[13]])
+		s3, s4, s9, s14 = g(s3, s4, s9, s14, m[x[14]], m[x[15]])
+	}
+	out = [16]uint32{
+		s0 ^ s8, s1 ^ s9, s2 ^ s10, s3 ^ s11, s4 ^ s12, s5 ^ s13, s6 ^ s14, s7 ^ s15,
+		s8 ^ cv[0], s9 ^ cv[1], s10 ^ cv[2], s11 ^ cv[3], s12 ^ cv[4], s13 ^ cv[5], s14 ^ cv[6], s15 ^ cv[7],
+	}
+	return out
+}
+
+func g(a, b, c, d, mx, my uint32) (uint32, uint32, uint32, uint32) {
+	a += b + mx
+	d = bits.RotateLeft32(d^a, -16)
+	c += d
+	b = bits.RotateLeft32(b^c, -12)
+	a += b + my
+	d = bits.RotateLeft32(d^a, -8)
+	c += d
+	b = bits.RotateLeft32(b^c, -7)
+	return a, b, c, d
+}
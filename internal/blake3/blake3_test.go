@@ -0,0 +1,60 @@
+package blake3
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Selected entries from the official test_vectors.json. The input is the
+// byte sequence 0, 1, ..., 250, 0, 1, ... of the given length.
+var testVectors = []struct {
+	inputLen int
+	hash     string
+	keyed    string
+}{
+	{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262",
+		"92b2b75604ed3c761f9d6f62392c8a9227ad0ea3f09573e783f1498a4ed60d26"},
+	{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213",
+		"6d7878dfff2f485635d39013278ae14f1454b8c0a3a2d34bc1ab38228a80c95b"},
+	{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11",
+		"c951ecdf03288d0fcc96ee3413563d8a6d3589547f2c2fb36d9786470f1b9d6e"},
+	{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7",
+		"75c46f6f3d9eb4f55ecaaee480db732e6c2105546f1e675003687c31719c7ba4"},
+	{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444",
+		"357dc55de0c7e382c900fd6e320acc04146be01db6a8ce7210b7189bd664ea69"},
+	{3073, "7124b49501012f81cc7f11ca069ec9226cecb8a2c850cfe644e327d22d3e1cd3",
+		"68dede9bef00ba89e43f31a6825f4cf433389fedae75c04ee9f0cf16a427c95a"},
+	{8193, "bab6c09cb8ce8cf459261398d2e7aef35700bf488116ceb94a36d0f5f1b7bc3b",
+		"954a2a75420c8d6547e3ba5b98d963e6fa6491addc8c023189cc519821b4a1f5"},
+	{102400, "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085",
+		"1c35d1a5811083fd7119f5d5d1ba027b4d01c0c6c49fb6ff2cf75393ea5db4a7"},
+}
+
+func TestVectors(t *testing.T) {
+	var key [KeySize]byte
+	copy(key[:], "whats the Elvish word for friend")
+	for _, v := range testVectors {
+		in := make([]byte, v.inputLen)
+		for i := range in {
+			in[i] = byte(i % 251)
+		}
+		h := Sum256(in)
+		if hex.EncodeToString(h[:]) != v.hash {
+			t.Errorf("len=%d: wrong hash %x", v.inputLen, h)
+		}
+		h = SumKeyed256(&key, in)
+		if hex.EncodeToString(h[:]) != v.keyed {
+			t.Errorf("len=%d: wrong keyed hash %x", v.inputLen, h)
+		}
+	}
+}
+
+// A typical long name: 255 bytes, encrypted and base64-encoded
+func BenchmarkSumKeyed256(b *testing.B) {
+	var key [KeySize]byte
+	in := make([]byte, 344)
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		SumKeyed256(&key, in)
+	}
+}
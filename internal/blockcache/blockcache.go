@@ -0,0 +1,206 @@
+// Package blockcache implements the "-cachedir" block cache. It stores
+// ciphertext blocks on fast local storage, so file contents in the cache are
+// protected just like in CIPHERDIR, and are authenticated when they are
+// decrypted.
+package blockcache
+
+import (
+	"container/list"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/membudget"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// BudgetName is the name of the cache in the "-cachemem" accounting
+	BudgetName = "blockcache"
+	// entryMem is the approximate memory used by the bookkeeping of one
+	// cached block, which is charged to the "-cachemem" budget. The block
+	// itself is on disk.
+	entryMem = 160
+)
+
+type key struct {
+	// fileID is the file ID from the file header, as a string so it can be
+	// used as a map key
+	fileID  string
+	blockNo uint64
+}
+
+type entry struct {
+	key  key
+	size int64
+	// item is the charge to the memory budget
+	item *membudget.Item
+}
+
+// Cache is a least-recently-used cache of ciphertext blocks. The blocks are
+// stored in a private directory that is created by New() and deleted by
+// Close(). All methods are safe for concurrent use. A nil *Cache caches
+// nothing.
+type Cache struct {
+	mu  sync.Mutex
+	dir string
+	// max is the size limit in bytes, size the current size
+	max, size int64
+	// lru holds *entry elements, most recently used first
+	lru *list.List
+	// files maps file IDs to their cached blocks
+	files map[string]map[uint64]*list.Element
+	// budget is the "-cachemem" memory budget
+	budget *membudget.Budget
+}
+
+// New creates a cache that stores up to "max" bytes in a new subdirectory
+// of "parent". The memory used by its bookkeeping is charged to "budget".
+func New(parent string, max int64, budget *membudget.Budget) (*Cache, error) {
+	dir, err := os.MkdirTemp(parent, "gocryptfs-cache-")
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{
+		dir:    dir,
+		max:    max,
+		lru:    list.New(),
+		files:  make(map[string]map[uint64]*list.Element),
+		budget: budget,
+	}, nil
+}
+
+func (c *Cache) path(k key) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%s.%d", hex.EncodeToString([]byte(k.fileID)), k.blockNo))
+}
+
+// Get returns the cached ciphertext of block "blockNo" of the file
+// identified by "fileID", or nil if it is not cached.
+func (c *Cache) Get(fileID []byte, blockNo uint64) []byte {
+	if c == nil {
+		return nil
+	}
+	k := key{string(fileID), blockNo}
+	c.mu.Lock()
+	el := c.files[k.fileID][blockNo]
+	if el == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	c.budget.Touch(el.Value.(*entry).item)
+	c.mu.Unlock()
+	// The block may have been evicted concurrently, in which case this
+	// is a cache miss.
+	data, err := os.ReadFile(c.path(k))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Put stores "ciphertext" as block "blockNo" of the file identified by
+// "fileID", replacing any cached version. Evicts the least recently used
+// blocks if the cache grows above its limit.
+func (c *Cache) Put(fileID []byte, blockNo uint64, ciphertext []byte) {
+	if c == nil || int64(len(ciphertext)) > c.max {
+		return
+	}
+	c.put(fileID, blockNo, ciphertext)
+	c.budget.Evict()
+}
+
+// put implements Put() without the eviction from the memory budget, which
+// must run without holding c.mu.
+func (c *Cache) put(fileID []byte, blockNo uint64, ciphertext []byte) {
+	k := key{string(fileID), blockNo}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(k)
+	// Write to a temporary file first so concurrent Get()s never see a
+	// partially written block
+	tmp := c.path(k) + ".tmp"
+	err := os.WriteFile(tmp, ciphertext, 0600)
+	if err == nil {
+		err = os.Rename(tmp, c.path(k))
+	}
+	if err != nil {
+		tlog.Warn.Printf("blockcache: %v", err)
+		os.Remove(tmp)
+		return
+	}
+	e := &entry{key: k, size: int64(len(ciphertext))}
+	e.item = c.budget.Add(BudgetName, entryMem, func() { c.evict(k, e) })
+	el := c.lru.PushFront(e)
+	if c.files[k.fileID] == nil {
+		c.files[k.fileID] = make(map[uint64]*list.Element)
+	}
+	c.files[k.fileID][blockNo] = el
+	c.size += int64(len(ciphertext))
+	for c.size > c.max {
+		c.remove(c.lru.Back().Value.(*entry).key)
+	}
+}
+
+// Invalidate drops block "fromBlockNo" and all following blocks of the file
+// identified by "fileID" from the cache.
+func (c *Cache) Invalidate(fileID []byte, fromBlockNo uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for blockNo := range c.files[string(fileID)] {
+		if blockNo >= fromBlockNo {
+			c.remove(key{string(fileID), blockNo})
+		}
+	}
+}
+
+// evict drops the block "k" if it is still cached as "e". Called by the
+// memory budget.
+func (c *Cache) evict(k key, e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el := c.files[k.fileID][k.blockNo]; el != nil && el.Value.(*entry) == e {
+		c.remove(k)
+	}
+}
+
+// remove drops the block "k". The caller must hold c.mu.
+func (c *Cache) remove(k key) {
+	el := c.files[k.fileID][k.blockNo]
+	if el == nil {
+		return
+	}
+	c.budget.Remove(el.Value.(*entry).item)
+	c.lru.Remove(el)
+	delete(c.files[k.fileID], k.blockNo)
+	if len(c.files[k.fileID]) == 0 {
+		delete(c.files, k.fileID)
+	}
+	c.size -= el.Value.(*entry).size
+	if err := os.Remove(c.path(k)); err != nil {
+		tlog.Warn.Printf("blockcache: %v", err)
+	}
+}
+
+// Close deletes the cache directory.
+func (c *Cache) Close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.RemoveAll(c.dir); err != nil {
+		tlog.Warn.Printf("blockcache: %v", err)
+	}
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		c.budget.Remove(el.Value.(*entry).item)
+	}
+	c.lru.Init()
+	c.files = make(map[string]map[uint64]*list.Element)
+	c.size = 0
+}
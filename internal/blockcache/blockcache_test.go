@@ -0,0 +1,84 @@
+package blockcache
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/membudget"
+)
+
+func TestCache(t *testing.T) {
+	c, err := New(t.TempDir(), 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := []byte("0123456789abcdef")
+
+	c.Put(id, 0, []byte("aaaa"))
+	c.Put(id, 1, []byte("bbbb"))
+	if have := c.Get(id, 0); !bytes.Equal(have, []byte("aaaa")) {
+		t.Errorf("have %q", have)
+	}
+	// Block 1 is now the least recently used one and gets evicted
+	c.Put(id, 2, []byte("cccc"))
+	if c.Get(id, 1) != nil {
+		t.Error("block 1 should have been evicted")
+	}
+	if c.Get(id, 0) == nil || c.Get(id, 2) == nil {
+		t.Error("blocks 0 and 2 should be cached")
+	}
+	// Overwriting replaces the cached block
+	c.Put(id, 0, []byte("AAAA"))
+	if have := c.Get(id, 0); !bytes.Equal(have, []byte("AAAA")) {
+		t.Errorf("have %q", have)
+	}
+	c.Invalidate(id, 1)
+	if c.Get(id, 2) != nil {
+		t.Error("block 2 should have been invalidated")
+	}
+	if c.Get(id, 0) == nil {
+		t.Error("block 0 should still be cached")
+	}
+	if c.size != 4 {
+		t.Errorf("wrong size %d", c.size)
+	}
+}
+
+func TestClose(t *testing.T) {
+	c, err := New(t.TempDir(), 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put([]byte("x"), 0, []byte("data"))
+	c.Close()
+	if _, err := os.Stat(c.dir); !os.IsNotExist(err) {
+		t.Errorf("cache dir should be gone: %v", err)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := membudget.New(2 * entryMem)
+	c, err := New(t.TempDir(), 100, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id := []byte("0123456789abcdef")
+	c.Put(id, 0, []byte("aaaa"))
+	c.Put(id, 1, []byte("bbbb"))
+	c.Get(id, 0)
+	// The budget has room for two blocks, and block 1 is the least
+	// recently used one
+	c.Put(id, 2, []byte("cccc"))
+	if c.Get(id, 1) != nil {
+		t.Error("block 1 should have been evicted")
+	}
+	if c.size != 8 {
+		t.Errorf("wrong size %d", c.size)
+	}
+	if u := b.Usage()[BudgetName]; u.Entries != 2 || u.Evictions != 1 {
+		t.Errorf("wrong usage %+v", u)
+	}
+}
@@ -0,0 +1,120 @@
+package configfile
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// Argon2idDefaultMemory is the default memory parameter in KiB. Together
+	// with Argon2idDefaultTime and argon2idThreads, this is the second
+	// recommended option of RFC 9106, section 4.
+	Argon2idDefaultMemory = 64 * 1024
+	// Argon2idDefaultTime is the default number of passes over the memory
+	Argon2idDefaultTime = 3
+	// argon2idThreads is the number of lanes we compute in parallel
+	argon2idThreads = 4
+	// We reject parameters below these values, like for scrypt
+	argon2idMinMemory  = 1024
+	argon2idMinTime    = 1
+	argon2idMinThreads = 1
+	argon2idMaxThreads = 64
+)
+
+// Argon2idKDF is an instance of the Argon2id key derivation function
+// ("-argon2id")
+type Argon2idKDF struct {
+	// Salt is the random salt that is passed to Argon2id
+	Salt []byte
+	// Memory is the memory cost in KiB
+	Memory uint32
+	// Time is the number of passes over the memory
+	Time uint32
+	// Threads is the number of lanes
+	Threads uint8
+	// KeyLen is the output data length
+	KeyLen int
+}
+
+// NewArgon2idKDF returns a new instance of Argon2idKDF. Zero values select
+// the defaults.
+func NewArgon2idKDF(memory uint32, time uint32) Argon2idKDF {
+	if memory == 0 {
+		memory = Argon2idDefaultMemory
+	}
+	if time == 0 {
+		time = Argon2idDefaultTime
+	}
+	return Argon2idKDF{
+		Salt:    cryptocore.RandBytes(cryptocore.KeyLen),
+		Memory:  memory,
+		Time:    time,
+		Threads: argon2idThreads,
+		KeyLen:  cryptocore.KeyLen,
+	}
+}
+
+// DeriveKey returns a new key from a supplied password.
+func (a *Argon2idKDF) DeriveKey(pw []byte) []byte {
+	if err := a.validateParams(); err != nil {
+		tlog.Fatal.Println(err.Error())
+		os.Exit(exitcodes.ScryptParams)
+	}
+	return argon2.IDKey(pw, a.Salt, a.Time, a.Memory, a.Threads, uint32(a.KeyLen))
+}
+
+// EquivalentLogN returns the scrypt cost parameter logN that needs about as
+// much work per password guess. scrypt with logN uses 2^logN KiB and goes
+// over them twice.
+func (a *Argon2idKDF) EquivalentLogN() int {
+	return int(math.Log2(float64(a.Memory) * float64(a.Time) / 2))
+}
+
+// validateParams checks that all parameters are at or above hardcoded
+// limits, so that we do not get weak parameters passed through a rogue
+// gocryptfs.conf.
+func (a *Argon2idKDF) validateParams() error {
+	if a.Memory < argon2idMinMemory {
+		return fmt.Errorf("Fatal: Argon2id memory below minimum: value=%d KiB, min=%d KiB", a.Memory, argon2idMinMemory)
+	}
+	if a.Time < argon2idMinTime {
+		return fmt.Errorf("Fatal: Argon2id time below minimum: value=%d, min=%d", a.Time, argon2idMinTime)
+	}
+	if a.Threads < argon2idMinThreads || a.Threads > argon2idMaxThreads {
+		return fmt.Errorf("Fatal: Argon2id threads out of range: value=%d, allowed %d ... %d",
+			a.Threads, argon2idMinThreads, argon2idMaxThreads)
+	}
+	if len(a.Salt) < scryptMinSaltLen {
+		return fmt.Errorf("Fatal: Argon2id salt length below minimum: value=%d, min=%d", len(a.Salt), scryptMinSaltLen)
+	}
+	if a.KeyLen < cryptocore.KeyLen {
+		return fmt.Errorf("Fatal: Argon2id KeyLen below minimum: value=%d, min=%d", a.KeyLen, cryptocore.KeyLen)
+	}
+	return nil
+}
+
+// cacheDescription returns the name of the kernel keyring entry that holds
+// the key derived from "pw" ("-kdfcache"), like ScryptKDF.cacheDescription
+func (a *Argon2idKDF) cacheDescription(pw []byte) string {
+	h := sha256.New()
+	h.Write([]byte("gocryptfs kdf cache argon2id"))
+	h.Write(a.Salt)
+	binary.Write(h, binary.BigEndian, []uint64{uint64(a.Memory), uint64(a.Time), uint64(a.Threads), uint64(a.KeyLen)})
+	h.Write(pw)
+	return "gocryptfs:kdf:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// derivedKeyLen returns the length of the keys DeriveKey returns
+func (a *Argon2idKDF) derivedKeyLen() int {
+	return a.KeyLen
+}
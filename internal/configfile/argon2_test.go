@@ -0,0 +1,59 @@
+package configfile
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+func TestArgon2id(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename:       "config_test/tmp.conf",
+		Password:       testPw,
+		Creator:        "test",
+		Argon2id:       true,
+		Argon2idMemory: 8 * 1024,
+		Argon2idTime:   1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagArgon2id) {
+		t.Error("Argon2id flag should be set but is not")
+	}
+	a := c.Argon2idObject
+	if a.Memory != 8*1024 || a.Time != 1 || a.Threads != argon2idThreads {
+		t.Errorf("wrong parameters: %+v", a)
+	}
+	// A new password keeps the parameters, but gets a new salt
+	salt := a.Salt
+	c.EncryptKey(masterkey, []byte("new"), 10)
+	if c.Argon2idObject.Memory != 8*1024 || c.Argon2idObject.Time != 1 {
+		t.Errorf("parameters changed: %+v", c.Argon2idObject)
+	}
+	if string(c.Argon2idObject.Salt) == string(salt) {
+		t.Error("salt has not changed")
+	}
+	if _, err = c.DecryptMasterKey([]byte("new")); err != nil {
+		t.Error(err)
+	}
+
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	if _, err = c.DecryptMasterKey(testPw); err == nil {
+		t.Error("the old password still works")
+	}
+	// Weak parameters from a rogue config file are rejected
+	c.Argon2idObject.Memory = 8
+	if err = c.Validate(); err == nil {
+		t.Error("weak parameters were accepted")
+	}
+	c.Argon2idObject = nil
+	if err = c.Validate(); err == nil {
+		t.Error("missing Argon2idObject was accepted")
+	}
+}
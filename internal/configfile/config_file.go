@@ -6,7 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"syscall"
+	"time"
 
 	"os"
 
@@ -46,8 +48,14 @@ type ConfFile struct {
 	EncryptedKey []byte
 	// ScryptObject stores parameters for scrypt hashing (key derivation)
 	ScryptObject ScryptKDF
+	// Argon2idObject replaces ScryptObject if the Argon2id feature flag is
+	// set ("-argon2id")
+	Argon2idObject *Argon2idKDF `json:",omitempty"`
 	// Version is the On-Disk-Format version this filesystem uses
 	Version uint16
+	// SchemaVersion is the layout of this config file, see CurrentSchema.
+	// Not written for schema 0.
+	SchemaVersion uint16 `json:",omitempty"`
 	// FeatureFlags is a list of feature flags this filesystem has enabled.
 	// If gocryptfs encounters a feature flag it does not support, it will refuse
 	// mounting. This mechanism is analogous to the ext4 feature flags that are
@@ -57,8 +65,61 @@ type ConfFile struct {
 	FIDO2 *FIDO2Params `json:",omitempty"`
 	// LongNameMax corresponds to the -longnamemax flag
 	LongNameMax uint8 `json:",omitempty"`
+	// PQHybrid parameters ("-pqkey")
+	PQHybrid *PQHybridParams `json:",omitempty"`
+	// TPM2 is a second key slot for the master key, sealed to a TPM
+	// ("-tpm2-enroll")
+	TPM2 *TPM2Params `json:",omitempty"`
+	// PKCS11 is a key slot for the master key, wrapped by a PKCS#11 token
+	// ("-pkcs11-enroll")
+	PKCS11 *PKCS11Params `json:",omitempty"`
+	// Profile documents the answers given to "-init -wizard" and the options
+	// they resulted in. Like Creator, it is only for humans.
+	Profile string `json:",omitempty"`
+	// Label is a short name for the filesystem ("-label"). Like Creator, the
+	// following fields only help humans identify the filesystem.
+	Label string `json:",omitempty"`
+	// Description is a free-form description ("-description")
+	Description string `json:",omitempty"`
+	// Created is the time of "-init" in RFC 3339 format
+	Created string `json:",omitempty"`
+	// CreatorHost is the hostname of the machine that ran "-init"
+	CreatorHost string `json:",omitempty"`
+	// MountDefaults are mount options, like "allow_other" or "idle=30m",
+	// that are applied to every mount ("-mount-defaults")
+	MountDefaults []string `json:",omitempty"`
+	// MountDefaultsMAC authenticates MountDefaults, so that they cannot be
+	// changed without the master key
+	MountDefaultsMAC []byte `json:",omitempty"`
+	// KeyEpoch is the newest key epoch ("-new-key-epoch"). If it is not 0,
+	// EncryptedKey holds the key of this epoch instead of the master key.
+	KeyEpoch uint8 `json:",omitempty"`
+	// EncryptedEpochKeys holds the keys of the epochs before KeyEpoch,
+	// starting with the master key, encrypted with a key derived from the
+	// key in EncryptedKey
+	EncryptedEpochKeys [][]byte `json:",omitempty"`
+	// WORMRetention is how long files cannot be deleted on a "-worm"
+	// filesystem, in the format of time.ParseDuration. Empty means forever.
+	WORMRetention string `json:",omitempty"`
+	// ImageMaxSize is the size in bytes up to which a "-container" image
+	// grows. Zero means that the image has a fixed size.
+	ImageMaxSize uint64 `json:",omitempty"`
+	// Subvolumes are the directories that have their own key
+	// ("-add-subvolume")
+	Subvolumes []SubvolumeParams `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
+	// pqSecret is the decapsulated "-pqkey" secret. Not exported to JSON.
+	pqSecret []byte
+	// epochKeys are the keys of all key epochs after DecryptMasterKey. Not
+	// exported to JSON.
+	epochKeys [][]byte
+	// migrations are the schema upgrades that Load() has applied. Not
+	// exported to JSON.
+	migrations []string
+	// kdfCache is how long DecryptMasterKey keeps the key derived from the
+	// password in the kernel keyring ("-kdfcache"). Not exported to JSON.
+	kdfCache time.Duration
 }
 
 // CreateArgs exists because the argument list to Create became too long.
@@ -73,7 +134,41 @@ type CreateArgs struct {
 	Fido2HmacSalt      []byte
 	DeterministicNames bool
 	XChaCha20Poly1305  bool
+	AEGIS256           bool
+	AES128             bool
 	LongNameMax        uint8
+	MerkleTree         bool
+	BindPath           bool
+	LongNameBLAKE3     bool
+	HCTR2Names         bool
+	// PQKeySeed is the content of the "-pqkey" key file
+	PQKeySeed []byte
+	// Profile is the summary of "-init -wizard"
+	Profile string
+	// Label and Description are set by "-label" and "-description"
+	Label       string
+	Description string
+	// MountDefaults are the options given to "-mount-defaults"
+	MountDefaults []string
+	// WORM and WORMRetention are set by "-worm" and "-worm-retention"
+	WORM          bool
+	WORMRetention time.Duration
+	// Immutable is set by "-immutable"
+	Immutable bool
+	// FlatLayout is set by "-flat", FlatImage by "-image", "-image_size"
+	// and "-container"
+	FlatLayout bool
+	FlatImage  bool
+	// ImageMaxSize is set by "-size"
+	ImageMaxSize uint64
+	// ScryptR and ScryptP are set by "-scryptr" and "-scryptp"
+	ScryptR int
+	ScryptP int
+	// Argon2id, Argon2idMemory (KiB) and Argon2idTime are set by "-argon2id",
+	// "-argon2id-memory" and "-argon2id-time"
+	Argon2id       bool
+	Argon2idMemory uint32
+	Argon2idTime   uint32
 }
 
 // Create - create a new config with a random key encrypted with
@@ -81,17 +176,29 @@ type CreateArgs struct {
 // Uses scrypt with cost parameter "LogN".
 func Create(args *CreateArgs) error {
 	cf := ConfFile{
-		filename: args.Filename,
-		Creator:  args.Creator,
-		Version:  contentenc.CurrentVersion,
+		filename:      args.Filename,
+		Creator:       args.Creator,
+		Version:       contentenc.CurrentVersion,
+		SchemaVersion: CurrentSchema,
+		Profile:       args.Profile,
+		// Creation info
+		Label:       args.Label,
+		Description: args.Description,
+		Created:     time.Now().UTC().Format(time.RFC3339),
+	}
+	if h, err := os.Hostname(); err == nil {
+		cf.CreatorHost = h
 	}
 	// Feature flags
 	cf.setFeatureFlag(FlagHKDF)
 	if args.XChaCha20Poly1305 {
 		cf.setFeatureFlag(FlagXChaCha20Poly1305)
+	} else if args.AEGIS256 {
+		cf.setFeatureFlag(FlagAEGIS256)
 	} else {
 		// 128-bit IVs are mandatory for AES-GCM (default is 96!) and AES-SIV,
-		// XChaCha20Poly1305 uses even an even longer IV of 192 bits.
+		// XChaCha20Poly1305 uses even an even longer IV of 192 bits, and
+		// AEGIS-256 one of 256 bits.
 		cf.setFeatureFlag(FlagGCMIV128)
 	}
 	if args.PlaintextNames {
@@ -106,13 +213,45 @@ func Create(args *CreateArgs) error {
 			cf.LongNameMax = args.LongNameMax
 			cf.setFeatureFlag(FlagLongNameMax)
 		}
-		cf.setFeatureFlag(FlagEMENames)
+		if args.LongNameBLAKE3 {
+			cf.setFeatureFlag(FlagLongNameBLAKE3)
+		}
+		if args.HCTR2Names {
+			cf.setFeatureFlag(FlagHCTR2Names)
+		} else {
+			cf.setFeatureFlag(FlagEMENames)
+		}
 		cf.setFeatureFlag(FlagLongNames)
 		cf.setFeatureFlag(FlagRaw64)
 	}
+	if args.MerkleTree {
+		cf.setFeatureFlag(FlagMerkleTree)
+	}
+	if args.BindPath {
+		cf.setFeatureFlag(FlagBindPath)
+	}
+	if args.WORM {
+		cf.setFeatureFlag(FlagWORM)
+		if args.WORMRetention > 0 {
+			cf.WORMRetention = args.WORMRetention.String()
+		}
+	}
+	if args.Immutable {
+		cf.setFeatureFlag(FlagImmutable)
+	}
+	if args.FlatLayout {
+		cf.setFeatureFlag(FlagFlatLayout)
+	}
+	if args.FlatImage {
+		cf.setFeatureFlag(FlagFlatImage)
+		cf.ImageMaxSize = args.ImageMaxSize
+	}
 	if args.AESSIV {
 		cf.setFeatureFlag(FlagAESSIV)
 	}
+	if args.AES128 {
+		cf.setFeatureFlag(FlagAES128)
+	}
 	if len(args.Fido2CredentialID) > 0 {
 		cf.setFeatureFlag(FlagFIDO2)
 		cf.FIDO2 = &FIDO2Params{
@@ -120,8 +259,25 @@ func Create(args *CreateArgs) error {
 			HMACSalt:     args.Fido2HmacSalt,
 		}
 	}
+	if len(args.PQKeySeed) > 0 {
+		if err := cf.encapsulatePQHybrid(args.PQKeySeed); err != nil {
+			return err
+		}
+	}
 	// Catch bugs and invalid cli flag combinations early
-	cf.ScryptObject = NewScryptKDF(args.LogN)
+	if args.Argon2id {
+		cf.setFeatureFlag(FlagArgon2id)
+		a := NewArgon2idKDF(args.Argon2idMemory, args.Argon2idTime)
+		cf.Argon2idObject = &a
+	} else {
+		cf.ScryptObject = NewScryptKDF(args.LogN)
+		if args.ScryptR > 0 {
+			cf.ScryptObject.R = args.ScryptR
+		}
+		if args.ScryptP > 0 {
+			cf.ScryptObject.P = args.ScryptP
+		}
+	}
 	if err := cf.Validate(); err != nil {
 		return err
 	}
@@ -133,6 +289,7 @@ func Create(args *CreateArgs) error {
 		// This sets ScryptObject and EncryptedKey
 		// Note: this looks at the FeatureFlags, so call it AFTER setting them.
 		cf.EncryptKey(key, args.Password, args.LogN)
+		cf.SetMountDefaults(args.MountDefaults, key)
 		for i := range key {
 			key[i] = 0
 		}
@@ -191,6 +348,11 @@ func Load(filename string) (*ConfFile, error) {
 		return nil, err
 	}
 
+	// Upgrade older layouts
+	if err := cf.migrateSchema(); err != nil {
+		return nil, exitcodes.NewErr(err.Error(), exitcodes.DeprecatedFS)
+	}
+
 	if err := cf.Validate(); err != nil {
 		return nil, exitcodes.NewErr(err.Error(), exitcodes.DeprecatedFS)
 	}
@@ -207,18 +369,39 @@ func (cf *ConfFile) setFeatureFlag(flag flagIota) {
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[flag])
 }
 
+// kdf is a password-based key derivation function
+type kdf interface {
+	DeriveKey(pw []byte) []byte
+	validateParams() error
+	cacheDescription(pw []byte) string
+	derivedKeyLen() int
+}
+
+// kdf returns the key derivation function that locks the master key:
+// Argon2id with the Argon2id feature flag, scrypt otherwise
+func (cf *ConfFile) kdf() kdf {
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		return cf.Argon2idObject
+	}
+	return &cf.ScryptObject
+}
+
 // DecryptMasterKey decrypts the masterkey stored in cf.EncryptedKey using
 // password.
 func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err error) {
 	// Generate derived key from password
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	scryptHash := cf.deriveKey(password)
+	scryptHash, err = cf.mixPQSecret(scryptHash)
+	if err != nil {
+		return nil, err
+	}
 
 	// Unlock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
 
 	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
-	masterkey, err = ce.DecryptBlock(cf.EncryptedKey, 0, nil)
+	masterkey, err = ce.DecryptBlock(cf.EncryptedKey, cf.keyBlockNo(), nil)
 	tlog.Warn.Enabled = true
 
 	// Purge scrypt-derived key
@@ -231,24 +414,55 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 
 	if err != nil {
 		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
+		if cf.IsFeatureFlagSet(FlagPQHybrid) {
+			return nil, exitcodes.NewErr("Password or -pqkey key file incorrect.", exitcodes.PasswordIncorrect)
+		}
 		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
 	}
-	return masterkey, nil
+	// With key epochs, we have decrypted the newest key. The master key is
+	// the key of epoch 0.
+	return cf.decryptEpochKeys(masterkey)
 }
 
 // EncryptKey - encrypt "key" using an scrypt hash generated from "password"
 // and store it in cf.EncryptedKey.
 // Uses scrypt with cost parameter logN and stores the scrypt parameters in
-// cf.ScryptObject.
+// cf.ScryptObject. With the Argon2id feature flag, Argon2id is used instead,
+// with the parameters in cf.Argon2idObject and a new salt.
 func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
-	// Generate scrypt-derived key from password
-	cf.ScryptObject = NewScryptKDF(logN)
-	scryptHash := cf.ScryptObject.DeriveKey(password)
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		a := NewArgon2idKDF(cf.Argon2idObject.Memory, cf.Argon2idObject.Time)
+		cf.Argon2idObject = &a
+	} else {
+		// Keep the block size and the number of lanes
+		r, p := cf.ScryptObject.R, cf.ScryptObject.P
+		cf.ScryptObject = NewScryptKDF(logN)
+		if r > scryptMinR {
+			cf.ScryptObject.R = r
+		}
+		if p > 1 {
+			cf.ScryptObject.P = p
+		}
+	}
+	// Generate the password-derived key
+	scryptHash := cf.kdf().DeriveKey(password)
+	scryptHash, err := cf.mixPQSecret(scryptHash)
+	if err != nil {
+		log.Panic(err)
+	}
 
+	// With key epochs, the newest key is locked instead. It unlocks the
+	// others.
+	if cf.KeyEpoch > 0 {
+		if len(cf.epochKeys) != int(cf.KeyEpoch)+1 {
+			log.Panic("EncryptKey: the key epochs have not been decrypted")
+		}
+		key = cf.epochKeys[cf.KeyEpoch]
+	}
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	cf.EncryptedKey = ce.EncryptBlock(key, cf.keyBlockNo(), nil)
 
 	// Purge scrypt-derived key
 	for i := range scryptHash {
@@ -320,9 +534,27 @@ func (cf *ConfFile) ContentEncryption() (algo cryptocore.AEADTypeEnum, err error
 	if cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) {
 		return cryptocore.BackendXChaCha20Poly1305, nil
 	}
+	if cf.IsFeatureFlagSet(FlagAEGIS256) {
+		return cryptocore.BackendAEGIS256, nil
+	}
 	if cf.IsFeatureFlagSet(FlagAESSIV) {
 		return cryptocore.BackendAESSIV, nil
 	}
-	// If neither AES-SIV nor XChaCha are selected, we must be using AES-GCM
+	if cf.IsFeatureFlagSet(FlagAES128) {
+		return cryptocore.BackendGoGCM128, nil
+	}
+	// If neither AES-SIV, XChaCha nor AEGIS are selected, we must be using AES-GCM
 	return cryptocore.BackendGoGCM, nil
 }
+
+// WORMRetentionDuration parses WORMRetention. Returns 0 if it is not set.
+func (cf *ConfFile) WORMRetentionDuration() (time.Duration, error) {
+	if cf.WORMRetention == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(cf.WORMRetention)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid WORMRetention %q in config file", cf.WORMRetention)
+	}
+	return d, nil
+}
@@ -1,10 +1,13 @@
 package configfile
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/hybridkem"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -175,3 +178,339 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+func TestCreateConfPQHybrid(t *testing.T) {
+	if !hybridkem.Supported {
+		t.Skip("built without ML-KEM support")
+	}
+	seed := bytes.Repeat([]byte{7}, hybridkem.SeedLen)
+	err := Create(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		PQKeySeed: seed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagPQHybrid) {
+		t.Error("PQHybrid flag should be set but is not")
+	}
+	// The password alone is not enough
+	if _, err = c.DecryptMasterKey(testPw); err == nil {
+		t.Error("master key was unlocked without the key file")
+	}
+	if err = c.UnlockPQHybrid(seed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.DecryptMasterKey(testPw); err != nil {
+		t.Error(err)
+	}
+	// Nor is the wrong key file
+	seed[0] ^= 1
+	if err = c.UnlockPQHybrid(seed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.DecryptMasterKey(testPw); err == nil {
+		t.Error("master key was unlocked with the wrong key file")
+	}
+}
+
+func TestKeyEpochs(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for epoch := 1; epoch <= 2; epoch++ {
+		if err = c.AddKeyEpoch(masterkey, testPw); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.WriteFile(); err != nil {
+			t.Fatal(err)
+		}
+		key, c2, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c2.IsFeatureFlagSet(FlagKeyEpochs) || int(c2.KeyEpoch) != epoch {
+			t.Fatalf("epoch %d: wrong config: %v %d", epoch, c2.FeatureFlags, c2.KeyEpoch)
+		}
+		// The master key stays the same, the new keys are different
+		if !bytes.Equal(key, masterkey) {
+			t.Errorf("epoch %d: master key has changed", epoch)
+		}
+		keys := c2.EpochKeys()
+		if len(keys) != epoch || bytes.Equal(keys[epoch-1], masterkey) ||
+			(epoch > 1 && bytes.Equal(keys[0], keys[1])) {
+			t.Errorf("epoch %d: wrong keys", epoch)
+		}
+		c = c2
+	}
+	// Swapped keys are detected
+	c.EncryptedEpochKeys[0], c.EncryptedEpochKeys[1] = c.EncryptedEpochKeys[1], c.EncryptedEpochKeys[0]
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	if _, err = c.DecryptMasterKey(testPw); err == nil {
+		t.Error("swapped epoch keys were accepted")
+	}
+	tlog.Warn.Enabled = true
+}
+
+func TestReadOnly(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadOnly(masterkey, testPw)
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagReadOnly) || !bytes.Equal(key, masterkey) {
+		t.Errorf("wrong config: %v", c.FeatureFlags)
+	}
+	// Removing the flag is detected
+	c.FeatureFlags = c.FeatureFlags[:len(c.FeatureFlags)-1]
+	if c.IsFeatureFlagSet(FlagReadOnly) {
+		t.Fatal("flag was not removed")
+	}
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	if _, err = c.DecryptMasterKey(testPw); err == nil {
+		t.Error("removing the ReadOnly flag was not detected")
+	}
+	tlog.Warn.Enabled = true
+}
+
+func TestTPM2(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.AddKeyEpoch(masterkey, testPw); err != nil {
+		t.Fatal(err)
+	}
+	// The TPM is not needed here, the sealed key is just a key
+	sealedKey := cryptocore.RandBytes(cryptocore.KeyLen)
+	p := TPM2Params{Public: []byte("pub"), Private: []byte("priv"), PCRs: "sha256:7"}
+	if err = c.SetTPM2(masterkey, sealedKey, p); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TPM2 == nil || c.TPM2.PCRs != "sha256:7" || string(c.TPM2.Public) != "pub" {
+		t.Fatalf("wrong TPM2 key slot: %+v", c.TPM2)
+	}
+	key, err := c.DecryptMasterKeyTPM2(sealedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, masterkey) || len(c.EpochKeys()) != 1 {
+		t.Error("wrong keys")
+	}
+	// The password keeps working
+	if _, err = c.DecryptMasterKey(testPw); err != nil {
+		t.Error(err)
+	}
+	if _, err = c.DecryptMasterKeyTPM2(cryptocore.RandBytes(cryptocore.KeyLen)); err == nil {
+		t.Error("wrong sealed key was accepted")
+	}
+	// A new key epoch would not be in the key slot
+	if err = c.AddKeyEpoch(masterkey, testPw); err != nil {
+		t.Fatal(err)
+	}
+	if c.TPM2 != nil {
+		t.Error("TPM2 key slot was not removed")
+	}
+}
+
+// The PKCS#11 key slot is removed with the others when the filesystem is
+// made read-only
+func TestPKCS11(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slotKey := cryptocore.RandBytes(cryptocore.KeyLen)
+	p := PKCS11Params{Module: "/usr/lib/opensc-pkcs11.so", KeyID: []byte{1}, WrappedKey: []byte("wrapped")}
+	if err = c.SetPKCS11(masterkey, slotKey, p); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = Load("config_test/tmp.conf"); err != nil {
+		t.Fatal(err)
+	}
+	key, err := c.DecryptMasterKeyPKCS11(slotKey)
+	if err != nil || !bytes.Equal(key, masterkey) {
+		t.Fatalf("wrong key: %v", err)
+	}
+	if !c.HasKeySlots() {
+		t.Error("HasKeySlots() = false")
+	}
+	c.SetReadOnly(masterkey, testPw)
+	if c.HasKeySlots() {
+		t.Error("the key slots were not removed")
+	}
+	// An incomplete key slot is rejected
+	c.PKCS11 = &PKCS11Params{Module: "x"}
+	if err = c.Validate(); err == nil {
+		t.Error("incomplete key slot was accepted")
+	}
+}
+
+func TestSchemaMigration(t *testing.T) {
+	if len(schemaMigrations) != CurrentSchema {
+		t.Fatalf("have %d schema migrations for schema %d", len(schemaMigrations), CurrentSchema)
+	}
+	// v2.conf has the current schema, it only does not record it
+	c, err := Load("config_test/v2.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SchemaVersion != CurrentSchema || len(c.Migrations()) != 0 {
+		t.Errorf("schema %d, migrations %v", c.SchemaVersion, c.Migrations())
+	}
+	// A newer schema is rejected
+	c.SchemaVersion = CurrentSchema + 1
+	if err = c.migrateSchema(); err == nil {
+		t.Error("newer schema should be rejected")
+	}
+}
+
+func TestSubvolumes(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svPw := []byte("subvolume")
+	if err = c.AddSubvolume("/work/", svPw, 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"", "/", "work", "work/x", "."} {
+		if c.CheckNewSubvolume(p) == nil {
+			t.Errorf("%q: overlapping subvolume was accepted", p)
+		}
+	}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagSubvolumes) {
+		t.Errorf("flag not set: %v", c.FeatureFlags)
+	}
+	sv := c.Subvolume("work/a/b")
+	if sv == nil || sv.Path != "work" || c.Subvolume("workx") != nil {
+		t.Fatalf("wrong subvolume: %v", sv)
+	}
+	key, err := sv.DecryptKey(svPw)
+	if err != nil || len(key) != 32 {
+		t.Fatalf("key: %v", err)
+	}
+	if _, err = sv.DecryptKey(testPw); err == nil {
+		t.Error("wrong password was accepted")
+	}
+	// The path is authenticated
+	sv.Path = "play"
+	if _, err = sv.DecryptKey(svPw); err == nil {
+		t.Error("changed path was accepted")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.AddKeyEpoch(masterkey, testPw); err != nil {
+		t.Fatal(err)
+	}
+	c.SetMountDefaults([]string{"cachemem=1000000"}, masterkey)
+	c.TPM2 = &TPM2Params{Public: []byte("pub"), Private: []byte("priv"), EncryptedKey: []byte("key")}
+	newKey := cryptocore.RandBytes(cryptocore.KeyLen)
+	if err = c.Rekey("config_test/tmp.conf", newKey, testPw); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, newKey) {
+		t.Error("master key has not changed")
+	}
+	if c.IsFeatureFlagSet(FlagKeyEpochs) || c.KeyEpoch != 0 || c.TPM2 != nil {
+		t.Errorf("key epochs or key slots have been kept: %v %d %v", c.FeatureFlags, c.KeyEpoch, c.TPM2)
+	}
+	if err = c.VerifyMountDefaults(newKey); err != nil {
+		t.Error(err)
+	}
+}
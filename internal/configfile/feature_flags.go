@@ -1,5 +1,9 @@
 package configfile
 
+import (
+	"sort"
+)
+
 type flagIota int
 
 const (
@@ -26,14 +30,58 @@ const (
 	// FlagHKDF enables HKDF-derived keys for use with GCM, EME and SIV
 	// instead of directly using the master key (GCM and EME) or the SHA-512
 	// hashed master key (SIV).
-	// Note that this flag does not change the password hashing algorithm
-	// which always is scrypt.
+	// Note that this flag does not change the password hashing algorithm,
+	// see FlagArgon2id for that.
 	FlagHKDF
 	// FlagFIDO2 means that "-fido2" was used when creating the filesystem.
 	// The masterkey is protected using a FIDO2 token instead of a password.
 	FlagFIDO2
 	// FlagXChaCha20Poly1305 means we use XChaCha20-Poly1305 file content encryption
 	FlagXChaCha20Poly1305
+	// FlagMerkleTree means that every file has a hash tree in
+	// gocryptfs.merkle ("-merkle")
+	FlagMerkleTree
+	// FlagBindPath means that the file contents are bound to the DirIV of
+	// the parent directory ("-bindpath")
+	FlagBindPath
+	// FlagAEGIS256 means we use AEGIS-256 file content encryption
+	FlagAEGIS256
+	// FlagAES128 means we use AES-GCM file content encryption with a 128-bit
+	// key instead of a 256-bit key ("-aes128")
+	FlagAES128
+	// FlagPQHybrid means that the masterkey is additionally protected by a
+	// hybrid X25519+ML-KEM-768 key file ("-pqkey")
+	FlagPQHybrid
+	// FlagLongNameBLAKE3 means that long names are hashed with keyed BLAKE3
+	// instead of SHA-256 ("-longnamehash=blake3")
+	FlagLongNameBLAKE3
+	// FlagHCTR2Names indicates HCTR2 filename encryption instead of EME
+	// ("-hctr2")
+	FlagHCTR2Names
+	// FlagKeyEpochs means that new files are encrypted with a newer key
+	// than the master key, and the file header says which ("-new-key-epoch")
+	FlagKeyEpochs
+	// FlagWORM means that files cannot be modified or deleted once they
+	// have been written and closed ("-worm")
+	FlagWORM
+	// FlagReadOnly means that the filesystem is always mounted read-only
+	// ("-make-readonly")
+	FlagReadOnly
+	// FlagFlatLayout means that file contents are stored in a flat blob
+	// directory, and the directory tree in an encrypted index ("-flat")
+	FlagFlatLayout
+	// FlagFlatImage means that the flat layout is stored in the image
+	// CIPHERDIR/gocryptfs.image ("-image", "-image_size")
+	FlagFlatImage
+	// FlagSubvolumes means that some directories have their own key, which
+	// is locked with their own password ("-add-subvolume")
+	FlagSubvolumes
+	// FlagArgon2id means that the masterkey is locked with a key derived by
+	// Argon2id instead of scrypt ("-argon2id")
+	FlagArgon2id
+	// FlagImmutable means that files can be marked immutable in their
+	// header ("-immutable")
+	FlagImmutable
 )
 
 // knownFlags stores the known feature flags and their string representation
@@ -49,6 +97,32 @@ var knownFlags = map[flagIota]string{
 	FlagHKDF:              "HKDF",
 	FlagFIDO2:             "FIDO2",
 	FlagXChaCha20Poly1305: "XChaCha20Poly1305",
+	FlagMerkleTree:        "MerkleTree",
+	FlagBindPath:          "BindPath",
+	FlagAEGIS256:          "AEGIS256",
+	FlagAES128:            "AES128",
+	FlagPQHybrid:          "PQHybrid",
+	FlagLongNameBLAKE3:    "LongNameBLAKE3",
+	FlagHCTR2Names:        "HCTR2Names",
+	FlagKeyEpochs:         "KeyEpochs",
+	FlagWORM:              "WORM",
+	FlagReadOnly:          "ReadOnly",
+	FlagFlatLayout:        "FlatLayout",
+	FlagFlatImage:         "FlatImage",
+	FlagSubvolumes:        "Subvolumes",
+	FlagArgon2id:          "Argon2id",
+	FlagImmutable:         "Immutable",
+}
+
+// KnownFeatureFlags returns the names of all feature flags this version of
+// gocryptfs understands, sorted alphabetically
+func KnownFeatureFlags() []string {
+	out := make([]string, 0, len(knownFlags))
+	for _, f := range knownFlags {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out
 }
 
 // isFeatureFlagKnown verifies that we understand a feature flag.
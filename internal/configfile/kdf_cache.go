@@ -0,0 +1,34 @@
+package configfile
+
+import (
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// CacheDerivedKey makes DecryptMasterKey keep the key that the KDF derives
+// from the password in the kernel keyring of the user for "timeout"
+// ("-kdfcache"). Unlocking the same config with the same password again
+// within that time skips the KDF.
+func (cf *ConfFile) CacheDerivedKey(timeout time.Duration) {
+	cf.kdfCache = timeout
+}
+
+// deriveKey runs the KDF on "password", or takes the result from the
+// kernel keyring if "-kdfcache" is active
+func (cf *ConfFile) deriveKey(password []byte) []byte {
+	kdf := cf.kdf()
+	if cf.kdfCache <= 0 {
+		return kdf.DeriveKey(password)
+	}
+	desc := kdf.cacheDescription(password)
+	if k := kdfCacheGet(desc); len(k) == kdf.derivedKeyLen() {
+		tlog.Debug.Printf("-kdfcache: using the cached key")
+		return k
+	}
+	k := kdf.DeriveKey(password)
+	if err := kdfCachePut(desc, k, cf.kdfCache); err != nil {
+		tlog.Info.Printf("-kdfcache: %v", err)
+	}
+	return k
+}
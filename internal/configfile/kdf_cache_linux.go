@@ -0,0 +1,44 @@
+package configfile
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// kdfCachePerm lets all processes of the user read the key, also those that
+// do not possess the user keyring, like a daemonized gocryptfs
+const kdfCachePerm = 0x3f000000 | // possessor: all
+	0x000b0000 // user: view, read, search
+
+// kdfCacheGet returns the key stored as "desc" in the user keyring, or nil
+func kdfCacheGet(desc string) []byte {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", desc, 0)
+	if err != nil {
+		return nil
+	}
+	buf := make([]byte, 64)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil || n > len(buf) {
+		return nil
+	}
+	return buf[:n]
+}
+
+// kdfCachePut stores "key" as "desc" in the user keyring. The kernel deletes
+// it after "timeout".
+func kdfCachePut(desc string, key []byte, timeout time.Duration) error {
+	id, err := unix.AddKey("user", desc, key, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return err
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_SETPERM, id, kdfCachePerm, 0, 0)
+	if err == nil {
+		secs := int((timeout + time.Second - 1) / time.Second)
+		_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, secs, 0, 0)
+	}
+	if err != nil {
+		unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package configfile
+
+import (
+	"errors"
+	"time"
+)
+
+// kdfCacheGet always misses, there is no kernel keyring on this platform
+func kdfCacheGet(desc string) []byte {
+	return nil
+}
+
+// kdfCachePut is not supported on this platform
+func kdfCachePut(desc string, key []byte, timeout time.Duration) error {
+	return errors.New("the kernel keyring is only available on Linux")
+}
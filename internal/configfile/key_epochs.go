@@ -0,0 +1,97 @@
+package configfile
+
+import (
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// MaxKeyEpoch is the highest key epoch. The file header has one byte for it.
+const MaxKeyEpoch = 255
+
+// decryptEpochKeys decrypts the keys of the older key epochs with "newest",
+// the key decrypted from EncryptedKey, and returns the master key. Without
+// key epochs, "newest" is the master key and is returned unchanged.
+func (cf *ConfFile) decryptEpochKeys(newest []byte) (masterkey []byte, err error) {
+	if cf.KeyEpoch == 0 {
+		return newest, nil
+	}
+	ce := getKeyEncrypter(cryptocore.KeyEpochsKey(newest), true)
+	defer ce.Wipe()
+	keys := make([][]byte, 0, int(cf.KeyEpoch)+1)
+	for i, encrypted := range cf.EncryptedEpochKeys {
+		// The epoch is authenticated as the block number, so that the keys
+		// cannot be swapped
+		key, err := ce.DecryptBlock(encrypted, uint64(i), nil)
+		if err != nil {
+			return nil, fmt.Errorf("key epoch %d: %v", i, err)
+		}
+		keys = append(keys, key)
+	}
+	cf.epochKeys = append(keys, newest)
+	// Return a copy, the caller usually wipes the master key after use
+	return append([]byte(nil), keys[0]...), nil
+}
+
+// EpochKeys returns the keys of the key epochs 1 to KeyEpoch, which
+// DecryptMasterKey has decrypted. New files are encrypted with the last one.
+// The caller should wipe them after use.
+func (cf *ConfFile) EpochKeys() (keys [][]byte) {
+	if len(cf.epochKeys) < 2 {
+		return nil
+	}
+	for _, k := range cf.epochKeys[1:] {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	return keys
+}
+
+// AddKeyEpoch generates the key for a new key epoch and locks it with
+// "password", which must be the current password. The config must have been
+// unlocked with DecryptMasterKey, which returned "masterkey". The previous
+// keys are kept for the existing files. The key slots lock the old key and
+// are removed.
+func (cf *ConfFile) AddKeyEpoch(masterkey []byte, password []byte) error {
+	if cf.KeyEpoch == MaxKeyEpoch {
+		return fmt.Errorf("the maximum of %d key epochs has been reached", MaxKeyEpoch)
+	}
+	keys := cf.epochKeys
+	if cf.KeyEpoch == 0 {
+		keys = [][]byte{masterkey}
+	}
+	if len(keys) != int(cf.KeyEpoch)+1 {
+		return fmt.Errorf("the key epochs have not been decrypted")
+	}
+	newest := cryptocore.RandBytes(cryptocore.KeyLen)
+	ce := getKeyEncrypter(cryptocore.KeyEpochsKey(newest), true)
+	defer ce.Wipe()
+	cf.EncryptedEpochKeys = nil
+	for i, key := range keys {
+		cf.EncryptedEpochKeys = append(cf.EncryptedEpochKeys, ce.EncryptBlock(key, uint64(i), nil))
+	}
+	cf.KeyEpoch++
+	cf.setFeatureFlag(FlagKeyEpochs)
+	cf.epochKeys = append(keys, newest)
+	cf.EncryptKey(nil, password, cf.ScryptObject.LogN())
+	cf.removeKeySlots()
+	return nil
+}
+
+// validateKeyEpochs checks that the KeyEpochs feature flag and the keys
+// match
+func (cf *ConfFile) validateKeyEpochs() error {
+	if !cf.IsFeatureFlagSet(FlagKeyEpochs) {
+		if cf.KeyEpoch != 0 || len(cf.EncryptedEpochKeys) != 0 {
+			return fmt.Errorf("KeyEpoch is set but the KeyEpochs feature flag is not")
+		}
+		return nil
+	}
+	if cf.KeyEpoch == 0 {
+		return fmt.Errorf("KeyEpochs feature flag is set but KeyEpoch is 0")
+	}
+	if len(cf.EncryptedEpochKeys) != int(cf.KeyEpoch) {
+		return fmt.Errorf("KeyEpoch=%d, but there are %d EncryptedEpochKeys",
+			cf.KeyEpoch, len(cf.EncryptedEpochKeys))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package configfile
+
+import (
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Key slots unlock the master key without the password. Each slot locks
+// the key in EncryptedKey with its own random slot key, which is protected
+// by a device: the TPM ("-tpm2-enroll") or a PKCS#11 token
+// ("-pkcs11-enroll"). The password keeps working.
+
+// lockWithSlotKey encrypts the key that EncryptedKey holds with "slotKey".
+// The config must have been unlocked with DecryptMasterKey, which returned
+// "masterkey".
+func (cf *ConfFile) lockWithSlotKey(masterkey []byte, slotKey []byte) ([]byte, error) {
+	if len(slotKey) < cryptocore.KeyLen {
+		return nil, fmt.Errorf("slot key too short: %d bytes", len(slotKey))
+	}
+	key := masterkey
+	if cf.KeyEpoch > 0 {
+		if len(cf.epochKeys) != int(cf.KeyEpoch)+1 {
+			return nil, fmt.Errorf("the key epochs have not been decrypted")
+		}
+		key = cf.epochKeys[cf.KeyEpoch]
+	}
+	ce := getKeyEncrypter(slotKey, true)
+	defer ce.Wipe()
+	return ce.EncryptBlock(key, cf.keyBlockNo(), nil), nil
+}
+
+// unlockWithSlotKey decrypts "encrypted", which lockWithSlotKey has returned,
+// with "slotKey" and returns the master key. "device" names the device of
+// the key slot in the error message.
+func (cf *ConfFile) unlockWithSlotKey(encrypted []byte, slotKey []byte, device string) (masterkey []byte, err error) {
+	ce := getKeyEncrypter(slotKey, true)
+	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages
+	key, err := ce.DecryptBlock(encrypted, cf.keyBlockNo(), nil)
+	tlog.Warn.Enabled = true
+	ce.Wipe()
+	if err != nil {
+		return nil, exitcodes.NewErr(fmt.Sprintf("The key from the %s does not match its key slot.", device),
+			exitcodes.PasswordIncorrect)
+	}
+	return cf.decryptEpochKeys(key)
+}
+
+// HasKeySlots returns true if the master key is also locked in a key slot
+func (cf *ConfFile) HasKeySlots() bool {
+	return cf.TPM2 != nil || cf.PKCS11 != nil
+}
+
+// removeKeySlots removes all key slots. Called when the key in EncryptedKey
+// changes, which the slots cannot follow without their devices.
+func (cf *ConfFile) removeKeySlots() {
+	cf.TPM2 = nil
+	cf.PKCS11 = nil
+}
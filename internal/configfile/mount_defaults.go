@@ -0,0 +1,51 @@
+package configfile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// mountDefaultsMAC computes the MAC over "opts" with "key", which is
+// derived by cryptocore.MountDefaultsKey()
+func mountDefaultsMAC(opts []string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	// Options cannot contain null bytes, which makes the encoding unambiguous
+	mac.Write([]byte(strings.Join(opts, "\x00")))
+	return mac.Sum(nil)
+}
+
+// SetMountDefaults sets the mount options that are applied to every mount
+// and authenticates them with "masterkey". An empty list removes them.
+func (cf *ConfFile) SetMountDefaults(opts []string, masterkey []byte) {
+	if len(opts) == 0 {
+		cf.MountDefaults = nil
+		cf.MountDefaultsMAC = nil
+		return
+	}
+	cf.MountDefaults = opts
+	cf.MountDefaultsMAC = mountDefaultsMAC(opts, cryptocore.MountDefaultsKey(masterkey))
+}
+
+// VerifyMountDefaults checks that MountDefaults have been set by someone
+// who knows the master key
+func (cf *ConfFile) VerifyMountDefaults(masterkey []byte) error {
+	return cf.VerifyMountDefaultsKey(cryptocore.MountDefaultsKey(masterkey))
+}
+
+// VerifyMountDefaultsKey is VerifyMountDefaults with the key derived by
+// cryptocore.MountDefaultsKey(). The key can be kept after the master key
+// has been wiped.
+func (cf *ConfFile) VerifyMountDefaultsKey(key []byte) error {
+	if len(cf.MountDefaults) == 0 && len(cf.MountDefaultsMAC) == 0 {
+		return nil
+	}
+	if !hmac.Equal(cf.MountDefaultsMAC, mountDefaultsMAC(cf.MountDefaults, key)) {
+		return fmt.Errorf("the saved mount options %q have been modified without the master key",
+			strings.Join(cf.MountDefaults, ","))
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package configfile
+
+import (
+	"fmt"
+)
+
+// PKCS11Params is a key slot that unlocks the master key with an RSA key on
+// a PKCS#11 token, like a smartcard or an HSM ("-pkcs11-enroll"). The
+// private key never leaves the token.
+type PKCS11Params struct {
+	// Module is the path of the PKCS#11 module of the token, like
+	// "/usr/lib/opensc-pkcs11.so"
+	Module string
+	// KeyID is the CKA_ID of the RSA key pair on the token
+	KeyID []byte
+	// WrappedKey is the slot key, encrypted with the public key using
+	// RSA-OAEP with SHA-256. The token decrypts it.
+	WrappedKey []byte
+	// EncryptedKey holds the same key as ConfFile.EncryptedKey, encrypted
+	// with the slot key
+	EncryptedKey []byte
+}
+
+// SetPKCS11 adds the PKCS#11 key slot "p", which locks the key in
+// EncryptedKey with "slotKey". p.WrappedKey must hold "slotKey" wrapped
+// by the token, p.EncryptedKey is set here. The config must have been
+// unlocked with DecryptMasterKey, which returned "masterkey". An existing
+// PKCS#11 key slot is replaced.
+func (cf *ConfFile) SetPKCS11(masterkey []byte, slotKey []byte, p PKCS11Params) (err error) {
+	p.EncryptedKey, err = cf.lockWithSlotKey(masterkey, slotKey)
+	if err != nil {
+		return err
+	}
+	cf.PKCS11 = &p
+	return nil
+}
+
+// DecryptMasterKeyPKCS11 decrypts the master key with "slotKey", which the
+// token has unwrapped from PKCS11.WrappedKey
+func (cf *ConfFile) DecryptMasterKeyPKCS11(slotKey []byte) (masterkey []byte, err error) {
+	if cf.PKCS11 == nil {
+		return nil, fmt.Errorf("no PKCS#11 key slot")
+	}
+	return cf.unlockWithSlotKey(cf.PKCS11.EncryptedKey, slotKey, "PKCS#11 token")
+}
+
+// validatePKCS11 checks that the PKCS#11 key slot is complete
+func (cf *ConfFile) validatePKCS11() error {
+	if cf.PKCS11 == nil {
+		return nil
+	}
+	p := cf.PKCS11
+	if p.Module == "" || len(p.KeyID) == 0 || len(p.WrappedKey) == 0 || len(p.EncryptedKey) == 0 {
+		return fmt.Errorf("PKCS#11 key slot is incomplete")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package configfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/hybridkem"
+)
+
+// hkdfInfoPQHybrid is the HKDF info string for combining the scrypt hash
+// with the "-pqkey" secret
+const hkdfInfoPQHybrid = "X25519+ML-KEM-768 master key wrapping"
+
+// PQHybridParams is a structure for storing the "-pqkey" parameters.
+type PQHybridParams struct {
+	// Ciphertext is the encapsulated key, see hybridkem.Encapsulate
+	Ciphertext []byte
+}
+
+// encapsulatePQHybrid sets the PQHybrid feature flag and creates a new
+// encapsulated key for the key file content "seed". Used by Create.
+func (cf *ConfFile) encapsulatePQHybrid(seed []byte) error {
+	shared, ciphertext, err := hybridkem.Encapsulate(seed)
+	if err != nil {
+		return err
+	}
+	cf.setFeatureFlag(FlagPQHybrid)
+	cf.PQHybrid = &PQHybridParams{Ciphertext: ciphertext}
+	cf.pqSecret = shared
+	return nil
+}
+
+// UnlockPQHybrid decapsulates the "-pqkey" secret using the key file
+// content "seed". It must be called before DecryptMasterKey and EncryptKey
+// on filesystems that have the PQHybrid feature flag.
+func (cf *ConfFile) UnlockPQHybrid(seed []byte) error {
+	if !cf.IsFeatureFlagSet(FlagPQHybrid) {
+		return nil
+	}
+	shared, err := hybridkem.Decapsulate(seed, cf.PQHybrid.Ciphertext)
+	if err != nil {
+		return err
+	}
+	cf.pqSecret = shared
+	return nil
+}
+
+// mixPQSecret combines the scrypt hash with the "-pqkey" secret, so that
+// unlocking the masterkey needs both. The scrypt hash is wiped. Without the
+// PQHybrid feature flag, it is returned unchanged.
+func (cf *ConfFile) mixPQSecret(scryptHash []byte) ([]byte, error) {
+	if !cf.IsFeatureFlagSet(FlagPQHybrid) {
+		return scryptHash, nil
+	}
+	defer func() {
+		for i := range scryptHash {
+			scryptHash[i] = 0
+		}
+	}()
+	if cf.pqSecret == nil {
+		return nil, exitcodes.NewErr("Masterkey protected by a -pqkey key file; need to use the -pqkey option.",
+			exitcodes.Usage)
+	}
+	out := make([]byte, len(scryptHash))
+	h := hkdf.New(sha256.New, scryptHash, cf.pqSecret, []byte(hkdfInfoPQHybrid))
+	if _, err := io.ReadFull(h, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// validatePQHybrid checks that the PQHybrid feature flag and parameters
+// match
+func (cf *ConfFile) validatePQHybrid() error {
+	if !cf.IsFeatureFlagSet(FlagPQHybrid) {
+		if cf.PQHybrid != nil {
+			return fmt.Errorf("PQHybrid parameters present but the PQHybrid feature flag is NOT set")
+		}
+		return nil
+	}
+	if cf.PQHybrid == nil || len(cf.PQHybrid.Ciphertext) != hybridkem.CiphertextLen {
+		return fmt.Errorf("PQHybrid feature flag set but the ciphertext is missing or has the wrong length")
+	}
+	return nil
+}
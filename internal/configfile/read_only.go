@@ -0,0 +1,22 @@
+package configfile
+
+// keyBlockNo returns the block number that EncryptedKey is encrypted with.
+// It is part of the authenticated data, which binds the ReadOnly feature flag
+// to the password: a config file that has the flag removed no longer
+// decrypts.
+func (cf *ConfFile) keyBlockNo() uint64 {
+	if cf.IsFeatureFlagSet(FlagReadOnly) {
+		return 1
+	}
+	return 0
+}
+
+// SetReadOnly marks the filesystem as read-only for good and locks the
+// master key with "password" again, which must be the current password. The
+// config must have been unlocked with DecryptMasterKey, which returned
+// "masterkey". The key slots no longer decrypt and are removed.
+func (cf *ConfFile) SetReadOnly(masterkey []byte, password []byte) {
+	cf.setFeatureFlag(FlagReadOnly)
+	cf.EncryptKey(masterkey, password, cf.ScryptObject.LogN())
+	cf.removeKeySlots()
+}
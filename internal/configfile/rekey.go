@@ -0,0 +1,34 @@
+package configfile
+
+import (
+	"fmt"
+)
+
+// Rekey replaces the master key with the new key "masterkey", locks it with
+// "password", which must be the current password, and moves the config to
+// "filename" (see WriteFile). The filesystem keeps its settings. Key epochs
+// and key slots belong to the old key and are removed, and the mount
+// defaults are authenticated with the new key. The config must have been
+// unlocked with DecryptMasterKey. The files must then be re-encrypted with
+// the new key ("-rekey").
+func (cf *ConfFile) Rekey(filename string, masterkey []byte, password []byte) error {
+	if cf.IsFeatureFlagSet(FlagSubvolumes) {
+		// Each subvolume key is locked with its own password
+		return fmt.Errorf("filesystems with subvolumes cannot be rekeyed")
+	}
+	var flags []string
+	for _, f := range cf.FeatureFlags {
+		if f != knownFlags[FlagKeyEpochs] {
+			flags = append(flags, f)
+		}
+	}
+	cf.FeatureFlags = flags
+	cf.KeyEpoch = 0
+	cf.EncryptedEpochKeys = nil
+	cf.epochKeys = nil
+	cf.removeKeySlots()
+	cf.SetMountDefaults(cf.MountDefaults, masterkey)
+	cf.EncryptKey(masterkey, password, cf.ScryptObject.LogN())
+	cf.filename = filename
+	return nil
+}
@@ -0,0 +1,45 @@
+package configfile
+
+import (
+	"fmt"
+)
+
+// CurrentSchema is the layout of gocryptfs.conf that this version of
+// gocryptfs writes. It is independent of Version, the on-disk format of the
+// encrypted files: a new schema only changes how the config file stores
+// things, like key slots or KDF parameters, and Load() upgrades older
+// layouts in memory. "-migrate-config" writes the upgrade to disk.
+// Schema 0 is the layout of all config files so far, which do not record
+// the schema at all.
+const CurrentSchema = 0
+
+// schemaMigrations[i] upgrades a config file from schema i to schema i+1.
+// Migrations only get the parsed config file, not the master key, and must
+// not change anything the encrypted files depend on. Bump CurrentSchema
+// together with adding one.
+var schemaMigrations = []struct {
+	desc    string
+	migrate func(cf *ConfFile)
+}{}
+
+// migrateSchema upgrades "cf" to CurrentSchema and records the steps for
+// Migrations()
+func (cf *ConfFile) migrateSchema() error {
+	if cf.SchemaVersion > CurrentSchema {
+		return fmt.Errorf("Config file schema %d is newer than schema %d, the newest this version "+
+			"of gocryptfs supports. Please upgrade gocryptfs.", cf.SchemaVersion, CurrentSchema)
+	}
+	for v := cf.SchemaVersion; v < CurrentSchema; v++ {
+		m := schemaMigrations[v]
+		m.migrate(cf)
+		cf.migrations = append(cf.migrations, fmt.Sprintf("schema %d to %d: %s", v, v+1, m.desc))
+	}
+	cf.SchemaVersion = CurrentSchema
+	return nil
+}
+
+// Migrations returns the schema upgrades that Load() has applied, oldest
+// first. They are written to disk by the next WriteFile().
+func (cf *ConfFile) Migrations() []string {
+	return cf.migrations
+}
@@ -1,13 +1,14 @@
 package configfile
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"math"
 	"os"
 
-	"golang.org/x/crypto/scrypt"
-
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -25,6 +26,16 @@ const (
 	// We reject all lower values that we might get through modified config files.
 	scryptMinR = 8
 	scryptMinP = 1
+	// Upper limits keep a modified config file (or a typo) from making
+	// unlocking take hours or run out of memory. One lane needs
+	// 128 * R * N bytes, which is at most 256 GiB at the maximum logN and
+	// the default R.
+	scryptMaxLogN      = 28
+	scryptMaxR         = 32
+	scryptMaxLaneBytes = 1 << 38
+	// Every lane that DeriveKey computes in parallel needs the full scrypt
+	// memory. We reject more lanes than a machine is likely to have cores.
+	scryptMaxP = 64
 	// logN=10 takes 6ms on a Pentium G630. This should be fast enough for all
 	// purposes. We reject lower values.
 	scryptMinLogN = 10
@@ -38,9 +49,10 @@ type ScryptKDF struct {
 	Salt []byte
 	// N: scrypt CPU/Memory cost parameter
 	N int
-	// R: scrypt block size parameter
+	// R: scrypt block size parameter ("-scryptr")
 	R int
-	// P: scrypt parallelization parameter
+	// P: scrypt parallelization parameter. DeriveKey computes the P lanes
+	// in parallel ("-scryptp").
 	P int
 	// KeyLen is the output data length
 	KeyLen int
@@ -55,8 +67,8 @@ func NewScryptKDF(logN int) ScryptKDF {
 	} else {
 		s.N = 1 << uint32(logN)
 	}
-	s.R = 8 // Always 8
-	s.P = 1 // Always 1
+	s.R = scryptMinR // Changed by "-scryptr"
+	s.P = 1          // Changed by "-scryptp"
 	s.KeyLen = cryptocore.KeyLen
 	return s
 }
@@ -67,7 +79,7 @@ func (s *ScryptKDF) DeriveKey(pw []byte) []byte {
 		tlog.Fatal.Println(err.Error())
 		os.Exit(exitcodes.ScryptParams)
 	}
-	k, err := scrypt.Key(pw, s.Salt, s.N, s.R, s.P, s.KeyLen)
+	k, err := parallelScryptKey(pw, s.Salt, s.N, s.R, s.P, s.KeyLen)
 	if err != nil {
 		log.Panicf("DeriveKey failed: %v", err)
 	}
@@ -89,12 +101,28 @@ func (s *ScryptKDF) validateParams() error {
 	if s.N < minN {
 		return fmt.Errorf("Fatal: scryptn below 10 is too low to make sense")
 	}
+	if s.N > 1<<scryptMaxLogN {
+		return fmt.Errorf("Fatal: scryptn above %d", scryptMaxLogN)
+	}
+	if s.N&(s.N-1) != 0 {
+		return fmt.Errorf("Fatal: scrypt parameter N is not a power of two: value=%d", s.N)
+	}
 	if s.R < scryptMinR {
 		return fmt.Errorf("Fatal: scrypt parameter R below minimum: value=%d, min=%d", s.R, scryptMinR)
 	}
+	if s.R > scryptMaxR {
+		return fmt.Errorf("Fatal: scrypt parameter R above maximum: value=%d, max=%d", s.R, scryptMaxR)
+	}
+	if laneBytes := 128 * uint64(s.R) * uint64(s.N); laneBytes > scryptMaxLaneBytes {
+		return fmt.Errorf("Fatal: scrypt needs too much memory: %d GiB per lane, max=%d GiB",
+			laneBytes>>30, scryptMaxLaneBytes>>30)
+	}
 	if s.P < scryptMinP {
 		return fmt.Errorf("Fatal: scrypt parameter P below minimum: value=%d, min=%d", s.P, scryptMinP)
 	}
+	if s.P > scryptMaxP {
+		return fmt.Errorf("Fatal: scrypt parameter P above maximum: value=%d, max=%d", s.P, scryptMaxP)
+	}
 	if len(s.Salt) < scryptMinSaltLen {
 		return fmt.Errorf("Fatal: scrypt salt length below minimum: value=%d, min=%d", len(s.Salt), scryptMinSaltLen)
 	}
@@ -103,3 +131,20 @@ func (s *ScryptKDF) validateParams() error {
 	}
 	return nil
 }
+
+// derivedKeyLen returns the length of the keys DeriveKey returns
+func (s *ScryptKDF) derivedKeyLen() int {
+	return s.KeyLen
+}
+
+// cacheDescription returns the name of the kernel keyring entry that holds
+// the key derived from "pw" ("-kdfcache"). It covers all parameters, so an
+// entry is never used for a different config or password.
+func (s *ScryptKDF) cacheDescription(pw []byte) string {
+	h := sha256.New()
+	h.Write([]byte("gocryptfs kdf cache"))
+	h.Write(s.Salt)
+	binary.Write(h, binary.BigEndian, []uint64{uint64(s.N), uint64(s.R), uint64(s.P), uint64(s.KeyLen)})
+	h.Write(pw)
+	return "gocryptfs:kdf:" + hex.EncodeToString(h.Sum(nil))
+}
@@ -1,8 +1,12 @@
 package configfile
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
 )
 
 /*
@@ -43,3 +47,91 @@ func benchmarkScryptN(b *testing.B, n int) {
 	}
 	b.ReportAllocs()
 }
+
+// parallelScryptKey must compute the same key as the reference implementation
+func TestParallelScrypt(t *testing.T) {
+	salt := []byte("0123456789abcdef0123456789abcdef")
+	for _, p := range []int{1, 3, 8} {
+		want, err := scrypt.Key(testPw, salt, 1024, 8, p, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := parallelScryptKey(testPw, salt, 1024, 8, p, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("p=%d: wrong key", p)
+		}
+	}
+}
+
+// validateParams must reject parameters outside of the limits
+func TestScryptParamsBounds(t *testing.T) {
+	for _, tc := range []struct {
+		n, r, p int
+		ok      bool
+	}{
+		{1 << 10, 8, 1, true},
+		{1 << 28, 8, 1, true},
+		{1 << 20, 32, 64, true},
+		{1 << 9, 8, 1, false},
+		{1 << 29, 8, 1, false},
+		{3 << 10, 8, 1, false},
+		{1 << 10, 7, 1, false},
+		{1 << 10, 33, 1, false},
+		{1 << 28, 16, 1, false},
+		{1 << 10, 8, 0, false},
+		{1 << 10, 8, 65, false},
+	} {
+		s := NewScryptKDF(10)
+		s.N, s.R, s.P = tc.n, tc.r, tc.p
+		if err := s.validateParams(); (err == nil) != tc.ok {
+			t.Errorf("N=%d R=%d P=%d: ok=%v, err=%v", tc.n, tc.r, tc.p, tc.ok, err)
+		}
+	}
+}
+
+// Test that "-scryptr" and "-scryptp" survive a password change, and that
+// "-kdfcache" takes the key from the kernel keyring
+func TestScryptPAndCache(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		ScryptR:  16,
+		ScryptP:  4,
+		Creator:  "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.EncryptKey(masterkey, testPw, 10)
+	if c.ScryptObject.R != 16 || c.ScryptObject.P != 4 {
+		t.Errorf("R=%d P=%d after EncryptKey, want 16 and 4", c.ScryptObject.R, c.ScryptObject.P)
+	}
+
+	c.CacheDerivedKey(time.Minute)
+	desc := c.ScryptObject.cacheDescription(testPw)
+	if _, err = c.DecryptMasterKey(testPw); err != nil {
+		t.Fatal(err)
+	}
+	k := kdfCacheGet(desc)
+	if k == nil {
+		t.Skip("kernel keyring not available")
+	}
+	if !bytes.Equal(k, c.ScryptObject.DeriveKey(testPw)) {
+		t.Fatal("wrong key in cache")
+	}
+	// A wrong cached key makes the password fail
+	if err = kdfCachePut(desc, make([]byte, len(k)), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.DecryptMasterKey(testPw); err == nil {
+		t.Error("the cache has not been used")
+	}
+	kdfCachePut(desc, k, time.Second)
+}
@@ -0,0 +1,149 @@
+package configfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// SubvolumeParams describes a directory that has its own key, locked with
+// its own password ("-add-subvolume"). The names and the file contents
+// below the directory are encrypted with this key instead of the master key.
+type SubvolumeParams struct {
+	// Path is the plaintext path of the directory, relative to the root of
+	// the filesystem. Like Label, it is not encrypted.
+	Path string
+	// EncryptedKey holds the key of the subvolume, encrypted with a key
+	// derived from its password. Path is authenticated as additional data.
+	EncryptedKey []byte
+	// ScryptObject stores the parameters for hashing the password
+	ScryptObject ScryptKDF
+}
+
+// NormalizeSubvolumePath returns "p" relative to the root of the filesystem,
+// without leading slash, like it is stored in SubvolumeParams.Path
+func NormalizeSubvolumePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// isBelow returns true if "p" is the directory "dir" or inside it
+func isBelow(p string, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// pathID returns the additional data that binds the encrypted key to the
+// path of the subvolume. DecryptBlock wants a 16-byte file ID.
+func pathID(p string) []byte {
+	h := sha256.Sum256([]byte(p))
+	return h[:16]
+}
+
+// Subvolume returns the subvolume whose directory is "p" or contains "p",
+// or nil if there is none
+func (cf *ConfFile) Subvolume(p string) *SubvolumeParams {
+	p = NormalizeSubvolumePath(p)
+	for i := range cf.Subvolumes {
+		if isBelow(p, cf.Subvolumes[i].Path) {
+			return &cf.Subvolumes[i]
+		}
+	}
+	return nil
+}
+
+// CheckNewSubvolume returns an error if the directory "p" cannot become a
+// subvolume: if it is the root directory, or if it overlaps with an existing
+// subvolume.
+func (cf *ConfFile) CheckNewSubvolume(p string) error {
+	p = NormalizeSubvolumePath(p)
+	if p == "" {
+		return fmt.Errorf("the root directory cannot be a subvolume")
+	}
+	for _, sv := range cf.Subvolumes {
+		if isBelow(p, sv.Path) || isBelow(sv.Path, p) {
+			return fmt.Errorf("%q overlaps with the subvolume %q", p, sv.Path)
+		}
+	}
+	return nil
+}
+
+// AddSubvolume generates a key for the new subvolume at "p" and locks it
+// with "password", using scrypt with cost parameter "logN".
+func (cf *ConfFile) AddSubvolume(p string, password []byte, logN int) error {
+	if err := cf.CheckNewSubvolume(p); err != nil {
+		return err
+	}
+	p = NormalizeSubvolumePath(p)
+	sv := SubvolumeParams{
+		Path:         p,
+		ScryptObject: NewScryptKDF(logN),
+	}
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	scryptHash := sv.ScryptObject.DeriveKey(password)
+	ce := getKeyEncrypter(scryptHash, true)
+	sv.EncryptedKey = ce.EncryptBlock(key, 0, pathID(p))
+	for i := range scryptHash {
+		scryptHash[i] = 0
+	}
+	for i := range key {
+		key[i] = 0
+	}
+	ce.Wipe()
+	cf.Subvolumes = append(cf.Subvolumes, sv)
+	cf.setFeatureFlag(FlagSubvolumes)
+	return nil
+}
+
+// DecryptKey decrypts the key of the subvolume with its password. The
+// caller should wipe it after use.
+func (sv *SubvolumeParams) DecryptKey(password []byte) ([]byte, error) {
+	scryptHash := sv.ScryptObject.DeriveKey(password)
+	ce := getKeyEncrypter(scryptHash, true)
+	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
+	key, err := ce.DecryptBlock(sv.EncryptedKey, 0, pathID(sv.Path))
+	tlog.Warn.Enabled = true
+	for i := range scryptHash {
+		scryptHash[i] = 0
+	}
+	ce.Wipe()
+	if err != nil {
+		return nil, exitcodes.NewErr(fmt.Sprintf("Password for subvolume %q incorrect.", sv.Path),
+			exitcodes.PasswordIncorrect)
+	}
+	return key, nil
+}
+
+// validateSubvolumes checks that the Subvolumes feature flag and the list
+// match, and that the subvolumes do not overlap
+func (cf *ConfFile) validateSubvolumes() error {
+	if !cf.IsFeatureFlagSet(FlagSubvolumes) {
+		if len(cf.Subvolumes) != 0 {
+			return fmt.Errorf("Subvolumes are set but the Subvolumes feature flag is NOT set")
+		}
+		return nil
+	}
+	if len(cf.Subvolumes) == 0 {
+		return fmt.Errorf("Subvolumes feature flag is set but there are no subvolumes")
+	}
+	if cf.IsFeatureFlagSet(FlagFlatLayout) {
+		return fmt.Errorf("FlatLayout conflicts with Subvolumes feature flag")
+	}
+	for i, sv := range cf.Subvolumes {
+		if sv.Path == "" || sv.Path != NormalizeSubvolumePath(sv.Path) {
+			return fmt.Errorf("invalid subvolume path %q", sv.Path)
+		}
+		if err := sv.ScryptObject.validateParams(); err != nil {
+			return fmt.Errorf("subvolume %q: %v", sv.Path, err)
+		}
+		for _, sv2 := range cf.Subvolumes[i+1:] {
+			if isBelow(sv.Path, sv2.Path) || isBelow(sv2.Path, sv.Path) {
+				return fmt.Errorf("subvolumes %q and %q overlap", sv.Path, sv2.Path)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package configfile
+
+import (
+	"fmt"
+)
+
+// TPM2Params is a key slot that unlocks the master key with a key sealed to
+// the TPM of one machine ("-tpm2-enroll").
+type TPM2Params struct {
+	// Public and Private are the sealed object as written by tpm2_create.
+	// Only the TPM that has sealed it can load it.
+	Public  []byte
+	Private []byte
+	// PCRs is the PCR selection the sealed key is bound to, like
+	// "sha256:0,7". Empty if it is not bound to PCRs.
+	PCRs string `json:",omitempty"`
+	// EncryptedKey holds the same key as ConfFile.EncryptedKey, encrypted
+	// with the sealed key
+	EncryptedKey []byte
+}
+
+// SetTPM2 adds the TPM2 key slot "p", which locks the key in EncryptedKey
+// with "sealedKey". p.EncryptedKey is set here. The config must have been
+// unlocked with DecryptMasterKey, which returned "masterkey". An existing
+// TPM2 key slot is replaced.
+func (cf *ConfFile) SetTPM2(masterkey []byte, sealedKey []byte, p TPM2Params) (err error) {
+	p.EncryptedKey, err = cf.lockWithSlotKey(masterkey, sealedKey)
+	if err != nil {
+		return err
+	}
+	cf.TPM2 = &p
+	return nil
+}
+
+// DecryptMasterKeyTPM2 decrypts the master key with "sealedKey", which the
+// TPM has unsealed from the TPM2 key slot
+func (cf *ConfFile) DecryptMasterKeyTPM2(sealedKey []byte) (masterkey []byte, err error) {
+	if cf.TPM2 == nil {
+		return nil, fmt.Errorf("no TPM2 key slot")
+	}
+	return cf.unlockWithSlotKey(cf.TPM2.EncryptedKey, sealedKey, "TPM")
+}
+
+// validateTPM2 checks that the TPM2 key slot is complete
+func (cf *ConfFile) validateTPM2() error {
+	if cf.TPM2 == nil {
+		return nil
+	}
+	if len(cf.TPM2.Public) == 0 || len(cf.TPM2.Private) == 0 || len(cf.TPM2.EncryptedKey) == 0 {
+		return fmt.Errorf("TPM2 key slot is incomplete")
+	}
+	return nil
+}
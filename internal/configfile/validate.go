@@ -11,8 +11,15 @@ func (cf *ConfFile) Validate() error {
 	if cf.Version != contentenc.CurrentVersion {
 		return fmt.Errorf("Unsupported on-disk format %d", cf.Version)
 	}
-	// scrypt params ok?
-	if err := cf.ScryptObject.validateParams(); err != nil {
+	// KDF params ok?
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		if cf.Argon2idObject == nil {
+			return fmt.Errorf("Argon2id feature flag is set, but Argon2idObject is missing")
+		}
+		if err := cf.Argon2idObject.validateParams(); err != nil {
+			return err
+		}
+	} else if err := cf.ScryptObject.validateParams(); err != nil {
 		return err
 	}
 	// All feature flags that are in the config file are known?
@@ -38,8 +45,29 @@ func (cf *ConfFile) Validate() error {
 				return fmt.Errorf("XChaCha20Poly1305 requires HKDF feature flag")
 			}
 		}
+		if cf.IsFeatureFlagSet(FlagAEGIS256) {
+			if cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) || cf.IsFeatureFlagSet(FlagAESSIV) {
+				return fmt.Errorf("AEGIS256 conflicts with XChaCha20Poly1305 and AESSIV feature flags")
+			}
+			if cf.IsFeatureFlagSet(FlagGCMIV128) {
+				return fmt.Errorf("AEGIS256 conflicts with GCMIV128 feature flag")
+			}
+			if !cf.IsFeatureFlagSet(FlagHKDF) {
+				return fmt.Errorf("AEGIS256 requires HKDF feature flag")
+			}
+		}
+		if cf.IsFeatureFlagSet(FlagAES128) {
+			if cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) || cf.IsFeatureFlagSet(FlagAESSIV) ||
+				cf.IsFeatureFlagSet(FlagAEGIS256) {
+				return fmt.Errorf("AES128 conflicts with XChaCha20Poly1305, AESSIV and AEGIS256 feature flags")
+			}
+			if !cf.IsFeatureFlagSet(FlagHKDF) {
+				return fmt.Errorf("AES128 requires HKDF feature flag")
+			}
+		}
 		// The absence of other flags means AES-GCM (oldest algorithm)
-		if !cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) && !cf.IsFeatureFlagSet(FlagAESSIV) {
+		if !cf.IsFeatureFlagSet(FlagXChaCha20Poly1305) && !cf.IsFeatureFlagSet(FlagAESSIV) &&
+			!cf.IsFeatureFlagSet(FlagAEGIS256) {
 			if !cf.IsFeatureFlagSet(FlagGCMIV128) {
 				return fmt.Errorf("AES-GCM requires GCMIV128 feature flag")
 			}
@@ -63,6 +91,23 @@ func (cf *ConfFile) Validate() error {
 			if cf.IsFeatureFlagSet(FlagLongNameMax) {
 				return fmt.Errorf("PlaintextNames conflicts with LongNameMax feature flag")
 			}
+			if cf.IsFeatureFlagSet(FlagLongNameBLAKE3) {
+				return fmt.Errorf("PlaintextNames conflicts with LongNameBLAKE3 feature flag")
+			}
+			if cf.IsFeatureFlagSet(FlagHCTR2Names) {
+				return fmt.Errorf("PlaintextNames conflicts with HCTR2Names feature flag")
+			}
+		}
+		if cf.IsFeatureFlagSet(FlagHCTR2Names) {
+			if cf.IsFeatureFlagSet(FlagEMENames) {
+				return fmt.Errorf("HCTR2Names conflicts with EMENames feature flag")
+			}
+			if !cf.IsFeatureFlagSet(FlagHKDF) {
+				return fmt.Errorf("HCTR2Names requires HKDF feature flag")
+			}
+		}
+		if cf.IsFeatureFlagSet(FlagLongNameBLAKE3) && !cf.IsFeatureFlagSet(FlagLongNames) {
+			return fmt.Errorf("LongNameBLAKE3 requires LongNames feature flag")
 		}
 		if cf.IsFeatureFlagSet(FlagEMENames) {
 			// All combinations of DirIV, LongNames, Raw64 allowed
@@ -74,5 +119,39 @@ func (cf *ConfFile) Validate() error {
 			return fmt.Errorf("LongNameMax=0 but the LongNameMax feature flag IS set")
 		}
 	}
+	if cf.WORMRetention != "" && !cf.IsFeatureFlagSet(FlagWORM) {
+		return fmt.Errorf("WORMRetention is set but the WORM feature flag is NOT set")
+	}
+	if cf.IsFeatureFlagSet(FlagFlatImage) && !cf.IsFeatureFlagSet(FlagFlatLayout) {
+		return fmt.Errorf("FlatImage requires the FlatLayout feature flag")
+	}
+	if cf.ImageMaxSize != 0 && !cf.IsFeatureFlagSet(FlagFlatImage) {
+		return fmt.Errorf("ImageMaxSize is set but the FlatImage feature flag is NOT set")
+	}
+	if cf.IsFeatureFlagSet(FlagFlatLayout) {
+		if cf.IsFeatureFlagSet(FlagPlaintextNames) {
+			return fmt.Errorf("FlatLayout conflicts with PlaintextNames feature flag")
+		}
+		if cf.IsFeatureFlagSet(FlagMerkleTree) || cf.IsFeatureFlagSet(FlagBindPath) || cf.IsFeatureFlagSet(FlagWORM) ||
+			cf.IsFeatureFlagSet(FlagImmutable) {
+			return fmt.Errorf("FlatLayout conflicts with MerkleTree, BindPath, WORM and Immutable feature flags")
+		}
+	}
+	// Master key wrapping
+	if err := cf.validatePQHybrid(); err != nil {
+		return err
+	}
+	if err := cf.validateKeyEpochs(); err != nil {
+		return err
+	}
+	if err := cf.validateTPM2(); err != nil {
+		return err
+	}
+	if err := cf.validatePKCS11(); err != nil {
+		return err
+	}
+	if err := cf.validateSubvolumes(); err != nil {
+		return err
+	}
 	return nil
 }
@@ -3,6 +3,7 @@ package contentenc
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -54,11 +55,22 @@ type ContentEnc struct {
 	CReqPool bPool
 	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE.
 	PReqPool bPool
+	// keyEpochs are the ContentEnc instances for the key epochs 1, 2, ...
+	// ("-new-key-epoch"). This instance is epoch 0.
+	keyEpochs []*ContentEnc
+	// writeThreads is the number of goroutines that encrypt a large write
+	// ("-write_threads")
+	writeThreads int
+	// headerFeatures is what ParseHeader accepts on this filesystem
+	headerFeatures HeaderFeatures
+	// headerLen is the length of the file header including the extension
+	// set by SetHeaderExt
+	headerLen uint64
 }
 
 // New returns an initialized ContentEnc instance.
 func New(cc *cryptocore.CryptoCore, plainBS uint64) *ContentEnc {
-	tlog.Debug.Printf("contentenc.New: plainBS=%d", plainBS)
+	tlog.ContentEnc.Debug.Printf("contentenc.New: plainBS=%d", plainBS)
 
 	if fuse.MAX_KERNEL_WRITE%plainBS != 0 {
 		log.Panicf("unaligned MAX_KERNEL_WRITE=%d", fuse.MAX_KERNEL_WRITE)
@@ -81,10 +93,88 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64) *ContentEnc {
 		CReqPool:     newBPool(cReqSize),
 		pBlockPool:   newBPool(int(plainBS)),
 		PReqPool:     newBPool(pReqSize),
+		writeThreads: runtime.NumCPU(),
+		headerLen:    HeaderLen,
+	}
+	if c.writeThreads > encryptMaxSplit {
+		c.writeThreads = encryptMaxSplit
 	}
 	return c
 }
 
+// SetWriteThreads sets the number of goroutines that encrypt a large write
+// request ("-write_threads"). The default is the number of CPUs, but at most
+// 2.
+func (be *ContentEnc) SetWriteThreads(n int) {
+	be.writeThreads = n
+	for _, e := range be.keyEpochs {
+		e.writeThreads = n
+	}
+}
+
+// SetKeyEpochs adds the crypto cores of the key epochs 1, 2, ... . New files
+// are encrypted in the last one.
+func (be *ContentEnc) SetKeyEpochs(ccs []*cryptocore.CryptoCore) {
+	be.keyEpochs = nil
+	be.headerFeatures.KeyEpochs = len(ccs) > 0
+	for _, cc := range ccs {
+		e := New(cc, be.plainBS)
+		e.writeThreads = be.writeThreads
+		e.headerFeatures = be.headerFeatures
+		e.headerLen = be.headerLen
+		be.keyEpochs = append(be.keyEpochs, e)
+	}
+}
+
+// SetImmutable allows the immutable marker in the file headers. Must only be
+// called when the filesystem has the Immutable feature flag ("-immutable").
+func (be *ContentEnc) SetImmutable() {
+	be.headerFeatures.Immutable = true
+	for _, e := range be.keyEpochs {
+		e.headerFeatures.Immutable = true
+	}
+}
+
+// SetHeaderExt reserves "n" bytes behind the header of every file.
+// Filesystems created with "-merkle" keep the state of the hash tree there.
+func (be *ContentEnc) SetHeaderExt(n uint64) {
+	be.headerLen = HeaderLen + n
+	for _, e := range be.keyEpochs {
+		e.headerLen = be.headerLen
+	}
+}
+
+// HeaderLen returns the length of the file header including the extension,
+// which is where the first block starts. Use the constant HeaderLen for the
+// header alone.
+func (be *ContentEnc) HeaderLen() uint64 {
+	return be.headerLen
+}
+
+// HeaderFeatures returns what ParseHeader should accept for the files of
+// this filesystem
+func (be *ContentEnc) HeaderFeatures() HeaderFeatures {
+	return be.headerFeatures
+}
+
+// KeyEpoch returns the ContentEnc for the files of key epoch "epoch" (see
+// FileHeader), or nil if we do not have its key. The returned instance has
+// the same block sizes, so the pools are interchangeable.
+func (be *ContentEnc) KeyEpoch(epoch uint8) *ContentEnc {
+	if epoch == 0 {
+		return be
+	}
+	if int(epoch) > len(be.keyEpochs) {
+		return nil
+	}
+	return be.keyEpochs[epoch-1]
+}
+
+// CurrentKeyEpoch returns the key epoch that new files are encrypted in
+func (be *ContentEnc) CurrentKeyEpoch() uint8 {
+	return uint8(len(be.keyEpochs))
+}
+
 // PlainBS returns the plaintext block size
 func (be *ContentEnc) PlainBS() uint64 {
 	return be.plainBS
@@ -115,18 +205,52 @@ func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, file
 	return pBuf.Bytes(), err
 }
 
+const (
+	// dirIVLen is the length of a DirIV
+	dirIVLen = 16
+	// bindingLen is the length of the PathBinding() that BindPath() appends
+	// to the file ID
+	bindingLen = 16
+)
+
+// PathBinding returns a hash of "dirIV", the DirIV of the parent directory,
+// and "cName", the encrypted name of the file. For long names, this is the
+// hashed gocryptfs.longname.* name.
+func PathBinding(dirIV []byte, cName string) []byte {
+	if len(dirIV) != dirIVLen {
+		log.Panicf("wrong dirIV length: %d", len(dirIV))
+	}
+	h := sha256.New()
+	h.Write(dirIV)
+	h.Write([]byte(cName))
+	return h.Sum(nil)[:bindingLen]
+}
+
+// BindPath returns "fileID" followed by "binding" from PathBinding(). The
+// result can be passed instead of the file ID to bind the file contents to
+// their directory and name ("-bindpath").
+func BindPath(fileID []byte, binding []byte) []byte {
+	if len(binding) != bindingLen {
+		log.Panicf("wrong binding length: %d", len(binding))
+	}
+	out := make([]byte, 0, len(fileID)+bindingLen)
+	out = append(out, fileID...)
+	return append(out, binding...)
+}
+
 // concatAD concatenates the block number and the file ID to a byte blob
 // that can be passed to AES-GCM as associated data (AD).
 // Result is: aData = [blockNo.bigEndian fileID].
 func concatAD(blockNo uint64, fileID []byte) (aData []byte) {
-	if fileID != nil && len(fileID) != headerIDLen {
+	if l := len(fileID) &^ 1; fileID != nil && l != headerIDLen && l != headerIDLen+bindingLen {
 		// fileID is nil when decrypting the master key from the config file,
-		// and for symlinks and xattrs.
+		// and for symlinks and xattrs. It is longer with BindPath(), and one
+		// byte longer with Immutable().
 		log.Panicf("wrong fileID length: %d", len(fileID))
 	}
 	const lenUint64 = 8
 	// Preallocate space to save an allocation in append()
-	aData = make([]byte, lenUint64, lenUint64+headerIDLen)
+	aData = make([]byte, lenUint64, lenUint64+len(fileID))
 	binary.BigEndian.PutUint64(aData, blockNo)
 	aData = append(aData, fileID...)
 	return aData
@@ -145,12 +269,12 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 
 	// All-zero block?
 	if bytes.Equal(ciphertext, be.allZeroBlock) {
-		tlog.Debug.Printf("DecryptBlock: file hole encountered")
+		tlog.ContentEnc.Debug.Printf("DecryptBlock: file hole encountered")
 		return make([]byte, be.plainBS), nil
 	}
 
 	if len(ciphertext) < be.cryptoCore.IVLen {
-		tlog.Warn.Printf("DecryptBlock: Block is too short: %d bytes", len(ciphertext))
+		tlog.ContentEnc.Warn.Printf("DecryptBlock: Block is too short: %d bytes", len(ciphertext))
 		return nil, errors.New("Block is too short")
 	}
 
@@ -172,8 +296,8 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 	plaintext, err := be.cryptoCore.AEADCipher.Open(plaintext, nonce, ciphertext, aData)
 
 	if err != nil {
-		tlog.Debug.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertextOrig))
-		tlog.Debug.Println(hex.Dump(ciphertextOrig))
+		tlog.ContentEnc.Debug.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertextOrig))
+		tlog.ContentEnc.Debug.Println(hex.Dump(ciphertextOrig))
 		return nil, err
 	}
 
@@ -182,15 +306,15 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 
 // At some point, splitting the ciphertext into more groups will not improve
 // performance, as spawning goroutines comes at a cost.
-// 2 seems to work ok for now.
+// 2 seems to work ok for now. This is the default of "-write_threads".
 const encryptMaxSplit = 2
 
-// encryptBlocksParallel splits the plaintext into parts and encrypts them
-// in parallel.
+// encryptBlocksParallel splits the plaintext into writeThreads parts and
+// encrypts them in parallel.
 func (be *ContentEnc) encryptBlocksParallel(plaintextBlocks [][]byte, ciphertextBlocks [][]byte, firstBlockNo uint64, fileID []byte) {
-	ncpu := runtime.NumCPU()
-	if ncpu > encryptMaxSplit {
-		ncpu = encryptMaxSplit
+	ncpu := be.writeThreads
+	if ncpu > len(plaintextBlocks) {
+		ncpu = len(plaintextBlocks)
 	}
 	groupSize := len(plaintextBlocks) / ncpu
 	var wg sync.WaitGroup
@@ -220,7 +344,7 @@ func (be *ContentEnc) encryptBlocksParallel(plaintextBlocks [][]byte, ciphertext
 func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
 	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
 	// For large writes, we parallelize encryption.
-	if len(plaintextBlocks) >= 32 && runtime.NumCPU() >= 2 {
+	if len(plaintextBlocks) >= 32 && be.writeThreads >= 2 {
 		be.encryptBlocksParallel(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
 	} else {
 		be.doEncryptBlocks(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
@@ -1,6 +1,7 @@
 package contentenc
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
@@ -94,3 +95,106 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// A block encrypted with BindPath() only decrypts with the same DirIV and
+// name
+func TestBindPath(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true)
+	f := New(cc, DefaultBS)
+	fileID := make([]byte, headerIDLen)
+	iv1 := make([]byte, dirIVLen)
+	iv2 := make([]byte, dirIVLen)
+	iv2[0] = 1
+
+	ciphertext := f.EncryptBlock([]byte("hello"), 0, BindPath(fileID, PathBinding(iv1, "a")))
+	if _, err := f.DecryptBlock(ciphertext, 0, BindPath(fileID, PathBinding(iv1, "a"))); err != nil {
+		t.Error(err)
+	}
+	if _, err := f.DecryptBlock(ciphertext, 0, BindPath(fileID, PathBinding(iv2, "a"))); err == nil {
+		t.Error("block decrypted with a different DirIV")
+	}
+	if _, err := f.DecryptBlock(ciphertext, 0, BindPath(fileID, PathBinding(iv1, "b"))); err == nil {
+		t.Error("block decrypted with a different name")
+	}
+	if _, err := f.DecryptBlock(ciphertext, 0, fileID); err == nil {
+		t.Error("block decrypted without a DirIV")
+	}
+}
+
+// TestHeaderKeyEpoch checks that the key epoch survives Pack and ParseHeader,
+// that epoch 0 gives the header without key epochs, and that other epochs
+// are rejected on filesystems without key epochs
+func TestHeaderKeyEpoch(t *testing.T) {
+	h := RandomHeader()
+	if buf := h.Pack(); buf[0] != 0 || buf[1] != CurrentVersion {
+		t.Errorf("wrong version bytes: %x", buf[:2])
+	}
+	h.KeyEpoch = 7
+	if _, err := ParseHeader(h.Pack(), HeaderFeatures{}); err == nil {
+		t.Error("key epoch accepted without the KeyEpochs feature")
+	}
+	h2, err := ParseHeader(h.Pack(), HeaderFeatures{KeyEpochs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.KeyEpoch != 7 || h2.Version != CurrentVersion || !bytes.Equal(h2.ID, h.ID) {
+		t.Errorf("wrong header: %+v", h2)
+	}
+}
+
+// The immutable marker survives Pack and ParseHeader if enabled, and a block
+// of an immutable file does not decrypt once the marker has been cleared
+func TestHeaderImmutable(t *testing.T) {
+	h := RandomHeader()
+	h.KeyEpoch = 3
+	h.Immutable = true
+	if _, err := ParseHeader(h.Pack(), HeaderFeatures{KeyEpochs: true}); err == nil {
+		t.Error("immutable marker accepted without the Immutable feature")
+	}
+	h2, err := ParseHeader(h.Pack(), HeaderFeatures{KeyEpochs: true, Immutable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h2.Immutable || h2.KeyEpoch != 3 || h2.Version != CurrentVersion {
+		t.Errorf("wrong header: %+v", h2)
+	}
+
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true)
+	f := New(cc, DefaultBS)
+	ciphertext := f.EncryptBlock([]byte("hello"), 0, Immutable(h.ID))
+	if _, err := f.DecryptBlock(ciphertext, 0, Immutable(h.ID)); err != nil {
+		t.Error(err)
+	}
+	if _, err := f.DecryptBlock(ciphertext, 0, h.ID); err == nil {
+		t.Error("block decrypted without the immutable marker")
+	}
+}
+
+// TestWriteThreads checks that a large write encrypted by several goroutines
+// decrypts to the original plaintext, also with an odd number of blocks
+func TestWriteThreads(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true)
+	f := New(cc, DefaultBS)
+	fileID := make([]byte, headerIDLen)
+	var blocks [][]byte
+	var plaintext []byte
+	for i := 0; i < 33; i++ {
+		b := bytes.Repeat([]byte{byte(i)}, DefaultBS)
+		blocks = append(blocks, b)
+		plaintext = append(plaintext, b...)
+	}
+	for _, n := range []int{1, 3, 8} {
+		f.SetWriteThreads(n)
+		ciphertext := f.EncryptBlocks(blocks, 5, fileID)
+		have, err := f.DecryptBlocks(ciphertext, 5, fileID)
+		if err != nil {
+			t.Fatalf("n=%d: %v", n, err)
+		}
+		if !bytes.Equal(have, plaintext) {
+			t.Errorf("n=%d: wrong plaintext", n)
+		}
+	}
+}
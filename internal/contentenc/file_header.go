@@ -3,6 +3,17 @@ package contentenc
 // Per-file header
 //
 // Format: [ "Version" uint16 big endian ] [ "Id" 16 random bytes ]
+//
+// On filesystems with key epochs ("-new-key-epoch"), the high byte of
+// "Version" is the key epoch the file is encrypted with. It is zero for
+// epoch 0, which makes the header identical to the one without key epochs.
+//
+// On filesystems created with "-immutable", the highest bit of the low byte
+// marks an immutable file. The marker is also authenticated together with
+// each block, see Immutable().
+//
+// Older gocryptfs versions reject both, which is why they are only accepted
+// when the filesystem has the matching feature flag, see HeaderFeatures.
 
 import (
 	"bytes"
@@ -22,12 +33,27 @@ const (
 	headerIDLen      = 16 // 128 bit random file id
 	// HeaderLen is the total header length
 	HeaderLen = headerVersionLen + headerIDLen
+	// headerImmutable is the bit in "Version" that marks immutable files
+	headerImmutable = 0x80
 )
 
 // FileHeader represents the header stored on each non-empty file.
 type FileHeader struct {
 	Version uint16
 	ID      []byte
+	// KeyEpoch selects the content key, see ContentEnc.KeyEpoch
+	KeyEpoch uint8
+	// Immutable files cannot be written, truncated or renamed
+	Immutable bool
+}
+
+// HeaderFeatures selects the optional uses of "Version" that ParseHeader
+// accepts
+type HeaderFeatures struct {
+	// KeyEpochs accepts key epochs > 0 (feature flag KeyEpochs)
+	KeyEpochs bool
+	// Immutable accepts the immutable marker (feature flag Immutable)
+	Immutable bool
 }
 
 // Pack - serialize fileHeader object
@@ -36,7 +62,11 @@ func (h *FileHeader) Pack() []byte {
 		log.Panic("FileHeader object not properly initialized")
 	}
 	buf := make([]byte, HeaderLen)
-	binary.BigEndian.PutUint16(buf[0:headerVersionLen], h.Version)
+	version := uint16(h.KeyEpoch)<<8 | h.Version
+	if h.Immutable {
+		version |= headerImmutable
+	}
+	binary.BigEndian.PutUint16(buf[0:headerVersionLen], version)
 	copy(buf[headerVersionLen:], h.ID)
 	return buf
 
@@ -46,8 +76,9 @@ func (h *FileHeader) Pack() []byte {
 var allZeroFileID = make([]byte, headerIDLen)
 var allZeroHeader = make([]byte, HeaderLen)
 
-// ParseHeader - parse "buf" into fileHeader object
-func ParseHeader(buf []byte) (*FileHeader, error) {
+// ParseHeader - parse "buf" into fileHeader object. The key epoch and the
+// immutable marker are rejected unless enabled in "feat".
+func ParseHeader(buf []byte, feat HeaderFeatures) (*FileHeader, error) {
 	if len(buf) != HeaderLen {
 		return nil, fmt.Errorf("ParseHeader: invalid length, want=%d have=%d", HeaderLen, len(buf))
 	}
@@ -55,10 +86,21 @@ func ParseHeader(buf []byte) (*FileHeader, error) {
 		return nil, fmt.Errorf("ParseHeader: header is all-zero. Header hexdump: %s", hex.EncodeToString(buf))
 	}
 	var h FileHeader
-	h.Version = binary.BigEndian.Uint16(buf[0:headerVersionLen])
+	version := binary.BigEndian.Uint16(buf[0:headerVersionLen])
+	h.Version = version & (0xff &^ headerImmutable)
+	h.Immutable = version&headerImmutable != 0
+	h.KeyEpoch = uint8(version >> 8)
 	if h.Version != CurrentVersion {
 		return nil, fmt.Errorf("ParseHeader: invalid version, want=%d have=%d. Header hexdump: %s",
-			CurrentVersion, h.Version, hex.EncodeToString(buf))
+			CurrentVersion, version, hex.EncodeToString(buf))
+	}
+	if h.KeyEpoch > 0 && !feat.KeyEpochs {
+		return nil, fmt.Errorf("ParseHeader: key epoch %d, but the filesystem has no key epochs. Header hexdump: %s",
+			h.KeyEpoch, hex.EncodeToString(buf))
+	}
+	if h.Immutable && !feat.Immutable {
+		return nil, fmt.Errorf("ParseHeader: immutable marker is set, but not enabled on the filesystem. Header hexdump: %s",
+			hex.EncodeToString(buf))
 	}
 	h.ID = buf[headerVersionLen:]
 	if bytes.Equal(h.ID, allZeroFileID) {
@@ -75,3 +117,12 @@ func RandomHeader() *FileHeader {
 	h.ID = cryptocore.RandBytes(headerIDLen)
 	return &h
 }
+
+// Immutable returns the associated data "ad" of a file that is marked
+// immutable in its header. Clearing the marker on disk makes the blocks fail
+// authentication.
+func Immutable(ad []byte) []byte {
+	out := make([]byte, len(ad), len(ad)+1)
+	copy(out, ad)
+	return append(out, 1)
+}
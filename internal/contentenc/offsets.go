@@ -15,15 +15,15 @@ func (be *ContentEnc) PlainOffToBlockNo(plainOffset uint64) uint64 {
 
 // CipherOffToBlockNo converts the ciphertext offset to the plaintext block number.
 func (be *ContentEnc) CipherOffToBlockNo(cipherOffset uint64) uint64 {
-	if cipherOffset < HeaderLen {
+	if cipherOffset < be.headerLen {
 		log.Panicf("BUG: offset %d is inside the file header", cipherOffset)
 	}
-	return (cipherOffset - HeaderLen) / be.cipherBS
+	return (cipherOffset - be.headerLen) / be.cipherBS
 }
 
 // BlockNoToCipherOff gets the ciphertext offset of block "blockNo"
 func (be *ContentEnc) BlockNoToCipherOff(blockNo uint64) uint64 {
-	return HeaderLen + blockNo*be.cipherBS
+	return be.headerLen + blockNo*be.cipherBS
 }
 
 // BlockNoToPlainOff gets the plaintext offset of block "blockNo"
@@ -42,23 +42,23 @@ func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
 		return 0
 	}
 
-	if cipherSize == HeaderLen {
+	if cipherSize == be.headerLen {
 		// This can happen between createHeader() and Write() and is harmless.
-		tlog.Debug.Printf("cipherSize %d == header size: interrupted write?\n", cipherSize)
+		tlog.ContentEnc.Debug.Printf("cipherSize %d == header size: interrupted write?\n", cipherSize)
 		return 0
 	}
 
-	if cipherSize < HeaderLen {
-		tlog.Warn.Printf("cipherSize %d < header size %d: corrupt file\n", cipherSize, HeaderLen)
+	if cipherSize < be.headerLen {
+		tlog.ContentEnc.Warn.Printf("cipherSize %d < header size %d: corrupt file\n", cipherSize, be.headerLen)
 		return 0
 	}
 
 	// If the last block is incomplete, pad it to 1 byte of plaintext
 	// (= 33 bytes of ciphertext).
-	lastBlockSize := (cipherSize - HeaderLen) % be.cipherBS
+	lastBlockSize := (cipherSize - be.headerLen) % be.cipherBS
 	if lastBlockSize > 0 && lastBlockSize <= be.BlockOverhead() {
 		tmp := cipherSize - lastBlockSize + be.BlockOverhead() + 1
-		tlog.Warn.Printf("cipherSize %d: incomplete last block (%d bytes), padding to %d bytes", cipherSize, lastBlockSize, tmp)
+		tlog.ContentEnc.Warn.Printf("cipherSize %d: incomplete last block (%d bytes), padding to %d bytes", cipherSize, lastBlockSize, tmp)
 		cipherSize = tmp
 	}
 
@@ -66,10 +66,10 @@ func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
 	blockNo := be.CipherOffToBlockNo(cipherSize - 1)
 	blockCount := blockNo + 1
 
-	overhead := be.BlockOverhead()*blockCount + HeaderLen
+	overhead := be.BlockOverhead()*blockCount + be.headerLen
 
 	if overhead > cipherSize {
-		tlog.Warn.Printf("cipherSize %d < overhead %d: corrupt file\n", cipherSize, overhead)
+		tlog.ContentEnc.Warn.Printf("cipherSize %d < overhead %d: corrupt file\n", cipherSize, overhead)
 		return 0
 	}
 
@@ -51,3 +51,30 @@ func TestSizeToSize(t *testing.T) {
 		fmt.Printf("%d\t%d\t%d\t%d\n", x, yTable[x][0], yTable[x][1], yTable[x][2])
 	}
 }
+
+// TestHeaderExt checks that SetHeaderExt moves the blocks behind the
+// extension, also in the key epochs
+func TestHeaderExt(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true)
+	ce := New(cc, DefaultBS)
+	ce.SetKeyEpochs([]*cryptocore.CryptoCore{cc})
+	ce.SetHeaderExt(41)
+	for _, e := range []*ContentEnc{ce, ce.KeyEpoch(1)} {
+		if e.HeaderLen() != HeaderLen+41 {
+			t.Errorf("HeaderLen() = %d", e.HeaderLen())
+		}
+		if off := e.BlockNoToCipherOff(1); off != HeaderLen+41+e.CipherBS() {
+			t.Errorf("BlockNoToCipherOff(1) = %d", off)
+		}
+		if b := e.CipherOffToBlockNo(HeaderLen + 41); b != 0 {
+			t.Errorf("CipherOffToBlockNo = %d", b)
+		}
+		if size := e.CipherSizeToPlainSize(e.PlainSizeToCipherSize(5000)); size != 5000 {
+			t.Errorf("plain size %d, want 5000", size)
+		}
+		if size := e.CipherSizeToPlainSize(HeaderLen + 41); size != 0 {
+			t.Errorf("header-only file has plain size %d", size)
+		}
+	}
+}
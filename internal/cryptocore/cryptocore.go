@@ -13,6 +13,8 @@ import (
 
 	"github.com/rfjakob/eme"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/aegis"
+	"github.com/rfjakob/gocryptfs/v2/internal/hctr2"
 	"github.com/rfjakob/gocryptfs/v2/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -24,6 +26,8 @@ const (
 	// AuthTagLen is the length of a authentication tag in bytes.
 	// All backends use 16 bytes.
 	AuthTagLen = 16
+	// gcm128KeyLen is the content key length of the AES-128-GCM backends
+	gcm128KeyLen = 16
 )
 
 // AEADTypeEnum indicates the type of AEAD backend in use.
@@ -48,6 +52,14 @@ var BackendOpenSSL = AEADTypeEnum{"AES-GCM-256", "OpenSSL", 16}
 // "AES-GCM-256-Go" in gocryptfs -speed.
 var BackendGoGCM = AEADTypeEnum{"AES-GCM-256", "Go", 16}
 
+// BackendOpenSSL128 specifies the OpenSSL AES-128-GCM backend.
+// "AES-GCM-128-OpenSSL" in gocryptfs -speed.
+var BackendOpenSSL128 = AEADTypeEnum{"AES-GCM-128", "OpenSSL", 16}
+
+// BackendGoGCM128 specifies the Go based AES-128-GCM backend.
+// "AES-GCM-128-Go" in gocryptfs -speed.
+var BackendGoGCM128 = AEADTypeEnum{"AES-GCM-128", "Go", 16}
+
 // BackendAESSIV specifies an AESSIV backend.
 // "AES-SIV-512-Go" in gocryptfs -speed.
 var BackendAESSIV = AEADTypeEnum{"AES-SIV-512", "Go", siv_aead.NonceSize}
@@ -59,6 +71,10 @@ var BackendXChaCha20Poly1305 = AEADTypeEnum{"XChaCha20-Poly1305", "Go", chacha20
 // BackendXChaCha20Poly1305OpenSSL specifies XChaCha20-Poly1305-OpenSSL.
 var BackendXChaCha20Poly1305OpenSSL = AEADTypeEnum{"XChaCha20-Poly1305", "OpenSSL", chacha20poly1305.NonceSizeX}
 
+// BackendAEGIS256 specifies AEGIS-256-Go.
+// "AEGIS-256-Go" in gocryptfs -speed.
+var BackendAEGIS256 = AEADTypeEnum{"AEGIS-256", "Go", aegis.NonceSize}
+
 // CryptoCore is the low level crypto implementation.
 type CryptoCore struct {
 	// EME is used for filename encryption.
@@ -88,7 +104,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 	if len(key) != KeyLen {
 		log.Panicf("Unsupported key length of %d bytes", len(key))
 	}
-	if IVBitLen != 96 && IVBitLen != 128 && IVBitLen != chacha20poly1305.NonceSizeX*8 {
+	if IVBitLen != 96 && IVBitLen != 128 && IVBitLen != chacha20poly1305.NonceSizeX*8 && IVBitLen != aegis.NonceSize*8 {
 		log.Panicf("Unsupported IV length of %d bits", IVBitLen)
 	}
 
@@ -114,9 +130,16 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 
 	// Initialize an AEAD cipher for file content encryption.
 	var aeadCipher cipher.AEAD
-	if aeadType == BackendOpenSSL || aeadType == BackendGoGCM {
+	if aeadType == BackendOpenSSL || aeadType == BackendGoGCM ||
+		aeadType == BackendOpenSSL128 || aeadType == BackendGoGCM128 {
 		var gcmKey []byte
-		if useHKDF {
+		if aeadType == BackendOpenSSL128 || aeadType == BackendGoGCM128 {
+			// AES-128-GCM is new, there is no legacy mode
+			if !useHKDF {
+				log.Panic("AES-128-GCM must use HKDF, but it is disabled")
+			}
+			gcmKey = hkdfDerive(key, hkdfInfoGCM128Content, gcm128KeyLen)
+		} else if useHKDF {
 			gcmKey = hkdfDerive(key, hkdfInfoGCMContent, KeyLen)
 		} else {
 			// Filesystems created by gocryptfs v0.7 through v1.2 don't use HKDF.
@@ -129,7 +152,12 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 				log.Panicf("stupidgcm only supports 128-bit IVs, you wanted %d", IVBitLen)
 			}
 			aeadCipher = stupidgcm.NewAES256GCM(gcmKey)
-		case BackendGoGCM:
+		case BackendOpenSSL128:
+			if IVBitLen != 128 {
+				log.Panicf("stupidgcm only supports 128-bit IVs, you wanted %d", IVBitLen)
+			}
+			aeadCipher = stupidgcm.NewAES128GCM(gcmKey)
+		case BackendGoGCM, BackendGoGCM128:
 			goGcmBlockCipher, err := aes.NewCipher(gcmKey)
 			if err != nil {
 				log.Panic(err)
@@ -183,6 +211,21 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 		if err != nil {
 			log.Panic(err)
 		}
+	} else if aeadType == BackendAEGIS256 {
+		if IVBitLen != aegis.NonceSize*8 {
+			log.Panicf("AEGIS-256 must use 256-bit IVs, you wanted %d", IVBitLen)
+		}
+		if !useHKDF {
+			log.Panic("AEGIS-256 must use HKDF, but it is disabled")
+		}
+		derivedKey := hkdfDerive(key, hkdfInfoAEGIS256Content, aegis.KeySize)
+		aeadCipher, err = aegis.New(derivedKey)
+		if err != nil {
+			log.Panic(err)
+		}
+		for i := range derivedKey {
+			derivedKey[i] = 0
+		}
 	} else {
 		log.Panicf("unknown cipher backend %q", aeadType)
 	}
@@ -201,6 +244,21 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 	}
 }
 
+// NewHCTR2 returns the HCTR2 cipher for filename encryption ("-hctr2"),
+// keyed with a key derived from "masterkey", to be used instead of
+// CryptoCore.EMECipher.
+func NewHCTR2(masterkey []byte) *hctr2.HCTR2 {
+	key := hkdfDerive(masterkey, hkdfInfoHCTR2Names, KeyLen)
+	bc, err := aes.NewCipher(key)
+	for i := range key {
+		key[i] = 0
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	return hctr2.New(bc)
+}
+
 type wiper interface {
 	Wipe()
 }
@@ -18,6 +18,16 @@ func TestCryptoCoreNew(t *testing.T) {
 		if c.IVLen != 16 {
 			t.Fail()
 		}
+		if useHKDF {
+			c = New(key, BackendGoGCM128, 128, useHKDF)
+			if c.IVLen != 16 {
+				t.Fail()
+			}
+			c = New(key, BackendAEGIS256, 256, useHKDF)
+			if c.IVLen != 32 {
+				t.Fail()
+			}
+		}
 		if stupidgcm.BuiltWithoutOpenssl {
 			continue
 		}
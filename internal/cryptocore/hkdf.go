@@ -11,9 +11,20 @@ const (
 	// "info" data that HKDF mixes into the generated key to make it unique.
 	// For convenience, we use a readable string.
 	hkdfInfoEMENames               = "EME filename encryption"
+	hkdfInfoHCTR2Names             = "HCTR2 filename encryption"
 	hkdfInfoGCMContent             = "AES-GCM file content encryption"
+	hkdfInfoGCM128Content          = "AES-128-GCM file content encryption"
 	hkdfInfoSIVContent             = "AES-SIV file content encryption"
 	hkdfInfoXChaChaPoly1305Content = "XChaCha20-Poly1305 file content encryption"
+	hkdfInfoAEGIS256Content        = "AEGIS-256 file content encryption"
+	hkdfInfoAuditLog               = "audit log authentication"
+	hkdfInfoManifest               = "manifest authentication"
+	hkdfInfoMerkle                 = "merkle tree authentication"
+	hkdfInfoLongNames              = "BLAKE3 long name hashing"
+	hkdfInfoMountDefaults          = "mount defaults authentication"
+	hkdfInfoKeyEpochs              = "key epoch wrapping"
+	hkdfInfoFlatIndex              = "flat layout index encryption"
+	hkdfInfoFlatBlobs              = "flat layout blob names"
 )
 
 // hkdfDerive derives "outLen" bytes from "masterkey" and "info" using
@@ -28,3 +39,51 @@ func hkdfDerive(masterkey []byte, info string, outLen int) (out []byte) {
 	}
 	return out
 }
+
+// AuditLogKey derives the key that authenticates the "-auditlog" records
+// from the master key.
+func AuditLogKey(masterkey []byte) []byte {
+	return hkdfDerive(masterkey, hkdfInfoAuditLog, KeyLen)
+}
+
+// ManifestKey derives the key that authenticates the "-manifest" file from
+// the master key.
+func ManifestKey(masterkey []byte) []byte {
+	return hkdfDerive(masterkey, hkdfInfoManifest, KeyLen)
+}
+
+// MerkleKey derives the key that authenticates the "-merkle" hash trees from
+// the master key.
+func MerkleKey(masterkey []byte) []byte {
+	return hkdfDerive(masterkey, hkdfInfoMerkle, KeyLen)
+}
+
+// LongNameKey derives the key for hashing long names with BLAKE3
+// ("-longnamehash=blake3") from the master key.
+func LongNameKey(masterkey []byte) []byte {
+	return hkdfDerive(masterkey, hkdfInfoLongNames, KeyLen)
+}
+
+// MountDefaultsKey derives the key that authenticates the mount options
+// saved in the config file ("-mount-defaults") from the master key.
+func MountDefaultsKey(masterkey []byte) []byte {
+	return hkdfDerive(masterkey, hkdfInfoMountDefaults, KeyLen)
+}
+
+// KeyEpochsKey derives the key that encrypts the keys of the older key
+// epochs in the config file ("-new-key-epoch") from the newest key.
+func KeyEpochsKey(newestKey []byte) []byte {
+	return hkdfDerive(newestKey, hkdfInfoKeyEpochs, KeyLen)
+}
+
+// FlatIndexKey derives the key that encrypts the directory index of a
+// filesystem with the flat layout ("-flat") from the master key.
+func FlatIndexKey(masterkey []byte) []byte {
+	return hkdfDerive(masterkey, hkdfInfoFlatIndex, KeyLen)
+}
+
+// FlatBlobKey derives the key that encrypts the blob numbers into blob
+// names ("-flat") from the master key.
+func FlatBlobKey(masterkey []byte) []byte {
+	return hkdfDerive(masterkey, hkdfInfoFlatBlobs, KeyLen)
+}
@@ -10,8 +10,10 @@ import (
 	"net"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/resources"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -21,17 +23,91 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
+// IdleUnmounter is implemented by filesystems that support the
+// UnmountWhenIdle request (fusefrontend, but not fusefrontend_reverse).
+type IdleUnmounter interface {
+	UnmountWhenIdle() error
+}
+
+// Syncer is implemented by filesystems that support the Sync request
+// (fusefrontend, but not fusefrontend_reverse, which is read-only).
+type Syncer interface {
+	Sync() error
+}
+
+// LastAccesser is implemented by filesystems that track when they were
+// last accessed (fusefrontend, but not fusefrontend_reverse).
+type LastAccesser interface {
+	LastAccess() time.Time
+}
+
+// StatsReporter is implemented by filesystems that support the Stats request
+// (fusefrontend, but not fusefrontend_reverse).
+type StatsReporter interface {
+	Stats() *ctlsock.StatsStruct
+}
+
+// ChangesReporter is implemented by filesystems that support the Changes
+// request (fusefrontend, but not fusefrontend_reverse).
+type ChangesReporter interface {
+	Changes(seq uint64, t int64) (*ctlsock.ChangesStruct, error)
+}
+
+// SubvolumeLocker is implemented by filesystems that support the
+// LockSubvolume and UnlockSubvolume requests (fusefrontend, but not
+// fusefrontend_reverse).
+type SubvolumeLocker interface {
+	LockSubvolume(path string) error
+	UnlockSubvolume(path string, password []byte) error
+}
+
+// Locker is implemented by filesystems that support the Lock and Unlock
+// requests (fusefrontend, but not fusefrontend_reverse).
+type Locker interface {
+	Lock() error
+	Unlock(password []byte) error
+	IsLocked() bool
+}
+
+// ReadOnlySetter is implemented by filesystems that support the SetReadOnly
+// and SetReadWrite requests (fusefrontend, but not fusefrontend_reverse).
+type ReadOnlySetter interface {
+	SetReadOnly(ro bool) error
+	IsReadOnly() bool
+}
+
+// ReloadFunc handles Reload requests. It returns the changed options and
+// the changes that need a remount.
+type ReloadFunc func() (result string, warnText string, err error)
+
+// ChangePasswordFunc handles ChangePassword requests. It returns warnings
+// about the new password.
+type ChangePasswordFunc func(oldPassword []byte, newPassword []byte) (warnText string, err error)
+
 type ctlSockHandler struct {
 	fs     Interface
 	socket *net.UnixListener
+	// info is returned for Info requests
+	info ctlsock.InfoStruct
+	// reload handles Reload requests. nil if not supported.
+	reload ReloadFunc
+	// changePassword handles ChangePassword requests. nil if not supported.
+	changePassword ChangePasswordFunc
 }
 
 // Serve serves incoming connections on "sock". This call blocks so you
 // probably want to run it in a new goroutine.
-func Serve(sock net.Listener, fs Interface) {
+// "info" is returned for Info requests, with LastAccess filled in if "fs"
+// is a LastAccesser. "reload" handles Reload requests and "changePassword"
+// ChangePassword requests. Both may be nil.
+func Serve(sock net.Listener, fs Interface, info ctlsock.InfoStruct, reload ReloadFunc,
+	changePassword ChangePasswordFunc) {
 	handler := ctlSockHandler{
-		fs:     fs,
-		socket: sock.(*net.UnixListener),
+		fs:             fs,
+		socket:         sock.(*net.UnixListener),
+		info:           info,
+		reload:         reload,
+		changePassword: changePassword,
 	}
 	handler.acceptLoop()
 }
@@ -43,7 +119,7 @@ func (ch *ctlSockHandler) acceptLoop() {
 			// This can trigger on program exit with "use of closed network connection".
 			// Special-casing this is hard due to https://github.com/golang/go/issues/4373
 			// so just don't use tlog.Warn to not cause panics in the tests.
-			tlog.Info.Printf("ctlsock: Accept error: %v", err)
+			tlog.Ctlsock.Info.Printf("ctlsock: Accept error: %v", err)
 			break
 		}
 		go ch.handleConnection(conn.(*net.UnixConn))
@@ -67,12 +143,12 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 			conn.Close()
 			return
 		} else if err != nil {
-			tlog.Warn.Printf("ctlsock: Read error: %#v", err)
+			tlog.Ctlsock.Warn.Printf("ctlsock: Read error: %#v", err)
 			conn.Close()
 			return
 		}
 		if n == ReadBufSize {
-			tlog.Warn.Printf("ctlsock: request too big (max = %d bytes)", ReadBufSize-1)
+			tlog.Ctlsock.Warn.Printf("ctlsock: request too big (max = %d bytes)", ReadBufSize-1)
 			conn.Close()
 			return
 		}
@@ -80,7 +156,7 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 		var in ctlsock.RequestStruct
 		err = json.Unmarshal(data, &in)
 		if err != nil {
-			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
+			tlog.Ctlsock.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
 			err = errors.New("JSON Unmarshal error: " + err.Error())
 			sendResponse(conn, err, "", "")
 			continue
@@ -89,16 +165,178 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 	}
 }
 
+// countOperations returns how many operations "in" asks for
+func countOperations(in *ctlsock.RequestStruct) (n int) {
+	for _, set := range []bool{
+		in.EncryptPath != "", in.DecryptPath != "", in.UnmountWhenIdle, in.Info, in.Sync,
+		in.LogLevels != nil, in.Stats, in.Changes, in.LockSubvolume != "", in.UnlockSubvolume != "",
+		in.Reload, in.Resources, in.ChangePassword, in.Lock, in.Unlock, in.SetReadOnly, in.SetReadWrite,
+	} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
 // handleRequest handles an already-unmarshaled JSON request
 func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
 	var err error
 	var inPath, outPath, clean, warnText string
-	// You cannot perform both decryption and encryption in one request
-	if in.DecryptPath != "" && in.EncryptPath != "" {
-		err = errors.New("Ambiguous")
+	// Every request does one thing. The other fields, like Password, are
+	// parameters.
+	if countOperations(in) > 1 {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	if in.Lock || in.Unlock {
+		l, ok := ch.fs.(Locker)
+		if !ok {
+			sendResponse(conn, syscall.ENOTSUP, "", "")
+			return
+		}
+		if in.Lock {
+			err = l.Lock()
+		} else {
+			pw := []byte(in.Password)
+			err = l.Unlock(pw)
+			for i := range pw {
+				pw[i] = 0
+			}
+		}
+		sendResponse(conn, err, "", "")
+		return
+	}
+	if in.SetReadOnly || in.SetReadWrite {
+		r, ok := ch.fs.(ReadOnlySetter)
+		if !ok {
+			sendResponse(conn, syscall.ENOTSUP, "", "")
+			return
+		}
+		if in.SetReadWrite && ch.info.ReadOnly {
+			// Mounted with -ro, the kernel rejects the writes
+			sendResponse(conn, syscall.EROFS, "", "")
+			return
+		}
+		sendResponse(conn, r.SetReadOnly(in.SetReadOnly), "", "")
+		return
+	}
+	if in.Resources {
+		writeResponse(conn, &ctlsock.ResponseStruct{Resources: resources.Usage()})
+		return
+	}
+	if in.Reload {
+		if ch.reload == nil {
+			sendResponse(conn, syscall.ENOTSUP, "", "")
+			return
+		}
+		result, warnText, err := ch.reload()
+		sendResponse(conn, err, result, warnText)
+		return
+	}
+	if in.ChangePassword {
+		if ch.changePassword == nil {
+			sendResponse(conn, syscall.ENOTSUP, "", "")
+			return
+		}
+		oldPw := []byte(in.Password)
+		newPw := []byte(in.NewPassword)
+		warnText, err := ch.changePassword(oldPw, newPw)
+		for i := range oldPw {
+			oldPw[i] = 0
+		}
+		for i := range newPw {
+			newPw[i] = 0
+		}
+		sendResponse(conn, err, "", warnText)
+		return
+	}
+	if in.LockSubvolume != "" || in.UnlockSubvolume != "" {
+		l, ok := ch.fs.(SubvolumeLocker)
+		if !ok {
+			sendResponse(conn, syscall.ENOTSUP, "", "")
+			return
+		}
+		if in.LockSubvolume != "" {
+			err = l.LockSubvolume(SanitizePath(in.LockSubvolume))
+		} else {
+			pw := []byte(in.Password)
+			err = l.UnlockSubvolume(SanitizePath(in.UnlockSubvolume), pw)
+			for i := range pw {
+				pw[i] = 0
+			}
+		}
+		sendResponse(conn, err, "", "")
+		return
+	}
+	if in.LogLevels != nil {
+		if err = tlog.SetModuleLevels(in.LogLevels); err != nil {
+			sendResponse(conn, err, "", "")
+			return
+		}
+		if len(in.LogLevels) > 0 {
+			tlog.Ctlsock.Info.Printf("ctlsock: log levels set to %v", tlog.ModuleLevels())
+		}
+		writeResponse(conn, &ctlsock.ResponseStruct{LogLevels: tlog.ModuleLevels()})
+		return
+	}
+	if in.Changes {
+		c, ok := ch.fs.(ChangesReporter)
+		if !ok {
+			sendResponse(conn, syscall.ENOTSUP, "", "")
+			return
+		}
+		changes, err := c.Changes(in.ChangesSinceSeq, in.ChangesSinceTime)
+		if err != nil {
+			sendResponse(conn, err, "", "")
+			return
+		}
+		writeResponse(conn, &ctlsock.ResponseStruct{Changes: changes})
+		return
+	}
+	if in.Stats {
+		s, ok := ch.fs.(StatsReporter)
+		if !ok {
+			sendResponse(conn, syscall.ENOTSUP, "", "")
+			return
+		}
+		writeResponse(conn, &ctlsock.ResponseStruct{Stats: s.Stats()})
+		return
+	}
+	if in.Sync {
+		if s, ok := ch.fs.(Syncer); ok {
+			err = s.Sync()
+		} else {
+			err = syscall.ENOTSUP
+		}
+		sendResponse(conn, err, "", "")
+		return
+	}
+	if in.UnmountWhenIdle {
+		if u, ok := ch.fs.(IdleUnmounter); ok {
+			err = u.UnmountWhenIdle()
+		} else {
+			err = syscall.ENOTSUP
+		}
 		sendResponse(conn, err, "", "")
 		return
 	}
+	if in.Info {
+		info := ch.info
+		if la, ok := ch.fs.(LastAccesser); ok {
+			if t := la.LastAccess(); !t.IsZero() {
+				info.LastAccess = t.Unix()
+			}
+		}
+		if r, ok := ch.fs.(ReadOnlySetter); ok && r.IsReadOnly() {
+			info.ReadOnly = true
+		}
+		if l, ok := ch.fs.(Locker); ok {
+			info.Locked = l.IsLocked()
+		}
+		writeResponse(conn, &ctlsock.ResponseStruct{Info: &info})
+		return
+	}
 	// Neither encryption nor encryption has been requested, makes no sense
 	if in.DecryptPath == "" && in.EncryptPath == "" {
 		err = errors.New("Empty input")
@@ -145,19 +383,24 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 			if se, ok := pe.Err.(syscall.Errno); ok {
 				msg.ErrNo = int32(se)
 			}
-		} else if err == syscall.ENOENT {
-			msg.ErrNo = int32(syscall.ENOENT)
+		} else if se, ok := err.(syscall.Errno); ok {
+			msg.ErrNo = int32(se)
 		}
 	}
+	writeResponse(conn, &msg)
+}
+
+// writeResponse sends "msg" as JSON
+func writeResponse(conn *net.UnixConn, msg *ctlsock.ResponseStruct) {
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
-		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
+		tlog.Ctlsock.Warn.Printf("ctlsock: Marshal failed: %v", err)
 		return
 	}
 	// For convenience for the user, add a newline at the end.
 	jsonMsg = append(jsonMsg, '\n')
 	_, err = conn.Write(jsonMsg)
 	if err != nil {
-		tlog.Warn.Printf("ctlsock: Write failed: %v", err)
+		tlog.Ctlsock.Warn.Printf("ctlsock: Write failed: %v", err)
 	}
 }
@@ -0,0 +1,31 @@
+package ctlsocksrv
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+)
+
+func TestCountOperations(t *testing.T) {
+	testCases := []struct {
+		in   ctlsock.RequestStruct
+		want int
+	}{
+		{ctlsock.RequestStruct{}, 0},
+		{ctlsock.RequestStruct{EncryptPath: "a"}, 1},
+		{ctlsock.RequestStruct{EncryptPath: "a", DecryptPath: "b"}, 2},
+		// Parameters are not operations
+		{ctlsock.RequestStruct{Unlock: true, Password: "x"}, 1},
+		{ctlsock.RequestStruct{ChangePassword: true, Password: "x", NewPassword: "y"}, 1},
+		{ctlsock.RequestStruct{Changes: true, ChangesSinceSeq: 1, ChangesSinceTime: 2}, 1},
+		// An empty map only queries the log levels
+		{ctlsock.RequestStruct{LogLevels: map[string]string{}}, 1},
+		{ctlsock.RequestStruct{Lock: true, Unlock: true}, 2},
+		{ctlsock.RequestStruct{SetReadOnly: true, Info: true, Sync: true}, 3},
+	}
+	for i, tc := range testCases {
+		if have := countOperations(&tc.in); have != tc.want {
+			t.Errorf("case %d: want %d operations, have %d", i, tc.want, have)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Package dirlock prevents a CIPHERDIR from being mounted read-write by two
+// gocryptfs processes at the same time, which corrupts directory IVs and
+// file contents. This also works across machines if the CIPHERDIR is on a
+// network filesystem that supports locking, like NFS.
+package dirlock
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileName is the name of the lock file in the root of CIPHERDIR.
+// A directory cannot be locked on NFS, so we need a regular file that can
+// be opened read-write.
+const FileName = "gocryptfs.lock"
+
+// DirLock is a lock on a CIPHERDIR
+type DirLock struct {
+	f *os.File
+	// created is set if we have created the lock file. Only then Unlock()
+	// deletes it. With "-plaintextnames", a file of that name in CIPHERDIR
+	// may belong to the user.
+	created bool
+}
+
+// Lock takes an exclusive lock on "cipherdir". The lock is held until
+// Unlock() is called or the process exits.
+// If another process holds the lock, Lock retries until "timeout" has
+// passed, and then returns unix.EWOULDBLOCK. The retries cover a previous
+// gocryptfs process that has been unmounted but has not exited yet.
+func Lock(cipherdir string, timeout time.Duration) (*DirLock, error) {
+	path := filepath.Join(cipherdir, FileName)
+	deadline := time.Now().Add(timeout)
+	for {
+		created := true
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+		if os.IsExist(err) {
+			created = false
+			f, err = os.OpenFile(path, os.O_RDWR|syscall.O_NOFOLLOW, 0600)
+			if os.IsNotExist(err) {
+				// Deleted by the previous owner in the meantime
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		// On NFS, flock is emulated with a whole-file byte-range lock, which
+		// is visible to other NFS clients.
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			if sameFile(f, path) {
+				return &DirLock{f: f, created: created}, nil
+			}
+			// The previous owner has deleted the file in Unlock() while we
+			// were waiting. Lock the new one.
+			f.Close()
+			continue
+		}
+		f.Close()
+		if err != unix.EWOULDBLOCK || time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// sameFile checks that "path" still refers to the open file "f".
+func sameFile(f *os.File, path string) bool {
+	var st1, st2 syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st1); err != nil {
+		return false
+	}
+	if err := syscall.Lstat(path, &st2); err != nil {
+		return false
+	}
+	return st1.Dev == st2.Dev && st1.Ino == st2.Ino
+}
+
+// Unlock deletes the lock file if Lock() has created it, so it does not
+// clutter CIPHERDIR, and releases the lock.
+func (l *DirLock) Unlock() {
+	if l.created {
+		os.Remove(l.f.Name())
+	}
+	l.f.Close()
+}
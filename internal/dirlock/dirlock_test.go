@@ -0,0 +1,53 @@
+package dirlock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Lock(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flock locks belong to the open file description, so a second Lock()
+	// fails even within the same process
+	if _, err = Lock(dir, 0); err != unix.EWOULDBLOCK {
+		t.Errorf("want EWOULDBLOCK, have %v", err)
+	}
+	// A lock that is released while we retry is taken
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l.Unlock()
+	}()
+	l, err = Lock(dir, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Unlock()
+	if _, err = os.Stat(filepath.Join(dir, FileName)); !os.IsNotExist(err) {
+		t.Errorf("lock file was not deleted: %v", err)
+	}
+}
+
+// A lock file that we have not created is left alone
+func TestLockExisting(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, FileName)
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Lock(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Unlock()
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("lock file was deleted: %v", err)
+	}
+}
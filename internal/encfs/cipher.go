@@ -0,0 +1,180 @@
+package encfs
+
+// The "ssl/aes" cipher of EncFS (SSL_Cipher.cpp): AES-CBC for full blocks,
+// AES-CFB for everything else, and a truncated HMAC-SHA1 for checksums and IV
+// derivation.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+const (
+	// ivLen is the length of the IV part of an EncFS key
+	ivLen = aes.BlockSize
+	// keyChecksumLen is the number of checksum bytes in front of the encoded
+	// volume key
+	keyChecksumLen = 4
+)
+
+// sslCipher is an EncFS key, that is, an AES key plus the IV seed that
+// follows it
+type sslCipher struct {
+	block cipher.Block
+	// iv is mixed with a 64-bit seed to get the actual IV of every operation
+	iv [ivLen]byte
+	// mac is HMAC-SHA1 keyed with the AES key. macLock serializes its
+	// users, like the key mutex in EncFS.
+	macLock sync.Mutex
+	mac     hash.Hash
+	// raw is the AES key followed by the IV seed
+	raw []byte
+}
+
+// newSSLCipher takes the AES key followed by the IV seed
+func newSSLCipher(raw []byte) (*sslCipher, error) {
+	keyLen := len(raw) - ivLen
+	block, err := aes.NewCipher(raw[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	c := &sslCipher{
+		block: block,
+		mac:   hmac.New(sha1.New, raw[:keyLen]),
+		raw:   append([]byte{}, raw...),
+	}
+	copy(c.iv[:], raw[keyLen:])
+	return c, nil
+}
+
+// wipe overwrites the key bytes we have a copy of. The AES key schedule and
+// the HMAC state are out of reach.
+func (c *sslCipher) wipe() {
+	for i := range c.raw {
+		c.raw[i] = 0
+	}
+	for i := range c.iv {
+		c.iv[i] = 0
+	}
+}
+
+// mac64 is MAC_64 in EncFS: HMAC-SHA1 over "data" and, if "chainedIV" is not
+// nil, the little-endian chained IV, folded to 64 bits. The result is stored
+// in "chainedIV".
+func (c *sslCipher) mac64(data []byte, chainedIV *uint64) uint64 {
+	c.macLock.Lock()
+	defer c.macLock.Unlock()
+	c.mac.Reset()
+	c.mac.Write(data)
+	if chainedIV != nil {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], *chainedIV)
+		c.mac.Write(b[:])
+	}
+	md := c.mac.Sum(nil)
+	// EncFS skips the last byte of the digest when folding
+	var h [8]byte
+	for i := 0; i < len(md)-1; i++ {
+		h[i%8] ^= md[i]
+	}
+	v := binary.BigEndian.Uint64(h[:])
+	if chainedIV != nil {
+		*chainedIV = v
+	}
+	return v
+}
+
+// mac32 is MAC_32 in EncFS
+func (c *sslCipher) mac32(data []byte, chainedIV *uint64) uint32 {
+	m := c.mac64(data, chainedIV)
+	return uint32(m>>32) ^ uint32(m)
+}
+
+// mac16 is MAC_16 in EncFS
+func (c *sslCipher) mac16(data []byte, chainedIV *uint64) uint16 {
+	m := c.mac32(data, chainedIV)
+	return uint16(m>>16) ^ uint16(m)
+}
+
+// ivec derives the IV for "seed": the first 16 bytes of
+// HMAC-SHA1(iv || le64(seed))
+func (c *sslCipher) ivec(seed uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], seed)
+	c.macLock.Lock()
+	defer c.macLock.Unlock()
+	c.mac.Reset()
+	c.mac.Write(c.iv[:])
+	c.mac.Write(b[:])
+	return c.mac.Sum(nil)[:ivLen]
+}
+
+// shuffleBytes, unshuffleBytes and flipBytes spread changes over the whole
+// buffer before and between the two CFB passes of streamEncode
+func shuffleBytes(buf []byte) {
+	for i := 0; i < len(buf)-1; i++ {
+		buf[i+1] ^= buf[i]
+	}
+}
+
+func unshuffleBytes(buf []byte) {
+	for i := len(buf) - 1; i > 0; i-- {
+		buf[i] ^= buf[i-1]
+	}
+}
+
+// flipBytes reverses every 64-byte chunk of "buf"
+func flipBytes(buf []byte) {
+	for len(buf) > 0 {
+		n := len(buf)
+		if n > 64 {
+			n = 64
+		}
+		for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+			buf[i], buf[j] = buf[j], buf[i]
+		}
+		buf = buf[n:]
+	}
+}
+
+// streamEncode encrypts "buf" of any length in place
+func (c *sslCipher) streamEncode(buf []byte, seed uint64) {
+	shuffleBytes(buf)
+	cipher.NewCFBEncrypter(c.block, c.ivec(seed)).XORKeyStream(buf, buf)
+	flipBytes(buf)
+	shuffleBytes(buf)
+	cipher.NewCFBEncrypter(c.block, c.ivec(seed+1)).XORKeyStream(buf, buf)
+}
+
+// streamDecode decrypts "buf" of any length in place
+func (c *sslCipher) streamDecode(buf []byte, seed uint64) {
+	cipher.NewCFBDecrypter(c.block, c.ivec(seed+1)).XORKeyStream(buf, buf)
+	unshuffleBytes(buf)
+	flipBytes(buf)
+	cipher.NewCFBDecrypter(c.block, c.ivec(seed)).XORKeyStream(buf, buf)
+	unshuffleBytes(buf)
+}
+
+// blockEncode encrypts "buf", a multiple of the AES block size, in place
+func (c *sslCipher) blockEncode(buf []byte, seed uint64) error {
+	if len(buf)%aes.BlockSize != 0 {
+		return fmt.Errorf("length %d is not a multiple of the block size", len(buf))
+	}
+	cipher.NewCBCEncrypter(c.block, c.ivec(seed)).CryptBlocks(buf, buf)
+	return nil
+}
+
+// blockDecode decrypts "buf", a multiple of the AES block size, in place
+func (c *sslCipher) blockDecode(buf []byte, seed uint64) error {
+	if len(buf)%aes.BlockSize != 0 {
+		return fmt.Errorf("length %d is not a multiple of the block size", len(buf))
+	}
+	cipher.NewCBCDecrypter(c.block, c.ivec(seed)).CryptBlocks(buf, buf)
+	return nil
+}
@@ -0,0 +1,319 @@
+package encfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+)
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func testVolume(t *testing.T, blockNames bool, chainedNameIV bool) *Volume {
+	c, err := newSSLCipher(randBytes(24 + ivLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Volume{
+		c:             c,
+		blockNames:    blockNames,
+		chainedNameIV: chainedNameIV,
+		uniqueIV:      true,
+		allowHoles:    true,
+		blockSize:     1024,
+	}
+}
+
+// encryptFile is the inverse of FileIV and DecryptBlock, like
+// CipherFileIO::writeOneBlock in EncFS
+func (v *Volume) encryptFile(plain []byte, fileIV uint64) []byte {
+	var out []byte
+	if v.uniqueIV {
+		var hdr [fileHeaderLen]byte
+		binary.BigEndian.PutUint64(hdr[:], fileIV)
+		v.c.streamEncode(hdr[:], 0)
+		out = append(out, hdr[:]...)
+	}
+	for blockNo := uint64(0); len(plain) > 0; blockNo++ {
+		n := len(plain)
+		if n > v.blockSize {
+			n = v.blockSize
+		}
+		block := append([]byte{}, plain[:n]...)
+		if n == v.blockSize {
+			v.c.blockEncode(block, blockNo^fileIV)
+		} else {
+			v.c.streamEncode(block, blockNo^fileIV)
+		}
+		out = append(out, block...)
+		plain = plain[n:]
+	}
+	return out
+}
+
+// writeConfig writes an .encfs6.xml for "raw", the volume key followed by
+// the IV seed, to "dir"
+func writeConfig(dir string, password []byte, raw []byte, nameAlg string) error {
+	salt := randBytes(20)
+	const iterations = 1000
+	keySize := len(raw) - ivLen
+	userKey := pbkdf2.Key(password, salt, iterations, keySize+ivLen, sha1.New)
+	uc, err := newSSLCipher(userKey)
+	if err != nil {
+		return err
+	}
+	checksum := uc.mac32(raw, nil)
+	encKey := make([]byte, keyChecksumLen, keyChecksumLen+len(raw))
+	binary.BigEndian.PutUint32(encKey, checksum)
+	encKey = append(encKey, raw...)
+	uc.streamEncode(encKey[keyChecksumLen:], uint64(checksum))
+	xml := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" standalone="yes" ?>
+<!DOCTYPE boost_serialization>
+<boost_serialization signature="serialization::archive" version="7">
+    <cfg class_id="0" tracking_level="0" version="20">
+        <version>20100713</version>
+        <creator>EncFS 1.9.5</creator>
+        <cipherAlg class_id="1" tracking_level="0" version="0">
+            <name>ssl/aes</name>
+            <major>3</major>
+            <minor>0</minor>
+        </cipherAlg>
+        <nameAlg>
+            <name>%s</name>
+            <major>4</major>
+            <minor>0</minor>
+        </nameAlg>
+        <keySize>%d</keySize>
+        <blockSize>1024</blockSize>
+        <plainData>0</plainData>
+        <uniqueIV>1</uniqueIV>
+        <chainedNameIV>1</chainedNameIV>
+        <externalIVChaining>0</externalIVChaining>
+        <blockMACBytes>0</blockMACBytes>
+        <blockMACRandBytes>0</blockMACRandBytes>
+        <allowHoles>1</allowHoles>
+        <encodedKeySize>%d</encodedKeySize>
+        <encodedKeyData>
+%s
+</encodedKeyData>
+        <saltLen>%d</saltLen>
+        <saltData>
+%s
+</saltData>
+        <kdfIterations>%d</kdfIterations>
+        <desiredKDFDuration>500</desiredKDFDuration>
+    </cfg>
+</boost_serialization>
+`, nameAlg, keySize*8, len(encKey), base64.StdEncoding.EncodeToString(encKey),
+		len(salt), base64.StdEncoding.EncodeToString(salt), iterations)
+	return ioutil.WriteFile(filepath.Join(dir, ConfDefaultName), []byte(xml), 0600)
+}
+
+// The EncFS base64 variant consumes the least significant bits first
+func TestBase64(t *testing.T) {
+	if s := b64Encode([]byte{0xff}); s != "z1" {
+		t.Errorf("b64Encode(0xff) = %q", s)
+	}
+	if s := b64Encode([]byte{0, 0}); s != ",,," {
+		t.Errorf("b64Encode(0, 0) = %q", s)
+	}
+	for l := 0; l < 50; l++ {
+		in := randBytes(l)
+		s := b64Encode(in)
+		if len(s) != (l*8+5)/6 {
+			t.Errorf("len=%d: wrong encoded length %d", l, len(s))
+		}
+		out, err := b64Decode(s)
+		if err != nil || !bytes.Equal(in, out) {
+			t.Errorf("len=%d: round trip failed: %v", l, err)
+		}
+	}
+	if _, err := b64Decode("abc_"); err == nil {
+		t.Error("invalid character accepted")
+	}
+}
+
+func TestStreamAndBlock(t *testing.T) {
+	v := testVolume(t, true, true)
+	for _, l := range []int{1, 2, 15, 16, 63, 64, 65, 200} {
+		p := randBytes(l)
+		buf := append([]byte{}, p...)
+		v.c.streamEncode(buf, 42)
+		if l > 1 && bytes.Equal(buf, p) {
+			t.Errorf("len=%d: stream encoding did nothing", l)
+		}
+		v.c.streamDecode(buf, 42)
+		if !bytes.Equal(buf, p) {
+			t.Errorf("len=%d: stream round trip failed", l)
+		}
+	}
+	p := randBytes(64)
+	buf := append([]byte{}, p...)
+	if err := v.c.blockEncode(buf, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.c.blockDecode(buf, 7); err != nil || !bytes.Equal(buf, p) {
+		t.Errorf("block round trip failed: %v", err)
+	}
+	if err := v.c.blockDecode(buf[:17], 7); err == nil {
+		t.Error("partial block accepted")
+	}
+}
+
+func TestNames(t *testing.T) {
+	for _, blockNames := range []bool{true, false} {
+		for _, chained := range []bool{true, false} {
+			v := testVolume(t, blockNames, chained)
+			name := fmt.Sprintf("block=%v,chained=%v", blockNames, chained)
+			for _, pName := range []string{"a", "status.txt", "0123456789abcdef", strings.Repeat("x", 150)} {
+				cName, iv, err := v.EncryptName(pName, 1234)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if chained == (iv == 0) {
+					t.Errorf("%s: wrong chained IV %d", name, iv)
+				}
+				pName2, iv2, err := v.DecryptName(cName, 1234)
+				if err != nil || pName2 != pName || iv2 != iv {
+					t.Errorf("%s: round trip failed: %q %v", name, pName2, err)
+				}
+				// Names in other directories do not decrypt
+				_, _, err = v.DecryptName(cName, 1235)
+				if chained && err == nil {
+					t.Errorf("%s: name decrypted with the wrong IV", name)
+				}
+			}
+			if _, _, err := v.DecryptName("abc", 0); err == nil {
+				t.Errorf("%s: short name accepted", name)
+			}
+		}
+	}
+}
+
+func TestLinks(t *testing.T) {
+	v := testVolume(t, true, true)
+	for _, target := range []string{"status.txt", "../a/./b", "/a/b/c/d", "a//b/"} {
+		cTarget, err := v.encryptLink(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(target, "/") != strings.HasPrefix(cTarget, "+") {
+			t.Errorf("%q: wrong encrypted target %q", target, cTarget)
+		}
+		target2, err := v.DecryptLink(cTarget)
+		if err != nil || target2 != target {
+			t.Errorf("%q: round trip failed: %q %v", target, target2, err)
+		}
+	}
+}
+
+func TestContent(t *testing.T) {
+	v := testVolume(t, true, true)
+	const fileIV = 0x0123456789abcdef
+	for _, l := range []int{0, 1, 1023, 1024, 1025, 3000} {
+		p := randBytes(l)
+		// A hole in the middle of the file
+		if l >= 3000 {
+			for i := 1024; i < 2048; i++ {
+				p[i] = 0
+			}
+		}
+		ct := v.encryptFile(p, fileIV)
+		if v.PlainSize(uint64(len(ct))) != uint64(l) {
+			t.Errorf("len=%d: wrong PlainSize", l)
+		}
+		iv, err := v.FileIV(ct[:v.HeaderLen()])
+		if err != nil || iv != fileIV {
+			t.Fatalf("len=%d: wrong file IV %x: %v", l, iv, err)
+		}
+		ct = ct[v.HeaderLen():]
+		if l >= 3000 {
+			// EncFS leaves holes alone
+			copy(ct[1024:2048], make([]byte, 1024))
+		}
+		var out []byte
+		for blockNo := uint64(0); len(ct) > 0; blockNo++ {
+			n := len(ct)
+			if n > v.BlockSize() {
+				n = v.BlockSize()
+			}
+			if err = v.DecryptBlock(ct[:n], blockNo, iv); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, ct[:n]...)
+			ct = ct[n:]
+		}
+		if !bytes.Equal(out, p) {
+			t.Errorf("len=%d: content round trip failed", l)
+		}
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	dir := t.TempDir()
+	raw := randBytes(24 + ivLen)
+	if err := writeConfig(dir, []byte("test"), raw, "nameio/block"); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := LoadConfig(filepath.Join(dir, ConfDefaultName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := cf.Unlock([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v.c.raw, raw) || !v.blockNames || !v.chainedNameIV || !v.uniqueIV || v.BlockSize() != 1024 {
+		t.Errorf("wrong volume: %+v", v)
+	}
+	_, err = cf.Unlock([]byte("wrong"))
+	if e, ok := err.(exitcodes.Err); !ok || e.Error() != "Password incorrect." {
+		t.Errorf("wrong password: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	good := Config{
+		CipherAlg:      alg{Name: "ssl/aes", Major: 3},
+		NameAlg:        alg{Name: "nameio/block", Major: 4},
+		KeySize:        192,
+		BlockSize:      1024,
+		EncodedKeySize: 44,
+		SaltData:       "AAAA",
+		KDFIterations:  1000,
+	}
+	if err := good.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []func(*Config){
+		func(c *Config) { c.CipherAlg.Name = "ssl/blowfish" },
+		func(c *Config) { c.NameAlg.Name = "nameio/block32" },
+		func(c *Config) { c.BlockMACBytes = 8 },
+		func(c *Config) { c.ExternalIVChaining = true },
+		func(c *Config) { c.KDFIterations = 0 },
+		func(c *Config) { c.BlockSize = 1000 },
+		func(c *Config) { c.EncodedKeySize = 60 },
+	} {
+		c := good
+		tc(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("invalid config accepted: %+v", c)
+		}
+	}
+}
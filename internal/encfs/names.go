@@ -0,0 +1,238 @@
+package encfs
+
+// File name encryption (BlockNameIO.cpp, StreamNameIO.cpp) and the base64
+// variant EncFS uses for names (base64.cpp).
+
+import (
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errNameTooShort = errors.New("encfs: encrypted name too short")
+
+// b64ToASCII is the EncFS base64 alphabet. It differs from RFC 4648 and is
+// safe to use in file names.
+const b64ToASCII = ",-0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// asciiToB64 is the inverse of b64ToASCII. Invalid characters map to 0xff.
+var asciiToB64 [256]byte
+
+func init() {
+	for i := range asciiToB64 {
+		asciiToB64[i] = 0xff
+	}
+	for i := 0; i < len(b64ToASCII); i++ {
+		asciiToB64[b64ToASCII[i]] = byte(i)
+	}
+}
+
+// b64Encode encodes "in" like EncFS: the bits are consumed starting with the
+// least significant bit of the first byte, and a final partial group is
+// output as well
+func b64Encode(in []byte) string {
+	var sb strings.Builder
+	var work uint
+	var bits uint
+	for _, b := range in {
+		work |= uint(b) << bits
+		bits += 8
+		for bits >= 6 {
+			sb.WriteByte(b64ToASCII[work&63])
+			work >>= 6
+			bits -= 6
+		}
+	}
+	if bits > 0 {
+		sb.WriteByte(b64ToASCII[work&63])
+	}
+	return sb.String()
+}
+
+// b64Decode is the inverse of b64Encode. Leftover bits that do not make up a
+// full byte are dropped.
+func b64Decode(in string) ([]byte, error) {
+	out := make([]byte, 0, len(in)*6/8)
+	var work uint
+	var bits uint
+	for i := 0; i < len(in); i++ {
+		v := asciiToB64[in[i]]
+		if v == 0xff {
+			return nil, fmt.Errorf("encfs: invalid character %q in encrypted name", in[i])
+		}
+		work |= uint(v) << bits
+		bits += 6
+		if bits >= 8 {
+			out = append(out, byte(work))
+			work >>= 8
+			bits -= 8
+		}
+	}
+	return out, nil
+}
+
+// encryptName encrypts a single path component. "iv" is the chained IV of
+// the parent directory, or nil if IV chaining is off, and is advanced to the
+// IV of "name".
+func (v *Volume) encryptName(name string, iv *uint64) (string, error) {
+	var seed uint64
+	if iv != nil {
+		seed = *iv
+	}
+	var buf []byte
+	if v.blockNames {
+		// PKCS#7-like padding to a multiple of the AES block size, always
+		// at least one byte
+		pad := aes.BlockSize - len(name)%aes.BlockSize
+		buf = make([]byte, 2+len(name)+pad)
+		copy(buf[2:], name)
+		for i := 2 + len(name); i < len(buf); i++ {
+			buf[i] = byte(pad)
+		}
+	} else {
+		buf = make([]byte, 2+len(name))
+		copy(buf[2:], name)
+	}
+	mac := v.c.mac16(buf[2:], iv)
+	buf[0] = byte(mac >> 8)
+	buf[1] = byte(mac)
+	if v.blockNames {
+		if err := v.c.blockEncode(buf[2:], uint64(mac)^seed); err != nil {
+			return "", err
+		}
+	} else {
+		v.c.streamEncode(buf[2:], uint64(mac)^seed)
+	}
+	return b64Encode(buf), nil
+}
+
+// decryptName decrypts a single path component. "iv" is handled like in
+// encryptName.
+func (v *Volume) decryptName(cName string, iv *uint64) (string, error) {
+	name, err := v.decryptRaw(cName, iv)
+	if err != nil {
+		return "", err
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return "", fmt.Errorf("encfs: invalid plaintext name %q", name)
+	}
+	return name, nil
+}
+
+// decryptRaw is decryptName without the checks that only apply to directory
+// entries. The absolute target of a symlink is encrypted as a single name
+// that contains slashes.
+func (v *Volume) decryptRaw(cName string, iv *uint64) (string, error) {
+	buf, err := b64Decode(cName)
+	if err != nil {
+		return "", err
+	}
+	if len(buf) < 3 || (v.blockNames && len(buf) < 2+aes.BlockSize) {
+		return "", errNameTooShort
+	}
+	var seed uint64
+	if iv != nil {
+		seed = *iv
+	}
+	mac := uint16(buf[0])<<8 | uint16(buf[1])
+	data := buf[2:]
+	if v.blockNames {
+		if err = v.c.blockDecode(data, uint64(mac)^seed); err != nil {
+			return "", err
+		}
+	} else {
+		v.c.streamDecode(data, uint64(mac)^seed)
+	}
+	// The checksum covers the padding as well
+	if v.c.mac16(data, iv) != mac {
+		return "", fmt.Errorf("encfs: checksum mismatch in name %q", cName)
+	}
+	if v.blockNames {
+		pad := int(data[len(data)-1])
+		if pad == 0 || pad > aes.BlockSize || pad > len(data) {
+			return "", fmt.Errorf("encfs: invalid padding in name %q", cName)
+		}
+		data = data[:len(data)-pad]
+	}
+	return string(data), nil
+}
+
+// EncryptName encrypts the plaintext name "name" of an entry in a directory
+// with the chained IV "dirIV". It returns the encrypted name and the chained
+// IV of the entry (zero if IV chaining is off).
+func (v *Volume) EncryptName(name string, dirIV uint64) (cName string, iv uint64, err error) {
+	if v.chainedNameIV {
+		iv = dirIV
+	}
+	cName, err = v.encryptName(name, v.ivPtr(&iv))
+	return cName, iv, err
+}
+
+// DecryptName is the inverse of EncryptName
+func (v *Volume) DecryptName(cName string, dirIV uint64) (name string, iv uint64, err error) {
+	if v.chainedNameIV {
+		iv = dirIV
+	}
+	name, err = v.decryptName(cName, v.ivPtr(&iv))
+	return name, iv, err
+}
+
+// ivPtr returns nil if IV chaining is off, and "iv" otherwise
+func (v *Volume) ivPtr(iv *uint64) *uint64 {
+	if !v.chainedNameIV {
+		return nil
+	}
+	return iv
+}
+
+// DecryptLink decrypts the target of a symlink. EncFS encrypts relative
+// targets component by component, starting with the IV of the root
+// directory, and keeps "." and "..". Absolute targets are marked with a "+"
+// and encrypted as a single name without IV chaining.
+func (v *Volume) DecryptLink(cTarget string) (string, error) {
+	if strings.HasPrefix(cTarget, "+") {
+		name, err := v.decryptRaw(cTarget[1:], nil)
+		if err != nil {
+			return "", err
+		}
+		return "/" + name, nil
+	}
+	var iv uint64
+	parts := strings.Split(cTarget, "/")
+	for i, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			continue
+		}
+		name, err := v.decryptRaw(p, v.ivPtr(&iv))
+		if err != nil {
+			return "", err
+		}
+		parts[i] = name
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// encryptLink is the inverse of DecryptLink
+func (v *Volume) encryptLink(target string) (string, error) {
+	if strings.HasPrefix(target, "/") {
+		cName, err := v.encryptName(target[1:], nil)
+		if err != nil {
+			return "", err
+		}
+		return "+" + cName, nil
+	}
+	var iv uint64
+	parts := strings.Split(target, "/")
+	for i, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			continue
+		}
+		cName, err := v.encryptName(p, v.ivPtr(&iv))
+		if err != nil {
+			return "", err
+		}
+		parts[i] = cName
+	}
+	return strings.Join(parts, "/"), nil
+}
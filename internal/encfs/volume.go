@@ -0,0 +1,260 @@
+// Package encfs reads volumes created by EncFS, so that "gocryptfs -encfs"
+// can mount them read-only.
+//
+// Supported is what "encfs" creates in its standard mode and the expert mode
+// variants that only differ in key size, block size and name encoding:
+// AES ("ssl/aes"), "nameio/block" or "nameio/stream" names, per-file IVs and
+// chained name IVs. Not supported are block MAC headers and external IV
+// chaining (both part of paranoia mode), and configs older than EncFS 1.5
+// (".encfs5" and earlier).
+package encfs
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+)
+
+const (
+	// ConfDefaultName is the name of the EncFS config file in the root of
+	// the volume
+	ConfDefaultName = ".encfs6.xml"
+	// fileHeaderLen is the length of the encrypted per-file IV in front of
+	// the file contents
+	fileHeaderLen = 8
+)
+
+// alg is the name and interface version of an EncFS algorithm
+type alg struct {
+	Name  string `xml:"name"`
+	Major int    `xml:"major"`
+	Minor int    `xml:"minor"`
+}
+
+// Config is the content of an .encfs6.xml file. EncFS writes it using
+// boost::serialization.
+type Config struct {
+	Version            int    `xml:"cfg>version"`
+	Creator            string `xml:"cfg>creator"`
+	CipherAlg          alg    `xml:"cfg>cipherAlg"`
+	NameAlg            alg    `xml:"cfg>nameAlg"`
+	KeySize            int    `xml:"cfg>keySize"`
+	BlockSize          int    `xml:"cfg>blockSize"`
+	PlainData          bool   `xml:"cfg>plainData"`
+	UniqueIV           bool   `xml:"cfg>uniqueIV"`
+	ChainedNameIV      bool   `xml:"cfg>chainedNameIV"`
+	ExternalIVChaining bool   `xml:"cfg>externalIVChaining"`
+	BlockMACBytes      int    `xml:"cfg>blockMACBytes"`
+	BlockMACRandBytes  int    `xml:"cfg>blockMACRandBytes"`
+	AllowHoles         bool   `xml:"cfg>allowHoles"`
+	EncodedKeySize     int    `xml:"cfg>encodedKeySize"`
+	EncodedKeyData     string `xml:"cfg>encodedKeyData"`
+	SaltLen            int    `xml:"cfg>saltLen"`
+	SaltData           string `xml:"cfg>saltData"`
+	KDFIterations      int    `xml:"cfg>kdfIterations"`
+	DesiredKDFDuration int    `xml:"cfg>desiredKDFDuration"`
+}
+
+// LoadConfig reads and validates the EncFS config file "filename"
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cf Config
+	if err = xml.Unmarshal(data, &cf); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	if err = cf.Validate(); err != nil {
+		return nil, err
+	}
+	return &cf, nil
+}
+
+// Validate checks that we support all features the volume uses
+func (cf *Config) Validate() error {
+	if cf.KDFIterations <= 0 || cf.SaltData == "" {
+		return fmt.Errorf("volumes without PBKDF2 key derivation (EncFS before 1.5) are not supported")
+	}
+	if cf.CipherAlg.Name != "ssl/aes" || cf.CipherAlg.Major < 3 {
+		return fmt.Errorf("cipher %s %d.%d is not supported, only ssl/aes 3.0 and later",
+			cf.CipherAlg.Name, cf.CipherAlg.Major, cf.CipherAlg.Minor)
+	}
+	switch cf.KeySize {
+	case 128, 192, 256:
+	default:
+		return fmt.Errorf("invalid key size %d", cf.KeySize)
+	}
+	switch {
+	case cf.NameAlg.Name == "nameio/block" && cf.NameAlg.Major >= 3:
+	case cf.NameAlg.Name == "nameio/stream" && cf.NameAlg.Major >= 2:
+	default:
+		return fmt.Errorf("name encoding %s %d.%d is not supported, only nameio/block and nameio/stream",
+			cf.NameAlg.Name, cf.NameAlg.Major, cf.NameAlg.Minor)
+	}
+	if cf.BlockSize <= 0 || cf.BlockSize%16 != 0 {
+		return fmt.Errorf("invalid block size %d", cf.BlockSize)
+	}
+	if cf.PlainData {
+		return fmt.Errorf("unencrypted file contents (plainData) are not supported")
+	}
+	if cf.BlockMACBytes != 0 || cf.BlockMACRandBytes != 0 {
+		return fmt.Errorf("block MAC headers (paranoia mode) are not supported")
+	}
+	if cf.ExternalIVChaining {
+		return fmt.Errorf("external IV chaining (paranoia mode) is not supported")
+	}
+	if cf.EncodedKeySize != keyChecksumLen+cf.KeySize/8+ivLen {
+		return fmt.Errorf("invalid encoded key size %d", cf.EncodedKeySize)
+	}
+	return nil
+}
+
+// decodeBase64 decodes the base64 blobs in the config file. They contain
+// line breaks, and the padding is optional.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(strings.Join(strings.Fields(s), ""), "=")
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+// Unlock derives the user key from "password" and decrypts the volume key
+func (cf *Config) Unlock(password []byte) (*Volume, error) {
+	salt, err := decodeBase64(cf.SaltData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid saltData: %v", err)
+	}
+	encKey, err := decodeBase64(cf.EncodedKeyData)
+	if err != nil || len(encKey) != cf.EncodedKeySize {
+		return nil, fmt.Errorf("invalid encodedKeyData")
+	}
+	keyLen := cf.KeySize / 8
+	userKey := pbkdf2.Key(password, salt, cf.KDFIterations, keyLen+ivLen, sha1.New)
+	uc, err := newSSLCipher(userKey)
+	for i := range userKey {
+		userKey[i] = 0
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer uc.wipe()
+	// The volume key is stream-encrypted with the checksum of its plaintext
+	// as the IV seed
+	checksum := binary.BigEndian.Uint32(encKey)
+	raw := encKey[keyChecksumLen:]
+	uc.streamDecode(raw, uint64(checksum))
+	defer func() {
+		for i := range raw {
+			raw[i] = 0
+		}
+	}()
+	if uc.mac32(raw, nil) != checksum {
+		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+	}
+	c, err := newSSLCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Volume{
+		c:             c,
+		blockNames:    cf.NameAlg.Name == "nameio/block",
+		chainedNameIV: cf.ChainedNameIV,
+		uniqueIV:      cf.UniqueIV,
+		allowHoles:    cf.AllowHoles,
+		blockSize:     cf.BlockSize,
+	}, nil
+}
+
+// Volume decrypts names and file contents of an unlocked EncFS volume
+type Volume struct {
+	// c holds the volume key
+	c *sslCipher
+	// blockNames is true for "nameio/block", false for "nameio/stream"
+	blockNames bool
+	// chainedNameIV: names are encrypted with an IV that depends on the
+	// names of all parent directories
+	chainedNameIV bool
+	// uniqueIV: every file starts with a random, encrypted 8-byte IV
+	uniqueIV bool
+	// allowHoles: blocks that are all zero are not encrypted
+	allowHoles bool
+	blockSize  int
+}
+
+// Wipe tries to wipe the volume key from memory
+func (v *Volume) Wipe() {
+	v.c.wipe()
+}
+
+// BlockSize returns the size of a plaintext and ciphertext block
+func (v *Volume) BlockSize() int {
+	return v.blockSize
+}
+
+// HeaderLen returns the length of the file header in front of the first
+// block: 8 bytes with per-file IVs, 0 otherwise
+func (v *Volume) HeaderLen() int {
+	if v.uniqueIV {
+		return fileHeaderLen
+	}
+	return 0
+}
+
+// PlainSize converts a ciphertext file size to the plaintext size
+func (v *Volume) PlainSize(cSize uint64) uint64 {
+	h := uint64(v.HeaderLen())
+	if cSize < h {
+		return 0
+	}
+	return cSize - h
+}
+
+// FileIV decrypts the file header "header" to get the file IV. Without
+// per-file IVs, the file IV is always zero and "header" is ignored.
+func (v *Volume) FileIV(header []byte) (uint64, error) {
+	if !v.uniqueIV {
+		return 0, nil
+	}
+	if len(header) != fileHeaderLen {
+		return 0, fmt.Errorf("encfs: file header has %d bytes, want %d", len(header), fileHeaderLen)
+	}
+	var buf [fileHeaderLen]byte
+	copy(buf[:], header)
+	v.c.streamDecode(buf[:], 0)
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+// DecryptBlock decrypts block number "blockNo" of a file in place. Full
+// blocks are encrypted with AES-CBC, the last, partial block of a file with
+// the stream cipher.
+func (v *Volume) DecryptBlock(block []byte, blockNo uint64, fileIV uint64) error {
+	if len(block) > v.blockSize {
+		return fmt.Errorf("encfs: block has %d bytes, maximum is %d", len(block), v.blockSize)
+	}
+	seed := blockNo ^ fileIV
+	if len(block) < v.blockSize {
+		v.c.streamDecode(block, seed)
+		return nil
+	}
+	if v.allowHoles && isZero(block) {
+		// Holes in sparse files read as zeros
+		return nil
+	}
+	return v.c.blockDecode(block, seed)
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
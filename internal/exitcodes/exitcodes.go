@@ -72,6 +72,52 @@ const (
 	DevNull = 30
 	// FIDO2Error - an error was encountered while interacting with a FIDO2 token
 	FIDO2Error = 31
+	// PolicyError - the "-policy" file could not be loaded
+	PolicyError = 32
+	// Locked - CIPHERDIR is already mounted read-write by another process
+	Locked = 33
+	// Sandbox - "-seccomp" or "-sandbox-user" could not be applied
+	Sandbox = 34
+	// AuditLog - the "-auditlog" file could not be opened or has been
+	// tampered with
+	AuditLog = 35
+	// Manifest - the "-manifest" file has been tampered with, or CIPHERDIR
+	// does not match it
+	Manifest = 36
+	// PQKey - the "-pqkey" key file could not be read or created
+	PQKey = 37
+	// Fscrypt - "-export-fscrypt" could not set up the destination directory,
+	// or some files could not be copied
+	Fscrypt = 38
+	// EncFS - the "-encfs" volume could not be loaded or uses features that
+	// are not supported
+	EncFS = 39
+	// PasswordWeak - the new password is weaker than "-require-entropy"
+	// allows
+	PasswordWeak = 40
+	// Unhealthy - a check of "-health" has failed
+	Unhealthy = 41
+	// ChangesIncomplete - "-changes" could not list all changes since the
+	// requested point
+	ChangesIncomplete = 42
+	// VerifyDiffers - "-verify" found differences between CIPHERDIR and
+	// PLAINDIR
+	VerifyDiffers = 43
+	// Downgrade - "-downgrade" could not copy all files
+	Downgrade = 44
+	// Resources - "-cgroup", "-memory_max" or "-cpu_max" could not be
+	// applied
+	Resources = 45
+	// TPM2 - "-tpm2-enroll" could not seal the key to the TPM
+	TPM2 = 46
+	// PKCS11 - "-pkcs11-enroll" or "-pkcs11" could not use the PKCS#11 token
+	PKCS11 = 47
+	// Rekey - "-rekey" could not re-encrypt the filesystem, or an
+	// interrupted "-rekey" has not been completed
+	Rekey = 48
+	// ReservedName - a user file in CIPHERDIR has a name that gocryptfs uses
+	// internally, see "-plaintextnames"
+	ReservedName = 49
 )
 
 // Err wraps an error with an associated numeric exit code
@@ -0,0 +1,150 @@
+// Package faultinject implements the "-fault_inject" option: it makes
+// accesses to the backing storage fail in reproducible ways, for testing the
+// read-modify-write, "-journal" and "-retry_count" code paths.
+package faultinject
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Injector decides which backing storage accesses fail. A nil *Injector
+// does not inject anything.
+type Injector struct {
+	// eioWrite makes every eioWrite-th write fail with EIO
+	eioWrite uint64
+	// shortRead makes every shortRead-th read return half of the data
+	shortRead uint64
+	// fsyncDelay delays every fsync
+	fsyncDelay time.Duration
+	// writeDelay delays every write
+	writeDelay time.Duration
+	// crashAfterWrite kills the process after the crashAfterWrite-th write
+	crashAfterWrite uint64
+	// noFallocate makes fallocate fail with EOPNOTSUPP
+	noFallocate bool
+	// Counters. Use atomic ops to access them.
+	writes, reads uint64
+}
+
+// Parse parses a "-fault_inject" specification: a comma-separated list of
+//
+//	eio_write=N          every Nth write fails with EIO
+//	short_read=N         every Nth read returns only half of the data
+//	fsync_delay=DURATION every fsync takes DURATION longer
+//	write_delay=DURATION every write takes DURATION longer
+//	crash_after_write=N  the process is killed right after the Nth write
+//	no_fallocate=BOOL    fallocate fails with EOPNOTSUPP, like on ZFS
+//
+// Writes are counted per attempt, so a write that is retried because of
+// "-retry_count" counts again.
+func Parse(spec string) (*Injector, error) {
+	in := &Injector{}
+	for _, opt := range strings.Split(spec, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q: want KEY=VALUE", opt)
+		}
+		var err error
+		switch kv[0] {
+		case "eio_write":
+			in.eioWrite, err = parseCount(kv[1])
+		case "short_read":
+			in.shortRead, err = parseCount(kv[1])
+		case "crash_after_write":
+			in.crashAfterWrite, err = parseCount(kv[1])
+		case "no_fallocate":
+			in.noFallocate, err = strconv.ParseBool(kv[1])
+		case "fsync_delay":
+			in.fsyncDelay, err = parseDelay(kv[1])
+		case "write_delay":
+			in.writeDelay, err = parseDelay(kv[1])
+		default:
+			return nil, fmt.Errorf("unknown fault %q", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", kv[0], err)
+		}
+	}
+	return in, nil
+}
+
+func parseCount(s string) (uint64, error) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err == nil && n == 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return n, err
+}
+
+func parseDelay(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	return d, err
+}
+
+// BeforeWrite is called before a write to the backing storage. It returns
+// EIO if the write should fail.
+func (in *Injector) BeforeWrite() error {
+	if in == nil {
+		return nil
+	}
+	if in.writeDelay > 0 {
+		time.Sleep(in.writeDelay)
+	}
+	n := atomic.AddUint64(&in.writes, 1)
+	if in.eioWrite > 0 && n%in.eioWrite == 0 {
+		tlog.Debug.Printf("faultinject: write %d fails with EIO", n)
+		return syscall.EIO
+	}
+	return nil
+}
+
+// AfterWrite is called after a successful write to the backing storage. It
+// kills the process after the configured number of writes, like a power
+// failure would, without unmounting or syncing anything.
+func (in *Injector) AfterWrite() {
+	if in == nil || in.crashAfterWrite == 0 {
+		return
+	}
+	if atomic.LoadUint64(&in.writes) >= in.crashAfterWrite {
+		tlog.Info.Printf("faultinject: crashing after write %d", in.crashAfterWrite)
+		syscall.Kill(os.Getpid(), syscall.SIGKILL)
+	}
+}
+
+// ShortRead is called after a read of "n" bytes from the backing storage and
+// returns how many of them the caller should use.
+func (in *Injector) ShortRead(n int) int {
+	if in == nil || in.shortRead == 0 {
+		return n
+	}
+	if c := atomic.AddUint64(&in.reads, 1); c%in.shortRead == 0 {
+		tlog.Debug.Printf("faultinject: read %d returns %d of %d bytes", c, n/2, n)
+		return n / 2
+	}
+	return n
+}
+
+// NoFallocate returns true if fallocate on the backing storage should fail
+// with EOPNOTSUPP
+func (in *Injector) NoFallocate() bool {
+	return in != nil && in.noFallocate
+}
+
+// DelayFsync is called before an fsync of the backing storage
+func (in *Injector) DelayFsync() {
+	if in == nil || in.fsyncDelay == 0 {
+		return
+	}
+	time.Sleep(in.fsyncDelay)
+}
@@ -0,0 +1,49 @@
+package faultinject
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	in, err := Parse("eio_write=3,short_read=2,fsync_delay=10ms,write_delay=20ms,crash_after_write=100,no_fallocate=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.eioWrite != 3 || in.shortRead != 2 || in.fsyncDelay != 10*time.Millisecond ||
+		in.writeDelay != 20*time.Millisecond || in.crashAfterWrite != 100 || !in.NoFallocate() {
+		t.Errorf("wrong result %+v", in)
+	}
+	for _, bad := range []string{"", "eio_write", "eio_write=0", "eio_write=-1", "fsync_delay=0s", "write_delay=-1s", "foo=1", "no_fallocate=maybe"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
+
+func TestInject(t *testing.T) {
+	in, _ := Parse("eio_write=3,short_read=2")
+	for i := 1; i <= 6; i++ {
+		err := in.BeforeWrite()
+		if fail := i%3 == 0; fail != (err == syscall.EIO) {
+			t.Errorf("write %d: have %v", i, err)
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		want := 100
+		if i%2 == 0 {
+			want = 50
+		}
+		if have := in.ShortRead(100); have != want {
+			t.Errorf("read %d: have %d, want %d", i, have, want)
+		}
+	}
+	// A nil Injector does nothing
+	var none *Injector
+	if none.BeforeWrite() != nil || none.ShortRead(100) != 100 {
+		t.Error("nil Injector should not inject faults")
+	}
+	none.AfterWrite()
+	none.DelayFsync()
+}
@@ -0,0 +1,70 @@
+// Package fscrypt sets up directories encrypted by the kernel's native
+// filesystem encryption (ext4, f2fs), for "gocryptfs -export-fscrypt".
+//
+// Only v2 encryption policies are supported (Linux 5.4 and later). Their
+// keys are added to the filesystem with FS_IOC_ADD_ENCRYPTION_KEY and are
+// not tied to a session keyring like the deprecated v1 policies.
+package fscrypt
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// KeySize is the length of the raw master key in bytes
+	KeySize = 64
+	// IdentifierSize is the length of the key identifier the kernel
+	// derives from the master key
+	IdentifierSize = 16
+)
+
+// ReadKeyFile reads the raw master key stored in "filename". The format is
+// the one "fscryptctl add_key" reads from stdin.
+func ReadKeyFile(filename string) ([]byte, error) {
+	key, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != KeySize {
+		Wipe(key)
+		return nil, fmt.Errorf("%s: not a key file, want %d bytes, have %d", filename, KeySize, len(key))
+	}
+	return key, nil
+}
+
+// CreateKeyFile generates a new random master key and writes it to
+// "filename", which must not exist yet. The file is readable only by its
+// owner.
+func CreateKeyFile(filename string) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fd.Write(key)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(filename)
+		Wipe(key)
+		return nil, err
+	}
+	return key, nil
+}
+
+// Wipe overwrites "b" with zeros
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
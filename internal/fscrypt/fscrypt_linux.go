@@ -0,0 +1,61 @@
+package fscrypt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// AddKey adds the master key "key" to the filesystem "dir" is on, and returns
+// the key identifier. Files encrypted with the key are accessible until it
+// is removed again, or until the filesystem is unmounted.
+func AddKey(dir string, key []byte) (id [IdentifierSize]byte, err error) {
+	if len(key) != KeySize {
+		return id, fmt.Errorf("wrong key length %d", len(key))
+	}
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return id, err
+	}
+	defer unix.Close(fd)
+	// struct fscrypt_add_key_arg is followed by the raw key
+	var arg unix.FscryptAddKeyArg
+	buf := make([]byte, unsafe.Sizeof(arg)+KeySize)
+	defer Wipe(buf)
+	binary.LittleEndian.PutUint32(buf[unsafe.Offsetof(arg.Key_spec):], unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER)
+	binary.LittleEndian.PutUint32(buf[unsafe.Offsetof(arg.Raw_size):], KeySize)
+	copy(buf[unsafe.Sizeof(arg):], key)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.FS_IOC_ADD_ENCRYPTION_KEY, uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return id, fmt.Errorf("FS_IOC_ADD_ENCRYPTION_KEY: %w", errno)
+	}
+	// The kernel writes the identifier into key_spec.u
+	spec := unsafe.Offsetof(arg.Key_spec) + unsafe.Offsetof(arg.Key_spec.U)
+	copy(id[:], buf[spec:])
+	return id, nil
+}
+
+// SetPolicy sets a v2 encryption policy using the key "id" on the empty
+// directory "dir". Contents are encrypted with AES-256-XTS and names with
+// AES-256-CTS, the defaults of the fscrypt tool.
+func SetPolicy(dir string, id [IdentifierSize]byte) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	policy := unix.FscryptPolicyV2{
+		Version:                   unix.FSCRYPT_POLICY_V2,
+		Contents_encryption_mode:  unix.FSCRYPT_MODE_AES_256_XTS,
+		Filenames_encryption_mode: unix.FSCRYPT_MODE_AES_256_CTS,
+		Flags:                     unix.FSCRYPT_POLICY_FLAGS_PAD_32,
+		Master_key_identifier:     id,
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.FS_IOC_SET_ENCRYPTION_POLICY, uintptr(unsafe.Pointer(&policy)))
+	if errno != 0 {
+		return fmt.Errorf("FS_IOC_SET_ENCRYPTION_POLICY: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package fscrypt
+
+import (
+	"errors"
+)
+
+var errUnsupported = errors.New("fscrypt is only available on Linux")
+
+// AddKey is not supported on this platform
+func AddKey(dir string, key []byte) (id [IdentifierSize]byte, err error) {
+	return id, errUnsupported
+}
+
+// SetPolicy is not supported on this platform
+func SetPolicy(dir string, id [IdentifierSize]byte) error {
+	return errUnsupported
+}
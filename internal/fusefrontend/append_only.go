@@ -0,0 +1,67 @@
+package fusefrontend
+
+// Append-only mounts (-append_only).
+//
+// Files can be created and appended to, but existing content cannot be
+// overwritten, truncated or deleted. Renaming is allowed as long as it does
+// not replace a file. Directories are not affected.
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// checkAppend returns EPERM if there is file content at or after "off",
+// which a write or truncate at "off" would destroy.
+// The caller must hold ContentLock exclusively.
+func (f *File) checkAppend(off uint64) syscall.Errno {
+	if !f.rootNode.args.AppendOnly {
+		return 0
+	}
+	size, err := f.plainSize()
+	if err != nil {
+		return syscall.EIO
+	}
+	if off < size {
+		tlog.FuseFrontend.Debug.Printf("ino%d: -append_only: offset %d < size %d", f.qIno.Ino, off, size)
+		return syscall.EPERM
+	}
+	return 0
+}
+
+// checkAppendTruncFd returns EPERM if O_TRUNC would truncate the non-empty
+// file open at "fd"
+func (rn *RootNode) checkAppendTruncFd(fd int) syscall.Errno {
+	if !rn.args.AppendOnly {
+		return 0
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return syscall.EIO
+	}
+	if st.Size > 0 {
+		return syscall.EPERM
+	}
+	return 0
+}
+
+// checkAppendDelete returns EPERM if "cName" in "dirfd" exists and is not
+// a directory. Deleting or replacing it would lose its content.
+func (rn *RootNode) checkAppendDelete(dirfd int, cName string) syscall.Errno {
+	if !rn.args.AppendOnly {
+		return 0
+	}
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		// Nothing to lose
+		return 0
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		return 0
+	}
+	return syscall.EPERM
+}
@@ -1,7 +1,14 @@
 package fusefrontend
 
 import (
+	"time"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/auditlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/faultinject"
+	"github.com/rfjakob/gocryptfs/v2/internal/policy"
+	"github.com/rfjakob/gocryptfs/v2/internal/progress"
 )
 
 // Args is a container for arguments that are passed from main() to fusefrontend
@@ -24,8 +31,9 @@ type Args struct {
 	// location. If it is false, reverse mode maps ".gocryptfs.reverse.conf"
 	// to "gocryptfs.conf" in the plaintext dir.
 	ConfigCustom bool
-	// NoPrealloc disables automatic preallocation before writing
-	NoPrealloc bool
+	// Prealloc is the preallocation strategy before writing (PreallocAuto,
+	// PreallocFull, PreallocHeader or PreallocNone). Set via "-prealloc".
+	Prealloc string
 	// Exclude is a list of paths to make inaccessible, starting match at
 	// the filesystem root
 	Exclude []string
@@ -51,4 +59,101 @@ type Args struct {
 	OneFileSystem bool
 	// DeterministicNames disables gocryptfs.diriv files
 	DeterministicNames bool
+	// Policy holds the per-directory rules loaded from the "-policy" file.
+	// nil if no policy file was given. Only applicable to forward mode.
+	Policy *policy.Policy
+	// UnionCreate selects the branch for new files in union mounts
+	// (UnionCreateFirst or UnionCreateMfs). Set via "-union-create".
+	UnionCreate string
+	// MaxSize is the limit for the total plaintext size in bytes, set via
+	// "-max_size". Zero means unlimited.
+	MaxSize uint64
+	// MaxFileSize is the limit for the plaintext size of each file in
+	// bytes, set via "-max_file_size". Zero means unlimited.
+	MaxFileSize uint64
+	// BwLimit limits file reads and writes to this many bytes per second,
+	// set via "-bwlimit". Zero means unlimited.
+	BwLimit uint64
+	// IOPLimit limits file reads and writes to this many operations per
+	// second, set via "-ioplimit". Zero means unlimited.
+	IOPLimit uint64
+	// IOTimeout makes backing storage accesses fail with EIO if they take
+	// longer than this, set via "-io_timeout". Zero means wait forever.
+	IOTimeout time.Duration
+	// RetryCount is how often failed writes and fsyncs are retried before
+	// returning EIO, set via "-retry_count". RetryInterval is the wait
+	// before the first retry and doubles for each further one.
+	RetryCount    int
+	RetryInterval time.Duration
+	// Replica is a copy of Cipherdir (absolute path). Blocks that fail
+	// authentication are read from there and repaired. Set via "-replica".
+	Replica string
+	// CacheDir enables the block cache on fast local storage. CacheSize is
+	// its size limit in bytes. Set via "-cachedir" and "-cachesize".
+	CacheDir  string
+	CacheSize int64
+	// CacheMem is the memory budget in bytes that the in-memory caches and
+	// the bookkeeping of the block cache share. Set via "-cachemem".
+	CacheMem int64
+	// Journal saves the old contents of blocks before they are overwritten,
+	// so that writes interrupted by a crash can be rolled back.
+	// Set via "-journal".
+	Journal bool
+	// Sync opens all files with O_SYNC. Set via "-sync".
+	Sync bool
+	// FsyncOnClose syncs files that are open for writing when they are
+	// closed. Set via "-fsync_on_close".
+	FsyncOnClose bool
+	// FsyncInterval syncs the backing filesystem periodically, batching up
+	// the writes of all files. Set via "-fsync_interval".
+	FsyncInterval time.Duration
+	// NoAtime stops reads from updating the access time of backing files.
+	// RelAtime does the same, but then emulates the "relatime" mount
+	// option. Set via "-noatime" and "-relatime".
+	NoAtime  bool
+	RelAtime bool
+	// AuditLog records unlink, rmdir, rename and truncate operations.
+	// nil if "-auditlog" is not used.
+	AuditLog *auditlog.Log
+	// MerkleKey authenticates the per-file hash trees. nil if the filesystem
+	// has been created without "-merkle".
+	MerkleKey []byte
+	// BindPath mixes the DirIV of the parent directory into the content
+	// encryption of every file. Set for filesystems created with
+	// "-bindpath".
+	BindPath bool
+	// Reencrypt re-encrypts the files of older key epochs with the newest
+	// key while the filesystem has been idle for ReencryptIdle, at up to
+	// ReencryptRate bytes per second (zero means unlimited). Set via
+	// "-reencrypt", "-reencrypt-idle" and "-reencrypt-rate".
+	Reencrypt     bool
+	ReencryptIdle time.Duration
+	ReencryptRate uint64
+	// ReencryptProgress reports the progress of Reencrypt, if not nil.
+	// Stopped when all files are done or on unmount.
+	ReencryptProgress *progress.Reporter
+	// WORM seals files when they are closed after being written, and
+	// WORMRetention is how long sealed files cannot be deleted (zero means
+	// forever). Set for filesystems created with "-worm".
+	WORM          bool
+	WORMRetention time.Duration
+	// AppendOnly forbids overwriting, truncating and deleting existing file
+	// content ("-append_only")
+	AppendOnly bool
+	// Notify watches CIPHERDIR with inotify and forwards changes made
+	// outside of the mount to the kernel ("-notify")
+	Notify bool
+	// Rescue replaces corrupt blocks with zeros and shows unreadable
+	// directories as empty, and logs what was skipped after unmount
+	// ("-rescue").
+	Rescue bool
+	// Faults injects failures into the accesses to the backing storage
+	// ("-fault_inject"). nil if not enabled.
+	Faults *faultinject.Injector
+	// TrackChanges records the paths changed through the mount for the
+	// Changes control socket request. Set when "-ctlsock" is used.
+	TrackChanges bool
+	// Stats collects the statistics for the Stats control socket request
+	// ("gocryptfs -top"). Set when "-ctlsock" is used.
+	Stats bool
 }
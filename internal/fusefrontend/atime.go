@@ -0,0 +1,52 @@
+package fusefrontend
+
+// Access time handling (-noatime, -relatime)
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// relatimeMaxAge is how old the access time may get before relatime()
+// updates it even if the file has not changed. Same as in the kernel.
+const relatimeMaxAge = 24 * time.Hour
+
+// noatimeFlag returns O_NOATIME if reads should not update the access time
+// of backing files and directories, and 0 otherwise. The caller must retry
+// without the flag if the open fails with EPERM, as O_NOATIME is only
+// allowed for the owner of the file.
+func (rn *RootNode) noatimeFlag() int {
+	if rn.args.NoAtime || rn.args.RelAtime {
+		return syscallcompat.O_NOATIME
+	}
+	return 0
+}
+
+// relatime emulates the "relatime" mount option for the backing file when
+// -relatime is used. On the first read through this file handle, the access
+// time is set to now if it is older than the modification or change time,
+// or older than relatimeMaxAge. All other reads do not touch it.
+func (f *File) relatime() {
+	if !f.rootNode.args.RelAtime || !atomic.CompareAndSwapUint32(&f.atimeChecked, 0, 1) {
+		return
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(f.intFd(), &st); err != nil {
+		return
+	}
+	atime := time.Unix(st.Atim.Unix())
+	now := time.Now()
+	if atime.After(time.Unix(st.Mtim.Unix())) && atime.After(time.Unix(st.Ctim.Unix())) &&
+		now.Sub(atime) < relatimeMaxAge {
+		return
+	}
+	// A nil mtime is left unchanged
+	if err := syscallcompat.FutimesNano(f.intFd(), &now, nil); err != nil {
+		tlog.FuseFrontend.Debug.Printf("ino%d: relatime: could not update atime: %v", f.qIno.Ino, err)
+	}
+}
@@ -0,0 +1,33 @@
+package fusefrontend
+
+// Integration of the -auditlog log of destructive operations
+
+import (
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// audit logs operation "op" on the plaintext path "path" (and "path2" for
+// renames) before it is carried out. It returns EIO if the record could not
+// be written, and the operation must then be skipped, so that every change
+// is in the log.
+func (rn *RootNode) audit(op string, path string, path2 string, size uint64) syscall.Errno {
+	l := rn.args.AuditLog
+	if l == nil {
+		return 0
+	}
+	cPath, err := rn.EncryptPath(path)
+	var cPath2 string
+	if err == nil && path2 != "" {
+		cPath2, err = rn.EncryptPath(path2)
+	}
+	if err == nil {
+		err = l.Add(op, cPath, cPath2, size)
+	}
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("auditlog: could not log %s of %q: %v", op, path, err)
+		return syscall.EIO
+	}
+	return 0
+}
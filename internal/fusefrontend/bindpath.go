@@ -0,0 +1,217 @@
+package fusefrontend
+
+// Binding of file contents to their path (-bindpath)
+//
+// A hash of the DirIV of the parent directory and of the encrypted name of
+// the file is appended to the file ID in the additional data of every
+// content block. A file that has been moved or renamed behind our back,
+// for example swapped with another file in the same directory, no longer
+// decrypts. Renaming a file through the mount re-encrypts it under its new
+// name (renameRebind). A hard link cannot be bound to two names, so Link
+// returns EXDEV for regular files, and ln(1) fails like it does across
+// filesystems.
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// pathBinding returns what the contents of the file "cName" in the directory
+// open at "dirfd" are bound to. The file is the child "name" of n, or n
+// itself if "name" is empty. Returns nil if "-bindpath" is off or the file is
+// in a plaintext subtree.
+func (n *Node) pathBinding(b *branch, dirfd int, cName string, name string) ([]byte, syscall.Errno) {
+	if !n.rootNode().args.BindPath || n.isPlaintext(name) {
+		return nil, 0
+	}
+	nt, _, errno := b.keys()
+	if errno != 0 {
+		return nil, errno
+	}
+	iv, err := nt.ReadDirIVAt(dirfd)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return contentenc.PathBinding(iv, cName), 0
+}
+
+// checkBindPath returns EXDEV if "cName" in "dirfd" is a regular file that
+// would get a new name with "-bindpath"
+func (n *Node) checkBindPath(dirfd int, cName string) syscall.Errno {
+	if !n.rootNode().args.BindPath {
+		return 0
+	}
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFREG {
+		return syscall.EXDEV
+	}
+	return 0
+}
+
+// renameRebind moves the regular file "cName" in "dirfd", which is the child
+// "name" of n, to "cName2" in "dirfd2", which is the child "newName" of n2.
+// The contents are re-encrypted with the path binding of the new name into a
+// temporary file next to the target, which is then renamed over the target,
+// and the original is deleted. Like renameCopyAt, it returns EXDEV for files
+// that are open and for RENAME_EXCHANGE.
+func (n *Node) renameRebind(b *branch, name string, dirfd int, cName string, n2 *Node, newName string,
+	dirfd2 int, cName2 string, flags uint32) error {
+	if flags&(syscallcompat.RENAME_EXCHANGE|syscallcompat.RENAME_WHITEOUT) != 0 {
+		return syscall.EXDEV
+	}
+	rn := n.rootNode()
+	_, ce, errno := b.keys()
+	if errno != 0 {
+		return errno
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	if uint64(st.Size) <= ce.HeaderLen() {
+		// No content blocks, nothing is bound to the name
+		syscall.Close(fd)
+		return syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
+	}
+	var st2 unix.Stat_t
+	if syscallcompat.Fstatat(dirfd2, cName2, &st2, unix.AT_SYMLINK_NOFOLLOW) == nil {
+		if flags&syscallcompat.RENAME_NOREPLACE != 0 {
+			syscall.Close(fd)
+			return syscall.EEXIST
+		}
+		if st2.Dev == st.Dev && st2.Ino == st.Ino {
+			// Same file, rename(2) does nothing
+			syscall.Close(fd)
+			return nil
+		}
+	}
+	sst := syscallcompat.Unix2syscall(st)
+	if openfiletable.IsOpen(inomap.QInoFromStat(&sst)) {
+		// The open file handles would keep writing to the deleted original
+		tlog.FuseFrontend.Debug.Printf("renameRebind: %q is open", cName)
+		syscall.Close(fd)
+		return syscall.EXDEV
+	}
+	binding, errno := n.pathBinding(b, dirfd, cName, name)
+	if errno != 0 {
+		syscall.Close(fd)
+		return errno
+	}
+	binding2, errno := n2.pathBinding(b, dirfd2, cName2, newName)
+	if errno != 0 {
+		syscall.Close(fd)
+		return errno
+	}
+	oldID := rn.merkleFileID(dirfd, cName)
+
+	rn.rewriteLock.Lock()
+	defer rn.rewriteLock.Unlock()
+	src := rn.newReencryptFile(fd, binding)
+	src.contentEnc = ce
+	defer src.reencryptClose()
+
+	tmpName := fmt.Sprintf("%s%d", renameTmpPrefix, cryptocore.RandUint64())
+	tlog.FuseFrontend.Debug.Printf("renameRebind: %d/%s -> %d/%s via %s", dirfd, cName, dirfd2, cName2, tmpName)
+	tmpFd, err := syscallcompat.Openat(dirfd2, tmpName, syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW,
+		uint32(st.Mode)&07777)
+	if err != nil {
+		return err
+	}
+	tmp := rn.newReencryptFile(tmpFd, binding2)
+	tmp.contentEnc = ce
+	defer tmp.reencryptClose()
+	err = rn.rebindCopy(src, tmp, &st)
+	if err == nil {
+		// Encrypted xattrs are not bound to the name
+		renameCopyXattrs(fd, tmpFd)
+		err = syscall.Fsync(tmpFd)
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(dirfd2, tmpName, 0)
+		return err
+	}
+
+	// Writes through the mount are blocked by ContentLock meanwhile
+	e := src.fileTableEntry
+	e.ContentLock.Lock()
+	defer e.ContentLock.Unlock()
+	var st3 unix.Stat_t
+	if err = unix.Fstat(fd, &st3); err == nil && (st3.Size != st.Size || st3.Mtim != st.Mtim) {
+		// Changed in the meantime
+		err = syscall.EBUSY
+	}
+	if err == nil {
+		// Best effort, like cp -p
+		syscallcompat.Fchownat(dirfd2, tmpName, int(st.Uid), int(st.Gid), unix.AT_SYMLINK_NOFOLLOW)
+		atime := time.Unix(st.Atim.Unix())
+		mtime := time.Unix(st.Mtim.Unix())
+		syscallcompat.UtimesNanoAtNofollow(dirfd2, tmpName, &atime, &mtime)
+		err = syscallcompat.Renameat2(dirfd2, tmpName, dirfd2, cName2, uint(flags))
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(dirfd2, tmpName, 0)
+		return err
+	}
+	if err = syscallcompat.Unlinkat(dirfd, cName, 0); err != nil {
+		// Do not leave the file in both places
+		tlog.FuseFrontend.Warn.Printf("renameRebind: could not delete %q, deleting the copy: %v", cName, err)
+		syscallcompat.Unlinkat(dirfd2, cName2, 0)
+		return err
+	}
+	rn.merkleForget(oldID)
+	// The copy has a different inode number. Make the kernel look it up
+	// again. This blocks until the kernel has our reply to the rename.
+	go n2.NotifyEntry(newName)
+	return nil
+}
+
+// rebindCopy writes a new header to "tmp" and encrypts the plaintext of
+// "src", which has the stat data "st", into it. The caller must hold
+// rewriteLock.
+func (rn *RootNode) rebindCopy(src *File, tmp *File, st *unix.Stat_t) error {
+	th := contentenc.RandomHeader()
+	th.KeyEpoch = tmp.contentEnc.CurrentKeyEpoch()
+	if _, err := syscall.Pwrite(tmp.intFd(), rn.packHeader(th), 0); err != nil {
+		return err
+	}
+	tmp.cacheHeader(th)
+	plainSize := src.contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+	if err := rn.reencryptEncrypt(src, tmp, plainSize, nil); err != nil {
+		return err
+	}
+	// The copy must have a clean tree state (-merkle)
+	tmp.fileTableEntry.ContentLock.Lock()
+	defer tmp.fileTableEntry.ContentLock.Unlock()
+	return tmp.merkleClean()
+}
+
+// contentAD returns what has to be authenticated together with each content
+// block besides the block number: the file ID, followed by the path binding
+// with "-bindpath", and the marker of immutable files.
+func (f *File) contentAD(fileID []byte, immutable bool) []byte {
+	ad := fileID
+	if f.pathBinding != nil {
+		ad = contentenc.BindPath(fileID, f.pathBinding)
+	}
+	if immutable {
+		ad = contentenc.Immutable(ad)
+	}
+	return ad
+}
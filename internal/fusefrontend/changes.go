@@ -0,0 +1,227 @@
+package fusefrontend
+
+// Tracking of changed paths for incremental backups (Changes control socket
+// request, "gocryptfs -changes")
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// changesMaxEntries limits the memory use of the changes. When it is reached,
+// the older half of the entries is dropped, and queries that reach back
+// that far are answered as incomplete.
+const changesMaxEntries = 100000
+
+type change struct {
+	seq     uint64
+	time    time.Time
+	deleted bool
+}
+
+// changes records the plaintext paths that have been created, modified or
+// deleted through the mount. Each path is stored once, with the sequence
+// number of its latest change. A nil *changes records nothing.
+type changes struct {
+	sync.Mutex
+	// first is the sequence number before the first change. It is the
+	// mount time in nanoseconds, so that numbers from an earlier mount are
+	// smaller and recognized as incomplete.
+	first uint64
+	// seq is the sequence number of the latest change
+	seq uint64
+	// started is the mount time
+	started time.Time
+	// dropped and droppedTime are the sequence number and time of the
+	// newest dropped entry
+	dropped     uint64
+	droppedTime time.Time
+	entries     map[string]*change
+}
+
+func newChanges() *changes {
+	now := time.Now()
+	return &changes{
+		first:   uint64(now.UnixNano()),
+		seq:     uint64(now.UnixNano()),
+		started: now,
+		entries: make(map[string]*change),
+	}
+}
+
+// record stores a change of "path". The caller must hold the lock.
+func (c *changes) record(path string, deleted bool) {
+	c.seq++
+	e := c.entries[path]
+	if e == nil {
+		e = &change{}
+		c.entries[path] = e
+	}
+	e.seq = c.seq
+	e.time = time.Now()
+	e.deleted = deleted
+	if len(c.entries) > changesMaxEntries {
+		c.dropOldest()
+	}
+}
+
+// dropOldest drops the older half of the entries. The caller must hold the
+// lock.
+func (c *changes) dropOldest() {
+	seqs := make([]uint64, 0, len(c.entries))
+	for _, e := range c.entries {
+		seqs = append(seqs, e.seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	limit := seqs[len(seqs)/2]
+	for path, e := range c.entries {
+		if e.seq <= limit {
+			if e.time.After(c.droppedTime) {
+				c.droppedTime = e.time
+			}
+			delete(c.entries, path)
+		}
+	}
+	c.dropped = limit
+	tlog.FuseFrontend.Info.Printf("changes: more than %d changed paths, dropped the oldest ones", changesMaxEntries)
+}
+
+// changed records that "path" has been created or modified
+func (c *changes) changed(path string) {
+	if c == nil || path == "" {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.record(path, false)
+}
+
+// deleted records that "path" has been deleted. Changes recorded for the
+// paths below it are dropped, the deletion covers them.
+func (c *changes) deleted(path string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.dropBelow(path)
+	c.record(path, true)
+}
+
+// renamed records that "from" has been renamed to "to", or, if "exchange"
+// is set, that both have been swapped
+func (c *changes) renamed(from string, to string, exchange bool) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	// The entries below a renamed directory are reported by the new path
+	// of the directory
+	c.dropBelow(from)
+	c.dropBelow(to)
+	c.record(from, !exchange)
+	c.record(to, false)
+}
+
+// dropBelow drops the entries below the directory "dir". The caller must hold
+// the lock.
+func (c *changes) dropBelow(dir string) {
+	prefix := dir + "/"
+	for path := range c.entries {
+		if strings.HasPrefix(path, prefix) {
+			delete(c.entries, path)
+		}
+	}
+}
+
+// changed records a change of the child "name" of "n", or of "n" itself if
+// "name" is empty
+func (n *Node) changed(name string) {
+	if c := n.rootNode().changes; c != nil {
+		c.changed(filepath.Join(n.Path(), name))
+	}
+}
+
+// deleted records the deletion of the child "name" of "n"
+func (n *Node) deleted(name string) {
+	if c := n.rootNode().changes; c != nil {
+		c.deleted(filepath.Join(n.Path(), name))
+	}
+}
+
+// changed records a change of the file. Does nothing if the path of the file
+// is not known.
+func (f *File) changed() {
+	if f.rootNode.changes != nil && f.node != nil {
+		f.rootNode.changes.changed(f.node.Path())
+	}
+}
+
+// plainChange is a change of the plaintext path "path"
+type plainChange struct {
+	path    string
+	seq     uint64
+	deleted bool
+}
+
+// since returns the changes after the sequence number "seq", or, if "seq" is
+// 0, after the time "t". It also returns the current sequence number, and
+// whether the changes are complete.
+func (c *changes) since(seq uint64, t time.Time) (out []plainChange, cur uint64, complete bool) {
+	c.Lock()
+	defer c.Unlock()
+	if seq > 0 {
+		complete = seq >= c.first && seq >= c.dropped
+	} else {
+		complete = !t.Before(c.started) && !t.Before(c.droppedTime)
+	}
+	for path, e := range c.entries {
+		if (seq > 0 && e.seq > seq) || (seq == 0 && e.time.After(t)) {
+			out = append(out, plainChange{path: path, seq: e.seq, deleted: e.deleted})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].seq < out[j].seq })
+	return out, c.seq, complete
+}
+
+// Changes returns the ciphertext paths changed after the sequence number
+// "seq", or, if "seq" is 0, after the Unix time "t". Implements
+// ctlsocksrv.ChangesReporter.
+func (rn *RootNode) Changes(seq uint64, t int64) (*ctlsock.ChangesStruct, error) {
+	if rn.changes == nil {
+		return nil, syscall.ENOTSUP
+	}
+	plain, cur, complete := rn.changes.since(seq, time.Unix(t, 0))
+	out := &ctlsock.ChangesStruct{
+		Seq:      cur,
+		Complete: complete,
+		Changes:  []ctlsock.Change{},
+	}
+	for _, p := range plain {
+		cPath, err := rn.EncryptPath(p.path)
+		if err != nil {
+			// A deleted path whose parent directory has been deleted as
+			// well. The deletion of the parent is reported.
+			if !p.deleted {
+				tlog.FuseFrontend.Debug.Printf("Changes: cannot encrypt %q: %v", p.path, err)
+			}
+			continue
+		}
+		out.Changes = append(out.Changes, ctlsock.Change{Path: cPath, Deleted: p.deleted})
+		// The encrypted name of a long name is stored in a second file
+		if !rn.args.PlaintextNames && nametransform.IsLongContent(filepath.Base(cPath)) {
+			out.Changes = append(out.Changes, ctlsock.Change{Path: cPath + nametransform.LongNameSuffix,
+				Deleted: p.deleted})
+		}
+	}
+	return out, nil
+}
@@ -7,7 +7,6 @@ import (
 	"syscall"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
-	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -32,11 +31,17 @@ func (rn *RootNode) EncryptPath(plainPath string) (cipherPath string, err error)
 	parts := strings.Split(plainPath, "/")
 	wd := dirfd
 	for i, part := range parts {
-		dirIV, err := rn.nameTransform.ReadDirIVAt(wd)
-		if err != nil {
-			return "", err
+		// Names below the directory of a subvolume use its key
+		b := rn.subvolumeBranch(strings.Join(parts[:i], "/"))
+		if errno := b.rlockKeys(); errno != 0 {
+			return "", errno
 		}
-		cPart, err := rn.nameTransform.EncryptAndHashName(part, dirIV)
+		dirIV, err := b.nameTransform.ReadDirIVAt(wd)
+		var cPart string
+		if err == nil {
+			cPart, err = b.nameTransform.EncryptAndHashName(part, dirIV)
+		}
+		b.mu.RUnlock()
 		if err != nil {
 			return "", err
 		}
@@ -55,7 +60,7 @@ func (rn *RootNode) EncryptPath(plainPath string) (cipherPath string, err error)
 		// and reliable.
 		defer syscall.Close(wd)
 	}
-	tlog.Debug.Printf("EncryptPath %q -> %q", plainPath, cipherPath)
+	tlog.FuseFrontend.Debug.Printf("EncryptPath %q -> %q", plainPath, cipherPath)
 	return cipherPath, nil
 }
 
@@ -78,18 +83,8 @@ func (rn *RootNode) DecryptPath(cipherPath string) (plainPath string, err error)
 	parts := strings.Split(cipherPath, "/")
 	wd := dirfd
 	for i, part := range parts {
-		dirIV, err := rn.nameTransform.ReadDirIVAt(wd)
-		if err != nil {
-			return "", err
-		}
-		longPart := part
-		if nametransform.IsLongContent(part) {
-			longPart, err = nametransform.ReadLongNameAt(wd, part)
-			if err != nil {
-				return "", err
-			}
-		}
-		name, err := rn.nameTransform.DecryptName(longPart, dirIV)
+		b := rn.subvolumeBranch(plainPath)
+		name, err := b.decryptNameAt(wd, part)
 		if err != nil {
 			return "", err
 		}
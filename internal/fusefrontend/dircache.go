@@ -7,6 +7,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/membudget"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -20,6 +21,12 @@ const (
 	enableDebugMessages = false
 	// Enable hit rate statistics printing
 	enableStats = false
+	// dirCacheBudgetName is the name of the dirCache in the "-cachemem"
+	// accounting
+	dirCacheBudgetName = "dircache"
+	// dirCacheEntryMem approximates the kernel memory of the cached fd plus
+	// the entry itself. The IV is charged on top.
+	dirCacheEntryMem = 512
 )
 
 type dirCacheEntry struct {
@@ -29,6 +36,8 @@ type dirCacheEntry struct {
 	fd int
 	// content of gocryptfs.diriv in this directory
 	iv []byte
+	// charge to the memory budget
+	item *membudget.Item
 }
 
 func (e *dirCacheEntry) Clear() {
@@ -39,12 +48,13 @@ func (e *dirCacheEntry) Clear() {
 	if e.fd > 0 {
 		err := syscall.Close(e.fd)
 		if err != nil {
-			tlog.Warn.Printf("dirCache.Clear: Close failed: %v", err)
+			tlog.FuseFrontend.Warn.Printf("dirCache.Clear: Close failed: %v", err)
 		}
 	}
 	e.fd = -1
 	e.node = nil
 	e.iv = nil
+	e.item = nil
 }
 
 type dirCache struct {
@@ -52,6 +62,11 @@ type dirCache struct {
 	// Expected length of the stored IVs. Only used for sanity checks.
 	// Usually set to 16, but 0 in plaintextnames mode.
 	ivLen int
+	// allowNoIV is set when the policy file has "plaintext" rules. Directories
+	// inside plaintext subtrees have no diriv and are stored with a nil IV.
+	allowNoIV bool
+	// budget is the "-cachemem" memory budget
+	budget *membudget.Budget
 	// Cache entries
 	entries [dirCacheSize]dirCacheEntry
 	// Where to store the next entry (index into entries)
@@ -70,16 +85,44 @@ func (d *dirCache) Clear() {
 	d.Lock()
 	defer d.Unlock()
 	for i := range d.entries {
-		d.entries[i].Clear()
+		d.clearEntry(&d.entries[i])
+	}
+}
+
+// clearEntry clears "e" and releases its memory budget. The caller must hold
+// the lock.
+func (d *dirCache) clearEntry(e *dirCacheEntry) {
+	d.budget.Remove(e.item)
+	e.Clear()
+}
+
+// evict clears the entry that is charged as "it". Called by the memory
+// budget.
+func (d *dirCache) evict(it *membudget.Item) {
+	d.Lock()
+	defer d.Unlock()
+	for i := range d.entries {
+		if e := &d.entries[i]; e.item == it {
+			d.dbg("dirCache.evict  %p\n", e.node)
+			e.Clear()
+			return
+		}
 	}
 }
 
 // Store the entry in the cache. The passed "fd" will be Dup()ed, and the caller
 // can close their copy at will.
 func (d *dirCache) Store(node *Node, fd int, iv []byte) {
+	d.store(node, fd, iv)
+	d.budget.Evict()
+}
+
+// store implements Store() without the eviction from the memory budget, which
+// must run without holding the lock.
+func (d *dirCache) store(node *Node, fd int, iv []byte) {
 	// Note: package ensurefds012, imported from main, guarantees that dirCache
 	// can never get fds 0,1,2.
-	if fd <= 0 || len(iv) != d.ivLen {
+	if fd <= 0 || !d.ivLenOk(iv) {
 		log.Panicf("Store sanity check failed: fd=%d len=%d", fd, len(iv))
 	}
 	d.Lock()
@@ -88,16 +131,19 @@ func (d *dirCache) Store(node *Node, fd int, iv []byte) {
 	// Round-robin works well enough
 	d.nextIndex = (d.nextIndex + 1) % dirCacheSize
 	// Close the old fd
-	e.Clear()
+	d.clearEntry(e)
 	fd2, err := syscall.Dup(fd)
 	if err != nil {
-		tlog.Warn.Printf("dirCache.Store: Dup failed: %v", err)
+		tlog.FuseFrontend.Warn.Printf("dirCache.Store: Dup failed: %v", err)
 		return
 	}
 	d.dbg("dirCache.Store  %p fd=%d iv=%x\n", node, fd2, iv)
 	e.fd = fd2
 	e.node = node
 	e.iv = iv
+	var it *membudget.Item
+	it = d.budget.Add(dirCacheBudgetName, dirCacheEntryMem+int64(len(iv)), func() { d.evict(it) })
+	e.item = it
 	// expireThread is started on the first Lookup()
 	if !d.expireThreadRunning {
 		d.expireThreadRunning = true
@@ -128,10 +174,11 @@ func (d *dirCache) Lookup(node *Node) (fd int, iv []byte) {
 		var err error
 		fd, err = syscall.Dup(e.fd)
 		if err != nil {
-			tlog.Warn.Printf("dirCache.Lookup: Dup failed: %v", err)
+			tlog.FuseFrontend.Warn.Printf("dirCache.Lookup: Dup failed: %v", err)
 			return -1, nil
 		}
 		iv = e.iv
+		d.budget.Touch(e.item)
 		break
 	}
 	if fd == 0 {
@@ -141,13 +188,18 @@ func (d *dirCache) Lookup(node *Node) (fd int, iv []byte) {
 	if enableStats {
 		d.hits++
 	}
-	if fd <= 0 || len(iv) != d.ivLen {
+	if fd <= 0 || !d.ivLenOk(iv) {
 		log.Panicf("Lookup sanity check failed: fd=%d len=%d", fd, len(iv))
 	}
 	d.dbg("dirCache.Lookup %p hit fd=%d dup=%d iv=%x\n", node, e.fd, fd, iv)
 	return fd, iv
 }
 
+// ivLenOk checks if "iv" has the expected length
+func (d *dirCache) ivLenOk(iv []byte) bool {
+	return len(iv) == d.ivLen || (d.allowNoIV && iv == nil)
+}
+
 // expireThread is started on the first Lookup()
 func (d *dirCache) expireThread() {
 	for {
@@ -12,6 +12,7 @@ import (
 	"math"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -50,6 +51,26 @@ type File struct {
 	lastOpCount uint64
 	// Parent filesystem
 	rootNode *RootNode
+	// plaintext is set for files in a "plaintext" policy subtree. Their
+	// content is passed through unencrypted, see file_plaintext.go.
+	plaintext bool
+	// branch is the branch the file lives in, see branch.addFile()
+	branch *branch
+	// node is the Node this file was opened through. Used by readRepair()
+	// to find the file in the replica.
+	node *Node
+	// atimeChecked is set to 1 by relatime() on the first read. Use atomic
+	// ops to access it.
+	atimeChecked uint32
+	// pathBinding is the hash of the parent DirIV and of the encrypted name
+	// with "-bindpath", see bindpath.go
+	pathBinding []byte
+	// wormWriter is set if this handle keeps the file from being sealed on a
+	// -worm filesystem, see worm.go
+	wormWriter bool
+	// busy counts the bytes read and written through this handle, see
+	// stats.go
+	busy busyBytes
 }
 
 // NewFile returns a new go-fuse File instance based on an already-open file
@@ -71,11 +92,12 @@ func NewFile(fd int, cName string, rn *RootNode) (f *File, st *syscall.Stat_t, e
 
 	f = &File{
 		fd:             osFile,
-		contentEnc:     rn.contentEnc,
+		contentEnc:     rn.branch.contentEnc,
 		qIno:           qi,
 		fileTableEntry: e,
 		rootNode:       rn,
 	}
+	atomic.AddInt64(&rn.openFiles, 1)
 	return f, st, 0
 }
 
@@ -84,43 +106,47 @@ func (f *File) intFd() int {
 	return int(f.fd.Fd())
 }
 
-// readFileID loads the file header from disk and extracts the file ID.
-// Returns io.EOF if the file is empty.
-func (f *File) readFileID() ([]byte, error) {
+// readFileID loads the file header from disk. Returns io.EOF if the file is
+// empty.
+func (f *File) readFileID() (*contentenc.FileHeader, error) {
 	// We read +1 byte to determine if the file has actual content
 	// and not only the header. A header-only file will be considered empty.
 	// This makes File ID poisoning more difficult.
-	readLen := contentenc.HeaderLen + 1
+	readLen := f.contentEnc.HeaderLen() + 1
 	buf := make([]byte, readLen)
 	n, err := f.fd.ReadAt(buf, 0)
 	if err != nil {
 		if err == io.EOF && n != 0 {
-			tlog.Warn.Printf("readFileID %d: incomplete file, got %d instead of %d bytes",
+			tlog.FuseFrontend.Warn.Printf("readFileID %d: incomplete file, got %d instead of %d bytes",
 				f.qIno.Ino, n, readLen)
 			f.rootNode.reportMitigatedCorruption(fmt.Sprint(f.qIno.Ino))
 		}
 		return nil, err
 	}
 	buf = buf[:contentenc.HeaderLen]
-	h, err := contentenc.ParseHeader(buf)
-	if err != nil {
-		return nil, err
-	}
-	return h.ID, nil
+	return contentenc.ParseHeader(buf, f.contentEnc.HeaderFeatures())
+}
+
+// cacheHeader saves the fields of the file header "h" in the open file table.
+// The caller must hold ContentLock exclusively, or IDLock.
+func (f *File) cacheHeader(h *contentenc.FileHeader) {
+	e := f.fileTableEntry
+	e.ID, e.KeyEpoch, e.Immutable = h.ID, h.KeyEpoch, h.Immutable
 }
 
-// createHeader creates a new random header and writes it to disk.
-// Returns the new file ID.
+// createHeader creates a new random header in the current key epoch and
+// writes it to disk.
 // The caller must hold fileIDLock.Lock().
-func (f *File) createHeader() (fileID []byte, err error) {
-	h := contentenc.RandomHeader()
-	buf := h.Pack()
+func (f *File) createHeader() (h *contentenc.FileHeader, err error) {
+	h = contentenc.RandomHeader()
+	h.KeyEpoch = f.contentEnc.CurrentKeyEpoch()
+	buf := f.rootNode.packHeader(h)
 	// Prevent partially written (=corrupt) header by preallocating the space beforehand
-	if !f.rootNode.args.NoPrealloc && f.rootNode.quirks&syscallcompat.QuirkBrokenFalloc == 0 {
-		err = syscallcompat.EnospcPrealloc(f.intFd(), 0, contentenc.HeaderLen)
+	if f.rootNode.prealloc != PreallocNone {
+		err = f.rootNode.preallocate(f.intFd(), 0, int64(len(buf)))
 		if err != nil {
 			if !syscallcompat.IsENOSPC(err) {
-				tlog.Warn.Printf("ino%d: createHeader: prealloc failed: %s\n", f.qIno.Ino, err.Error())
+				tlog.FuseFrontend.Warn.Printf("ino%d: createHeader: prealloc failed: %s\n", f.qIno.Ino, err.Error())
 			}
 			return nil, err
 		}
@@ -130,7 +156,20 @@ func (f *File) createHeader() (fileID []byte, err error) {
 	if err != nil {
 		return nil, err
 	}
-	return h.ID, err
+	return h, err
+}
+
+// keyEpochEnc returns the ContentEnc for the file contents of key epoch
+// "keyEpoch", or EIO if we do not have the key. This happens when the
+// filesystem has been mounted with "-masterkey", which is the key of epoch 0.
+func (f *File) keyEpochEnc(keyEpoch uint8) (*contentenc.ContentEnc, syscall.Errno) {
+	ce := f.contentEnc.KeyEpoch(keyEpoch)
+	if ce == nil {
+		tlog.FuseFrontend.Warn.Printf("ino%d: encrypted with key epoch %d, but we only have the keys up to epoch %d",
+			f.qIno.Ino, keyEpoch, f.contentEnc.CurrentKeyEpoch())
+		return nil, syscall.EIO
+	}
+	return ce, 0
 }
 
 // doRead - read "length" plaintext bytes from plaintext offset "off" and append
@@ -144,15 +183,10 @@ func (f *File) createHeader() (fileID []byte, err error) {
 // by Write() and Truncate() via doWrite() for Read-Modify-Write.
 func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Errno) {
 	// Get the file ID, either from the open file table, or from disk.
-	var fileID []byte
 	f.fileTableEntry.IDLock.Lock()
-	if f.fileTableEntry.ID != nil {
-		// Use the cached value in the file table
-		fileID = f.fileTableEntry.ID
-	} else {
+	if f.fileTableEntry.ID == nil {
 		// Not cached, we have to read it from disk.
-		var err error
-		fileID, err = f.readFileID()
+		h, err := f.readFileID()
 		if err != nil {
 			f.fileTableEntry.IDLock.Unlock()
 			if err == io.EOF {
@@ -163,17 +197,30 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 			n, _ := f.fd.ReadAt(buf, 0)
 			buf = buf[:n]
 			hexdump := hex.EncodeToString(buf)
-			tlog.Warn.Printf("doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
+			tlog.FuseFrontend.Warn.Printf("doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
 				f.qIno.Ino, err, n, hexdump)
+			f.rootNode.salvage.add(f.statsPath(), "corrupt header, file cannot be read: %v", err)
 			return nil, syscall.EIO
 		}
 		// Save into the file table
-		f.fileTableEntry.ID = fileID
+		f.cacheHeader(h)
+	}
+	fileID := f.fileTableEntry.ID
+	keyEpoch := f.fileTableEntry.KeyEpoch
+	immutable := f.fileTableEntry.Immutable
+	if errno := f.merkleLoad(); errno != 0 {
+		f.fileTableEntry.IDLock.Unlock()
+		return nil, errno
 	}
+	tree := f.fileTableEntry.Tree
 	f.fileTableEntry.IDLock.Unlock()
 	if fileID == nil {
 		log.Panicf("fileID=%v", fileID)
 	}
+	contentEnc, errno := f.keyEpochEnc(keyEpoch)
+	if errno != 0 {
+		return nil, errno
+	}
 	// Read the backing ciphertext in one go
 	blocks := f.contentEnc.ExplodePlainRange(off, length)
 	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
@@ -182,34 +229,77 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 		return nil, syscall.EFBIG
 	}
 	skip := blocks[0].Skip
-	tlog.Debug.Printf("doRead: off=%d len=%d -> off=%d len=%d skip=%d\n",
+	tlog.FuseFrontend.Debug.Printf("doRead: off=%d len=%d -> off=%d len=%d skip=%d\n",
 		off, length, alignedOffset, alignedLength, skip)
 
-	ciphertext := f.rootNode.contentEnc.CReqPool.Get()
+	ciphertext := f.contentEnc.CReqPool.Get()
 	ciphertext = ciphertext[:int(alignedLength)]
-	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
-	if err != nil && err != io.EOF {
-		tlog.Warn.Printf("read: ReadAt: %s", err.Error())
-		return nil, fs.ToErrno(err)
+	firstBlockNo := blocks[0].BlockNo
+	n := f.readCached(ciphertext, firstBlockNo, fileID)
+	fromCache := n > 0
+	if !fromCache {
+		// On timeout, ciphertext is not returned to the pool because the
+		// stuck ReadAt may still write into it.
+		err := f.rootNode.withTimeout(func() (err error) {
+			n, err = f.fd.ReadAt(ciphertext, int64(alignedOffset))
+			n = f.rootNode.faults.ShortRead(n)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}, nil)
+		if err != nil {
+			tlog.FuseFrontend.Warn.Printf("read: ReadAt: %s", err.Error())
+			return nil, fs.ToErrno(err)
+		}
+	}
+	// "-merkle": check the blocks against the hash tree, and that the file
+	// has not been cut off
+	if errno := f.merkleVerify(tree, ciphertext[:n], firstBlockNo, n < len(ciphertext)); errno != 0 {
+		f.contentEnc.CReqPool.Put(ciphertext)
+		return nil, errno
 	}
 	// The ReadAt came back empty. We can skip all the decryption and return early.
 	if n == 0 {
-		f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+		f.contentEnc.CReqPool.Put(ciphertext)
 		return dst, 0
 	}
 	// Truncate ciphertext buffer down to actually read bytes
 	ciphertext = ciphertext[0:n]
 
-	firstBlockNo := blocks[0].BlockNo
-	tlog.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
+	tlog.FuseFrontend.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
 
 	// Decrypt it
-	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID)
-	f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+	plaintext, err := contentEnc.DecryptBlocks(ciphertext, firstBlockNo, f.contentAD(fileID, immutable))
+	if err == nil && !fromCache {
+		f.cacheBlocks(ciphertext, firstBlockNo, fileID)
+	}
+	if err != nil && !fromCache && f.rootNode.salvage != nil {
+		// "-rescue": return what can be decrypted instead of EIO
+		f.contentEnc.PReqPool.Put(plaintext)
+		plaintext = f.salvageBlocks(ciphertext, firstBlockNo, fileID, immutable, contentEnc)
+		err = nil
+	}
+	f.contentEnc.CReqPool.Put(ciphertext)
+	if err != nil && fromCache {
+		// Someone has tampered with the cache. Drop it and try again.
+		tlog.FuseFrontend.Warn.Printf("doRead %d: corrupt block in -cachedir: %v", f.qIno.Ino, err)
+		f.contentEnc.PReqPool.Put(plaintext)
+		f.rootNode.blockCache.Invalidate(fileID, firstBlockNo)
+		return f.doRead(dst, off, length)
+	}
 	if err != nil {
 		corruptBlockNo := firstBlockNo + f.contentEnc.PlainOffToBlockNo(uint64(len(plaintext)))
-		tlog.Warn.Printf("doRead %d: corrupt block #%d: %v", f.qIno.Ino, corruptBlockNo, err)
-		return nil, syscall.EIO
+		tlog.FuseFrontend.Warn.Printf("doRead %d: corrupt block #%d: %v", f.qIno.Ino, corruptBlockNo, err)
+		if f.rootNode.args.Replica == "" {
+			return nil, syscall.EIO
+		}
+		f.contentEnc.PReqPool.Put(plaintext)
+		plaintext, err = f.readRepair(alignedOffset, n, firstBlockNo, fileID, immutable, contentEnc)
+		if err != nil {
+			tlog.FuseFrontend.Warn.Printf("doRead %d: read-repair failed: %v", f.qIno.Ino, err)
+			return nil, syscall.EIO
+		}
 	}
 
 	// Crop down to the relevant part
@@ -224,30 +314,42 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	// else: out stays empty, file was smaller than the requested offset
 
 	out = append(dst, out...)
-	f.rootNode.contentEnc.PReqPool.Put(plaintext)
+	f.contentEnc.PReqPool.Put(plaintext)
 
 	return out, 0
 }
 
 // Read - FUSE call
 func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse.ReadResult, errno syscall.Errno) {
+	f.rootNode.stats.op(statRead)
+	defer func() {
+		if errno == 0 && resultData != nil {
+			f.rootNode.stats.io(ctx, false, f, resultData.Size())
+		}
+	}()
 	if len(buf) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
-		tlog.Warn.Printf("Read: rejecting oversized request with EMSGSIZE, len=%d", len(buf))
+		tlog.FuseFrontend.Warn.Printf("Read: rejecting oversized request with EMSGSIZE, len=%d", len(buf))
 		return nil, syscall.EMSGSIZE
 	}
+	f.rootNode.throttle(len(buf))
+	f.rootNode.touch()
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
 	f.fileTableEntry.ContentLock.RLock()
 	defer f.fileTableEntry.ContentLock.RUnlock()
 
-	tlog.Debug.Printf("ino%d: FUSE Read: offset=%d length=%d", f.qIno.Ino, off, len(buf))
+	tlog.FuseFrontend.Debug.Printf("ino%d: FUSE Read: offset=%d length=%d", f.qIno.Ino, off, len(buf))
+	f.relatime()
+	if f.plaintext {
+		return f.readPlaintext(buf, off)
+	}
 	out, errno := f.doRead(buf[:0], uint64(off), uint64(len(buf)))
 	if errno != 0 {
 		return nil, errno
 	}
-	tlog.Debug.Printf("ino%d: Read: errno=%d, returning %d bytes", f.qIno.Ino, errno, len(out))
+	tlog.FuseFrontend.Debug.Printf("ino%d: Read: errno=%d, returning %d bytes", f.qIno.Ino, errno, len(out))
 	return fuse.ReadResultData(out), errno
 }
 
@@ -267,21 +369,27 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 	//
 	// If the file ID is not cached, read it from disk
 	if f.fileTableEntry.ID == nil {
-		var err error
-		fileID, err := f.readFileID()
+		h, err := f.readFileID()
 		// Write a new file header if the file is empty
 		if err == io.EOF {
-			fileID, err = f.createHeader()
+			h, err = f.createHeader()
 			fileWasEmpty = true
 		} else if err != nil {
 			// Other errors mean readFileID() found a corrupt header
-			tlog.Warn.Printf("doWrite %d: corrupt header: %v", f.qIno.Ino, err)
+			tlog.FuseFrontend.Warn.Printf("doWrite %d: corrupt header: %v", f.qIno.Ino, err)
 			return 0, syscall.EIO
 		}
 		if err != nil {
 			return 0, fs.ToErrno(err)
 		}
-		f.fileTableEntry.ID = fileID
+		f.cacheHeader(h)
+	}
+	contentEnc, errno := f.keyEpochEnc(f.fileTableEntry.KeyEpoch)
+	if errno != 0 {
+		return 0, errno
+	}
+	if errno := f.merkleLoad(); errno != 0 {
+		return 0, errno
 	}
 	// Handle payload data
 	dataBuf := bytes.NewBuffer(data)
@@ -294,54 +402,107 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 			// Read
 			oldData, errno := f.doRead(nil, b.BlockPlainOff(), f.contentEnc.PlainBS())
 			if errno != 0 {
-				tlog.Warn.Printf("ino%d fh%d: RMW read failed: errno=%d", f.qIno.Ino, f.intFd(), errno)
+				tlog.FuseFrontend.Warn.Printf("ino%d fh%d: RMW read failed: errno=%d", f.qIno.Ino, f.intFd(), errno)
 				return 0, errno
 			}
 			// Modify
 			blockData = f.contentEnc.MergeBlocks(oldData, blockData, int(b.Skip))
-			tlog.Debug.Printf("len(oldData)=%d len(blockData)=%d", len(oldData), len(blockData))
+			tlog.FuseFrontend.Debug.Printf("len(oldData)=%d len(blockData)=%d", len(oldData), len(blockData))
 		}
-		tlog.Debug.Printf("ino%d: Writing %d bytes to block #%d",
+		tlog.FuseFrontend.Debug.Printf("ino%d: Writing %d bytes to block #%d",
 			f.qIno.Ino, len(blockData), b.BlockNo)
 		// Write into the to-encrypt list
 		toEncrypt[i] = blockData
 	}
 	// Encrypt all blocks
-	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	ciphertext := contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.contentAD(f.fileTableEntry.ID, f.fileTableEntry.Immutable))
 	// Preallocate so we cannot run out of space in the middle of the write.
 	// This prevents partially written (=corrupt) blocks.
 	var err error
 	cOff := blocks[0].BlockCipherOff()
-	// f.fd.WriteAt & syscallcompat.EnospcPrealloc take int64 offsets!
+	// f.fd.WriteAt & preallocate take int64 offsets!
 	if cOff > math.MaxInt64 {
 		return 0, syscall.EFBIG
 	}
-	if !f.rootNode.args.NoPrealloc {
-		err = syscallcompat.EnospcPrealloc(f.intFd(), int64(cOff), int64(len(ciphertext)))
+	if f.rootNode.prealloc == PreallocFull {
+		err = f.rootNode.preallocate(f.intFd(), int64(cOff), int64(len(ciphertext)))
 		if err != nil {
 			if !syscallcompat.IsENOSPC(err) {
-				tlog.Warn.Printf("ino%d fh%d: doWrite: prealloc failed: %v", f.qIno.Ino, f.intFd(), err)
+				tlog.FuseFrontend.Warn.Printf("ino%d fh%d: doWrite: prealloc failed: %v", f.qIno.Ino, f.intFd(), err)
 			}
 			if fileWasEmpty {
 				// Kill the file header again
+				f.merkleDrop()
 				f.fileTableEntry.ID = nil
 				err2 := syscall.Ftruncate(f.intFd(), 0)
 				if err2 != nil {
-					tlog.Warn.Printf("ino%d fh%d: doWrite: rollback failed: %v", f.qIno.Ino, f.intFd(), err2)
+					tlog.FuseFrontend.Warn.Printf("ino%d fh%d: doWrite: rollback failed: %v", f.qIno.Ino, f.intFd(), err2)
 				}
 			}
 			return 0, fs.ToErrno(err)
 		}
 	}
-	// Write
-	_, err = f.fd.WriteAt(ciphertext, int64(cOff))
-	// Return memory to CReqPool
-	f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+	// The hash tree is rebuilt if we crash during the write (-merkle)
+	if errno := f.merkleBegin(blocks[0].BlockNo); errno != 0 {
+		return 0, errno
+	}
+	// Save the old contents so that an interrupted overwrite can be rolled
+	// back (-journal)
+	rec, recID, errno := f.journalBegin(int64(cOff), int64(len(ciphertext)), false)
+	if errno != 0 {
+		return 0, errno
+	}
+	// Hash the new blocks now, ciphertext goes back to the pool below
+	leaves := f.merkleLeaves(ciphertext)
+	// Write. If the write is stuck after "-io_timeout", we fail the request
+	// but keep the file busy until the write returns. Only then do we know
+	// whether the journal record has to be rolled back. If we crash before,
+	// the record is replayed on the next mount.
+	fileID := f.fileTableEntry.ID
+	busyDone := f.fileTableEntry.ContentLock.KeepBusy()
+	timedOut, err := f.rootNode.withTimeout2(func() error {
+		err := f.rootNode.withRetry("doWrite", func() error {
+			if err := f.rootNode.faults.BeforeWrite(); err != nil {
+				return err
+			}
+			_, err := f.fd.WriteAt(ciphertext, int64(cOff))
+			if err == nil {
+				f.rootNode.faults.AfterWrite()
+			}
+			return err
+		})
+		if err == nil {
+			f.cacheBlocks(ciphertext, blocks[0].BlockNo, fileID)
+		} else {
+			// We do not know what ended up on disk
+			f.rootNode.blockCache.Invalidate(fileID, blocks[0].BlockNo)
+		}
+		// Return memory to CReqPool. Only done here so that a WriteAt that
+		// is stuck past the timeout does not read from reused memory.
+		f.contentEnc.CReqPool.Put(ciphertext)
+		return err
+	}, func(err error) {
+		f.journalEnd(rec, recID, err != nil)
+		busyDone()
+	})
 	if err != nil {
-		tlog.Warn.Printf("ino%d fh%d: doWrite: WriteAt off=%d len=%d failed: %v",
+		tlog.FuseFrontend.Warn.Printf("ino%d fh%d: doWrite: WriteAt off=%d len=%d failed: %v",
 			f.qIno.Ino, f.intFd(), cOff, len(ciphertext), err)
+		if !timedOut {
+			f.journalEnd(rec, recID, true)
+			busyDone()
+		}
+		// We do not know what ended up on disk, the tree is rebuilt
+		f.merkleUnload()
 		return 0, fs.ToErrno(err)
 	}
+	busyDone()
+	if errno = f.journalEnd(rec, recID, false); errno != 0 {
+		return 0, errno
+	}
+	if errno = f.merkleWrite(blocks[0].BlockNo, leaves); errno != 0 {
+		return 0, errno
+	}
 	return uint32(len(data)), 0
 }
 
@@ -358,22 +519,58 @@ func (f *File) isConsecutiveWrite(off int64) bool {
 // Write - FUSE call
 //
 // If the write creates a hole, pads the file to the next block boundary.
-func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+func (f *File) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	f.rootNode.stats.op(statWrite)
+	defer func() {
+		if errno == 0 {
+			f.rootNode.stats.io(ctx, true, f, int(written))
+			f.changed()
+		}
+	}()
 	if len(data) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
-		tlog.Warn.Printf("Write: rejecting oversized request with EMSGSIZE, len=%d", len(data))
+		tlog.FuseFrontend.Warn.Printf("Write: rejecting oversized request with EMSGSIZE, len=%d", len(data))
 		return 0, syscall.EMSGSIZE
 	}
+	f.rootNode.throttle(len(data))
+	f.rootNode.touch()
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
 		// The file descriptor has been closed concurrently
-		tlog.Warn.Printf("ino%d fh%d: Write on released file", f.qIno.Ino, f.intFd())
+		tlog.FuseFrontend.Warn.Printf("ino%d fh%d: Write on released file", f.qIno.Ino, f.intFd())
 		return 0, syscall.EBADF
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
-	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	tlog.FuseFrontend.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	if errno = f.rootNode.checkReadOnly(); errno != 0 {
+		return 0, errno
+	}
+	if errno = f.checkImmutable(); errno != 0 {
+		return 0, errno
+	}
+	if errno = f.checkWORM(); errno != 0 {
+		return 0, errno
+	}
+	if errno = f.checkAppend(uint64(off)); errno != 0 {
+		return 0, errno
+	}
+	if errno = f.checkFileSize(uint64(off) + uint64(len(data))); errno != 0 {
+		return 0, errno
+	}
+	reserved, errno := f.quotaGrow(uint64(off) + uint64(len(data)))
+	if errno != 0 {
+		return 0, errno
+	}
+	defer func() {
+		if errno != 0 {
+			f.rootNode.quota.release(reserved)
+		}
+	}()
+	if f.plaintext {
+		return f.writePlaintext(data, off)
+	}
 	// If the write creates a file hole, we have to zero-pad the last block.
 	// But if the write directly follows an earlier write, it cannot create a
 	// hole, and we can save one Stat() call.
@@ -398,9 +595,28 @@ func (f *File) Release(ctx context.Context) syscall.Errno {
 		log.Panicf("ino%d fh%d: double release", f.qIno.Ino, f.intFd())
 	}
 	f.released = true
+	// Lock() also waits for a write that is stuck after "-io_timeout" and
+	// still uses f.fd.
+	f.fileTableEntry.ContentLock.Lock()
+	if f.rootNode.merkle != nil && f.isWritable() {
+		// Mark the hash tree clean so that it is not rebuilt on the next
+		// open
+		if err := f.merkleClean(); err != nil {
+			tlog.FuseFrontend.Warn.Printf("ino%d: -merkle: could not mark the hash tree clean: %v", f.qIno.Ino, err)
+		}
+	}
+	f.fileTableEntry.ContentLock.Unlock()
 	openfiletable.Unregister(f.qIno)
 	err := f.fd.Close()
 	f.fdLock.Unlock()
+	if f.wormWriter {
+		f.rootNode.worm.closed(f.qIno)
+	}
+	if f.branch != nil {
+		atomic.AddInt64(&f.branch.openFiles, -1)
+	}
+	f.rootNode.stats.removeFile(f)
+	f.rootNode.fileClosed()
 	return fs.ToErrno(err)
 }
 
@@ -410,6 +626,14 @@ func (f *File) Flush(ctx context.Context) syscall.Errno {
 	defer f.fdLock.RUnlock()
 
 	err := syscallcompat.Flush(f.intFd())
+	if err == nil && f.rootNode.args.FsyncOnClose && f.isWritable() {
+		err = f.rootNode.withTimeout(func() error {
+			return f.rootNode.withRetry("Flush", func() error {
+				f.rootNode.faults.DelayFsync()
+				return syscall.Fsync(f.intFd())
+			})
+		}, nil)
+	}
 	return fs.ToErrno(err)
 }
 
@@ -418,18 +642,25 @@ func (f *File) Flush(ctx context.Context) syscall.Errno {
 // Unfortunately, as Node.Fsync is also defined and takes precedence,
 // File.Fsync is never called at the moment.
 func (f *File) Fsync(ctx context.Context, flags uint32) (errno syscall.Errno) {
+	f.rootNode.stats.op(statFsync)
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
-	return fs.ToErrno(syscall.Fsync(f.intFd()))
+	return fs.ToErrno(f.rootNode.withTimeout(func() error {
+		return f.rootNode.withRetry("Fsync", func() error {
+			f.rootNode.faults.DelayFsync()
+			return syscall.Fsync(f.intFd())
+		})
+	}, nil))
 }
 
 // Getattr FUSE call (like stat)
 func (f *File) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
+	f.rootNode.stats.op(statGetattr)
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
-	tlog.Debug.Printf("file.GetAttr()")
+	tlog.FuseFrontend.Debug.Printf("file.GetAttr()")
 	st := syscall.Stat_t{}
 	err := syscall.Fstat(f.intFd(), &st)
 	if err != nil {
@@ -437,7 +668,9 @@ func (f *File) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
 	}
 	f.rootNode.inoMap.TranslateStat(&st)
 	a.FromStat(&st)
-	a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+	if !f.plaintext {
+		a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+	}
 	if f.rootNode.args.ForceOwner != nil {
 		a.Owner = *f.rootNode.args.ForceOwner
 	}
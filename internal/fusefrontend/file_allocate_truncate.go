@@ -10,7 +10,10 @@ import (
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/auditlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/journal"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -36,11 +39,20 @@ var allocateWarnOnce sync.Once
 // This allows us to reuse the file grow mechanics from Truncate as they are
 // complicated and hard to get right.
 //
-// Other modes (hole punching, zeroing) are not supported.
-func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+// If the backing filesystem does not support fallocate, mode=FALLOC_DEFAULT
+// falls back to allocateByWriting, and mode=FALLOC_FL_KEEP_SIZE fails with
+// EOPNOTSUPP.
+//
+// Other modes (hole punching, zeroing, inserting and collapsing ranges) are
+// not supported. The Linux FUSE module does not forward
+// FALLOC_FL_INSERT_RANGE and FALLOC_FL_COLLAPSE_RANGE anyway, and the block
+// number is authenticated together with each block, so shifting the content
+// would mean re-encrypting everything behind the range.
+func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) (errno syscall.Errno) {
+	f.rootNode.stats.op(statOther)
 	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE {
 		f := func() {
-			tlog.Info.Printf("fallocate: only mode 0 (default) and 1 (keep size) are supported")
+			tlog.FuseFrontend.Info.Printf("fallocate: only mode 0 (default) and 1 (keep size) are supported")
 		}
 		allocateWarnOnce.Do(f)
 		return syscall.EOPNOTSUPP
@@ -51,8 +63,42 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	if f.released {
 		return syscall.EBADF
 	}
+	defer func() {
+		if errno == 0 {
+			f.changed()
+		}
+	}()
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	if errno := f.rootNode.checkReadOnly(); errno != 0 {
+		return errno
+	}
+	if errno := f.checkImmutable(); errno != 0 {
+		return errno
+	}
+	if errno := f.checkWORM(); errno != 0 {
+		return errno
+	}
+	if mode == FALLOC_DEFAULT {
+		if errno := f.checkFileSize(off + sz); errno != 0 {
+			return errno
+		}
+	}
+
+	if f.plaintext {
+		var reserved uint64
+		if mode == FALLOC_DEFAULT {
+			var errno syscall.Errno
+			if reserved, errno = f.quotaGrow(off + sz); errno != 0 {
+				return errno
+			}
+		}
+		err := syscallcompat.Fallocate(f.intFd(), mode, int64(off), int64(sz))
+		if err != nil {
+			f.rootNode.quota.release(reserved)
+		}
+		return fs.ToErrno(err)
+	}
 
 	blocks := f.contentEnc.ExplodePlainRange(off, sz)
 	firstBlock := blocks[0]
@@ -64,9 +110,12 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	cipherOff := firstBlock.BlockCipherOff()
 	cipherSz := lastBlock.BlockCipherOff() - cipherOff +
 		f.contentEnc.BlockOverhead() + lastBlock.Skip + lastBlock.Length
-	err := syscallcompat.Fallocate(f.intFd(), FALLOC_FL_KEEP_SIZE, int64(cipherOff), int64(cipherSz))
-	tlog.Debug.Printf("Allocate off=%d sz=%d mode=%x cipherOff=%d cipherSz=%d\n",
+	err := f.rootNode.fallocKeepSize(f.intFd(), int64(cipherOff), int64(cipherSz))
+	tlog.FuseFrontend.Debug.Printf("Allocate off=%d sz=%d mode=%x cipherOff=%d cipherSz=%d\n",
 		off, sz, mode, cipherOff, cipherSz)
+	if err == syscall.EOPNOTSUPP && mode == FALLOC_DEFAULT {
+		return f.allocateByWriting(off, sz)
+	}
 	if err != nil {
 		return fs.ToErrno(err)
 	}
@@ -89,20 +138,130 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	// The file grows. The space has already been allocated in (1), so what is
 	// left to do is to pad the first and last block and call truncate.
 	// truncateGrowFile does just that.
-	return f.truncateGrowFile(oldPlainSz, newPlainSz)
+	if errno := f.rootNode.quota.reserve(newPlainSz - oldPlainSz); errno != 0 {
+		return errno
+	}
+	errno = f.truncateGrowFile(oldPlainSz, newPlainSz)
+	if errno != 0 {
+		f.rootNode.quota.release(newPlainSz - oldPlainSz)
+	}
+	return errno
+}
+
+// writeZeros writes "sz" zero bytes at "off", in chunks that doWrite() can
+// take. The caller must hold ContentLock exclusively.
+func (f *File) writeZeros(off uint64, sz uint64) syscall.Errno {
+	chunk := uint64(fuse.MAX_KERNEL_WRITE)
+	zero := make([]byte, chunk)
+	for o := off; o < off+sz; o += chunk {
+		n := off + sz - o
+		if n > chunk {
+			n = chunk
+		}
+		if _, errno := f.doWrite(zero[:n], int64(o)); errno != 0 {
+			return errno
+		}
+	}
+	return 0
+}
+
+// allocateByWriting implements fallocate mode 0 on backing filesystems that
+// do not support fallocate: like posix_fallocate() in glibc, it writes
+// zeros to allocate the space. Only the part of the range beyond the end of
+// the file is written, as zeros must not overwrite data. File holes inside
+// the file stay holes.
+// The caller must hold ContentLock exclusively.
+func (f *File) allocateByWriting(off uint64, sz uint64) syscall.Errno {
+	oldSize, err := f.statPlainSize()
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	end := off + sz
+	if end <= oldSize {
+		return 0
+	}
+	if off < oldSize {
+		off = oldSize
+	}
+	if errno := f.rootNode.quota.reserve(end - oldSize); errno != 0 {
+		return errno
+	}
+	errno := f.writePadHole(int64(off))
+	if errno == 0 {
+		errno = f.writeZeros(off, end-off)
+	}
+	if errno != 0 {
+		f.rootNode.quota.release(end - oldSize)
+	}
+	return errno
 }
 
 // truncate - called from Setattr.
 func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
+	if errno = f.rootNode.checkReadOnly(); errno != 0 {
+		return errno
+	}
+	if errno = f.checkImmutable(); errno != 0 {
+		return errno
+	}
+	if errno = f.checkWORM(); errno != 0 {
+		return errno
+	}
+	if errno = f.checkAppend(newSize); errno != 0 {
+		return errno
+	}
+	if errno = f.checkFileSize(newSize); errno != 0 {
+		return errno
+	}
+	if f.node != nil {
+		if errno = f.rootNode.audit(auditlog.OpTruncate, f.node.Path(), "", newSize); errno != 0 {
+			return errno
+		}
+	}
+	q := f.rootNode.quota
+	if q == nil {
+		return f.doTruncate(newSize)
+	}
+	oldSize, err := f.plainSize()
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	if newSize > oldSize {
+		if errno = q.reserve(newSize - oldSize); errno != 0 {
+			return errno
+		}
+	}
+	errno = f.doTruncate(newSize)
+	if errno != 0 {
+		if newSize > oldSize {
+			q.release(newSize - oldSize)
+		}
+		return errno
+	}
+	if newSize < oldSize {
+		q.release(oldSize - newSize)
+	}
+	return 0
+}
+
+// doTruncate does the actual work for truncate().
+func (f *File) doTruncate(newSize uint64) (errno syscall.Errno) {
 	var err error
+	if f.plaintext {
+		return fs.ToErrno(syscall.Ftruncate(f.intFd(), int64(newSize)))
+	}
+	if errno = f.merkleLoad(); errno != 0 {
+		return errno
+	}
 	// Common case first: Truncate to zero
 	if newSize == 0 {
 		err = syscall.Ftruncate(int(f.fd.Fd()), 0)
 		if err != nil {
-			tlog.Warn.Printf("ino%d fh%d: Ftruncate(fd, 0) returned error: %v", f.qIno.Ino, f.intFd(), err)
+			tlog.FuseFrontend.Warn.Printf("ino%d fh%d: Ftruncate(fd, 0) returned error: %v", f.qIno.Ino, f.intFd(), err)
 			return fs.ToErrno(err)
 		}
-		// Truncate to zero kills the file header
+		// Truncate to zero kills the file header, and with it the hash tree
+		f.merkleDrop()
 		f.fileTableEntry.ID = nil
 		return 0
 	}
@@ -115,7 +274,7 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 
 	oldB := float32(oldSize) / float32(f.contentEnc.PlainBS())
 	newB := float32(newSize) / float32(f.contentEnc.PlainBS())
-	tlog.Debug.Printf("ino%d: FUSE Truncate from %.2f to %.2f blocks (%d to %d bytes)", f.qIno.Ino, oldB, newB, oldSize, newSize)
+	tlog.FuseFrontend.Debug.Printf("ino%d: FUSE Truncate from %.2f to %.2f blocks (%d to %d bytes)", f.qIno.Ino, oldB, newB, oldSize, newSize)
 
 	// File size stays the same - nothing to do
 	if newSize == oldSize {
@@ -135,29 +294,51 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 	if lastBlockLen > 0 {
 		data, errno = f.doRead(nil, plainOff, lastBlockLen)
 		if errno != 0 {
-			tlog.Warn.Printf("Truncate: shrink doRead returned error: %v", err)
+			tlog.FuseFrontend.Warn.Printf("Truncate: shrink doRead returned error: %v", err)
+			return errno
+		}
+	}
+	// Save the partial block that is rewritten below, so that it can be
+	// restored if we crash after the Ftruncate (-journal)
+	var rec *journal.Record
+	var recID string
+	if lastBlockLen > 0 {
+		rec, recID, errno = f.journalBegin(int64(cipherOff), int64(f.contentEnc.CipherBS()), true)
+		if errno != 0 {
 			return errno
 		}
 	}
 	// Truncate down to the last complete block
+	f.invalidateCache(blockNo)
+	if errno = f.merkleBegin(blockNo); errno != 0 {
+		f.journalEnd(rec, recID, true)
+		return errno
+	}
 	err = syscall.Ftruncate(int(f.fd.Fd()), int64(cipherOff))
 	if err != nil {
-		tlog.Warn.Printf("Truncate: shrink Ftruncate returned error: %v", err)
+		tlog.FuseFrontend.Warn.Printf("Truncate: shrink Ftruncate returned error: %v", err)
+		f.journalEnd(rec, recID, true)
 		return fs.ToErrno(err)
 	}
+	if errno = f.merkleResize(cipherOff); errno != 0 {
+		f.journalEnd(rec, recID, true)
+		return errno
+	}
 	// Append partial block
 	if lastBlockLen > 0 {
-		_, status := f.doWrite(data, int64(plainOff))
-		return status
+		_, errno = f.doWrite(data, int64(plainOff))
 	}
-	return 0
+	if errno2 := f.journalEnd(rec, recID, errno != 0); errno == 0 {
+		errno = errno2
+	}
+	return errno
 }
 
 // statPlainSize stats the file and returns the plaintext size
 func (f *File) statPlainSize() (uint64, error) {
 	fi, err := f.fd.Stat()
 	if err != nil {
-		tlog.Warn.Printf("ino%d fh%d: statPlainSize: %v", f.qIno.Ino, f.intFd(), err)
+		tlog.FuseFrontend.Warn.Printf("ino%d fh%d: statPlainSize: %v", f.qIno.Ino, f.intFd(), err)
 		return 0, err
 	}
 	cipherSz := uint64(fi.Size())
@@ -172,6 +353,9 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Er
 	if newPlainSz <= oldPlainSz {
 		log.Panicf("BUG: newSize=%d <= oldSize=%d", newPlainSz, oldPlainSz)
 	}
+	if errno := f.merkleLoad(); errno != 0 {
+		return errno
+	}
 	newEOFOffset := newPlainSz - 1
 	if oldPlainSz > 0 {
 		n1 := f.contentEnc.PlainOffToBlockNo(oldPlainSz - 1)
@@ -197,18 +381,25 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Er
 	if newPlainSz%f.contentEnc.PlainBS() == 0 {
 		// The file was empty, so it did not have a header. Create one.
 		if oldPlainSz == 0 {
-			id, err := f.createHeader()
+			h, err := f.createHeader()
 			if err != nil {
 				return fs.ToErrno(err)
 			}
-			f.fileTableEntry.ID = id
+			f.cacheHeader(h)
+			if errno = f.merkleLoad(); errno != 0 {
+				return errno
+			}
 		}
 		cSz := int64(f.contentEnc.PlainSizeToCipherSize(newPlainSz))
+		if errno = f.merkleBegin(f.contentEnc.PlainOffToBlockNo(oldPlainSz)); errno != 0 {
+			return errno
+		}
 		err := syscall.Ftruncate(f.intFd(), cSz)
 		if err != nil {
-			tlog.Warn.Printf("Truncate: grow Ftruncate returned error: %v", err)
+			tlog.FuseFrontend.Warn.Printf("Truncate: grow Ftruncate returned error: %v", err)
+			return fs.ToErrno(err)
 		}
-		return fs.ToErrno(err)
+		return f.merkleResize(uint64(cSz))
 	}
 	// The new size is NOT aligned, so we need to write a partial block.
 	// Write a single zero to the last byte and let doWrite figure it out.
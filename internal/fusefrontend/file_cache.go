@@ -0,0 +1,67 @@
+package fusefrontend
+
+// Integration of the -cachedir block cache into the read and write paths
+
+// readCached fills "ciphertext" with blocks from the block cache, starting at
+// "firstBlockNo". A cached block that is shorter than a full block is the
+// last block of the file, so reading stops there.
+// Returns the number of bytes read, or 0 if not all blocks are cached.
+func (f *File) readCached(ciphertext []byte, firstBlockNo uint64, fileID []byte) int {
+	bc := f.rootNode.blockCache
+	if bc == nil {
+		return 0
+	}
+	stats := &f.rootNode.stats
+	cipherBS := int(f.contentEnc.CipherBS())
+	n := 0
+	for blockNo := firstBlockNo; n < len(ciphertext); blockNo++ {
+		block := bc.Get(fileID, blockNo)
+		if block == nil || len(block) > len(ciphertext)-n {
+			stats.hit(false, &stats.blockCacheHits, &stats.blockCacheMisses)
+			return 0
+		}
+		n += copy(ciphertext[n:], block)
+		if len(block) < cipherBS {
+			break
+		}
+	}
+	stats.hit(true, &stats.blockCacheHits, &stats.blockCacheMisses)
+	return n
+}
+
+// cacheBlocks stores the "ciphertext" blocks, starting at "firstBlockNo",
+// in the block cache.
+func (f *File) cacheBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte) {
+	bc := f.rootNode.blockCache
+	if bc == nil {
+		return
+	}
+	cipherBS := int(f.contentEnc.CipherBS())
+	for i := 0; i < len(ciphertext); i += cipherBS {
+		end := i + cipherBS
+		if end > len(ciphertext) {
+			end = len(ciphertext)
+		}
+		bc.Put(fileID, firstBlockNo+uint64(i/cipherBS), ciphertext[i:end])
+	}
+}
+
+// invalidateCache drops block "fromBlockNo" and all following blocks of this
+// file from the block cache.
+// The caller must hold ContentLock.
+func (f *File) invalidateCache(fromBlockNo uint64) {
+	bc := f.rootNode.blockCache
+	if bc == nil {
+		return
+	}
+	fileID := f.fileTableEntry.ID
+	if fileID == nil {
+		h, err := f.readFileID()
+		if err != nil {
+			// No valid header, so there is nothing in the cache
+			return
+		}
+		fileID = h.ID
+	}
+	bc.Invalidate(fileID, fromBlockNo)
+}
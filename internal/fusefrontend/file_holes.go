@@ -18,7 +18,7 @@ func (f *File) writePadHole(targetOff int64) syscall.Errno {
 	// Get the current file size.
 	fi, err := f.fd.Stat()
 	if err != nil {
-		tlog.Warn.Printf("checkAndPadHole: Fstat failed: %v", err)
+		tlog.FuseFrontend.Warn.Printf("checkAndPadHole: Fstat failed: %v", err)
 		return fs.ToErrno(err)
 	}
 	plainSize := f.contentEnc.CipherSizeToPlainSize(uint64(fi.Size()))
@@ -52,7 +52,7 @@ func (f *File) zeroPad(plainSize uint64) syscall.Errno {
 	}
 	missing := f.contentEnc.PlainBS() - lastBlockLen
 	pad := make([]byte, missing)
-	tlog.Debug.Printf("zeroPad: Writing %d bytes\n", missing)
+	tlog.FuseFrontend.Debug.Printf("zeroPad: Writing %d bytes\n", missing)
 	_, errno := f.doWrite(pad, int64(plainSize))
 	return errno
 }
@@ -63,6 +63,7 @@ func (f *File) zeroPad(plainSize uint64) syscall.Errno {
 // fuse_file_llseek @ https://git.kernel.org/pub/scm/linux/kernel/git/stable/linux.git/tree/fs/fuse/file.c?h=v5.12.7#n2634
 // this function is only called for SEEK_HOLE & SEEK_DATA.
 func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	f.rootNode.stats.op(statOther)
 	const (
 		SEEK_DATA = 3 // find next data segment at or above `off`
 		SEEK_HOLE = 4 // find next hole at or above `off`
@@ -71,16 +72,24 @@ func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, sy
 		MinusOne = ^uint64(0)
 	)
 	if whence != SEEK_DATA && whence != SEEK_HOLE {
-		tlog.Warn.Printf("BUG: Lseek was called with whence=%d. This is not supported!", whence)
+		tlog.FuseFrontend.Warn.Printf("BUG: Lseek was called with whence=%d. This is not supported!", whence)
 		return 0, syscall.EINVAL
 	}
 	if runtime.GOOS != "linux" {
 		// MacOS has broken (different?) SEEK_DATA / SEEK_HOLE semantics, see
 		// https://lists.gnu.org/archive/html/bug-gnulib/2018-09/msg00051.html
-		tlog.Warn.Printf("buggy on non-linux platforms, disabling SEEK_DATA & SEEK_HOLE")
+		tlog.FuseFrontend.Warn.Printf("buggy on non-linux platforms, disabling SEEK_DATA & SEEK_HOLE")
 		return MinusOne, syscall.ENOSYS
 	}
 
+	if f.plaintext {
+		newOff, err := syscall.Seek(f.intFd(), int64(off), int(whence))
+		if err != nil {
+			return MinusOne, fs.ToErrno(err)
+		}
+		return uint64(newOff), 0
+	}
+
 	// We will need the file size
 	var st syscall.Stat_t
 	err := syscall.Fstat(f.intFd(), &st)
@@ -90,17 +99,17 @@ func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, sy
 	fileSize := st.Size
 	// Better safe than sorry. The logic is only tested for 4k blocks.
 	if st.Blksize != 4096 {
-		tlog.Warn.Printf("unsupported block size of %d bytes, disabling SEEK_DATA & SEEK_HOLE", st.Blksize)
+		tlog.FuseFrontend.Warn.Printf("unsupported block size of %d bytes, disabling SEEK_DATA & SEEK_HOLE", st.Blksize)
 		return MinusOne, syscall.ENOSYS
 	}
 
 	// man lseek: offset beyond end of file -> ENXIO
-	if f.rootNode.contentEnc.PlainOffToCipherOff(off) >= uint64(fileSize) {
+	if f.contentEnc.PlainOffToCipherOff(off) >= uint64(fileSize) {
 		return MinusOne, syscall.ENXIO
 	}
 
 	// Round down to start of block:
-	cipherOff := f.rootNode.contentEnc.BlockNoToCipherOff(f.rootNode.contentEnc.PlainOffToBlockNo(off))
+	cipherOff := f.contentEnc.BlockNoToCipherOff(f.contentEnc.PlainOffToBlockNo(off))
 	newCipherOff, err := syscall.Seek(f.intFd(), int64(cipherOff), int(whence))
 	if err != nil {
 		return MinusOne, fs.ToErrno(err)
@@ -117,12 +126,12 @@ func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, sy
 			return MinusOne, fs.ToErrno(err)
 		}
 		if newCipherOff == fi.Size() {
-			return f.rootNode.contentEnc.CipherSizeToPlainSize(uint64(newCipherOff)), 0
+			return f.contentEnc.CipherSizeToPlainSize(uint64(newCipherOff)), 0
 		}
 	}
 	// syscall.Seek gave us the beginning of the next ext4 data/hole section.
 	// The next gocryptfs data/hole block starts at the next block boundary,
 	// so we have to round up:
-	newBlockNo := f.rootNode.contentEnc.CipherOffToBlockNo(uint64(newCipherOff) + f.rootNode.contentEnc.CipherBS() - 1)
-	return f.rootNode.contentEnc.BlockNoToPlainOff(newBlockNo), 0
+	newBlockNo := f.contentEnc.CipherOffToBlockNo(uint64(newCipherOff) + f.contentEnc.CipherBS() - 1)
+	return f.contentEnc.BlockNoToPlainOff(newBlockNo), 0
 }
@@ -0,0 +1,98 @@
+package fusefrontend
+
+// Integration of the -journal undo log into the write and truncate paths
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/journal"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// journalBegin saves the existing ciphertext in the "length" bytes at
+// "cOff" in the journal before it is overwritten. Writes that only append
+// to the file are not journaled, and nil is returned.
+// If "shrink" is set, the file is about to be truncated to "cOff", and a
+// rollback restores the saved block as the new end of the file.
+// The caller must hold ContentLock and pass the returned record to
+// journalEnd().
+func (f *File) journalBegin(cOff int64, length int64, shrink bool) (rec *journal.Record, id string, errno syscall.Errno) {
+	j := f.rootNode.journal
+	if j == nil {
+		return nil, "", 0
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil {
+		return nil, "", fs.ToErrno(err)
+	}
+	if cOff >= st.Size {
+		return nil, "", 0
+	}
+	end := cOff + length
+	if end > st.Size {
+		end = st.Size
+	}
+	if f.node == nil {
+		return nil, "", syscall.EIO
+	}
+	cPath, err := f.rootNode.EncryptPath(f.node.Path())
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("ino%d: journal: could not get path: %v", f.qIno.Ino, err)
+		return nil, "", syscall.EIO
+	}
+	rec = &journal.Record{
+		Path:   cPath,
+		Header: make([]byte, contentenc.HeaderLen),
+		Offset: cOff,
+		Data:   make([]byte, end-cOff),
+		Size:   st.Size,
+	}
+	if shrink {
+		rec.Size = end
+	}
+	if _, err = f.fd.ReadAt(rec.Header, 0); err == nil {
+		_, err = f.fd.ReadAt(rec.Data, cOff)
+	}
+	if err == nil {
+		id, err = j.Add(rec)
+	}
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("ino%d: journal: could not save old contents: %v", f.qIno.Ino, err)
+		return nil, "", syscall.EIO
+	}
+	return rec, id, 0
+}
+
+// journalEnd is called when the write protected by "rec" is done. If it
+// succeeded, the new contents are synced to disk. If it failed, the old
+// contents are restored. Then the record is deleted.
+// The caller must hold ContentLock.
+func (f *File) journalEnd(rec *journal.Record, id string, failed bool) syscall.Errno {
+	if rec == nil {
+		return 0
+	}
+	var err error
+	if !failed {
+		err = f.fd.Sync()
+	}
+	if failed || err != nil {
+		f.invalidateCache(f.contentEnc.CipherOffToBlockNo(uint64(rec.Offset)))
+		if err = rec.Apply(f.fd); err != nil {
+			// Keep the record, it is rolled back on the next mount
+			tlog.FuseFrontend.Warn.Printf("ino%d: journal: rollback failed: %v", f.qIno.Ino, err)
+			return syscall.EIO
+		}
+		failed = true
+	}
+	if err = f.rootNode.journal.Remove(id); err != nil {
+		tlog.FuseFrontend.Warn.Printf("ino%d: journal: could not remove record %s: %v", f.qIno.Ino, id, err)
+		return syscall.EIO
+	}
+	if failed {
+		return syscall.EIO
+	}
+	return 0
+}
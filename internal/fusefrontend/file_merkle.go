@@ -0,0 +1,300 @@
+package fusefrontend
+
+// Integration of the -merkle hash trees into the read, write and truncate
+// paths
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/merkle"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// merkleRebuildChunk is the number of blocks that merkleLoad() hashes at a
+// time
+const merkleRebuildChunk = 64
+
+// merkleBlockCount returns the number of blocks in a ciphertext file of
+// size "cSize", counting a partial last block.
+func (f *File) merkleBlockCount(cSize uint64) int {
+	if cSize <= f.contentEnc.HeaderLen() {
+		return 0
+	}
+	return int(f.contentEnc.CipherOffToBlockNo(cSize-1) + 1)
+}
+
+// merkleCorrupt logs and reports a file that does not match its tree
+func (f *File) merkleCorrupt(format string, args ...interface{}) syscall.Errno {
+	tlog.FuseFrontend.Warn.Printf("ino%d: -merkle: "+format, append([]interface{}{f.qIno.Ino}, args...)...)
+	f.rootNode.reportMitigatedCorruption(fmt.Sprint(f.qIno.Ino))
+	return syscall.EIO
+}
+
+// packHeader returns the header "h" of a new file, followed by the initial
+// tree state (-merkle)
+func (rn *RootNode) packHeader(h *contentenc.FileHeader) []byte {
+	buf := h.Pack()
+	if rn.merkle != nil {
+		buf = append(buf, rn.merkle.NewState(h.ID)...)
+	}
+	return buf
+}
+
+// merkleLoad loads the hash tree into the open file table entry, reading
+// the file ID first if needed. It does nothing if "-merkle" is off, the tree
+// is already loaded, or the file is empty. If the file has not been closed
+// cleanly, the tree is rebuilt from the first block that may have changed.
+// The caller must hold ContentLock exclusively, or IDLock.
+func (f *File) merkleLoad() syscall.Errno {
+	store := f.rootNode.merkle
+	e := f.fileTableEntry
+	if store == nil || f.plaintext || e.Tree != nil {
+		return 0
+	}
+	if e.ID == nil {
+		h, err := f.readFileID()
+		if err == io.EOF {
+			return 0
+		} else if err != nil {
+			tlog.FuseFrontend.Warn.Printf("ino%d: -merkle: corrupt header: %v", f.qIno.Ino, err)
+			return syscall.EIO
+		}
+		f.cacheHeader(h)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	n := f.merkleBlockCount(uint64(st.Size))
+	state := make([]byte, merkle.StateLen)
+	if _, err := f.fd.ReadAt(state, contentenc.HeaderLen); err != nil {
+		return f.merkleCorrupt("could not read the hash tree state: %v", err)
+	}
+	t, err := store.Open(e.ID, state, n)
+	if err != nil {
+		return f.merkleCorrupt("could not load hash tree: %v", err)
+	}
+	if from, dirty := t.Dirty(); dirty && from < n {
+		if errno := f.merkleRebuild(t, from, n); errno != 0 {
+			t.Close()
+			return errno
+		}
+		tlog.FuseFrontend.Info.Printf("ino%d: -merkle: the file has not been closed cleanly, rehashed blocks #%d to #%d",
+			f.qIno.Ino, from, n-1)
+	}
+	e.Tree = t
+	return 0
+}
+
+// merkleRebuild hashes the blocks "from" to "n"-1 into the tree "t"
+func (f *File) merkleRebuild(t *merkle.Tree, from int, n int) syscall.Errno {
+	buf := make([]byte, merkleRebuildChunk*f.contentEnc.CipherBS())
+	for i := from; i < n; i += merkleRebuildChunk {
+		m, err := f.fd.ReadAt(buf, int64(f.contentEnc.BlockNoToCipherOff(uint64(i))))
+		if err != nil && err != io.EOF {
+			tlog.FuseFrontend.Warn.Printf("ino%d: -merkle: rebuild: %v", f.qIno.Ino, err)
+			return fs.ToErrno(err)
+		}
+		if err = t.Update(i, f.merkleHash(buf[:m])); err != nil {
+			tlog.FuseFrontend.Warn.Printf("ino%d: -merkle: rebuild: %v", f.qIno.Ino, err)
+			return syscall.EIO
+		}
+	}
+	return 0
+}
+
+// merkleHash returns the leaves of the blocks in "ciphertext"
+func (f *File) merkleHash(ciphertext []byte) (leaves [][]byte) {
+	bs := int(f.contentEnc.CipherBS())
+	for off := 0; off < len(ciphertext); off += bs {
+		end := off + bs
+		if end > len(ciphertext) {
+			end = len(ciphertext)
+		}
+		leaves = append(leaves, merkle.LeafHash(ciphertext[off:end]))
+	}
+	return leaves
+}
+
+// merkleVerify checks "ciphertext", which has been read starting at block
+// "firstBlockNo", against the hash tree "t". "eof" is set if the read hit the
+// end of the file.
+// The caller must hold ContentLock.
+func (f *File) merkleVerify(t *merkle.Tree, ciphertext []byte, firstBlockNo uint64, eof bool) syscall.Errno {
+	if t == nil {
+		return 0
+	}
+	leaves := f.merkleHash(ciphertext)
+	first := int(firstBlockNo)
+	ok, err := t.Verify(first, leaves)
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("ino%d: -merkle: %v", f.qIno.Ino, err)
+		return syscall.EIO
+	}
+	if !ok {
+		return f.merkleCorrupt("blocks #%d to #%d do not match the hash tree", first, first+len(leaves)-1)
+	}
+	if end := first + len(leaves); eof && end < t.Len() {
+		return f.merkleCorrupt("file ends at block #%d, but the hash tree has %d blocks", end, t.Len())
+	}
+	return 0
+}
+
+// merkleLeaves hashes the blocks in "ciphertext" for merkleWrite(). Returns
+// nil if there is no tree.
+func (f *File) merkleLeaves(ciphertext []byte) [][]byte {
+	if f.fileTableEntry.Tree == nil {
+		return nil
+	}
+	return f.merkleHash(ciphertext)
+}
+
+// merkleBegin must be called before the blocks from "firstBlockNo" on are
+// written or truncated away. It marks the tree state in the file header
+// dirty and makes it durable, so that the tree is rebuilt if we crash.
+// The caller must hold ContentLock exclusively.
+func (f *File) merkleBegin(firstBlockNo uint64) syscall.Errno {
+	t := f.fileTableEntry.Tree
+	if t == nil {
+		return 0
+	}
+	err := t.MarkDirty(int(firstBlockNo), func(state []byte) error {
+		if _, err := f.fd.WriteAt(state, contentenc.HeaderLen); err != nil {
+			return err
+		}
+		return f.fd.Sync()
+	})
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("ino%d: -merkle: could not mark the hash tree dirty: %v", f.qIno.Ino, err)
+		return fs.ToErrno(err)
+	}
+	return 0
+}
+
+// merkleWrite updates the tree after "leaves" have been written starting at
+// block "firstBlockNo". Skipped blocks are file holes.
+// The caller must hold ContentLock exclusively.
+func (f *File) merkleWrite(firstBlockNo uint64, leaves [][]byte) syscall.Errno {
+	t := f.fileTableEntry.Tree
+	if t == nil {
+		return 0
+	}
+	if err := t.Update(int(firstBlockNo), leaves); err != nil {
+		return f.merkleFailed(err)
+	}
+	return 0
+}
+
+// merkleResize updates the tree after the ciphertext file has been
+// truncated to "cSize". New blocks are file holes.
+// The caller must hold ContentLock exclusively.
+func (f *File) merkleResize(cSize uint64) syscall.Errno {
+	t := f.fileTableEntry.Tree
+	if t == nil {
+		return 0
+	}
+	if err := t.Resize(f.merkleBlockCount(cSize)); err != nil {
+		return f.merkleFailed(err)
+	}
+	return 0
+}
+
+// merkleFailed unloads the tree after an error. The state in the file
+// header is dirty, so the tree is rebuilt when it is loaded again.
+// The caller must hold ContentLock exclusively.
+func (f *File) merkleFailed(err error) syscall.Errno {
+	tlog.FuseFrontend.Warn.Printf("ino%d: -merkle: could not update the hash tree: %v", f.qIno.Ino, err)
+	f.merkleUnload()
+	return syscall.EIO
+}
+
+// merkleUnload closes the tree, it is loaded again when needed
+// The caller must hold ContentLock exclusively.
+func (f *File) merkleUnload() {
+	e := f.fileTableEntry
+	if e.Tree == nil {
+		return
+	}
+	e.Tree.Close()
+	e.Tree = nil
+}
+
+// merkleClean makes the file durable and marks the tree state clean. It is
+// called when a writable file is closed.
+// The caller must hold ContentLock exclusively.
+func (f *File) merkleClean() error {
+	t := f.fileTableEntry.Tree
+	if t == nil {
+		return nil
+	}
+	if _, dirty := t.Dirty(); !dirty {
+		return nil
+	}
+	if err := f.fd.Sync(); err != nil {
+		return err
+	}
+	return t.MarkClean(func(state []byte) error {
+		_, err := f.fd.WriteAt(state, contentenc.HeaderLen)
+		return err
+	})
+}
+
+// merkleDrop deletes the tree when the file ID goes away because the file
+// has been truncated to zero.
+// The caller must hold ContentLock exclusively.
+func (f *File) merkleDrop() {
+	e := f.fileTableEntry
+	if e.Tree == nil {
+		return
+	}
+	f.merkleUnload()
+	if err := f.rootNode.merkle.Remove(e.ID); err != nil {
+		tlog.FuseFrontend.Warn.Printf("ino%d: -merkle: could not delete hash tree: %v", f.qIno.Ino, err)
+	}
+}
+
+// merkleFileID returns the file ID of "cName" in "dirfd" if it is a regular
+// file with a single link, so that its tree can be deleted together with
+// it. Returns nil otherwise.
+func (rn *RootNode) merkleFileID(dirfd int, cName string) []byte {
+	if rn.merkle == nil {
+		return nil
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Nlink != 1 {
+		return nil
+	}
+	return rn.readFileIDFd(fd)
+}
+
+// readFileIDFd returns the file ID in the header of the file open at "fd",
+// or nil
+func (rn *RootNode) readFileIDFd(fd int) []byte {
+	h := rn.readHeaderFd(fd)
+	if h == nil {
+		return nil
+	}
+	return h.ID
+}
+
+// merkleForget deletes the tree of a file that has been unlinked or
+// replaced. "fileID" may be nil.
+func (rn *RootNode) merkleForget(fileID []byte) {
+	if fileID == nil {
+		return
+	}
+	if err := rn.merkle.Remove(fileID); err != nil {
+		tlog.FuseFrontend.Warn.Printf("-merkle: could not delete hash tree: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package fusefrontend
+
+// Unencrypted I/O for files in "plaintext" policy subtrees
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// readPlaintext reads len(buf) bytes at offset "off" directly from the
+// backing file. The caller must hold ContentLock.RLock().
+func (f *File) readPlaintext(buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := f.fd.ReadAt(buf, off)
+	n = f.rootNode.faults.ShortRead(n)
+	if err != nil && err != io.EOF {
+		tlog.FuseFrontend.Warn.Printf("ino%d: readPlaintext: ReadAt off=%d len=%d failed: %v",
+			f.qIno.Ino, off, len(buf), err)
+		return nil, fs.ToErrno(err)
+	}
+	return fuse.ReadResultData(buf[:n]), 0
+}
+
+// writePlaintext writes "data" at offset "off" directly to the backing file.
+// The caller must hold ContentLock.Lock().
+func (f *File) writePlaintext(data []byte, off int64) (uint32, syscall.Errno) {
+	var n int
+	err := f.rootNode.withRetry("writePlaintext", func() (err error) {
+		if err = f.rootNode.faults.BeforeWrite(); err != nil {
+			return err
+		}
+		n, err = f.fd.WriteAt(data, off)
+		if err == nil {
+			f.rootNode.faults.AfterWrite()
+		}
+		return err
+	})
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("ino%d: writePlaintext: WriteAt off=%d len=%d failed: %v",
+			f.qIno.Ino, off, len(data), err)
+		return uint32(n), fs.ToErrno(err)
+	}
+	return uint32(n), 0
+}
@@ -12,6 +12,7 @@ import (
 )
 
 func (f *File) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
+	f.rootNode.stats.op(statSetattr)
 	errno = f.setAttr(ctx, in)
 	if errno != 0 {
 		return errno
@@ -23,7 +24,7 @@ func (f *File) setAttr(ctx context.Context, in *fuse.SetAttrIn) (errno syscall.E
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
-		tlog.Warn.Printf("ino%d fh%d: Truncate on released file", f.qIno.Ino, f.intFd())
+		tlog.FuseFrontend.Warn.Printf("ino%d fh%d: Truncate on released file", f.qIno.Ino, f.intFd())
 		return syscall.EBADF
 	}
 	f.fileTableEntry.ContentLock.Lock()
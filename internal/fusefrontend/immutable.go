@@ -0,0 +1,189 @@
+package fusefrontend
+
+// Immutable files
+//
+// A file is marked immutable in its header, see contentenc.FileHeader. The
+// marker is authenticated together with each block, so it cannot be cleared
+// in CIPHERDIR without breaking the file. The marker needs the Immutable
+// feature flag ("-immutable"), because older gocryptfs versions cannot read
+// such headers. Immutable files cannot be written,
+// truncated or renamed through the mount, regardless of their permissions.
+// The marker is set and cleared through the "user.gocryptfs.immutable"
+// xattr, which re-encrypts the file with a new header.
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// xattrImmutable is the virtual xattr that shows and sets the immutable
+// marker. It is not stored on the backing file, and not listed by
+// Listxattr(), so that copies of the file do not inherit it.
+const xattrImmutable = "user.gocryptfs.immutable"
+
+// HeaderFeatures returns what the file headers in CIPHERDIR may use
+func (rn *RootNode) HeaderFeatures() contentenc.HeaderFeatures {
+	return rn.headerFeatures
+}
+
+// readHeaderFd returns the header of the file open at "fd", or nil
+func (rn *RootNode) readHeaderFd(fd int) *contentenc.FileHeader {
+	buf := make([]byte, contentenc.HeaderLen)
+	if n, err := syscall.Pread(fd, buf, 0); err != nil || n != len(buf) {
+		return nil
+	}
+	h, err := contentenc.ParseHeader(buf, rn.headerFeatures)
+	if err != nil {
+		return nil
+	}
+	return h
+}
+
+// isImmutableFd returns true if the file open at "fd" is marked immutable
+func (rn *RootNode) isImmutableFd(fd int) bool {
+	if !rn.headerFeatures.Immutable {
+		return false
+	}
+	h := rn.readHeaderFd(fd)
+	return h != nil && h.Immutable
+}
+
+// isImmutableAt returns true if the ciphertext file "cName" in "dirfd" is
+// marked immutable. Directories and symlinks never are.
+func (rn *RootNode) isImmutableAt(dirfd int, cName string) bool {
+	if !rn.headerFeatures.Immutable {
+		return false
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return false
+	}
+	return rn.isImmutableFd(fd)
+}
+
+// checkImmutable returns EPERM if the file is marked immutable.
+// The caller must hold ContentLock exclusively.
+func (f *File) checkImmutable() syscall.Errno {
+	if f.plaintext {
+		return 0
+	}
+	if f.fileTableEntry.ID == nil {
+		h, err := f.readFileID()
+		if err != nil {
+			// Empty or corrupt, which is for the caller to find out
+			return 0
+		}
+		f.cacheHeader(h)
+	}
+	if f.fileTableEntry.Immutable {
+		tlog.FuseFrontend.Debug.Printf("ino%d: immutable", f.qIno.Ino)
+		return syscall.EPERM
+	}
+	return 0
+}
+
+// checkRenameImmutable returns EPERM if renaming "cName" in "dirfd" to
+// "cName2" in "dirfd2" would move or replace an immutable file.
+func (n *Node) checkRenameImmutable(name string, dirfd int, cName string, n2 *Node, newName string,
+	dirfd2 int, cName2 string) syscall.Errno {
+	rn := n.rootNode()
+	if !n.isPlaintext(name) && rn.isImmutableAt(dirfd, cName) {
+		return syscall.EPERM
+	}
+	if !n2.isPlaintext(newName) && rn.isImmutableAt(dirfd2, cName2) {
+		return syscall.EPERM
+	}
+	return 0
+}
+
+// getImmutable handles reading xattrImmutable: "1" if the file is immutable,
+// ENODATA otherwise
+func (n *Node) getImmutable() ([]byte, syscall.Errno) {
+	if n.isPlaintext("") {
+		return nil, syscall.ENODATA
+	}
+	dirfd, cName, errno := n.prepareAtSyscallMyself()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(dirfd)
+	if !n.rootNode().isImmutableAt(dirfd, cName) {
+		return nil, syscall.ENODATA
+	}
+	return []byte("1"), 0
+}
+
+// setImmutable sets or clears the immutable marker of the file by
+// re-encrypting it with a new header. Only the owner of the file and root
+// can do that, and only on filesystems with the Immutable feature flag.
+func (n *Node) setImmutable(ctx context.Context, immutable bool) syscall.Errno {
+	rn := n.rootNode()
+	if !rn.headerFeatures.Immutable || n.isPlaintext("") || n.branch != rn.branch {
+		return syscall.EOPNOTSUPP
+	}
+	rel, err := rn.EncryptPath(n.Path())
+	if err != nil {
+		return syscall.EIO
+	}
+	fd, err := rn.branch.openBeneath(rel, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return fs.ToErrno(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		syscall.Close(fd)
+		return syscall.EOPNOTSUPP
+	}
+	if caller, ok := fuse.FromContext(ctx); ok && caller.Uid != 0 && caller.Uid != st.Uid {
+		syscall.Close(fd)
+		return syscall.EPERM
+	}
+	if uint64(st.Size) <= rn.branch.contentEnc.HeaderLen() {
+		// Empty files have no header to hold the marker
+		syscall.Close(fd)
+		return syscall.EINVAL
+	}
+	h := rn.readHeaderFd(fd)
+	if h == nil {
+		syscall.Close(fd)
+		return syscall.EIO
+	}
+	if h.Immutable == immutable {
+		syscall.Close(fd)
+		return 0
+	}
+	rn.rewriteLock.Lock()
+	defer rn.rewriteLock.Unlock()
+	s, err := rn.loadReencryptState()
+	if err != nil {
+		syscall.Close(fd)
+		tlog.FuseFrontend.Warn.Printf("%s: %v", xattrImmutable, err)
+		return syscall.EIO
+	}
+	err = rn.rewriteFile(s, rel, fd, &st, h, immutable, nil)
+	if err == errReencryptBusy {
+		// Written to meanwhile
+		return syscall.EBUSY
+	} else if err != nil {
+		tlog.FuseFrontend.Warn.Printf("%s: %q: %v", xattrImmutable, rel, err)
+		return syscall.EIO
+	}
+	return 0
+}
@@ -0,0 +1,163 @@
+package fusefrontend
+
+// Locking the whole filesystem and switching it to read-only at runtime,
+// through the control socket.
+//
+// Lock() wipes the keys of the primary branch and of the subvolumes. Like
+// for a locked subvolume, the operations that use the keys hold the read lock
+// on them (branch.rlockKeys) and fail with EACCES once they are gone. On top
+// of that, RootNode.locked makes all operations that access CIPHERDIR fail
+// with EACCES, see checkLocked(). The goroutines of -reencrypt and -notify
+// use the keys outside of FUSE requests, so Lock() is not supported with
+// them.
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// lockReleaseWait is how long Lock() waits for open files to be released.
+// close(2) returns before the kernel sends RELEASE.
+const lockReleaseWait = time.Second
+
+// UnlockFunc returns the crypto helpers for the primary branch if "password"
+// is correct. "wipe" wipes their keys.
+type UnlockFunc func(password []byte) (c *contentenc.ContentEnc, n *nametransform.NameTransform, wipe func(), err error)
+
+// SetLockFunc sets the function that wipes the keys passed to NewRootNode(),
+// and the one that Unlock() uses to check the password. Pass nil for
+// "unlock" if the password is not known (-masterkey, -zerokey). Must be
+// called before mounting.
+func (rn *RootNode) SetLockFunc(wipe func(), unlock UnlockFunc) {
+	rn.branch.wipe = wipe
+	rn.unlockKeys = unlock
+}
+
+// Lock is called via the control socket. It wipes the keys of the
+// filesystem and of the subvolumes, and makes all access fail with EACCES
+// until Unlock() is called. Fails with EBUSY while files are open.
+func (rn *RootNode) Lock() error {
+	rn.lockMu.Lock()
+	defer rn.lockMu.Unlock()
+	if rn.branch.isLocked() {
+		return nil
+	}
+	if rn.unlockKeys == nil || len(rn.branches) > 1 || rn.reencryptStop != nil || rn.notify != nil {
+		// -masterkey, -zerokey, -union, -reencrypt, -notify
+		return syscall.ENOTSUP
+	}
+	// New operations fail from here on
+	atomic.StoreUint32(&rn.locked, 1)
+	for t := time.Now(); atomic.LoadInt64(&rn.openFiles) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(t) > lockReleaseWait {
+			atomic.StoreUint32(&rn.locked, 0)
+			return syscall.EBUSY
+		}
+	}
+	// The write locks wait for the running operations that use the keys.
+	// A file may still have been opened by an operation that started
+	// before.
+	branches := append([]*branch{rn.branch}, rn.subvolumes...)
+	busy := false
+	for _, b := range branches {
+		b.mu.Lock()
+		busy = busy || atomic.LoadInt64(&b.openFiles) > 0
+	}
+	for _, b := range branches {
+		if !busy {
+			b.dropKeys()
+		}
+		b.mu.Unlock()
+	}
+	if busy {
+		atomic.StoreUint32(&rn.locked, 0)
+		return syscall.EBUSY
+	}
+	tlog.Info.Printf("Filesystem locked")
+	// Drop the plaintext names and contents from the kernel cache
+	rn.invalidateAll(&rn.Inode)
+	return nil
+}
+
+// Unlock is called via the control socket. It unlocks the filesystem with
+// "password". The subvolumes stay locked.
+func (rn *RootNode) Unlock(password []byte) error {
+	rn.lockMu.Lock()
+	defer rn.lockMu.Unlock()
+	if !rn.branch.isLocked() {
+		return nil
+	}
+	c, n, wipe, err := rn.unlockKeys(password)
+	if err != nil {
+		return err
+	}
+	b := rn.branch
+	b.mu.Lock()
+	b.locked = false
+	b.nameTransform = n
+	b.contentEnc = c
+	b.wipe = wipe
+	b.mu.Unlock()
+	atomic.StoreUint32(&rn.locked, 0)
+	tlog.Info.Printf("Filesystem unlocked")
+	return nil
+}
+
+// IsLocked returns true between Lock() and Unlock()
+func (rn *RootNode) IsLocked() bool {
+	return rn.branch.isLocked()
+}
+
+// checkLocked returns EACCES between Lock() and Unlock()
+func (rn *RootNode) checkLocked() syscall.Errno {
+	if atomic.LoadUint32(&rn.locked) != 0 {
+		return syscall.EACCES
+	}
+	return 0
+}
+
+// invalidateAll makes the kernel forget everything it has cached below "in"
+func (rn *RootNode) invalidateAll(in *fs.Inode) {
+	for name, ch := range in.Children() {
+		rn.invalidateAll(ch)
+		ch.NotifyContent(0, 0)
+		in.NotifyEntry(name)
+	}
+}
+
+// SetReadOnly is called via the control socket. With "ro", all writes fail
+// with EROFS, including those to files that are already open.
+func (rn *RootNode) SetReadOnly(ro bool) error {
+	var v uint32
+	if ro {
+		v = 1
+	}
+	if atomic.SwapUint32(&rn.readOnly, v) != v {
+		if ro {
+			tlog.Info.Printf("Filesystem switched to read-only")
+		} else {
+			tlog.Info.Printf("Filesystem switched to read-write")
+		}
+	}
+	return nil
+}
+
+// IsReadOnly returns true after SetReadOnly(true)
+func (rn *RootNode) IsReadOnly() bool {
+	return atomic.LoadUint32(&rn.readOnly) != 0
+}
+
+// checkReadOnly returns EROFS after SetReadOnly(true)
+func (rn *RootNode) checkReadOnly() syscall.Errno {
+	if rn.IsReadOnly() {
+		return syscall.EROFS
+	}
+	return 0
+}
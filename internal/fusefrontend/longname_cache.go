@@ -0,0 +1,92 @@
+package fusefrontend
+
+import (
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/membudget"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+const (
+	// longNameCacheBudgetName is the name of the longNameCache in the
+	// "-cachemem" accounting
+	longNameCacheBudgetName = "longnames"
+	// longNameEntryMem is the approximate overhead of a longNameCache entry.
+	// The strings are charged on top.
+	longNameEntryMem = 128
+)
+
+type longNameEntry struct {
+	name string
+	item *membudget.Item
+}
+
+// longNameCache caches the contents of "gocryptfs.longname.*.name" files, so
+// that OpenDir does not have to read them again. Only names whose hash
+// matches the file name are stored. As the hash does not depend on the
+// directory, an entry never becomes stale and is only evicted by the memory
+// budget.
+type longNameCache struct {
+	sync.Mutex
+	budget  *membudget.Budget
+	entries map[string]*longNameEntry
+}
+
+func newLongNameCache(budget *membudget.Budget) *longNameCache {
+	return &longNameCache{budget: budget, entries: make(map[string]*longNameEntry)}
+}
+
+// get returns the long name stored for "hashName"
+func (c *longNameCache) get(hashName string) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e := c.entries[hashName]
+	if e == nil {
+		return "", false
+	}
+	c.budget.Touch(e.item)
+	return e.name, true
+}
+
+// put stores "name" as the long name of "hashName"
+func (c *longNameCache) put(hashName string, name string) {
+	c.Lock()
+	if _, ok := c.entries[hashName]; ok {
+		c.Unlock()
+		return
+	}
+	e := &longNameEntry{name: name}
+	e.item = c.budget.Add(longNameCacheBudgetName, longNameEntryMem+int64(len(hashName)+len(name)),
+		func() { c.evict(hashName, e) })
+	if e.item != nil {
+		c.entries[hashName] = e
+	}
+	c.Unlock()
+	c.budget.Evict()
+}
+
+// evict drops "hashName" if it is still cached as "e". Called by the memory
+// budget.
+func (c *longNameCache) evict(hashName string, e *longNameEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries[hashName] == e {
+		delete(c.entries, hashName)
+	}
+}
+
+// readLongName returns the content of "cName.name" in the directory "dirfd"
+// like nametransform.ReadLongNameAt, using the longNameCache of the branch.
+func (b *branch) readLongName(dirfd int, cName string) (string, error) {
+	if name, ok := b.longNames.get(cName); ok {
+		return name, nil
+	}
+	name, err := nametransform.ReadLongNameAt(dirfd, cName)
+	if err != nil {
+		return "", err
+	}
+	if b.nameTransform.HashLongName(name) == cName {
+		b.longNames.put(cName, name)
+	}
+	return name, nil
+}
@@ -2,6 +2,7 @@ package fusefrontend
 
 import (
 	"context"
+	"path/filepath"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -9,6 +10,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/auditlog"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -18,29 +20,48 @@ import (
 // in a gocryptfs mount.
 type Node struct {
 	fs.Inode
+	// branch is the CIPHERDIR this node was found in. In union mounts,
+	// a directory can exist in several branches, and this is the first one.
+	branch *branch
 }
 
 // Lookup - FUSE call for discovering a file.
 func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch *fs.Inode, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().stats.op(statLookup)
+	// Excluded paths, and other users' directories in a "userdir", look
+	// like they do not exist
+	if n.isExcluded(name) || n.userDirHidden(ctx, name) {
+		return nil, syscall.ENOENT
+	}
+	rn := n.rootNode()
+	b := rn.branch
+	if rn.isUnion() {
+		// Don't trust the cached child, the file may have been deleted
+		// from one branch and still exist in another.
+		if b = n.findBranch(name); b == nil {
+			return nil, syscall.ENOENT
+		}
+	} else if len(rn.subvolumes) > 0 {
+		b = n.childBranch(name)
+	}
+	dirfd, cName, errno := n.prepareAtSyscallIn(b, name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
 	// Get device number and inode number into `st`
-	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	st, err := rn.fstatat(dirfd, cName)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
 
 	// Create new inode and fill `out`
-	ch = n.newChild(ctx, st, out)
+	ch = n.newChild(ctx, b, st, out)
 
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
-	n.translateSize(dirfd, cName, &out.Attr)
+	n.translateSize(b, dirfd, cName, n.isPlaintext(name), &out.Attr)
 
-	rn := n.rootNode()
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
 	}
@@ -69,6 +90,7 @@ func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch
 //
 // GetAttr is symlink-safe through use of openBackingDir() and Fstatat().
 func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	n.rootNode().stats.op(statGetattr)
 	// If the kernel gives us a file handle, use it.
 	if f != nil {
 		return f.(fs.FileGetattrer).Getattr(ctx, out)
@@ -80,18 +102,18 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	}
 	defer syscall.Close(dirfd)
 
-	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	rn := n.rootNode()
+	st, err := rn.fstatat(dirfd, cName)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
 
 	// Fix inode number
-	rn := n.rootNode()
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
 
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
-	n.translateSize(dirfd, cName, &out.Attr)
+	n.translateSize(n.branch, dirfd, cName, n.isPlaintext(""), &out.Attr)
 
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
@@ -100,6 +122,7 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 }
 
 func (n *Node) Access(ctx context.Context, mode uint32) syscall.Errno {
+	n.rootNode().stats.op(statOther)
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
 	if errno != 0 {
 		return errno
@@ -114,22 +137,69 @@ func (n *Node) Access(ctx context.Context, mode uint32) syscall.Errno {
 //
 // Symlink-safe through use of Unlinkat().
 func (n *Node) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().stats.op(statUnlink)
+	if errno = n.checkWritable(name); errno != 0 {
+		return
+	}
+	rn := n.rootNode()
+	if errno = rn.audit(auditlog.OpUnlink, filepath.Join(n.Path(), name), "", 0); errno != 0 {
+		return
+	}
+	defer func() {
+		if errno == 0 {
+			n.deleted(name)
+		}
+	}()
+	if !rn.isUnion() {
+		return n.unlinkIn(rn.branch, name)
+	}
+	// Delete the file from all branches, otherwise a copy in a later branch
+	// would show up in its place.
+	errno = syscall.ENOENT
+	for _, b := range rn.branches {
+		errno2 := n.unlinkIn(b, name)
+		if errno2 == 0 {
+			errno = 0
+		} else if errno2 != syscall.ENOENT {
+			return errno2
+		}
+	}
+	return errno
+}
+
+// unlinkIn deletes the child "name" from branch "b".
+func (n *Node) unlinkIn(b *branch, name string) (errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscallIn(b, name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
+	if errno = n.rootNode().wormCheckDelete(dirfd, cName); errno != 0 {
+		return
+	}
+	if errno = n.rootNode().checkAppendDelete(dirfd, cName); errno != 0 {
+		return
+	}
+	size, nlink := n.quotaStatAt(b, dirfd, cName, n.isPlaintext(name))
+	var fileID []byte
+	if b == n.rootNode().branch && !n.isPlaintext(name) {
+		fileID = n.rootNode().merkleFileID(dirfd, cName)
+	}
 	// Delete content
 	err := syscallcompat.Unlinkat(dirfd, cName, 0)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
+	if nlink == 1 {
+		n.rootNode().quota.release(size)
+	}
+	n.rootNode().merkleForget(fileID)
 	// Delete ".name" file
-	if !n.rootNode().args.PlaintextNames && nametransform.IsLongContent(cName) {
+	if !n.plainNames(name) && nametransform.IsLongContent(cName) {
 		err = nametransform.DeleteLongNameAt(dirfd, cName)
 		if err != nil {
-			tlog.Warn.Printf("Unlink: could not delete .name file: %v", err)
+			tlog.FuseFrontend.Warn.Printf("Unlink: could not delete .name file: %v", err)
 		}
 	}
 	return fs.ToErrno(err)
@@ -139,17 +209,27 @@ func (n *Node) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
 //
 // Symlink-safe through openBackingDir() + Readlinkat().
 func (n *Node) Readlink(ctx context.Context) (out []byte, errno syscall.Errno) {
+	n.rootNode().stats.op(statOther)
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
-	return n.readlink(dirfd, cName)
+	return n.readlink(n.branch, dirfd, cName, n.isPlaintext(""))
 }
 
 // Setattr - FUSE call. Called for chmod, truncate, utimens, ...
 func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
+	n.rootNode().stats.op(statSetattr)
+	if errno = n.checkWritable(""); errno != 0 {
+		return
+	}
+	defer func() {
+		if errno == 0 {
+			n.changed("")
+		}
+	}()
 	// Use the fd if the kernel gave us one
 	if f != nil {
 		f2 := f.(*File)
@@ -220,7 +300,11 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 		}
 		f2 := f.(*File)
 		defer f2.Release(ctx)
+		// Other handles on the file may be writing or releasing
+		// concurrently, as in File.setAttr()
+		f2.fileTableEntry.ContentLock.Lock()
 		errno = syscall.Errno(f2.truncate(sz))
+		f2.fileTableEntry.ContentLock.Unlock()
 		if errno != 0 {
 			return errno
 		}
@@ -234,12 +318,28 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 //
 // Symlink-safe because the path is ignored.
 func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	p := n.rootNode().args.Cipherdir
+	n.rootNode().stats.op(statOther)
+	rn := n.rootNode()
 	var st syscall.Statfs_t
-	err := syscall.Statfs(p, &st)
+	err := rn.statfs(rn.branch, &st)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
+	// Union mounts report the sum of all branches, in units of the block
+	// size of the primary branch.
+	for _, b := range rn.branches[1:] {
+		var st2 syscall.Statfs_t
+		err = rn.statfs(b, &st2)
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		scale := uint64(st2.Bsize) / uint64(st.Bsize)
+		st.Blocks += st2.Blocks * scale
+		st.Bfree += st2.Bfree * scale
+		st.Bavail += st2.Bavail * scale
+		st.Files += st2.Files
+		st.Ffree += st2.Ffree
+	}
 	out.FromStatfsT(&st)
 	return 0
 }
@@ -248,7 +348,14 @@ func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 //
 // Symlink-safe through use of Mknodat().
 func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().stats.op(statOther)
+	if errno = n.checkWritable(name); errno != 0 {
+		return
+	}
+	if errno = n.checkUserDir(ctx, name); errno != 0 {
+		return
+	}
+	b, dirfd, cName, errno := n.prepareAtSyscallBranch(name)
 	if errno != 0 {
 		return
 	}
@@ -263,8 +370,8 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	var err error
 	ctx2 := toFuseCtx(ctx)
-	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err := rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+	if !n.plainNames(name) && nametransform.IsLongContent(cName) {
+		err := n.dirBranch(b).writeLongNameAt(dirfd, cName, name)
 		if err != nil {
 			errno = fs.ToErrno(err)
 			return
@@ -289,7 +396,8 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 		return
 	}
 
-	inode = n.newChild(ctx, st, out)
+	inode = n.newChild(ctx, b, st, out)
+	n.changed(name)
 
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
@@ -303,24 +411,42 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 //
 // Symlink-safe through use of Linkat().
 func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().stats.op(statOther)
+	n2 := toNode(target)
+	if errno = n2.checkCrossPolicy("", n, name); errno != 0 {
+		return
+	}
+	if errno = n.checkUserDir(ctx, name); errno != 0 {
+		return
+	}
+	// The link must end up in the same branch as the target
+	b := n2.branch
+	if errno = n.checkSameBranch(b, name); errno != 0 {
+		return
+	}
+	dirfd, cName, errno := n.prepareAtSyscallIn(b, name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
-	n2 := toNode(target)
 	dirfd2, cName2, errno := n2.prepareAtSyscallMyself()
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd2)
 
+	// -bindpath: the contents are bound to the name of the target
+	if !n2.isPlaintext("") {
+		if errno = n.checkBindPath(dirfd2, cName2); errno != 0 {
+			return
+		}
+	}
+
 	// Handle long file name (except in PlaintextNames mode)
-	rn := n.rootNode()
 	var err error
-	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+	if !n.plainNames(name) && nametransform.IsLongContent(cName) {
+		err = n.dirBranch(b).writeLongNameAt(dirfd, cName, name)
 		if err != nil {
 			errno = fs.ToErrno(err)
 			return
@@ -344,8 +470,9 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 		errno = fs.ToErrno(err)
 		return
 	}
-	inode = n.newChild(ctx, st, out)
-	n.translateSize(dirfd, cName, &out.Attr)
+	inode = n.newChild(ctx, b, st, out)
+	n.translateSize(b, dirfd, cName, n.isPlaintext(name), &out.Attr)
+	n.changed(name)
 	return inode, 0
 }
 
@@ -353,7 +480,14 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 //
 // Symlink-safe through use of Symlinkat.
 func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().stats.op(statOther)
+	if errno = n.checkWritable(name); errno != 0 {
+		return
+	}
+	if errno = n.checkUserDir(ctx, name); errno != 0 {
+		return
+	}
+	b, dirfd, cName, errno := n.prepareAtSyscallBranch(name)
 	if errno != 0 {
 		return
 	}
@@ -365,16 +499,21 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 		ctx = nil
 	}
 
+	plainNames := n.plainNames(name)
 	cTarget := target
-	if !rn.args.PlaintextNames {
+	if !plainNames {
 		// Symlinks are encrypted like file contents (GCM) and base64-encoded
-		cTarget = rn.encryptSymlinkTarget(target)
+		if errno = b.rlockKeys(); errno != 0 {
+			return nil, errno
+		}
+		cTarget = b.encryptSymlinkTarget(target)
+		b.mu.RUnlock()
 	}
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	var err error
 	ctx2 := toFuseCtx(ctx)
-	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
-		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+	if !plainNames && nametransform.IsLongContent(cName) {
+		err = n.dirBranch(b).writeLongNameAt(dirfd, cName, name)
 		if err != nil {
 			return nil, fs.ToErrno(err)
 		}
@@ -399,7 +538,8 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 	// Report the plaintext size, not the encrypted blob size
 	st.Size = int64(len(target))
 
-	inode = n.newChild(ctx, st, out)
+	inode = n.newChild(ctx, b, st, out)
+	n.changed(name)
 	return inode, 0
 }
 
@@ -411,7 +551,7 @@ func rejectRenameFlags(flags uint32) syscall.Errno {
 	case syscallcompat.RENAME_NOREPLACE | syscallcompat.RENAME_WHITEOUT:
 		return 0
 	default:
-		tlog.Warn.Printf("rejectRenameFlags: unknown flag combination 0x%x", flags)
+		tlog.FuseFrontend.Warn.Printf("rejectRenameFlags: unknown flag combination 0x%x", flags)
 		return syscall.EINVAL
 	}
 }
@@ -421,33 +561,95 @@ func rejectRenameFlags(flags uint32) syscall.Errno {
 //
 // Symlink-safe through Renameat().
 func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) (errno syscall.Errno) {
+	n.rootNode().stats.op(statRename)
 	if errno = rejectRenameFlags(flags); errno != 0 {
 		return errno
 	}
+	n2 := toNode(newParent)
+	if errno = n.checkCrossPolicy(name, n2, newName); errno != 0 {
+		return errno
+	}
+	if errno = n2.checkUserDir(ctx, newName); errno != 0 {
+		return errno
+	}
+	errno = n.rootNode().audit(auditlog.OpRename, filepath.Join(n.Path(), name), filepath.Join(n2.Path(), newName), 0)
+	if errno != 0 {
+		return errno
+	}
 
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	b, dirfd, cName, errno := n.prepareAtSyscallBranch(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
-	n2 := toNode(newParent)
-	dirfd2, cName2, errno := n2.prepareAtSyscall(newName)
+	// Renaming never moves data to a different branch
+	if errno = n2.checkSameBranch(b, newName); errno != 0 {
+		return
+	}
+	dirfd2, cName2, errno := n2.prepareAtSyscallIn(b, newName)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd2)
 
+	// -bindpath: files are re-encrypted for their new name. Exchanging them
+	// is not supported.
+	rebind := false
+	if !n.isPlaintext(name) {
+		rebind = n.checkBindPath(dirfd, cName) != 0
+		if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+			if errno = n2.checkBindPath(dirfd2, cName2); errno != 0 {
+				return
+			}
+		}
+	}
+
+	if errno = n.checkRenameImmutable(name, dirfd, cName, n2, newName, dirfd2, cName2); errno != 0 {
+		return
+	}
+	if errno = n.rootNode().wormCheckRename(dirfd, cName, dirfd2, cName2); errno != 0 {
+		return
+	}
+	// -append_only: the target must not be replaced
+	if errno = n.rootNode().checkAppendDelete(dirfd2, cName2); errno != 0 {
+		return
+	}
+
+	// A file that is overwritten by the rename frees its quota
+	var replacedSize, replacedNlink uint64
+	if flags&syscallcompat.RENAME_EXCHANGE == 0 {
+		replacedSize, replacedNlink = n2.quotaStatAt(b, dirfd2, cName2, n2.isPlaintext(newName))
+	}
+	// The same goes for its hash tree (-merkle)
+	var replacedID []byte
+	if flags&syscallcompat.RENAME_EXCHANGE == 0 && !n2.isPlaintext(newName) {
+		replacedID = n.rootNode().merkleFileID(dirfd2, cName2)
+	}
+	defer func() {
+		if errno == 0 && replacedNlink == 1 {
+			n.rootNode().quota.release(replacedSize)
+		}
+		if errno == 0 {
+			n.rootNode().merkleForget(replacedID)
+			n.rootNode().changes.renamed(filepath.Join(n.Path(), name), filepath.Join(n2.Path(), newName),
+				flags&syscallcompat.RENAME_EXCHANGE != 0)
+		}
+	}()
+
 	// Easy case.
-	rn := n.rootNode()
-	if rn.args.PlaintextNames {
-		return fs.ToErrno(syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags)))
+	if n.plainNames(name) && n2.plainNames(newName) {
+		err := syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
+		if err == syscall.EXDEV {
+			err = n2.renameCopy(dirfd, cName, dirfd2, cName2, newName, flags)
+		}
+		return fs.ToErrno(err)
 	}
 	// Long destination file name: create .name file
 	nameFileAlreadyThere := false
 	var err error
 	if nametransform.IsLongContent(cName2) {
-		err = rn.nameTransform.WriteLongNameAt(dirfd2, cName2, newName)
+		err = n2.dirBranch(b).writeLongNameAt(dirfd2, cName2, newName)
 		// Failure to write the .name file is expected when the target path already
 		// exists. Since hashes are pretty unique, there is no need to modify the
 		// .name file in this case, and we ignore the error.
@@ -458,19 +660,27 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 		}
 	}
 	// Actual rename
-	tlog.Debug.Printf("Renameat %d/%s -> %d/%s\n", dirfd, cName, dirfd2, cName2)
-	err = syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
+	tlog.FuseFrontend.Debug.Printf("Renameat %d/%s -> %d/%s\n", dirfd, cName, dirfd2, cName2)
+	if rebind {
+		err = n.renameRebind(b, name, dirfd, cName, n2, newName, dirfd2, cName2, flags)
+	} else {
+		err = syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
+	}
 	if (flags&syscallcompat.RENAME_NOREPLACE == 0) && (err == syscall.ENOTEMPTY || err == syscall.EEXIST) {
 		// If an empty directory is overwritten we will always get an error as
 		// the "empty" directory will still contain gocryptfs.diriv.
 		// Interestingly, ext4 returns ENOTEMPTY while xfs returns EEXIST.
 		// We handle that by trying to fs.Rmdir() the target directory and trying
 		// again.
-		tlog.Debug.Printf("Rename: Handling ENOTEMPTY")
+		tlog.FuseFrontend.Debug.Printf("Rename: Handling ENOTEMPTY")
 		if n2.Rmdir(ctx, newName) == 0 {
 			err = syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
 		}
 	}
+	if err == syscall.EXDEV && !rebind {
+		// The ciphertext directories are on different filesystems
+		err = n2.renameCopy(dirfd, cName, dirfd2, cName2, newName, flags)
+	}
 	if err != nil {
 		if nametransform.IsLongContent(cName2) && !nameFileAlreadyThere {
 			// Roll back .name creation unless the .name file was already there
@@ -493,6 +703,7 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 //
 // Note: f is always set to nil by go-fuse
 func (n *Node) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall.Errno {
+	n.rootNode().stats.op(statFsync)
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
 	if errno != 0 {
 		return errno
@@ -505,5 +716,11 @@ func (n *Node) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall
 	}
 	defer syscall.Close(fd)
 
-	return fs.ToErrno(syscall.Fsync(fd))
+	rn := n.rootNode()
+	return fs.ToErrno(rn.withTimeout(func() error {
+		return rn.withRetry("Fsync", func() error {
+			rn.faults.DelayFsync()
+			return syscall.Fsync(fd)
+		})
+	}, nil))
 }
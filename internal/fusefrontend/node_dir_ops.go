@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"path/filepath"
 	"runtime"
 	"syscall"
 
@@ -12,9 +13,10 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
-	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/auditlog"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/policy"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -61,7 +63,7 @@ func (n *Node) mkdirWithIv(dirfd int, cName string, mode uint32, context *fuse.C
 		// Delete inconsistent directory (missing gocryptfs.diriv!)
 		err2 := syscallcompat.Unlinkat(dirfd, cName, unix.AT_REMOVEDIR)
 		if err2 != nil {
-			tlog.Warn.Printf("mkdirWithIv: rollback failed: %v", err2)
+			tlog.FuseFrontend.Warn.Printf("mkdirWithIv: rollback failed: %v", err2)
 		}
 	}
 	return err
@@ -71,7 +73,14 @@ func (n *Node) mkdirWithIv(dirfd int, cName string, mode uint32, context *fuse.C
 //
 // Symlink-safe through use of Mkdirat().
 func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().stats.op(statMkdir)
+	if errno := n.checkWritable(name); errno != 0 {
+		return nil, errno
+	}
+	if errno := n.checkUserDir(ctx, name); errno != 0 {
+		return nil, errno
+	}
+	b, dirfd, cName, errno := n.prepareAtSyscallBranch(name)
 	if errno != 0 {
 		return nil, errno
 	}
@@ -84,7 +93,7 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 	}
 
 	var st syscall.Stat_t
-	if rn.args.PlaintextNames {
+	if n.plainNames(name) {
 		err := syscallcompat.MkdiratUser(dirfd, cName, mode, context)
 		if err != nil {
 			return nil, fs.ToErrno(err)
@@ -97,7 +106,8 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 		st = syscallcompat.Unix2syscall(ust)
 
 		// Create child node & return
-		ch := n.newChild(ctx, &st, out)
+		ch := n.newChild(ctx, b, &st, out)
+		n.changed(name)
 		return ch, 0
 
 	}
@@ -111,7 +121,7 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 	// Handle long file name
 	if nametransform.IsLongContent(cName) {
 		// Create ".name"
-		err := rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+		err := n.dirBranch(b).writeLongNameAt(dirfd, cName, name)
 		if err != nil {
 			return nil, fs.ToErrno(err)
 		}
@@ -132,14 +142,14 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 	fd, err := syscallcompat.Openat(dirfd, cName,
 		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
-		tlog.Warn.Printf("Mkdir %q: Openat failed: %v", cName, err)
+		tlog.FuseFrontend.Warn.Printf("Mkdir %q: Openat failed: %v", cName, err)
 		return nil, fs.ToErrno(err)
 	}
 	defer syscall.Close(fd)
 
 	err = syscall.Fstat(fd, &st)
 	if err != nil {
-		tlog.Warn.Printf("Mkdir %q: Fstat failed: %v", cName, err)
+		tlog.FuseFrontend.Warn.Printf("Mkdir %q: Fstat failed: %v", cName, err)
 		return nil, fs.ToErrno(err)
 	}
 
@@ -149,13 +159,14 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 		origMode = uint32(st.Mode&^0777) | origMode
 		err = syscall.Fchmod(fd, origMode)
 		if err != nil {
-			tlog.Warn.Printf("Mkdir %q: Fchmod %#o -> %#o failed: %v", cName, mode, origMode, err)
+			tlog.FuseFrontend.Warn.Printf("Mkdir %q: Fchmod %#o -> %#o failed: %v", cName, mode, origMode, err)
 		}
 
 	}
 
 	// Create child node & return
-	ch := n.newChild(ctx, &st, out)
+	ch := n.newChild(ctx, b, &st, out)
+	n.changed(name)
 	return ch, 0
 }
 
@@ -164,14 +175,61 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 // This function is symlink-safe through use of openBackingDir() and
 // ReadDirIVAt().
 func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	parentDirFd, cDirName, errno := n.prepareAtSyscallMyself()
+	n.rootNode().stats.op(statReaddir)
+	rn := n.rootNode()
+	if !rn.isUnion() {
+		plain, errno := n.readdirIn(rn.branch)
+		if errno != 0 {
+			if rn.salvage == nil {
+				return nil, errno
+			}
+			// "-rescue": show the directory as empty and go on
+			rn.salvage.add(n.Path(), "directory cannot be read, skipped: %v", errno)
+			plain = nil
+		}
+		return fs.NewListDirStream(n.filterUserDir(ctx, plain)), 0
+	}
+	// Union mount: merge the directory contents of all branches. If a name
+	// exists in several branches, the first one wins, like in Lookup().
+	var merged []fuse.DirEntry
+	seen := make(map[string]bool)
+	for _, b := range n.dirBranches() {
+		plain, errno := n.readdirIn(b)
+		if errno != 0 {
+			return nil, errno
+		}
+		for _, e := range plain {
+			if seen[e.Name] {
+				continue
+			}
+			seen[e.Name] = true
+			merged = append(merged, e)
+		}
+	}
+	return fs.NewListDirStream(n.filterUserDir(ctx, merged)), 0
+}
+
+// readdirIn reads and decrypts the directory contents of n in branch "b".
+func (n *Node) readdirIn(b *branch) ([]fuse.DirEntry, syscall.Errno) {
+	parentDirFd, cDirName, errno := n.prepareAtSyscallMyselfIn(b)
 	if errno != 0 {
 		return nil, errno
 	}
 	defer syscall.Close(parentDirFd)
+	// The names are encrypted with the key of the subvolume n is in, if any
+	b = n.dirBranch(b)
+	if errno = b.rlockKeys(); errno != 0 {
+		return nil, errno
+	}
+	defer b.mu.RUnlock()
 
 	// Read ciphertext directory
-	fd, err := syscallcompat.Openat(parentDirFd, cDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	flags := syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_NOFOLLOW
+	fd, err := syscallcompat.Openat(parentDirFd, cDirName, flags|n.rootNode().noatimeFlag(), 0)
+	if err == syscall.EPERM {
+		// O_NOATIME is only allowed for the owner of the directory
+		fd, err = syscallcompat.Openat(parentDirFd, cDirName, flags, 0)
+	}
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -180,17 +238,22 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
-	// Get DirIV (stays nil if PlaintextNames is used)
+	// Get DirIV (stays nil if PlaintextNames is used or if we are in a
+	// plaintext subtree)
 	var cachedIV []byte
 	rn := n.rootNode()
-	if !rn.args.PlaintextNames {
+	plainDir := rn.args.PlaintextNames || n.isPlaintext("")
+	if !plainDir {
 		// Read the DirIV from disk
-		cachedIV, err = rn.nameTransform.ReadDirIVAt(fd)
+		cachedIV, err = b.nameTransform.ReadDirIVAt(fd)
 		if err != nil {
-			tlog.Warn.Printf("OpenDir %q: could not read %s: %v", cDirName, nametransform.DirIVFilename, err)
+			tlog.FuseFrontend.Warn.Printf("OpenDir %q: could not read %s: %v", cDirName, nametransform.DirIVFilename, err)
 			return nil, syscall.EIO
 		}
 	}
+	if b == rn.branch {
+		rn.notify.watch(n, fd, cachedIV, plainDir)
+	}
 	// Decrypted directory entries
 	var plain []fuse.DirEntry
 	// Add "." and ".."
@@ -198,29 +261,47 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
 		cName := cipherEntries[i].Name
-		if n.IsRoot() && cName == configfile.ConfDefaultName {
-			// silently ignore "gocryptfs.conf" in the top level dir
+		if n.IsRoot() && IsReservedName(cName) {
+			// silently ignore "gocryptfs.conf" etc in the top level dir
 			continue
 		}
-		if rn.args.PlaintextNames {
-			plain = append(plain, cipherEntries[i])
+		if plainDir || n.isPlaintext(cName) {
+			// In an encrypted directory, entries that are the root of a
+			// plaintext subtree are stored unencrypted as well.
+			if !n.isExcluded(cName) {
+				plain = append(plain, cipherEntries[i])
+			}
 			continue
 		}
 		if !rn.args.DeterministicNames && cName == nametransform.DirIVFilename {
 			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
 			continue
 		}
+		if isRenameTmp(cName) {
+			// copy in progress, see renameCopyAt()
+			continue
+		}
 		// Handle long file name
 		isLong := nametransform.LongNameNone
 		if rn.args.LongNames {
 			isLong = nametransform.NameType(cName)
 		}
 		if isLong == nametransform.LongNameContent {
-			cNameLong, err := nametransform.ReadLongNameAt(fd, cName)
+			cNameLong, err := b.readLongName(fd, cName)
 			if err != nil {
-				tlog.Warn.Printf("OpenDir %q: invalid entry %q: Could not read .name: %v",
+				tlog.FuseFrontend.Warn.Printf("OpenDir %q: invalid entry %q: Could not read .name: %v",
 					cDirName, cName, err)
 				rn.reportMitigatedCorruption(cName)
+				rn.salvage.add(n.Path(), "invalid entry %q skipped", cName)
+				continue
+			}
+			// Lookup() would not find the entry under this name. Happens when
+			// the ".name" file of another hard link has been copied here.
+			if b.nameTransform.HashLongName(cNameLong) != cName {
+				tlog.FuseFrontend.Warn.Printf("OpenDir %q: invalid entry %q: .name belongs to a different file",
+					cDirName, cName)
+				rn.reportMitigatedCorruption(cName)
+				rn.salvage.add(n.Path(), "invalid entry %q skipped", cName)
 				continue
 			}
 			cName = cNameLong
@@ -228,11 +309,17 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 			// ignore "gocryptfs.longname.*.name"
 			continue
 		}
-		name, err := rn.nameTransform.DecryptName(cName, cachedIV)
+		name, err := b.nameTransform.DecryptName(cName, cachedIV)
 		if err != nil {
-			tlog.Warn.Printf("OpenDir %q: invalid entry %q: %v",
+			tlog.FuseFrontend.Warn.Printf("OpenDir %q: invalid entry %q: %v",
 				cDirName, cName, err)
 			rn.reportMitigatedCorruption(cName)
+			rn.salvage.add(n.Path(), "invalid entry %q skipped", cName)
+			continue
+		}
+		// Hide excluded entries, and encrypted entries that are shadowed by
+		// a plaintext subtree of the same name
+		if f := n.policyFlags(name); f&(policy.Exclude|policy.Plaintext) != 0 {
 			continue
 		}
 		// Override the ciphertext name with the plaintext name but reuse the rest
@@ -241,20 +328,52 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 		plain = append(plain, cipherEntries[i])
 	}
 
-	return fs.NewListDirStream(plain), 0
+	return plain, 0
 }
 
 // Rmdir - FUSE call.
 //
 // Symlink-safe through Unlinkat() + AT_REMOVEDIR.
 func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
+	n.rootNode().stats.op(statRmdir)
+	if errno := n.checkWritable(name); errno != 0 {
+		return errno
+	}
+	rn := n.rootNode()
+	if errno := rn.audit(auditlog.OpRmdir, filepath.Join(n.Path(), name), "", 0); errno != 0 {
+		return errno
+	}
+	defer func() {
+		if code == 0 {
+			n.deleted(name)
+		}
+	}()
+	if !rn.isUnion() {
+		return n.rmdirIn(rn.branch, name)
+	}
+	// Remove the directory from all branches, like Unlink() does. Each copy
+	// must be empty, so a failure leaves the remaining copies intact.
+	code = syscall.ENOENT
+	for _, b := range rn.branches {
+		errno := n.rmdirIn(b, name)
+		if errno == 0 {
+			code = 0
+		} else if errno != syscall.ENOENT {
+			return errno
+		}
+	}
+	return code
+}
+
+// rmdirIn removes the child directory "name" from branch "b".
+func (n *Node) rmdirIn(b *branch, name string) (code syscall.Errno) {
 	rn := n.rootNode()
-	parentDirFd, cName, errno := n.prepareAtSyscall(name)
+	parentDirFd, cName, errno := n.prepareAtSyscallIn(b, name)
 	if errno != 0 {
 		return errno
 	}
 	defer syscall.Close(parentDirFd)
-	if rn.args.PlaintextNames {
+	if n.plainNames(name) {
 		// Unlinkat with AT_REMOVEDIR is equivalent to Rmdir
 		err := unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
 		return fs.ToErrno(err)
@@ -279,13 +398,13 @@ func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
 			return fs.ToErrno(err)
 		}
 		if st.Mode&0700 != 0700 {
-			tlog.Debug.Printf("Rmdir: permWorkaround")
+			tlog.FuseFrontend.Debug.Printf("Rmdir: permWorkaround")
 			permWorkaround = true
 			// This cast is needed on Darwin, where st.Mode is uint16.
 			origMode = uint32(st.Mode)
 			err = syscallcompat.FchmodatNofollow(parentDirFd, cName, origMode|0700)
 			if err != nil {
-				tlog.Debug.Printf("Rmdir: permWorkaround: chmod failed: %v", err)
+				tlog.FuseFrontend.Debug.Printf("Rmdir: permWorkaround: chmod failed: %v", err)
 				return fs.ToErrno(err)
 			}
 		}
@@ -293,7 +412,7 @@ func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
 	dirfd, err := syscallcompat.Openat(parentDirFd, cName,
 		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
-		tlog.Debug.Printf("Rmdir: Open: %v", err)
+		tlog.FuseFrontend.Debug.Printf("Rmdir: Open: %v", err)
 		return fs.ToErrno(err)
 	}
 	defer syscall.Close(dirfd)
@@ -304,7 +423,7 @@ func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
 			if code != 0 {
 				err = unix.Fchmod(dirfd, origMode)
 				if err != nil {
-					tlog.Warn.Printf("Rmdir: permWorkaround: rollback failed: %v", err)
+					tlog.FuseFrontend.Warn.Printf("Rmdir: permWorkaround: rollback failed: %v", err)
 				}
 			}
 		}()
@@ -314,12 +433,12 @@ retry:
 	children, err := syscallcompat.Getdents(dirfd)
 	if err == io.EOF {
 		// The directory is empty
-		tlog.Warn.Printf("Rmdir: %q: %s is missing", cName, nametransform.DirIVFilename)
+		tlog.FuseFrontend.Warn.Printf("Rmdir: %q: %s is missing", cName, nametransform.DirIVFilename)
 		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
 		return fs.ToErrno(err)
 	}
 	if err != nil {
-		tlog.Warn.Printf("Rmdir: Getdents: %v", err)
+		tlog.FuseFrontend.Warn.Printf("Rmdir: Getdents: %v", err)
 		return fs.ToErrno(err)
 	}
 	// MacOS sprinkles .DS_Store files everywhere. This is hard to avoid for
@@ -327,10 +446,10 @@ retry:
 	if runtime.GOOS == "darwin" && len(children) <= 2 && haveDsstore(children) {
 		err = unix.Unlinkat(dirfd, dsStoreName, 0)
 		if err != nil {
-			tlog.Warn.Printf("Rmdir: failed to delete blocking file %q: %v", dsStoreName, err)
+			tlog.FuseFrontend.Warn.Printf("Rmdir: failed to delete blocking file %q: %v", dsStoreName, err)
 			return fs.ToErrno(err)
 		}
-		tlog.Warn.Printf("Rmdir: had to delete blocking file %q", dsStoreName)
+		tlog.FuseFrontend.Warn.Printf("Rmdir: had to delete blocking file %q", dsStoreName)
 		goto retry
 	}
 	// If the directory is not empty besides gocryptfs.diriv, do not even
@@ -340,7 +459,7 @@ retry:
 	}
 	// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ"
 	tmpName := fmt.Sprintf("%s.rmdir.%d", nametransform.DirIVFilename, cryptocore.RandUint64())
-	tlog.Debug.Printf("Rmdir: Renaming %s to %s", nametransform.DirIVFilename, tmpName)
+	tlog.FuseFrontend.Debug.Printf("Rmdir: Renaming %s to %s", nametransform.DirIVFilename, tmpName)
 	// The directory is in an inconsistent state between rename and rmdir.
 	// Protect against concurrent readers.
 	rn.dirIVLock.Lock()
@@ -348,7 +467,7 @@ retry:
 	err = syscallcompat.Renameat(dirfd, nametransform.DirIVFilename,
 		parentDirFd, tmpName)
 	if err != nil {
-		tlog.Warn.Printf("Rmdir: Renaming %s to %s failed: %v",
+		tlog.FuseFrontend.Warn.Printf("Rmdir: Renaming %s to %s failed: %v",
 			nametransform.DirIVFilename, tmpName, err)
 		return fs.ToErrno(err)
 	}
@@ -360,14 +479,14 @@ retry:
 		err2 := syscallcompat.Renameat(parentDirFd, tmpName,
 			dirfd, nametransform.DirIVFilename)
 		if err2 != nil {
-			tlog.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
+			tlog.FuseFrontend.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
 		}
 		return fs.ToErrno(err)
 	}
 	// Delete "gocryptfs.diriv.rmdir.XYZ"
 	err = syscallcompat.Unlinkat(parentDirFd, tmpName, 0)
 	if err != nil {
-		tlog.Warn.Printf("Rmdir: Could not clean up %s: %v", tmpName, err)
+		tlog.FuseFrontend.Warn.Printf("Rmdir: Could not clean up %s: %v", tmpName, err)
 	}
 	// Delete .name file
 	if nametransform.IsLongContent(cName) {
@@ -35,20 +35,26 @@ func toNode(op fs.InodeEmbedder) *Node {
 	return op.(*Node)
 }
 
-// readlink reads and decrypts a symlink. Used by Readlink, Getattr, Lookup.
-func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errno) {
+// readlink reads and decrypts a symlink in branch "b". Used by Readlink,
+// Getattr, Lookup.
+// Pass plaintext=true if the symlink is in a "plaintext" policy subtree.
+func (n *Node) readlink(b *branch, dirfd int, cName string, plaintext bool) (out []byte, errno syscall.Errno) {
 	cTarget, err := syscallcompat.Readlinkat(dirfd, cName)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
 	rn := n.rootNode()
-	if rn.args.PlaintextNames {
+	if rn.args.PlaintextNames || plaintext {
 		return []byte(cTarget), 0
 	}
 	// Symlinks are encrypted like file contents (GCM) and base64-encoded
-	target, err := rn.decryptSymlinkTarget(cTarget)
+	if errno = b.rlockKeys(); errno != 0 {
+		return nil, errno
+	}
+	target, err := b.decryptSymlinkTarget(cTarget)
+	b.mu.RUnlock()
 	if err != nil {
-		tlog.Warn.Printf("Readlink %q: decrypting target failed: %v", cName, err)
+		tlog.FuseFrontend.Warn.Printf("Readlink %q: decrypting target failed: %v", cName, err)
 		return nil, syscall.EIO
 	}
 	return []byte(target), 0
@@ -57,13 +63,19 @@ func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errn
 // translateSize translates the ciphertext size in `out` into plaintext size.
 // Handles regular files & symlinks (and finds out what is what by looking at
 // `out.Mode`).
-func (n *Node) translateSize(dirfd int, cName string, out *fuse.Attr) {
+// Files and symlinks in "plaintext" policy subtrees (plaintext=true) are
+// left alone.
+func (n *Node) translateSize(b *branch, dirfd int, cName string, plaintext bool, out *fuse.Attr) {
+	if plaintext {
+		return
+	}
 	if out.IsRegular() {
-		rn := n.rootNode()
-		out.Size = rn.contentEnc.CipherSizeToPlainSize(out.Size)
+		if _, ce, errno := b.keys(); errno == 0 {
+			out.Size = ce.CipherSizeToPlainSize(out.Size)
+		}
 	} else if out.IsSymlink() {
 		// read and decrypt target
-		target, _ := n.readlink(dirfd, cName)
+		target, _ := n.readlink(b, dirfd, cName, false)
 		out.Size = uint64(len(target))
 	}
 }
@@ -78,10 +90,10 @@ func (n *Node) rootNode() *RootNode {
 	return n.Root().Operations().(*RootNode)
 }
 
-// newChild attaches a new child inode to n.
+// newChild attaches a new child inode, found in branch `b`, to n.
 // The passed-in `st` will be modified to get a unique inode number
 // (or, in `-sharedstorage` mode, the inode number will be set to zero).
-func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.EntryOut) *fs.Inode {
+func (n *Node) newChild(ctx context.Context, b *branch, st *syscall.Stat_t, out *fuse.EntryOut) *fs.Inode {
 	rn := n.rootNode()
 	// Get stable inode number based on underlying (device,ino) pair
 	rn.inoMap.TranslateStat(st)
@@ -100,6 +112,6 @@ func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.Entry
 		Gen:  gen,
 		Ino:  st.Ino,
 	}
-	node := &Node{}
+	node := &Node{branch: b}
 	return n.NewInode(ctx, node, id)
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/auditlog"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -16,6 +17,13 @@ import (
 //
 // Symlink-safe through Openat().
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	n.rootNode().stats.op(statOpen)
+	if errno = n.rootNode().checkShutdown(); errno != 0 {
+		return
+	}
+	if errno = n.checkOpenFlags(flags); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
 	if errno != 0 {
 		return
@@ -32,14 +40,39 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		fuseFlags = fuse.FOPEN_KEEP_CACHE
 	}
 
+	binding, errno := n.pathBinding(n.branch, dirfd, cName, "")
+	if errno != 0 {
+		return
+	}
+
+	// O_TRUNC frees the quota of the old content
+	var truncatedSize uint64
+	if newFlags&syscall.O_TRUNC != 0 {
+		if errno = rn.audit(auditlog.OpTruncate, n.Path(), "", 0); errno != 0 {
+			return
+		}
+		truncatedSize, _ = n.quotaStatAt(n.branch, dirfd, cName, n.isPlaintext(""))
+	}
+	// Immutable files, and sealed files on -worm filesystems, cannot be
+	// opened for writing, and -append_only forbids O_TRUNC. The checks need
+	// the open file, so O_TRUNC is applied afterwards.
+	forWrite := int(flags)&syscall.O_ACCMODE != syscall.O_RDONLY || newFlags&syscall.O_TRUNC != 0
+	truncate := newFlags&syscall.O_TRUNC != 0
+	newFlags &^= syscall.O_TRUNC
+
 	// Open backing file
 	fd, err := syscallcompat.Openat(dirfd, cName, newFlags, 0)
 	// Handle a few specific errors
+	if err == syscall.EPERM && newFlags&syscallcompat.O_NOATIME != 0 {
+		// O_NOATIME is only allowed for the owner of the file
+		newFlags &^= syscallcompat.O_NOATIME
+		fd, err = syscallcompat.Openat(dirfd, cName, newFlags, 0)
+	}
 	if err != nil {
 		if err == syscall.EMFILE {
 			var lim syscall.Rlimit
 			syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
-			tlog.Warn.Printf("Open %q: too many open files. Current \"ulimit -n\": %d", cName, lim.Cur)
+			tlog.FuseFrontend.Warn.Printf("Open %q: too many open files. Current \"ulimit -n\": %d", cName, lim.Cur)
 		}
 		if err == syscall.EACCES && (int(flags)&syscall.O_ACCMODE) == syscall.O_WRONLY {
 			fd, err = rn.openWriteOnlyFile(dirfd, cName, newFlags)
@@ -50,20 +83,71 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		errno = fs.ToErrno(err)
 		return
 	}
-	fh, _, errno = NewFile(fd, cName, rn)
-	return fh, fuseFlags, errno
+	if forWrite {
+		if !n.isPlaintext("") && rn.isImmutableFd(fd) {
+			syscall.Close(fd)
+			return nil, 0, syscall.EPERM
+		}
+		qi, errno := rn.wormOpen(fd)
+		if errno != 0 {
+			syscall.Close(fd)
+			return nil, 0, errno
+		}
+		if truncate {
+			if errno = rn.checkAppendTruncFd(fd); errno != 0 {
+				rn.worm.closed(qi)
+				syscall.Close(fd)
+				return nil, 0, errno
+			}
+			if err = syscall.Ftruncate(fd, 0); err != nil {
+				rn.worm.closed(qi)
+				syscall.Close(fd)
+				return nil, 0, fs.ToErrno(err)
+			}
+		}
+	}
+	rn.quota.release(truncatedSize)
+	f, _, errno := NewFile(fd, cName, rn)
+	if errno != 0 {
+		return
+	}
+	if errno = n.branch.addFile(f); errno != 0 {
+		f.Release(ctx)
+		return nil, 0, errno
+	}
+	f.plaintext = n.isPlaintext("")
+	f.node = n
+	f.pathBinding = binding
+	f.wormWriter = forWrite && rn.worm != nil
+	rn.stats.addFile(f)
+	return f, fuseFlags, 0
 }
 
 // Create - FUSE call. Creates a new file.
 //
 // Symlink-safe through the use of Openat().
 func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
+	n.rootNode().stats.op(statCreate)
+	if errno = n.rootNode().checkShutdown(); errno != 0 {
+		return
+	}
+	if errno = n.checkWritable(name); errno != 0 {
+		return
+	}
+	if errno = n.checkUserDir(ctx, name); errno != 0 {
+		return
+	}
+	b, dirfd, cName, errno := n.prepareAtSyscallBranch(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
+	binding, errno := n.pathBinding(b, dirfd, cName, name)
+	if errno != 0 {
+		return
+	}
+
 	var err error
 	fd := -1
 	// Make sure context is nil if we don't want to preserve the owner
@@ -74,9 +158,9 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 	newFlags := rn.mangleOpenFlags(flags)
 	// Handle long file name
 	ctx2 := toFuseCtx(ctx)
-	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
+	if !n.plainNames(name) && nametransform.IsLongContent(cName) {
 		// Create ".name"
-		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
+		err = n.dirBranch(b).writeLongNameAt(dirfd, cName, name)
 		if err != nil {
 			return nil, nil, 0, fs.ToErrno(err)
 		}
@@ -94,21 +178,32 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 		if err == syscall.EMFILE {
 			var lim syscall.Rlimit
 			syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
-			tlog.Warn.Printf("Create %q: too many open files. Current \"ulimit -n\": %d", cName, lim.Cur)
+			tlog.FuseFrontend.Warn.Printf("Create %q: too many open files. Current \"ulimit -n\": %d", cName, lim.Cur)
 		}
 		return nil, nil, 0, fs.ToErrno(err)
 	}
 
-	fh, st, errno := NewFile(fd, cName, rn)
+	f, st, errno := NewFile(fd, cName, rn)
 	if errno != 0 {
 		return
 	}
+	if errno = b.addFile(f); errno != 0 {
+		f.Release(ctx)
+		return nil, nil, 0, errno
+	}
+	f.plaintext = n.isPlaintext(name)
+	f.pathBinding = binding
+	rn.worm.created(f.qIno)
+	f.wormWriter = rn.worm != nil
 
-	inode = n.newChild(ctx, st, out)
+	inode = n.newChild(ctx, b, st, out)
+	f.node = toNode(inode.Operations())
+	rn.stats.addFile(f)
+	n.changed(name)
 
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
 	}
 
-	return inode, fh, fuseFlags, errno
+	return inode, f, fuseFlags, errno
 }
@@ -0,0 +1,141 @@
+package fusefrontend
+
+// Per-directory policy (-policy) helpers
+
+import (
+	"context"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/policy"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// policyFlags returns the policy flags that apply to the child "name" of
+// directory n. Pass name="" to get the flags of n itself.
+func (n *Node) policyFlags(name string) policy.Flags {
+	p := n.rootNode().args.Policy
+	if p == nil {
+		return 0
+	}
+	return p.Match(filepath.Join(n.Path(), name))
+}
+
+// isPlaintext returns true if the child "name" (or n itself if name="") is
+// in a "plaintext" subtree. Its name, content and symlink target are stored
+// unencrypted. Directories in plaintext subtrees have no gocryptfs.diriv.
+func (n *Node) isPlaintext(name string) bool {
+	return n.policyFlags(name)&policy.Plaintext != 0
+}
+
+// isExcluded returns true if the child "name" is hidden by an "exclude" rule.
+func (n *Node) isExcluded(name string) bool {
+	return n.policyFlags(name)&policy.Exclude != 0
+}
+
+// plainNames returns true if the name of the child "name" is not encrypted,
+// either globally through -plaintextnames or through a "plaintext" rule.
+func (n *Node) plainNames(name string) bool {
+	return n.rootNode().args.PlaintextNames || n.isPlaintext(name)
+}
+
+// checkWritable returns EROFS if the child "name" (or n itself if name="")
+// is in a "readonly" subtree, or if the filesystem has been switched to
+// read-only.
+func (n *Node) checkWritable(name string) syscall.Errno {
+	if errno := n.rootNode().checkReadOnly(); errno != 0 {
+		return errno
+	}
+	if n.policyFlags(name)&policy.ReadOnly != 0 {
+		tlog.FuseFrontend.Debug.Printf("checkWritable: %q is read-only by policy", filepath.Join(n.Path(), name))
+		return syscall.EROFS
+	}
+	return 0
+}
+
+// checkOpenFlags returns EROFS if n is in a "readonly" subtree and "flags"
+// would allow modifying it.
+func (n *Node) checkOpenFlags(flags uint32) syscall.Errno {
+	if int(flags)&syscall.O_ACCMODE == syscall.O_RDONLY && int(flags)&syscall.O_TRUNC == 0 {
+		return 0
+	}
+	return n.checkWritable("")
+}
+
+// checkCrossPolicy returns EXDEV if moving or linking the child "name" of n to
+// the child "newName" of n2 would cross the boundary of a "plaintext" subtree
+// or of a subvolume, as that would require re-encrypting the data. It returns
+// EROFS if either side is read-only.
+func (n *Node) checkCrossPolicy(name string, n2 *Node, newName string) syscall.Errno {
+	if errno := n.checkWritable(name); errno != 0 {
+		return errno
+	}
+	if errno := n2.checkWritable(newName); errno != 0 {
+		return errno
+	}
+	if n.isPlaintext(name) != n2.isPlaintext(newName) {
+		return syscall.EXDEV
+	}
+	return n.checkCrossSubvolume(name, n2, newName)
+}
+
+// isUserDir returns true if n is the directory of a "userdir" rule
+func (n *Node) isUserDir() bool {
+	p := n.rootNode().args.Policy
+	return p.HasUserDirs() && p.IsUserDir(n.Path())
+}
+
+// userDirHidden returns true if n is a "userdir" directory and the child
+// "name" belongs to somebody else than the caller. Root sees everything.
+func (n *Node) userDirHidden(ctx context.Context, name string) bool {
+	if !n.isUserDir() {
+		return false
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok || caller.Uid == 0 {
+		return false
+	}
+	return name != strconv.Itoa(int(caller.Uid)) && name != n.rootNode().userName(caller.Uid)
+}
+
+// filterUserDir removes the entries that userDirHidden() hides from
+// "entries"
+func (n *Node) filterUserDir(ctx context.Context, entries []fuse.DirEntry) []fuse.DirEntry {
+	if !n.isUserDir() {
+		return entries
+	}
+	var filtered []fuse.DirEntry
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." || !n.userDirHidden(ctx, e.Name) {
+			filtered = append(filtered, e)
+		}
+	}
+	return filtered
+}
+
+// checkUserDir returns EACCES if the caller may not create the child "name"
+// because it would belong to somebody else.
+func (n *Node) checkUserDir(ctx context.Context, name string) syscall.Errno {
+	if n.userDirHidden(ctx, name) {
+		return syscall.EACCES
+	}
+	return 0
+}
+
+// userName returns the name of the user "uid", or the empty string if it
+// has none.
+func (rn *RootNode) userName(uid uint32) string {
+	if v, ok := rn.userNames.Load(uid); ok {
+		return v.(string)
+	}
+	var name string
+	if u, err := user.LookupId(strconv.Itoa(int(uid))); err == nil {
+		name = u.Username
+	}
+	rn.userNames.Store(uid, name)
+	return name
+}
@@ -15,37 +15,77 @@ import (
 // with the "___at" family of system calls (openat, fstatat, unlinkat...) to
 // access the backing encrypted child file.
 func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno syscall.Errno) {
+	_, dirfd, cName, errno = n.prepareAtSyscallBranch(child)
+	return
+}
+
+// prepareAtSyscallBranch is like prepareAtSyscall, but additionally returns
+// the branch the child lives in (or would be created in). Callers that
+// encrypt or decrypt anything must use the key of that branch.
+func (n *Node) prepareAtSyscallBranch(child string) (b *branch, dirfd int, cName string, errno syscall.Errno) {
 	if child == "" {
-		tlog.Warn.Printf("BUG: prepareAtSyscall: child=%q, should have called prepareAtSyscallMyself", child)
-		return n.prepareAtSyscallMyself()
+		tlog.FuseFrontend.Warn.Printf("BUG: prepareAtSyscall: child=%q, should have called prepareAtSyscallMyself", child)
+		dirfd, cName, errno = n.prepareAtSyscallMyself()
+		return n.branch, dirfd, cName, errno
 	}
+	b = n.childBranch(child)
+	if b.isLocked() {
+		// The child is the directory of a locked subvolume
+		return nil, -1, "", syscall.EACCES
+	}
+	dirfd, cName, errno = n.prepareAtSyscallIn(b, child)
+	return
+}
 
+// prepareAtSyscallIn is like prepareAtSyscall, but accesses the child in
+// branch "b".
+func (n *Node) prepareAtSyscallIn(b *branch, child string) (dirfd int, cName string, errno syscall.Errno) {
 	rn := n.rootNode()
 
 	// All filesystem operations go through here, so this is a good place
-	// to reset the idle marker.
+	// to reset the idle marker, and to reject them while locked.
 	atomic.StoreUint32(&rn.IsIdle, 0)
+	rn.touch()
+	if errno = rn.checkLocked(); errno != 0 {
+		return -1, "", errno
+	}
 
 	if n.IsRoot() && rn.isFiltered(child) {
 		return -1, "", syscall.EPERM
 	}
+	if n.isExcluded(child) {
+		return -1, "", syscall.EPERM
+	}
+	plainNames := n.plainNames(child)
+	// The name is encrypted with the key of the directory, which differs
+	// from "b" for the directory of a subvolume
+	nb := n.dirBranch(b)
+	nt, _, errno := nb.keys()
+	if errno != 0 {
+		return -1, "", errno
+	}
 
 	var encryptName func(int, string, []byte) (string, error)
-	if !rn.args.PlaintextNames {
+	if !plainNames {
 		encryptName = func(dirfd int, child string, iv []byte) (cName string, err error) {
+			if errno := nb.rlockKeys(); errno != 0 {
+				return "", errno
+			}
+			defer nb.mu.RUnlock()
 			// Badname allowed, try to determine filenames
-			if rn.nameTransform.HaveBadnamePatterns() {
-				return rn.nameTransform.EncryptAndHashBadName(child, iv, dirfd)
+			if nb.nameTransform.HaveBadnamePatterns() {
+				return nb.nameTransform.EncryptAndHashBadName(child, iv, dirfd)
 			}
-			return rn.nameTransform.EncryptAndHashName(child, iv)
+			return nb.nameTransform.EncryptAndHashName(child, iv)
 		}
 	}
 
 	// Cache lookup
 	var iv []byte
-	dirfd, iv = rn.dirCache.Lookup(n)
+	dirfd, iv = nb.dirCache.Lookup(n)
+	rn.stats.hit(dirfd > 0, &rn.stats.dirCacheHits, &rn.stats.dirCacheMisses)
 	if dirfd > 0 {
-		if rn.args.PlaintextNames {
+		if plainNames {
 			return dirfd, child, 0
 		}
 		var err error
@@ -58,29 +98,43 @@ func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno sy
 	}
 
 	// Slowpath: Open ourselves & read diriv
-	parentDirfd, myCName, errno := n.prepareAtSyscallMyself()
+	parentDirfd, myCName, errno := n.prepareAtSyscallMyselfIn(b)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(parentDirfd)
 
-	dirfd, err := syscallcompat.Openat(parentDirfd, myCName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	// Directories in plaintext subtrees have no diriv
+	readIV := !rn.args.PlaintextNames && !n.isPlaintext("")
+	var fd int
+	var fdIV []byte
+	err := rn.withTimeout(func() (err error) {
+		fd, err = syscallcompat.Openat(parentDirfd, myCName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		if err != nil {
+			return err
+		}
+		if readIV {
+			fdIV, err = nt.ReadDirIVAt(fd)
+			if err != nil {
+				syscall.Close(fd)
+				return err
+			}
+		}
+		return nil
+	}, func(err error) {
+		if err == nil {
+			syscall.Close(fd)
+		}
+	})
 	if err != nil {
 		return -1, "", fs.ToErrno(err)
 	}
+	dirfd, iv = fd, fdIV
 
 	// Cache store
-	if !rn.args.PlaintextNames {
-		var err error
-		iv, err = rn.nameTransform.ReadDirIVAt(dirfd)
-		if err != nil {
-			syscall.Close(dirfd)
-			return -1, "", fs.ToErrno(err)
-		}
-	}
-	rn.dirCache.Store(n, dirfd, iv)
+	nb.dirCache.Store(n, dirfd, iv)
 
-	if rn.args.PlaintextNames {
+	if plainNames {
 		return dirfd, child, 0
 	}
 
@@ -94,18 +148,33 @@ func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno sy
 }
 
 func (n *Node) prepareAtSyscallMyself() (dirfd int, cName string, errno syscall.Errno) {
+	return n.prepareAtSyscallMyselfIn(n.branch)
+}
+
+// prepareAtSyscallMyselfIn is like prepareAtSyscallMyself, but accesses the
+// node in branch "b".
+func (n *Node) prepareAtSyscallMyselfIn(b *branch) (dirfd int, cName string, errno syscall.Errno) {
 	dirfd = -1
+	n.rootNode().touch()
+	if errno = n.rootNode().checkLocked(); errno != 0 {
+		return
+	}
 
 	// Handle root node
 	if n.IsRoot() {
-		var err error
-		rn := n.rootNode()
-		// Open cipherdir (following symlinks)
-		dirfd, err = syscallcompat.Open(rn.args.Cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		var fd int
+		err := n.rootNode().withTimeout(func() (err error) {
+			fd, err = b.openBeneath("", syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+			return err
+		}, func(err error) {
+			if err == nil {
+				syscall.Close(fd)
+			}
+		})
 		if err != nil {
 			return -1, "", fs.ToErrno(err)
 		}
-		return dirfd, ".", 0
+		return fd, ".", 0
 	}
 
 	// Otherwise convert to prepareAtSyscall of parent node
@@ -115,5 +184,21 @@ func (n *Node) prepareAtSyscallMyself() (dirfd int, cName string, errno syscall.
 		return
 	}
 	parent := toNode(p1.Operations())
-	return parent.prepareAtSyscall(myName)
+	return parent.prepareAtSyscallIn(b, myName)
+}
+
+// openBeneath opens the ciphertext path "rel", relative to CIPHERDIR of
+// branch b, with syscallcompat.OpenatNofollow. Symlinks in "rel" are never
+// followed. Use it for the paths that do not come from the node tree.
+func (b *branch) openBeneath(rel string, flags int, mode uint32) (int, error) {
+	if b.rootFd >= 0 {
+		return syscallcompat.OpenatNofollow(b.rootFd, rel, flags, mode)
+	}
+	// Open cipherdir (following symlinks)
+	dirfd, err := syscallcompat.Open(b.cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(dirfd)
+	return syscallcompat.OpenatNofollow(dirfd, rel, flags, mode)
 }
@@ -30,10 +30,21 @@ func isAcl(attr string) bool {
 	return attr == "system.posix_acl_access" || attr == "system.posix_acl_default"
 }
 
+// The SELinux label of the backing file. The kernel and LSM-aware tools like
+// restorecon need to see it in plaintext.
+var xattrSELinux = "security.selinux"
+
+// isPassthrough returns true if the attribute is stored on the backing file
+// without encryption
+func isPassthrough(attr string) bool {
+	return isAcl(attr) || attr == xattrSELinux
+}
+
 // GetXAttr - FUSE call. Reads the value of extended attribute "attr".
 //
 // This function is symlink-safe through Fgetxattr.
 func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	n.rootNode().stats.op(statXattr)
 	rn := n.rootNode()
 	// If we are not mounted with -suid, reading the capability xattr does not
 	// make a lot of sense, so reject the request and gain a massive speedup.
@@ -45,16 +56,27 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 		return 0, syscall.EOPNOTSUPP
 	}
 	var data []byte
-	// ACLs are passed through without encryption
-	if isAcl(attr) {
+	if attr == xattrImmutable {
+		var errno syscall.Errno
+		data, errno = n.getImmutable()
+		if errno != 0 {
+			return minus1, errno
+		}
+	} else if isPassthrough(attr) {
+		// ACLs and SELinux labels are passed through without encryption
 		var errno syscall.Errno
 		data, errno = n.getXAttr(attr)
 		if errno != 0 {
 			return minus1, errno
 		}
 	} else {
-		// encrypted user xattr
-		cAttr, err := rn.encryptXattrName(attr)
+		// encrypted user xattr. The read lock on the keys must not be held
+		// during getXAttr(), which takes it again.
+		if errno := n.branch.rlockKeys(); errno != 0 {
+			return minus1, errno
+		}
+		cAttr, err := n.branch.encryptXattrName(attr)
+		n.branch.mu.RUnlock()
 		if err != nil {
 			return minus1, syscall.EIO
 		}
@@ -62,9 +84,13 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 		if errno != 0 {
 			return 0, errno
 		}
-		data, err = rn.decryptXattrValue(cData)
+		if errno = n.branch.rlockKeys(); errno != 0 {
+			return minus1, errno
+		}
+		data, err = n.branch.decryptXattrValue(cData)
+		n.branch.mu.RUnlock()
 		if err != nil {
-			tlog.Warn.Printf("GetXAttr: %v", err)
+			tlog.FuseFrontend.Warn.Printf("GetXAttr: %v", err)
 			return minus1, syscall.EIO
 		}
 	}
@@ -82,13 +108,32 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 // SetXAttr - FUSE call. Set extended attribute.
 //
 // This function is symlink-safe through Fsetxattr.
-func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) (errno syscall.Errno) {
+	n.rootNode().stats.op(statXattr)
+	if errno := n.checkWritable(""); errno != 0 {
+		return errno
+	}
+	defer func() {
+		if errno == 0 {
+			n.changed("")
+		}
+	}()
 	rn := n.rootNode()
 	flags = uint32(filterXattrSetFlags(int(flags)))
 
-	// ACLs are passed through without encryption
-	if isAcl(attr) {
-		// result of setting an acl depends on the user doing it
+	if attr == xattrImmutable {
+		switch string(data) {
+		case "1":
+			return n.setImmutable(ctx, true)
+		case "0":
+			return n.setImmutable(ctx, false)
+		}
+		return syscall.EINVAL
+	}
+
+	// ACLs and SELinux labels are passed through without encryption
+	if isPassthrough(attr) {
+		// result of setting an acl or label depends on the user doing it
 		var context *fuse.Context
 		if rn.args.PreserveOwner {
 			context = toFuseCtx(ctx)
@@ -96,26 +141,45 @@ func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uin
 		return n.setXAttr(context, attr, data, flags)
 	}
 
-	cAttr, err := rn.encryptXattrName(attr)
+	if errno := n.branch.rlockKeys(); errno != 0 {
+		return errno
+	}
+	cAttr, err := n.branch.encryptXattrName(attr)
+	cData := n.branch.encryptXattrValue(data)
+	n.branch.mu.RUnlock()
 	if err != nil {
 		return syscall.EINVAL
 	}
-	cData := rn.encryptXattrValue(data)
 	return n.setXAttr(nil, cAttr, cData, flags)
 }
 
 // RemoveXAttr - FUSE call.
 //
 // This function is symlink-safe through Fremovexattr.
-func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
-	rn := n.rootNode()
+func (n *Node) Removexattr(ctx context.Context, attr string) (errno syscall.Errno) {
+	n.rootNode().stats.op(statXattr)
+	if errno := n.checkWritable(""); errno != 0 {
+		return errno
+	}
+	defer func() {
+		if errno == 0 {
+			n.changed("")
+		}
+	}()
+	if attr == xattrImmutable {
+		return n.setImmutable(ctx, false)
+	}
 
-	// ACLs are passed through without encryption
-	if isAcl(attr) {
+	// ACLs and SELinux labels are passed through without encryption
+	if isPassthrough(attr) {
 		return n.removeXAttr(attr)
 	}
 
-	cAttr, err := rn.encryptXattrName(attr)
+	if errno := n.branch.rlockKeys(); errno != 0 {
+		return errno
+	}
+	cAttr, err := n.branch.encryptXattrName(attr)
+	n.branch.mu.RUnlock()
 	if err != nil {
 		return syscall.EINVAL
 	}
@@ -126,33 +190,45 @@ func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
 //
 // This function is symlink-safe through Flistxattr.
 func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	n.rootNode().stats.op(statXattr)
 	cNames, errno := n.listXAttr()
 	if errno != 0 {
 		return 0, errno
 	}
 	rn := n.rootNode()
+	// The encrypted names are skipped if n is the directory of a locked
+	// subvolume
+	unlocked := n.branch.rlockKeys() == 0
+	if unlocked {
+		defer n.branch.mu.RUnlock()
+	}
 	var buf bytes.Buffer
 	for _, curName := range cNames {
-		// ACLs are passed through without encryption
-		if isAcl(curName) {
+		// ACLs and SELinux labels are passed through without encryption
+		if isPassthrough(curName) {
 			buf.WriteString(curName + "\000")
 			continue
 		}
-		if !strings.HasPrefix(curName, xattrStorePrefix) {
+		if !strings.HasPrefix(curName, xattrStorePrefix) || !unlocked {
 			continue
 		}
-		name, err := rn.decryptXattrName(curName)
+		name, err := n.branch.decryptXattrName(curName)
 		if err != nil {
-			tlog.Warn.Printf("ListXAttr: invalid xattr name %q: %v", curName, err)
+			tlog.FuseFrontend.Warn.Printf("ListXAttr: invalid xattr name %q: %v", curName, err)
 			rn.reportMitigatedCorruption(curName)
 			continue
 		}
 		// We *used to* encrypt ACLs, which caused a lot of problems.
 		if isAcl(name) {
-			tlog.Warn.Printf("ListXAttr: ignoring deprecated encrypted ACL %q = %q", curName, name)
+			tlog.FuseFrontend.Warn.Printf("ListXAttr: ignoring deprecated encrypted ACL %q = %q", curName, name)
 			rn.reportMitigatedCorruption(curName)
 			continue
 		}
+		// An encrypted label stored before labels were passed through would
+		// shadow the real one.
+		if name == xattrSELinux {
+			continue
+		}
 		buf.WriteString(name + "\000")
 	}
 	// Caller passes size zero to find out how large their buffer should be
@@ -23,7 +23,7 @@ func (n *Node) getXAttr(cAttr string) (out []byte, errno syscall.Errno) {
 	}
 	defer syscall.Close(dirfd)
 
-	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, cName)
+	procPath := fmt.Sprintf("%s/%d/%s", syscallcompat.ProcSelfFd, dirfd, cName)
 	cData, err := syscallcompat.Lgetxattr(procPath, cAttr)
 	if err != nil {
 		return nil, fs.ToErrno(err)
@@ -38,7 +38,7 @@ func (n *Node) setXAttr(context *fuse.Context, cAttr string, cData []byte, flags
 	}
 	defer syscall.Close(dirfd)
 
-	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, cName)
+	procPath := fmt.Sprintf("%s/%d/%s", syscallcompat.ProcSelfFd, dirfd, cName)
 
 	return fs.ToErrno(syscallcompat.LsetxattrUser(procPath, cAttr, cData, int(flags), context))
 }
@@ -50,7 +50,7 @@ func (n *Node) removeXAttr(cAttr string) (errno syscall.Errno) {
 	}
 	defer syscall.Close(dirfd)
 
-	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, cName)
+	procPath := fmt.Sprintf("%s/%d/%s", syscallcompat.ProcSelfFd, dirfd, cName)
 	return fs.ToErrno(unix.Lremovexattr(procPath, cAttr))
 }
 
@@ -61,7 +61,7 @@ func (n *Node) listXAttr() (out []string, errno syscall.Errno) {
 	}
 	defer syscall.Close(dirfd)
 
-	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, cName)
+	procPath := fmt.Sprintf("%s/%d/%s", syscallcompat.ProcSelfFd, dirfd, cName)
 	cNames, err := syscallcompat.Llistxattr(procPath)
 	if err != nil {
 		return nil, fs.ToErrno(err)
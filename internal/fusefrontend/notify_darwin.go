@@ -0,0 +1,18 @@
+package fusefrontend
+
+import (
+	"errors"
+)
+
+// notifier is not implemented on MacOS, which has no inotify
+type notifier struct{}
+
+func newNotifier() (*notifier, error) {
+	return nil, errors.New("not supported on MacOS")
+}
+
+func (no *notifier) watch(n *Node, dirfd int, iv []byte, plain bool) {}
+
+func (no *notifier) close() {}
+
+func (no *notifier) loop() {}
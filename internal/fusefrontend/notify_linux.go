@@ -0,0 +1,236 @@
+package fusefrontend
+
+// Forwarding of changes in CIPHERDIR to the kernel (-notify)
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// notifyMask selects the inotify events that change what the mount shows.
+// IN_CLOSE_WRITE is used instead of IN_MODIFY so a file that is being
+// written does not flush the page cache for every write.
+const notifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_CLOSE_WRITE | unix.IN_ATTRIB | unix.IN_ONLYDIR
+
+// notifyWatch is a watched ciphertext directory
+type notifyWatch struct {
+	node *Node
+	// iv is the DirIV of the directory, nil if names are not encrypted
+	iv []byte
+	// plain is set if the names in the directory are not encrypted
+	// (-plaintextnames or a "plaintext" policy subtree)
+	plain bool
+}
+
+// notifier watches the ciphertext directories of the primary branch with
+// inotify and tells the kernel to drop what it has cached about the
+// corresponding plaintext entries. The kernel then also generates inotify
+// events for applications that watch the mount.
+type notifier struct {
+	fd int
+	// stop is the write end of a pipe. Closing it stops loop().
+	stop    int
+	stopped int
+	mu      sync.Mutex
+	watches map[int32]*notifyWatch
+	// warned is set after the first failed inotify_add_watch was logged
+	warned bool
+}
+
+func newNotifier() (*notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %v", err)
+	}
+	var p [2]int
+	if err = unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &notifier{
+		fd:      fd,
+		stopped: p[0],
+		stop:    p[1],
+		watches: make(map[int32]*notifyWatch),
+	}, nil
+}
+
+// watch adds the ciphertext directory open as "dirfd" to the watched
+// directories. "n" is the directory node.
+func (no *notifier) watch(n *Node, dirfd int, iv []byte, plain bool) {
+	if no == nil {
+		return
+	}
+	path := fmt.Sprintf("%s/%d", syscallcompat.ProcSelfFd, dirfd)
+	wd, err := unix.InotifyAddWatch(no.fd, path, notifyMask)
+	no.mu.Lock()
+	defer no.mu.Unlock()
+	if err != nil {
+		// Typically ENOSPC: fs.inotify.max_user_watches has been reached
+		if !no.warned {
+			tlog.FuseFrontend.Warn.Printf("-notify: cannot watch more directories: %v", err)
+			no.warned = true
+		}
+		return
+	}
+	// Watching the same directory again returns the same wd. The node may
+	// have changed if the kernel has forgotten the old one.
+	no.watches[int32(wd)] = &notifyWatch{node: n, iv: iv, plain: plain}
+}
+
+// close stops loop()
+func (no *notifier) close() {
+	if no == nil {
+		return
+	}
+	syscall.Close(no.stop)
+}
+
+// loop reads inotify events and forwards them until close() is called
+func (no *notifier) loop() {
+	defer syscall.Close(no.fd)
+	defer syscall.Close(no.stopped)
+	buf := make([]byte, 64*1024)
+	fds := []unix.PollFd{
+		{Fd: int32(no.fd), Events: unix.POLLIN},
+		{Fd: int32(no.stopped), Events: unix.POLLIN},
+	}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			tlog.FuseFrontend.Warn.Printf("-notify: poll: %v", err)
+			return
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		n, err := syscall.Read(no.fd, buf)
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		} else if err != nil {
+			tlog.FuseFrontend.Warn.Printf("-notify: read: %v", err)
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+			no.handle(ev.Wd, ev.Mask, string(trimNul(nameBytes)))
+		}
+	}
+}
+
+// trimNul cuts off the NUL padding of an inotify event name
+func trimNul(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+// handle forwards the inotify event "mask" for the entry "cName" in the
+// directory with watch descriptor "wd"
+func (no *notifier) handle(wd int32, mask uint32, cName string) {
+	no.mu.Lock()
+	w := no.watches[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		// The directory has been deleted or moved away
+		delete(no.watches, wd)
+	}
+	no.mu.Unlock()
+	if w == nil || cName == "" {
+		return
+	}
+	dir := w.node
+	name, child, ok := w.resolve(cName)
+	if !ok {
+		return
+	}
+	tlog.Debug.Printf("-notify: event %#x for %q in %q", mask, name, dir.Path())
+	switch {
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		if child != nil {
+			dir.NotifyDelete(name, &child.Inode)
+		} else {
+			dir.NotifyEntry(name)
+		}
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		dir.NotifyEntry(name)
+	case mask&(unix.IN_CLOSE_WRITE|unix.IN_ATTRIB) != 0:
+		if child != nil {
+			child.NotifyContent(0, 0)
+		}
+	}
+	// Drop cached directory listings
+	dir.NotifyContent(0, 0)
+}
+
+// resolve returns the plaintext name of the ciphertext entry "cName" and
+// its node, if the kernel knows it. Returns ok=false for internal files.
+func (w *notifyWatch) resolve(cName string) (name string, child *Node, ok bool) {
+	n := w.node
+	rn := n.rootNode()
+	if n.IsRoot() && IsReservedName(cName) {
+		return "", nil, false
+	}
+	if w.plain || n.isPlaintext(cName) {
+		if n.isExcluded(cName) {
+			return "", nil, false
+		}
+		var child *Node
+		if c := n.GetChild(cName); c != nil {
+			child = toNode(c.Operations())
+		}
+		return cName, child, true
+	}
+	if !rn.args.DeterministicNames && cName == nametransform.DirIVFilename {
+		return "", nil, false
+	}
+	if rn.args.LongNames && nametransform.NameType(cName) == nametransform.LongNameFilename {
+		// A change of the ".name" file is a change of the file it belongs to
+		cName = nametransform.RemoveLongNameSuffix(cName)
+	}
+	nt := rn.branch.nameTransform
+	// Known entries are found by encrypting their names. This also works
+	// after the ".name" file of a long name is gone.
+	for name, c := range n.Children() {
+		if c2, err := nt.EncryptAndHashName(name, w.iv); err == nil && c2 == cName {
+			return name, toNode(c.Operations()), true
+		}
+	}
+	if rn.args.LongNames && nametransform.IsLongContent(cName) {
+		dirfd, cDirName, errno := n.prepareAtSyscallMyself()
+		if errno != 0 {
+			return "", nil, false
+		}
+		defer syscall.Close(dirfd)
+		fd, err := syscallcompat.Openat(dirfd, cDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return "", nil, false
+		}
+		defer syscall.Close(fd)
+		cNameLong, err := rn.branch.readLongName(fd, cName)
+		if err != nil {
+			return "", nil, false
+		}
+		cName = cNameLong
+	}
+	name, err := nt.DecryptName(cName, w.iv)
+	if err != nil {
+		return "", nil, false
+	}
+	return name, nil, true
+}
@@ -0,0 +1,71 @@
+package fusefrontend
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Preallocation strategies, set via "-prealloc"
+const (
+	// PreallocAuto picks PreallocNone on filesystems where preallocation is
+	// broken or slow (Btrfs, ZFS), and PreallocFull everywhere else. This is
+	// the default.
+	PreallocAuto = "auto"
+	// PreallocFull preallocates the file header and every write, so that
+	// running out of space never leaves a half-written block behind
+	PreallocFull = "full"
+	// PreallocHeader only preallocates the file header, which is written
+	// once per file. A full disk can corrupt the last block of a write, but
+	// not the whole file.
+	PreallocHeader = "header"
+	// PreallocNone never preallocates
+	PreallocNone = "none"
+)
+
+// preallocStrategy resolves PreallocAuto for a backing filesystem with the
+// quirks "quirks"
+func preallocStrategy(mode string, quirks uint64) string {
+	if mode != PreallocAuto {
+		return mode
+	}
+	if quirks&(syscallcompat.QuirkBrokenFalloc|syscallcompat.QuirkSlowFalloc) != 0 {
+		return PreallocNone
+	}
+	return PreallocFull
+}
+
+// fallocKeepSize is syscallcompat.EnospcPrealloc. ZFS, NFSv3 and exFAT do
+// not support it. After the first EOPNOTSUPP, it is not tried again for the
+// rest of the mount, and returns EOPNOTSUPP right away.
+func (rn *RootNode) fallocKeepSize(fd int, off int64, len int64) error {
+	if atomic.LoadUint32(&rn.noFallocate) != 0 {
+		return syscall.EOPNOTSUPP
+	}
+	var err error
+	if rn.faults.NoFallocate() {
+		err = syscall.EOPNOTSUPP
+	} else {
+		err = syscallcompat.EnospcPrealloc(fd, off, len)
+	}
+	if err == syscall.EOPNOTSUPP && atomic.CompareAndSwapUint32(&rn.noFallocate, 0, 1) {
+		// https://github.com/rfjakob/gocryptfs/issues/22
+		tlog.Info.Printf(tlog.ColorYellow + "The underlying filesystem does not support fallocate(2). " +
+			"gocryptfs will continue working but is no longer resistant against out-of-space errors." +
+			tlog.ColorReset)
+	}
+	return err
+}
+
+// preallocate reserves the space for writing "len" bytes at "off" in "fd".
+// It is a no-op if the backing filesystem does not support fallocate, so
+// that the write goes ahead without it.
+func (rn *RootNode) preallocate(fd int, off int64, len int64) error {
+	err := rn.fallocKeepSize(fd, off, len)
+	if err == syscall.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
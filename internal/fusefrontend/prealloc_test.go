@@ -0,0 +1,29 @@
+package fusefrontend
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+func TestPreallocStrategy(t *testing.T) {
+	testCases := []struct {
+		mode   string
+		quirks uint64
+		want   string
+	}{
+		{PreallocAuto, 0, PreallocFull},
+		{PreallocAuto, syscallcompat.QuirkBrokenFalloc, PreallocNone},
+		{PreallocAuto, syscallcompat.QuirkSlowFalloc, PreallocNone},
+		{PreallocAuto, syscallcompat.QuirkNoUserXattr, PreallocFull},
+		// Explicit choices override the quirks
+		{PreallocFull, syscallcompat.QuirkBrokenFalloc, PreallocFull},
+		{PreallocHeader, syscallcompat.QuirkSlowFalloc, PreallocHeader},
+		{PreallocNone, 0, PreallocNone},
+	}
+	for _, tc := range testCases {
+		if have := preallocStrategy(tc.mode, tc.quirks); have != tc.want {
+			t.Errorf("mode=%s quirks=%#x: want %s, have %s", tc.mode, tc.quirks, tc.want, have)
+		}
+	}
+}
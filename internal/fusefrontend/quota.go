@@ -0,0 +1,359 @@
+package fusefrontend
+
+// Plaintext quota (-max_size).
+//
+// The usage is updated on every operation that changes a file size, and
+// stored in gocryptfs.quota when the filesystem is unmounted. While mounted,
+// the file is marked as in use. If it is still marked when mounting,
+// gocryptfs has not been unmounted cleanly, and the usage is computed again
+// from the ciphertext sizes in CIPHERDIR. So is the usage of -union mounts,
+// whose branches can also be mounted on their own. Mounting without
+// -max_size deletes the stored usage, as it is not tracked then.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/reserveddir"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// quota tracks the total plaintext size of all files and enforces the
+// -max_size limit. A nil *quota means that there is no limit, and all
+// methods are no-ops.
+type quota struct {
+	// max is the limit in bytes
+	max uint64
+	// used is the current usage in bytes. Use atomic ops to access it.
+	used uint64
+	// stored is set if the usage is kept in quotaDirName
+	stored bool
+}
+
+const (
+	// quotaDirName is the directory in CIPHERDIR that holds the usage
+	quotaDirName   = "gocryptfs.quota"
+	quotaStateName = "usage"
+)
+
+// quotaState is the content of the usage file
+type quotaState struct {
+	// Used is the usage in bytes
+	Used uint64
+	// Mounted is set while the filesystem is mounted. Used is stale then.
+	Mounted bool
+}
+
+// reserve accounts "delta" more bytes. Returns EDQUOT if this would exceed
+// the limit, in which case nothing is accounted.
+func (q *quota) reserve(delta uint64) syscall.Errno {
+	if q == nil || delta == 0 {
+		return 0
+	}
+	for {
+		used := atomic.LoadUint64(&q.used)
+		if used+delta > q.max || used+delta < used {
+			return syscall.EDQUOT
+		}
+		if atomic.CompareAndSwapUint64(&q.used, used, used+delta) {
+			return 0
+		}
+	}
+}
+
+// release accounts "delta" fewer bytes.
+func (q *quota) release(delta uint64) {
+	if q == nil || delta == 0 {
+		return
+	}
+	for {
+		used := atomic.LoadUint64(&q.used)
+		newUsed := used - delta
+		if delta > used {
+			// Files have been deleted behind our back
+			newUsed = 0
+		}
+		if atomic.CompareAndSwapUint64(&q.used, used, newUsed) {
+			return
+		}
+	}
+}
+
+// OnAdd is called by go-fuse when the filesystem is mounted. We use it to
+// compute the initial quota usage and to start syncLoop() and the -notify
+// loop, after all -union branches have been added.
+func (rn *RootNode) OnAdd(ctx context.Context) {
+	if rn.syncStop != nil {
+		go rn.syncLoop()
+	}
+	if rn.reencryptStop != nil {
+		go rn.reencryptLoop()
+	}
+	if rn.notify != nil {
+		rn.watchRoot()
+		go rn.notify.loop()
+	}
+	if rn.quota == nil {
+		// Changes are not tracked, the stored usage becomes stale
+		if err := rn.removeQuotaState(); err != nil {
+			tlog.FuseFrontend.Warn.Printf("Quota: cannot delete the stored usage: %v", err)
+		}
+		return
+	}
+	used, err := rn.loadUsage()
+	if err != nil {
+		tlog.FuseFrontend.Info.Printf("Quota: %v, scanning CIPHERDIR", err)
+		used = 0
+		for _, b := range rn.branches {
+			used += rn.scanUsage(b, b.cipherdir, false, make(map[[2]uint64]bool))
+		}
+	}
+	atomic.StoreUint64(&rn.quota.used, used)
+	if len(rn.branches) == 1 {
+		err = rn.saveQuotaState(&quotaState{Used: used, Mounted: true})
+		if errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.EACCES) {
+			tlog.FuseFrontend.Info.Printf("Quota: cannot store the usage: %v", err)
+		} else if err != nil {
+			tlog.FuseFrontend.Warn.Printf("Quota: cannot store the usage: %v", err)
+		} else {
+			rn.quota.stored = true
+		}
+	}
+	tlog.FuseFrontend.Info.Printf("Quota: %d of %d bytes used", used, rn.quota.max)
+	if used > rn.quota.max {
+		tlog.FuseFrontend.Warn.Printf("Quota: usage exceeds -max_size, writes that grow files will fail")
+	}
+}
+
+// loadUsage returns the stored usage, or an error if there is none that
+// can be used
+func (rn *RootNode) loadUsage() (uint64, error) {
+	if len(rn.branches) > 1 {
+		return 0, errors.New("-union mount")
+	}
+	fd, err := rn.branch.openBeneath(filepath.Join(quotaDirName, quotaStateName), syscall.O_RDONLY, 0)
+	if err == syscall.ENOENT {
+		return 0, errors.New("no stored usage")
+	} else if err != nil {
+		return 0, err
+	}
+	f := os.NewFile(uintptr(fd), quotaStateName)
+	buf, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	var st quotaState
+	if err = json.Unmarshal(buf, &st); err != nil {
+		return 0, fmt.Errorf("%s: %v", quotaStateName, err)
+	}
+	if st.Mounted {
+		return 0, errors.New("not unmounted cleanly")
+	}
+	return st.Used, nil
+}
+
+// saveQuotaState replaces the stored usage with "st" atomically and durably
+func (rn *RootNode) saveQuotaState(st *quotaState) error {
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err = reserveddir.Mkdir(filepath.Join(rn.args.Cipherdir, quotaDirName)); err != nil {
+		return err
+	}
+	dirfd, err := rn.branch.openBeneath(quotaDirName, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	newName := quotaStateName + ".new"
+	if err = syscallcompat.Unlinkat(dirfd, newName, 0); err != nil && err != syscall.ENOENT {
+		return err
+	}
+	fd, err := syscallcompat.Openat(dirfd, newName, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), newName)
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, newName, dirfd, quotaStateName)
+	}
+	if err == nil {
+		err = syscall.Fsync(dirfd)
+	}
+	return err
+}
+
+// removeQuotaState deletes the stored usage. A missing file is not an
+// error.
+func (rn *RootNode) removeQuotaState() error {
+	dirfd, err := rn.branch.openBeneath(quotaDirName, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err == syscall.ENOENT {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	err = syscallcompat.Unlinkat(dirfd, quotaStateName, 0)
+	if err == syscall.ENOENT || err == syscall.EROFS {
+		return nil
+	}
+	return err
+}
+
+// storeUsage stores the usage after unmount
+func (rn *RootNode) storeUsage() {
+	if rn.quota == nil || !rn.quota.stored {
+		return
+	}
+	s := &quotaState{Used: atomic.LoadUint64(&rn.quota.used)}
+	if err := rn.saveQuotaState(s); err != nil {
+		tlog.FuseFrontend.Warn.Printf("Quota: cannot store the usage: %v", err)
+	}
+}
+
+// scanUsage returns the total plaintext size of the files below the
+// ciphertext directory "dir". If "raw" is set, "dir" belongs to a
+// "plaintext" policy subtree, where file sizes are not translated. Files
+// with more than one hard link are only counted once, "seen" holds their
+// device and inode numbers.
+func (rn *RootNode) scanUsage(b *branch, dir string, raw bool, seen map[[2]uint64]bool) (used uint64) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("Quota: cannot scan %q: %v", dir, err)
+		return 0
+	}
+	// Without a gocryptfs.diriv file, this must be a "plaintext" policy
+	// subtree
+	if !raw && !rn.args.PlaintextNames && !rn.args.DeterministicNames {
+		if _, err := os.Lstat(filepath.Join(dir, nametransform.DirIVFilename)); err != nil {
+			raw = true
+		}
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if dir == b.cipherdir && IsReservedName(name) {
+			continue
+		}
+		if !raw && !rn.args.PlaintextNames &&
+			(name == nametransform.DirIVFilename || nametransform.NameType(name) == nametransform.LongNameFilename) {
+			continue
+		}
+		if e.IsDir() {
+			used += rn.scanUsage(b, filepath.Join(dir, name), raw, seen)
+			continue
+		}
+		if !e.Type().IsRegular() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		if raw {
+			used += uint64(fi.Size())
+		} else {
+			used += b.contentEnc.CipherSizeToPlainSize(uint64(fi.Size()))
+		}
+	}
+	return used
+}
+
+// quotaStatAt returns the plaintext size and the link count of the regular
+// file "cName" in "dirfd", so that the caller can release its quota after
+// deleting or overwriting it. Returns zeros if there is no quota or if
+// "cName" is not a regular file.
+func (n *Node) quotaStatAt(b *branch, dirfd int, cName string, plaintext bool) (size uint64, nlink uint64) {
+	if n.rootNode().quota == nil {
+		return 0, 0
+	}
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return 0, 0
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return 0, 0
+	}
+	size = uint64(st.Size)
+	if _, ce, errno := b.keys(); errno == 0 && !plaintext {
+		size = ce.CipherSizeToPlainSize(size)
+	}
+	return size, uint64(st.Nlink)
+}
+
+// quotaGrow reserves quota for growing the file to "newSize" bytes.
+// Returns the number of bytes reserved, which must be released again if the
+// operation fails.
+// The caller must hold ContentLock.
+func (f *File) quotaGrow(newSize uint64) (reserved uint64, errno syscall.Errno) {
+	q := f.rootNode.quota
+	if q == nil {
+		return 0, 0
+	}
+	oldSize, err := f.plainSize()
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	if newSize <= oldSize {
+		return 0, 0
+	}
+	reserved = newSize - oldSize
+	if errno = q.reserve(reserved); errno != 0 {
+		return 0, errno
+	}
+	return reserved, 0
+}
+
+// checkFileSize returns EFBIG if growing the file to "newSize" bytes would
+// exceed -max_file_size. Files that are larger already can still be shrunk.
+// The caller must hold ContentLock.
+func (f *File) checkFileSize(newSize uint64) syscall.Errno {
+	max := f.rootNode.args.MaxFileSize
+	if max == 0 || newSize <= max {
+		return 0
+	}
+	if oldSize, err := f.plainSize(); err == nil && newSize <= oldSize {
+		return 0
+	}
+	tlog.FuseFrontend.Debug.Printf("ino%d: -max_file_size: %d > %d", f.qIno.Ino, newSize, max)
+	return syscall.EFBIG
+}
+
+// plainSize returns the plaintext size of the file, also for files in
+// "plaintext" policy subtrees.
+func (f *File) plainSize() (uint64, error) {
+	if !f.plaintext {
+		return f.statPlainSize()
+	}
+	fi, err := f.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fi.Size()), nil
+}
@@ -0,0 +1,690 @@
+package fusefrontend
+
+// Background re-encryption of older key epochs (-reencrypt)
+//
+// While the filesystem is idle, the files that are still encrypted with the
+// key of an older epoch (see "-new-key-epoch") are re-encrypted with the
+// newest key. A file is first encrypted into gocryptfs.reencrypt/tmp, and
+// then copied over the original in place. This keeps the inode, and with it
+// hard links, owner, permissions and xattrs.
+// The in-place copy is recorded in gocryptfs.reencrypt/state beforehand, and
+// an interrupted copy is completed on the next mount. The state also records
+// how far the walk through CIPHERDIR has got, so that it continues there
+// after a remount.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/v2/internal/progress"
+	"github.com/rfjakob/gocryptfs/v2/internal/ratelimit"
+	"github.com/rfjakob/gocryptfs/v2/internal/reserveddir"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// reencryptDirName is the directory in CIPHERDIR that holds the state
+	// and the temporary file
+	reencryptDirName   = "gocryptfs.reencrypt"
+	reencryptStateName = "state"
+	reencryptTmpName   = "tmp"
+	// reencryptChunk is how many bytes are copied at a time
+	reencryptChunk = 32 * contentenc.DefaultBS
+	// reencryptSaveInterval is how often the walk position is saved while
+	// no file needs to be re-encrypted
+	reencryptSaveInterval = 10 * time.Second
+)
+
+var (
+	// errReencryptBusy means that the filesystem is in use, or that the
+	// file has changed. The file is tried again when the filesystem is idle.
+	errReencryptBusy = errors.New("filesystem busy")
+	// errReencryptStop means that the filesystem is being unmounted
+	errReencryptStop = errors.New("stopped")
+)
+
+// reencryptState is stored as JSON in gocryptfs.reencrypt/state
+type reencryptState struct {
+	// KeyEpoch is the epoch the files are re-encrypted to
+	KeyEpoch uint8
+	// Last is the ciphertext path, relative to CIPHERDIR, of the last file
+	// that has been checked. The walk continues after it.
+	Last string
+	// Done is set when the walk has checked all files
+	Done bool
+	// Files and Bytes count the re-encrypted files and their plaintext size
+	Files uint64
+	Bytes uint64
+	// Pending is set while the tmp file is copied over the original
+	Pending *reencryptPending `json:",omitempty"`
+	// saved is when the state has been written last
+	saved time.Time
+}
+
+// reencryptPending is the file that is being overwritten by the tmp file
+type reencryptPending struct {
+	// Path is relative to CIPHERDIR
+	Path string
+	Ino  uint64
+	// OldID is the file ID before the re-encryption. Its hash tree is
+	// deleted afterwards (-merkle).
+	OldID []byte
+	// Atime and Mtime are restored after the copy
+	Atime time.Time
+	Mtime time.Time
+}
+
+// reencryptOpenDir opens gocryptfs.reencrypt relative to CIPHERDIR, after
+// creating it if "create" is set. The files in it are opened relative to
+// the returned fd with O_NOFOLLOW.
+func (rn *RootNode) reencryptOpenDir(create bool) (int, error) {
+	if create {
+		if err := reserveddir.Mkdir(filepath.Join(rn.args.Cipherdir, reencryptDirName)); err != nil {
+			return -1, err
+		}
+	}
+	return rn.branch.openBeneath(reencryptDirName, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+}
+
+// reencryptOpen opens "name" in gocryptfs.reencrypt. If "create" is set, it
+// replaces it with a new, empty file.
+func (rn *RootNode) reencryptOpen(name string, flags int, create bool) (int, error) {
+	dirfd, err := rn.reencryptOpenDir(create)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(dirfd)
+	if create {
+		return reencryptCreate(dirfd, name, flags)
+	}
+	return syscallcompat.Openat(dirfd, name, flags|syscall.O_NOFOLLOW, 0)
+}
+
+// reencryptCreate replaces "name" in the directory "dirfd" with a new,
+// empty file. O_EXCL makes sure that we never write through a symlink.
+func reencryptCreate(dirfd int, name string, flags int) (int, error) {
+	if err := syscallcompat.Unlinkat(dirfd, name, 0); err != nil && err != syscall.ENOENT {
+		return -1, err
+	}
+	return syscallcompat.Openat(dirfd, name, flags|syscall.O_CREAT|syscall.O_EXCL, 0600)
+}
+
+// reencryptRemoveTmp deletes the tmp file
+func (rn *RootNode) reencryptRemoveTmp() {
+	dirfd, err := rn.reencryptOpenDir(false)
+	if err != nil {
+		return
+	}
+	syscallcompat.Unlinkat(dirfd, reencryptTmpName, 0)
+	syscall.Close(dirfd)
+}
+
+// loadReencryptState reads the state. A missing state file is not an error.
+func (rn *RootNode) loadReencryptState() (*reencryptState, error) {
+	s := &reencryptState{}
+	fd, err := rn.reencryptOpen(reencryptStateName, syscall.O_RDONLY, false)
+	if err == syscall.ENOENT {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), reencryptStateName)
+	buf, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(buf, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", reencryptStateName, err)
+	}
+	return s, nil
+}
+
+// saveReencryptState writes the state to disk. It replaces the old state
+// atomically and is durable when it returns.
+func (rn *RootNode) saveReencryptState(s *reencryptState) error {
+	buf, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	dirfd, err := rn.reencryptOpenDir(true)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	newName := reencryptStateName + ".new"
+	fd, err := reencryptCreate(dirfd, newName, syscall.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), newName)
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, newName, dirfd, reencryptStateName)
+	}
+	if err != nil {
+		return err
+	}
+	s.saved = time.Now()
+	return nil
+}
+
+// reencryptRecover completes an in-place copy that has been interrupted by
+// a crash. Called by NewRootNode() on every mount, also without
+// "-reencrypt", as the file is incomplete until then.
+func (rn *RootNode) reencryptRecover() {
+	s, err := rn.loadReencryptState()
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("-reencrypt: %v", err)
+		return
+	}
+	p := s.Pending
+	if p == nil {
+		return
+	}
+	err = func() error {
+		fd, err := rn.branch.openBeneath(p.Path, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		var st syscall.Stat_t
+		if err = syscall.Fstat(fd, &st); err != nil {
+			return err
+		}
+		if uint64(st.Ino) != p.Ino {
+			return fmt.Errorf("inode number has changed from %d to %d", p.Ino, st.Ino)
+		}
+		tmpFd, err := rn.reencryptOpen(reencryptTmpName, syscall.O_RDONLY, false)
+		if err != nil {
+			return err
+		}
+		tmp := os.NewFile(uintptr(tmpFd), reencryptTmpName)
+		defer tmp.Close()
+		wfd, err := rn.reencryptOpenWrite(fd, p.Path, uint32(st.Mode))
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(wfd)
+		return reencryptCopyBack(wfd, tmp, p)
+	}()
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("-reencrypt: could not complete the interrupted re-encryption of %q: %v",
+			p.Path, err)
+		return
+	}
+	tlog.FuseFrontend.Info.Printf("-reencrypt: completed the interrupted re-encryption of %q", p.Path)
+	rn.reencryptFinish(s)
+}
+
+// reencryptFinish cleans up after the tmp file has been copied over the
+// original
+func (rn *RootNode) reencryptFinish(s *reencryptState) {
+	if rn.merkle != nil {
+		rn.merkleForget(s.Pending.OldID)
+	}
+	s.Pending = nil
+	if err := rn.saveReencryptState(s); err != nil {
+		tlog.FuseFrontend.Warn.Printf("-reencrypt: %v", err)
+	}
+	rn.reencryptRemoveTmp()
+}
+
+// reencryptCopyBack overwrites the file open at "fd" with the ciphertext of
+// "tmp". Blocks of zeros are file holes, and are skipped to keep them.
+func reencryptCopyBack(fd int, tmp *os.File, p *reencryptPending) error {
+	if err := syscall.Ftruncate(fd, 0); err != nil {
+		return err
+	}
+	buf := make([]byte, reencryptChunk)
+	var off int64
+	for {
+		n, err := tmp.ReadAt(buf, off)
+		if n > 0 && !isZero(buf[:n]) {
+			if _, err2 := syscall.Pwrite(fd, buf[:n], off); err2 != nil {
+				return err2
+			}
+		}
+		off += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if err := syscall.Ftruncate(fd, off); err != nil {
+		return err
+	}
+	if err := syscallcompat.FutimesNano(fd, &p.Atime, &p.Mtime); err != nil {
+		tlog.FuseFrontend.Warn.Printf("-reencrypt: %q: could not restore the times: %v", p.Path, err)
+	}
+	return syscall.Fsync(fd)
+}
+
+// isZero returns true if "buf" only contains zeros
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reencryptIsIdle returns true if no file is open, and there has been no
+// filesystem operation for args.ReencryptIdle.
+func (rn *RootNode) reencryptIsIdle() bool {
+	return atomic.LoadInt64(&rn.openFiles) == 0 && time.Since(rn.LastAccess()) >= rn.args.ReencryptIdle
+}
+
+// reencryptWait waits until the filesystem is idle. Returns
+// errReencryptStop if it is being unmounted.
+func (rn *RootNode) reencryptWait() error {
+	for {
+		if rn.checkShutdown() != 0 {
+			return errReencryptStop
+		}
+		if rn.reencryptIsIdle() {
+			return nil
+		}
+		select {
+		case <-rn.reencryptStop:
+			return errReencryptStop
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// reencryptLoop walks CIPHERDIR and re-encrypts the files of older key
+// epochs whenever the filesystem is idle, until all files are done or
+// rn.reencryptStop is closed.
+func (rn *RootNode) reencryptLoop() {
+	defer rn.args.ReencryptProgress.Stop()
+	epoch := rn.branch.contentEnc.CurrentKeyEpoch()
+	s, err := rn.loadReencryptState()
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("-reencrypt: %v", err)
+		return
+	}
+	if s.KeyEpoch != epoch {
+		// A new key epoch has been added, start over
+		s = &reencryptState{KeyEpoch: epoch}
+	}
+	if epoch == 0 || s.Done {
+		tlog.FuseFrontend.Info.Printf("-reencrypt: all files are encrypted with the key of epoch %d", epoch)
+		return
+	}
+	tlog.FuseFrontend.Info.Printf("-reencrypt: re-encrypting to key epoch %d when idle for %v", epoch,
+		rn.args.ReencryptIdle)
+	if p := rn.args.ReencryptProgress; p != nil {
+		// Count the files that are still to be checked. Only the files are
+		// known in advance, the bytes depend on their key epochs.
+		last := s.Last
+		go func() {
+			files, _, err := progress.Scan(rn.args.Cipherdir, func(rel string, info os.FileInfo) bool {
+				return rn.IsInternalPath(rel, info) || walkedBefore(rel, last, info.IsDir())
+			})
+			if err == nil {
+				p.SetTotal(files, 0)
+			}
+		}()
+	}
+	limiter := ratelimit.New(rn.args.ReencryptRate)
+	for {
+		if err = rn.reencryptWait(); err != nil {
+			break
+		}
+		err = rn.reencryptWalk(s, limiter, "")
+		if err != errReencryptBusy {
+			break
+		}
+	}
+	if err == nil {
+		s.Done = true
+		tlog.FuseFrontend.Info.Printf("-reencrypt: done, re-encrypted %d files (%d bytes)", s.Files, s.Bytes)
+	} else if err != errReencryptStop {
+		tlog.FuseFrontend.Warn.Printf("-reencrypt: %v", err)
+	}
+	if err = rn.saveReencryptState(s); err != nil {
+		tlog.FuseFrontend.Warn.Printf("-reencrypt: %v", err)
+	}
+}
+
+// reencryptWalk checks the files in the ciphertext directory "rel" (relative
+// to CIPHERDIR) and its subdirectories, in the order of walkedBefore().
+// Files up to s.Last have been checked before and are skipped.
+func (rn *RootNode) reencryptWalk(s *reencryptState, limiter *ratelimit.Limiter, rel string) error {
+	dirfd, err := rn.branch.openBeneath(rel, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("-reencrypt: cannot scan %q: %v", rel, err)
+		return nil
+	}
+	dir := os.NewFile(uintptr(dirfd), rel)
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		dir.Close()
+		tlog.FuseFrontend.Warn.Printf("-reencrypt: cannot scan %q: %v", rel, err)
+		return nil
+	}
+	// Without a gocryptfs.diriv file, this must be a "plaintext" policy
+	// subtree. Its files are not encrypted.
+	if !rn.args.PlaintextNames && !rn.args.DeterministicNames {
+		var st unix.Stat_t
+		err = syscallcompat.Fstatat(dirfd, nametransform.DirIVFilename, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			dir.Close()
+			return nil
+		}
+	}
+	dir.Close()
+	// walkedBefore() expects the order of os.ReadDir()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		name := e.Name()
+		if rel == "" && IsReservedName(name) {
+			continue
+		}
+		if !rn.args.PlaintextNames &&
+			(name == nametransform.DirIVFilename || nametransform.NameType(name) == nametransform.LongNameFilename) {
+			continue
+		}
+		p := filepath.Join(rel, name)
+		if walkedBefore(p, s.Last, e.IsDir()) {
+			continue
+		}
+		if e.IsDir() {
+			if err = rn.reencryptWalk(s, limiter, p); err != nil {
+				return err
+			}
+			continue
+		}
+		if !e.Type().IsRegular() {
+			continue
+		}
+		n, err := rn.reencryptFile(s, limiter, p)
+		if err == errReencryptBusy || err == errReencryptStop || s.Pending != nil {
+			// With s.Pending set, the file has been left incomplete. The
+			// copy is tried again on the next mount.
+			return err
+		} else if err != nil {
+			tlog.FuseFrontend.Warn.Printf("-reencrypt: skipping %q: %v", p, err)
+		}
+		s.Last = p
+		rn.args.ReencryptProgress.Add(1, n)
+		if n > 0 {
+			s.Files++
+			s.Bytes += n
+		}
+		if n > 0 || time.Since(s.saved) > reencryptSaveInterval {
+			if err = rn.saveReencryptState(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkedBefore returns true if the walk has been past the ciphertext path
+// "p" already when it has checked the file "last". The walk goes depth
+// first, and through each directory sorted by name.
+func walkedBefore(p string, last string, isDir bool) bool {
+	if last == "" {
+		return false
+	}
+	a, b := strings.Split(p, "/"), strings.Split(last, "/")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	// "p" is "last" itself, or a directory on the way to it
+	return len(a) == len(b) && !isDir
+}
+
+// reencryptFile re-encrypts the ciphertext file "rel" (relative to
+// CIPHERDIR) with the key of epoch s.KeyEpoch if it has an older one.
+// Returns its plaintext size if it has been re-encrypted, or 0.
+func (rn *RootNode) reencryptFile(s *reencryptState, limiter *ratelimit.Limiter, rel string) (uint64, error) {
+	fd, err := rn.branch.openBeneath(rel, syscall.O_RDONLY|syscall.O_NOFOLLOW|rn.noatimeFlag(), 0)
+	if err == syscall.EPERM {
+		// O_NOATIME is only allowed for the owner of the file
+		fd, err = rn.branch.openBeneath(rel, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return 0, err
+	}
+	buf := make([]byte, contentenc.HeaderLen)
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG || uint64(st.Size) <= rn.branch.contentEnc.HeaderLen() {
+		// Not a regular file, or no content
+		syscall.Close(fd)
+		return 0, nil
+	}
+	if n, err := syscall.Pread(fd, buf, 0); n != len(buf) {
+		syscall.Close(fd)
+		return 0, err
+	}
+	h, err := contentenc.ParseHeader(buf, rn.headerFeatures)
+	if err != nil {
+		// Left to -fsck
+		syscall.Close(fd)
+		return 0, nil
+	}
+	if h.KeyEpoch >= s.KeyEpoch {
+		syscall.Close(fd)
+		return 0, nil
+	}
+	rn.rewriteLock.Lock()
+	defer rn.rewriteLock.Unlock()
+	plainSize := rn.branch.contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+	if err = rn.rewriteFile(s, rel, fd, &st, h, h.Immutable, limiter); err != nil {
+		return 0, err
+	}
+	return plainSize, nil
+}
+
+// rewriteFile re-encrypts the ciphertext file "rel" (relative to CIPHERDIR)
+// with a new header in the newest key epoch. The immutable marker of the new
+// header is set to "immutable". The file is open read-only at "fd", which is
+// closed afterwards, and has the stat data "st" and the header "h".
+// With a "limiter", this runs in the background for -reencrypt, and gives up
+// with errReencryptBusy when the filesystem is in use.
+// The caller must hold rewriteLock.
+func (rn *RootNode) rewriteFile(s *reencryptState, rel string, fd int, st *unix.Stat_t,
+	h *contentenc.FileHeader, immutable bool, limiter *ratelimit.Limiter) error {
+	var binding []byte
+	if rn.args.BindPath {
+		dirIV, err := rn.readDirIV(filepath.Dir(rel))
+		if err != nil {
+			syscall.Close(fd)
+			return err
+		}
+		binding = contentenc.PathBinding(dirIV, filepath.Base(rel))
+	}
+	src := rn.newReencryptFile(fd, binding)
+	defer src.reencryptClose()
+
+	// Encrypt into the tmp file
+	tmpFd, err := rn.reencryptOpen(reencryptTmpName, syscall.O_RDWR, true)
+	if err != nil {
+		return err
+	}
+	tmp := rn.newReencryptFile(tmpFd, binding)
+	defer tmp.reencryptClose()
+	th := contentenc.RandomHeader()
+	th.KeyEpoch = rn.branch.contentEnc.CurrentKeyEpoch()
+	th.Immutable = immutable
+	if _, err = syscall.Pwrite(tmpFd, rn.packHeader(th), 0); err != nil {
+		rn.reencryptRemoveTmp()
+		return err
+	}
+	tmp.cacheHeader(th)
+	plainSize := src.contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+	if err = rn.reencryptEncrypt(src, tmp, plainSize, limiter); err != nil {
+		rn.reencryptRemoveTmp()
+		return err
+	}
+	// The copy must have a clean tree state (-merkle)
+	tmp.fileTableEntry.ContentLock.Lock()
+	err = tmp.merkleClean()
+	tmp.fileTableEntry.ContentLock.Unlock()
+	if err == nil {
+		err = syscall.Fsync(tmpFd)
+	}
+	if err != nil {
+		rn.reencryptRemoveTmp()
+		return err
+	}
+
+	// Copy it over the original. Reads and writes through the mount are
+	// blocked by ContentLock meanwhile.
+	e := src.fileTableEntry
+	e.ContentLock.Lock()
+	defer e.ContentLock.Unlock()
+	var st2 unix.Stat_t
+	if err = unix.Fstat(src.intFd(), &st2); err != nil {
+		return err
+	}
+	if st2.Size != st.Size || st2.Mtim != st.Mtim || st2.Ctim != st.Ctim {
+		// Changed in the meantime
+		rn.reencryptRemoveTmp()
+		return errReencryptBusy
+	}
+	wfd, err := rn.reencryptOpenWrite(src.intFd(), rel, uint32(st.Mode))
+	if err != nil {
+		rn.reencryptRemoveTmp()
+		return err
+	}
+	defer syscall.Close(wfd)
+	s.Pending = &reencryptPending{Path: rel, Ino: uint64(st.Ino), OldID: h.ID,
+		Atime: time.Unix(st.Atim.Unix()), Mtime: time.Unix(st.Mtim.Unix())}
+	if err = rn.saveReencryptState(s); err != nil {
+		s.Pending = nil
+		return err
+	}
+	if err = reencryptCopyBack(wfd, tmp.fd, s.Pending); err != nil {
+		return fmt.Errorf("could not overwrite %q: %v", rel, err)
+	}
+	e.IDLock.Lock()
+	src.cacheHeader(th)
+	src.merkleUnload()
+	e.IDLock.Unlock()
+	rn.reencryptFinish(s)
+	return nil
+}
+
+// reencryptEncrypt copies the plaintext of "src" to "tmp", which is
+// encrypted in the newest key epoch. With a "limiter", it returns
+// errReencryptBusy if the filesystem is not idle any more.
+func (rn *RootNode) reencryptEncrypt(src *File, tmp *File, plainSize uint64, limiter *ratelimit.Limiter) error {
+	for off := uint64(0); off < plainSize; off += reencryptChunk {
+		select {
+		case <-rn.reencryptStop:
+			return errReencryptStop
+		default:
+		}
+		if limiter != nil && !rn.reencryptIsIdle() {
+			return errReencryptBusy
+		}
+		src.fileTableEntry.ContentLock.RLock()
+		data, errno := src.doRead(nil, off, reencryptChunk)
+		src.fileTableEntry.ContentLock.RUnlock()
+		if errno != 0 {
+			return fmt.Errorf("read failed: %v", errno)
+		}
+		if len(data) == 0 {
+			break
+		}
+		// Keep file holes. The last block must be written to get the size
+		// right.
+		if off+uint64(len(data)) < plainSize && isZero(data) {
+			continue
+		}
+		limiter.Wait(uint64(len(data)))
+		tmp.fileTableEntry.ContentLock.Lock()
+		_, errno = tmp.doWrite(data, int64(off))
+		tmp.fileTableEntry.ContentLock.Unlock()
+		if errno != 0 {
+			return fmt.Errorf("write failed: %v", errno)
+		}
+	}
+	return nil
+}
+
+// reencryptOpenWrite opens the ciphertext file "rel" (relative to
+// CIPHERDIR), which is also open at "fd", for writing. Read-only files get
+// write permission for the moment.
+func (rn *RootNode) reencryptOpenWrite(fd int, rel string, mode uint32) (int, error) {
+	wfd, err := rn.branch.openBeneath(rel, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != syscall.EACCES || mode&0200 != 0 {
+		return wfd, err
+	}
+	if err = syscall.Fchmod(fd, mode&07777|0200); err != nil {
+		return -1, err
+	}
+	wfd, err = rn.branch.openBeneath(rel, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err2 := syscall.Fchmod(fd, mode&07777); err2 != nil {
+		tlog.FuseFrontend.Warn.Printf("-reencrypt: %q: reverting permissions failed: %v", rel, err2)
+	}
+	return wfd, err
+}
+
+// readDirIV reads the gocryptfs.diriv file of the ciphertext directory "rel"
+// (relative to CIPHERDIR)
+func (rn *RootNode) readDirIV(rel string) ([]byte, error) {
+	dirfd, err := rn.branch.openBeneath(rel, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	return rn.branch.nameTransform.ReadDirIVAt(dirfd)
+}
+
+// newReencryptFile wraps "fd" in a File. Unlike NewFile(), it is not counted
+// in openFiles, so that it does not stop the filesystem from being idle.
+func (rn *RootNode) newReencryptFile(fd int, binding []byte) *File {
+	var st syscall.Stat_t
+	syscall.Fstat(fd, &st)
+	qi := inomap.QInoFromStat(&st)
+	return &File{
+		fd:             os.NewFile(uintptr(fd), ""),
+		contentEnc:     rn.branch.contentEnc,
+		qIno:           qi,
+		fileTableEntry: openfiletable.Register(qi),
+		rootNode:       rn,
+		pathBinding:    binding,
+	}
+}
+
+// reencryptClose closes a File from newReencryptFile()
+func (f *File) reencryptClose() {
+	openfiletable.Unregister(f.qIno)
+	f.fd.Close()
+}
@@ -0,0 +1,216 @@
+package fusefrontend
+
+// Renames across backing filesystems
+//
+// A rename inside the mount fails with EXDEV if the two ciphertext
+// directories are on different filesystems, for example if a directory in
+// CIPHERDIR is a bind mount. The ciphertext of a file does not depend on its
+// path (except with -bindpath, where renameRebind re-encrypts it anyway), so
+// we can copy it over without re-encrypting, check the copy and delete the
+// original.
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// renameTmpPrefix is the prefix of the ciphertext name the copy is written to
+// before it is renamed to its final name. Encrypted names never contain a
+// ".", so it cannot clash with them, and OpenDir skips it.
+const renameTmpPrefix = "gocryptfs.rename."
+
+// renameCopyBufSize is the buffer size for copying and comparing files
+const renameCopyBufSize = 128 * 1024
+
+// isRenameTmp returns true if "cName" is a temporary file of renameCopyAt
+func isRenameTmp(cName string) bool {
+	return strings.HasPrefix(cName, renameTmpPrefix)
+}
+
+// renameCopy moves "cName" in "dirfd" to "cName2" in "dirfd2", which is the
+// child "newName" of n2, with renameCopyAt.
+func (n2 *Node) renameCopy(dirfd int, cName string, dirfd2 int, cName2 string, newName string, flags uint32) error {
+	err := renameCopyAt(dirfd, cName, dirfd2, cName2, flags)
+	if err == nil {
+		// The copy has a different inode number. Make the kernel look it up
+		// again. This blocks until the kernel has our reply to the rename.
+		go n2.NotifyEntry(newName)
+	}
+	return err
+}
+
+// renameCopyAt moves the ciphertext file or symlink "cName" in "dirfd" to
+// "cName2" in "dirfd2" by copying it. It is called when Renameat2 has failed
+// with EXDEV, and returns EXDEV itself for what it cannot move: directories,
+// special files, files that are open, and RENAME_EXCHANGE.
+func renameCopyAt(dirfd int, cName string, dirfd2 int, cName2 string, flags uint32) error {
+	if flags&(syscallcompat.RENAME_EXCHANGE|syscallcompat.RENAME_WHITEOUT) != 0 {
+		return syscall.EXDEV
+	}
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	mode := uint32(st.Mode) & syscall.S_IFMT
+	if mode != syscall.S_IFREG && mode != syscall.S_IFLNK {
+		return syscall.EXDEV
+	}
+	st2 := syscallcompat.Unix2syscall(st)
+	if mode == syscall.S_IFREG && openfiletable.IsOpen(inomap.QInoFromStat(&st2)) {
+		// The open file handles would keep writing to the deleted original
+		tlog.FuseFrontend.Debug.Printf("renameCopyAt: %q is open", cName)
+		return syscall.EXDEV
+	}
+	if flags&syscallcompat.RENAME_NOREPLACE != 0 {
+		var st3 unix.Stat_t
+		if syscallcompat.Fstatat(dirfd2, cName2, &st3, unix.AT_SYMLINK_NOFOLLOW) == nil {
+			return syscall.EEXIST
+		}
+	}
+	tmpName := fmt.Sprintf("%s%d", renameTmpPrefix, cryptocore.RandUint64())
+	tlog.FuseFrontend.Debug.Printf("renameCopyAt: %d/%s -> %d/%s via %s", dirfd, cName, dirfd2, cName2, tmpName)
+	var err error
+	if mode == syscall.S_IFLNK {
+		err = renameCopySymlink(dirfd, cName, dirfd2, tmpName)
+	} else {
+		err = renameCopyFile(dirfd, cName, dirfd2, tmpName, &st)
+	}
+	if err == nil {
+		// Best effort, like cp -p
+		syscallcompat.Fchownat(dirfd2, tmpName, int(st.Uid), int(st.Gid), unix.AT_SYMLINK_NOFOLLOW)
+		atime := time.Unix(st.Atim.Unix())
+		mtime := time.Unix(st.Mtim.Unix())
+		syscallcompat.UtimesNanoAtNofollow(dirfd2, tmpName, &atime, &mtime)
+		err = syscallcompat.Renameat2(dirfd2, tmpName, dirfd2, cName2, uint(flags))
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(dirfd2, tmpName, 0)
+		return err
+	}
+	if err = syscallcompat.Unlinkat(dirfd, cName, 0); err != nil {
+		// Do not leave the file in both places
+		tlog.FuseFrontend.Warn.Printf("renameCopyAt: could not delete %q, deleting the copy: %v", cName, err)
+		syscallcompat.Unlinkat(dirfd2, cName2, 0)
+		return err
+	}
+	return nil
+}
+
+// renameCopySymlink copies the symlink "cName" in "dirfd" to "cName2" in
+// "dirfd2". The encrypted target is copied as it is.
+func renameCopySymlink(dirfd int, cName string, dirfd2 int, cName2 string) error {
+	target, err := syscallcompat.Readlinkat(dirfd, cName)
+	if err != nil {
+		return err
+	}
+	if err = unix.Symlinkat(target, dirfd2, cName2); err != nil {
+		return err
+	}
+	if target2, err := syscallcompat.Readlinkat(dirfd2, cName2); err != nil || target2 != target {
+		tlog.FuseFrontend.Warn.Printf("renameCopySymlink: copy of %q does not match: %v", cName, err)
+		return syscall.EIO
+	}
+	return nil
+}
+
+// renameCopyFile copies the regular file "cName" in "dirfd", which has the
+// stat data "st", to the new file "cName2" in "dirfd2", together with its
+// xattrs. Blocks of zeros are skipped to keep file holes. The copy is synced
+// to disk and compared with the original.
+func renameCopyFile(dirfd int, cName string, dirfd2 int, cName2 string, st *unix.Stat_t) error {
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	fd2, err := syscallcompat.Openat(dirfd2, cName2, syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW,
+		uint32(st.Mode)&07777)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd2)
+	buf := make([]byte, renameCopyBufSize)
+	zeros := make([]byte, renameCopyBufSize)
+	var off int64
+	for {
+		n, err := syscall.Pread(fd, buf, off)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if !bytes.Equal(buf[:n], zeros[:n]) {
+			if _, err = syscall.Pwrite(fd2, buf[:n], off); err != nil {
+				return err
+			}
+		}
+		off += int64(n)
+	}
+	if err = syscall.Ftruncate(fd2, off); err != nil {
+		return err
+	}
+	renameCopyXattrs(fd, fd2)
+	if err = syscall.Fsync(fd2); err != nil {
+		return err
+	}
+	if err = renameCompare(fd, fd2); err != nil {
+		tlog.FuseFrontend.Warn.Printf("renameCopyFile: copy of %q does not match: %v", cName, err)
+		return syscall.EIO
+	}
+	return nil
+}
+
+// renameCopyXattrs copies the xattrs of the file open at "fd" to "fd2".
+// Encrypted xattrs are stored as xattrs of the backing file. Errors are
+// ignored.
+func renameCopyXattrs(fd int, fd2 int) {
+	names, err := syscallcompat.Flistxattr(fd)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		val, err := syscallcompat.Fgetxattr(fd, name)
+		if err == nil {
+			err = unix.Fsetxattr(fd2, name, val, 0)
+		}
+		if err != nil {
+			tlog.FuseFrontend.Debug.Printf("renameCopyXattrs: xattr %q: %v", name, err)
+		}
+	}
+}
+
+// renameCompare returns an error if the contents of "fd" and "fd2" differ
+func renameCompare(fd int, fd2 int) error {
+	buf := make([]byte, renameCopyBufSize)
+	buf2 := make([]byte, renameCopyBufSize)
+	var off int64
+	for {
+		n, err := syscall.Pread(fd, buf, off)
+		if err != nil {
+			return err
+		}
+		n2, err := syscall.Pread(fd2, buf2, off)
+		if err != nil {
+			return err
+		}
+		if n != n2 || !bytes.Equal(buf[:n], buf2[:n2]) {
+			return fmt.Errorf("difference at offset %d", off)
+		}
+		if n == 0 {
+			return nil
+		}
+		off += int64(n)
+	}
+}
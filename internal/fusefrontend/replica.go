@@ -0,0 +1,65 @@
+package fusefrontend
+
+// Read-repair from a replica CIPHERDIR (-replica)
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// readRepair is called by doRead() when the "length" bytes of ciphertext at
+// "cOff" failed to decrypt. It reads the same range from the replica. If
+// that decrypts, the good ciphertext is written back to CIPHERDIR and the
+// plaintext is returned.
+//
+// The replica must be a copy of CIPHERDIR (for example, made by rsync), so
+// that encrypted file names and file IDs are identical. "contentEnc" is
+// the ContentEnc of the key epoch of the file.
+func (f *File) readRepair(cOff uint64, length int, firstBlockNo uint64, fileID []byte, immutable bool,
+	contentEnc *contentenc.ContentEnc) ([]byte, error) {
+	rn := f.rootNode
+	if f.node == nil {
+		return nil, fmt.Errorf("unknown path")
+	}
+	cPath, err := rn.EncryptPath(f.node.Path())
+	if err != nil {
+		return nil, err
+	}
+	replica, err := os.OpenFile(filepath.Join(rn.args.Replica, cPath), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer replica.Close()
+	ciphertext := make([]byte, length)
+	n, err := replica.ReadAt(ciphertext, int64(cOff))
+	if n != length {
+		return nil, fmt.Errorf("replica: short read: %d of %d bytes: %v", n, length, err)
+	}
+	// DecryptBlocks also authenticates the file ID, so we cannot accidentally
+	// use data from a different file that happens to have the same name.
+	plaintext, err := contentEnc.DecryptBlocks(ciphertext, firstBlockNo, f.contentAD(fileID, immutable))
+	if err != nil {
+		f.contentEnc.PReqPool.Put(plaintext)
+		return nil, fmt.Errorf("replica: %v", err)
+	}
+	// Repair. The caller may only have a read-only fd, so open the backing
+	// file again for writing. Failure to repair is not fatal, we still have
+	// the good data.
+	primary, err := rn.branch.openBeneath(cPath, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err == nil {
+		_, err = syscall.Pwrite(primary, ciphertext, int64(cOff))
+		syscall.Close(primary)
+	}
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("ino%d: read-repair: could not write back to %q: %v", f.qIno.Ino, cPath, err)
+	} else {
+		tlog.FuseFrontend.Warn.Printf("ino%d: read-repair: repaired %d bytes at offset %d in %q from the replica",
+			f.qIno.Ino, length, cOff, cPath)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,102 @@
+package fusefrontend
+
+// Salvage mode (-rescue)
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// salvage collects what "-rescue" could not read, for the report that is
+// logged after unmount. A nil *salvage records nothing.
+type salvage struct {
+	mu sync.Mutex
+	// items maps plaintext paths to the problems found there
+	items map[string][]string
+}
+
+// newSalvage returns nil if "-rescue" is not enabled
+func newSalvage(enabled bool) *salvage {
+	if !enabled {
+		return nil
+	}
+	return &salvage{items: make(map[string][]string)}
+}
+
+// add records a problem at the plaintext path "path"
+func (s *salvage) add(path string, format string, a ...interface{}) {
+	if s == nil {
+		return
+	}
+	msg := fmt.Sprintf(format, a...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Reading a file twice must not list its bad blocks twice
+	for _, m := range s.items[path] {
+		if m == msg {
+			return
+		}
+	}
+	s.items[path] = append(s.items[path], msg)
+}
+
+// report logs the salvage report
+func (s *salvage) report() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.items) == 0 {
+		tlog.Info.Printf("-rescue: salvage report: everything that was accessed could be read")
+		return
+	}
+	paths := make([]string, 0, len(s.items))
+	for p := range s.items {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	fmt.Fprintf(&b, "-rescue: salvage report: problems in %d paths", len(paths))
+	for _, p := range paths {
+		for _, m := range s.items[p] {
+			fmt.Fprintf(&b, "\n  /%s: %s", p, m)
+		}
+	}
+	tlog.Info.Printf("%s", b.String())
+}
+
+// salvageBlocks is called by doRead() in "-rescue" mode when "ciphertext"
+// failed to decrypt. It decrypts block by block and replaces the blocks that
+// fail with zeros, so that the rest of the file can still be read.
+func (f *File) salvageBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte, immutable bool,
+	contentEnc *contentenc.ContentEnc) []byte {
+	cBS := int(contentEnc.CipherBS())
+	overhead := int(contentEnc.BlockOverhead())
+	plaintext := f.contentEnc.PReqPool.Get()[:0]
+	for off := 0; off < len(ciphertext); off += cBS {
+		end := off + cBS
+		if end > len(ciphertext) {
+			end = len(ciphertext)
+		}
+		blockNo := firstBlockNo + uint64(off/cBS)
+		pBlock, err := contentEnc.DecryptBlock(ciphertext[off:end], blockNo, f.contentAD(fileID, immutable))
+		if err != nil {
+			tlog.FuseFrontend.Warn.Printf("ino%d: -rescue: replacing corrupt block #%d with zeros: %v",
+				f.qIno.Ino, blockNo, err)
+			f.rootNode.salvage.add(f.statsPath(), "block #%d replaced with zeros", blockNo)
+			n := end - off - overhead
+			if n < 0 {
+				n = 0
+			}
+			pBlock = make([]byte, n)
+		}
+		plaintext = append(plaintext, pBlock...)
+	}
+	return plaintext
+}
@@ -0,0 +1,34 @@
+package fusefrontend
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// withRetry runs "fn", which writes or syncs data on the backing storage,
+// and runs it again if it fails with EIO. Between attempts, it waits
+// "-retry_interval", doubling the wait each time, for at most
+// "-retry_count" retries. "op" names the operation in log messages.
+//
+// "fn" must be idempotent, which is the case for pwrite and fsync.
+func (rn *RootNode) withRetry(op string, fn func() error) error {
+	interval := rn.args.RetryInterval
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil {
+			if i > 0 {
+				tlog.FuseFrontend.Info.Printf("%s: succeeded after %d retries", op, i)
+			}
+			return nil
+		}
+		if i >= rn.args.RetryCount || !errors.Is(err, syscall.EIO) {
+			return err
+		}
+		tlog.FuseFrontend.Warn.Printf("%s: %v, retrying in %v (%d/%d)", op, err, interval, i+1, rn.args.RetryCount)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
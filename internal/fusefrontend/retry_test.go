@@ -0,0 +1,43 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestWithRetry(t *testing.T) {
+	rn := &RootNode{args: Args{RetryCount: 2}}
+
+	// EIO is retried until the call succeeds
+	calls := 0
+	err := rn.withRetry("test", func() error {
+		calls++
+		if calls < 3 {
+			return syscall.EIO
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("err=%v calls=%d", err, calls)
+	}
+
+	// ... but only RetryCount times
+	calls = 0
+	err = rn.withRetry("test", func() error {
+		calls++
+		return syscall.EIO
+	})
+	if err != syscall.EIO || calls != 3 {
+		t.Errorf("err=%v calls=%d", err, calls)
+	}
+
+	// Other errors are not retried
+	calls = 0
+	err = rn.withRetry("test", func() error {
+		calls++
+		return syscall.ENOSPC
+	})
+	if err != syscall.ENOSPC || calls != 1 {
+		t.Errorf("err=%v calls=%d", err, calls)
+	}
+}
@@ -1,16 +1,30 @@
 package fusefrontend
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/auditlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/blockcache"
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/dirlock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/faultinject"
 	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/journal"
+	"github.com/rfjakob/gocryptfs/v2/internal/manifest"
+	"github.com/rfjakob/gocryptfs/v2/internal/membudget"
+	"github.com/rfjakob/gocryptfs/v2/internal/merkle"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/ratelimit"
+	"github.com/rfjakob/gocryptfs/v2/internal/reserveddir"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -24,10 +38,10 @@ type RootNode struct {
 	// Readers must RLock() it to prevent them from seeing intermediate
 	// states
 	dirIVLock sync.RWMutex
-	// Filename encryption helper
-	nameTransform *nametransform.NameTransform
-	// Content encryption helper
-	contentEnc *contentenc.ContentEnc
+	// branches holds the CIPHERDIRs that make up this filesystem. The first
+	// entry is the primary branch (args.Cipherdir), further entries are
+	// only present in union mounts (-union). See union.go.
+	branches []*branch
 	// This lock is used by openWriteOnlyFile() to block concurrent opens while
 	// it relaxes the permissions on a file.
 	openWriteOnlyLock sync.RWMutex
@@ -45,8 +59,6 @@ type RootNode struct {
 	// When -idle was used when mounting, idleMonitor() sets it to 1
 	// periodically.
 	IsIdle uint32
-	// dirCache caches directory fds
-	dirCache dirCache
 	// inoMap translates inode numbers from different devices to unique inode
 	// numbers.
 	inoMap *inomap.InoMap
@@ -59,41 +71,300 @@ type RootNode struct {
 	// quirks is a bitmap that enables workaround for quirks in the filesystem
 	// backing the cipherdir
 	quirks uint64
+	// prealloc is args.Prealloc with PreallocAuto resolved for the backing
+	// filesystem
+	prealloc string
+	// noFallocate is set to 1 when the backing filesystem has returned
+	// EOPNOTSUPP for fallocate. Use atomic ops to access it.
+	noFallocate uint32
+	// quota enforces -max_size. nil if there is no limit.
+	quota *quota
+	// worm seals the files of a -worm filesystem. nil otherwise.
+	worm *worm
+	// limits implements -bwlimit and -ioplimit
+	limits ratelimit.Throttle
+	// blockCache implements -cachedir. nil if not enabled.
+	blockCache *blockcache.Cache
+	// budget is the -cachemem memory budget shared by the caches
+	budget *membudget.Budget
+	// salvage collects the salvage report of -rescue. nil if not enabled.
+	salvage *salvage
+	// faults implements -fault_inject. nil if not enabled.
+	faults *faultinject.Injector
+	// journal implements -journal. nil if not enabled.
+	journal *journal.Journal
+	// merkle stores the per-file hash trees (-merkle). nil if not enabled.
+	merkle *merkle.Store
+	// syncStop stops syncLoop() (-fsync_interval). nil if not running.
+	syncStop chan struct{}
+	// reencryptStop stops reencryptLoop() (-reencrypt). nil if not running.
+	reencryptStop chan struct{}
+	// notify forwards changes in CIPHERDIR to the kernel (-notify). nil if
+	// not enabled.
+	notify *notifier
+	// rewriteLock serializes rewriteFile(), which is used by -reencrypt and
+	// to set the immutable marker
+	rewriteLock sync.Mutex
+	// headerFeatures is what the file headers of the primary branch may
+	// use, see contentenc.HeaderFeatures
+	headerFeatures contentenc.HeaderFeatures
+	// shuttingDown is set to 1 by Shutdown(). Use atomic ops to access it.
+	shuttingDown uint32
+	// IdleUnmount is signaled when UnmountWhenIdle() has been called and no
+	// file is open anymore. main.doMount() then unmounts the filesystem.
+	IdleUnmount chan struct{}
+	// unmountWhenIdle is set to 1 by UnmountWhenIdle(), openFiles counts the
+	// open File handles. Use atomic ops to access them.
+	unmountWhenIdle uint32
+	openFiles       int64
+	// lastAccess is the time of the last filesystem operation in Unix
+	// seconds, reported via the control socket. Use atomic ops to access it.
+	lastAccess int64
+	// stats are reported via the control socket ("-top")
+	stats stats
+	// requestQueue holds the fuselimit.Limiter in front of the filesystem
+	// with -threads and -max_queue, set by SetRequestQueue(). Use atomic ops
+	// to access it.
+	requestQueue atomic.Value
+	// changes are reported via the control socket ("-changes"). nil if
+	// args.TrackChanges is not set.
+	changes *changes
+	// userNames caches uid -> user name for "userdir" policy rules
+	userNames sync.Map
+	// subvolumes are the directories with their own keys. Unlike union
+	// branches, they are not in "branches". See subvolume.go.
+	subvolumes []*branch
+	// subvolumeKeys checks the passwords for UnlockSubvolume(). nil with
+	// -masterkey and -zerokey.
+	subvolumeKeys SubvolumeKeyFunc
+	// unlockKeys checks the password for Unlock(). nil with -masterkey and
+	// -zerokey. See lock.go.
+	unlockKeys UnlockFunc
+	// lockMu serializes Lock() and Unlock()
+	lockMu sync.Mutex
+	// locked is set to 1 by Lock() and back to 0 by Unlock(). Use atomic
+	// ops to access it.
+	locked uint32
+	// readOnly is set to 1 by SetReadOnly(true). Use atomic ops to access
+	// it.
+	readOnly uint32
 }
 
 func NewRootNode(args Args, c *contentenc.ContentEnc, n *nametransform.NameTransform) *RootNode {
 	var rootDev uint64
 	var st syscall.Stat_t
 	if err := syscall.Stat(args.Cipherdir, &st); err != nil {
-		tlog.Warn.Printf("Could not stat backing directory %q: %v", args.Cipherdir, err)
+		tlog.FuseFrontend.Warn.Printf("Could not stat backing directory %q: %v", args.Cipherdir, err)
 	} else {
 		rootDev = uint64(st.Dev)
 	}
 
 	if len(args.Exclude) > 0 {
-		tlog.Warn.Printf("Forward mode does not support -exclude")
-	}
-
-	ivLen := nametransform.DirIVLen
-	if args.PlaintextNames {
-		ivLen = 0
+		tlog.FuseFrontend.Warn.Printf("Forward mode does not support -exclude")
 	}
 
 	rn := &RootNode{
-		args:          args,
-		nameTransform: n,
-		contentEnc:    c,
-		inoMap:        inomap.New(rootDev),
-		dirCache:      dirCache{ivLen: ivLen},
-		quirks:        syscallcompat.DetectQuirks(args.Cipherdir),
+		args:    args,
+		inoMap:  inomap.New(rootDev),
+		quirks:  syscallcompat.DetectQuirks(args.Cipherdir),
+		budget:  membudget.New(args.CacheMem),
+		faults:  args.Faults,
+		salvage: newSalvage(args.Rescue),
+		// Does not change when the keys are dropped by Lock()
+		headerFeatures: c.HeaderFeatures(),
+		// Buffered so that signalIdleUnmount() never blocks
+		IdleUnmount: make(chan struct{}, 1),
+	}
+	rn.limits.Set(args.BwLimit, args.IOPLimit)
+	rn.prealloc = preallocStrategy(args.Prealloc, rn.quirks)
+	rn.branch = rn.newBranch(args.Cipherdir, c, n)
+	rn.branches = []*branch{rn.branch}
+	if args.MaxSize > 0 {
+		rn.quota = &quota{max: args.MaxSize}
+	}
+	if args.WORM {
+		rn.worm = newWorm(args.WORMRetention)
+	}
+	if args.TrackChanges {
+		rn.changes = newChanges()
+	}
+	if args.Stats {
+		rn.stats.enable()
+	}
+	if args.CacheDir != "" {
+		var err error
+		rn.blockCache, err = blockcache.New(args.CacheDir, args.CacheSize, rn.budget)
+		if err != nil {
+			tlog.Fatal.Printf("-cachedir: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+	}
+	if args.Journal {
+		j, replayed, err := journal.Open(args.Cipherdir)
+		if err != nil {
+			tlog.Fatal.Printf("-journal: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+		if replayed > 0 {
+			tlog.FuseFrontend.Info.Printf("-journal: rolled back %d interrupted writes", replayed)
+		}
+		rn.journal = j
+	} else if n := journal.Pending(args.Cipherdir); n > 0 {
+		tlog.FuseFrontend.Warn.Printf("%s contains %d interrupted writes. Mount with -journal to roll them back.",
+			journal.DirName, n)
+	}
+	if args.MerkleKey != nil {
+		var err error
+		rn.merkle, err = merkle.OpenStore(args.Cipherdir, args.MerkleKey)
+		if err != nil {
+			tlog.Fatal.Printf("-merkle: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+	}
+	if args.FsyncInterval > 0 {
+		// syncLoop is started by OnAdd()
+		rn.syncStop = make(chan struct{})
+	}
+	if args.Notify {
+		var err error
+		// loop() is started by OnAdd()
+		rn.notify, err = newNotifier()
+		if err != nil {
+			tlog.Fatal.Printf("-notify: %v", err)
+			os.Exit(exitcodes.Init)
+		}
+	}
+	rn.reencryptRecover()
+	if args.Reencrypt {
+		if args.Policy.HasPlaintext() && (args.PlaintextNames || args.DeterministicNames) {
+			// reencryptWalk() recognizes plaintext subtrees by their
+			// missing gocryptfs.diriv files
+			tlog.Fatal.Printf("-reencrypt cannot be used together with \"plaintext\" policy rules " +
+				"on filesystems without gocryptfs.diriv files")
+			os.Exit(exitcodes.Usage)
+		}
+		// reencryptLoop is started by OnAdd() as well
+		rn.reencryptStop = make(chan struct{})
 	}
 	return rn
 }
 
+// Chrooted is called by main.doMount() after it has chrooted into the
+// cipherdir ("-sandbox-user"), before the first FUSE request is served.
+func (rn *RootNode) Chrooted() {
+	rn.args.Cipherdir = "/"
+	rn.branch.cipherdir = "/"
+	for _, b := range rn.subvolumes {
+		b.cipherdir = "/"
+	}
+	if rn.merkle != nil {
+		s, err := merkle.OpenStore("/", rn.args.MerkleKey)
+		if err != nil {
+			// Keep the old store. Its paths do not resolve any more, so
+			// writes fail instead of going unprotected.
+			tlog.FuseFrontend.Warn.Printf("-merkle: %v", err)
+			return
+		}
+		rn.merkle = s
+	}
+}
+
+// watchRoot adds the root directory of the primary branch to the
+// directories watched by -notify. Subdirectories are added when they are
+// read.
+func (rn *RootNode) watchRoot() {
+	fd, err := rn.branch.openBeneath("", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("-notify: %v", err)
+		return
+	}
+	defer syscall.Close(fd)
+	var iv []byte
+	if !rn.args.PlaintextNames {
+		if iv, err = rn.branch.nameTransform.ReadDirIVAt(fd); err != nil {
+			tlog.FuseFrontend.Warn.Printf("-notify: could not read %s: %v", nametransform.DirIVFilename, err)
+			return
+		}
+	}
+	rn.notify.watch(&rn.Node, fd, iv, rn.args.PlaintextNames)
+}
+
 // main.doMount() calls this after unmount
 func (rn *RootNode) AfterUnmount() {
 	// print stats before we exit
-	rn.dirCache.stats()
+	for _, b := range rn.branches {
+		b.dirCache.stats()
+	}
+	rn.blockCache.Close()
+	if rn.syncStop != nil {
+		close(rn.syncStop)
+		rn.syncAll()
+	}
+	if rn.reencryptStop != nil {
+		close(rn.reencryptStop)
+	}
+	rn.notify.close()
+	rn.storeUsage()
+	rn.salvage.report()
+}
+
+// HashLongName returns the "gocryptfs.longname.*" name the encrypted name
+// "cName" is stored under, or "" if long names are not used. Used by
+// main.fsck() to check the ".name" files in CIPHERDIR.
+func (rn *RootNode) HashLongName(cName string) string {
+	if rn.args.PlaintextNames || !rn.args.LongNames {
+		return ""
+	}
+	return rn.branch.nameTransform.HashLongName(cName)
+}
+
+// EncryptString encrypts "data" with the master key like a symlink target.
+// Used for plaintext paths that are stored in CIPHERDIR.
+func (rn *RootNode) EncryptString(data string) string {
+	return rn.branch.encryptSymlinkTarget(data)
+}
+
+// DecryptString decrypts the output of EncryptString
+func (rn *RootNode) DecryptString(cData64 string) (string, error) {
+	return rn.branch.decryptSymlinkTarget(cData64)
+}
+
+// throttle delays a read or write of "n" bytes as required by -bwlimit and
+// -ioplimit. Must be called without holding any locks.
+func (rn *RootNode) throttle(n int) {
+	rn.limits.Wait(uint64(n))
+}
+
+// SetRateLimits changes -bwlimit and -ioplimit of the running mount. Zero
+// means no limit.
+func (rn *RootNode) SetRateLimits(bwLimit uint64, iopLimit uint64) {
+	rn.limits.Set(bwLimit, iopLimit)
+}
+
+// SetCacheMem changes the -cachemem memory budget of the running mount. The
+// least recently used cache entries are evicted if the caches use more.
+func (rn *RootNode) SetCacheMem(max int64) {
+	rn.budget.SetMax(max)
+}
+
+// touch records a filesystem operation for LastAccess()
+func (rn *RootNode) touch() {
+	now := time.Now().Unix()
+	// Skip the store, and the cache line bouncing it causes, if nothing
+	// has changed
+	if atomic.LoadInt64(&rn.lastAccess) != now {
+		atomic.StoreInt64(&rn.lastAccess, now)
+	}
+}
+
+// LastAccess returns the time of the last filesystem operation, or the zero
+// time if there has been none. Implements ctlsocksrv.LastAccesser.
+func (rn *RootNode) LastAccess() time.Time {
+	t := atomic.LoadInt64(&rn.lastAccess)
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(t, 0)
 }
 
 // mangleOpenFlags is used by Create() and Open() to convert the open flags the user
@@ -117,6 +388,10 @@ func (rn *RootNode) mangleOpenFlags(flags uint32) (newFlags int) {
 	newFlags = newFlags &^ syscall.O_CREAT
 	// We always want O_NOFOLLOW to be safe against symlink races
 	newFlags |= syscall.O_NOFOLLOW
+	if rn.args.Sync {
+		newFlags |= syscall.O_SYNC
+	}
+	newFlags |= rn.noatimeFlag()
 	return newFlags
 }
 
@@ -131,12 +406,86 @@ func (rn *RootNode) reportMitigatedCorruption(item string) {
 	select {
 	case rn.MitigatedCorruptions <- item:
 	case <-time.After(1 * time.Second):
-		tlog.Warn.Printf("BUG: reportCorruptItem: timeout")
+		tlog.FuseFrontend.Warn.Printf("BUG: reportCorruptItem: timeout")
 		//debug.PrintStack()
 		return
 	}
 }
 
+// RekeyDirName is the directory in CIPHERDIR that holds the filesystem with
+// the new master key while "-rekey" is running
+const RekeyDirName = "gocryptfs.rekey"
+
+// QuarantineDirName is the directory in CIPHERDIR where "-fsck -repair" moves
+// corrupt files
+const QuarantineDirName = "gocryptfs.quarantine"
+
+// reservedNames are the names in the root directory of CIPHERDIR that are
+// used internally by gocryptfs
+var reservedNames = []string{configfile.ConfDefaultName, journal.DirName, dirlock.FileName,
+	auditlog.FileName, manifest.FileName, merkle.DirName, reencryptDirName, RekeyDirName, QuarantineDirName,
+	quotaDirName}
+
+// IsReservedName returns true if "cName" in the root directory of CIPHERDIR
+// is used internally by gocryptfs and must be hidden from the plaintext view.
+func IsReservedName(cName string) bool {
+	for _, n := range reservedNames {
+		if cName == n {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckReservedNames returns an error if a reserved name in the root
+// directory of "cipherdir" belongs to a user file. This can only happen
+// with "-plaintextnames". gocryptfs would hide the file and overwrite or
+// delete it.
+func CheckReservedNames(cipherdir string) error {
+	for _, name := range reservedNames {
+		if name == configfile.ConfDefaultName {
+			continue
+		}
+		path := filepath.Join(cipherdir, name)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		switch name {
+		case dirlock.FileName:
+			// The lock file is always empty
+			if !fi.Mode().IsRegular() || fi.Size() != 0 {
+				err = fmt.Errorf("%s is not a lock file", path)
+			}
+		case auditlog.FileName:
+			err = auditlog.CheckFormat(path)
+		case manifest.FileName:
+			err = manifest.CheckFormat(path)
+		default:
+			err = reserveddir.Check(path)
+		}
+		if err != nil {
+			return fmt.Errorf("%v. %s is reserved for gocryptfs, rename it", err, name)
+		}
+	}
+	return nil
+}
+
+// IsInternalPath returns true if the ciphertext path "rel" (relative to
+// CIPHERDIR) is not part of the plaintext tree: the reserved names in the
+// root directory, gocryptfs.diriv and gocryptfs.longname.*.name files.
+// "info" is its stat data. Used to count the files in CIPHERDIR.
+func (rn *RootNode) IsInternalPath(rel string, info os.FileInfo) bool {
+	name := info.Name()
+	if !strings.Contains(rel, "/") && IsReservedName(name) {
+		return true
+	}
+	return !rn.args.PlaintextNames &&
+		(name == nametransform.DirIVFilename || nametransform.NameType(name) == nametransform.LongNameFilename)
+}
+
 // isFiltered - check if plaintext file "child" should be forbidden
 //
 // Prevents name clashes with internal files when file names are not encrypted
@@ -144,10 +493,10 @@ func (rn *RootNode) isFiltered(child string) bool {
 	if !rn.args.PlaintextNames {
 		return false
 	}
-	// gocryptfs.conf in the root directory is forbidden
-	if child == configfile.ConfDefaultName {
-		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
-			configfile.ConfDefaultName)
+	// gocryptfs.conf etc in the root directory are forbidden
+	if IsReservedName(child) {
+		tlog.FuseFrontend.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			child)
 		return true
 	}
 	// Note: gocryptfs.diriv is NOT forbidden because diriv and plaintextnames
@@ -160,15 +509,15 @@ func (rn *RootNode) isFiltered(child string) bool {
 // The empty string decrypts to the empty string.
 //
 // This function does not do any I/O and is hence symlink-safe.
-func (rn *RootNode) decryptSymlinkTarget(cData64 string) (string, error) {
+func (b *branch) decryptSymlinkTarget(cData64 string) (string, error) {
 	if cData64 == "" {
 		return "", nil
 	}
-	cData, err := rn.nameTransform.B64DecodeString(cData64)
+	cData, err := b.nameTransform.B64DecodeString(cData64)
 	if err != nil {
 		return "", err
 	}
-	data, err := rn.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	data, err := b.contentEnc.DecryptBlock([]byte(cData), 0, nil)
 	if err != nil {
 		return "", err
 	}
@@ -194,7 +543,7 @@ func (rn *RootNode) openWriteOnlyFile(dirfd int, cName string, newFlags int) (rw
 	perms := uint32(st.Mode)
 	// Verify that we don't have read permissions
 	if perms&0400 != 0 {
-		tlog.Warn.Printf("openWriteOnlyFile: unexpected permissions %#o, returning EPERM", perms)
+		tlog.FuseFrontend.Warn.Printf("openWriteOnlyFile: unexpected permissions %#o, returning EPERM", perms)
 		err = syscall.EPERM
 		return
 	}
@@ -208,13 +557,13 @@ func (rn *RootNode) openWriteOnlyFile(dirfd int, cName string, newFlags int) (rw
 	// Relax permissions and revert on return
 	err = syscall.Fchmod(woFd, perms|0400)
 	if err != nil {
-		tlog.Warn.Printf("openWriteOnlyFile: changing permissions failed: %v", err)
+		tlog.FuseFrontend.Warn.Printf("openWriteOnlyFile: changing permissions failed: %v", err)
 		return
 	}
 	defer func() {
 		err2 := syscall.Fchmod(woFd, perms)
 		if err2 != nil {
-			tlog.Warn.Printf("openWriteOnlyFile: reverting permissions failed: %v", err2)
+			tlog.FuseFrontend.Warn.Printf("openWriteOnlyFile: reverting permissions failed: %v", err2)
 		}
 	}()
 	return syscallcompat.Openat(dirfd, cName, newFlags, 0)
@@ -225,12 +574,12 @@ func (rn *RootNode) openWriteOnlyFile(dirfd int, cName string, newFlags int) (rw
 // The empty string encrypts to the empty string.
 //
 // Symlink-safe because it does not do any I/O.
-func (rn *RootNode) encryptSymlinkTarget(data string) (cData64 string) {
+func (b *branch) encryptSymlinkTarget(data string) (cData64 string) {
 	if data == "" {
 		return ""
 	}
-	cData := rn.contentEnc.EncryptBlock([]byte(data), 0, nil)
-	cData64 = rn.nameTransform.B64EncodeToString(cData)
+	cData := b.contentEnc.EncryptBlock([]byte(data), 0, nil)
+	cData64 = b.nameTransform.B64EncodeToString(cData)
 	return cData64
 }
 
@@ -238,51 +587,51 @@ func (rn *RootNode) encryptSymlinkTarget(data string) (cData64 string) {
 // The data is encrypted like a file content block, but without binding it to
 // a file location (block number and file id are set to zero).
 // Special case: an empty value is encrypted to an empty value.
-func (rn *RootNode) encryptXattrValue(data []byte) (cData []byte) {
+func (b *branch) encryptXattrValue(data []byte) (cData []byte) {
 	if len(data) == 0 {
 		return []byte{}
 	}
-	return rn.contentEnc.EncryptBlock(data, 0, nil)
+	return b.contentEnc.EncryptBlock(data, 0, nil)
 }
 
 // decryptXattrValue decrypts the xattr value "cData".
-func (rn *RootNode) decryptXattrValue(cData []byte) (data []byte, err error) {
+func (b *branch) decryptXattrValue(cData []byte) (data []byte, err error) {
 	if len(cData) == 0 {
 		return []byte{}, nil
 	}
-	data, err1 := rn.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	data, err1 := b.contentEnc.DecryptBlock([]byte(cData), 0, nil)
 	if err1 == nil {
 		return data, nil
 	}
 	// This backward compatibility is needed to support old
 	// file systems having xattr values base64-encoded.
-	cData, err2 := rn.nameTransform.B64DecodeString(string(cData))
+	cData, err2 := b.nameTransform.B64DecodeString(string(cData))
 	if err2 != nil {
 		// Looks like the value was not base64-encoded, but just corrupt.
 		// Return the original decryption error: err1
 		return nil, err1
 	}
-	return rn.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	return b.contentEnc.DecryptBlock([]byte(cData), 0, nil)
 }
 
 // encryptXattrName transforms "user.foo" to "user.gocryptfs.a5sAd4XAa47f5as6dAf"
-func (rn *RootNode) encryptXattrName(attr string) (string, error) {
+func (b *branch) encryptXattrName(attr string) (string, error) {
 	// xattr names are encrypted like file names, but with a fixed IV.
-	cAttr, err := rn.nameTransform.EncryptXattrName(attr)
+	cAttr, err := b.nameTransform.EncryptXattrName(attr)
 	if err != nil {
 		return "", err
 	}
 	return xattrStorePrefix + cAttr, nil
 }
 
-func (rn *RootNode) decryptXattrName(cAttr string) (attr string, err error) {
+func (b *branch) decryptXattrName(cAttr string) (attr string, err error) {
 	// Reject anything that does not start with "user.gocryptfs."
 	if !strings.HasPrefix(cAttr, xattrStorePrefix) {
 		return "", syscall.EINVAL
 	}
 	// Strip "user.gocryptfs." prefix
 	cAttr = cAttr[len(xattrStorePrefix):]
-	attr, err = rn.nameTransform.DecryptXattrName(cAttr)
+	attr, err = b.nameTransform.DecryptXattrName(cAttr)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,388 @@
+package fusefrontend
+
+// Statistics for the Stats control socket request ("gocryptfs -top")
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/fuselimit"
+)
+
+// Operation types counted in stats.ops
+const (
+	statLookup = iota
+	statGetattr
+	statSetattr
+	statOpen
+	statCreate
+	statRead
+	statWrite
+	statReaddir
+	statMkdir
+	statUnlink
+	statRmdir
+	statRename
+	statFsync
+	statXattr
+	// statOther are the rarer operations like Readlink, Symlink or Statfs
+	statOther
+	statCount
+)
+
+var statNames = [statCount]string{"lookup", "getattr", "setattr", "open", "create", "read", "write",
+	"readdir", "mkdir", "unlink", "rmdir", "rename", "fsync", "xattr", "other"}
+
+const (
+	// statsRecentPeriod is the length of the periods that the per-file and
+	// per-process counters are reported for
+	statsRecentPeriod = 10 * time.Second
+	// statsMaxEntries limits the memory use of the per-thread counters and
+	// of the closed files. Threads and files beyond that are not tracked
+	// until the next period.
+	statsMaxEntries = 10000
+	// statsTop is how many files and processes are reported
+	statsTop = 10
+)
+
+// busyBytes are the bytes read and written by a file or a thread. Use
+// atomic ops to access them.
+type busyBytes struct {
+	read, written uint64
+}
+
+func (b *busyBytes) add(write bool, n uint64) {
+	if write {
+		atomic.AddUint64(&b.written, n)
+	} else {
+		atomic.AddUint64(&b.read, n)
+	}
+}
+
+func (b *busyBytes) load() busyBytes {
+	return busyBytes{read: atomic.LoadUint64(&b.read), written: atomic.LoadUint64(&b.written)}
+}
+
+// since returns the bytes since the snapshot "old" was taken. A counter
+// that is smaller than in the snapshot has been dropped and recreated
+// meanwhile.
+func (b busyBytes) since(old busyBytes) busyBytes {
+	if b.read < old.read || b.written < old.written {
+		return b
+	}
+	return busyBytes{read: b.read - old.read, written: b.written - old.written}
+}
+
+// busySnapshot are the per-file and per-thread counters at the start of a
+// period
+type busySnapshot struct {
+	start time.Time
+	files map[*File]busyBytes
+	tids  map[uint32]busyBytes
+}
+
+// stats collects the statistics of a mount. The counters are accessed
+// atomically. Nothing is collected unless enabled, which is only the case
+// with "-ctlsock".
+//
+// The bytes per file are counted in the File, and the bytes per thread in
+// "tids". Mapping them to paths and processes is left to report(), which
+// compares them to snapshots taken at the start of the last two periods.
+type stats struct {
+	// enabled is set by enable() before mounting
+	enabled          bool
+	ops              [statCount]uint64
+	bytesRead        uint64
+	bytesWritten     uint64
+	dirCacheHits     uint64
+	dirCacheMisses   uint64
+	blockCacheHits   uint64
+	blockCacheMisses uint64
+	// tids maps thread IDs to *busyBytes. nTids is its size, use atomic ops.
+	tids  sync.Map
+	nTids int64
+	// filesLock protects files, the open files, and the files closed in the
+	// current and in the previous period, which are still reported
+	filesLock              sync.Mutex
+	files, closed, closed2 map[*File]struct{}
+	// reportLock protects the snapshots and tgids
+	reportLock sync.Mutex
+	// snap is taken at the start of the current period, snapPrev at the
+	// start of the one before. The report covers both, so that it always
+	// covers at least one full period.
+	snap, snapPrev *busySnapshot
+	// tgids caches threadGroup()
+	tgids map[uint32]uint32
+}
+
+// enable starts collecting statistics. Must be called before mounting.
+func (s *stats) enable() {
+	s.enabled = true
+	s.files = map[*File]struct{}{}
+	s.closed = map[*File]struct{}{}
+	s.tgids = map[uint32]uint32{}
+	s.snap = &busySnapshot{start: time.Now()}
+}
+
+// op counts an operation of type "t"
+func (s *stats) op(t int) {
+	if !s.enabled {
+		return
+	}
+	atomic.AddUint64(&s.ops[t], 1)
+}
+
+// hit counts a cache lookup in "hits" or "misses"
+func (s *stats) hit(found bool, hits *uint64, misses *uint64) {
+	if !s.enabled {
+		return
+	}
+	if found {
+		atomic.AddUint64(hits, 1)
+	} else {
+		atomic.AddUint64(misses, 1)
+	}
+}
+
+// io counts "n" bytes read or written to the file "f" by the thread that
+// made the request "ctx"
+func (s *stats) io(ctx context.Context, write bool, f *File, n int) {
+	if !s.enabled {
+		return
+	}
+	if write {
+		atomic.AddUint64(&s.bytesWritten, uint64(n))
+	} else {
+		atomic.AddUint64(&s.bytesRead, uint64(n))
+	}
+	f.busy.add(write, uint64(n))
+	caller, ok := fuse.FromContext(ctx)
+	if !ok || caller.Pid == 0 {
+		return
+	}
+	b, ok := s.tids.Load(caller.Pid)
+	if !ok {
+		if atomic.LoadInt64(&s.nTids) >= statsMaxEntries {
+			return
+		}
+		var loaded bool
+		b, loaded = s.tids.LoadOrStore(caller.Pid, &busyBytes{})
+		if !loaded {
+			atomic.AddInt64(&s.nTids, 1)
+		}
+	}
+	b.(*busyBytes).add(write, uint64(n))
+}
+
+// addFile registers the open file "f"
+func (s *stats) addFile(f *File) {
+	if !s.enabled {
+		return
+	}
+	s.filesLock.Lock()
+	s.files[f] = struct{}{}
+	s.filesLock.Unlock()
+}
+
+// removeFile unregisters "f" when it is closed. Its bytes are reported
+// until the period is over.
+func (s *stats) removeFile(f *File) {
+	if !s.enabled {
+		return
+	}
+	s.filesLock.Lock()
+	if _, ok := s.files[f]; ok {
+		delete(s.files, f)
+		if len(s.closed) < statsMaxEntries {
+			s.closed[f] = struct{}{}
+		}
+	}
+	s.filesLock.Unlock()
+}
+
+// snapshot returns the current per-file and per-thread counters
+func (s *stats) snapshot() *busySnapshot {
+	out := &busySnapshot{start: time.Now(), files: map[*File]busyBytes{}, tids: map[uint32]busyBytes{}}
+	s.filesLock.Lock()
+	for _, m := range []map[*File]struct{}{s.files, s.closed, s.closed2} {
+		for f := range m {
+			out.files[f] = f.busy.load()
+		}
+	}
+	s.filesLock.Unlock()
+	s.tids.Range(func(k, v interface{}) bool {
+		out.tids[k.(uint32)] = v.(*busyBytes).load()
+		return true
+	})
+	return out
+}
+
+// rotate starts a new period with the snapshot "now" if the current one is
+// over. It drops the threads that were idle during the whole period, and the
+// files that were closed before its start. The caller must hold reportLock.
+func (s *stats) rotate(now *busySnapshot) {
+	if now.start.Sub(s.snap.start) < statsRecentPeriod {
+		return
+	}
+	s.filesLock.Lock()
+	s.closed2, s.closed = s.closed, map[*File]struct{}{}
+	s.filesLock.Unlock()
+	for tid, n := range now.tids {
+		if old, ok := s.snap.tids[tid]; ok && old == n {
+			s.tids.Delete(tid)
+			atomic.AddInt64(&s.nTids, -1)
+			delete(s.tgids, tid)
+		}
+	}
+	s.snapPrev, s.snap = s.snap, now
+}
+
+// report returns the statistics in the form of the control socket
+func (s *stats) report() *ctlsock.StatsStruct {
+	out := &ctlsock.StatsStruct{
+		Ops:              make(map[string]uint64, statCount),
+		BytesRead:        atomic.LoadUint64(&s.bytesRead),
+		BytesWritten:     atomic.LoadUint64(&s.bytesWritten),
+		DirCacheHits:     atomic.LoadUint64(&s.dirCacheHits),
+		DirCacheMisses:   atomic.LoadUint64(&s.dirCacheMisses),
+		BlockCacheHits:   atomic.LoadUint64(&s.blockCacheHits),
+		BlockCacheMisses: atomic.LoadUint64(&s.blockCacheMisses),
+	}
+	for i, name := range statNames {
+		out.Ops[name] = atomic.LoadUint64(&s.ops[i])
+	}
+	if !s.enabled {
+		return out
+	}
+	s.reportLock.Lock()
+	defer s.reportLock.Unlock()
+	now := s.snapshot()
+	s.rotate(now)
+	base := s.snapPrev
+	if base == nil {
+		base = s.snap
+	}
+	out.RecentSeconds = now.start.Sub(base.start).Seconds()
+	// Looked up here, and not for every read or write
+	files := map[string]busyBytes{}
+	for f, n := range now.files {
+		d := n.since(base.files[f])
+		if d.read == 0 && d.written == 0 {
+			continue
+		}
+		p := f.statsPath()
+		sum := files[p]
+		files[p] = busyBytes{read: sum.read + d.read, written: sum.written + d.written}
+	}
+	pids := map[uint32]busyBytes{}
+	for tid, n := range now.tids {
+		d := n.since(base.tids[tid])
+		if d.read == 0 && d.written == 0 {
+			continue
+		}
+		pid, ok := s.tgids[tid]
+		if !ok {
+			pid = threadGroup(tid)
+			s.tgids[tid] = pid
+		}
+		sum := pids[pid]
+		pids[pid] = busyBytes{read: sum.read + d.read, written: sum.written + d.written}
+	}
+	for path, n := range files {
+		out.Files = append(out.Files, ctlsock.StatsFile{Path: path, BytesRead: n.read, BytesWritten: n.written})
+	}
+	sort.Slice(out.Files, func(i, j int) bool {
+		return out.Files[i].BytesRead+out.Files[i].BytesWritten > out.Files[j].BytesRead+out.Files[j].BytesWritten
+	})
+	if len(out.Files) > statsTop {
+		out.Files = out.Files[:statsTop]
+	}
+	for pid, n := range pids {
+		out.Processes = append(out.Processes, ctlsock.StatsProcess{Pid: pid, BytesRead: n.read, BytesWritten: n.written})
+	}
+	sort.Slice(out.Processes, func(i, j int) bool {
+		return out.Processes[i].BytesRead+out.Processes[i].BytesWritten > out.Processes[j].BytesRead+out.Processes[j].BytesWritten
+	})
+	if len(out.Processes) > statsTop {
+		out.Processes = out.Processes[:statsTop]
+	}
+	// With "-allow_other", the client may not be able to see the other
+	// users' processes
+	for i := range out.Processes {
+		out.Processes[i].Comm = processComm(out.Processes[i].Pid)
+	}
+	return out
+}
+
+// threadGroup returns the process ID of the thread "tid". FUSE requests carry
+// the ID of the calling thread, and a process with many threads should be
+// counted once.
+func threadGroup(tid uint32) uint32 {
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", tid))
+	if err != nil {
+		return tid
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Tgid:") {
+			if pid, err := strconv.ParseUint(strings.TrimSpace(line[5:]), 10, 32); err == nil {
+				return uint32(pid)
+			}
+		}
+	}
+	return tid
+}
+
+// processComm returns the command name of "pid", or "" if it has exited
+func processComm(pid uint32) string {
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// statsPath returns the plaintext path of the file for the per-file
+// statistics
+func (f *File) statsPath() string {
+	if f.node == nil {
+		return fmt.Sprintf("ino%d", f.qIno.Ino)
+	}
+	return f.node.Path()
+}
+
+// Stats returns the statistics of the mount. Implements
+// ctlsocksrv.StatsReporter.
+func (rn *RootNode) Stats() *ctlsock.StatsStruct {
+	out := rn.stats.report()
+	out.OpenFiles = uint64(atomic.LoadInt64(&rn.openFiles))
+	out.CacheMemLimit = uint64(rn.budget.Max())
+	out.CacheMem = map[string]ctlsock.StatsCacheMem{}
+	for name, u := range rn.budget.Usage() {
+		out.CacheMem[name] = ctlsock.StatsCacheMem{Bytes: u.Bytes, Entries: u.Entries, Evictions: u.Evictions}
+	}
+	if l, ok := rn.requestQueue.Load().(*fuselimit.Limiter); ok {
+		q := l.Stats()
+		out.RequestsRunning = uint64(q.Running)
+		out.RequestsWaiting = uint64(q.Waiting)
+		out.OldestRequestSeconds = q.Oldest.Seconds()
+		out.RequestsRejected = q.Rejected
+	}
+	return out
+}
+
+// SetRequestQueue sets the limiter whose request queue Stats() reports. It is
+// created after the RootNode, when the control socket may already be
+// serving.
+func (rn *RootNode) SetRequestQueue(l *fuselimit.Limiter) {
+	rn.requestQueue.Store(l)
+}
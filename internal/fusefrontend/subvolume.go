@@ -0,0 +1,287 @@
+package fusefrontend
+
+// Subvolumes (-add-subvolume): directories whose names and file contents are
+// encrypted with their own key instead of the master key.
+//
+// A subvolume is a branch that shares the backing directory with the primary
+// branch. The name of the subvolume directory itself is stored in its parent
+// and encrypted with the key of the parent. Everything below it uses the key
+// of the subvolume. Without that key, the subvolume is locked: the directory
+// is visible, but its contents cannot be accessed (EACCES).
+//
+// Subvolumes can be locked and unlocked at runtime through the control socket.
+// The keys are protected by branch.mu: crypto operations hold the read lock
+// (rlockKeys), so that LockSubvolume() can wipe the keys safely. Locking
+// fails with EBUSY while files in the subvolume are open.
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// SubvolumeKeyFunc returns the crypto helpers for the subvolume at "path"
+// if "password" is correct. "wipe" wipes their keys.
+type SubvolumeKeyFunc func(path string, password []byte) (c *contentenc.ContentEnc, n *nametransform.NameTransform, wipe func(), err error)
+
+// AddSubvolume makes the directory "path", relative to the mount root, a
+// subvolume with its own keys. Pass nil for "c", "n" and "wipe" if the
+// subvolume is locked. Must be called before mounting.
+func (rn *RootNode) AddSubvolume(path string, c *contentenc.ContentEnc, n *nametransform.NameTransform, wipe func()) {
+	b := rn.newBranch(rn.args.Cipherdir, c, n)
+	b.subvolume = path
+	b.locked = c == nil
+	b.wipe = wipe
+	rn.subvolumes = append(rn.subvolumes, b)
+}
+
+// SetSubvolumeKeyFunc sets the function that UnlockSubvolume() uses to check
+// the password. Must be called before mounting.
+func (rn *RootNode) SetSubvolumeKeyFunc(f SubvolumeKeyFunc) {
+	rn.subvolumeKeys = f
+}
+
+// findSubvolume returns the subvolume whose directory is "p"
+func (rn *RootNode) findSubvolume(p string) (*branch, error) {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	for _, b := range rn.subvolumes {
+		if b.subvolume == p {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not a subvolume", p)
+}
+
+// LockSubvolume is called via the control socket. It wipes the keys of the
+// subvolume at "p", so that its contents cannot be accessed until
+// UnlockSubvolume() is called. Fails with EBUSY while files in the subvolume
+// are open.
+func (rn *RootNode) LockSubvolume(p string) error {
+	b, err := rn.findSubvolume(p)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	if b.locked {
+		b.mu.Unlock()
+		return nil
+	}
+	if atomic.LoadInt64(&b.openFiles) > 0 {
+		b.mu.Unlock()
+		return syscall.EBUSY
+	}
+	b.dropKeys()
+	b.mu.Unlock()
+	tlog.Info.Printf("Subvolume %q locked", b.subvolume)
+	// Drop the plaintext names and contents from the kernel cache
+	rn.invalidateSubvolume(b.subvolume)
+	return nil
+}
+
+// UnlockSubvolume is called via the control socket. It unlocks the subvolume
+// at "p" with "password".
+func (rn *RootNode) UnlockSubvolume(p string, password []byte) error {
+	b, err := rn.findSubvolume(p)
+	if err != nil {
+		return err
+	}
+	if rn.subvolumeKeys == nil {
+		// -masterkey or -zerokey
+		return syscall.ENOTSUP
+	}
+	c, n, wipe, err := rn.subvolumeKeys(b.subvolume, password)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	if !b.locked {
+		b.mu.Unlock()
+		wipe()
+		return nil
+	}
+	b.locked = false
+	b.nameTransform = n
+	b.contentEnc = c
+	b.wipe = wipe
+	b.mu.Unlock()
+	tlog.Info.Printf("Subvolume %q unlocked", b.subvolume)
+	rn.invalidateSubvolume(b.subvolume)
+	return nil
+}
+
+// dropKeys locks b and wipes its keys. The caller must hold b.mu.
+func (b *branch) dropKeys() {
+	b.locked = true
+	b.nameTransform = nil
+	b.contentEnc = nil
+	if b.wipe != nil {
+		b.wipe()
+		b.wipe = nil
+	}
+}
+
+// WipeKeys wipes the keys of the primary branch (see SetLockFunc) and of all
+// unlocked subvolumes. Called after unmount.
+func (rn *RootNode) WipeKeys() {
+	for _, b := range append([]*branch{rn.branch}, rn.subvolumes...) {
+		b.mu.Lock()
+		if b.wipe != nil {
+			b.wipe()
+			b.wipe = nil
+		}
+		b.mu.Unlock()
+	}
+}
+
+// invalidateSubvolume makes the kernel forget the directory of the subvolume
+// at "p", and everything it has cached below it
+func (rn *RootNode) invalidateSubvolume(p string) {
+	dir, name := path.Split(p)
+	in := &rn.Inode
+	for _, c := range strings.Split(dir, "/") {
+		if c == "" {
+			continue
+		}
+		if in = in.GetChild(c); in == nil {
+			// Not known to the kernel
+			return
+		}
+	}
+	if ch := in.GetChild(name); ch != nil {
+		ch.NotifyContent(0, 0)
+	}
+	in.NotifyEntry(name)
+}
+
+// keys returns the crypto helpers of b, or EACCES if b is locked.
+// Use rlockKeys() instead if the keys are used for encryption or decryption,
+// as they may be wiped concurrently.
+func (b *branch) keys() (*nametransform.NameTransform, *contentenc.ContentEnc, syscall.Errno) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.locked {
+		return nil, nil, syscall.EACCES
+	}
+	return b.nameTransform, b.contentEnc, 0
+}
+
+// rlockKeys takes the read lock on the keys of b, which keeps them from being
+// wiped. Returns EACCES if b is locked. Otherwise, the caller must
+// call b.mu.RUnlock() when it is done, and must not call rlockKeys() again
+// before that (a waiting LockSubvolume() would deadlock).
+func (b *branch) rlockKeys() syscall.Errno {
+	b.mu.RLock()
+	if b.locked {
+		b.mu.RUnlock()
+		return syscall.EACCES
+	}
+	return 0
+}
+
+// isLocked returns true if b is a locked subvolume, or the primary branch of
+// a locked filesystem
+func (b *branch) isLocked() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.locked
+}
+
+// writeLongNameAt is nametransform.WriteLongNameAt with the key of b
+func (b *branch) writeLongNameAt(dirfd int, hashName string, plainName string) error {
+	if errno := b.rlockKeys(); errno != 0 {
+		return errno
+	}
+	defer b.mu.RUnlock()
+	return b.nameTransform.WriteLongNameAt(dirfd, hashName, plainName)
+}
+
+// addFile sets the content encryption helper of the newly opened file "f"
+// in b, and counts it as open. Returns EACCES if b is a locked subvolume.
+func (b *branch) addFile(f *File) syscall.Errno {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.locked {
+		return syscall.EACCES
+	}
+	f.contentEnc = b.contentEnc
+	f.branch = b
+	atomic.AddInt64(&b.openFiles, 1)
+	return 0
+}
+
+// isBelow returns true if the plaintext path "p" is the directory "dir" or
+// inside it
+func isBelow(p string, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// subvolumeBranch returns the subvolume that contains the plaintext path "p",
+// or the primary branch
+func (rn *RootNode) subvolumeBranch(p string) *branch {
+	for _, b := range rn.subvolumes {
+		if isBelow(p, b.subvolume) {
+			return b
+		}
+	}
+	return rn.branch
+}
+
+// dirBranch returns the branch whose keys encrypt the names of the children
+// of directory n, when n is accessed in branch "b". This differs from "b"
+// for the directory of a subvolume, which lives in the subvolume branch, but
+// is a child of a directory outside of it.
+func (n *Node) dirBranch(b *branch) *branch {
+	rn := n.rootNode()
+	if len(rn.subvolumes) == 0 {
+		return b
+	}
+	return rn.subvolumeBranch(n.Path())
+}
+
+// checkCrossSubvolume returns EXDEV if moving or linking the child "name" of
+// n to the child "newName" of n2 would move data to a different key, or
+// would move the directory of a subvolume.
+func (n *Node) checkCrossSubvolume(name string, n2 *Node, newName string) syscall.Errno {
+	rn := n.rootNode()
+	if len(rn.subvolumes) == 0 {
+		return 0
+	}
+	from := filepath.Join(n.Path(), name)
+	to := filepath.Join(n2.Path(), newName)
+	if rn.subvolumeBranch(from) != rn.subvolumeBranch(to) {
+		return syscall.EXDEV
+	}
+	for _, b := range rn.subvolumes {
+		if isBelow(b.subvolume, from) || isBelow(b.subvolume, to) {
+			return syscall.EXDEV
+		}
+	}
+	return 0
+}
+
+// decryptNameAt decrypts the name "cName" in the directory "dirfd" with the
+// key of b. Long names are read from their ".name" file.
+func (b *branch) decryptNameAt(dirfd int, cName string) (string, error) {
+	if errno := b.rlockKeys(); errno != 0 {
+		return "", errno
+	}
+	defer b.mu.RUnlock()
+	dirIV, err := b.nameTransform.ReadDirIVAt(dirfd)
+	if err != nil {
+		return "", err
+	}
+	if nametransform.IsLongContent(cName) {
+		cName, err = b.readLongName(dirfd, cName)
+		if err != nil {
+			return "", err
+		}
+	}
+	return b.nameTransform.DecryptName(cName, dirIV)
+}
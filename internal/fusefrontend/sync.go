@@ -0,0 +1,106 @@
+package fusefrontend
+
+// Durability options (-fsync_on_close, -fsync_interval) and graceful shutdown
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// isWritable returns true if the backing file is open for writing.
+func (f *File) isWritable() bool {
+	flags, err := unix.FcntlInt(uintptr(f.intFd()), unix.F_GETFL, 0)
+	return err == nil && flags&syscall.O_ACCMODE != syscall.O_RDONLY
+}
+
+// syncLoop syncs the backing filesystem every args.FsyncInterval until
+// rn.syncStop is closed. This bounds the amount of data that can be lost in
+// a crash, at the cost of one sync per interval instead of one per file.
+func (rn *RootNode) syncLoop() {
+	ticker := time.NewTicker(rn.args.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rn.syncStop:
+			return
+		case <-ticker.C:
+			rn.syncAll()
+		}
+	}
+}
+
+// syncAll syncs the filesystems that back all CIPHERDIRs. Used by
+// syncLoop(), Shutdown() and Sync(). Errors are logged, and the last one
+// is returned.
+func (rn *RootNode) syncAll() (lastErr error) {
+	for _, b := range rn.branches {
+		err := rn.withTimeout(func() error {
+			fd, err := b.openBeneath("", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+			if err != nil {
+				return err
+			}
+			defer syscall.Close(fd)
+			return syscallcompat.Syncfs(fd)
+		}, nil)
+		if err != nil {
+			tlog.FuseFrontend.Warn.Printf("syncing %q failed: %v", b.cipherdir, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Sync is called via the control socket ("-unmount") to write all data to
+// disk before unmounting.
+func (rn *RootNode) Sync() error {
+	return rn.syncAll()
+}
+
+// Shutdown is called when gocryptfs receives SIGTERM or SIGINT, before it
+// unmounts. New opens fail with ESHUTDOWN from now on, and all data that
+// has been written so far is synced to disk.
+func (rn *RootNode) Shutdown() {
+	atomic.StoreUint32(&rn.shuttingDown, 1)
+	rn.syncAll()
+}
+
+// UnmountWhenIdle is called via the control socket ("-unmount -when-idle").
+// Like Shutdown(), it makes new opens fail. IdleUnmount is signaled once no
+// file is open anymore, which may be right away.
+func (rn *RootNode) UnmountWhenIdle() error {
+	rn.Shutdown()
+	atomic.StoreUint32(&rn.unmountWhenIdle, 1)
+	if atomic.LoadInt64(&rn.openFiles) == 0 {
+		rn.signalIdleUnmount()
+	}
+	return nil
+}
+
+// fileClosed is called by File.Release().
+func (rn *RootNode) fileClosed() {
+	if atomic.AddInt64(&rn.openFiles, -1) == 0 && atomic.LoadUint32(&rn.unmountWhenIdle) != 0 {
+		rn.signalIdleUnmount()
+	}
+}
+
+func (rn *RootNode) signalIdleUnmount() {
+	select {
+	case rn.IdleUnmount <- struct{}{}:
+	default:
+		// Already signaled
+	}
+}
+
+// checkShutdown returns ESHUTDOWN once Shutdown() has been called.
+func (rn *RootNode) checkShutdown() syscall.Errno {
+	if atomic.LoadUint32(&rn.shuttingDown) != 0 {
+		return syscall.ESHUTDOWN
+	}
+	return 0
+}
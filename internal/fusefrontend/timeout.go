@@ -0,0 +1,79 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// withTimeout runs "fn", which accesses the backing storage, and gives up
+// with EIO if it does not return within the "-io_timeout" duration.
+//
+// A syscall that is stuck in the kernel (think dead NFS server) cannot be
+// aborted, so "fn" keeps running in the background. "fn" must therefore only
+// write to variables the caller does not look at after a timeout. When "fn"
+// eventually returns after the timeout, "late" is called (if not nil) with
+// its result, to release what "fn" has acquired, like file descriptors.
+func (rn *RootNode) withTimeout(fn func() error, late func(err error)) error {
+	_, err := rn.withTimeout2(fn, late)
+	return err
+}
+
+// withTimeout2 is withTimeout that also reports if the timeout has hit, which
+// means that "late" is going to be called.
+func (rn *RootNode) withTimeout2(fn func() error, late func(err error)) (timedOut bool, err error) {
+	timeout := rn.args.IOTimeout
+	if timeout <= 0 {
+		return false, fn()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return false, err
+	case <-timer.C:
+		tlog.FuseFrontend.Warn.Printf("backing storage did not respond within %v, returning EIO", timeout)
+		if late != nil {
+			go func() {
+				late(<-done)
+			}()
+		}
+		return true, syscall.EIO
+	}
+}
+
+// fstatat is syscallcompat.Fstatat2 with AT_SYMLINK_NOFOLLOW and -io_timeout.
+func (rn *RootNode) fstatat(dirfd int, cName string) (*syscall.Stat_t, error) {
+	var st *syscall.Stat_t
+	err := rn.withTimeout(func() (err error) {
+		st, err = syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// statfs is syscall.Statfs with -io_timeout.
+func (rn *RootNode) statfs(b *branch, out *syscall.Statfs_t) error {
+	var st syscall.Statfs_t
+	err := rn.withTimeout(func() error {
+		if b.rootFd >= 0 {
+			return syscall.Fstatfs(b.rootFd, &st)
+		}
+		return syscall.Statfs(b.cipherdir, &st)
+	}, nil)
+	if err == nil {
+		*out = st
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/faultinject"
+	"github.com/rfjakob/gocryptfs/v2/internal/journal"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+func TestWithTimeout(t *testing.T) {
+	rn := &RootNode{args: Args{IOTimeout: 10 * time.Millisecond}}
+
+	// Fast calls pass through their result
+	err := rn.withTimeout(func() error { return syscall.ENOENT }, nil)
+	if err != syscall.ENOENT {
+		t.Errorf("want ENOENT, got %v", err)
+	}
+
+	// Stuck calls return EIO and get cleaned up once they complete
+	unblock := make(chan struct{})
+	lateCalled := make(chan struct{})
+	err = rn.withTimeout(func() error {
+		<-unblock
+		return nil
+	}, func(err error) {
+		if err == nil {
+			close(lateCalled)
+		}
+	})
+	if err != syscall.EIO {
+		t.Errorf("want EIO, got %v", err)
+	}
+	close(unblock)
+	select {
+	case <-lateCalled:
+	case <-time.After(time.Second):
+		t.Error("late() was not called")
+	}
+}
+
+// A write that is stuck past the timeout fails, but keeps its journal record
+// and the file busy until it returns
+func TestWriteTimeout(t *testing.T) {
+	ctx := context.Background()
+	cipherdir := test_helpers.InitFS(t)
+	rn := newTestFS(Args{Cipherdir: cipherdir, Journal: true, IOTimeout: 50 * time.Millisecond})
+	ch, fh, _, errno := rn.Create(ctx, "f", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	// The journal needs the path of the file
+	rn.AddChild("f", ch, true)
+	f := fh.(*File)
+	defer f.Release(ctx)
+	if _, errno = f.Write(ctx, bytes.Repeat([]byte("a"), 4096), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	faults, err := faultinject.Parse("write_delay=300ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rn.faults = faults
+	want := bytes.Repeat([]byte("b"), 4096)
+	if _, errno = f.Write(ctx, want, 0); errno != syscall.EIO {
+		t.Fatalf("want EIO, have %v", errno)
+	}
+	if n := journal.Pending(cipherdir); n != 1 {
+		t.Errorf("want 1 journal record, have %d", n)
+	}
+	// Waits for the stuck write
+	f.fileTableEntry.ContentLock.RLock()
+	have, errno := f.doRead(nil, 0, 4096)
+	f.fileTableEntry.ContentLock.RUnlock()
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if !bytes.Equal(have, want) {
+		t.Error("content of the late write is missing")
+	}
+	if n := journal.Pending(cipherdir); n != 0 {
+		t.Errorf("want no journal records, have %d", n)
+	}
+}
@@ -0,0 +1,200 @@
+package fusefrontend
+
+// Union mounts (-union): several CIPHERDIRs, each with its own master key,
+// presented as one merged plaintext tree.
+
+import (
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// UnionCreateFirst creates new files and directories in the first branch
+	// that contains the parent directory. This is the default.
+	UnionCreateFirst = "first"
+	// UnionCreateMfs creates new files and directories in the branch with the
+	// most free space that contains the parent directory.
+	UnionCreateMfs = "mfs"
+)
+
+// branch is a CIPHERDIR together with the crypto helpers for its master key.
+// A normal mount has exactly one branch.
+type branch struct {
+	// cipherdir is the backing storage directory (absolute path)
+	cipherdir string
+	// rootFd is cipherdir, opened when the branch is created. Everything in
+	// the branch is opened relative to it, so that renaming CIPHERDIR, or
+	// replacing a directory on its path with a symlink, does not affect the
+	// mount. -1 if it could not be opened.
+	rootFd int
+	// Filename encryption helper
+	nameTransform *nametransform.NameTransform
+	// Content encryption helper
+	contentEnc *contentenc.ContentEnc
+	// dirCache caches directory fds in this branch
+	dirCache dirCache
+	// longNames caches the long names in this branch
+	longNames *longNameCache
+	// subvolume is the directory, relative to the mount root, of a
+	// subvolume branch (see subvolume.go). Empty for CIPHERDIRs.
+	subvolume string
+	// locked is set if the key of the subvolume has not been given, or if
+	// the primary branch has been locked by RootNode.Lock(). Its
+	// nameTransform and contentEnc are nil.
+	locked bool
+	// mu protects locked, nameTransform and contentEnc of subvolumes and of
+	// the primary branch, which can be locked and unlocked at runtime. See
+	// keys() and rlockKeys().
+	mu sync.RWMutex
+	// wipe wipes the keys of an unlocked subvolume or primary branch
+	wipe func()
+	// openFiles counts the open files in this branch. Use atomic ops.
+	openFiles int64
+}
+
+// newBranch creates a branch for "cipherdir".
+func (rn *RootNode) newBranch(cipherdir string, c *contentenc.ContentEnc, n *nametransform.NameTransform) *branch {
+	ivLen := nametransform.DirIVLen
+	if rn.args.PlaintextNames {
+		ivLen = 0
+	}
+	rootFd, err := syscallcompat.Open(cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	if err != nil {
+		tlog.FuseFrontend.Warn.Printf("newBranch: could not open %q: %v", cipherdir, err)
+		rootFd = -1
+	}
+	return &branch{
+		cipherdir:     cipherdir,
+		rootFd:        rootFd,
+		nameTransform: n,
+		contentEnc:    c,
+		dirCache:      dirCache{ivLen: ivLen, allowNoIV: rn.args.Policy.HasPlaintext(), budget: rn.budget},
+		longNames:     newLongNameCache(rn.budget),
+	}
+}
+
+// AddUnionBranch adds another CIPHERDIR to the filesystem. The caller
+// must make sure that it uses the same feature flags as the primary
+// CIPHERDIR. Must be called before mounting.
+func (rn *RootNode) AddUnionBranch(cipherdir string, c *contentenc.ContentEnc, n *nametransform.NameTransform) {
+	rn.branches = append(rn.branches, rn.newBranch(cipherdir, c, n))
+}
+
+// isUnion returns true if more than one CIPHERDIR is mounted
+func (rn *RootNode) isUnion() bool {
+	return len(rn.branches) > 1
+}
+
+// childBranch returns the branch the child "name" of directory n lives in.
+// If the child does not exist, it returns the branch where it would be
+// created according to the -union-create policy.
+func (n *Node) childBranch(name string) *branch {
+	rn := n.rootNode()
+	if !rn.isUnion() {
+		if len(rn.subvolumes) > 0 {
+			return rn.subvolumeBranch(filepath.Join(n.Path(), name))
+		}
+		return rn.branch
+	}
+	if ch := n.GetChild(name); ch != nil {
+		return toNode(ch.Operations()).branch
+	}
+	if b := n.findBranch(name); b != nil {
+		return b
+	}
+	return n.createBranch()
+}
+
+// findBranch returns the first branch that contains the child "name" of
+// directory n, or nil if there is none.
+func (n *Node) findBranch(name string) *branch {
+	for _, b := range n.rootNode().branches {
+		dirfd, cName, errno := n.prepareAtSyscallIn(b, name)
+		if errno != 0 {
+			continue
+		}
+		var st unix.Stat_t
+		err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+		syscall.Close(dirfd)
+		if err == nil {
+			return b
+		}
+	}
+	return nil
+}
+
+// dirBranches returns all branches the directory n exists in. The root
+// directory exists in all branches.
+func (n *Node) dirBranches() (out []*branch) {
+	rn := n.rootNode()
+	if !rn.isUnion() || n.IsRoot() {
+		return rn.branches
+	}
+	for _, b := range rn.branches {
+		dirfd, cName, errno := n.prepareAtSyscallMyselfIn(b)
+		if errno != 0 {
+			continue
+		}
+		var st unix.Stat_t
+		err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+		syscall.Close(dirfd)
+		if err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// createBranch selects the branch for a new child of directory n. Only
+// branches that already contain n are considered, so the directory
+// structure is never duplicated behind the user's back.
+func (n *Node) createBranch() *branch {
+	candidates := n.dirBranches()
+	if len(candidates) == 0 {
+		return n.branch
+	}
+	if n.rootNode().args.UnionCreate != UnionCreateMfs {
+		return candidates[0]
+	}
+	best := candidates[0]
+	var bestFree uint64
+	for _, b := range candidates {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(b.cipherdir, &st); err != nil {
+			tlog.FuseFrontend.Warn.Printf("createBranch: Statfs %q: %v", b.cipherdir, err)
+			continue
+		}
+		free := st.Bavail * uint64(st.Bsize)
+		if free > bestFree {
+			best = b
+			bestFree = free
+		}
+	}
+	return best
+}
+
+// checkSameBranch returns EXDEV if the child "newName" of directory n2 cannot
+// be created in branch b. Renaming and hard-linking cannot move data from one
+// branch to another because each branch uses a different key.
+func (n2 *Node) checkSameBranch(b *branch, newName string) syscall.Errno {
+	if !n2.rootNode().isUnion() {
+		return 0
+	}
+	if b2 := n2.findBranch(newName); b2 != nil && b2 != b {
+		return syscall.EXDEV
+	}
+	for _, b2 := range n2.dirBranches() {
+		if b2 == b {
+			return 0
+		}
+	}
+	return syscall.EXDEV
+}
@@ -0,0 +1,162 @@
+package fusefrontend
+
+// Write-once-read-many volumes (-worm).
+//
+// A file can only be written through the file handle that created it, and
+// through other handles opened while that one is still open. When the last
+// of them is closed, the file is sealed: it cannot be opened for writing,
+// truncated, renamed or deleted any more. With a retention time, sealed
+// files can be deleted once their ctime is older than that.
+//
+// Which files are still being written is only known in memory, so files that
+// were open when the filesystem was unmounted are sealed after a remount.
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// worm tracks the files that are still being written. A nil *worm means that
+// the volume is not a WORM volume, and nothing is sealed.
+type worm struct {
+	// retention is how long sealed files cannot be deleted. 0 means forever.
+	retention time.Duration
+	sync.Mutex
+	// writers counts the open write handles of the files that are not
+	// sealed yet
+	writers map[inomap.QIno]int
+}
+
+func newWorm(retention time.Duration) *worm {
+	return &worm{retention: retention, writers: map[inomap.QIno]int{}}
+}
+
+// created registers the handle of a newly created file
+func (w *worm) created(qi inomap.QIno) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	w.writers[qi]++
+	w.Unlock()
+}
+
+// open registers another write handle of "qi". Returns false if the file is
+// sealed, in which case nothing is registered.
+func (w *worm) open(qi inomap.QIno) bool {
+	if w == nil {
+		return true
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.writers[qi] == 0 {
+		return false
+	}
+	w.writers[qi]++
+	return true
+}
+
+// closed unregisters a write handle. The file is sealed when it was the last.
+func (w *worm) closed(qi inomap.QIno) {
+	if w == nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.writers[qi]--; w.writers[qi] <= 0 {
+		delete(w.writers, qi)
+	}
+}
+
+// sealed returns true if "qi" cannot be written any more
+func (w *worm) sealed(qi inomap.QIno) bool {
+	if w == nil {
+		return false
+	}
+	w.Lock()
+	defer w.Unlock()
+	return w.writers[qi] == 0
+}
+
+// checkWORM returns EPERM if the file has been sealed. Called before
+// writing through an open file handle.
+func (f *File) checkWORM() syscall.Errno {
+	if f.rootNode.worm.sealed(f.qIno) {
+		tlog.FuseFrontend.Debug.Printf("ino%d: -worm: sealed", f.qIno.Ino)
+		return syscall.EPERM
+	}
+	return 0
+}
+
+// wormStatAt returns the QIno and the stat data of "cName" in "dirfd"
+func wormStatAt(dirfd int, cName string) (inomap.QIno, *unix.Stat_t, error) {
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return inomap.QIno{}, nil, err
+	}
+	st2 := syscallcompat.Unix2syscall(st)
+	return inomap.QInoFromStat(&st2), &st, nil
+}
+
+// wormOpen registers a write handle of the file open at "fd". Returns EPERM
+// if it has been sealed. On success, the caller must call worm.closed() for
+// the returned QIno when the handle is closed.
+func (rn *RootNode) wormOpen(fd int) (inomap.QIno, syscall.Errno) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return inomap.QIno{}, fs.ToErrno(err)
+	}
+	qi := inomap.QInoFromStat(&st)
+	if !rn.worm.open(qi) {
+		tlog.FuseFrontend.Debug.Printf("ino%d: -worm: sealed", qi.Ino)
+		return qi, syscall.EPERM
+	}
+	return qi, 0
+}
+
+// wormCheckDelete returns EPERM if "cName" in "dirfd" is a sealed file whose
+// retention time has not passed yet. Empty directories can always be
+// deleted.
+func (rn *RootNode) wormCheckDelete(dirfd int, cName string) syscall.Errno {
+	w := rn.worm
+	if w == nil {
+		return 0
+	}
+	qi, st, err := wormStatAt(dirfd, cName)
+	if err != nil || st.Mode&syscall.S_IFMT == syscall.S_IFDIR || !w.sealed(qi) {
+		return 0
+	}
+	if w.retention > 0 && time.Since(time.Unix(st.Ctim.Unix())) >= w.retention {
+		return 0
+	}
+	return syscall.EPERM
+}
+
+// wormCheckRename returns EPERM if renaming "cName" in "dirfd" to "cName2"
+// in "dirfd2" would move or replace a sealed file or a directory.
+func (rn *RootNode) wormCheckRename(dirfd int, cName string, dirfd2 int, cName2 string) syscall.Errno {
+	w := rn.worm
+	if w == nil {
+		return 0
+	}
+	moved := func(dirfd int, cName string) bool {
+		qi, st, err := wormStatAt(dirfd, cName)
+		if err != nil {
+			return false
+		}
+		// Moving a directory would move the sealed files in it
+		return st.Mode&syscall.S_IFMT == syscall.S_IFDIR || w.sealed(qi)
+	}
+	if moved(dirfd, cName) || moved(dirfd2, cName2) {
+		return syscall.EPERM
+	}
+	return 0
+}
@@ -33,12 +33,12 @@ func newTestFS(args Args) *RootNode {
 func TestEncryptDecryptXattrName(t *testing.T) {
 	fs := newTestFS(Args{})
 	attr1 := "user.foo123456789"
-	cAttr, err := fs.encryptXattrName(attr1)
+	cAttr, err := fs.branch.encryptXattrName(attr1)
 	if err != nil {
 		t.Fatal(err)
 	}
 	t.Logf("cAttr=%v", cAttr)
-	attr2, err := fs.decryptXattrName(cAttr)
+	attr2, err := fs.branch.decryptXattrName(cAttr)
 	if attr1 != attr2 || err != nil {
 		t.Fatalf("Decrypt mismatch: %v != %v", attr1, attr2)
 	}
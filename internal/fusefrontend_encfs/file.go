@@ -0,0 +1,63 @@
+package fusefrontend_encfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/encfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// File is an open file in a `gocryptfs -encfs` mount
+type File struct {
+	// Backing FD
+	fd *os.File
+	// fileIV is the decrypted IV from the file header
+	fileIV uint64
+	vol    *encfs.Volume
+	// cPath is the relative ciphertext path, for log messages
+	cPath string
+}
+
+// Read - FUSE call. Reads the blocks that cover the requested range and
+// decrypts them.
+func (f *File) Read(ctx context.Context, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	bs := int64(f.vol.BlockSize())
+	firstBlock := off / bs
+	lastBlock := (off + int64(len(buf)) + bs - 1) / bs
+	cBuf := make([]byte, (lastBlock-firstBlock)*bs)
+	n, err := f.fd.ReadAt(cBuf, int64(f.vol.HeaderLen())+firstBlock*bs)
+	if err != nil && err != io.EOF {
+		return nil, fs.ToErrno(err)
+	}
+	cBuf = cBuf[:n]
+	for i := 0; i*int(bs) < n; i++ {
+		end := (i + 1) * int(bs)
+		if end > n {
+			end = n
+		}
+		if err = f.vol.DecryptBlock(cBuf[i*int(bs):end], uint64(firstBlock)+uint64(i), f.fileIV); err != nil {
+			tlog.Warn.Printf("Read %q: block %d: %v", f.cPath, firstBlock+int64(i), err)
+			return nil, syscall.EIO
+		}
+	}
+	skip := int(off - firstBlock*bs)
+	if skip >= len(cBuf) {
+		return fuse.ReadResultData(nil), 0
+	}
+	out := cBuf[skip:]
+	if len(out) > len(buf) {
+		out = out[:len(buf)]
+	}
+	return fuse.ReadResultData(out), 0
+}
+
+// Release - FUSE call, close file
+func (f *File) Release(context.Context) syscall.Errno {
+	return fs.ToErrno(f.fd.Close())
+}
@@ -0,0 +1,15 @@
+package fusefrontend_encfs
+
+import (
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Check that we have implemented the fs.File* interfaces
+var _ = (fs.FileReader)((*File)(nil))
+var _ = (fs.FileReleaser)((*File)(nil))
+
+/* Will not implement these - EncFS volumes are mounted read-only!
+var _ = (fs.FileWriter)((*File)(nil))
+var _ = (fs.FileSetattrer)((*File)(nil))
+var _ = (fs.FileAllocater)((*File)(nil))
+*/
@@ -0,0 +1,217 @@
+package fusefrontend_encfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/encfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Node is a file or directory in the filesystem tree
+// in a `gocryptfs -encfs` mount.
+type Node struct {
+	fs.Inode
+	// cPath is the relative ciphertext path
+	cPath string
+	// iv is the chained IV of this node. The entries of a directory are
+	// encrypted with the IV of the directory.
+	iv uint64
+}
+
+// rootNode returns the Root Node of the filesystem.
+func (n *Node) rootNode() *RootNode {
+	return n.Root().Operations().(*RootNode)
+}
+
+// prepareAtSyscall returns a (dirfd, cName) pair for this node that can be
+// used with the "___at" family of system calls. The caller must close dirfd.
+func (n *Node) prepareAtSyscall() (dirfd int, cName string, errno syscall.Errno) {
+	cDir, cName := filepath.Dir(n.cPath), filepath.Base(n.cPath)
+	if n.cPath == "" {
+		// The root directory
+		cDir, cName = "", "."
+	} else if cDir == "." {
+		cDir = ""
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(n.rootNode().cipherdir, cDir)
+	if err != nil {
+		return -1, "", fs.ToErrno(err)
+	}
+	return dirfd, cName, 0
+}
+
+// translateAttr fixes the inode number, and translates the ciphertext size
+// in "out" to the plaintext size.
+func (n *Node) translateAttr(dirfd int, cName string, st *syscall.Stat_t, out *fuse.Attr) {
+	rn := n.rootNode()
+	rn.inoMap.TranslateStat(st)
+	out.FromStat(st)
+	if out.IsRegular() {
+		out.Size = rn.vol.PlainSize(out.Size)
+	} else if out.IsSymlink() {
+		target, _ := n.readlink(dirfd, cName)
+		out.Size = uint64(len(target))
+	}
+}
+
+// readlink reads and decrypts a symlink
+func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errno) {
+	cTarget, err := syscallcompat.Readlinkat(dirfd, cName)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	target, err := n.rootNode().vol.DecryptLink(cTarget)
+	if err != nil {
+		tlog.Warn.Printf("Readlink %q: %v", filepath.Join(n.cPath, cName), err)
+		return nil, syscall.EIO
+	}
+	return []byte(target), 0
+}
+
+// Lookup - FUSE call for discovering a file.
+func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	rn := n.rootNode()
+	cName, iv, err := rn.vol.EncryptName(name, n.iv)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(rn.cipherdir, n.cPath)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	defer syscall.Close(dirfd)
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	child := &Node{
+		cPath: filepath.Join(n.cPath, cName),
+		iv:    iv,
+	}
+	n.translateAttr(dirfd, cName, st, &out.Attr)
+	id := fs.StableAttr{
+		Mode: uint32(st.Mode),
+		Gen:  1,
+		Ino:  st.Ino,
+	}
+	return n.NewInode(ctx, child, id), 0
+}
+
+// Getattr - FUSE call for stat()ing a file.
+func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	dirfd, cName, errno := n.prepareAtSyscall()
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(dirfd)
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	n.translateAttr(dirfd, cName, st, &out.Attr)
+	return 0
+}
+
+// Readlink - FUSE call.
+func (n *Node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(dirfd)
+	return n.readlink(dirfd, cName)
+}
+
+// Readdir - FUSE call. Entries whose names cannot be decrypted, like the
+// EncFS config file, are skipped.
+func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	rn := n.rootNode()
+	dirfd, err := syscallcompat.OpenDirNofollow(rn.cipherdir, n.cPath)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	defer syscall.Close(fd)
+	cEntries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	entries := make([]fuse.DirEntry, 0, len(cEntries))
+	for _, e := range cEntries {
+		name, _, err := rn.vol.DecryptName(e.Name, n.iv)
+		if err != nil {
+			if !(n.cPath == "" && e.Name == encfs.ConfDefaultName) {
+				tlog.Warn.Printf("Readdir %q: invalid entry %q: %v", n.cPath, e.Name, err)
+			}
+			continue
+		}
+		e.Name = name
+		entries = append(entries, e)
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+// Open - FUSE call. Open already-existing file.
+func (n *Node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	dirfd, cName, errno := n.prepareAtSyscall()
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		f.Close()
+		return nil, 0, fs.ToErrno(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		f.Close()
+		return nil, 0, syscall.EACCES
+	}
+	vol := n.rootNode().vol
+	// Empty files have no header
+	var fileIV uint64
+	if hLen := vol.HeaderLen(); st.Size > 0 && hLen > 0 {
+		header := make([]byte, hLen)
+		if _, err = f.ReadAt(header, 0); err == nil {
+			fileIV, err = vol.FileIV(header)
+		}
+		if err != nil {
+			tlog.Warn.Printf("Open %q: reading the file header failed: %v", n.cPath, err)
+			f.Close()
+			return nil, 0, syscall.EIO
+		}
+	}
+	return &File{fd: f, fileIV: fileIV, vol: vol, cPath: n.cPath}, 0, 0
+}
+
+// Statfs - FUSE call. Returns information about the filesystem.
+func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(n.rootNode().cipherdir, &st); err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromStatfsT(&st)
+	return 0
+}
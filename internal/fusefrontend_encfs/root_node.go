@@ -0,0 +1,47 @@
+// Package fusefrontend_encfs presents the decrypted, read-only view of an
+// EncFS volume ("gocryptfs -encfs").
+package fusefrontend_encfs
+
+import (
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/encfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// RootNode is the root directory in a `gocryptfs -encfs` mount
+type RootNode struct {
+	Node
+	// cipherdir is the EncFS volume
+	cipherdir string
+	// vol decrypts names and file contents
+	vol *encfs.Volume
+	// inoMap translates inode numbers from different devices to unique inode
+	// numbers.
+	inoMap *inomap.InoMap
+}
+
+// NewRootNode returns a read-only FUSE filesystem that decrypts the EncFS
+// volume in "cipherdir"
+func NewRootNode(cipherdir string, vol *encfs.Volume) *RootNode {
+	var rootDev uint64
+	var st syscall.Stat_t
+	if err := syscall.Stat(cipherdir, &st); err != nil {
+		tlog.Warn.Printf("Could not stat backing directory %q: %v", cipherdir, err)
+	} else {
+		rootDev = uint64(st.Dev)
+	}
+	return &RootNode{
+		cipherdir: cipherdir,
+		vol:       vol,
+		inoMap:    inomap.New(rootDev),
+	}
+}
+
+// Chrooted is called by main.doMount() after it has chrooted into the
+// backing directory ("-sandbox-user"), before the first FUSE request is
+// served.
+func (rn *RootNode) Chrooted() {
+	rn.cipherdir = "/"
+}
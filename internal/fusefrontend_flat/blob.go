@@ -0,0 +1,154 @@
+package fusefrontend_flat
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+)
+
+// blob encrypts and decrypts the contents of an open blob. The caller must
+// hold the contentLock of the node.
+type blob struct {
+	fd         blobFile
+	contentEnc *contentenc.ContentEnc
+}
+
+// header returns the file header, or nil if the blob is empty
+func (b blob) header() (*contentenc.FileHeader, error) {
+	buf := make([]byte, contentenc.HeaderLen)
+	n, err := b.fd.ReadAt(buf, 0)
+	if n == 0 && err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return contentenc.ParseHeader(buf, b.contentEnc.HeaderFeatures())
+}
+
+// plainSize returns the plaintext size
+func (b blob) plainSize() (uint64, error) {
+	size, err := b.fd.size()
+	if err != nil {
+		return 0, err
+	}
+	return b.contentEnc.CipherSizeToPlainSize(uint64(size)), nil
+}
+
+// readAt returns up to "length" bytes of plaintext at "off"
+func (b blob) readAt(off uint64, length uint64) ([]byte, error) {
+	h, err := b.header()
+	if err != nil || h == nil || length == 0 {
+		return nil, err
+	}
+	blocks := b.contentEnc.ExplodePlainRange(off, length)
+	first := blocks[0]
+	cBuf := make([]byte, uint64(len(blocks))*b.contentEnc.CipherBS())
+	n, err := b.fd.ReadAt(cBuf, int64(first.BlockCipherOff()))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	plain, err := b.contentEnc.DecryptBlocks(cBuf[:n], first.BlockNo, h.ID)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	if first.Skip >= uint64(len(plain)) {
+		return nil, nil
+	}
+	plain = plain[first.Skip:]
+	if uint64(len(plain)) > length {
+		plain = plain[:length]
+	}
+	return plain, nil
+}
+
+// writeBlocks encrypts the plaintext blocks and writes them, starting at
+// block "firstBlockNo"
+func (b blob) writeBlocks(h *contentenc.FileHeader, blocks [][]byte, firstBlockNo uint64) error {
+	cBuf := b.contentEnc.EncryptBlocks(blocks, firstBlockNo, h.ID)
+	_, err := b.fd.WriteAt(cBuf, int64(b.contentEnc.BlockNoToCipherOff(firstBlockNo)))
+	b.contentEnc.CReqPool.Put(cBuf)
+	return err
+}
+
+// writeAt writes "data" at "off". Writing past the end creates a file hole.
+func (b blob) writeAt(data []byte, off uint64) error {
+	if len(data) == 0 {
+		return nil
+	}
+	h, err := b.header()
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		h = contentenc.RandomHeader()
+		if _, err = b.fd.WriteAt(h.Pack(), 0); err != nil {
+			return err
+		}
+	}
+	size, err := b.plainSize()
+	if err != nil {
+		return err
+	}
+	bs := b.contentEnc.PlainBS()
+	// Only the last block can be partial. Pad it if we write past it.
+	if lastNo := (size - 1) / bs; size%bs != 0 && off/bs > lastNo {
+		last, err := b.readAt(lastNo*bs, bs)
+		if err != nil {
+			return err
+		}
+		padded := make([]byte, bs)
+		copy(padded, last)
+		if err = b.writeBlocks(h, [][]byte{padded}, lastNo); err != nil {
+			return err
+		}
+	}
+	var blocks [][]byte
+	intra := b.contentEnc.ExplodePlainRange(off, uint64(len(data)))
+	for _, ib := range intra {
+		part := data[:ib.Length]
+		data = data[ib.Length:]
+		if !ib.IsPartial() {
+			blocks = append(blocks, part)
+			continue
+		}
+		old, err := b.readAt(ib.BlockPlainOff(), bs)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, b.contentEnc.MergeBlocks(old, part, int(ib.Skip)))
+	}
+	return b.writeBlocks(h, blocks, intra[0].BlockNo)
+}
+
+// truncate changes the plaintext size to "newSize"
+func (b blob) truncate(newSize uint64) error {
+	size, err := b.plainSize()
+	if err != nil || newSize == size {
+		return err
+	}
+	if newSize == 0 {
+		return b.fd.Truncate(0)
+	}
+	if newSize > size {
+		// Writing the last byte pads the old last block and leaves a hole
+		// in between
+		return b.writeAt([]byte{0}, newSize-1)
+	}
+	bs := b.contentEnc.PlainBS()
+	if newSize%bs != 0 {
+		lastNo := (newSize - 1) / bs
+		last, err := b.readAt(lastNo*bs, newSize-lastNo*bs)
+		if err != nil {
+			return err
+		}
+		h, err := b.header()
+		if err != nil {
+			return err
+		}
+		if err = b.writeBlocks(h, [][]byte{last}, lastNo); err != nil {
+			return err
+		}
+	}
+	return b.fd.Truncate(int64(b.contentEnc.PlainSizeToCipherSize(newSize)))
+}
@@ -0,0 +1,150 @@
+package fusefrontend_flat
+
+import (
+	"errors"
+	"sort"
+)
+
+// Compact moves the blobs and the index of a "-container" image towards its
+// start and shrinks the container file to the used part. It must not run
+// while the filesystem is mounted. Returns the old and the new size of the
+// container in bytes.
+func (rn *RootNode) Compact() (oldSize int64, newSize int64, err error) {
+	im, ok := rn.store.(*imageStore)
+	if !ok || im.maxUnits == 0 {
+		return 0, 0, errors.New("only containers created with -container can be compacted")
+	}
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return im.compact(rn.idx)
+}
+
+// compact moves blobs down into free units until no blob can be moved any
+// more, saving the index after every move, so that the units it freed can
+// be used by the next one. Then the unused units at the end are cut off.
+func (im *imageStore) compact(idx *index) (oldSize int64, newSize int64, err error) {
+	oldSize = int64(im.units * unitSize)
+	var files []*entry
+	walkEntries(idx.Root, func(e *entry) {
+		if e.isRegular() && len(e.Extents) > 0 {
+			files = append(files, e)
+		}
+	})
+	for {
+		// Move the blobs at the end first
+		sort.Slice(files, func(i, j int) bool { return lastUnit(files[i].Extents) > lastUnit(files[j].Extents) })
+		moved := false
+		for _, e := range files {
+			ok, err := im.moveDown(e)
+			if err != nil {
+				return oldSize, oldSize, err
+			}
+			if !ok {
+				continue
+			}
+			moved = true
+			if err = im.saveIndex(idx); err != nil {
+				return oldSize, oldSize, err
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+	// The index may still be behind free units
+	im.cursor = firstUnit
+	if err = im.saveIndex(idx); err != nil {
+		return oldSize, oldSize, err
+	}
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	units := uint64(MinImageSize / unitSize)
+	for u := im.units; u > units; u-- {
+		if im.isUsed(u - 1) {
+			units = u
+			break
+		}
+	}
+	if units < im.units {
+		if err = im.fd.Truncate(int64(units * unitSize)); err != nil {
+			return oldSize, oldSize, err
+		}
+		if err = im.fd.Sync(); err != nil {
+			return oldSize, oldSize, err
+		}
+		im.free -= im.units - units
+		im.units = units
+	}
+	return oldSize, int64(im.units * unitSize), nil
+}
+
+// lastUnit returns the unit after the last unit in "exts"
+func lastUnit(exts []extent) (last uint64) {
+	for _, ext := range exts {
+		if ext.Start+ext.Len > last {
+			last = ext.Start + ext.Len
+		}
+	}
+	return last
+}
+
+// moveDown copies the blob of "e" to the lowest free units, if that moves
+// its end towards the start of the image. The old units are released after
+// the next index save. Returns false if the blob stays where it is.
+func (im *imageStore) moveDown(e *entry) (bool, error) {
+	im.mu.Lock()
+	old := e.Extents
+	n := unitCount(old)
+	if n > im.free {
+		// Do not grow the container
+		im.mu.Unlock()
+		return false, nil
+	}
+	im.cursor = firstUnit
+	exts, err := im.alloc(n, 0)
+	if err != nil {
+		im.mu.Unlock()
+		return false, err
+	}
+	if lastUnit(exts) >= lastUnit(old) {
+		im.release(exts)
+		im.mu.Unlock()
+		return false, nil
+	}
+	im.mu.Unlock()
+
+	buf := make([]byte, 1<<20)
+	total := n * unitSize
+	for off := uint64(0); off < total; off += uint64(len(buf)) {
+		length := total - off
+		if length > uint64(len(buf)) {
+			length = uint64(len(buf))
+		}
+		for _, r := range mapRange(old, off, length) {
+			if _, err = im.fd.ReadAt(buf[r.bufOff:r.bufOff+r.len], r.off); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			for _, r := range mapRange(exts, off, length) {
+				if _, err = im.fd.WriteAt(buf[r.bufOff:r.bufOff+r.len], r.off); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			im.mu.Lock()
+			im.release(exts)
+			im.mu.Unlock()
+			return false, err
+		}
+	}
+
+	im.mu.Lock()
+	e.Extents = exts
+	im.pending = append(im.pending, old...)
+	im.changed = true
+	im.mu.Unlock()
+	return true, nil
+}
@@ -0,0 +1,81 @@
+package fusefrontend_flat
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// File is an open file in a `gocryptfs -flat` mount
+type File struct {
+	// fd is the open blob
+	fd   blobFile
+	node *Node
+}
+
+// blob returns the encrypted view of the backing FD
+func (f *File) blob() blob {
+	return blob{f.fd, f.node.rootNode().contentEnc}
+}
+
+// Read - FUSE call
+func (f *File) Read(ctx context.Context, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.node.contentLock.Lock()
+	defer f.node.contentLock.Unlock()
+	out, err := f.blob().readAt(uint64(off), uint64(len(buf)))
+	if err != nil {
+		tlog.Warn.Printf("ino%d: Read at %d: %v", f.node.e.Num, off, err)
+		return nil, fs.ToErrno(err)
+	}
+	return fuse.ReadResultData(out), 0
+}
+
+// Write - FUSE call
+func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.node.contentLock.Lock()
+	defer f.node.contentLock.Unlock()
+	if err := f.blob().writeAt(data, uint64(off)); err != nil {
+		if !syscallcompat.IsENOSPC(err) {
+			tlog.Warn.Printf("ino%d: Write at %d: %v", f.node.e.Num, off, err)
+		}
+		return 0, fs.ToErrno(err)
+	}
+	return uint32(len(data)), 0
+}
+
+// Flush - FUSE call. Blobs are written synchronously, so there is nothing
+// to do, except saving the index if the size or location of the blob has
+// changed (-image).
+func (f *File) Flush(ctx context.Context) syscall.Errno {
+	return f.flushIndex()
+}
+
+// Fsync - FUSE call
+func (f *File) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	if err := f.fd.Sync(); err != nil {
+		return fs.ToErrno(err)
+	}
+	return f.flushIndex()
+}
+
+// Release - FUSE call, close file
+func (f *File) Release(context.Context) syscall.Errno {
+	if err := f.fd.Close(); err != nil {
+		return fs.ToErrno(err)
+	}
+	return f.flushIndex()
+}
+
+// flushIndex calls RootNode.flushIndex and logs errors
+func (f *File) flushIndex() syscall.Errno {
+	if err := f.node.rootNode().flushIndex(); err != nil {
+		tlog.Warn.Printf("saving the index failed: %v", err)
+		return syscall.EIO
+	}
+	return 0
+}
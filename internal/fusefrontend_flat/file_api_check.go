@@ -0,0 +1,16 @@
+package fusefrontend_flat
+
+import (
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Check that we have implemented the fs.File* interfaces
+var _ = (fs.FileReader)((*File)(nil))
+var _ = (fs.FileWriter)((*File)(nil))
+var _ = (fs.FileFlusher)((*File)(nil))
+var _ = (fs.FileFsyncer)((*File)(nil))
+var _ = (fs.FileReleaser)((*File)(nil))
+
+/* Not implemented yet
+var _ = (fs.FileAllocater)((*File)(nil))
+*/
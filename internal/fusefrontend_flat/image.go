@@ -0,0 +1,734 @@
+package fusefrontend_flat
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// ImageName is the image in CIPHERDIR that holds the index and the blobs of
+// a filesystem created with "-image", "-image_size" or "-container". It is a
+// regular file, or a symlink to a block device or to the container file.
+const ImageName = "gocryptfs.image"
+
+const (
+	// unitSize is the allocation unit of the image
+	unitSize = 4096
+	// slotSize is the size of each of the two superblock slots at the start
+	// of the image
+	slotSize = 64 * 1024
+	// firstUnit is the first unit after the superblock slots
+	firstUnit = 2 * slotSize / unitSize
+	// MinImageSize is the smallest image that can be used. It holds the
+	// superblocks and one MiB of data.
+	MinImageSize = 2*slotSize + 1<<20
+)
+
+// superblockAD is the additional data of the encrypted superblocks
+var superblockAD = []byte("gocryptfs.image superblock")
+
+// errEmptySlot is returned by readSlot() for a superblock slot that has
+// never been written
+var errEmptySlot = errors.New("empty superblock slot")
+
+// extent is a run of consecutive units in the image
+type extent struct {
+	Start uint64
+	Len   uint64
+}
+
+// superblock points to the current index. It is written alternately to the
+// two slots, so that a torn write leaves the previous one intact.
+type superblock struct {
+	// Gen is incremented on every index save. The valid slot with the
+	// highest Gen is the current one.
+	Gen uint64
+	// Len is the length of the encrypted index, which is stored in Extents
+	Len     uint64
+	Extents []extent
+}
+
+// imageStore keeps the index and the blobs in a fixed-size image file or
+// block device. The storage below only sees a file of constant size, so the
+// number and the sizes of the files are not visible. They are visible in
+// the pattern of changed units, though. A "-container" image is a file that
+// grows when it is full, up to a limit, and is shrunk by compact().
+//
+// The image starts with two superblock slots, followed by the units that
+// hold the encrypted index and the blobs. The allocation table is not
+// stored, it is rebuilt from the index on mount. Freed units are only
+// reused after the next index save, as the index on disk references them
+// until then.
+type imageStore struct {
+	fd         *os.File
+	contentEnc *contentenc.ContentEnc
+	aead       cipher.AEAD
+	// units is the number of units in the image
+	units uint64
+	// maxUnits is the number of units a container may grow to. Zero for
+	// fixed-size images.
+	maxUnits uint64
+	// mu protects the fields below, and Size, Extents and the Mtime of the
+	// regular file entries
+	mu sync.Mutex
+	// used is the allocation table, one bit per unit
+	used []uint64
+	// free is the number of free units
+	free uint64
+	// cursor is where the next allocation starts searching
+	cursor uint64
+	// pending are freed units that the index on disk still references
+	pending []extent
+	// sb is the current superblock, and slot the slot it is stored in
+	sb   superblock
+	slot int
+	// changed is set when a blob has changed since the last index save
+	changed bool
+	// openCount counts the open blobs of each entry. removed marks the
+	// entries that have been deleted while they were open.
+	openCount map[*entry]int
+	removed   map[*entry]bool
+}
+
+// openImage opens the image at "path". It grows up to "maxSize" bytes if
+// that is not zero. The index is read by loadIndex().
+func openImage(path string, contentEnc *contentenc.ContentEnc, aead cipher.AEAD, maxSize uint64) (*imageStore, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Seek also works for block devices, where Stat returns size zero
+	size, err := fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if size < MinImageSize {
+		fd.Close()
+		return nil, fmt.Errorf("%s: image is too small (%d bytes, minimum is %d)", path, size, MinImageSize)
+	}
+	units := uint64(size) / unitSize
+	return &imageStore{
+		fd:         fd,
+		contentEnc: contentEnc,
+		aead:       aead,
+		units:      units,
+		maxUnits:   maxSize / unitSize,
+		free:       units,
+		used:       make([]uint64, (units+63)/64),
+		cursor:     firstUnit,
+		openCount:  make(map[*entry]int),
+		removed:    make(map[*entry]bool),
+	}, nil
+}
+
+// FormatImage clears the superblock slots of the image at "path", so that
+// the first mount starts with an empty filesystem
+func FormatImage(path string) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	size, err := fd.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < MinImageSize {
+		return fmt.Errorf("%s: image is too small (%d bytes, minimum is %d)", path, size, MinImageSize)
+	}
+	if _, err = fd.WriteAt(make([]byte, 2*slotSize), 0); err != nil {
+		return err
+	}
+	return fd.Sync()
+}
+
+// readSlot reads and decrypts superblock slot "slot"
+func (im *imageStore) readSlot(slot int) (*superblock, error) {
+	buf := make([]byte, slotSize)
+	if _, err := im.fd.ReadAt(buf, int64(slot)*slotSize); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(buf, make([]byte, slotSize)) {
+		return nil, errEmptySlot
+	}
+	n := binary.BigEndian.Uint32(buf)
+	nonceLen := im.aead.NonceSize()
+	if n < uint32(nonceLen) || n > slotSize-4 {
+		return nil, fmt.Errorf("superblock %d: invalid length %d", slot, n)
+	}
+	sealed := buf[4 : 4+n]
+	plain, err := im.aead.Open(nil, sealed[:nonceLen], sealed[nonceLen:], superblockAD)
+	if err != nil {
+		return nil, fmt.Errorf("superblock %d: decryption failed: %v", slot, err)
+	}
+	var sb superblock
+	if err = gob.NewDecoder(bytes.NewReader(plain)).Decode(&sb); err != nil {
+		return nil, fmt.Errorf("superblock %d: %v", slot, err)
+	}
+	return &sb, nil
+}
+
+// writeSlot encrypts "sb" and writes it to slot "slot"
+func (im *imageStore) writeSlot(slot int, sb *superblock) error {
+	var plain bytes.Buffer
+	if err := gob.NewEncoder(&plain).Encode(sb); err != nil {
+		return err
+	}
+	nonce := cryptocore.RandBytes(im.aead.NonceSize())
+	sealed := im.aead.Seal(nonce, nonce, plain.Bytes(), superblockAD)
+	if len(sealed) > slotSize-4 {
+		return fmt.Errorf("superblock too big: the index is split into %d extents", len(sb.Extents))
+	}
+	buf := make([]byte, slotSize)
+	binary.BigEndian.PutUint32(buf, uint32(len(sealed)))
+	copy(buf[4:], sealed)
+	_, err := im.fd.WriteAt(buf, int64(slot)*slotSize)
+	return err
+}
+
+// loadIndex reads the index the newest valid superblock points to, and
+// rebuilds the allocation table. Returns nil if both superblock slots are
+// empty, which means that the image is new.
+func (im *imageStore) loadIndex() (*index, error) {
+	var sbs []*superblock
+	var slots []int
+	var lastErr error
+	for slot := 0; slot < 2; slot++ {
+		sb, err := im.readSlot(slot)
+		if err == errEmptySlot {
+			continue
+		} else if err != nil {
+			lastErr = err
+			continue
+		}
+		sbs = append(sbs, sb)
+		slots = append(slots, slot)
+	}
+	if len(sbs) == 0 {
+		if lastErr != nil {
+			return nil, fmt.Errorf("%s: %v", ImageName, lastErr)
+		}
+		// New image. The first save goes to slot 0.
+		im.slot = 1
+		im.markUsed(extent{0, firstUnit})
+		return nil, nil
+	}
+	if len(sbs) == 2 && sbs[1].Gen > sbs[0].Gen {
+		sbs[0], sbs[1] = sbs[1], sbs[0]
+		slots[0], slots[1] = slots[1], slots[0]
+	}
+	// Fall back to the older index if the newer one cannot be read
+	for i, sb := range sbs {
+		var idx *index
+		idx, lastErr = im.readIndex(sb)
+		if lastErr != nil {
+			continue
+		}
+		if lastErr = im.buildTable(sb, idx); lastErr != nil {
+			break
+		}
+		im.sb, im.slot = *sb, slots[i]
+		return idx, nil
+	}
+	return nil, fmt.Errorf("%s: %v", ImageName, lastErr)
+}
+
+// readIndex reads and decrypts the index "sb" points to
+func (im *imageStore) readIndex(sb *superblock) (*index, error) {
+	var total uint64
+	for _, ext := range sb.Extents {
+		if ext.Start < firstUnit || ext.Start+ext.Len > im.units || ext.Start+ext.Len < ext.Start {
+			return nil, fmt.Errorf("index: extent %v outside of the image", ext)
+		}
+		total += ext.Len
+	}
+	if sb.Len > total*unitSize {
+		return nil, fmt.Errorf("index: length %d exceeds its extents", sb.Len)
+	}
+	buf := make([]byte, sb.Len)
+	for _, r := range mapRange(sb.Extents, 0, sb.Len) {
+		if _, err := im.fd.ReadAt(buf[r.bufOff:r.bufOff+r.len], r.off); err != nil {
+			return nil, err
+		}
+	}
+	return openIndex(im.aead, buf)
+}
+
+// buildTable marks the superblocks, the index and all blobs as used
+func (im *imageStore) buildTable(sb *superblock, idx *index) error {
+	for i := range im.used {
+		im.used[i] = 0
+	}
+	im.free = im.units
+	im.markUsed(extent{0, firstUnit})
+	var err error
+	mark := func(owner string, exts []extent) {
+		for _, ext := range exts {
+			if err != nil {
+				return
+			}
+			if ext.Start < firstUnit || ext.Start+ext.Len > im.units || ext.Start+ext.Len < ext.Start {
+				err = fmt.Errorf("%s: extent %v outside of the image", owner, ext)
+				return
+			}
+			for u := ext.Start; u < ext.Start+ext.Len; u++ {
+				if im.isUsed(u) {
+					err = fmt.Errorf("%s: unit %d is used twice", owner, u)
+					return
+				}
+			}
+			im.markUsed(ext)
+		}
+	}
+	mark("index", sb.Extents)
+	walkEntries(idx.Root, func(e *entry) {
+		if e.isRegular() {
+			mark(fmt.Sprintf("ino%d", e.Num), e.Extents)
+		}
+	})
+	return err
+}
+
+// walkEntries calls "fn" for "e" and everything below it
+func walkEntries(e *entry, fn func(*entry)) {
+	fn(e)
+	for _, c := range e.Children {
+		walkEntries(c, fn)
+	}
+}
+
+func (im *imageStore) isUsed(u uint64) bool {
+	return im.used[u/64]&(1<<(u%64)) != 0
+}
+
+// markUsed marks the units of "ext" as used. The caller must hold im.mu.
+func (im *imageStore) markUsed(ext extent) {
+	for u := ext.Start; u < ext.Start+ext.Len; u++ {
+		im.used[u/64] |= 1 << (u % 64)
+	}
+	im.free -= ext.Len
+}
+
+// release marks the units of "exts" as free. The caller must hold im.mu.
+func (im *imageStore) release(exts []extent) {
+	for _, ext := range exts {
+		for u := ext.Start; u < ext.Start+ext.Len; u++ {
+			im.used[u/64] &^= 1 << (u % 64)
+		}
+		im.free += ext.Len
+	}
+}
+
+// alloc allocates "n" units. It tries to continue at unit "hint", so that a
+// growing blob stays in one extent. The caller must hold im.mu.
+func (im *imageStore) alloc(n uint64, hint uint64) ([]extent, error) {
+	if n > im.free {
+		if err := im.grow(n - im.free); err != nil {
+			return nil, err
+		}
+	}
+	u := hint
+	if u < firstUnit || u >= im.units || im.isUsed(u) {
+		u = im.cursor
+	}
+	var out []extent
+	for n > 0 {
+		// Find the next free unit, wrapping around at the end. There is
+		// one, because n <= im.free.
+		for u >= im.units || im.isUsed(u) {
+			u++
+			if u >= im.units {
+				u = firstUnit
+			}
+		}
+		ext := extent{Start: u}
+		for n > 0 && u < im.units && !im.isUsed(u) {
+			ext.Len++
+			n--
+			u++
+		}
+		im.markUsed(ext)
+		out = appendExtents(out, ext)
+	}
+	im.cursor = u
+	return out, nil
+}
+
+// grow enlarges a container by at least "need" units. It grows by an eighth
+// of its size at once, so that a growing container is not extended on every
+// write. The caller must hold im.mu.
+func (im *imageStore) grow(need uint64) error {
+	if im.units+need > im.maxUnits {
+		return syscall.ENOSPC
+	}
+	add := im.units / 8
+	if add < need {
+		add = need
+	}
+	if im.units+add > im.maxUnits {
+		add = im.maxUnits - im.units
+	}
+	if err := im.fd.Truncate(int64((im.units + add) * unitSize)); err != nil {
+		return err
+	}
+	im.units += add
+	im.free += add
+	for uint64(len(im.used))*64 < im.units {
+		im.used = append(im.used, 0)
+	}
+	return nil
+}
+
+// appendExtents appends "add" to "exts", merging adjacent extents
+func appendExtents(exts []extent, add ...extent) []extent {
+	for _, ext := range add {
+		if last := len(exts) - 1; last >= 0 && exts[last].Start+exts[last].Len == ext.Start {
+			exts[last].Len += ext.Len
+			continue
+		}
+		exts = append(exts, ext)
+	}
+	return exts
+}
+
+// unitCount returns the number of units in "exts"
+func unitCount(exts []extent) (n uint64) {
+	for _, ext := range exts {
+		n += ext.Len
+	}
+	return n
+}
+
+// cutExtents keeps the first "keep" units of "exts" and returns the rest
+// separately
+func cutExtents(exts []extent, keep uint64) (kept []extent, cut []extent) {
+	for _, ext := range exts {
+		switch {
+		case keep >= ext.Len:
+			kept = append(kept, ext)
+			keep -= ext.Len
+		case keep > 0:
+			kept = append(kept, extent{ext.Start, keep})
+			cut = append(cut, extent{ext.Start + keep, ext.Len - keep})
+			keep = 0
+		default:
+			cut = append(cut, ext)
+		}
+	}
+	return kept, cut
+}
+
+// physRange is a part of a byte range that is contiguous in the image
+type physRange struct {
+	// off is the offset in the image, bufOff the offset in the byte range
+	off    int64
+	bufOff uint64
+	len    uint64
+}
+
+// mapRange translates "length" bytes at offset "off" of a blob stored in
+// "exts" to ranges in the image. The extents must cover the range.
+func mapRange(exts []extent, off uint64, length uint64) (out []physRange) {
+	var bufOff uint64
+	var extOff uint64
+	for _, ext := range exts {
+		extLen := ext.Len * unitSize
+		if length > 0 && off < extOff+extLen {
+			skip := off - extOff
+			n := extLen - skip
+			if n > length {
+				n = length
+			}
+			out = append(out, physRange{
+				off:    int64(ext.Start*unitSize + skip),
+				bufOff: bufOff,
+				len:    n,
+			})
+			off += n
+			bufOff += n
+			length -= n
+		}
+		extOff += extLen
+	}
+	return out
+}
+
+// saveIndex writes the index to newly allocated units, and then the
+// superblock that points to it to the other slot. Only then are the units
+// of the previous index and the units freed since then released.
+func (im *imageStore) saveIndex(idx *index) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	buf, err := sealIndex(im.aead, idx)
+	if err != nil {
+		return err
+	}
+	exts, err := im.alloc((uint64(len(buf))+unitSize-1)/unitSize, 0)
+	if err != nil {
+		return err
+	}
+	for _, r := range mapRange(exts, 0, uint64(len(buf))) {
+		if _, err = im.fd.WriteAt(buf[r.bufOff:r.bufOff+r.len], r.off); err != nil {
+			im.release(exts)
+			return err
+		}
+	}
+	if err = im.fd.Sync(); err != nil {
+		im.release(exts)
+		return err
+	}
+	sb := superblock{Gen: im.sb.Gen + 1, Len: uint64(len(buf)), Extents: exts}
+	slot := 1 - im.slot
+	if err = im.writeSlot(slot, &sb); err == nil {
+		err = im.fd.Sync()
+	}
+	if err != nil {
+		// The new superblock may or may not be on disk. Keep both indexes.
+		im.pending = append(im.pending, exts...)
+		return err
+	}
+	im.release(im.sb.Extents)
+	im.release(im.pending)
+	im.sb, im.slot, im.pending = sb, slot, nil
+	im.changed = false
+	return nil
+}
+
+// format does nothing: loadIndex() has already found both superblock slots
+// empty
+func (im *imageStore) format() error {
+	return nil
+}
+
+func (im *imageStore) dirty() bool {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.changed
+}
+
+// imageBlob is an open blob in the image
+type imageBlob struct {
+	im *imageStore
+	e  *entry
+}
+
+func (im *imageStore) create(e *entry) (blobFile, error) {
+	return im.open(e, true)
+}
+
+func (im *imageStore) open(e *entry, write bool) (blobFile, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.openCount[e]++
+	return &imageBlob{im, e}, nil
+}
+
+// remove frees the units of the blob, or marks it for Close() if it is open
+func (im *imageStore) remove(e *entry) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.openCount[e] > 0 {
+		im.removed[e] = true
+		return nil
+	}
+	im.pending = append(im.pending, e.Extents...)
+	e.Extents, e.Size = nil, 0
+	return nil
+}
+
+func (im *imageStore) stat(e *entry, f blobFile, out *fuse.Attr) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	out.Size = im.contentEnc.CipherSizeToPlainSize(e.Size)
+	out.Blocks = unitCount(e.Extents) * unitSize / 512
+	out.Blksize = unitSize
+	mtime := time.Unix(0, e.Mtime)
+	out.SetTimes(&mtime, &mtime, &mtime)
+	return nil
+}
+
+// setTimes sets the mtime. The atime is not stored.
+func (im *imageStore) setTimes(e *entry, a *time.Time, m *time.Time) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	e.Mtime = m.UnixNano()
+	return true, nil
+}
+
+func (im *imageStore) statfs(out *fuse.StatfsOut) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	out.Bsize = unitSize
+	out.Frsize = unitSize
+	out.Blocks = im.units - firstUnit
+	out.Bfree = im.free
+	if im.maxUnits > im.units {
+		// Report the limit of a container, not its current size
+		out.Blocks = im.maxUnits - firstUnit
+		out.Bfree += im.maxUnits - im.units
+	}
+	out.Bavail = out.Bfree
+	out.NameLen = 255
+	return nil
+}
+
+// chrooted does nothing, the image stays open
+func (im *imageStore) chrooted() {}
+
+// resize makes the blob "length" bytes at "off" long if it is shorter,
+// allocating units as needed. It returns the ranges that must be zeroed,
+// because they become part of the blob without being written.
+// The caller must hold im.mu.
+func (b *imageBlob) resize(off uint64, length uint64) (zero []physRange, err error) {
+	e := b.e
+	end := off + length
+	if have := unitCount(e.Extents); end > have*unitSize {
+		var hint uint64
+		if n := len(e.Extents); n > 0 {
+			hint = e.Extents[n-1].Start + e.Extents[n-1].Len
+		}
+		exts, err := b.im.alloc((end+unitSize-1)/unitSize-have, hint)
+		if err != nil {
+			return nil, err
+		}
+		e.Extents = appendExtents(e.Extents, exts...)
+	}
+	if off > e.Size {
+		zero = mapRange(e.Extents, e.Size, off-e.Size)
+	}
+	if end > e.Size {
+		e.Size = end
+	}
+	e.Mtime = time.Now().UnixNano()
+	b.im.changed = true
+	return zero, nil
+}
+
+// writeZero zeroes the ranges "zero" in the image
+func (im *imageStore) writeZero(zero []physRange) error {
+	buf := make([]byte, 128*1024)
+	for _, r := range zero {
+		for done := uint64(0); done < r.len; {
+			n := r.len - done
+			if n > uint64(len(buf)) {
+				n = uint64(len(buf))
+			}
+			if _, err := im.fd.WriteAt(buf[:n], r.off+int64(done)); err != nil {
+				return err
+			}
+			done += n
+		}
+	}
+	return nil
+}
+
+func (b *imageBlob) ReadAt(p []byte, off int64) (int, error) {
+	b.im.mu.Lock()
+	size := b.e.Size
+	if uint64(off) >= size {
+		b.im.mu.Unlock()
+		return 0, io.EOF
+	}
+	n := uint64(len(p))
+	if n > size-uint64(off) {
+		n = size - uint64(off)
+	}
+	ranges := mapRange(b.e.Extents, uint64(off), n)
+	b.im.mu.Unlock()
+	for _, r := range ranges {
+		if _, err := b.im.fd.ReadAt(p[r.bufOff:r.bufOff+r.len], r.off); err != nil {
+			return int(r.bufOff), err
+		}
+	}
+	if n < uint64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+func (b *imageBlob) WriteAt(p []byte, off int64) (int, error) {
+	b.im.mu.Lock()
+	zero, err := b.resize(uint64(off), uint64(len(p)))
+	ranges := mapRange(b.e.Extents, uint64(off), uint64(len(p)))
+	b.im.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if err = b.im.writeZero(zero); err != nil {
+		return 0, err
+	}
+	for _, r := range ranges {
+		if _, err := b.im.fd.WriteAt(p[r.bufOff:r.bufOff+r.len], r.off); err != nil {
+			return int(r.bufOff), err
+		}
+	}
+	return len(p), nil
+}
+
+func (b *imageBlob) size() (int64, error) {
+	b.im.mu.Lock()
+	defer b.im.mu.Unlock()
+	return int64(b.e.Size), nil
+}
+
+// Truncate shrinks or grows the blob. Units that are cut off are released
+// after the next index save.
+func (b *imageBlob) Truncate(size int64) error {
+	b.im.mu.Lock()
+	e := b.e
+	if uint64(size) >= e.Size {
+		zero, err := b.resize(uint64(size), 0)
+		b.im.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		return b.im.writeZero(zero)
+	}
+	defer b.im.mu.Unlock()
+	var cut []extent
+	e.Extents, cut = cutExtents(e.Extents, (uint64(size)+unitSize-1)/unitSize)
+	b.im.pending = append(b.im.pending, cut...)
+	e.Size = uint64(size)
+	e.Mtime = time.Now().UnixNano()
+	b.im.changed = true
+	return nil
+}
+
+func (b *imageBlob) Sync() error {
+	return b.im.fd.Sync()
+}
+
+// Close frees the units of the blob if it has been removed while open
+func (b *imageBlob) Close() error {
+	im := b.im
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.openCount[b.e]--
+	if im.openCount[b.e] > 0 {
+		return nil
+	}
+	delete(im.openCount, b.e)
+	if im.removed[b.e] {
+		delete(im.removed, b.e)
+		im.pending = append(im.pending, b.e.Extents...)
+		b.e.Extents, b.e.Size = nil, 0
+	}
+	return nil
+}
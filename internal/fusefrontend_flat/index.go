@@ -0,0 +1,149 @@
+package fusefrontend_flat
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// IndexName is the name of the encrypted directory index in CIPHERDIR. It
+// is also the additional data of the encrypted index.
+const IndexName = "gocryptfs.index"
+
+// indexVersion is incremented on incompatible changes of the index format
+const indexVersion = 1
+
+// rootNum is the number of the root directory. Numbers are never reused.
+const rootNum = 1
+
+// entry is a file, directory or symlink in the index
+type entry struct {
+	// Num is the inode number, and for regular files, the blob number
+	Num uint64
+	// Mode holds the file type and permission bits
+	Mode uint32
+	Uid  uint32
+	Gid  uint32
+	// Mtime of directories and symlinks in nanoseconds. Regular files use
+	// the times of their blob.
+	Mtime int64
+	// Target of a symlink
+	Target string
+	// Children of a directory
+	Children map[string]*entry
+	// Size is the ciphertext size of the blob, and Extents are the units it
+	// occupies. Only used in an image (-image), where regular files also
+	// use Mtime.
+	Size    uint64
+	Extents []extent
+}
+
+// isDir returns true if "e" is a directory
+func (e *entry) isDir() bool {
+	return e.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// isRegular returns true if "e" is a regular file, which has a blob
+func (e *entry) isRegular() bool {
+	return e.Mode&syscall.S_IFMT == syscall.S_IFREG
+}
+
+// index is the directory tree. It is stored with encoding/gob, because
+// file names are arbitrary bytes, which encoding/json would mangle.
+type index struct {
+	Version int
+	// Next is the number of the next new entry
+	Next uint64
+	Root *entry
+}
+
+// newNum returns a new entry number. The caller must hold rn.mu.
+func (rn *RootNode) newNum() uint64 {
+	num := rn.idx.Next
+	rn.idx.Next++
+	return num
+}
+
+// newEntry returns a new entry with the current time and the owner "uid",
+// "gid". The caller must hold rn.mu.
+func (rn *RootNode) newEntry(mode uint32, uid uint32, gid uint32) *entry {
+	e := &entry{
+		Num:   rn.newNum(),
+		Mode:  mode,
+		Uid:   uid,
+		Gid:   gid,
+		Mtime: time.Now().UnixNano(),
+	}
+	if e.isDir() {
+		e.Children = map[string]*entry{}
+	}
+	return e
+}
+
+// encode serializes the index
+func (idx *index) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(idx); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeIndex parses an index serialized by encode()
+func decodeIndex(plain []byte) (*index, error) {
+	var idx index
+	if err := gob.NewDecoder(bytes.NewReader(plain)).Decode(&idx); err != nil {
+		return nil, err
+	}
+	if idx.Version != indexVersion || idx.Root == nil || !idx.Root.isDir() {
+		return nil, fmt.Errorf("unsupported version %d", idx.Version)
+	}
+	return &idx, nil
+}
+
+// loadIndex loads the index from the store. On the first mount, an empty
+// index is created.
+func (rn *RootNode) loadIndex() error {
+	idx, err := rn.store.loadIndex()
+	if err != nil {
+		return err
+	}
+	if idx == nil {
+		return rn.createIndex()
+	}
+	rn.idx = idx
+	return nil
+}
+
+// createIndex prepares the store and saves an empty index. The root
+// directory takes the permissions and the owner of CIPHERDIR.
+func (rn *RootNode) createIndex() error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(rn.cipherdir, &st); err != nil {
+		return err
+	}
+	if err := rn.store.format(); err != nil {
+		return err
+	}
+	rn.idx = &index{Version: indexVersion, Next: rootNum}
+	rn.idx.Root = rn.newEntry(syscall.S_IFDIR|uint32(st.Mode)&07777, st.Uid, st.Gid)
+	return rn.saveIndex()
+}
+
+// saveIndex replaces the index on disk. The caller must hold rn.mu.
+func (rn *RootNode) saveIndex() error {
+	return rn.store.saveIndex(rn.idx)
+}
+
+// flushIndex saves the index if blob changes depend on it (-image). Called
+// when a file is flushed or synced.
+func (rn *RootNode) flushIndex() error {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if !rn.store.dirty() {
+		return nil
+	}
+	return rn.saveIndex()
+}
@@ -0,0 +1,420 @@
+package fusefrontend_flat
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Node is a file, directory or symlink in a `gocryptfs -flat` mount
+type Node struct {
+	fs.Inode
+	// e is the index entry. Protected by RootNode.mu.
+	e *entry
+	// contentLock serializes reads and writes of the blob
+	contentLock sync.Mutex
+}
+
+// rootNode returns the Root Node of the filesystem.
+func (n *Node) rootNode() *RootNode {
+	return n.Root().Operations().(*RootNode)
+}
+
+// caller returns the uid and gid of the process that called us
+func caller(ctx context.Context) (uid uint32, gid uint32) {
+	if c, ok := fuse.FromContext(ctx); ok {
+		return c.Uid, c.Gid
+	}
+	return uint32(os.Getuid()), uint32(os.Getgid())
+}
+
+// fillAttr fills "out" from the index entry "e". Regular files take the size
+// and the times from their blob, or from "fd" if it is not nil.
+// The caller must hold rn.mu.
+func (rn *RootNode) fillAttr(e *entry, fd blobFile, out *fuse.Attr) syscall.Errno {
+	out.Ino = e.Num
+	out.Mode = e.Mode
+	out.Uid = e.Uid
+	out.Gid = e.Gid
+	out.Nlink = 1
+	mtime := time.Unix(0, e.Mtime)
+	out.SetTimes(&mtime, &mtime, &mtime)
+	switch {
+	case e.isDir():
+		out.Nlink = 2
+		for _, c := range e.Children {
+			if c.isDir() {
+				out.Nlink++
+			}
+		}
+		out.Size = 4096
+	case e.isRegular():
+		if err := rn.store.stat(e, fd, out); err != nil {
+			tlog.Warn.Printf("ino%d: blob: %v", e.Num, err)
+			return fs.ToErrno(err)
+		}
+		out.Ino = e.Num
+		out.Mode = e.Mode
+		out.Uid = e.Uid
+		out.Gid = e.Gid
+		out.Nlink = 1
+	default:
+		out.Size = uint64(len(e.Target))
+	}
+	return 0
+}
+
+// newChild adds "e" as "name" to the directory "n", saves the index and
+// returns the new inode
+// The caller must hold rn.mu.
+func (n *Node) newChild(ctx context.Context, name string, e *entry, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	rn := n.rootNode()
+	n.e.Children[name] = e
+	n.e.Mtime = e.Mtime
+	if err := rn.saveIndex(); err != nil {
+		delete(n.e.Children, name)
+		tlog.Warn.Printf("saving the index failed: %v", err)
+		return nil, syscall.EIO
+	}
+	if errno := rn.fillAttr(e, nil, &out.Attr); errno != 0 {
+		return nil, errno
+	}
+	return n.NewInode(ctx, &Node{e: e}, fs.StableAttr{Mode: e.Mode, Ino: e.Num}), 0
+}
+
+// Lookup - FUSE call for discovering a file.
+func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	rn := n.rootNode()
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	e := n.e.Children[name]
+	if e == nil {
+		return nil, syscall.ENOENT
+	}
+	if errno := rn.fillAttr(e, nil, &out.Attr); errno != 0 {
+		return nil, errno
+	}
+	return n.NewInode(ctx, &Node{e: e}, fs.StableAttr{Mode: e.Mode, Ino: e.Num}), 0
+}
+
+// Getattr - FUSE call for stat()ing a file.
+func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	rn := n.rootNode()
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	var fd blobFile
+	if f != nil {
+		fd = f.(*File).fd
+	}
+	return rn.fillAttr(n.e, fd, &out.Attr)
+}
+
+// Setattr - FUSE call. Called for chmod, chown, truncate, utimens, ...
+func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	rn := n.rootNode()
+	if sz, ok := in.GetSize(); ok {
+		if !n.e.isRegular() {
+			return syscall.EINVAL
+		}
+		var fd blobFile
+		if f != nil {
+			fd = f.(*File).fd
+		} else {
+			var err error
+			if fd, err = rn.store.open(n.e, true); err != nil {
+				return fs.ToErrno(err)
+			}
+			defer fd.Close()
+		}
+		n.contentLock.Lock()
+		err := blob{fd, rn.contentEnc}.truncate(sz)
+		n.contentLock.Unlock()
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	changed := false
+	if mode, ok := in.GetMode(); ok {
+		n.e.Mode = n.e.Mode&syscall.S_IFMT | mode&07777
+		changed = true
+	}
+	if uid, ok := in.GetUID(); ok {
+		n.e.Uid = uid
+		changed = true
+	}
+	if gid, ok := in.GetGID(); ok {
+		n.e.Gid = gid
+		changed = true
+	}
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if n.e.isRegular() && (mok || aok) {
+		var a, m *time.Time
+		if aok {
+			a = &atime
+		}
+		if mok {
+			m = &mtime
+		}
+		save, err := rn.store.setTimes(n.e, a, m)
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		changed = changed || save
+	} else if mok {
+		n.e.Mtime = mtime.UnixNano()
+		changed = true
+	}
+	// A truncate without an open file is not followed by a flush
+	if changed || rn.store.dirty() {
+		if err := rn.saveIndex(); err != nil {
+			tlog.Warn.Printf("saving the index failed: %v", err)
+			return syscall.EIO
+		}
+	}
+	var fd blobFile
+	if f != nil {
+		fd = f.(*File).fd
+	}
+	return rn.fillAttr(n.e, fd, &out.Attr)
+}
+
+// Readdir - FUSE call.
+func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	rn := n.rootNode()
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	entries := make([]fuse.DirEntry, 0, len(n.e.Children))
+	for name, e := range n.e.Children {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: e.Mode, Ino: e.Num})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return fs.NewListDirStream(entries), 0
+}
+
+// Readlink - FUSE call.
+func (n *Node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	rn := n.rootNode()
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return []byte(n.e.Target), 0
+}
+
+// Mkdir - FUSE call.
+func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	rn := n.rootNode()
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if n.e.Children[name] != nil {
+		return nil, syscall.EEXIST
+	}
+	uid, gid := caller(ctx)
+	return n.newChild(ctx, name, rn.newEntry(syscall.S_IFDIR|mode&07777, uid, gid), out)
+}
+
+// Symlink - FUSE call.
+func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	rn := n.rootNode()
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if n.e.Children[name] != nil {
+		return nil, syscall.EEXIST
+	}
+	uid, gid := caller(ctx)
+	e := rn.newEntry(syscall.S_IFLNK|0777, uid, gid)
+	e.Target = target
+	return n.newChild(ctx, name, e, out)
+}
+
+// Create - FUSE call. Creates a new file and its blob.
+func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	rn := n.rootNode()
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	if n.e.Children[name] != nil {
+		return nil, nil, 0, syscall.EEXIST
+	}
+	uid, gid := caller(ctx)
+	e := rn.newEntry(syscall.S_IFREG|mode&07777, uid, gid)
+	fd, err := rn.store.create(e)
+	if err != nil {
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	inode, errno := n.newChild(ctx, name, e, out)
+	if errno != 0 {
+		fd.Close()
+		rn.store.remove(e)
+		return nil, nil, 0, errno
+	}
+	return inode, &File{fd: fd, node: inode.Operations().(*Node)}, 0, 0
+}
+
+// Open - FUSE call. Opens the blob of a regular file.
+func (n *Node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	rn := n.rootNode()
+	rn.mu.Lock()
+	e := n.e
+	rn.mu.Unlock()
+	if !e.isRegular() {
+		return nil, 0, syscall.EINVAL
+	}
+	// We need to read for read-modify-write, even if the caller only writes
+	fd, err := rn.store.open(e, flags&syscall.O_ACCMODE != syscall.O_RDONLY)
+	if err != nil {
+		return nil, 0, fs.ToErrno(err)
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		n.contentLock.Lock()
+		err = fd.Truncate(0)
+		n.contentLock.Unlock()
+		if err != nil {
+			fd.Close()
+			return nil, 0, fs.ToErrno(err)
+		}
+	}
+	return &File{fd: fd, node: n}, 0, 0
+}
+
+// Unlink - FUSE call. Deletes a file or symlink, and the blob of a file.
+// Open files stay usable until they are closed.
+func (n *Node) Unlink(ctx context.Context, name string) syscall.Errno {
+	rn := n.rootNode()
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	e := n.e.Children[name]
+	if e == nil {
+		return syscall.ENOENT
+	}
+	if e.isDir() {
+		return syscall.EISDIR
+	}
+	return n.removeChild(name)
+}
+
+// Rmdir - FUSE call.
+func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	rn := n.rootNode()
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	e := n.e.Children[name]
+	if e == nil {
+		return syscall.ENOENT
+	}
+	if !e.isDir() {
+		return syscall.ENOTDIR
+	}
+	if len(e.Children) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	return n.removeChild(name)
+}
+
+// removeChild removes "name" from the directory, saves the index, and
+// deletes the blob. A crash in between leaves an unused blob, but never
+// an entry without one.
+// The caller must hold rn.mu.
+func (n *Node) removeChild(name string) syscall.Errno {
+	rn := n.rootNode()
+	e := n.e.Children[name]
+	delete(n.e.Children, name)
+	oldMtime := n.e.Mtime
+	n.e.Mtime = time.Now().UnixNano()
+	if err := rn.saveIndex(); err != nil {
+		n.e.Children[name] = e
+		n.e.Mtime = oldMtime
+		tlog.Warn.Printf("saving the index failed: %v", err)
+		return syscall.EIO
+	}
+	if e.isRegular() {
+		if err := rn.store.remove(e); err != nil {
+			tlog.Warn.Printf("ino%d: deleting the blob failed: %v", e.Num, err)
+		}
+	}
+	return 0
+}
+
+// toNode returns the *Node of "op", which is a *Node or the *RootNode
+func toNode(op fs.InodeEmbedder) *Node {
+	if rn, ok := op.(*RootNode); ok {
+		return &rn.Node
+	}
+	return op.(*Node)
+}
+
+// Rename - FUSE call. Only the index changes, the blobs stay where they are.
+func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	rn := n.rootNode()
+	n2 := toNode(newParent)
+	if flags&^uint32(syscallcompat.RENAME_NOREPLACE|syscallcompat.RENAME_EXCHANGE) != 0 {
+		return syscall.EINVAL
+	}
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	e := n.e.Children[name]
+	if e == nil {
+		return syscall.ENOENT
+	}
+	replaced := n2.e.Children[newName]
+	if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+		if replaced == nil {
+			return syscall.ENOENT
+		}
+	} else if replaced != nil {
+		if flags&syscallcompat.RENAME_NOREPLACE != 0 {
+			return syscall.EEXIST
+		}
+		if replaced == e {
+			return 0
+		}
+		if e.isDir() && !replaced.isDir() {
+			return syscall.ENOTDIR
+		}
+		if !e.isDir() && replaced.isDir() {
+			return syscall.EISDIR
+		}
+		if replaced.isDir() && len(replaced.Children) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	oldMtime, oldMtime2 := n.e.Mtime, n2.e.Mtime
+	delete(n.e.Children, name)
+	if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+		n.e.Children[name] = replaced
+	}
+	n2.e.Children[newName] = e
+	now := time.Now().UnixNano()
+	n.e.Mtime, n2.e.Mtime = now, now
+	if err := rn.saveIndex(); err != nil {
+		// Undo, so the index in memory matches the one on disk
+		n2.e.Children[newName] = replaced
+		if replaced == nil {
+			delete(n2.e.Children, newName)
+		}
+		n.e.Children[name] = e
+		n.e.Mtime, n2.e.Mtime = oldMtime, oldMtime2
+		tlog.Warn.Printf("saving the index failed: %v", err)
+		return syscall.EIO
+	}
+	if flags&syscallcompat.RENAME_EXCHANGE == 0 && replaced != nil && replaced.isRegular() {
+		if err := rn.store.remove(replaced); err != nil {
+			tlog.Warn.Printf("ino%d: deleting the blob failed: %v", replaced.Num, err)
+		}
+	}
+	return 0
+}
+
+// Statfs - FUSE call. Returns information about the filesystem.
+func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	return fs.ToErrno(n.rootNode().store.statfs(out))
+}
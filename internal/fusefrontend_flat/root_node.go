@@ -0,0 +1,91 @@
+// Package fusefrontend_flat presents the decrypted view of a CIPHERDIR with
+// the flat layout ("gocryptfs -init -flat").
+//
+// Instead of mirroring the directory tree, the flat layout stores the
+// contents of every regular file in a blob in "blobs/XX/", where the blob
+// name is the encrypted blob number and XX are its first two characters.
+// Directories, names, permissions and symlinks only exist in the encrypted
+// directory index, "gocryptfs.index". Blobs use the normal gocryptfs file
+// format.
+//
+// With "-image" or "-container", the index and the blobs are stored in the
+// image "gocryptfs.image" instead, see image.go.
+package fusefrontend_flat
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"path/filepath"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// BlobDir is the directory in CIPHERDIR that holds the blobs
+const BlobDir = "blobs"
+
+// RootNode is the root directory in a `gocryptfs -flat` mount
+type RootNode struct {
+	Node
+	// cipherdir is the backing directory
+	cipherdir string
+	// contentEnc encrypts the blob contents
+	contentEnc *contentenc.ContentEnc
+	// store keeps the index and the blobs
+	store store
+	// mu protects the directory index. Every change is written to disk
+	// before it is acknowledged.
+	mu sync.Mutex
+	// idx is the directory index
+	idx *index
+}
+
+// NewRootNode loads the directory index from "cipherdir", or creates an
+// empty one on the first mount. If "image" is set, the index and the blobs
+// are in the image file ImageName, which grows up to "imageMaxSize" bytes
+// if that is not zero.
+func NewRootNode(cipherdir string, contentEnc *contentenc.ContentEnc, masterkey []byte, image bool, imageMaxSize uint64) (*RootNode, error) {
+	blobCipher, err := aes.NewCipher(cryptocore.FlatBlobKey(masterkey))
+	if err != nil {
+		return nil, err
+	}
+	indexCipher, err := aes.NewCipher(cryptocore.FlatIndexKey(masterkey))
+	if err != nil {
+		return nil, err
+	}
+	indexAEAD, err := cipher.NewGCM(indexCipher)
+	if err != nil {
+		return nil, err
+	}
+	rn := &RootNode{
+		cipherdir:  cipherdir,
+		contentEnc: contentEnc,
+	}
+	if image {
+		rn.store, err = openImage(filepath.Join(cipherdir, ImageName), contentEnc, indexAEAD, imageMaxSize)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		rn.store = &dirStore{
+			cipherdir:  cipherdir,
+			contentEnc: contentEnc,
+			indexAEAD:  indexAEAD,
+			blobCipher: blobCipher,
+		}
+	}
+	if err = rn.loadIndex(); err != nil {
+		return nil, err
+	}
+	rn.e = rn.idx.Root
+	return rn, nil
+}
+
+// Chrooted is called by main.doMount() after it has chrooted into the
+// backing directory ("-sandbox-user"), before the first FUSE request is
+// served.
+func (rn *RootNode) Chrooted() {
+	rn.cipherdir = "/"
+	rn.store.chrooted()
+}
@@ -0,0 +1,235 @@
+package fusefrontend_flat
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// blobFile is an open blob
+type blobFile interface {
+	io.ReaderAt
+	io.WriterAt
+	// size returns the ciphertext size
+	size() (int64, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// store keeps the directory index and the blobs. dirStore uses a file for
+// each of them, imageStore puts everything into a single fixed-size image.
+type store interface {
+	// loadIndex returns the index, or nil if the store is empty
+	loadIndex() (*index, error)
+	// saveIndex replaces the index on disk. The caller must hold rn.mu.
+	saveIndex(idx *index) error
+	// format prepares an empty store for the first index
+	format() error
+	// dirty returns true if blobs have changed in a way that only becomes
+	// permanent with the next saveIndex()
+	dirty() bool
+	create(e *entry) (blobFile, error)
+	open(e *entry, write bool) (blobFile, error)
+	// remove deletes the blob of "e". Open blobs stay usable until they
+	// are closed.
+	remove(e *entry) error
+	// stat fills in the size, times and block count of the blob of "e".
+	// "f" is the open blob, or nil.
+	stat(e *entry, f blobFile, out *fuse.Attr) error
+	// setTimes sets the times of the blob. Returns true if the index has
+	// to be saved.
+	setTimes(e *entry, a *time.Time, m *time.Time) (bool, error)
+	statfs(out *fuse.StatfsOut) error
+	// chrooted is called after the process has chrooted into cipherdir
+	chrooted()
+}
+
+// sealIndex encodes and encrypts the index
+func sealIndex(aead cipher.AEAD, idx *index) ([]byte, error) {
+	plain, err := idx.encode()
+	if err != nil {
+		return nil, err
+	}
+	nonce := cryptocore.RandBytes(aead.NonceSize())
+	return aead.Seal(nonce, nonce, plain, []byte(IndexName)), nil
+}
+
+// openIndex decrypts and decodes the index
+func openIndex(aead cipher.AEAD, buf []byte) (*index, error) {
+	nonceLen := aead.NonceSize()
+	if len(buf) < nonceLen {
+		return nil, fmt.Errorf("too short")
+	}
+	plain, err := aead.Open(nil, buf[:nonceLen], buf[nonceLen:], []byte(IndexName))
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %v", err)
+	}
+	return decodeIndex(plain)
+}
+
+// dirStore is the default flat layout: the index is the file
+// "gocryptfs.index", and every blob is a file in "blobs/XX/".
+type dirStore struct {
+	cipherdir  string
+	contentEnc *contentenc.ContentEnc
+	indexAEAD  cipher.AEAD
+	// blobCipher encrypts blob numbers into blob names
+	blobCipher cipher.Block
+}
+
+// dirBlob is an open blob file
+type dirBlob struct {
+	*os.File
+}
+
+func (f dirBlob) size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// blobPath returns the absolute path of the blob with number "num". The
+// blob name is the number encrypted with AES, which spreads the blobs evenly
+// over the shard directories without revealing the order they were created
+// in.
+func (s *dirStore) blobPath(num uint64) string {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:], num)
+	s.blobCipher.Encrypt(buf[:], buf[:])
+	name := hex.EncodeToString(buf[:])
+	return filepath.Join(s.cipherdir, BlobDir, name[:2], name)
+}
+
+// loadIndex reads the index. If neither the index nor the blob directory
+// exist, this is the first mount.
+func (s *dirStore) loadIndex() (*index, error) {
+	path := filepath.Join(s.cipherdir, IndexName)
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if _, err2 := os.Stat(filepath.Join(s.cipherdir, BlobDir)); err2 == nil {
+			return nil, fmt.Errorf("%s is missing", path)
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	idx, err := openIndex(s.indexAEAD, buf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return idx, nil
+}
+
+// saveIndex encrypts the index and replaces the one on disk
+func (s *dirStore) saveIndex(idx *index) error {
+	buf, err := sealIndex(s.indexAEAD, idx)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.cipherdir, IndexName)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// format creates the blob directory
+func (s *dirStore) format() error {
+	return os.Mkdir(filepath.Join(s.cipherdir, BlobDir), 0700)
+}
+
+// dirty returns false, blob files are permanent on their own
+func (s *dirStore) dirty() bool {
+	return false
+}
+
+func (s *dirStore) create(e *entry) (blobFile, error) {
+	path := s.blobPath(e.Num)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return dirBlob{fd}, nil
+}
+
+func (s *dirStore) open(e *entry, write bool) (blobFile, error) {
+	oflags := os.O_RDONLY
+	if write {
+		oflags = os.O_RDWR
+	}
+	fd, err := os.OpenFile(s.blobPath(e.Num), oflags, 0)
+	if err != nil {
+		return nil, err
+	}
+	return dirBlob{fd}, nil
+}
+
+func (s *dirStore) remove(e *entry) error {
+	return os.Remove(s.blobPath(e.Num))
+}
+
+// stat takes the size, the times and the block count from the blob file
+func (s *dirStore) stat(e *entry, f blobFile, out *fuse.Attr) error {
+	var st syscall.Stat_t
+	var err error
+	if f != nil {
+		err = syscall.Fstat(int(f.(dirBlob).Fd()), &st)
+	} else {
+		err = syscall.Stat(s.blobPath(e.Num), &st)
+	}
+	if err != nil {
+		return err
+	}
+	out.FromStat(&st)
+	out.Size = s.contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+	return nil
+}
+
+func (s *dirStore) setTimes(e *entry, a *time.Time, m *time.Time) (bool, error) {
+	return false, syscallcompat.UtimesNanoAtNofollow(-1, s.blobPath(e.Num), a, m)
+}
+
+func (s *dirStore) statfs(out *fuse.StatfsOut) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.cipherdir, &st); err != nil {
+		return err
+	}
+	out.FromStatfsT(&st)
+	return nil
+}
+
+func (s *dirStore) chrooted() {
+	s.cipherdir = "/"
+}
@@ -2,25 +2,25 @@ package fusefrontend_reverse
 
 import (
 	"io/ioutil"
-	"log"
-	"os"
 	"strings"
 
-	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
-	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 
 	"github.com/sabhiram/go-gitignore"
 )
 
 // prepareExcluder creates an object to check if paths are excluded
-// based on the patterns specified in the command line.
-func prepareExcluder(args fusefrontend.Args) *ignore.GitIgnore {
-	patterns := getExclusionPatterns(args)
-	if len(patterns) == 0 {
-		log.Panic(patterns)
+// based on the patterns specified in the command line. Returns nil if
+// nothing is excluded.
+func prepareExcluder(args fusefrontend.Args) (*ignore.GitIgnore, error) {
+	if len(args.Exclude) == 0 && len(args.ExcludeWildcard) == 0 && len(args.ExcludeFrom) == 0 {
+		return nil, nil
 	}
-	return ignore.CompileIgnoreLines(patterns...)
+	patterns, err := getExclusionPatterns(args)
+	if err != nil {
+		return nil, err
+	}
+	return ignore.CompileIgnoreLines(patterns...), nil
 }
 
 // getExclusionPatters prepares a list of patterns to be excluded.
@@ -28,7 +28,7 @@ func prepareExcluder(args fusefrontend.Args) *ignore.GitIgnore {
 // with a leading '/' to preserve backwards compatibility (before
 // wildcard matching was implemented, exclusions always were matched
 // against the full path).
-func getExclusionPatterns(args fusefrontend.Args) []string {
+func getExclusionPatterns(args fusefrontend.Args) ([]string, error) {
 	patterns := make([]string, len(args.Exclude)+len(args.ExcludeWildcard))
 	// add -exclude
 	for i, p := range args.Exclude {
@@ -40,12 +40,11 @@ func getExclusionPatterns(args fusefrontend.Args) []string {
 	for _, file := range args.ExcludeFrom {
 		lines, err := getLines(file)
 		if err != nil {
-			tlog.Fatal.Printf("Error reading exclusion patterns: %q", err)
-			os.Exit(exitcodes.ExcludeError)
+			return nil, err
 		}
 		patterns = append(patterns, lines...)
 	}
-	return patterns
+	return patterns, nil
 }
 
 // getLines reads a file and splits it into lines
@@ -56,3 +55,28 @@ func getLines(file string) ([]string, error) {
 	}
 	return strings.Split(string(buffer), "\n"), nil
 }
+
+// getExcluder returns the current excluder, or nil if nothing is excluded
+func (rn *RootNode) getExcluder() *ignore.GitIgnore {
+	e, _ := rn.excluder.Load().(*ignore.GitIgnore)
+	return e
+}
+
+// SetExcludes replaces the -exclude, -exclude-wildcard and -exclude-from
+// patterns. The files given in "excludeFrom" are read again. On error, the
+// old patterns stay in effect. As the kernel caches directory entries,
+// paths that have been looked up before may stay visible or hidden for a
+// moment.
+func (rn *RootNode) SetExcludes(exclude []string, excludeWildcard []string, excludeFrom []string) error {
+	args := fusefrontend.Args{
+		Exclude:         exclude,
+		ExcludeWildcard: excludeWildcard,
+		ExcludeFrom:     excludeFrom,
+	}
+	e, err := prepareExcluder(args)
+	if err != nil {
+		return err
+	}
+	rn.excluder.Store(e)
+	return nil
+}
@@ -16,7 +16,10 @@ func TestShouldPrefixExcludeValuesWithSlash(t *testing.T) {
 
 	expected := []string{"/file1", "/dir1/file2.txt", "*~", "build/*.o"}
 
-	patterns := getExclusionPatterns(args)
+	patterns, err := getExclusionPatterns(args)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !reflect.DeepEqual(patterns, expected) {
 		t.Errorf("expected %q, got %q", expected, patterns)
 	}
@@ -52,7 +55,10 @@ func TestShouldReadExcludePatternsFromFiles(t *testing.T) {
 	// It's ignored when the patterns are actually compiled
 	expected := []string{"cmdline1", "file1.1", "file1.2", "", "file2.1", "file2.2", ""}
 
-	patterns := getExclusionPatterns(args)
+	patterns, err := getExclusionPatterns(args)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !reflect.DeepEqual(patterns, expected) {
 		t.Errorf("expected %q, got %q", expected, patterns)
 	}
@@ -64,3 +70,26 @@ func TestShouldReturnFalseIfThereAreNoExclusions(t *testing.T) {
 		t.Error("Should not exclude any path if no exclusions were specified")
 	}
 }
+
+func TestSetExcludes(t *testing.T) {
+	var rfs RootNode
+	if err := rfs.SetExcludes([]string{"dir1"}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !rfs.isExcludedPlain("dir1/file") {
+		t.Error("dir1/file should be excluded")
+	}
+	// A missing -exclude-from file keeps the old patterns
+	if err := rfs.SetExcludes(nil, nil, []string{"/nonexistent/excludes"}); err == nil {
+		t.Error("missing -exclude-from file should fail")
+	}
+	if !rfs.isExcludedPlain("dir1/file") {
+		t.Error("dir1/file should still be excluded")
+	}
+	if err := rfs.SetExcludes(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rfs.isExcludedPlain("dir1/file") {
+		t.Error("dir1/file should not be excluded any more")
+	}
+}
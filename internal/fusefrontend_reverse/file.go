@@ -21,10 +21,13 @@ type File struct {
 	block0IV []byte
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Back pointer to the root of the filesystem
+	rootNode *RootNode
 }
 
 // Read - FUSE call
 func (f *File) Read(ctx context.Context, buf []byte, ioff int64) (resultData fuse.ReadResult, errno syscall.Errno) {
+	f.rootNode.throttle(len(buf))
 	length := uint64(len(buf))
 	off := uint64(ioff)
 	out := bytes.NewBuffer(buf[:0])
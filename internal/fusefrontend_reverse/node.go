@@ -180,6 +180,7 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		header:     header,
 		block0IV:   derivedIVs.Block0IV,
 		contentEnc: n.rootNode().contentEnc,
+		rootNode:   n.rootNode(),
 	}
 	return
 }
@@ -146,8 +146,18 @@ func (n *Node) lookupLongnameName(ctx context.Context, nameFile string, out *fus
 		errno = fs.ToErrno(err)
 		return
 	}
+	inoTag := uint8(inoTagNameFile)
+	if st.Mode&syscall.S_IFMT == syscall.S_IFREG && st.Nlink > 1 {
+		var dirSt syscall.Stat_t
+		if err = syscall.Fstat(fd, &dirSt); err != nil {
+			errno = fs.ToErrno(err)
+			return
+		}
+		st.Ino = linkNameFileIno(uint64(dirSt.Ino), nameFile)
+		inoTag = inoTagLinkNameFile
+	}
 	var vf *VirtualMemNode
-	vf, errno = n.newVirtualMemNode([]byte(cFullname), st, inoTagNameFile)
+	vf, errno = n.newVirtualMemNode([]byte(cFullname), st, inoTag)
 	if errno != 0 {
 		return nil, errno
 	}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
@@ -20,9 +21,8 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/ratelimit"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
-
-	"github.com/sabhiram/go-gitignore"
 )
 
 // RootNode is the root directory in a `gocryptfs -reverse` mount
@@ -34,8 +34,10 @@ type RootNode struct {
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
-	// Tests whether a path is excluded (hidden) from the user. Used by -exclude.
-	excluder ignore.IgnoreParser
+	// excluder holds the *ignore.GitIgnore that tests whether a path is
+	// excluded (hidden) from the user. Used by -exclude. Holds a nil pointer
+	// if nothing is excluded.
+	excluder atomic.Value
 	// inoMap translates inode numbers from different devices to unique inode
 	// numbers.
 	inoMap *inomap.InoMap
@@ -45,6 +47,8 @@ type RootNode struct {
 	// If a file name length is shorter than shortNameMax, there is no need to
 	// hash it.
 	shortNameMax int
+	// limits implements -bwlimit and -ioplimit
+	limits ratelimit.Throttle
 }
 
 // NewRootNode returns an encrypted FUSE overlay filesystem.
@@ -75,12 +79,21 @@ func NewRootNode(args fusefrontend.Args, c *contentenc.ContentEnc, n *nametransf
 		rootDev:       rootDev,
 		shortNameMax:  shortNameMax,
 	}
-	if len(args.Exclude) > 0 || len(args.ExcludeWildcard) > 0 || len(args.ExcludeFrom) > 0 {
-		rn.excluder = prepareExcluder(args)
+	rn.limits.Set(args.BwLimit, args.IOPLimit)
+	if err := rn.SetExcludes(args.Exclude, args.ExcludeWildcard, args.ExcludeFrom); err != nil {
+		tlog.Fatal.Printf("Error reading exclusion patterns: %q", err)
+		os.Exit(exitcodes.ExcludeError)
 	}
 	return rn
 }
 
+// Chrooted is called by main.doMount() after it has chrooted into the
+// backing directory ("-sandbox-user"), before the first FUSE request is
+// served.
+func (rn *RootNode) Chrooted() {
+	rn.args.Cipherdir = "/"
+}
+
 // You can pass either gocryptfs.longname.XYZ.name or gocryptfs.longname.XYZ.
 func (rn *RootNode) findLongnameParent(fd int, diriv []byte, longname string) (pName string, cFullName string, errno syscall.Errno) {
 	defer func() {
@@ -126,14 +139,15 @@ func (rn *RootNode) isExcludedPlain(pPath string) bool {
 	if pPath == "" {
 		return false
 	}
-	return rn.excluder != nil && rn.excluder.MatchesPath(pPath)
+	excluder := rn.getExcluder()
+	return excluder != nil && excluder.MatchesPath(pPath)
 }
 
 // excludeDirEntries filters out directory entries that are "-exclude"d.
 // pDir is the relative plaintext path to the directory these entries are
 // from. The entries should be plaintext files.
 func (rn *RootNode) excludeDirEntries(d *dirfdPlus, entries []fuse.DirEntry) (filtered []fuse.DirEntry) {
-	if rn.excluder == nil {
+	if rn.getExcluder() == nil {
 		return entries
 	}
 	filtered = make([]fuse.DirEntry, 0, len(entries))
@@ -149,3 +163,14 @@ func (rn *RootNode) excludeDirEntries(d *dirfdPlus, entries []fuse.DirEntry) (fi
 	}
 	return filtered
 }
+
+// throttle delays a read of "n" bytes as required by -bwlimit and -ioplimit.
+func (rn *RootNode) throttle(n int) {
+	rn.limits.Wait(uint64(n))
+}
+
+// SetRateLimits changes -bwlimit and -ioplimit of the running mount. Zero
+// means no limit.
+func (rn *RootNode) SetRateLimits(bwLimit uint64, iopLimit uint64) {
+	rn.limits.Set(bwLimit, iopLimit)
+}
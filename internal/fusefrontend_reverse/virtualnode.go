@@ -2,6 +2,8 @@ package fusefrontend_reverse
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"log"
 	"syscall"
 
@@ -21,6 +23,9 @@ const (
 	// virtual files. These are the tags we use.
 	inoTagDirIV    = 1
 	inoTagNameFile = 2
+	// inoTagLinkNameFile is used for the *.name files of hard-linked files,
+	// see linkNameFileIno
+	inoTagLinkNameFile = 3
 )
 
 type fileType int
@@ -62,6 +67,18 @@ func (n *Node) lookupFileType(cName string) fileType {
 	return typeReal
 }
 
+// linkNameFileIno returns the inode number of the ".name" file "nameFile" in
+// the directory "dirIno" that belongs to a hard-linked file. The inode number
+// of the file cannot be used, as it is the same for all links, while the
+// ".name" files are not: go-fuse would return the first one for all of them.
+// The result fits into the 48 bits inomap passes through.
+func linkNameFileIno(dirIno uint64, nameFile string) uint64 {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, dirIno)
+	h.Write([]byte(nameFile))
+	return binary.BigEndian.Uint64(h.Sum(nil)) >> 16
+}
+
 // VirtualMemNode is an in-memory node that does not have a representation
 // on disk.
 type VirtualMemNode struct {
@@ -0,0 +1,499 @@
+// Package fuselimit limits how many FUSE requests are processed at the same
+// time ("-threads"), and lets interactive requests go first. go-fuse starts a
+// new goroutine whenever all its goroutines are busy, so without a limit, a
+// burst of requests can start hundreds of goroutines that compete for the CPU
+// and the backing storage.
+//
+// Reads and writes on a file handle that has already transferred
+// streamBytes, and copy_file_range, are "bulk" requests. Everything else,
+// like metadata requests and the first reads of a document, is
+// "interactive". Bulk requests can only use half of the slots, and waiting
+// interactive requests get a free slot first, so that copying a huge file
+// does not make the rest of the mount unresponsive.
+//
+// Locking requests are not limited: SETLKW blocks until another process
+// releases its lock, and the request that releases it must not have to wait
+// for a free slot. FORGET and RELEASE are not limited either, as they only
+// free resources.
+//
+// With "-max_queue", requests that find that many others waiting fail with
+// EBUSY right away. When the backing storage stalls, this keeps thousands of
+// requests from piling up, each holding a goroutine and a buffer.
+package fuselimit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Request classes, in the order they are scheduled
+const (
+	interactive = iota
+	bulk
+	classCount
+)
+
+// streamBytes is how much a file handle reads or writes before its requests
+// are treated as bulk
+const streamBytes = 8 << 20
+
+// request is a request that is running or waiting for a slot
+type request struct {
+	class int
+	start time.Time
+	// el is the element of the request in Limiter.inflight
+	el *list.Element
+	// ready is closed when the request gets its slot
+	ready chan struct{}
+}
+
+// Limiter is a fuse.RawFileSystem that limits the requests to the
+// RawFileSystem it wraps
+type Limiter struct {
+	fuse.RawFileSystem
+	mu sync.Mutex
+	// max is the number of slots, maxBulk how many of them bulk requests
+	// may use
+	max, maxBulk int
+	// maxQueue is how many requests may wait for a slot. 0 means no limit.
+	maxQueue int
+	// running counts the requests being processed, by class
+	running [classCount]int
+	// waiting holds the requests waiting for a slot, by class, oldest first
+	waiting [classCount]*list.List
+	// inflight holds the running and the waiting requests, oldest first
+	inflight *list.List
+	// rejected counts the requests that failed with EBUSY
+	rejected uint64
+	// transferred counts the bytes read and written per file handle
+	transferred map[uint64]uint64
+}
+
+// New wraps "fs" so that at most "n" requests are processed at the same time.
+// If "maxQueue" is not 0, requests fail with EBUSY when "maxQueue" requests
+// are already waiting.
+func New(fs fuse.RawFileSystem, n int, maxQueue int) *Limiter {
+	l := &Limiter{
+		RawFileSystem: fs,
+		max:           n,
+		maxBulk:       n / 2,
+		maxQueue:      maxQueue,
+		inflight:      list.New(),
+		transferred:   make(map[uint64]uint64),
+	}
+	if l.maxBulk < 1 {
+		l.maxBulk = 1
+	}
+	for i := range l.waiting {
+		l.waiting[i] = list.New()
+	}
+	return l
+}
+
+// Stats describes the requests in the Limiter at one point in time
+type Stats struct {
+	// Running and Waiting count the requests being processed and the ones
+	// waiting for a slot
+	Running, Waiting int
+	// Oldest is the age of the oldest running or waiting request
+	Oldest time.Duration
+	// Rejected counts the requests that failed with EBUSY since the start
+	Rejected uint64
+}
+
+// Stats returns the current state of the request queue
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := Stats{
+		Running:  l.running[interactive] + l.running[bulk],
+		Waiting:  l.waiting[interactive].Len() + l.waiting[bulk].Len(),
+		Rejected: l.rejected,
+	}
+	if front := l.inflight.Front(); front != nil {
+		out.Oldest = time.Since(front.Value.(*request).start)
+	}
+	return out
+}
+
+// classify counts "n" bytes transferred on the file handle "fh" and returns
+// the class of the request
+func (l *Limiter) classify(fh uint64, n uint32) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.transferred[fh]
+	l.transferred[fh] = t + uint64(n)
+	if t >= streamBytes {
+		return bulk
+	}
+	return interactive
+}
+
+// class returns the class of a request on "fh" that transfers no data
+func (l *Limiter) class(fh uint64) int {
+	return l.classify(fh, 0)
+}
+
+// hasSlot returns true if a slot is free for a request of class "c". The
+// caller must hold l.mu.
+func (l *Limiter) hasSlot(c int) bool {
+	if l.running[interactive]+l.running[bulk] >= l.max {
+		return false
+	}
+	return c != bulk || l.running[bulk] < l.maxBulk
+}
+
+// canRun returns true if a request of class "c" may take a slot now, without
+// overtaking waiting requests of the same or a higher priority. The caller
+// must hold l.mu.
+func (l *Limiter) canRun(c int) bool {
+	for i := 0; i <= c; i++ {
+		if l.waiting[i].Len() > 0 {
+			return false
+		}
+	}
+	return l.hasSlot(c)
+}
+
+// acquire waits for a free slot for a request of class "c". Fails with EBUSY
+// if the queue is full, and with EINTR if the request has been interrupted
+// while waiting.
+func (l *Limiter) acquire(cancel <-chan struct{}, c int) (*request, fuse.Status) {
+	r := &request{class: c, start: time.Now()}
+	l.mu.Lock()
+	if l.canRun(c) {
+		l.running[c]++
+		r.el = l.inflight.PushBack(r)
+		l.mu.Unlock()
+		return r, fuse.OK
+	}
+	if l.maxQueue > 0 && l.waiting[interactive].Len()+l.waiting[bulk].Len() >= l.maxQueue {
+		l.rejected++
+		l.mu.Unlock()
+		return nil, fuse.EBUSY
+	}
+	r.ready = make(chan struct{})
+	r.el = l.inflight.PushBack(r)
+	el := l.waiting[c].PushBack(r)
+	l.mu.Unlock()
+	select {
+	case <-r.ready:
+		return r, fuse.OK
+	case <-cancel:
+	}
+	l.mu.Lock()
+	select {
+	case <-r.ready:
+		l.mu.Unlock()
+		// Got the slot at the same time, give it back
+		l.release(r)
+	default:
+		l.waiting[c].Remove(el)
+		l.inflight.Remove(r.el)
+		l.mu.Unlock()
+	}
+	return nil, fuse.EINTR
+}
+
+// release frees the slot taken by acquire() and hands it to the next
+// waiting request
+func (l *Limiter) release(r *request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running[r.class]--
+	l.inflight.Remove(r.el)
+	// Interactive requests first. If one of them is left waiting, there is
+	// no free slot for bulk requests either.
+	for next := 0; next < classCount; next++ {
+		for l.waiting[next].Len() > 0 && l.hasSlot(next) {
+			w := l.waiting[next].Remove(l.waiting[next].Front()).(*request)
+			l.running[next]++
+			close(w.ready)
+		}
+	}
+}
+
+// Release forgets the transferred bytes of the file handle
+func (l *Limiter) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+	l.mu.Lock()
+	delete(l.transferred, input.Fh)
+	l.mu.Unlock()
+	l.RawFileSystem.Release(cancel, input)
+}
+
+func (l *Limiter) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (l *Limiter) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (l *Limiter) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (l *Limiter) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (l *Limiter) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (l *Limiter) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (l *Limiter) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (l *Limiter) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (l *Limiter) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (l *Limiter) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (l *Limiter) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return nil, st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Readlink(cancel, header)
+}
+
+func (l *Limiter) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Access(cancel, input)
+}
+
+func (l *Limiter) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return 0, st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (l *Limiter) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return 0, st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (l *Limiter) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (l *Limiter) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (l *Limiter) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (l *Limiter) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Open(cancel, input, out)
+}
+
+func (l *Limiter) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	c := l.classify(input.Fh, input.Size)
+	r, st := l.acquire(cancel, c)
+	if !st.Ok() {
+		return nil, st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Read(cancel, input, buf)
+}
+
+func (l *Limiter) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Lseek(cancel, in, out)
+}
+
+func (l *Limiter) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	c := l.classify(input.Fh, uint32(len(data)))
+	r, st := l.acquire(cancel, c)
+	if !st.Ok() {
+		return 0, st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Write(cancel, input, data)
+}
+
+func (l *Limiter) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	r, st := l.acquire(cancel, bulk)
+	if !st.Ok() {
+		return 0, st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.CopyFileRange(cancel, input)
+}
+
+func (l *Limiter) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
+	c := l.class(input.Fh)
+	r, st := l.acquire(cancel, c)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Flush(cancel, input)
+}
+
+func (l *Limiter) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	c := l.class(input.Fh)
+	r, st := l.acquire(cancel, c)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Fsync(cancel, input)
+}
+
+func (l *Limiter) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.Fallocate(cancel, input)
+}
+
+func (l *Limiter) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (l *Limiter) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.ReadDir(cancel, input, out)
+}
+
+func (l *Limiter) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.ReadDirPlus(cancel, input, out)
+}
+
+func (l *Limiter) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.FsyncDir(cancel, input)
+}
+
+func (l *Limiter) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	r, st := l.acquire(cancel, interactive)
+	if !st.Ok() {
+		return st
+	}
+	defer l.release(r)
+	return l.RawFileSystem.StatFs(cancel, input, out)
+}
@@ -0,0 +1,171 @@
+package fuselimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// testFS blocks every GetAttr until "unblock" is closed and counts how many
+// are running
+type testFS struct {
+	fuse.RawFileSystem
+	unblock chan struct{}
+	running int32
+	max     int32
+}
+
+func (t *testFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	n := atomic.AddInt32(&t.running, 1)
+	for {
+		max := atomic.LoadInt32(&t.max)
+		if n <= max || atomic.CompareAndSwapInt32(&t.max, max, n) {
+			break
+		}
+	}
+	<-t.unblock
+	atomic.AddInt32(&t.running, -1)
+	return fuse.OK
+}
+
+func TestLimit(t *testing.T) {
+	tfs := &testFS{RawFileSystem: fuse.NewDefaultRawFileSystem(), unblock: make(chan struct{})}
+	fs := New(tfs, 2, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fs.GetAttr(nil, &fuse.GetAttrIn{}, &fuse.AttrOut{})
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	// A waiting request can be interrupted
+	cancel := make(chan struct{})
+	close(cancel)
+	if st := fs.GetAttr(cancel, &fuse.GetAttrIn{}, &fuse.AttrOut{}); st != fuse.EINTR {
+		t.Errorf("want EINTR, have %v", st)
+	}
+	close(tfs.unblock)
+	wg.Wait()
+	if tfs.max != 2 {
+		t.Errorf("%d requests ran at the same time, want 2", tfs.max)
+	}
+}
+
+// prioFS reports the class of each request when it starts, and blocks it
+// until it gets a token from "gate"
+type prioFS struct {
+	fuse.RawFileSystem
+	started chan string
+	gate    chan struct{}
+}
+
+func (p *prioFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	p.started <- "interactive"
+	<-p.gate
+	return fuse.OK
+}
+
+func (p *prioFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	p.started <- "bulk"
+	<-p.gate
+	return uint32(len(data)), fuse.OK
+}
+
+// waitFor waits until "n" requests of class "c" are waiting for a slot
+func waitFor(t *testing.T, l *Limiter, c int, n int) {
+	for i := 0; i < 1000; i++ {
+		l.mu.Lock()
+		have := l.waiting[c].Len()
+		l.mu.Unlock()
+		if have == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("class %d: %d requests should be waiting", c, n)
+}
+
+func TestPriority(t *testing.T) {
+	pfs := &prioFS{RawFileSystem: fuse.NewDefaultRawFileSystem(), started: make(chan string, 10),
+		gate: make(chan struct{})}
+	l := New(pfs, 2, 0)
+	// File handle 1 is streaming
+	l.classify(1, streamBytes)
+	var wg sync.WaitGroup
+	write := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Write(nil, &fuse.WriteIn{Fh: 1}, make([]byte, 4096))
+		}()
+	}
+	getattr := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.GetAttr(nil, &fuse.GetAttrIn{}, &fuse.AttrOut{})
+		}()
+	}
+	write()
+	if s := <-pfs.started; s != "bulk" {
+		t.Fatalf("have %s", s)
+	}
+	// Bulk requests may only use one of the two slots
+	write()
+	waitFor(t, l, bulk, 1)
+	getattr()
+	if s := <-pfs.started; s != "interactive" {
+		t.Fatalf("have %s", s)
+	}
+	getattr()
+	waitFor(t, l, interactive, 1)
+	// The waiting interactive request overtakes the waiting bulk request
+	pfs.gate <- struct{}{}
+	if s := <-pfs.started; s != "interactive" {
+		t.Errorf("interactive request should go first, have %s", s)
+	}
+	close(pfs.gate)
+	wg.Wait()
+	// Release forgets the file handle
+	l.Release(nil, &fuse.ReleaseIn{Fh: 1})
+	if l.classify(1, 0) != interactive {
+		t.Error("file handle 1 should start over after Release")
+	}
+}
+
+func TestMaxQueue(t *testing.T) {
+	tfs := &testFS{RawFileSystem: fuse.NewDefaultRawFileSystem(), unblock: make(chan struct{})}
+	l := New(tfs, 1, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.GetAttr(nil, &fuse.GetAttrIn{}, &fuse.AttrOut{})
+		}()
+	}
+	waitFor(t, l, interactive, 2)
+	// One request is running and two are waiting, so the queue is full
+	if st := l.GetAttr(nil, &fuse.GetAttrIn{}, &fuse.AttrOut{}); st != fuse.EBUSY {
+		t.Errorf("want EBUSY, have %v", st)
+	}
+	time.Sleep(10 * time.Millisecond)
+	s := l.Stats()
+	if s.Running != 1 || s.Waiting != 2 || s.Rejected != 1 {
+		t.Errorf("wrong stats: %+v", s)
+	}
+	if s.Oldest < 10*time.Millisecond {
+		t.Errorf("oldest request should be at least 10ms old, is %v", s.Oldest)
+	}
+	close(tfs.unblock)
+	wg.Wait()
+	s = l.Stats()
+	if s.Running != 0 || s.Waiting != 0 || s.Oldest != 0 {
+		t.Errorf("queue should be empty: %+v", s)
+	}
+}
@@ -0,0 +1,164 @@
+package hctr2
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vector from RFC 8452, Appendix A
+func TestPolyval(t *testing.T) {
+	h, _ := hex.DecodeString("25629347589242761d31f826ba4b757b")
+	x, _ := hex.DecodeString("4f4f95668c83dfb6401762bb2d01a262d1a24ddd2721d006bbe45f20d3c9f362")
+	p := polyval{h: loadElement(h)}
+	p.update(x)
+	var out [16]byte
+	p.s.store(out[:])
+	if have := hex.EncodeToString(out[:]); have != "f7a3b47b846119fae5b7866cf5e5b77e" {
+		t.Errorf("wrong POLYVAL result %s", have)
+	}
+}
+
+func newTestInstance() *HCTR2 {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		panic(err)
+	}
+	return New(bc)
+}
+
+// seq returns "n" bytes counting up from "start"
+func seq(n int, start byte) []byte {
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = start + byte(i)
+	}
+	return out
+}
+
+// Regression vectors with empty and unaligned tweaks and messages. They
+// were computed with a separate implementation written from the paper, so
+// they catch changes to the output, but they are not the published HCTR2
+// test vectors (crypto/testmgr.h, github.com/google/hctr2). Those are
+// still to be added here.
+// The key is seq(32, 0), the tweak seq(tweakLen, 0x80) and the plaintext
+// seq(msgLen, 0x40).
+func TestRegressionVectors(t *testing.T) {
+	bc, err := aes.NewCipher(seq(32, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(bc)
+	vectors := []struct {
+		tweakLen, msgLen int
+		ciphertext       string
+	}{
+		{0, 16, "7656b6c8be9ba0da669af79718aa9403"},
+		{0, 17, "002f9727709f273fcafae1fbb287920e41"},
+		{0, 32, "4416a49e07021e933de063e4ae3f05c8ec132919a926ec5536673d78c048aeab"},
+		{1, 16, "4c644f59f9fe8d83f602d29023b6bfa1"},
+		{1, 31, "17eb55129a01db1522fdf4d01cea89507333e77a4d479316ab3bd0d658ea8c"},
+		{16, 16, "ddf8448f76d73d706e3ade6cfb6928d5"},
+		{16, 48, "41e62c3efa43eef194ef15cde45503a54a5fa9310accb6ec0a3b16dd7ea62374671066b0a194a9d2ed8fed3d2c0c71d2"},
+		{17, 33, "d81e3c889c021ce128519d64a2aaa8296e81e46f28af77a293d58445a828536db3"},
+		{32, 64, "d83f97ee0de93a53a090224bace38f130f91cde5f43a6c2ea04968c63ee61b7dbffc751254c216037649f110fa491ac9e6663ce069eb7e8ef780b8992c7ab1ca"},
+		{32, 100, "479dfd9a1ad5b81fee43f54ba0d6070443921dada261580106aaf3b11bea301a73706d2de274d2c19bfbd52352bf4db91d54e2dfc882167b37a4b10385bc1b53fbe23b274019f796b81b3bb382ba472522aedaf14074f84f093b146c3bae4532a5e1c795"},
+		{5, 255, "cbaae6cd193fd77e5931929c901c42ca57bf0e0ee7c3ebafcc1f6902c93874920dfe4c2c3f99b994453c87f65776e92dfd52205ba8e69ef2e196b16606284b1dc48fb5cac1719e3bbc0e63d7a8faff4c870bae56cd2fa94b957a710fc4524cba047079db2c40901978353ff63b930b4c3af5d9b18f5642e158ed01d69cca99234b38c5b75a2f4056a58899a98bf5f0f77b0bd7e6a3f4baaa088d3bc0f8339ea1caf81d78e878a8d1ea371fa0f559c0f41202172b99ef3e94d9c1cdfaae2495d2eefd18edb0be5a52ae8afd09f49d9ab69e263e8f364f4de7620bea4eecd590aa9d455e31cde30ae8b5e0b1736ce838e5900b4777619dd5f32eec333b20c4ea"},
+	}
+	for _, v := range vectors {
+		tweak, p := seq(v.tweakLen, 0x80), seq(v.msgLen, 0x40)
+		if have := hex.EncodeToString(c.Encrypt(tweak, p)); have != v.ciphertext {
+			t.Errorf("tweak %d, message %d: wrong ciphertext %s", v.tweakLen, v.msgLen, have)
+		}
+		ct, _ := hex.DecodeString(v.ciphertext)
+		if have := c.Decrypt(tweak, ct); !bytes.Equal(have, p) {
+			t.Errorf("tweak %d, message %d: wrong plaintext %x", v.tweakLen, v.msgLen, have)
+		}
+	}
+}
+
+// Inputs shorter than a block are a programming error
+func TestShortInput(t *testing.T) {
+	c := newTestInstance()
+	for _, l := range []int{0, BlockSize - 1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("length %d: no panic", l)
+				}
+			}()
+			c.Encrypt(nil, make([]byte, l))
+		}()
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	c := newTestInstance()
+	tweak := make([]byte, 16)
+	for l := BlockSize; l < 300; l++ {
+		p := bytes.Repeat([]byte{byte(l)}, l)
+		ct := c.Encrypt(tweak, p)
+		if len(ct) != l {
+			t.Fatalf("l=%d: ciphertext has length %d", l, len(ct))
+		}
+		if bytes.Equal(ct, p) {
+			t.Errorf("l=%d: ciphertext equals plaintext", l)
+		}
+		if p2 := c.Decrypt(tweak, ct); !bytes.Equal(p, p2) {
+			t.Errorf("l=%d: round trip failed", l)
+		}
+	}
+}
+
+// Changing any byte of the plaintext or the tweak changes every ciphertext
+// block
+func TestWideBlock(t *testing.T) {
+	c := newTestInstance()
+	tweak := make([]byte, 16)
+	p := make([]byte, 64)
+	ct := c.Encrypt(tweak, p)
+	check := func(ct2 []byte, what string) {
+		for i := 0; i < len(ct); i += BlockSize {
+			if bytes.Equal(ct[i:i+BlockSize], ct2[i:i+BlockSize]) {
+				t.Errorf("%s: block at %d unchanged", what, i)
+			}
+		}
+	}
+	for i := range p {
+		p[i] ^= 1
+		check(c.Encrypt(tweak, p), "plaintext")
+		p[i] ^= 1
+	}
+	tweak[15] ^= 1
+	check(c.Encrypt(tweak, p), "tweak")
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	c := newTestInstance()
+	tweak := make([]byte, 16)
+	// A 255-byte name padded to 256 bytes
+	p := make([]byte, 256)
+	b.SetBytes(int64(len(p)))
+	for i := 0; i < b.N; i++ {
+		c.Encrypt(tweak, p)
+	}
+}
+
+// The assembly and the portable implementation must agree
+func TestPolyvalAsm(t *testing.T) {
+	if !useAsm {
+		t.Skip("no assembly implementation on this CPU")
+	}
+	h := fieldElement{0x0123456789abcdef, 0xfedcba9876543210}
+	data := make([]byte, 16*100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	var s1, s2 fieldElement
+	polyvalBlocksGeneric(&h, &s1, data)
+	polyvalBlocks(&h, &s2, data)
+	if s1 != s2 {
+		t.Errorf("generic=%x asm=%x", s1, s2)
+	}
+}
@@ -0,0 +1,86 @@
+package hctr2
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// POLYVAL (RFC 8452, section 3) in portable Go. Field elements are stored
+// as two little-endian 64-bit words, lo holding bytes 0...7.
+type fieldElement struct {
+	lo, hi uint64
+}
+
+func loadElement(b []byte) fieldElement {
+	return fieldElement{binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint64(b[8:])}
+}
+
+func (e fieldElement) store(b []byte) {
+	binary.LittleEndian.PutUint64(b, e.lo)
+	binary.LittleEndian.PutUint64(b[8:], e.hi)
+}
+
+// bmul64 returns the lower 64 bits of the carry-less product of x and y.
+// Integer multiplications with "holes" every 4 bits keep the carries from
+// spilling into the bits that are used, see BearSSL's ghash_ctmul64.c.
+func bmul64(x, y uint64) uint64 {
+	const m0, m1, m2, m3 = 0x1111111111111111, 0x2222222222222222, 0x4444444444444444, 0x8888888888888888
+	x0, x1, x2, x3 := x&m0, x&m1, x&m2, x&m3
+	y0, y1, y2, y3 := y&m0, y&m1, y&m2, y&m3
+	z0 := (x0 * y0) ^ (x1 * y3) ^ (x2 * y2) ^ (x3 * y1)
+	z1 := (x0 * y1) ^ (x1 * y0) ^ (x2 * y3) ^ (x3 * y2)
+	z2 := (x0 * y2) ^ (x1 * y1) ^ (x2 * y0) ^ (x3 * y3)
+	z3 := (x0 * y3) ^ (x1 * y2) ^ (x2 * y1) ^ (x3 * y0)
+	return (z0 & m0) | (z1 & m1) | (z2 & m2) | (z3 & m3)
+}
+
+// clmul returns the 128-bit carry-less product of x and y
+func clmul(x, y uint64) (lo, hi uint64) {
+	lo = bmul64(x, y)
+	hi = bits.Reverse64(bmul64(bits.Reverse64(x), bits.Reverse64(y))) >> 1
+	return lo, hi
+}
+
+// dot computes a * b * x^-128 in GF(2^128) modulo
+// x^128 + x^127 + x^126 + x^121 + 1
+func dot(a, b fieldElement) fieldElement {
+	// Karatsuba multiplication to 256 bits v0...v3
+	l0, l1 := clmul(a.lo, b.lo)
+	h0, h1 := clmul(a.hi, b.hi)
+	m0, m1 := clmul(a.lo^a.hi, b.lo^b.hi)
+	m0 ^= l0 ^ h0
+	m1 ^= l1 ^ h1
+	v0, v1, v2, v3 := l0, l1^m0, h0^m1, h1
+	// Montgomery reduction by x^128
+	v2 ^= v0 ^ (v0 >> 1) ^ (v0 >> 2) ^ (v0 >> 7)
+	v1 ^= (v0 << 63) ^ (v0 << 62) ^ (v0 << 57)
+	v3 ^= v1 ^ (v1 >> 1) ^ (v1 >> 2) ^ (v1 >> 7)
+	v2 ^= (v1 << 63) ^ (v1 << 62) ^ (v1 << 57)
+	return fieldElement{v2, v3}
+}
+
+// polyval is the running state of a POLYVAL computation
+type polyval struct {
+	h fieldElement
+	s fieldElement
+}
+
+// update absorbs "data", zero-padded to a multiple of 16 bytes
+func (p *polyval) update(data []byte) {
+	full := len(data) &^ 15
+	polyvalBlocks(&p.h, &p.s, data[:full])
+	if full < len(data) {
+		var block [16]byte
+		copy(block[:], data[full:])
+		polyvalBlocks(&p.h, &p.s, block[:])
+	}
+}
+
+// polyvalBlocksGeneric absorbs the 16-byte blocks in "data" into "s"
+func polyvalBlocksGeneric(h *fieldElement, s *fieldElement, data []byte) {
+	for len(data) >= 16 {
+		x := loadElement(data)
+		*s = dot(fieldElement{s.lo ^ x.lo, s.hi ^ x.hi}, *h)
+		data = data[16:]
+	}
+}
@@ -0,0 +1,21 @@
+package hctr2
+
+import (
+	"golang.org/x/sys/cpu"
+)
+
+// useAsm is set if the CPU has the carry-less multiplication instruction
+var useAsm = cpu.X86.HasPCLMULQDQ
+
+// Implemented in polyval_amd64.s
+//
+//go:noescape
+func polyvalBlocksAsm(h *fieldElement, s *fieldElement, data []byte)
+
+func polyvalBlocks(h *fieldElement, s *fieldElement, data []byte) {
+	if useAsm {
+		polyvalBlocksAsm(h, s, data)
+		return
+	}
+	polyvalBlocksGeneric(h, s, data)
+}
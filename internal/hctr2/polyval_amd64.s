@@ -0,0 +1,58 @@
+#include "textflag.h"
+
+// The POLYVAL reduction constant x^128 + x^127 + x^126 + x^121 + 1
+DATA poly<>+0(SB)/8, $0x0000000000000001
+DATA poly<>+8(SB)/8, $0xc200000000000000
+GLOBL poly<>(SB), RODATA|NOPTR, $16
+
+// func polyvalBlocksAsm(h *fieldElement, s *fieldElement, data []byte)
+TEXT ·polyvalBlocksAsm(SB), NOSPLIT, $0-40
+	MOVQ  h+0(FP), AX
+	MOVQ  s+8(FP), BX
+	MOVQ  data_base+16(FP), SI
+	MOVQ  data_len+24(FP), CX
+	MOVOU (AX), X1
+	MOVOU (BX), X0
+	MOVOU poly<>(SB), X7
+
+loop:
+	CMPQ CX, $16
+	JB   done
+	MOVOU (SI), X2
+	PXOR  X2, X0
+
+	// 256-bit product of X0 and H: X3 low half, X4 high half
+	MOVO      X0, X3
+	PCLMULQDQ $0x00, X1, X3
+	MOVO      X0, X4
+	PCLMULQDQ $0x11, X1, X4
+	MOVO      X0, X5
+	PCLMULQDQ $0x01, X1, X5
+	MOVO      X0, X6
+	PCLMULQDQ $0x10, X1, X6
+	PXOR      X6, X5
+	MOVO      X5, X6
+	PSLLO     $8, X6
+	PSRLO     $8, X5
+	PXOR      X6, X3
+	PXOR      X5, X4
+
+	// Montgomery reduction, two folds of the low 64 bits
+	MOVO      X3, X6
+	PCLMULQDQ $0x10, X7, X6
+	PSHUFD    $78, X3, X3
+	PXOR      X6, X3
+	MOVO      X3, X6
+	PCLMULQDQ $0x10, X7, X6
+	PSHUFD    $78, X3, X3
+	PXOR      X6, X3
+	PXOR      X4, X3
+	MOVO      X3, X0
+
+	ADDQ $16, SI
+	SUBQ $16, CX
+	JMP  loop
+
+done:
+	MOVOU X0, (BX)
+	RET
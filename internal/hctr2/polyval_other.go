@@ -0,0 +1,11 @@
+//go:build !amd64
+// +build !amd64
+
+package hctr2
+
+// useAsm is always false, there is no assembly for this architecture
+var useAsm = false
+
+func polyvalBlocks(h *fieldElement, s *fieldElement, data []byte) {
+	polyvalBlocksGeneric(h, s, data)
+}
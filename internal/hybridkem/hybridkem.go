@@ -0,0 +1,128 @@
+//go:build go1.24
+// +build go1.24
+
+// Package hybridkem implements a hybrid key encapsulation mechanism that
+// combines X25519 and ML-KEM-768 (FIPS 203). The shared secret stays safe
+// as long as either of the two is unbroken, in particular against an
+// attacker who records ciphertexts today and gets a quantum computer
+// later.
+//
+// The construction follows X-Wing (draft-connolly-cfrg-xwing-kem): both
+// secret keys are expanded from one 32-byte seed, and the shared secret is
+// SHA3-256 over both shared secrets, the X25519 ciphertext and public key.
+package hybridkem
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha3"
+	"fmt"
+)
+
+const (
+	// SeedLen is the length of the secret key seed in bytes
+	SeedLen = 32
+	// CiphertextLen is the length of an encapsulated key in bytes: the
+	// ML-KEM-768 ciphertext followed by the X25519 ephemeral public key.
+	CiphertextLen = mlkem.CiphertextSize768 + 32
+	// SharedKeyLen is the length of the shared secret in bytes
+	SharedKeyLen = 32
+)
+
+// label is the X-Wing domain separator `\.//^\`
+var label = []byte{0x5c, 0x2e, 0x2f, 0x2f, 0x5e, 0x5c}
+
+// Supported tells you if this build has ML-KEM support (Go 1.24 or later)
+const Supported = true
+
+type keyPair struct {
+	m  *mlkem.DecapsulationKey768
+	x  *ecdh.PrivateKey
+	px []byte
+}
+
+// expand derives the ML-KEM-768 and X25519 secret keys from "seed"
+func expand(seed []byte) (*keyPair, error) {
+	if len(seed) != SeedLen {
+		return nil, fmt.Errorf("hybridkem: seed must be %d bytes long, have %d", SeedLen, len(seed))
+	}
+	e := sha3.SumSHAKE256(seed, 96)
+	defer wipe(e)
+	m, err := mlkem.NewDecapsulationKey768(e[:64])
+	if err != nil {
+		return nil, err
+	}
+	x, err := ecdh.X25519().NewPrivateKey(e[64:])
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{m: m, x: x, px: x.PublicKey().Bytes()}, nil
+}
+
+// combine computes the shared secret from the shared secrets of the two
+// KEMs. The ML-KEM ciphertext and public key do not have to be included,
+// ML-KEM already binds them into its shared secret.
+func combine(ssM []byte, ssX []byte, ctX []byte, pkX []byte) []byte {
+	h := sha3.New256()
+	h.Write(ssM)
+	h.Write(ssX)
+	h.Write(ctX)
+	h.Write(pkX)
+	h.Write(label)
+	return h.Sum(nil)
+}
+
+// Encapsulate creates a fresh shared secret for the key pair described by
+// "seed" and returns it together with the ciphertext that Decapsulate
+// needs to recover it.
+func Encapsulate(seed []byte) (shared []byte, ciphertext []byte, err error) {
+	kp, err := expand(seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	ssM, ctM := kp.m.EncapsulationKey().Encapsulate()
+	defer wipe(ssM)
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ssX, err := eph.ECDH(kp.x.PublicKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(ssX)
+	ctX := eph.PublicKey().Bytes()
+	ciphertext = append(ctM, ctX...)
+	return combine(ssM, ssX, ctX, kp.px), ciphertext, nil
+}
+
+// Decapsulate recovers the shared secret from "ciphertext" using the key
+// pair described by "seed". Like ML-KEM, it does not detect a wrong seed:
+// the result is a different, unrelated secret.
+func Decapsulate(seed []byte, ciphertext []byte) (shared []byte, err error) {
+	if len(ciphertext) != CiphertextLen {
+		return nil, fmt.Errorf("hybridkem: ciphertext must be %d bytes long, have %d", CiphertextLen, len(ciphertext))
+	}
+	kp, err := expand(seed)
+	if err != nil {
+		return nil, err
+	}
+	ctM := ciphertext[:mlkem.CiphertextSize768]
+	ctX := ciphertext[mlkem.CiphertextSize768:]
+	ssM, err := kp.m.Decapsulate(ctM)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(ssM)
+	peer, err := ecdh.X25519().NewPublicKey(ctX)
+	if err != nil {
+		return nil, err
+	}
+	ssX, err := kp.x.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(ssX)
+	return combine(ssM, ssX, ctX, kp.px), nil
+}
@@ -0,0 +1,69 @@
+//go:build go1.24
+// +build go1.24
+
+package hybridkem
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncapsulateDecapsulate(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, SeedLen)
+	ss, ct, err := Encapsulate(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != SharedKeyLen || len(ct) != CiphertextLen {
+		t.Fatalf("wrong lengths: shared=%d ciphertext=%d", len(ss), len(ct))
+	}
+	ss2, err := Decapsulate(seed, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ss, ss2) {
+		t.Error("shared secrets differ")
+	}
+	// Every encapsulation is randomized
+	ss3, ct3, _ := Encapsulate(seed)
+	if bytes.Equal(ss, ss3) || bytes.Equal(ct, ct3) {
+		t.Error("encapsulation is not randomized")
+	}
+	// A different seed yields an unrelated secret
+	seed[0] ^= 1
+	ss4, err := Decapsulate(seed, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ss, ss4) {
+		t.Error("wrong seed yields the same secret")
+	}
+	seed[0] ^= 1
+	// So does a modified X25519 part
+	ct[len(ct)-1] ^= 1
+	ss5, err := Decapsulate(seed, ct)
+	if err == nil && bytes.Equal(ss, ss5) {
+		t.Error("modified ciphertext yields the same secret")
+	}
+	if _, err := Decapsulate(seed, ct[1:]); err == nil {
+		t.Error("short ciphertext was accepted")
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	fn := t.TempDir() + "/pq.key"
+	seed, err := CreateKeyFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CreateKeyFile(fn); err == nil {
+		t.Error("existing key file was overwritten")
+	}
+	seed2, err := ReadKeyFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seed, seed2) {
+		t.Error("seed differs after reading it back")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !go1.24
+// +build !go1.24
+
+package hybridkem
+
+import (
+	"errors"
+)
+
+const (
+	// SeedLen is the length of the secret key seed in bytes
+	SeedLen = 32
+	// CiphertextLen is the length of an encapsulated key in bytes
+	CiphertextLen = 1088 + 32
+	// SharedKeyLen is the length of the shared secret in bytes
+	SharedKeyLen = 32
+)
+
+// Supported tells you if this build has ML-KEM support (Go 1.24 or later)
+const Supported = false
+
+var errUnsupported = errors.New("hybridkem: this gocryptfs binary was built without ML-KEM support, it needs Go 1.24 or later")
+
+// Encapsulate is not supported in this build
+func Encapsulate(seed []byte) (shared []byte, ciphertext []byte, err error) {
+	return nil, nil, errUnsupported
+}
+
+// Decapsulate is not supported in this build
+func Decapsulate(seed []byte, ciphertext []byte) (shared []byte, err error) {
+	return nil, errUnsupported
+}
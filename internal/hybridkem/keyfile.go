@@ -0,0 +1,58 @@
+package hybridkem
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ReadKeyFile reads the hex-encoded seed stored in "filename"
+func ReadKeyFile(filename string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(content)
+	seed, err := hex.DecodeString(string(bytes.TrimSpace(content)))
+	if err != nil || len(seed) != SeedLen {
+		wipe(seed)
+		return nil, fmt.Errorf("%s: not a key file, want %d hex-encoded bytes", filename, SeedLen)
+	}
+	return seed, nil
+}
+
+// CreateKeyFile generates a new random seed and writes it to "filename",
+// which must not exist yet. The file is readable only by its owner.
+func CreateKeyFile(filename string) ([]byte, error) {
+	seed := make([]byte, SeedLen)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return nil, err
+	}
+	content := []byte(hex.EncodeToString(seed) + "\n")
+	defer wipe(content)
+	_, err = fd.Write(content)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(filename)
+		return nil, err
+	}
+	return seed, nil
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,228 @@
+// Package journal implements the "-journal" undo log. Before a ciphertext
+// block is overwritten in place, its old contents are saved in a record.
+// The record is deleted once the new contents are on disk. Records that are
+// still present when the filesystem is mounted belong to writes that were
+// interrupted by a crash, and are rolled back.
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/reserveddir"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// DirName is the name of the journal directory in the root of CIPHERDIR
+const DirName = "gocryptfs.journal"
+
+// tmpSuffix marks records that are still being written
+const tmpSuffix = ".tmp"
+
+// Record describes how to undo an interrupted write to a ciphertext file.
+type Record struct {
+	// Path is the path of the ciphertext file, relative to CIPHERDIR
+	Path string
+	// Header is the file header. The record is only applied if the file
+	// still has this header, so we cannot damage a different file that
+	// has been renamed to Path in the meantime.
+	Header []byte
+	// Offset is where Data is written back
+	Offset int64
+	// Data is the old ciphertext
+	Data []byte
+	// Size is the ciphertext file size to restore
+	Size int64
+}
+
+// Apply writes the old contents back to "f" and makes them durable.
+func (r *Record) Apply(f *os.File) error {
+	if len(r.Data) > 0 {
+		if _, err := f.WriteAt(r.Data, r.Offset); err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(r.Size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Journal is a directory of records. All methods are safe for concurrent
+// use. A nil *Journal journals nothing.
+type Journal struct {
+	dir string
+	// seq is used to generate record file names. Use atomic ops to access it.
+	seq uint64
+}
+
+// Open opens the journal in "cipherdir", creating it if it does not exist,
+// and rolls back all records that are left over from a crash.
+// Returns the number of rolled back records.
+func Open(cipherdir string) (j *Journal, replayed int, err error) {
+	dir := filepath.Join(cipherdir, DirName)
+	if err = reserveddir.Mkdir(dir); err != nil {
+		return nil, 0, err
+	}
+	j = &Journal{dir: dir}
+	replayed, err = j.replay(cipherdir)
+	if err != nil {
+		return nil, 0, err
+	}
+	return j, replayed, nil
+}
+
+// Pending returns the number of records in the journal of "cipherdir"
+// without touching them. Used to warn when a filesystem that has
+// unfinished records is mounted without "-journal".
+func Pending(cipherdir string) int {
+	entries, err := os.ReadDir(filepath.Join(cipherdir, DirName))
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if e.Name() != reserveddir.MarkerName && !strings.HasSuffix(e.Name(), tmpSuffix) {
+			n++
+		}
+	}
+	return n
+}
+
+// replay rolls back and deletes all records. Records that cannot be applied
+// are logged and deleted as well, so that they cannot roll back later
+// writes.
+func (j *Journal) replay(cipherdir string) (replayed int, err error) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return 0, err
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(cipherdir, "")
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(dirfd)
+	for _, e := range entries {
+		name := e.Name()
+		if name == reserveddir.MarkerName {
+			continue
+		}
+		path := filepath.Join(j.dir, name)
+		// An incomplete record means that the write had not started yet
+		if !strings.HasSuffix(name, tmpSuffix) {
+			if err := applyFile(dirfd, path); err != nil {
+				tlog.Warn.Printf("journal: could not roll back %q: %v", name, err)
+			} else {
+				replayed++
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, syncDir(j.dir)
+}
+
+// applyFile applies the record stored in the file "path". The ciphertext
+// file is opened relative to "dirfd", which is CIPHERDIR, without following
+// symlinks or leaving CIPHERDIR.
+func applyFile(dirfd int, path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var r Record
+	if err = json.Unmarshal(buf, &r); err != nil {
+		return err
+	}
+	if !validPath(r.Path) {
+		return fmt.Errorf("invalid path %q", r.Path)
+	}
+	fd, err := syscallcompat.OpenatNofollow(dirfd, r.Path, syscall.O_RDWR, 0)
+	if err == syscall.ENOENT {
+		// The file has been deleted, nothing to roll back
+		return nil
+	} else if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), r.Path)
+	defer f.Close()
+	header := make([]byte, len(r.Header))
+	if _, err = f.ReadAt(header, 0); err != nil || !bytes.Equal(header, r.Header) {
+		return fmt.Errorf("%q: file header has changed", r.Path)
+	}
+	tlog.Info.Printf("journal: rolling back interrupted write to %q at offset %d", r.Path, r.Offset)
+	return r.Apply(f)
+}
+
+// validPath returns true if "p" is a relative path that does not contain
+// ".." components
+func validPath(p string) bool {
+	if p == "" || filepath.IsAbs(p) {
+		return false
+	}
+	for _, c := range strings.Split(p, "/") {
+		if c == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Add durably stores "r" and returns an id that is passed to Remove() once
+// the write that "r" protects is on disk.
+func (j *Journal) Add(r *Record) (id string, err error) {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	id = fmt.Sprintf("%d", atomic.AddUint64(&j.seq, 1))
+	tmp := filepath.Join(j.dir, id+tmpSuffix)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(j.dir, id))
+	}
+	if err == nil {
+		err = syncDir(j.dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return id, nil
+}
+
+// Remove durably deletes the record "id". A record that is not deleted
+// durably would be rolled back after a crash, undoing later writes.
+func (j *Journal) Remove(id string) error {
+	if err := os.Remove(filepath.Join(j.dir, id)); err != nil {
+		return err
+	}
+	return syncDir(j.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,112 @@
+package journal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test that a record that is left over from a crash is rolled back by Open()
+func TestReplay(t *testing.T) {
+	cipherdir := t.TempDir()
+	path := filepath.Join(cipherdir, "file")
+	if err := os.WriteFile(path, []byte("HDRaaaabbbb"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	j, n, err := Open(cipherdir)
+	if err != nil || n != 0 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	_, err = j.Add(&Record{Path: "file", Header: []byte("HDR"), Offset: 3, Data: []byte("aaaa"), Size: 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unremoved records must not disturb later ones
+	id, err := j.Add(&Record{Path: "file", Header: []byte("HDR"), Offset: 7, Data: []byte("bbbb"), Size: 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if Pending(cipherdir) != 1 {
+		t.Errorf("Pending=%d", Pending(cipherdir))
+	}
+	// Simulate a torn write that also extended the file
+	if err := os.WriteFile(path, []byte("HDRxxaabbbbzzzz"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, n, err = Open(cipherdir)
+	if err != nil || n != 1 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	have, _ := os.ReadFile(path)
+	if !bytes.Equal(have, []byte("HDRaaaabbbb")) {
+		t.Errorf("have %q", have)
+	}
+	if Pending(cipherdir) != 0 {
+		t.Errorf("Pending=%d", Pending(cipherdir))
+	}
+}
+
+// Test that a record is not applied to a different file
+func TestReplayHeaderMismatch(t *testing.T) {
+	cipherdir := t.TempDir()
+	path := filepath.Join(cipherdir, "file")
+	j, _, err := Open(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = j.Add(&Record{Path: "file", Header: []byte("HDR"), Offset: 3, Data: []byte("aaaa"), Size: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("XYZxxxx"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, n, err := Open(cipherdir)
+	if err != nil || n != 0 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	have, _ := os.ReadFile(path)
+	if !bytes.Equal(have, []byte("XYZxxxx")) {
+		t.Errorf("have %q", have)
+	}
+}
+
+// Test that records cannot write outside of CIPHERDIR, neither through ".."
+// nor through symlinks
+func TestReplayOutside(t *testing.T) {
+	cipherdir := t.TempDir()
+	outside := t.TempDir()
+	path := filepath.Join(outside, "file")
+	if err := os.WriteFile(path, []byte("HDRxxxx"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(cipherdir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(cipherdir, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, _, err := Open(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, rel, "link/file", "link/../" + rel} {
+		_, err = j.Add(&Record{Path: p, Header: []byte("HDR"), Offset: 3, Data: []byte("aaaa"), Size: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, n, err := Open(cipherdir)
+	if err != nil || n != 0 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	have, _ := os.ReadFile(path)
+	if !bytes.Equal(have, []byte("HDRxxxx")) {
+		t.Errorf("have %q", have)
+	}
+}
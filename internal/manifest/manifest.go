@@ -0,0 +1,304 @@
+// Package manifest implements the "-manifest" list of all files in
+// CIPHERDIR with their sizes and content hashes.
+//
+// Authenticated encryption protects each block, but cannot tell if whole
+// files have been deleted, or if CIPHERDIR has been rolled back to an older
+// state. The manifest records the state at unmount, authenticated with a
+// key derived from the master key, and "-fsck" compares CIPHERDIR against
+// it. A rollback that includes the manifest itself is caught by the
+// anchor, a small file outside CIPHERDIR that stores the generation of the
+// latest manifest.
+package manifest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FileName is the name of the manifest in the root of CIPHERDIR
+const FileName = "gocryptfs.manifest"
+
+// tmpSuffix marks a manifest that is still being written
+const tmpSuffix = ".tmp"
+
+// Entry describes one file, directory or symlink
+type Entry struct {
+	// Path is relative to CIPHERDIR
+	Path string
+	// Mode holds the file type bits and permissions
+	Mode os.FileMode
+	Size int64
+	// Mtime is only used to skip re-hashing unchanged files
+	Mtime int64
+	// Hash is the SHA-256 of the contents of a regular file, or of the
+	// target of a symlink. Empty for directories.
+	Hash []byte `json:",omitempty"`
+}
+
+// Manifest is the list of all entries in CIPHERDIR
+type Manifest struct {
+	// Generation is incremented every time the manifest is written
+	Generation uint64
+	// Time in Unix seconds
+	Time    int64
+	Entries []Entry
+	// MAC authenticates everything above
+	MAC []byte `json:",omitempty"`
+}
+
+// mac computes the MAC of "m". m.MAC is ignored.
+func (m Manifest) mac(key []byte) []byte {
+	m.MAC = nil
+	buf, err := json.Marshal(m)
+	if err != nil {
+		// Cannot happen for this struct
+		panic(err)
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(buf)
+	return h.Sum(nil)
+}
+
+// Build walks "cipherdir" and returns the current state with generation
+// zero. Entries in the root directory whose names are in "skip" are left
+// out, as is the manifest itself. The hashes of files whose size and mtime
+// are the same as in "prev" are taken over from there. Pass nil to hash
+// everything.
+func Build(cipherdir string, skip []string, prev *Manifest) (*Manifest, error) {
+	old := make(map[string]*Entry)
+	if prev != nil {
+		for i := range prev.Entries {
+			old[prev.Entries[i].Path] = &prev.Entries[i]
+		}
+	}
+	skipped := map[string]bool{FileName: true, FileName + tmpSuffix: true}
+	for _, s := range skip {
+		skipped[s] = true
+	}
+	m := &Manifest{Time: time.Now().Unix()}
+	err := filepath.Walk(cipherdir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(cipherdir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if skipped[rel] {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		e := Entry{
+			Path:  filepath.ToSlash(rel),
+			Mode:  fi.Mode(),
+			Size:  fi.Size(),
+			Mtime: fi.ModTime().UnixNano(),
+		}
+		if o := old[e.Path]; o != nil && o.Mode == e.Mode && o.Size == e.Size && o.Mtime == e.Mtime {
+			e.Hash = o.Hash
+		} else if e.Hash, err = hash(path, fi); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			e.Size = 0
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// hash returns the SHA-256 of the contents of the regular file or the
+// target of the symlink at "path", and nil for everything else.
+func hash(path string, fi os.FileInfo) ([]byte, error) {
+	h := sha256.New()
+	switch {
+	case fi.Mode().IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err = io.Copy(h, f); err != nil {
+			return nil, err
+		}
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		h.Write([]byte(target))
+	default:
+		return nil, nil
+	}
+	return h.Sum(nil), nil
+}
+
+// Load reads the manifest of "cipherdir" and checks its MAC. If there is
+// no manifest, the error satisfies os.IsNotExist().
+func Load(cipherdir string, key []byte) (*Manifest, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(cipherdir, FileName))
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err = json.Unmarshal(buf, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", FileName, err)
+	}
+	if !hmac.Equal(m.mac(key), m.MAC) {
+		return nil, fmt.Errorf("%s: MAC mismatch, the manifest has been tampered with", FileName)
+	}
+	return m, nil
+}
+
+// CheckFormat returns an error if the file "path" does not look like a
+// manifest. The MAC cannot be checked without the key. With
+// "-plaintextnames", a user file in CIPHERDIR can have the name of the
+// manifest, and Save() would replace it.
+func CheckFormat(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var m Manifest
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&m); err != nil || len(m.MAC) != sha256.Size {
+		return fmt.Errorf("%s is not a manifest", path)
+	}
+	return nil
+}
+
+// Save authenticates "m" with "key" and durably stores it in "cipherdir"
+func (m *Manifest) Save(cipherdir string, key []byte) error {
+	m.MAC = m.mac(key)
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(cipherdir, FileName), buf)
+}
+
+// writeFile atomically and durably replaces "path" with "buf"
+func writeFile(path string, buf []byte) error {
+	tmp := path + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Diff compares the recorded state "m" with the current state "cur" and
+// returns a sorted list of differences, like "missing: PATH". Mtimes and
+// permissions are not compared.
+func Diff(m *Manifest, cur *Manifest) []string {
+	want := make(map[string]Entry)
+	for _, e := range m.Entries {
+		want[e.Path] = e
+	}
+	var diffs []string
+	for _, e := range cur.Entries {
+		w, ok := want[e.Path]
+		if !ok {
+			diffs = append(diffs, "added: "+e.Path)
+			continue
+		}
+		delete(want, e.Path)
+		if w.Mode.Type() != e.Mode.Type() || w.Size != e.Size || !bytes.Equal(w.Hash, e.Hash) {
+			diffs = append(diffs, "changed: "+e.Path)
+		}
+	}
+	for p := range want {
+		diffs = append(diffs, "missing: "+p)
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// Anchor is stored outside of CIPHERDIR and identifies the latest manifest
+type Anchor struct {
+	Generation uint64
+	MAC        []byte
+}
+
+// ReadAnchor reads the anchor file at "path". If it does not exist, the
+// error satisfies os.IsNotExist().
+func ReadAnchor(path string) (*Anchor, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &Anchor{}
+	if err = json.Unmarshal(buf, a); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return a, nil
+}
+
+// WriteAnchor durably stores the anchor of "m" at "path"
+func WriteAnchor(path string, m *Manifest) error {
+	buf, err := json.Marshal(Anchor{Generation: m.Generation, MAC: m.MAC})
+	if err != nil {
+		return err
+	}
+	return writeFile(path, buf)
+}
+
+// CheckAnchor returns an error if "m" is not the manifest that "a" was
+// written for, meaning that CIPHERDIR has been rolled back or the manifest
+// has been deleted. "m" and "a" may be nil if they do not exist.
+func CheckAnchor(m *Manifest, a *Anchor) error {
+	if a == nil {
+		return nil
+	}
+	if m == nil {
+		return fmt.Errorf("%s is missing, but the anchor has generation %d", FileName, a.Generation)
+	}
+	if m.Generation < a.Generation {
+		return fmt.Errorf("%s has generation %d, but the anchor has %d. CIPHERDIR has been rolled back",
+			FileName, m.Generation, a.Generation)
+	}
+	if m.Generation == a.Generation && !hmac.Equal(m.MAC, a.MAC) {
+		return fmt.Errorf("%s does not match the anchor of generation %d. CIPHERDIR has been rolled back",
+			FileName, a.Generation)
+	}
+	return nil
+}
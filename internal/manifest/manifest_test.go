@@ -0,0 +1,148 @@
+package manifest
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{1}, 32)
+
+func writeTestFile(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestDir creates a directory with a file, a subdirectory, a symlink and
+// a skipped file
+func newTestDir(t *testing.T) string {
+	dir := t.TempDir()
+	writeTestFile(t, dir+"/a", "aaa")
+	writeTestFile(t, dir+"/skipme", "x")
+	if err := os.Mkdir(dir+"/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir+"/d/b", "bbb")
+	if err := os.Symlink("a", dir+"/l"); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBuildDiff(t *testing.T) {
+	dir := newTestDir(t)
+	skip := []string{"skipme"}
+	m, err := Build(dir, skip, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, e := range m.Entries {
+		paths = append(paths, e.Path)
+	}
+	if want := []string{"a", "d", "d/b", "l"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("want %v, have %v", want, paths)
+	}
+	cur, err := Build(dir, skip, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := Diff(m, cur); len(diffs) != 0 {
+		t.Errorf("unexpected differences: %v", diffs)
+	}
+	// Same size, different content, and the mtime is restored
+	fi, _ := os.Stat(dir + "/a")
+	writeTestFile(t, dir+"/a", "AAA")
+	os.Chtimes(dir+"/a", fi.ModTime(), fi.ModTime())
+	os.Remove(dir + "/d/b")
+	writeTestFile(t, dir+"/c", "c")
+	writeTestFile(t, dir+"/skipme", "y")
+	cur, err = Build(dir, skip, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"added: c", "changed: a", "missing: d/b"}
+	if diffs := Diff(m, cur); !reflect.DeepEqual(diffs, want) {
+		t.Errorf("want %v, have %v", want, diffs)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir := newTestDir(t)
+	m, err := Build(dir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Generation = 7
+	if err = m.Save(dir, testKey); err != nil {
+		t.Fatal(err)
+	}
+	// The manifest does not list itself
+	m2, err := Load(dir, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Errorf("want %v, have %v", m, m2)
+	}
+	if _, err = Load(dir, bytes.Repeat([]byte{2}, 32)); err == nil {
+		t.Error("Load with wrong key should have failed")
+	}
+	path := filepath.Join(dir, FileName)
+	buf, _ := os.ReadFile(path)
+	buf = bytes.Replace(buf, []byte(`"Generation":7`), []byte(`"Generation":8`), 1)
+	writeTestFile(t, path, string(buf))
+	if _, err = Load(dir, testKey); err == nil {
+		t.Error("Load of tampered manifest should have failed")
+	}
+	os.Remove(path)
+	if _, err = Load(dir, testKey); !os.IsNotExist(err) {
+		t.Errorf("want ENOENT, have %v", err)
+	}
+}
+
+func TestAnchor(t *testing.T) {
+	dir := t.TempDir()
+	anchor := filepath.Join(dir, "anchor")
+	if _, err := ReadAnchor(anchor); !os.IsNotExist(err) {
+		t.Errorf("want ENOENT, have %v", err)
+	}
+	old := &Manifest{Generation: 1}
+	if err := old.Save(dir, testKey); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Generation: 2}
+	if err := m.Save(dir, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAnchor(anchor, m); err != nil {
+		t.Fatal(err)
+	}
+	a, err := ReadAnchor(anchor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckAnchor(m, a); err != nil {
+		t.Error(err)
+	}
+	if err = CheckAnchor(nil, nil); err != nil {
+		t.Error(err)
+	}
+	// Rolled back
+	if CheckAnchor(old, a) == nil {
+		t.Error("older generation was not detected")
+	}
+	// Deleted
+	if CheckAnchor(nil, a) == nil {
+		t.Error("missing manifest was not detected")
+	}
+	// Same generation, different contents
+	other := &Manifest{Generation: 2, Time: 1}
+	other.Save(dir, testKey)
+	if CheckAnchor(other, a) == nil {
+		t.Error("different manifest was not detected")
+	}
+}
@@ -0,0 +1,179 @@
+// Package membudget implements the "-cachemem" memory budget. The caches of
+// a mount charge their entries to one shared Budget, which evicts the least
+// recently used entries across all caches once the limit is exceeded.
+package membudget
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Item is a cache entry that is charged to a Budget
+type Item struct {
+	cache string
+	size  int64
+	evict func()
+	// el is nil once the item has been removed or evicted
+	el *list.Element
+}
+
+// Usage is the memory use of one cache
+type Usage struct {
+	// Bytes and Entries are the current use, Evictions counts the entries
+	// that have been evicted to stay within the budget.
+	Bytes     uint64
+	Entries   uint64
+	Evictions uint64
+}
+
+// Budget limits the total memory use of the caches. All methods are safe for
+// concurrent use. A nil *Budget charges nothing and never evicts.
+type Budget struct {
+	mu sync.Mutex
+	// max is the limit in bytes, used the bytes currently charged
+	max, used int64
+	// lru holds *Item elements, most recently used first
+	lru *list.List
+	// caches is the accounting per cache name
+	caches map[string]*Usage
+}
+
+// New returns a budget of "max" bytes.
+func New(max int64) *Budget {
+	return &Budget{
+		max:    max,
+		lru:    list.New(),
+		caches: make(map[string]*Usage),
+	}
+}
+
+// Add charges "size" bytes for a new entry of the cache "cache". Evict()
+// calls "evict" to drop the entry again. As the entry may have been replaced
+// in the meantime, "evict" must check that the entry still belongs to the
+// returned Item.
+//
+// Add itself never evicts, so it can be called while holding the lock of the
+// cache. Returns nil if the entry alone exceeds the budget and should not be
+// cached.
+func (b *Budget) Add(cache string, size int64, evict func()) *Item {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if size > b.max {
+		return nil
+	}
+	it := &Item{cache: cache, size: size, evict: evict}
+	it.el = b.lru.PushFront(it)
+	b.used += size
+	u := b.usage(cache)
+	u.Bytes += uint64(size)
+	u.Entries++
+	return it
+}
+
+// usage returns the accounting of "cache". The caller must hold b.mu.
+func (b *Budget) usage(cache string) *Usage {
+	u := b.caches[cache]
+	if u == nil {
+		u = &Usage{}
+		b.caches[cache] = u
+	}
+	return u
+}
+
+// Touch marks "it" as the most recently used entry.
+func (b *Budget) Touch(it *Item) {
+	if b == nil || it == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if it.el != nil {
+		b.lru.MoveToFront(it.el)
+	}
+}
+
+// Remove stops charging "it". To be called when the cache drops the entry
+// on its own. Removing an item that has already been evicted is a no-op.
+func (b *Budget) Remove(it *Item) {
+	if b == nil || it == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(it)
+}
+
+// remove unlinks "it". The caller must hold b.mu.
+func (b *Budget) remove(it *Item) {
+	if it.el == nil {
+		return
+	}
+	b.lru.Remove(it.el)
+	it.el = nil
+	b.used -= it.size
+	u := b.caches[it.cache]
+	u.Bytes -= uint64(it.size)
+	u.Entries--
+}
+
+// Evict drops the least recently used entries until the budget is met.
+// It calls the "evict" functions of the entries, so it must not be called
+// while holding the lock of a cache.
+func (b *Budget) Evict() {
+	if b == nil {
+		return
+	}
+	var victims []*Item
+	b.mu.Lock()
+	for b.used > b.max {
+		it := b.lru.Back().Value.(*Item)
+		b.remove(it)
+		b.caches[it.cache].Evictions++
+		victims = append(victims, it)
+	}
+	b.mu.Unlock()
+	for _, it := range victims {
+		it.evict()
+	}
+}
+
+// Max returns the limit in bytes.
+func (b *Budget) Max() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.max
+}
+
+// SetMax changes the limit to "max" bytes, and evicts entries if the caches
+// use more than that. Like Evict(), it must not be called while holding the
+// lock of a cache.
+func (b *Budget) SetMax(max int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.max = max
+	b.mu.Unlock()
+	b.Evict()
+}
+
+// Usage returns the accounting of all caches that have charged the budget,
+// by cache name.
+func (b *Budget) Usage() map[string]Usage {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string]Usage, len(b.caches))
+	for name, u := range b.caches {
+		out[name] = *u
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package membudget
+
+import (
+	"testing"
+)
+
+func TestBudget(t *testing.T) {
+	b := New(100)
+	cache := map[string]*Item{}
+	add := func(name string, key string, size int64) {
+		var it *Item
+		it = b.Add(name, size, func() {
+			if cache[key] == it {
+				delete(cache, key)
+			}
+		})
+		cache[key] = it
+	}
+	add("a", "a1", 40)
+	add("b", "b1", 40)
+	b.Touch(cache["a1"])
+	// Exceeds the budget, and b1 is the least recently used entry
+	add("a", "a2", 40)
+	b.Evict()
+	if cache["b1"] != nil {
+		t.Error("b1 should have been evicted")
+	}
+	if cache["a1"] == nil || cache["a2"] == nil {
+		t.Error("a1 and a2 should be cached")
+	}
+	u := b.Usage()
+	if u["a"].Bytes != 80 || u["a"].Entries != 2 || u["a"].Evictions != 0 {
+		t.Errorf("wrong usage of a: %+v", u["a"])
+	}
+	if u["b"].Bytes != 0 || u["b"].Entries != 0 || u["b"].Evictions != 1 {
+		t.Errorf("wrong usage of b: %+v", u["b"])
+	}
+	// Removing twice must not corrupt the accounting
+	b.Remove(cache["a1"])
+	b.Remove(cache["a1"])
+	if b.used != 40 {
+		t.Errorf("wrong used %d", b.used)
+	}
+	// Too big for the whole budget
+	if b.Add("a", 101, nil) != nil {
+		t.Error("an entry larger than the budget should be rejected")
+	}
+}
+
+func TestSetMax(t *testing.T) {
+	b := New(100)
+	evicted := 0
+	for i := 0; i < 4; i++ {
+		b.Add("a", 20, func() { evicted++ })
+	}
+	b.SetMax(50)
+	if evicted != 2 || b.used != 40 {
+		t.Errorf("want 2 evictions and 40 bytes used, got %d and %d", evicted, b.used)
+	}
+	if b.Max() != 50 {
+		t.Errorf("wrong max %d", b.Max())
+	}
+	if b.Add("a", 60, nil) != nil {
+		t.Error("an entry larger than the new budget should be rejected")
+	}
+}
+
+func TestNil(t *testing.T) {
+	var b *Budget
+	it := b.Add("a", 10, nil)
+	b.Touch(it)
+	b.Remove(it)
+	b.Evict()
+	b.SetMax(10)
+	if b.Usage() != nil || b.Max() != 0 {
+		t.Error("nil budget should be empty")
+	}
+}
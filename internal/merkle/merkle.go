@@ -0,0 +1,316 @@
+// Package merkle implements the per-file hash trees of filesystems created
+// with "-merkle".
+//
+// The leaves of a tree are the SHA-256 hashes of the ciphertext blocks of a
+// file, the inner nodes hash their two children. The root is authenticated,
+// together with the file ID and the number of blocks, in the file header
+// (see State). Authenticated encryption already detects changes to a block
+// and blocks moved to a different position, but not a file that has been
+// cut off at a block boundary, or a block that has been zeroed and now
+// looks like a file hole. The tree catches both.
+//
+// The nodes are kept in a tree file, and only read when needed. Node j of
+// level l (level 0 holds the leaves) covers the leaves j*2^l to
+// (j+1)*2^l-1, and is stored at position (2j+1)*2^l-1. This is the in-order
+// position, which does not depend on the number of leaves, so a file can
+// grow without moving nodes. Only complete nodes, whose leaves all exist,
+// are stored. The others are computed from their children, where a node
+// without a right child is passed up unchanged.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"sort"
+)
+
+// HashLen is the length of every node in the tree
+const HashLen = sha256.Size
+
+// Prefixes that separate leaf hashes from inner node hashes, like in
+// RFC 6962 (Certificate Transparency)
+const (
+	leafPrefix = 0
+	nodePrefix = 1
+)
+
+// zeroNode is the leaf of a file hole, and the parent of two zeroNodes. As
+// the tree file reads as zeros where nothing has been written, a file can
+// be extended by a hole without writing the nodes below it.
+var zeroNode = make([]byte, HashLen)
+
+// emptyRoot is the root of a tree without leaves
+var emptyRoot = sha256.New().Sum(nil)
+
+// LeafHash returns the leaf for the ciphertext block "block"
+func LeafHash(block []byte) []byte {
+	if isZero(block) {
+		// File hole
+		return zeroNode
+	}
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(block)
+	return h.Sum(nil)
+}
+
+// parent returns the parent of the nodes "left" and "right"
+func parent(left []byte, right []byte) []byte {
+	if isZero(left) && isZero(right) {
+		return zeroNode
+	}
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// isZero returns true if "buf" only contains zeros
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Tree is the hash tree of one file. Only the root and the number of leaves
+// are kept in memory. Tree is not safe for concurrent modification, but
+// Verify() may run concurrently.
+type Tree struct {
+	// f is the tree file
+	f *os.File
+	// n is the number of leaves
+	n int
+	// root is the root of the n leaves
+	root []byte
+	// size is the length of the tree file. Nothing behind it has been
+	// written, or it has been truncated away.
+	size int64
+	// id and key authenticate the state in the file header
+	id  []byte
+	key []byte
+	// dirtyFrom is the first block that may have changed since the state
+	// in the file header has been marked clean. -1 if it is clean.
+	dirtyFrom int
+}
+
+// Len returns the number of leaves
+func (t *Tree) Len() int {
+	return t.n
+}
+
+// Root returns the root hash
+func (t *Tree) Root() []byte {
+	return t.root
+}
+
+// Close closes the tree file
+func (t *Tree) Close() error {
+	return t.f.Close()
+}
+
+// pos returns the position of node "j" of level "l" in the tree file
+func pos(l int, j int) int64 {
+	return int64(2*j+1)<<uint(l) - 1
+}
+
+// complete returns true if all leaves below node "j" of level "l" exist in
+// a tree with "n" leaves
+func complete(l int, j int, n int) bool {
+	return (j+1)<<uint(l) <= n
+}
+
+// read returns the stored node "j" of level "l"
+func (t *Tree) read(l int, j int) ([]byte, error) {
+	buf := make([]byte, HashLen)
+	off := pos(l, j) * HashLen
+	if off >= t.size {
+		return buf, nil
+	}
+	n, err := t.f.ReadAt(buf, off)
+	if err == io.EOF {
+		// Short tree file, the rest reads as zeros
+		err = nil
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return buf, err
+}
+
+// write stores node "j" of level "l"
+func (t *Tree) write(l int, j int, node []byte) error {
+	off := pos(l, j) * HashLen
+	if _, err := t.f.WriteAt(node, off); err != nil {
+		return err
+	}
+	if end := off + HashLen; end > t.size {
+		t.size = end
+	}
+	return nil
+}
+
+// value returns node "j" of level "l" in a tree that only has the first "n"
+// leaves. It reads complete nodes and computes the others.
+func (t *Tree) value(l int, j int, n int) ([]byte, error) {
+	if complete(l, j, n) {
+		return t.read(l, j)
+	}
+	left, err := t.value(l-1, 2*j, n)
+	if err != nil || (2*j+1)<<uint(l-1) >= n {
+		// No right child
+		return left, err
+	}
+	right, err := t.value(l-1, 2*j+1, n)
+	if err != nil {
+		return nil, err
+	}
+	return parent(left, right), nil
+}
+
+// rootOf returns the root of the first "n" leaves
+func (t *Tree) rootOf(n int) ([]byte, error) {
+	if n == 0 {
+		return emptyRoot, nil
+	}
+	l := 0
+	for 1<<uint(l) < n {
+		l++
+	}
+	return t.value(l, 0, n)
+}
+
+// Verify returns true if "leaves" are the leaves starting at number
+// "first". No leaves are always fine, also behind the end of the tree.
+func (t *Tree) Verify(first int, leaves [][]byte) (bool, error) {
+	if len(leaves) == 0 {
+		return true, nil
+	}
+	if first+len(leaves) > t.n {
+		return false, nil
+	}
+	// Compute the parents of the leaves level by level, taking the other
+	// nodes from the tree file, up to the root
+	vals, lo := leaves, first
+	for l := 0; 1<<uint(l) < t.n; l++ {
+		hi := lo + len(vals) - 1
+		get := func(j int) ([]byte, error) {
+			if j >= lo && j <= hi {
+				return vals[j-lo], nil
+			}
+			return t.value(l, j, t.n)
+		}
+		var next [][]byte
+		for p := lo / 2; p <= hi/2; p++ {
+			left, err := get(2 * p)
+			if err != nil {
+				return false, err
+			}
+			if (2*p+1)<<uint(l) >= t.n {
+				next = append(next, left)
+				continue
+			}
+			right, err := get(2*p + 1)
+			if err != nil {
+				return false, err
+			}
+			next = append(next, parent(left, right))
+		}
+		vals, lo = next, lo/2
+	}
+	return bytes.Equal(vals[0], t.root), nil
+}
+
+// Update replaces the leaves starting at number "first" with "leaves". If
+// the tree grows, skipped leaves are file holes.
+func (t *Tree) Update(first int, leaves [][]byte) error {
+	old := t.n
+	if end := first + len(leaves); end > t.n {
+		if err := t.grow(end); err != nil {
+			return err
+		}
+	}
+	for i, leaf := range leaves {
+		if err := t.write(0, first+i, leaf); err != nil {
+			return err
+		}
+	}
+	return t.recompute(first, first+len(leaves), old)
+}
+
+// Resize changes the number of leaves to "n". New leaves are file holes.
+func (t *Tree) Resize(n int) error {
+	if n > t.n {
+		old := t.n
+		if err := t.grow(n); err != nil {
+			return err
+		}
+		return t.recompute(0, 0, old)
+	}
+	// The complete nodes of the remaining leaves do not change
+	t.n = n
+	var err error
+	t.root, err = t.rootOf(n)
+	return err
+}
+
+// grow sets the number of leaves to "n". Nodes behind the current leaves
+// may be left over from before a Resize() that shrunk the tree, so they are
+// truncated away first. Nodes that have to be kept are in front of them.
+func (t *Tree) grow(n int) error {
+	keep := int64(0)
+	if t.n > 0 {
+		keep = (2*int64(t.n) - 1) * HashLen
+	}
+	if t.size > keep {
+		if err := t.f.Truncate(keep); err != nil {
+			return err
+		}
+		t.size = keep
+	}
+	t.n = n
+	return nil
+}
+
+// recompute updates the complete inner nodes above the leaves "lo" to
+// "hi"-1, and above the last leaf of a tree that has grown from "old"
+// leaves, and then the root
+func (t *Tree) recompute(lo int, hi int, old int) error {
+	for l := 1; 1<<uint(l-1) < t.n; l++ {
+		var nodes []int
+		if lo < hi {
+			for j := lo >> uint(l); j <= (hi-1)>>uint(l); j++ {
+				nodes = append(nodes, j)
+			}
+		}
+		if old > 0 && old < t.n {
+			// Nodes that were incomplete before the tree has grown
+			nodes = append(nodes, (old-1)>>uint(l))
+		}
+		sort.Ints(nodes)
+		for i, j := range nodes {
+			if (i > 0 && nodes[i-1] == j) || !complete(l, j, t.n) {
+				continue
+			}
+			left, err := t.read(l-1, 2*j)
+			if err != nil {
+				return err
+			}
+			right, err := t.read(l-1, 2*j+1)
+			if err != nil {
+				return err
+			}
+			if err = t.write(l, j, parent(left, right)); err != nil {
+				return err
+			}
+		}
+	}
+	var err error
+	t.root, err = t.rootOf(t.n)
+	return err
+}
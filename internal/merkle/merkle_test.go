@@ -0,0 +1,232 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{1}, 32)
+
+var testID = bytes.Repeat([]byte{7}, 16)
+
+// leaves returns "n" different leaves
+func leaves(n int) [][]byte {
+	var out [][]byte
+	for i := 0; i < n; i++ {
+		out = append(out, LeafHash([]byte(fmt.Sprint(i))))
+	}
+	return out
+}
+
+// refRoot computes the root of "leaves" from scratch
+func refRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return emptyRoot
+	}
+	for len(leaves) > 1 {
+		var next [][]byte
+		for i := 0; i < len(leaves); i += 2 {
+			if i+1 == len(leaves) {
+				next = append(next, leaves[i])
+			} else {
+				next = append(next, parent(leaves[i], leaves[i+1]))
+			}
+		}
+		leaves = next
+	}
+	return leaves[0]
+}
+
+// openTest returns a new tree in "dir"
+func openTest(t *testing.T, dir string) (*Store, *Tree) {
+	s, err := OpenStore(dir, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := s.Open(testID, s.NewState(testID), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, tree
+}
+
+// Incremental updates must give the same root as building the tree from
+// scratch, and Verify() must accept the leaves and nothing else
+func TestIncremental(t *testing.T) {
+	_, tree := openTest(t, t.TempDir())
+	defer tree.Close()
+	var want [][]byte
+	resize := func(n int) {
+		for len(want) < n {
+			want = append(want, zeroNode)
+		}
+		want = want[:n]
+	}
+	all := leaves(40)
+	steps := []struct {
+		first, count, resize int
+	}{
+		{0, 1, -1}, {1, 2, -1}, {0, 3, -1}, {5, 2, -1}, {-1, 0, 9}, {8, 1, -1},
+		{-1, 0, 5}, {3, 4, -1}, {-1, 0, 1}, {-1, 0, 0}, {16, 1, -1}, {0, 16, -1},
+		{-1, 0, 3}, {2, 31, -1}, {-1, 0, 40}, {39, 1, -1}, {-1, 0, 17},
+	}
+	for k, s := range steps {
+		if s.resize >= 0 {
+			if err := tree.Resize(s.resize); err != nil {
+				t.Fatal(err)
+			}
+			resize(s.resize)
+		} else {
+			if err := tree.Update(s.first, all[s.first:s.first+s.count]); err != nil {
+				t.Fatal(err)
+			}
+			if s.first+s.count > len(want) {
+				resize(s.first + s.count)
+			}
+			copy(want[s.first:], all[s.first:s.first+s.count])
+		}
+		if tree.Len() != len(want) {
+			t.Fatalf("step %d: Len()=%d, want %d", k, tree.Len(), len(want))
+		}
+		if !bytes.Equal(tree.Root(), refRoot(want)) {
+			t.Fatalf("step %d: root mismatch", k)
+		}
+		for i := range want {
+			if ok, err := tree.Verify(i, want[i:]); !ok || err != nil {
+				t.Fatalf("step %d: leaves from %d do not verify: %v", k, i, err)
+			}
+			other := LeafHash([]byte("other"))
+			if ok, _ := tree.Verify(i, [][]byte{other}); ok {
+				t.Fatalf("step %d: wrong leaf %d verifies", k, i)
+			}
+		}
+		if ok, _ := tree.Verify(len(want), [][]byte{zeroNode}); ok {
+			t.Fatalf("step %d: leaf behind the end verifies", k)
+		}
+	}
+}
+
+// LeafHash() of a zeroed block is the leaf of a hole
+func TestHole(t *testing.T) {
+	if !bytes.Equal(LeafHash(make([]byte, 100)), zeroNode) {
+		t.Error("zero block is not a hole")
+	}
+	if bytes.Equal(LeafHash([]byte{1}), zeroNode) {
+		t.Error("non-zero block is a hole")
+	}
+}
+
+// state returns the state of "tree" after marking it clean
+func state(t *testing.T, tree *Tree) (st []byte) {
+	err := tree.MarkClean(func(s []byte) error {
+		st = s
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, tree := openTest(t, dir)
+	if err := tree.Update(0, leaves(5)); err != nil {
+		t.Fatal(err)
+	}
+	clean := state(t, tree)
+	if _, dirty := tree.Dirty(); dirty {
+		t.Error("tree still dirty")
+	}
+	root := tree.Root()
+	tree.Close()
+
+	loaded, err := s.Open(testID, clean, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Root(), root) {
+		t.Error("loaded tree differs")
+	}
+	loaded.Close()
+	// A different number of blocks, file ID or root does not verify
+	if _, err = s.Open(testID, clean, 4); err == nil {
+		t.Error("truncated file was accepted")
+	}
+	other := bytes.Repeat([]byte{8}, 16)
+	os.Link(s.path(testID), s.path(other))
+	if _, err = s.Open(other, clean, 5); err == nil {
+		t.Error("tree of a different file was accepted")
+	}
+	f, _ := os.OpenFile(s.path(testID), os.O_WRONLY, 0)
+	f.WriteAt(LeafHash([]byte("x")), pos(0, 4)*HashLen)
+	f.Close()
+	if _, err = s.Open(testID, clean, 5); err == nil {
+		t.Error("modified tree was accepted")
+	}
+	for _, id := range [][]byte{testID, other, testID} {
+		if err = s.Remove(id); err != nil {
+			t.Errorf("Remove: %v", err)
+		}
+	}
+	// Only the reserveddir marker is left
+	path := filepath.Join(dir, DirName)
+	if entries, _ := os.ReadDir(path); len(entries) != 1 {
+		t.Errorf("%d files left in %s", len(entries)-1, path)
+	}
+}
+
+// A crash leaves the state dirty. The tree must then be rebuilt from the
+// dirty block on, and the blocks before it must still be protected.
+func TestDirty(t *testing.T) {
+	s, tree := openTest(t, t.TempDir())
+	all := leaves(20)
+	tree.Update(0, all[:10])
+	state(t, tree)
+	var dirty []byte
+	save := func(st []byte) error {
+		dirty = st
+		return nil
+	}
+	if err := tree.MarkDirty(6, save); err != nil {
+		t.Fatal(err)
+	}
+	// Already dirty from there on
+	saved := dirty
+	tree.MarkDirty(8, save)
+	if !bytes.Equal(dirty, saved) {
+		t.Error("state was saved again")
+	}
+	// "Crash" in the middle of a write
+	tree.Update(6, all[6:])
+	tree.Close()
+
+	// The blocks before the dirty one are protected, also against
+	// truncation
+	if _, err := s.Open(testID, dirty, 5); err == nil {
+		t.Error("file truncated before the dirty block was accepted")
+	}
+	tree, err := s.Open(testID, dirty, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if from, ok := tree.Dirty(); !ok || from != 6 {
+		t.Fatalf("Dirty()=%d,%v", from, ok)
+	}
+	// Rebuild with what made it to disk
+	want := append(append([][]byte{}, all[:8]...), zeroNode, all[2], all[10], all[11])
+	tree.Update(6, want[6:])
+	if !bytes.Equal(tree.Root(), refRoot(want)) {
+		t.Error("rebuilt tree has the wrong root")
+	}
+	if ok, _ := tree.Verify(0, want); !ok {
+		t.Error("rebuilt tree does not verify")
+	}
+	if ok, _ := tree.Verify(2, all[3:4]); ok {
+		t.Error("wrong leaf verifies")
+	}
+}
@@ -0,0 +1,211 @@
+package merkle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/reserveddir"
+)
+
+// DirName is the name of the directory in the root of CIPHERDIR that holds
+// the tree files
+const DirName = "gocryptfs.merkle"
+
+// State is kept behind the file header, see contentenc.SetHeaderExt:
+//
+//	[ dirty byte ] [ number uint64 big endian ] [ MAC ]
+//
+// A clean state authenticates the whole tree. "number" is the number of
+// leaves, and the MAC is HMAC-SHA256 over file ID, dirty byte, number and
+// root.
+//
+// Before a block is changed, the state is marked dirty from that block on
+// and made durable. "number" is then the first block that may have
+// changed, and the MAC covers the root of the leaves before it. These
+// nodes do not change while the state is dirty, so a crash at any point
+// leaves a state that can be verified. The leaves from "number" on are
+// then hashed again from the file contents. The state is marked clean
+// again when the file is closed.
+const (
+	dirtyLen  = 1
+	numberLen = 8
+	macLen    = sha256.Size
+	// StateLen is the length of the state
+	StateLen = dirtyLen + numberLen + macLen
+)
+
+// Store keeps the tree files in DirName, one per file ID. Files with the
+// same ID (hard links) share a tree. A nil *Store stores nothing.
+type Store struct {
+	dir string
+	key []byte
+}
+
+// OpenStore opens the tree directory in "cipherdir", creating it if it does
+// not exist. The states are authenticated with "key".
+func OpenStore(cipherdir string, key []byte) (*Store, error) {
+	dir := filepath.Join(cipherdir, DirName)
+	if err := reserveddir.Mkdir(dir); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, key: key}, nil
+}
+
+// path returns the tree file of "fileID"
+func (s *Store) path(fileID []byte) string {
+	return filepath.Join(s.dir, hex.EncodeToString(fileID))
+}
+
+// mac authenticates "root" as the root of "fileID" in the state with the
+// dirty flag "dirty" and the number "number"
+func mac(key []byte, fileID []byte, dirty bool, number int, root []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(fileID)
+	var buf [dirtyLen + numberLen]byte
+	if dirty {
+		buf[0] = 1
+	}
+	binary.BigEndian.PutUint64(buf[dirtyLen:], uint64(number))
+	h.Write(buf[:])
+	h.Write(root)
+	return h.Sum(nil)
+}
+
+// packState serializes a state
+func packState(key []byte, fileID []byte, dirty bool, number int, root []byte) []byte {
+	buf := make([]byte, StateLen)
+	if dirty {
+		buf[0] = 1
+	}
+	binary.BigEndian.PutUint64(buf[dirtyLen:], uint64(number))
+	copy(buf[dirtyLen+numberLen:], mac(key, fileID, dirty, number, root))
+	return buf
+}
+
+// NewState returns the state of a new file with the ID "fileID", which is
+// dirty from the first block on
+func (s *Store) NewState(fileID []byte) []byte {
+	return packState(s.key, fileID, true, 0, emptyRoot)
+}
+
+// Open opens the tree of "fileID", which has "n" blocks, and verifies it
+// against "state" from the file header. If the state is dirty, the caller
+// must Update() the leaves from Dirty() on with the hashes of the blocks.
+func (s *Store) Open(fileID []byte, state []byte, n int) (*Tree, error) {
+	if len(state) != StateLen || state[0] > 1 {
+		return nil, fmt.Errorf("invalid tree state %x", state)
+	}
+	dirty := state[0] == 1
+	number64 := binary.BigEndian.Uint64(state[dirtyLen:])
+	if dirty && number64 > uint64(n) {
+		return nil, fmt.Errorf("file has %d blocks, but it had at least %d. It has been truncated.", n, number64)
+	} else if !dirty && number64 != uint64(n) {
+		return nil, fmt.Errorf("file has %d blocks, but its hash tree has %d. It has been truncated or extended.",
+			n, number64)
+	}
+	number := int(number64)
+	f, err := os.OpenFile(s.path(fileID), os.O_RDWR|os.O_CREATE, 0600)
+	if os.IsPermission(err) || errors.Is(err, syscall.EROFS) {
+		// Read-only CIPHERDIR. Clean trees can still be verified.
+		f, err = os.Open(s.path(fileID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t := &Tree{f: f, n: number, size: fi.Size(), id: fileID, key: s.key, dirtyFrom: -1}
+	if dirty {
+		t.dirtyFrom = number
+	}
+	if t.root, err = t.rootOf(number); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !hmac.Equal(mac(s.key, fileID, dirty, number, t.root), state[dirtyLen+numberLen:]) {
+		f.Close()
+		return nil, fmt.Errorf("hash tree does not match the MAC in the file header")
+	}
+	// Truncate away the nodes behind the leaves that are covered by the
+	// state, see grow()
+	if err = t.grow(n); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Dirty returns the first block that may have changed since the state has
+// last been marked clean, and false if it is clean
+func (t *Tree) Dirty() (int, bool) {
+	return t.dirtyFrom, t.dirtyFrom >= 0
+}
+
+// MarkDirty must be called before blocks from number "from" on are
+// changed. Unless the state is already dirty from there on, it calls
+// "save" with the new state, which must write it to the file header and
+// make it durable.
+func (t *Tree) MarkDirty(from int, save func(state []byte) error) error {
+	if from > t.n {
+		from = t.n
+	}
+	if t.dirtyFrom >= 0 && t.dirtyFrom <= from {
+		return nil
+	}
+	if t.dirtyFrom >= 0 {
+		// The new state covers nodes that have been written since it has
+		// been marked dirty
+		if err := t.f.Sync(); err != nil {
+			return err
+		}
+	}
+	root, err := t.rootOf(from)
+	if err != nil {
+		return err
+	}
+	if err = save(packState(t.key, t.id, true, from, root)); err != nil {
+		return err
+	}
+	t.dirtyFrom = from
+	return nil
+}
+
+// MarkClean makes the tree file durable and calls "save" with a clean
+// state, which must write it to the file header. The caller must have made
+// the blocks durable before.
+func (t *Tree) MarkClean(save func(state []byte) error) error {
+	if t.dirtyFrom < 0 {
+		return nil
+	}
+	if err := t.f.Sync(); err != nil {
+		return err
+	}
+	if err := save(packState(t.key, t.id, false, t.n, t.root)); err != nil {
+		return err
+	}
+	t.dirtyFrom = -1
+	return nil
+}
+
+// Remove deletes the tree file of "fileID". A missing tree file is not an
+// error.
+func (s *Store) Remove(fileID []byte) error {
+	if s == nil {
+		return nil
+	}
+	err := syscall.Unlink(s.path(fileID))
+	if err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
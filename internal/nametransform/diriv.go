@@ -71,17 +71,22 @@ func WriteDirIVAt(dirfd int) error {
 	// https://github.com/rfjakob/gocryptfs/commit/7d38f80a78644c8ec4900cc990bfb894387112ed
 	fd, err := syscallcompat.Openat(dirfd, DirIVFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, dirivPerms)
 	if err != nil {
-		tlog.Warn.Printf("WriteDirIV: Openat: %v", err)
+		tlog.NameTransform.Warn.Printf("WriteDirIV: Openat: %v", err)
 		return err
 	}
 	// Wrap the fd in an os.File - we need the write retry logic.
 	f := os.NewFile(uintptr(fd), DirIVFilename)
 	_, err = f.Write(iv)
+	if err == nil {
+		// Without gocryptfs.diriv, no file in the directory can be
+		// decrypted. Make sure it survives a crash.
+		err = f.Sync()
+	}
 	if err != nil {
 		f.Close()
 		// It is normal to get ENOSPC here
 		if !syscallcompat.IsENOSPC(err) {
-			tlog.Warn.Printf("WriteDirIV: Write: %v", err)
+			tlog.NameTransform.Warn.Printf("WriteDirIV: Write: %v", err)
 		}
 		// Delete incomplete gocryptfs.diriv file
 		syscallcompat.Unlinkat(dirfd, DirIVFilename, 0)
@@ -89,10 +94,21 @@ func WriteDirIVAt(dirfd int) error {
 	}
 	err = f.Close()
 	if err != nil {
-		tlog.Warn.Printf("WriteDirIV: Close: %v", err)
+		tlog.NameTransform.Warn.Printf("WriteDirIV: Close: %v", err)
 		// Delete incomplete gocryptfs.diriv file
 		syscallcompat.Unlinkat(dirfd, DirIVFilename, 0)
 		return err
 	}
+	// Also sync the directory entry. "dirfd" may be an O_PATH fd, which
+	// cannot be synced, so open the directory again. This is best-effort,
+	// as some filesystems do not support syncing directories.
+	fd, err = syscallcompat.Openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err == nil {
+		err = syscall.Fsync(fd)
+		syscall.Close(fd)
+	}
+	if err != nil {
+		tlog.NameTransform.Debug.Printf("WriteDirIV: could not sync directory: %v", err)
+	}
 	return nil
 }
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/blake3"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -20,18 +21,39 @@ const (
 	// gocryptfs.longname.[sha256].name  <--- File name, suffix = .name
 	LongNameSuffix = ".name"
 	longNamePrefix = "gocryptfs.longname."
+
+	// LongNameHashSHA256 selects SHA-256 for hashing long names. This is
+	// the default.
+	LongNameHashSHA256 = "sha256"
+	// LongNameHashBLAKE3 selects keyed BLAKE3 for hashing long names.
+	LongNameHashBLAKE3 = "blake3"
 )
 
 // HashLongName - take the hash of a long string "name" and return
 // "gocryptfs.longname.[sha256]"
 //
+// With "-longnamehash=blake3", the keyed BLAKE3 hash is used instead of
+// SHA-256. It has the same length, so the result looks the same.
+//
 // This function does not do any I/O.
 func (n *NameTransform) HashLongName(name string) string {
-	hashBin := sha256.Sum256([]byte(name))
+	var hashBin [32]byte
+	if n.longNameKey != nil {
+		hashBin = blake3.SumKeyed256(n.longNameKey, []byte(name))
+	} else {
+		hashBin = sha256.Sum256([]byte(name))
+	}
 	hashBase64 := n.B64.EncodeToString(hashBin[:])
 	return longNamePrefix + hashBase64
 }
 
+// SetLongNameKey switches HashLongName to keyed BLAKE3 using "key"
+// ("-longnamehash=blake3").
+func (n *NameTransform) SetLongNameKey(key []byte) {
+	n.longNameKey = new([blake3.KeySize]byte)
+	copy(n.longNameKey[:], key)
+}
+
 // Values returned by IsLongName
 const (
 	// LongNameContent is the file that stores the file content.
@@ -114,7 +136,7 @@ func ReadLongNameAt(dirfd int, cName string) (string, error) {
 func DeleteLongNameAt(dirfd int, hashName string) error {
 	err := syscallcompat.Unlinkat(dirfd, hashName+LongNameSuffix, 0)
 	if err != nil {
-		tlog.Warn.Printf("DeleteLongNameAt: %v", err)
+		tlog.NameTransform.Warn.Printf("DeleteLongNameAt: %v", err)
 	}
 	return err
 }
@@ -144,7 +166,7 @@ func (n *NameTransform) WriteLongNameAt(dirfd int, hashName string, plainName st
 		// Don't warn if the file already exists - this is allowed for renames
 		// and should be handled by the caller.
 		if err != syscall.EEXIST {
-			tlog.Warn.Printf("WriteLongName: Openat: %v", err)
+			tlog.NameTransform.Warn.Printf("WriteLongName: Openat: %v", err)
 		}
 		return err
 	}
@@ -152,14 +174,14 @@ func (n *NameTransform) WriteLongNameAt(dirfd int, hashName string, plainName st
 	_, err = fd.Write([]byte(cName))
 	if err != nil {
 		fd.Close()
-		tlog.Warn.Printf("WriteLongName: Write: %v", err)
+		tlog.NameTransform.Warn.Printf("WriteLongName: Write: %v", err)
 		// Delete incomplete longname file
 		syscallcompat.Unlinkat(dirfd, hashName+LongNameSuffix, 0)
 		return err
 	}
 	err = fd.Close()
 	if err != nil {
-		tlog.Warn.Printf("WriteLongName: Close: %v", err)
+		tlog.NameTransform.Warn.Printf("WriteLongName: Close: %v", err)
 		// Delete incomplete longname file
 		syscallcompat.Unlinkat(dirfd, hashName+LongNameSuffix, 0)
 		return err
@@ -1,6 +1,7 @@
 package nametransform
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 
@@ -69,3 +70,39 @@ func TestLongNameMax(t *testing.T) {
 		}
 	}
 }
+
+func TestHashLongNameBLAKE3(t *testing.T) {
+	n := newLognamesTestInstance(0)
+	name := strings.Repeat("x", 300)
+	h1 := n.HashLongName(name)
+	n.SetLongNameKey(make([]byte, 32))
+	h2 := n.HashLongName(name)
+	if h1 == h2 {
+		t.Error("BLAKE3 and SHA-256 hashes are identical")
+	}
+	if len(h1) != len(h2) || NameType(h2) != LongNameContent {
+		t.Errorf("BLAKE3 hash %q does not look like a long name", h2)
+	}
+	n.SetLongNameKey(bytes.Repeat([]byte{1}, 32))
+	if h3 := n.HashLongName(name); h3 == h2 {
+		t.Error("BLAKE3 hash does not depend on the key")
+	}
+}
+
+func benchmarkHashLongName(b *testing.B, n *NameTransform) {
+	// 255 bytes, encrypted and base64-encoded
+	name := strings.Repeat("x", 343)
+	for i := 0; i < b.N; i++ {
+		n.HashLongName(name)
+	}
+}
+
+func BenchmarkHashLongNameSHA256(b *testing.B) {
+	benchmarkHashLongName(b, newLognamesTestInstance(0))
+}
+
+func BenchmarkHashLongNameBLAKE3(b *testing.B) {
+	n := newLognamesTestInstance(0)
+	n.SetLongNameKey(make([]byte, 32))
+	benchmarkHashLongName(b, n)
+}
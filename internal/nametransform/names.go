@@ -8,8 +8,7 @@ import (
 	"path/filepath"
 	"syscall"
 
-	"github.com/rfjakob/eme"
-
+	"github.com/rfjakob/gocryptfs/v2/internal/blake3"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -20,7 +19,8 @@ const (
 
 // NameTransform is used to transform filenames.
 type NameTransform struct {
-	emeCipher *eme.EMECipher
+	// nameCipher is EME, or HCTR2 with "-hctr2"
+	nameCipher WideBlockCipher
 	// Names longer than `longNameMax` are hashed. Set to MaxInt when
 	// longnames are disabled.
 	longNameMax int
@@ -30,6 +30,17 @@ type NameTransform struct {
 	// Patterns to bypass decryption
 	badnamePatterns    []string
 	deterministicNames bool
+	// longNameKey is the BLAKE3 key for hashing long names, or nil to use
+	// SHA-256
+	longNameKey *[blake3.KeySize]byte
+}
+
+// WideBlockCipher is the tweakable, length-preserving cipher that encrypts
+// the padded file names. It is implemented by *eme.EMECipher and
+// *hctr2.HCTR2.
+type WideBlockCipher interface {
+	Encrypt(tweak []byte, inputData []byte) []byte
+	Decrypt(tweak []byte, inputData []byte) []byte
 }
 
 // New returns a new NameTransform instance.
@@ -37,8 +48,8 @@ type NameTransform struct {
 // If `longNames` is set, names longer than `longNameMax` are hashed to
 // `gocryptfs.longname.[sha256]`.
 // Pass `longNameMax = 0` to use the default value (255).
-func New(e *eme.EMECipher, longNames bool, longNameMax uint8, raw64 bool, badname []string, deterministicNames bool) *NameTransform {
-	tlog.Debug.Printf("nametransform.New: longNameMax=%v, raw64=%v, badname=%q",
+func New(e WideBlockCipher, longNames bool, longNameMax uint8, raw64 bool, badname []string, deterministicNames bool) *NameTransform {
+	tlog.NameTransform.Debug.Printf("nametransform.New: longNameMax=%v, raw64=%v, badname=%q",
 		longNameMax, raw64, badname)
 	b64 := base64.URLEncoding
 	if raw64 {
@@ -53,7 +64,7 @@ func New(e *eme.EMECipher, longNames bool, longNameMax uint8, raw64 bool, badnam
 		}
 	}
 	return &NameTransform{
-		emeCipher:          e,
+		nameCipher:         e,
 		longNameMax:        effectiveLongNameMax,
 		B64:                b64,
 		badnamePatterns:    badname,
@@ -72,7 +83,7 @@ func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error
 		return "", err
 	}
 	if err := IsValidName(res); err != nil {
-		tlog.Warn.Printf("DecryptName %q: invalid name after decryption: %v", cipherName, err)
+		tlog.NameTransform.Warn.Printf("DecryptName %q: invalid name after decryption: %v", cipherName, err)
 		return "", syscall.EBADMSG
 	}
 	return res, err
@@ -86,17 +97,17 @@ func (n *NameTransform) decryptName(cipherName string, iv []byte) (string, error
 		return "", err
 	}
 	if len(bin) == 0 {
-		tlog.Warn.Printf("decryptName: empty input")
+		tlog.NameTransform.Warn.Printf("decryptName: empty input")
 		return "", syscall.EBADMSG
 	}
 	if len(bin)%aes.BlockSize != 0 {
-		tlog.Debug.Printf("decryptName %q: decoded length %d is not a multiple of 16", cipherName, len(bin))
+		tlog.NameTransform.Debug.Printf("decryptName %q: decoded length %d is not a multiple of 16", cipherName, len(bin))
 		return "", syscall.EBADMSG
 	}
-	bin = n.emeCipher.Decrypt(iv, bin)
+	bin = n.nameCipher.Decrypt(iv, bin)
 	bin, err = unPad16(bin)
 	if err != nil {
-		tlog.Warn.Printf("decryptName %q: unPad16 error: %v", cipherName, err)
+		tlog.NameTransform.Warn.Printf("decryptName %q: unPad16 error: %v", cipherName, err)
 		return "", syscall.EBADMSG
 	}
 	plain := string(bin)
@@ -104,7 +115,7 @@ func (n *NameTransform) decryptName(cipherName string, iv []byte) (string, error
 }
 
 // EncryptName encrypts a file name "plainName" and returns a base64-encoded "cipherName64",
-// encrypted using EME (https://github.com/rfjakob/eme).
+// encrypted using EME (https://github.com/rfjakob/eme) or HCTR2.
 //
 // plainName is checked for null bytes, slashes etc. and such names are rejected
 // with an error.
@@ -113,20 +124,20 @@ func (n *NameTransform) decryptName(cipherName string, iv []byte) (string, error
 // to the full (not hashed) name if longname is used.
 func (n *NameTransform) EncryptName(plainName string, iv []byte) (cipherName64 string, err error) {
 	if err := IsValidName(plainName); err != nil {
-		tlog.Warn.Printf("EncryptName %q: invalid plainName: %v", plainName, err)
+		tlog.NameTransform.Warn.Printf("EncryptName %q: invalid plainName: %v", plainName, err)
 		return "", syscall.EBADMSG
 	}
 	return n.encryptName(plainName, iv), nil
 }
 
 // encryptName encrypts "plainName" and returns a base64-encoded "cipherName64",
-// encrypted using EME (https://github.com/rfjakob/eme).
+// encrypted using EME (https://github.com/rfjakob/eme) or HCTR2.
 //
 // No checks for null bytes etc are performed against plainName.
 func (n *NameTransform) encryptName(plainName string, iv []byte) (cipherName64 string) {
 	bin := []byte(plainName)
 	bin = pad16(bin)
-	bin = n.emeCipher.Encrypt(iv, bin)
+	bin = n.nameCipher.Encrypt(iv, bin)
 	cipherName64 = n.B64.EncodeToString(bin)
 	return cipherName64
 }
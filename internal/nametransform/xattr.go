@@ -27,7 +27,7 @@ func isValidXattrName(name string) error {
 // naming restriction.
 func (n *NameTransform) EncryptXattrName(plainName string) (cipherName64 string, err error) {
 	if err := isValidXattrName(plainName); err != nil {
-		tlog.Warn.Printf("EncryptXattrName %q: invalid plainName: %v", plainName, err)
+		tlog.NameTransform.Warn.Printf("EncryptXattrName %q: invalid plainName: %v", plainName, err)
 		return "", syscall.EBADMSG
 	}
 	return n.encryptName(plainName, xattrNameIV), nil
@@ -40,7 +40,7 @@ func (n *NameTransform) DecryptXattrName(cipherName string) (plainName string, e
 		return "", err
 	}
 	if err := isValidXattrName(plainName); err != nil {
-		tlog.Warn.Printf("DecryptXattrName %q: invalid name after decryption: %v", cipherName, err)
+		tlog.NameTransform.Warn.Printf("DecryptXattrName %q: invalid name after decryption: %v", cipherName, err)
 		return "", syscall.EBADMSG
 	}
 	return plainName, err
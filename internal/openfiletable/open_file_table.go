@@ -9,6 +9,7 @@ import (
 	"sync/atomic"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/merkle"
 )
 
 // wlock - serializes write accesses to each file (identified by inode number)
@@ -45,9 +46,17 @@ type Entry struct {
 	ContentLock countingMutex
 	// ID is the file ID in the file header.
 	ID []byte
+	// KeyEpoch is the key epoch in the file header, loaded together with ID.
+	KeyEpoch uint8
+	// Immutable is the immutable marker in the file header, loaded together
+	// with ID.
+	Immutable bool
 	// IDLock must be taken before reading or writing the ID field in this struct,
 	// unless you have an exclusive lock on ContentLock.
 	IDLock sync.Mutex
+	// Tree is the "-merkle" hash tree of the file, loaded together with ID.
+	// The same locking rules apply. It is closed when the entry is deleted.
+	Tree *merkle.Tree
 }
 
 // Register creates an open file table entry for "qi" (or incrementes the
@@ -75,19 +84,43 @@ func Unregister(qi inomap.QIno) {
 	e.refCount--
 	if e.refCount == 0 {
 		delete(t.entries, qi)
+		if e.Tree != nil {
+			e.Tree.Close()
+		}
 	}
 }
 
 // countingMutex incrementes t.writeLockCount on each Lock() call.
 type countingMutex struct {
 	sync.RWMutex
+	// busy counts writes that are still running after the lock was released,
+	// see KeepBusy().
+	busy sync.WaitGroup
 }
 
 func (c *countingMutex) Lock() {
 	c.RWMutex.Lock()
+	c.busy.Wait()
 	atomic.AddUint64(&t.writeOpCount, 1)
 }
 
+func (c *countingMutex) RLock() {
+	c.RWMutex.RLock()
+	c.busy.Wait()
+}
+
+// KeepBusy makes the following Lock() and RLock() calls wait until "done" is
+// called, even when the lock is released before that. The caller must hold
+// the write lock.
+//
+// This is used for a write that is stuck in the kernel after "-io_timeout":
+// the FUSE request fails, but nobody may touch the file content before the
+// write has returned.
+func (c *countingMutex) KeepBusy() (done func()) {
+	c.busy.Add(1)
+	return c.busy.Done
+}
+
 // WriteOpCount returns the write lock counter value. This value is incremented
 // each time writeLock.Lock() on a file table entry is called.
 func WriteOpCount() uint64 {
@@ -101,3 +134,10 @@ func CountOpenFiles() int {
 	defer t.Unlock()
 	return len(t.entries)
 }
+
+// IsOpen returns true if "qi" is in the table
+func IsOpen(qi inomap.QIno) bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.entries[qi] != nil
+}
@@ -0,0 +1,132 @@
+// Package pkcs11 wraps and unwraps keys with an RSA key on a PKCS#11 token
+// ("-pkcs11-enroll"). It calls pkcs11-tool from OpenSC, like package fido2
+// calls the fido2-tools.
+package pkcs11
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// MinRSABits is the minimum size of the RSA key
+const MinRSABits = 2048
+
+// pinEnv passes the PIN to pkcs11-tool, so that it does not show up in its
+// command line
+const pinEnv = "GOCRYPTFS_PKCS11_PIN"
+
+// ParseKeyID parses the hex-encoded CKA_ID "id", like "01" or "a1:b2"
+func ParseKeyID(id string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(id, ":", ""))
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key ID %q, want hex like \"01\"", id)
+	}
+	return b, nil
+}
+
+// run executes pkcs11-tool with the PKCS#11 module "module" and "args" in
+// "dir". If "pin" is not nil, it logs in with it.
+func run(dir string, module string, pin []byte, args ...string) error {
+	args = append([]string{"--module", module}, args...)
+	cmd := exec.Command("pkcs11-tool", args...)
+	cmd.Dir = dir
+	if pin != nil {
+		cmd.Args = append(cmd.Args, "--login", "--pin", "env:"+pinEnv)
+		cmd.Env = append(os.Environ(), pinEnv+"="+string(pin))
+	}
+	tlog.Debug.Printf("pkcs11: executing %q", cmd.Args)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("pkcs11-tool failed with %v: %s", err, msg)
+		}
+		return fmt.Errorf("pkcs11-tool failed with %v", err)
+	}
+	return nil
+}
+
+// publicKey reads the public key with the CKA_ID "id" from the token
+func publicKey(dir string, module string, id []byte) (*rsa.PublicKey, error) {
+	err := run(dir, module, nil, "--read-object", "--type", "pubkey", "--id", hex.EncodeToString(id),
+		"--output-file", "pubkey.der")
+	if err != nil {
+		return nil, err
+	}
+	der, err := ioutil.ReadFile(filepath.Join(dir, "pubkey.der"))
+	if err != nil {
+		return nil, err
+	}
+	return parsePublicKey(der, id)
+}
+
+// parsePublicKey parses the public key "der" that pkcs11-tool has read from
+// the key with the CKA_ID "id"
+func parsePublicKey(der []byte, id []byte) (*rsa.PublicKey, error) {
+	// Depending on the OpenSC version, the key is written as
+	// SubjectPublicKeyInfo or as PKCS#1
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		if pub, err = x509.ParsePKCS1PublicKey(der); err != nil {
+			return nil, fmt.Errorf("cannot parse the public key: %v", err)
+		}
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key %x is not an RSA key", id)
+	}
+	if rsaPub.N.BitLen() < MinRSABits {
+		return nil, fmt.Errorf("RSA key %x has %d bits, need at least %d", id, rsaPub.N.BitLen(), MinRSABits)
+	}
+	return rsaPub, nil
+}
+
+// Wrap encrypts "secret" with the public key with the CKA_ID "id" on the
+// token, using RSA-OAEP with SHA-256. Only the token can unwrap it.
+func Wrap(module string, id []byte, secret []byte) (wrapped []byte, err error) {
+	dir, err := ioutil.TempDir("", "gocryptfs-pkcs11-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	pub, err := publicKey(dir, module, id)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(pub, secret)
+}
+
+// wrap encrypts "secret" with "pub" the way Unwrap expects it
+func wrap(pub *rsa.PublicKey, secret []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, secret, nil)
+}
+
+// Unwrap decrypts "wrapped" on the token, which asks for "pin"
+func Unwrap(module string, id []byte, pin []byte, wrapped []byte) (secret []byte, err error) {
+	dir, err := ioutil.TempDir("", "gocryptfs-pkcs11-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "wrapped"), wrapped, 0600); err != nil {
+		return nil, err
+	}
+	err = run(dir, module, pin, "--decrypt", "--id", hex.EncodeToString(id), "--mechanism", "RSA-PKCS-OAEP",
+		"--hash-algorithm", "SHA256", "--mgf", "MGF1-SHA256", "--input-file", "wrapped", "--output-file", "secret")
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(dir, "secret"))
+}
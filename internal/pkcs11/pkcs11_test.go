@@ -0,0 +1,61 @@
+package pkcs11
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"testing"
+)
+
+func TestParseKeyID(t *testing.T) {
+	for in, want := range map[string][]byte{
+		"01":    {1},
+		"a1:B2": {0xa1, 0xb2},
+		"":      nil,
+		"xy":    nil,
+		"1":     nil,
+	} {
+		have, err := ParseKeyID(in)
+		if (err == nil) != (want != nil) || !bytes.Equal(have, want) {
+			t.Errorf("%q: want %x, have %x %v", in, want, have, err)
+		}
+	}
+}
+
+// Unwrap tells the token to use RSA-OAEP with SHA-256 and no label
+func TestWrap(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, MinRSABits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := []byte{1}
+	// pkcs11-tool writes one of these two encodings
+	pkix, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, der := range [][]byte{pkix, x509.MarshalPKCS1PublicKey(&priv.PublicKey)} {
+		pub, err := parsePublicKey(der, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret := []byte("0123456789abcdef0123456789abcdef")
+		wrapped, err := wrap(pub, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unwrapped, err := rsa.DecryptOAEP(sha256.New(), nil, priv, wrapped, nil)
+		if err != nil || !bytes.Equal(unwrapped, secret) {
+			t.Errorf("wrong key: %v", err)
+		}
+	}
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parsePublicKey(x509.MarshalPKCS1PublicKey(&small.PublicKey), id); err == nil {
+		t.Error("1024-bit key was accepted")
+	}
+}
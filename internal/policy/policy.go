@@ -0,0 +1,171 @@
+// Package policy parses the per-directory policy file passed via "-policy"
+// and matches plaintext paths against it.
+//
+// A policy file consists of lines like
+//
+//	# comment
+//	readonly  /Archive
+//	exclude   /Private/tmp
+//	plaintext /Public
+//
+// Each rule applies to the named path and everything below it. Paths are
+// relative to the root of the mount and may or may not start with a slash.
+// Rules are cumulative: "/Public/ro" in the example below is both
+// plaintext and read-only:
+//
+//	plaintext /Public
+//	readonly  /Public/ro
+//
+// The "userdir" action is different: it applies to the direct children of
+// the named directory only. Each child belongs to the user of the same name
+// (or numeric uid) and is hidden from everybody else, so with "-allow_other",
+//
+//	userdir /users
+//
+// gives every user a private "/users/NAME" in a shared filesystem.
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Flags is a bitmap of the policy actions that apply to a path
+type Flags uint8
+
+const (
+	// ReadOnly rejects all modifications with EROFS
+	ReadOnly Flags = 1 << iota
+	// Exclude hides the path from the mount
+	Exclude
+	// Plaintext stores names, file contents and symlink targets unencrypted
+	Plaintext
+)
+
+// actionNames maps the keywords in the policy file to Flags
+var actionNames = map[string]Flags{
+	"readonly":  ReadOnly,
+	"exclude":   Exclude,
+	"plaintext": Plaintext,
+}
+
+type rule struct {
+	flags Flags
+	// path is relative to the mount root, normalized, without leading slash.
+	// The empty string means the whole filesystem.
+	path string
+}
+
+// Policy is a parsed policy file
+type Policy struct {
+	rules []rule
+	// userDirs are the normalized paths of the "userdir" rules
+	userDirs []string
+}
+
+// Load reads and parses the policy file at "filename"
+func Load(filename string) (*Policy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return p, nil
+}
+
+// Parse parses policy rules from "r"
+func Parse(r io.Reader) (*Policy, error) {
+	p := &Policy{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"ACTION PATH\", got %q", lineNo, line)
+		}
+		if parts[0] == "userdir" {
+			p.userDirs = append(p.userDirs, normalize(parts[1]))
+			continue
+		}
+		flags, ok := actionNames[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown action %q", lineNo, parts[0])
+		}
+		relPath := normalize(parts[1])
+		if relPath == "" && flags&(Exclude|Plaintext) != 0 {
+			return nil, fmt.Errorf("line %d: %q cannot be applied to the root directory", lineNo, parts[0])
+		}
+		p.rules = append(p.rules, rule{flags: flags, path: relPath})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// normalize converts a path from the policy file to the format used by
+// Node.Path(): cleaned, relative, without leading or trailing slashes.
+// Cleaning a rooted path also takes care of any "..".
+func normalize(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// Match returns the combined flags of all rules that apply to the plaintext
+// path "relPath" (relative to the mount root, like returned by Node.Path()).
+// A nil Policy matches nothing.
+func (p *Policy) Match(relPath string) (flags Flags) {
+	if p == nil {
+		return 0
+	}
+	for _, r := range p.rules {
+		if r.path == "" || relPath == r.path || strings.HasPrefix(relPath, r.path+"/") {
+			flags |= r.flags
+		}
+	}
+	return flags
+}
+
+// HasPlaintext returns true if any rule uses the "plaintext" action
+func (p *Policy) HasPlaintext() bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.rules {
+		if r.flags&Plaintext != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUserDir returns true if "relPath" is the directory of a "userdir" rule,
+// meaning that its children are private to the user of the same name.
+func (p *Policy) IsUserDir(relPath string) bool {
+	if p == nil {
+		return false
+	}
+	for _, d := range p.userDirs {
+		if relPath == d {
+			return true
+		}
+	}
+	return false
+}
+
+// HasUserDirs returns true if any rule uses the "userdir" action
+func (p *Policy) HasUserDirs() bool {
+	return p != nil && len(p.userDirs) > 0
+}
@@ -0,0 +1,96 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAndMatch(t *testing.T) {
+	in := `
+# comment
+plaintext /Public
+readonly  Public/ro/
+exclude   /Documents/tmp
+readonly  /Documents/../Archive
+`
+	p, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		path string
+		want Flags
+	}{
+		{"", 0},
+		{"Public", Plaintext},
+		{"Public/x/y", Plaintext},
+		{"Publicity", 0},
+		{"Public/ro", Plaintext | ReadOnly},
+		{"Public/ro/file", Plaintext | ReadOnly},
+		{"Documents", 0},
+		{"Documents/tmp/x", Exclude},
+		{"Archive", ReadOnly},
+	}
+	for _, tc := range testCases {
+		have := p.Match(tc.path)
+		if have != tc.want {
+			t.Errorf("Match(%q): have=%d want=%d", tc.path, have, tc.want)
+		}
+	}
+	if !p.HasPlaintext() {
+		t.Error("HasPlaintext should be true")
+	}
+	if p.HasUserDirs() {
+		t.Error("HasUserDirs should be false")
+	}
+}
+
+func TestUserDir(t *testing.T) {
+	p, err := Parse(strings.NewReader("userdir /users/\nreadonly /users/shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasUserDirs() {
+		t.Error("HasUserDirs should be true")
+	}
+	for path, want := range map[string]bool{"users": true, "users/bob": false, "": false, "users2": false} {
+		if p.IsUserDir(path) != want {
+			t.Errorf("IsUserDir(%q) should be %v", path, want)
+		}
+	}
+	// "userdir" does not add any flags
+	if p.Match("users/bob") != 0 {
+		t.Errorf("Match: have=%d want=0", p.Match("users/bob"))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	bad := []string{
+		"plaintext",
+		"plaintext /a /b",
+		"encrypt /a",
+		"plaintext /",
+		"exclude /..",
+	}
+	for _, in := range bad {
+		_, err := Parse(strings.NewReader(in))
+		if err == nil {
+			t.Errorf("%q should have failed to parse", in)
+		}
+	}
+	// Making the whole filesystem read-only is allowed
+	p, err := Parse(strings.NewReader("readonly /"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Match("a/b") != ReadOnly {
+		t.Error("root readonly rule should match everything")
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	var p *Policy
+	if p.Match("a") != 0 || p.HasPlaintext() || p.IsUserDir("") || p.HasUserDirs() {
+		t.Error("nil Policy should match nothing")
+	}
+}
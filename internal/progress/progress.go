@@ -0,0 +1,295 @@
+// Package progress reports the progress of long-running operations like
+// "-fsck" and "-reencrypt" ("-progress").
+package progress
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// ModeAuto shows a status line if the output is a terminal
+	ModeAuto = "auto"
+	// ModeJSON writes one Status per line as JSON
+	ModeJSON = "json"
+	// ModeNone disables progress reports
+	ModeNone = "none"
+)
+
+// Interval is the time between two progress reports
+const Interval = time.Second
+
+// rateWeight is the weight of the last Interval in the throughput estimate.
+// The rest comes from the Intervals before, so pauses and bursts are
+// smoothed out over a few seconds.
+const rateWeight = 0.2
+
+// Status is a progress report. With "-progress json", one Status is written
+// per Interval, and a last one with Done set when the operation ends.
+type Status struct {
+	// Op is the operation, like "fsck"
+	Op string `json:"op"`
+	// Files and Bytes are done
+	Files uint64 `json:"files"`
+	Bytes uint64 `json:"bytes"`
+	// TotalFiles and TotalBytes are expected in total. Zero while unknown.
+	TotalFiles uint64 `json:"total_files"`
+	TotalBytes uint64 `json:"total_bytes"`
+	// BytesPerSecond is the current throughput
+	BytesPerSecond uint64 `json:"bytes_per_second"`
+	// ElapsedSeconds since the start of the operation
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	// ETASeconds is the estimated remaining time, or -1 if unknown
+	ETASeconds int64 `json:"eta_seconds"`
+	// Done is set in the last report
+	Done bool `json:"done"`
+}
+
+// Reporter counts the files and bytes an operation has done, and writes a
+// report every Interval. A nil *Reporter does not report anything.
+type Reporter struct {
+	op    string
+	w     io.Writer
+	json  bool
+	start time.Time
+	// Counters. Use atomic ops to access them.
+	files, bytes, totalFiles, totalBytes uint64
+	// stop is closed by Stop. loopDone is closed when loop has exited.
+	stop, loopDone chan struct{}
+	stopOnce       sync.Once
+
+	// Throughput estimate, only used by report
+	last                 time.Time
+	lastFiles, lastBytes uint64
+	fileRate, byteRate   float64
+}
+
+// New starts reporting the progress of the operation "op" to "w", as JSON
+// lines if "asJSON" is set, or else as a status line on a terminal.
+// Call Stop when the operation has ended.
+func New(op string, w io.Writer, asJSON bool) *Reporter {
+	now := time.Now()
+	r := &Reporter{
+		op:       op,
+		w:        w,
+		json:     asJSON,
+		start:    now,
+		last:     now,
+		stop:     make(chan struct{}),
+		loopDone: make(chan struct{}),
+	}
+	go r.loop()
+	return r
+}
+
+// Add counts "files" and "bytes" as done
+func (r *Reporter) Add(files uint64, bytes uint64) {
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&r.files, files)
+	atomic.AddUint64(&r.bytes, bytes)
+}
+
+// SetTotal sets the number of files and bytes expected in total, which
+// gives the ETA
+func (r *Reporter) SetTotal(files uint64, bytes uint64) {
+	if r == nil {
+		return
+	}
+	atomic.StoreUint64(&r.totalFiles, files)
+	atomic.StoreUint64(&r.totalBytes, bytes)
+}
+
+// countingReader counts the bytes read from it as done
+type countingReader struct {
+	io.Reader
+	r *Reporter
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.r.Add(0, uint64(n))
+	return n, err
+}
+
+// Reader returns a reader that counts the bytes read from "rd" as done
+func (r *Reporter) Reader(rd io.Reader) io.Reader {
+	if r == nil {
+		return rd
+	}
+	return countingReader{Reader: rd, r: r}
+}
+
+var errStopped = errors.New("stopped")
+
+// Scan counts the regular files below "dir" and their sizes. Files with
+// several hard links are counted once. If "skip" is not nil, it is called
+// with the path relative to "dir" of each entry, and the entries it returns
+// true for are not counted, or not walked into if they are directories.
+func Scan(dir string, skip func(rel string, info os.FileInfo) bool) (files uint64, bytes uint64, err error) {
+	return scan(dir, skip, nil)
+}
+
+// scan is Scan, but gives up when "stop" is closed
+func scan(dir string, skip func(rel string, info os.FileInfo) bool, stop chan struct{}) (files uint64, bytes uint64, err error) {
+	seen := make(map[uint64]struct{})
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		select {
+		case <-stop:
+			return errStopped
+		default:
+		}
+		if err != nil {
+			// Errors are reported by the operation itself
+			return nil
+		}
+		if skip != nil && path != dir {
+			rel, _ := filepath.Rel(dir, path)
+			if skip(rel, info) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			if _, ok := seen[st.Ino]; ok {
+				return nil
+			}
+			seen[st.Ino] = struct{}{}
+		}
+		files++
+		bytes += uint64(info.Size())
+		return nil
+	})
+	return files, bytes, err
+}
+
+// ScanTotal runs Scan(dir, skip) in the background and sets the result as
+// the total
+func (r *Reporter) ScanTotal(dir string, skip func(rel string, info os.FileInfo) bool) {
+	if r == nil {
+		return
+	}
+	go func() {
+		files, bytes, err := scan(dir, skip, r.stop)
+		if err == nil {
+			r.SetTotal(files, bytes)
+		}
+	}()
+}
+
+// Stop writes the last report and stops reporting
+func (r *Reporter) Stop() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		<-r.loopDone
+		s := r.report()
+		s.Done = true
+		if r.json {
+			r.writeJSON(s)
+		} else {
+			// Clear the status line, the operation prints its own summary
+			fmt.Fprint(r.w, "\r\033[K")
+		}
+	})
+}
+
+func (r *Reporter) loop() {
+	defer close(r.loopDone)
+	t := time.NewTicker(Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+		}
+		s := r.report()
+		if r.json {
+			r.writeJSON(s)
+		} else {
+			fmt.Fprintf(r.w, "\r%s\033[K", s.String())
+		}
+	}
+}
+
+func (r *Reporter) writeJSON(s Status) {
+	j, _ := json.Marshal(s)
+	r.w.Write(append(j, '\n'))
+}
+
+// report returns the current Status and updates the throughput estimate
+func (r *Reporter) report() Status {
+	now := time.Now()
+	s := Status{
+		Op:             r.op,
+		Files:          atomic.LoadUint64(&r.files),
+		Bytes:          atomic.LoadUint64(&r.bytes),
+		TotalFiles:     atomic.LoadUint64(&r.totalFiles),
+		TotalBytes:     atomic.LoadUint64(&r.totalBytes),
+		ElapsedSeconds: now.Sub(r.start).Seconds(),
+		ETASeconds:     -1,
+	}
+	if dt := now.Sub(r.last).Seconds(); dt > 0 {
+		fileRate := float64(s.Files-r.lastFiles) / dt
+		byteRate := float64(s.Bytes-r.lastBytes) / dt
+		if r.lastFiles == 0 && r.lastBytes == 0 {
+			// First estimate
+			r.fileRate, r.byteRate = fileRate, byteRate
+		} else {
+			r.fileRate += rateWeight * (fileRate - r.fileRate)
+			r.byteRate += rateWeight * (byteRate - r.byteRate)
+		}
+		r.last, r.lastFiles, r.lastBytes = now, s.Files, s.Bytes
+	}
+	s.BytesPerSecond = uint64(r.byteRate)
+	if s.TotalBytes > 0 && r.byteRate > 0 {
+		s.ETASeconds = eta(s.TotalBytes, s.Bytes, r.byteRate)
+	} else if s.TotalFiles > 0 && r.fileRate > 0 {
+		s.ETASeconds = eta(s.TotalFiles, s.Files, r.fileRate)
+	}
+	return s
+}
+
+// eta returns the seconds until "done" reaches "total" at "rate" per second
+func eta(total uint64, done uint64, rate float64) int64 {
+	if done >= total {
+		return 0
+	}
+	return int64(float64(total-done) / rate)
+}
+
+// String formats the Status as a status line like
+//
+//	fsck: 120/3400 files, 15/420 MiB, 8.5 MiB/s, 38s left
+func (s Status) String() string {
+	str := fmt.Sprintf("%s: %d", s.Op, s.Files)
+	if s.TotalFiles > 0 {
+		str += fmt.Sprintf("/%d", s.TotalFiles)
+	}
+	str += fmt.Sprintf(" files, %d", s.Bytes>>20)
+	if s.TotalBytes > 0 {
+		str += fmt.Sprintf("/%d", s.TotalBytes>>20)
+	}
+	str += fmt.Sprintf(" MiB, %.1f MiB/s", float64(s.BytesPerSecond)/(1<<20))
+	if s.ETASeconds >= 0 {
+		str += fmt.Sprintf(", %v left", time.Duration(s.ETASeconds)*time.Second)
+	}
+	return str
+}
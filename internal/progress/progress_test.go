@@ -0,0 +1,89 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReporterJSON(t *testing.T) {
+	var buf bytes.Buffer
+	r := New("test", &buf, true)
+	r.SetTotal(3, 300)
+	r.Add(1, 100)
+	n, err := ioutil.ReadAll(r.Reader(strings.NewReader("0123456789")))
+	if err != nil || len(n) != 10 {
+		t.Fatal(err)
+	}
+	r.Stop()
+	// Stop twice is fine
+	r.Stop()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var s Status
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &s); err != nil {
+		t.Fatal(err)
+	}
+	want := Status{Op: "test", Files: 1, Bytes: 110, TotalFiles: 3, TotalBytes: 300, Done: true}
+	s.ElapsedSeconds, s.ETASeconds, s.BytesPerSecond = 0, 0, 0
+	if s != want {
+		t.Errorf("have %+v, want %+v", s, want)
+	}
+}
+
+func TestNil(t *testing.T) {
+	var r *Reporter
+	r.Add(1, 1)
+	r.SetTotal(1, 1)
+	r.ScanTotal("/", nil)
+	r.Stop()
+	rd := strings.NewReader("x")
+	if r.Reader(rd) != rd {
+		t.Error("nil Reporter should not wrap the reader")
+	}
+}
+
+func TestScan(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0700)
+	os.Mkdir(filepath.Join(dir, "skipped"), 0700)
+	write("a", 10)
+	write("sub/b", 20)
+	write("skipped/c", 40)
+	// Hard links are counted once
+	if err := os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "sub/a2")); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink("a", filepath.Join(dir, "link"))
+	files, bytes, err := Scan(dir, func(rel string, info os.FileInfo) bool {
+		return rel == "skipped"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 2 || bytes != 30 {
+		t.Errorf("have %d files and %d bytes, want 2 and 30", files, bytes)
+	}
+}
+
+func TestString(t *testing.T) {
+	s := Status{Op: "fsck", Files: 120, TotalFiles: 3400, Bytes: 15 << 20, TotalBytes: 420 << 20,
+		BytesPerSecond: 17 << 19, ETASeconds: 38}
+	want := "fsck: 120/3400 files, 15/420 MiB, 8.5 MiB/s, 38s left"
+	if s.String() != want {
+		t.Errorf("have %q, want %q", s.String(), want)
+	}
+	s = Status{Op: "verify", Files: 1, ETASeconds: -1}
+	want = "verify: 1 files, 0 MiB, 0.0 MiB/s"
+	if s.String() != want {
+		t.Errorf("have %q, want %q", s.String(), want)
+	}
+}
@@ -0,0 +1,249 @@
+// Package pwstrength estimates how hard a password is to guess, and how long
+// an offline attack on gocryptfs.conf would take.
+//
+// The estimate follows the idea of zxcvbn: the password is split into
+// patterns an attacker would try early (common words, repeated characters,
+// sequences like "abc" or "123", keyboard rows, years), and the entropy is
+// the cheapest way to build the password from these patterns and single
+// random characters.
+package pwstrength
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// commonWords are passwords and words that come first in every password
+// list, most common first. Matching is done on the lowercased password with
+// common "leet" substitutions undone.
+var commonWords = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "admin", "dragon",
+	"monkey", "football", "baseball", "iloveyou", "master", "sunshine",
+	"princess", "shadow", "superman", "batman", "trustno", "secret",
+	"login", "passw", "pass", "hello", "freedom", "whatever", "starwars",
+	"michael", "charlie", "jordan", "hunter", "ranger", "buster", "soccer",
+	"hockey", "killer", "george", "andrew", "summer", "winter", "spring",
+	"autumn", "love", "god", "money", "access", "flower", "cheese",
+	"computer", "internet", "secure", "private", "encrypt", "crypt",
+	"gocryptfs", "root", "user", "test", "guest", "default", "changeme",
+	"nothing", "abc", "asdf", "zxcv", "qazwsx", "mypass", "mypassword",
+}
+
+// keyboardRows are the rows of a US keyboard, for runs like "asdfgh"
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+// leet undoes common character substitutions
+var leet = map[rune]rune{
+	'@': 'a', '4': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i',
+	'!': 'i', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z',
+}
+
+// Character classes
+const (
+	classLower = iota
+	classUpper
+	classDigit
+	classSymbol
+	classOther
+)
+
+// classSize is the number of characters in each class. Non-ASCII
+// characters are counted as a class of 100.
+var classSize = [...]float64{26, 26, 10, 33, 100}
+
+func class(r rune) int {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return classLower
+	case r >= 'A' && r <= 'Z':
+		return classUpper
+	case r >= '0' && r <= '9':
+		return classDigit
+	case r < utf8.RuneSelf:
+		return classSymbol
+	default:
+		return classOther
+	}
+}
+
+// charsetBits returns the entropy of a single random character from the
+// character class of "r"
+func charsetBits(r rune) float64 {
+	return math.Log2(classSize[class(r)])
+}
+
+// Entropy returns the estimated entropy of "password" in bits
+func Entropy(password []byte) float64 {
+	pw := make([]rune, 0, len(password))
+	for b := password; len(b) > 0; {
+		r, n := utf8.DecodeRune(b)
+		pw = append(pw, r)
+		b = b[n:]
+	}
+	lower := make([]rune, len(pw))
+	unleet := make([]rune, len(pw))
+	for i, r := range pw {
+		lower[i] = unicode.ToLower(r)
+		unleet[i] = lower[i]
+		if u, ok := leet[r]; ok {
+			unleet[i] = u
+		}
+	}
+	defer func() {
+		for i := range pw {
+			pw[i], lower[i], unleet[i] = 0, 0, 0
+		}
+	}()
+	// Random characters are drawn from all classes that appear in the
+	// password
+	var seen [len(classSize)]bool
+	var poolSize float64
+	for _, r := range pw {
+		if c := class(r); !seen[c] {
+			seen[c] = true
+			poolSize += classSize[c]
+		}
+	}
+	randomBits := math.Log2(poolSize)
+	// best[i] is the cheapest way to build pw[:i]
+	best := make([]float64, len(pw)+1)
+	for i := 1; i <= len(pw); i++ {
+		best[i] = math.Inf(1)
+	}
+	for i := 0; i < len(pw); i++ {
+		relax := func(end int, bits float64) {
+			if best[i]+bits < best[end] {
+				best[end] = best[i] + bits
+			}
+		}
+		relax(i+1, randomBits)
+		for rank, w := range commonWords {
+			if end := i + len(w); end <= len(pw) && string(unleet[i:end]) == w {
+				bits := math.Log2(float64(rank + 2))
+				if string(pw[i:end]) != w {
+					// Capitalization or substitutions
+					bits++
+				}
+				relax(end, bits)
+			}
+		}
+		// Repeated character: "aaaa"
+		end := i + 1
+		for end < len(pw) && lower[end] == lower[i] {
+			end++
+		}
+		if end-i >= 3 {
+			relax(end, charsetBits(pw[i])+math.Log2(float64(end-i)))
+		}
+		// Sequence: "abcd", "4321"
+		for _, delta := range []rune{1, -1} {
+			end = i + 1
+			for end < len(pw) && lower[end]-lower[end-1] == delta && charsetBits(pw[end]) == charsetBits(pw[i]) {
+				end++
+			}
+			if end-i >= 3 {
+				bits := charsetBits(pw[i]) + math.Log2(float64(end-i))
+				if delta < 0 {
+					bits++
+				}
+				relax(end, bits)
+			}
+		}
+		// Keyboard row: "qwert", "lkjh". No row is longer than 13 keys.
+		end = len(pw)
+		if end > i+13 {
+			end = i + 13
+		}
+		for ; end-i >= 4; end-- {
+			if onKeyboardRow(string(lower[i:end])) {
+				relax(end, math.Log2(47)+math.Log2(float64(end-i))+1)
+				break
+			}
+		}
+		// Year: "1987", "2024"
+		if i+4 <= len(pw) {
+			if y := string(pw[i : i+4]); (strings.HasPrefix(y, "19") || strings.HasPrefix(y, "20")) && isDigits(y) {
+				relax(i+4, math.Log2(200))
+			}
+		}
+	}
+	return best[len(pw)]
+}
+
+// onKeyboardRow checks if "s" is a run on one of the keyboard rows, forwards
+// or backwards
+func onKeyboardRow(s string) bool {
+	for _, row := range keyboardRows {
+		if strings.Contains(row, s) || strings.Contains(row, reverse(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// guessesPerSecondLogN16 is how many passwords an attacker with a few
+// hundred GPUs can test per second against a config file with the default
+// scrypt cost logN=16. Every increment of logN doubles the work per guess.
+const guessesPerSecondLogN16 = 1e6
+
+// CrackSeconds returns the average time, in seconds, an offline attack needs
+// to guess a password with "bits" of entropy when the config file uses the
+// scrypt cost parameter "logN"
+func CrackSeconds(bits float64, logN int) float64 {
+	rate := guessesPerSecondLogN16 * math.Pow(2, float64(16-logN))
+	// On average, half of the candidates have to be tried
+	return math.Pow(2, bits-1) / rate
+}
+
+// FormatSeconds returns a rough, human-readable form of "secs" like
+// "3 hours" or "centuries"
+func FormatSeconds(secs float64) string {
+	units := []struct {
+		name string
+		secs float64
+	}{
+		{"year", 365 * 24 * 3600},
+		{"day", 24 * 3600},
+		{"hour", 3600},
+		{"minute", 60},
+		{"second", 1},
+	}
+	if secs >= 100*units[0].secs {
+		return "centuries"
+	}
+	for _, u := range units {
+		if secs >= u.secs {
+			n := int(secs / u.secs)
+			if n == 1 {
+				return "1 " + u.name
+			}
+			return fmt.Sprintf("%d %ss", n, u.name)
+		}
+	}
+	return "less than a second"
+}
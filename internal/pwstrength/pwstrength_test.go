@@ -0,0 +1,60 @@
+package pwstrength
+
+import (
+	"testing"
+)
+
+func TestEntropy(t *testing.T) {
+	weak := []string{"", "password", "P@ssw0rd", "123456", "aaaaaaaaaaaa", "abcdefgh",
+		"qwertyuiop", "9876543210", "gocryptfs2024", "test"}
+	for _, pw := range weak {
+		if e := Entropy([]byte(pw)); e > 30 {
+			t.Errorf("%q: entropy %.1f, should be weak", pw, e)
+		}
+	}
+	strong := []string{"correct-horse-battery-staple-Xq7", "h7$Kq2!vZp9@wLm4", "gräßliche Übung verschlüsselt 93"}
+	for _, pw := range strong {
+		if e := Entropy([]byte(pw)); e < 80 {
+			t.Errorf("%q: entropy %.1f, should be strong", pw, e)
+		}
+	}
+	// Patterns are cheaper than the same number of random characters
+	if Entropy([]byte("passwordX9k")) >= Entropy([]byte("vbqtmzrhX9k")) {
+		t.Error("dictionary word not detected")
+	}
+	// Longer is stronger
+	if Entropy([]byte("h7$Kq2!v")) >= Entropy([]byte("h7$Kq2!vZp")) {
+		t.Error("entropy does not grow with length")
+	}
+}
+
+func TestCrackSeconds(t *testing.T) {
+	// Each additional bit, and each increment of logN, doubles the time
+	a := CrackSeconds(40, 16)
+	if b := CrackSeconds(41, 16); b != 2*a {
+		t.Errorf("bits: %v vs %v", a, b)
+	}
+	if b := CrackSeconds(40, 17); b != 2*a {
+		t.Errorf("logN: %v vs %v", a, b)
+	}
+}
+
+func TestFormatSeconds(t *testing.T) {
+	tests := []struct {
+		secs float64
+		want string
+	}{
+		{0.5, "less than a second"},
+		{1, "1 second"},
+		{119, "1 minute"},
+		{7200, "2 hours"},
+		{3 * 24 * 3600, "3 days"},
+		{50 * 365 * 24 * 3600, "50 years"},
+		{1e12, "centuries"},
+	}
+	for _, tc := range tests {
+		if s := FormatSeconds(tc.secs); s != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.secs, s, tc.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package ratelimit implements the token bucket used by the "-bwlimit" and
+// "-ioplimit" options.
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter is a token bucket that refills at a fixed rate. The zero value is
+// not usable, call New(). A nil *Limiter does not limit anything.
+type Limiter struct {
+	mu sync.Mutex
+	// rate is the refill rate in tokens per second
+	rate float64
+	// burst is the bucket size
+	burst float64
+	// tokens currently in the bucket. Goes negative when callers have to
+	// wait for tokens that have already been handed out.
+	tokens float64
+	// last is the time tokens was updated
+	last time.Time
+}
+
+// New returns a Limiter that hands out "rate" tokens per second. The bucket
+// holds one second worth of tokens, so short bursts are not delayed.
+// Returns nil if rate is zero.
+func New(rate uint64) *Limiter {
+	if rate == 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Rate returns the rate in tokens per second, or zero for a nil Limiter.
+func (l *Limiter) Rate() uint64 {
+	if l == nil {
+		return 0
+	}
+	return uint64(l.rate)
+}
+
+// Wait takes "n" tokens out of the bucket and sleeps until they have been
+// refilled, if necessary. Requests larger than the bucket are allowed and
+// delay the following callers accordingly.
+func (l *Limiter) Wait(n uint64) {
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// reserve takes "n" tokens and returns how long the caller has to wait
+// before using them.
+func (l *Limiter) reserve(n uint64) time.Duration {
+	if l == nil || n == 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Throttle combines the limiters for "-bwlimit" and "-ioplimit". The limits
+// can be changed with Set() while other goroutines are in Wait(). The zero
+// value does not limit anything.
+type Throttle struct {
+	// limits holds a *throttleLimits
+	limits atomic.Value
+}
+
+type throttleLimits struct {
+	bw, iop *Limiter
+}
+
+// Set limits the throughput to "bwLimit" bytes and "iopLimit" operations
+// per second. Zero means no limit. A limiter whose rate does not change is
+// kept, together with the tokens it has handed out.
+func (t *Throttle) Set(bwLimit uint64, iopLimit uint64) {
+	old, _ := t.limits.Load().(*throttleLimits)
+	if old == nil {
+		old = &throttleLimits{}
+	}
+	keep := func(l *Limiter, rate uint64) *Limiter {
+		if l.Rate() == rate {
+			return l
+		}
+		return New(rate)
+	}
+	t.limits.Store(&throttleLimits{
+		bw:  keep(old.bw, bwLimit),
+		iop: keep(old.iop, iopLimit),
+	})
+}
+
+// Wait delays an operation that transfers "n" bytes
+func (t *Throttle) Wait(n uint64) {
+	l, _ := t.limits.Load().(*throttleLimits)
+	if l == nil {
+		return
+	}
+	l.iop.Wait(1)
+	l.bw.Wait(n)
+}
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNil(t *testing.T) {
+	if l := New(0); l != nil {
+		t.Fatal("rate 0 should disable the limiter")
+	}
+	var l *Limiter
+	l.Wait(1000)
+}
+
+func TestReserve(t *testing.T) {
+	l := New(1000)
+	// The full bucket allows a burst of one second worth of tokens
+	if d := l.reserve(1000); d != 0 {
+		t.Errorf("burst should not wait, got %v", d)
+	}
+	// The next 500 tokens take half a second to refill
+	d := l.reserve(500)
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("want about 500ms, got %v", d)
+	}
+	// Waiting callers queue up behind each other
+	d = l.reserve(500)
+	if d < 900*time.Millisecond || d > time.Second {
+		t.Errorf("want about 1s, got %v", d)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	var th Throttle
+	// The zero value does not limit
+	th.Wait(1 << 30)
+	th.Set(1000, 0)
+	l := th.limits.Load().(*throttleLimits)
+	if l.bw.Rate() != 1000 || l.iop != nil {
+		t.Fatalf("wrong limiters: %+v", l)
+	}
+	th.Wait(1000)
+	// Changing the operation limit keeps the bandwidth limiter, whose
+	// bucket is empty now
+	th.Set(1000, 10)
+	l2 := th.limits.Load().(*throttleLimits)
+	if l2.bw != l.bw || l2.iop.Rate() != 10 {
+		t.Fatalf("wrong limiters: %+v", l2)
+	}
+	th.Set(0, 0)
+	if l3 := th.limits.Load().(*throttleLimits); l3.bw != nil || l3.iop != nil {
+		t.Fatalf("limits not removed: %+v", l3)
+	}
+}
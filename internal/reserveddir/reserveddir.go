@@ -0,0 +1,56 @@
+// Package reserveddir creates the directories that gocryptfs keeps in the
+// root of CIPHERDIR, like gocryptfs.journal. With "-plaintextnames", a user
+// directory can have the same name. Each reserved directory therefore
+// contains the empty file MarkerName, and gocryptfs refuses to use a
+// directory that has other contents but no marker.
+package reserveddir
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// MarkerName is the name of the marker file in a reserved directory
+const MarkerName = "gocryptfs.reserved"
+
+// Mkdir creates the reserved directory "dir", if it does not exist yet, and
+// its marker.
+func Mkdir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := Check(dir); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, MarkerName), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Check returns an error if "dir" is not a directory, or if it is not empty
+// and has no marker. It has then not been created by Mkdir.
+func Check(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if _, err = os.Lstat(filepath.Join(dir, MarkerName)); err == nil {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if _, err = d.Readdirnames(1); err != io.EOF {
+		return fmt.Errorf("%s was not created by gocryptfs", dir)
+	}
+	return nil
+}
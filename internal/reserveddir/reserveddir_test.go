@@ -0,0 +1,45 @@
+package reserveddir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMkdir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "gocryptfs.journal")
+	if err := Mkdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "x"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Existing reserved directory
+	if err := Mkdir(dir); err != nil {
+		t.Error(err)
+	}
+	if err := Check(dir); err != nil {
+		t.Error(err)
+	}
+	// A user directory with contents is refused
+	os.Remove(filepath.Join(dir, MarkerName))
+	if err := Mkdir(dir); err == nil {
+		t.Error("user directory was accepted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, MarkerName)); !os.IsNotExist(err) {
+		t.Errorf("marker was created: %v", err)
+	}
+	// An empty one is taken over
+	os.Remove(filepath.Join(dir, "x"))
+	if err := Check(dir); err != nil {
+		t.Error(err)
+	}
+	// A file is refused
+	file := filepath.Join(filepath.Dir(dir), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(file); err == nil {
+		t.Error("file was accepted")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build go1.19
+// +build go1.19
+
+package resources
+
+import "runtime/debug"
+
+// setGoMemoryLimit makes the garbage collector work harder as the memory
+// of the Go runtime approaches "n" bytes
+func setGoMemoryLimit(n uint64) {
+	debug.SetMemoryLimit(int64(n))
+}
@@ -0,0 +1,7 @@
+//go:build !go1.19
+// +build !go1.19
+
+package resources
+
+// setGoMemoryLimit needs Go 1.19 or later. The hard limit still applies.
+func setGoMemoryLimit(n uint64) {}
@@ -0,0 +1,111 @@
+// Package resources caps the memory and CPU usage of the gocryptfs daemon
+// ("-cgroup", "-memory-max", "-cpu-max") and reports its usage to the
+// control socket.
+package resources
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// cpuPeriod is the period of the cgroup CPU bandwidth limit in
+// microseconds, the kernel default
+const cpuPeriod = 100000
+
+var (
+	mu sync.Mutex
+	// cg is the cgroup that Apply has moved the process into, or nil
+	cg *cgroup
+	// limitMem and limitCPU are the limits set by Apply
+	limitMem, limitCPU uint64
+)
+
+// Apply caps the memory usage of the process at "memMax" bytes, and its CPU
+// usage at "cpuMax" percent of one CPU. Zero means no limit.
+//
+// If "cgroupPath" is set, the process moves into this cgroup v2 directory,
+// which is created if it does not exist, and the cgroup enforces the limits.
+// Relative paths are relative to the root of the cgroup v2 hierarchy.
+// Without a cgroup, memory is capped by RLIMIT_DATA, and CPU usage by
+// running at most cpuMax/100 (rounded up) threads at a time.
+// In both cases, the garbage collector works harder as memory usage
+// approaches memMax.
+func Apply(cgroupPath string, memMax uint64, cpuMax uint64) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if cgroupPath != "" {
+		c, err := joinCgroup(cgroupPath, memMax, cpuMax)
+		if err != nil {
+			return fmt.Errorf("-cgroup %q: %v", cgroupPath, err)
+		}
+		cg = c
+		tlog.Debug.Printf("resources: joined cgroup %q", c.path)
+	} else {
+		if memMax > 0 {
+			if err := setDataLimit(memMax); err != nil {
+				return fmt.Errorf("-memory-max: %v", err)
+			}
+		}
+		if cpuMax > 0 {
+			procs := int((cpuMax + 99) / 100)
+			runtime.GOMAXPROCS(procs)
+			tlog.Debug.Printf("resources: GOMAXPROCS=%d", procs)
+		}
+	}
+	if memMax > 0 {
+		// Leave a tenth for memory that is not the Go heap, like thread
+		// stacks and the page cache of a cgroup
+		setGoMemoryLimit(memMax / 10 * 9)
+	}
+	limitMem, limitCPU = memMax, cpuMax
+	return nil
+}
+
+// setDataLimit sets the soft RLIMIT_DATA to "n" bytes
+func setDataLimit(n uint64) error {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_DATA, &lim); err != nil {
+		return err
+	}
+	if uint64(lim.Max) < n {
+		return fmt.Errorf("%d bytes is above the hard RLIMIT_DATA of %d bytes", n, lim.Max)
+	}
+	lim.Cur = n
+	return syscall.Setrlimit(syscall.RLIMIT_DATA, &lim)
+}
+
+// Usage returns the current resource usage of the process, and the limits
+// set by Apply
+func Usage() *ctlsock.ResourcesStruct {
+	mu.Lock()
+	defer mu.Unlock()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	r := &ctlsock.ResourcesStruct{
+		MemoryMax:     limitMem,
+		MemoryCurrent: ms.Sys,
+		GoHeapBytes:   ms.HeapAlloc,
+		CPUMaxPercent: limitCPU,
+		Goroutines:    runtime.NumGoroutine(),
+	}
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err == nil {
+		r.UserCPUSeconds = timevalSeconds(ru.Utime)
+		r.SystemCPUSeconds = timevalSeconds(ru.Stime)
+		r.MaxRSS = uint64(ru.Maxrss) * maxrssUnit
+	}
+	if cg != nil {
+		r.Cgroup = cg.path
+		cg.usage(r)
+	}
+	return r
+}
+
+func timevalSeconds(tv syscall.Timeval) float64 {
+	return float64(tv.Sec) + float64(tv.Usec)/1e6
+}
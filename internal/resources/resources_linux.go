@@ -0,0 +1,159 @@
+package resources
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+)
+
+// maxrssUnit is the unit of Rusage.Maxrss in bytes
+const maxrssUnit = 1024
+
+// cgroup is a cgroup v2 directory
+type cgroup struct {
+	// path is the absolute path of the directory
+	path string
+	// dirfd is the open directory. It stays usable after "-sandbox-user"
+	// has chrooted.
+	dirfd int
+}
+
+// cgroup2Mount returns the mount point of the cgroup v2 hierarchy, usually
+// /sys/fs/cgroup, or /sys/fs/cgroup/unified on hybrid systems
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// 42 32 0:38 / /sys/fs/cgroup rw,relatime shared:9 - cgroup2 cgroup2 rw
+		fields := strings.Fields(s.Text())
+		for i, f := range fields {
+			if f == "-" && i+1 < len(fields) && len(fields) > 4 && fields[i+1] == "cgroup2" {
+				return fields[4], nil
+			}
+		}
+	}
+	return "", errors.New("no cgroup v2 hierarchy is mounted")
+}
+
+// joinCgroup moves the process into the cgroup v2 directory "path",
+// after creating it if needed and setting the limits
+func joinCgroup(path string, memMax uint64, cpuMax uint64) (*cgroup, error) {
+	if !filepath.IsAbs(path) {
+		root, err := cgroup2Mount()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(root, path)
+	}
+	err := os.Mkdir(path, 0755)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	created := err == nil
+	dirfd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	c := &cgroup{path: path, dirfd: dirfd}
+	err = c.setLimits(memMax, cpuMax)
+	if err == nil {
+		err = c.write("cgroup.procs", strconv.Itoa(os.Getpid()))
+	}
+	if err != nil {
+		syscall.Close(dirfd)
+		if created {
+			syscall.Rmdir(path)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// setLimits writes memory.max and cpu.max. The controllers are enabled in
+// the parent cgroup first, if they are not yet.
+func (c *cgroup) setLimits(memMax uint64, cpuMax uint64) error {
+	if memMax > 0 {
+		enableController(filepath.Dir(c.path), "memory")
+		if err := c.write("memory.max", strconv.FormatUint(memMax, 10)); os.IsNotExist(err) {
+			return errors.New("the memory controller is not available")
+		} else if err != nil {
+			return fmt.Errorf("setting memory.max: %v", err)
+		}
+	}
+	if cpuMax > 0 {
+		enableController(filepath.Dir(c.path), "cpu")
+		if err := c.write("cpu.max", fmt.Sprintf("%d %d", cpuMax*cpuPeriod/100, cpuPeriod)); os.IsNotExist(err) {
+			return errors.New("the cpu controller is not available")
+		} else if err != nil {
+			return fmt.Errorf("setting cpu.max: %v", err)
+		}
+	}
+	return nil
+}
+
+// enableController enables "controller" for the children of the cgroup
+// "parent". Errors show up when the limit is set.
+func enableController(parent string, controller string) {
+	ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+"+controller), 0)
+}
+
+func (c *cgroup) write(name string, value string) error {
+	fd, err := unix.Openat(c.dirfd, name, unix.O_WRONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	_, err = syscall.Write(fd, []byte(value))
+	return err
+}
+
+func (c *cgroup) read(name string) (string, error) {
+	fd, err := unix.Openat(c.dirfd, name, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	return strings.TrimSpace(string(content)), err
+}
+
+// usage fills in the usage of the cgroup. It includes all processes in
+// the cgroup, not only ours.
+func (c *cgroup) usage(r *ctlsock.ResourcesStruct) {
+	if s, err := c.read("memory.current"); err == nil {
+		r.MemoryCurrent, _ = strconv.ParseUint(s, 10, 64)
+	}
+	s, err := c.read("cpu.stat")
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(s, "\n") {
+		// usage_usec 1234
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		usec, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "usage_usec":
+			r.CgroupCPUSeconds = float64(usec) / 1e6
+		case "throttled_usec":
+			r.CPUThrottledSeconds = float64(usec) / 1e6
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package resources
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestApplyWithoutCgroup(t *testing.T) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_DATA, &lim); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_DATA, &lim)
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	defer Apply("", 0, 0)
+
+	if err := Apply("", 1<<40, 150); err != nil {
+		t.Fatal(err)
+	}
+	if n := runtime.GOMAXPROCS(0); n != 2 {
+		t.Errorf("150%% should run 2 threads, have %d", n)
+	}
+	var lim2 syscall.Rlimit
+	syscall.Getrlimit(syscall.RLIMIT_DATA, &lim2)
+	if lim.Max >= 1<<40 && lim2.Cur != 1<<40 {
+		t.Errorf("RLIMIT_DATA not set: %d", lim2.Cur)
+	}
+	r := Usage()
+	if r.MemoryMax != 1<<40 || r.CPUMaxPercent != 150 || r.Cgroup != "" {
+		t.Errorf("wrong limits %+v", r)
+	}
+	if r.MemoryCurrent == 0 || r.GoHeapBytes == 0 || r.MaxRSS == 0 || r.Goroutines == 0 {
+		t.Errorf("usage missing: %+v", r)
+	}
+}
@@ -0,0 +1,284 @@
+// Package rootsquash maps FUSE requests by root to an unprivileged user,
+// like "root_squash" does for NFS exports.
+//
+// The kernel skips the permission checks for root even with
+// "default_permissions", so the checks for squashed requests are done here,
+// against the attributes the filesystem reports.
+package rootsquash
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Nobody is the uid and gid root is mapped to by default, the same as the
+// NFS default "anonuid" and "anongid".
+const Nobody = 65534
+
+// Permission bits as used by access(2)
+const (
+	rOK = 4
+	wOK = 2
+	xOK = 1
+)
+
+type squashFS struct {
+	fuse.RawFileSystem
+	uid uint32
+	gid uint32
+}
+
+// New wraps "fs" so that requests by uid 0 are handled as if they came from
+// uid:gid.
+func New(fs fuse.RawFileSystem, uid uint32, gid uint32) fuse.RawFileSystem {
+	return &squashFS{
+		RawFileSystem: fs,
+		uid:           uid,
+		gid:           gid,
+	}
+}
+
+// squash rewrites the caller in "h" if it is root, and returns true if it
+// did.
+func (s *squashFS) squash(h *fuse.InHeader) bool {
+	if h.Uid != 0 {
+		return false
+	}
+	h.Uid = s.uid
+	h.Gid = s.gid
+	return true
+}
+
+// getAttr fetches the attributes of "nodeid" on behalf of the (squashed)
+// caller in "h".
+func (s *squashFS) getAttr(cancel <-chan struct{}, h *fuse.InHeader, nodeid uint64, out *fuse.AttrOut) fuse.Status {
+	in := fuse.GetAttrIn{InHeader: *h}
+	in.NodeId = nodeid
+	return s.RawFileSystem.GetAttr(cancel, &in, out)
+}
+
+// allowed checks "mask" (rOK, wOK, xOK) against the permission bits of "a"
+// that apply to the squashed user.
+func (s *squashFS) allowed(a *fuse.Attr, mask uint32) fuse.Status {
+	perm := a.Mode
+	if a.Uid == s.uid {
+		perm >>= 6
+	} else if a.Gid == s.gid {
+		perm >>= 3
+	}
+	if perm&mask != mask {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// check returns EACCES unless the squashed user has the permissions "mask"
+// on "nodeid".
+func (s *squashFS) check(cancel <-chan struct{}, h *fuse.InHeader, nodeid uint64, mask uint32) fuse.Status {
+	var out fuse.AttrOut
+	if st := s.getAttr(cancel, h, nodeid, &out); !st.Ok() {
+		return st
+	}
+	return s.allowed(&out.Attr, mask)
+}
+
+func (s *squashFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	if s.squash(header) {
+		if st := s.check(cancel, header, header.NodeId, xOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (s *squashFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	s.squash(&input.InHeader)
+	return s.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (s *squashFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if s.squash(&input.InHeader) {
+		var a fuse.AttrOut
+		if st := s.getAttr(cancel, &input.InHeader, input.NodeId, &a); !st.Ok() {
+			return st
+		}
+		owner := a.Uid == s.uid
+		// Only the owner may change mode and ownership
+		if input.Valid&(fuse.FATTR_MODE|fuse.FATTR_UID|fuse.FATTR_GID) != 0 && !owner {
+			return fuse.EPERM
+		}
+		if input.Valid&fuse.FATTR_SIZE != 0 {
+			if st := s.allowed(&a.Attr, wOK); !st.Ok() {
+				return st
+			}
+		}
+		if input.Valid&(fuse.FATTR_ATIME|fuse.FATTR_MTIME) != 0 && !owner {
+			if st := s.allowed(&a.Attr, wOK); !st.Ok() {
+				return st
+			}
+		}
+	}
+	return s.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (s *squashFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if s.squash(&input.InHeader) {
+		if st := s.check(cancel, &input.InHeader, input.NodeId, wOK|xOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (s *squashFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if s.squash(&input.InHeader) {
+		if st := s.check(cancel, &input.InHeader, input.NodeId, wOK|xOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (s *squashFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if s.squash(header) {
+		if st := s.check(cancel, header, header.NodeId, wOK|xOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (s *squashFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if s.squash(header) {
+		if st := s.check(cancel, header, header.NodeId, wOK|xOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (s *squashFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if s.squash(&input.InHeader) {
+		if st := s.check(cancel, &input.InHeader, input.NodeId, wOK|xOK); !st.Ok() {
+			return st
+		}
+		if st := s.check(cancel, &input.InHeader, input.Newdir, wOK|xOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (s *squashFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	if s.squash(&input.InHeader) {
+		if st := s.check(cancel, &input.InHeader, input.NodeId, wOK|xOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (s *squashFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	if s.squash(header) {
+		if st := s.check(cancel, header, header.NodeId, wOK|xOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (s *squashFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	s.squash(header)
+	return s.RawFileSystem.Readlink(cancel, header)
+}
+
+func (s *squashFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	if s.squash(&input.InHeader) {
+		if st := s.check(cancel, &input.InHeader, input.NodeId, input.Mask&(rOK|wOK|xOK)); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Access(cancel, input)
+}
+
+func (s *squashFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	if s.squash(header) {
+		if st := s.check(cancel, header, header.NodeId, rOK); !st.Ok() {
+			return 0, st
+		}
+	}
+	return s.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (s *squashFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	s.squash(header)
+	return s.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (s *squashFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if s.squash(&input.InHeader) {
+		if st := s.check(cancel, &input.InHeader, input.NodeId, wOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (s *squashFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	if s.squash(header) {
+		if st := s.check(cancel, header, header.NodeId, wOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (s *squashFS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	if s.squash(&input.InHeader) {
+		if st := s.check(cancel, &input.InHeader, input.NodeId, wOK|xOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (s *squashFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if s.squash(&input.InHeader) {
+		if st := s.check(cancel, &input.InHeader, input.NodeId, openMask(input.Flags)); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.Open(cancel, input, out)
+}
+
+func (s *squashFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if s.squash(&input.InHeader) {
+		if st := s.check(cancel, &input.InHeader, input.NodeId, rOK); !st.Ok() {
+			return st
+		}
+	}
+	return s.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (s *squashFS) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	s.squash(input)
+	return s.RawFileSystem.StatFs(cancel, input, out)
+}
+
+// openMask returns the permissions needed to open a file with "flags"
+func openMask(flags uint32) uint32 {
+	var mask uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mask = rOK
+	case syscall.O_WRONLY:
+		mask = wOK
+	default:
+		mask = rOK | wOK
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mask |= wOK
+	}
+	return mask
+}
@@ -0,0 +1,79 @@
+package rootsquash
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// testFS reports the attributes in "attr" for every node and records the
+// caller of the last Open
+type testFS struct {
+	fuse.RawFileSystem
+	attr   fuse.Attr
+	caller fuse.Caller
+}
+
+func (t *testFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	out.Attr = t.attr
+	return fuse.OK
+}
+
+func (t *testFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	t.caller = input.Caller
+	return fuse.OK
+}
+
+func (t *testFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	return fuse.OK
+}
+
+func TestOpen(t *testing.T) {
+	tfs := &testFS{RawFileSystem: fuse.NewDefaultRawFileSystem()}
+	fs := New(tfs, Nobody, Nobody)
+	testcases := []struct {
+		attr  fuse.Attr
+		uid   uint32
+		flags uint32
+		want  fuse.Status
+	}{
+		// Root is squashed
+		{fuse.Attr{Mode: 0600}, 0, syscall.O_RDONLY, fuse.EACCES},
+		{fuse.Attr{Mode: 0644}, 0, syscall.O_RDONLY, fuse.OK},
+		{fuse.Attr{Mode: 0644}, 0, syscall.O_RDWR, fuse.EACCES},
+		{fuse.Attr{Mode: 0644}, 0, syscall.O_RDONLY | syscall.O_TRUNC, fuse.EACCES},
+		{fuse.Attr{Mode: 0640, Owner: fuse.Owner{Gid: Nobody}}, 0, syscall.O_RDONLY, fuse.OK},
+		{fuse.Attr{Mode: 0600, Owner: fuse.Owner{Uid: Nobody}}, 0, syscall.O_RDWR, fuse.OK},
+		// Other users are left alone, the kernel checks their permissions
+		{fuse.Attr{Mode: 0600}, 1000, syscall.O_RDWR, fuse.OK},
+	}
+	for i, tc := range testcases {
+		tfs.attr = tc.attr
+		in := fuse.OpenIn{Flags: tc.flags}
+		in.Uid = tc.uid
+		have := fs.Open(nil, &in, &fuse.OpenOut{})
+		if have != tc.want {
+			t.Errorf("testcase %d: want %v, have %v", i, tc.want, have)
+		}
+		if have.Ok() && tc.uid == 0 && (tfs.caller.Uid != Nobody || tfs.caller.Gid != Nobody) {
+			t.Errorf("testcase %d: caller was not squashed: %v", i, tfs.caller)
+		}
+	}
+}
+
+func TestSetAttr(t *testing.T) {
+	tfs := &testFS{RawFileSystem: fuse.NewDefaultRawFileSystem()}
+	fs := New(tfs, Nobody, Nobody)
+	tfs.attr = fuse.Attr{Mode: 0666}
+	in := fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_MODE
+	if st := fs.SetAttr(nil, &in, &fuse.AttrOut{}); st != fuse.EPERM {
+		t.Errorf("chmod: want EPERM, have %v", st)
+	}
+	in = fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	if st := fs.SetAttr(nil, &in, &fuse.AttrOut{}); st != fuse.OK {
+		t.Errorf("truncate: want OK, have %v", st)
+	}
+}
@@ -0,0 +1,8 @@
+package sandbox
+
+import "errors"
+
+// DropPrivileges returns an error as "-sandbox-user" is Linux-only
+func DropPrivileges(dir string, uid int, gid int) error {
+	return errors.New("only supported on Linux")
+}
@@ -0,0 +1,39 @@
+package sandbox
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// DropPrivileges chroots into "dir" and switches to "uid" and "gid",
+// dropping all supplementary groups. Needs root.
+//
+// gocryptfs needs /proc/self/fd for operations on symlinks and xattrs, so
+// the working directory is left at /proc, outside of the chroot. Only
+// procfs can be reached that way.
+func DropPrivileges(dir string, uid int, gid int) error {
+	procfd, err := syscall.Open("/proc", syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(procfd)
+	if err = syscall.Chroot(dir); err != nil {
+		return fmt.Errorf("chroot: %w", err)
+	}
+	if err = syscall.Fchdir(procfd); err != nil {
+		return fmt.Errorf("fchdir: %w", err)
+	}
+	syscallcompat.ProcSelfFd = "self/fd"
+	if err = syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %w", err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+// Package sandbox reduces what the long-running gocryptfs process can do
+// once the filesystem is mounted. The process holds the master key, so
+// the impact of a compromise should be as small as possible.
+package sandbox
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// LookupUser returns the uid and gid of the user "name", which can also be
+// a numeric uid.
+func LookupUser(name string) (uid int, gid int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("unknown user %q", name)
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err = strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,8 @@
+package sandbox
+
+import "errors"
+
+// Seccomp returns an error as seccomp is Linux-only
+func Seccomp(inotify bool) error {
+	return errors.New("seccomp is only supported on Linux")
+}
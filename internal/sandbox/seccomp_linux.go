@@ -0,0 +1,135 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package sandbox
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Not defined in golang.org/x/sys/unix, see linux/seccomp.h
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	// Offsets into struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// allowedSyscalls are the syscalls that the Go runtime, go-fuse and
+// gocryptfs need after the filesystem has been mounted, and that exist on
+// amd64 and arm64. Architecture-specific ones are in archSyscalls.
+// Notably missing are execve, ptrace, socket, connect and mount.
+var allowedSyscalls = []uintptr{
+	// File I/O
+	unix.SYS_READ, unix.SYS_WRITE, unix.SYS_PREAD64, unix.SYS_PWRITE64,
+	unix.SYS_READV, unix.SYS_WRITEV, unix.SYS_PREADV, unix.SYS_PWRITEV,
+	unix.SYS_LSEEK, unix.SYS_CLOSE, unix.SYS_DUP, unix.SYS_DUP3, unix.SYS_FCNTL,
+	unix.SYS_IOCTL, unix.SYS_FLOCK, unix.SYS_PIPE2, unix.SYS_SPLICE,
+	unix.SYS_FSYNC, unix.SYS_FDATASYNC, unix.SYS_SYNCFS, unix.SYS_SYNC_FILE_RANGE,
+	unix.SYS_FTRUNCATE, unix.SYS_FALLOCATE, unix.SYS_READAHEAD,
+	// Metadata and directory operations
+	unix.SYS_OPENAT, unix.SYS_OPENAT2, unix.SYS_FSTAT, unix.SYS_STATX, unix.SYS_STATFS, unix.SYS_FSTATFS,
+	unix.SYS_GETDENTS64, unix.SYS_MKDIRAT, unix.SYS_MKNODAT, unix.SYS_UNLINKAT,
+	unix.SYS_RENAMEAT, unix.SYS_RENAMEAT2, unix.SYS_SYMLINKAT, unix.SYS_READLINKAT,
+	unix.SYS_LINKAT, unix.SYS_FCHMOD, unix.SYS_FCHMODAT, unix.SYS_FCHOWN,
+	unix.SYS_FCHOWNAT, unix.SYS_UTIMENSAT, unix.SYS_FACCESSAT, unix.SYS_FCHDIR,
+	unix.SYS_GETCWD, unix.SYS_UMASK,
+	unix.SYS_GETXATTR, unix.SYS_LGETXATTR, unix.SYS_FGETXATTR,
+	unix.SYS_SETXATTR, unix.SYS_LSETXATTR, unix.SYS_FSETXATTR,
+	unix.SYS_LISTXATTR, unix.SYS_LLISTXATTR, unix.SYS_FLISTXATTR,
+	unix.SYS_REMOVEXATTR, unix.SYS_LREMOVEXATTR, unix.SYS_FREMOVEXATTR,
+	// Unmounting ourselves. The kernel checks the permissions.
+	unix.SYS_UMOUNT2,
+	// The control socket accepts connections, but we do not open new ones
+	unix.SYS_ACCEPT4, unix.SYS_RECVFROM, unix.SYS_SENDTO, unix.SYS_RECVMSG,
+	unix.SYS_SENDMSG, unix.SYS_SHUTDOWN, unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME,
+	unix.SYS_GETSOCKOPT, unix.SYS_SETSOCKOPT,
+	unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_PWAIT,
+	unix.SYS_EVENTFD2, unix.SYS_PPOLL, unix.SYS_PSELECT6,
+	// Credentials. Used by "-allow_other" as root to create files owned
+	// by the calling user.
+	unix.SYS_GETUID, unix.SYS_GETEUID, unix.SYS_GETGID, unix.SYS_GETEGID,
+	unix.SYS_GETGROUPS, unix.SYS_SETGROUPS, unix.SYS_SETREUID, unix.SYS_SETREGID,
+	unix.SYS_SETRESUID, unix.SYS_SETRESGID, unix.SYS_SETFSUID, unix.SYS_SETFSGID,
+	// Memory, threads, signals, time: the Go runtime
+	unix.SYS_MMAP, unix.SYS_MUNMAP, unix.SYS_MPROTECT, unix.SYS_MREMAP,
+	unix.SYS_MADVISE, unix.SYS_BRK, unix.SYS_CLONE, unix.SYS_CLONE3,
+	unix.SYS_FUTEX, unix.SYS_SCHED_YIELD, unix.SYS_SCHED_GETAFFINITY,
+	unix.SYS_NANOSLEEP, unix.SYS_CLOCK_NANOSLEEP, unix.SYS_CLOCK_GETTIME,
+	unix.SYS_GETTIMEOFDAY, unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK,
+	unix.SYS_RT_SIGRETURN, unix.SYS_SIGALTSTACK, unix.SYS_RESTART_SYSCALL,
+	unix.SYS_GETPID, unix.SYS_GETPPID, unix.SYS_GETTID, unix.SYS_KILL,
+	unix.SYS_TGKILL, unix.SYS_TKILL, unix.SYS_GETRLIMIT, unix.SYS_PRLIMIT64,
+	unix.SYS_GETRANDOM, unix.SYS_MEMBARRIER, unix.SYS_RSEQ, unix.SYS_SET_ROBUST_LIST,
+	unix.SYS_EXIT, unix.SYS_EXIT_GROUP,
+}
+
+// inotifySyscalls are needed by "-notify" to watch the directories that are
+// listed after mounting
+var inotifySyscalls = []uintptr{unix.SYS_INOTIFY_ADD_WATCH, unix.SYS_INOTIFY_RM_WATCH}
+
+// Seccomp installs a seccomp-bpf filter on all threads of the process that
+// only allows the syscalls in allowedSyscalls and archSyscalls, and those in
+// inotifySyscalls if "inotify" is set. Other syscalls fail with EPERM. The
+// filter cannot be removed again.
+func Seccomp(inotify bool) error {
+	syscalls := append(allowedSyscalls, archSyscalls...)
+	if inotify {
+		syscalls = append(syscalls, inotifySyscalls...)
+	}
+	filter := seccompFilter(syscalls)
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	// no_new_privs is per-thread, but the kernel sets it on all threads
+	// when synchronizing the filter.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %w", err)
+	}
+	// Returns the id of the thread that could not be synchronized, if any
+	ret, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter,
+		seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+	if ret != 0 {
+		return fmt.Errorf("seccomp: could not synchronize thread %d", ret)
+	}
+	return nil
+}
+
+// seccompFilter returns a BPF program that kills the process if it runs
+// with a different syscall ABI than auditArch, allows "syscalls", and
+// makes everything else fail with EPERM.
+func seccompFilter(syscalls []uintptr) []unix.SockFilter {
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataArch},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: auditArch, Jt: 1},
+		{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetKillProcess},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: seccompDataNr},
+	}
+	for _, nr := range syscalls {
+		// Skip the following "allow" instruction if the number does not
+		// match. This keeps all jumps short.
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, K: uint32(nr), Jf: 1},
+			unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow},
+		)
+	}
+	return append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)})
+}
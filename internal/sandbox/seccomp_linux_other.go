@@ -0,0 +1,15 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package sandbox
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Seccomp returns an error as we have no syscall list for this
+// architecture
+func Seccomp(inotify bool) error {
+	return fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+}
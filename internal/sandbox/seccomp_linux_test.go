@@ -0,0 +1,60 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package sandbox
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// envChild tells the test binary that it runs as the child of
+// TestSeccomp
+const envChild = "SANDBOX_TEST_CHILD"
+
+// The filter cannot be removed again, so run the actual test in a child
+// process.
+func TestSeccomp(t *testing.T) {
+	if os.Getenv(envChild) != "" {
+		seccompChild(t)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSeccomp$", "-test.v")
+	cmd.Env = append(os.Environ(), envChild+"="+t.TempDir())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
+
+func seccompChild(t *testing.T) {
+	dir := os.Getenv(envChild)
+	if err := Seccomp(false); err != nil {
+		t.Fatal(err)
+	}
+	// File operations still work
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path, path+"2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(path + "2"); err != nil {
+		t.Fatal(err)
+	}
+	// Executing programs and opening sockets does not
+	err := exec.Command("/bin/true").Run()
+	if err == nil {
+		t.Error("exec should have failed")
+	}
+	_, err = syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != syscall.EPERM {
+		t.Errorf("want EPERM, have %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+package sandbox
+
+import "golang.org/x/sys/unix"
+
+// AUDIT_ARCH_X86_64 from linux/audit.h
+const auditArch = 0xc000003e
+
+// archSyscalls are the legacy syscalls that only exist on amd64
+var archSyscalls = []uintptr{
+	unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_NEWFSTATAT,
+	unix.SYS_ACCESS, unix.SYS_GETDENTS, unix.SYS_MKDIR, unix.SYS_RMDIR,
+	unix.SYS_UNLINK, unix.SYS_RENAME, unix.SYS_READLINK, unix.SYS_FUTIMESAT,
+	unix.SYS_PIPE, unix.SYS_DUP2, unix.SYS_POLL, unix.SYS_SELECT,
+	unix.SYS_EPOLL_WAIT, unix.SYS_ARCH_PRCTL,
+}
@@ -0,0 +1,12 @@
+package sandbox
+
+import "golang.org/x/sys/unix"
+
+// AUDIT_ARCH_AARCH64 from linux/audit.h
+const auditArch = 0xc00000b7
+
+// archSyscalls are the syscalls that are named differently on arm64
+var archSyscalls = []uintptr{
+	// newfstatat
+	unix.SYS_FSTATAT,
+}
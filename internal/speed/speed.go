@@ -14,6 +14,7 @@ import (
 
 	"golang.org/x/crypto/chacha20poly1305"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/aegis"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
@@ -44,9 +45,12 @@ func Run() {
 	}{
 		{name: cryptocore.BackendOpenSSL.String(), f: bStupidGCM, preferred: stupidgcm.PreferOpenSSLAES256GCM()},
 		{name: cryptocore.BackendGoGCM.String(), f: bGoGCM, preferred: !stupidgcm.PreferOpenSSLAES256GCM()},
+		{name: cryptocore.BackendOpenSSL128.String(), f: bStupidGCM128, preferred: false},
+		{name: cryptocore.BackendGoGCM128.String(), f: bGoGCM128, preferred: false},
 		{name: cryptocore.BackendAESSIV.String(), f: bAESSIV, preferred: false},
 		{name: cryptocore.BackendXChaCha20Poly1305OpenSSL.String(), f: bStupidXchacha, preferred: stupidgcm.PreferOpenSSLXchacha20poly1305()},
 		{name: cryptocore.BackendXChaCha20Poly1305.String(), f: bXchacha20poly1305, preferred: !stupidgcm.PreferOpenSSLXchacha20poly1305()},
+		{name: cryptocore.BackendAEGIS256.String(), f: bAEGIS256, preferred: false},
 	}
 	for _, b := range bTable {
 		fmt.Printf("%-26s\t", b.name)
@@ -148,6 +152,27 @@ func bGoGCMBlockSize(b *testing.B, blockSize int) {
 	bEncryptBlockSize(b, gGCM, blockSize)
 }
 
+// bStupidGCM128 benchmarks OpenSSL AES-128-GCM
+func bStupidGCM128(b *testing.B) {
+	if stupidgcm.BuiltWithoutOpenssl {
+		b.Skip("openssl has been disabled at compile-time")
+	}
+	bEncrypt(b, stupidgcm.NewAES128GCM(randBytes(16)))
+}
+
+// bGoGCM128 benchmarks Go stdlib GCM with a 128-bit key
+func bGoGCM128(b *testing.B) {
+	gAES, err := aes.NewCipher(randBytes(16))
+	if err != nil {
+		b.Fatal(err)
+	}
+	gGCM, err := cipher.NewGCMWithNonceSize(gAES, 16)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bEncrypt(b, gGCM)
+}
+
 // bAESSIV benchmarks AES-SIV from github.com/aperturerobotics/jacobsa-crypto/siv
 func bAESSIV(b *testing.B) {
 	c := siv_aead.New(randBytes(64))
@@ -160,6 +185,12 @@ func bXchacha20poly1305(b *testing.B) {
 	bEncrypt(b, c)
 }
 
+// bAEGIS256 benchmarks AEGIS-256 from internal/aegis
+func bAEGIS256(b *testing.B) {
+	c, _ := aegis.New(randBytes(32))
+	bEncrypt(b, c)
+}
+
 // bStupidXchacha benchmarks OpenSSL XChaCha20
 func bStupidXchacha(b *testing.B) {
 	if stupidgcm.BuiltWithoutOpenssl {
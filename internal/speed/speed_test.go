@@ -8,6 +8,7 @@ import (
 
 	"golang.org/x/crypto/chacha20poly1305"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/aegis"
 	"github.com/rfjakob/gocryptfs/v2/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 )
@@ -58,6 +59,14 @@ func BenchmarkGoGCMDecrypt(b *testing.B) {
 	bDecrypt(b, gGCM)
 }
 
+func BenchmarkGoGCM128(b *testing.B) {
+	bGoGCM128(b)
+}
+
+func BenchmarkStupidGCM128(b *testing.B) {
+	bStupidGCM128(b)
+}
+
 func BenchmarkAESSIV(b *testing.B) {
 	bAESSIV(b)
 }
@@ -75,6 +84,15 @@ func BenchmarkXchachaDecrypt(b *testing.B) {
 	bDecrypt(b, c)
 }
 
+func BenchmarkAEGIS256(b *testing.B) {
+	bAEGIS256(b)
+}
+
+func BenchmarkAEGIS256Decrypt(b *testing.B) {
+	c, _ := aegis.New(randBytes(32))
+	bDecrypt(b, c)
+}
+
 func BenchmarkStupidXchacha(b *testing.B) {
 	bStupidXchacha(b)
 }
@@ -64,7 +64,7 @@ func (c *stupidAEADCommon) Wiped() bool {
 	if c.wiped {
 		return true
 	}
-	if len(c.key) != keyLen {
+	if len(c.key) != keyLen && len(c.key) != keyLen128 {
 		log.Panicf("wrong key length %d", len(c.key))
 	}
 	return false
@@ -16,8 +16,10 @@ const (
 	BuiltWithoutOpenssl = false
 
 	keyLen = 32
-	ivLen  = 16
-	tagLen = 16
+	// keyLen128 is the key length of AES-128-GCM
+	keyLen128 = 16
+	ivLen     = 16
+	tagLen    = 16
 )
 
 type stupidGCM struct {
@@ -40,3 +42,20 @@ func NewAES256GCM(keyIn []byte) cipher.AEAD {
 		},
 	}
 }
+
+// NewAES128GCM returns a new AES-128-GCM cipher that satisfies the cipher.AEAD interface.
+//
+// Only 16-bytes keys and 16-byte IVs are supported.
+func NewAES128GCM(keyIn []byte) cipher.AEAD {
+	if len(keyIn) != keyLen128 {
+		log.Panicf("Only %d-byte keys are supported", keyLen128)
+	}
+	return &stupidGCM{
+		stupidAEADCommon{
+			// Create a private copy of the key
+			key:              append([]byte{}, keyIn...),
+			openSSLEVPCipher: C.EVP_aes_128_gcm(),
+			nonceSize:        ivLen,
+		},
+	}
+}
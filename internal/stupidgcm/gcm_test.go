@@ -27,3 +27,19 @@ func TestStupidGCM(t *testing.T) {
 
 	testCiphers(t, sGCM, gGCM)
 }
+
+func TestStupidGCM128(t *testing.T) {
+	key := randBytes(16)
+	sGCM := NewAES128GCM(key)
+
+	gAES, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gGCM, err := cipher.NewGCMWithNonceSize(gAES, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCiphers(t, sGCM, gGCM)
+}
@@ -39,7 +39,7 @@ int openssl_aead_seal(
         panic("EVP_EncryptInit_ex set cipher failed");
     }
 
-    // Check keyLen by trying to set it (fails if keyLen != 32)
+    // Check keyLen by trying to set it (fails if it does not match the cipher)
     if (EVP_CIPHER_CTX_set_key_length(ctx, keyLen) != 1) {
         panic("keyLen mismatch");
     }
@@ -125,7 +125,7 @@ int openssl_aead_open(
         panic("EVP_DecryptInit_ex set cipher failed");
     }
 
-    // Check keyLen by trying to set it (fails if keyLen != 32)
+    // Check keyLen by trying to set it (fails if it does not match the cipher)
     if (EVP_CIPHER_CTX_set_key_length(ctx, keyLen) != 1) {
         panic("keyLen mismatch");
     }
@@ -27,6 +27,11 @@ func NewAES256GCM(_ []byte) cipher.AEAD {
 	return nil
 }
 
+func NewAES128GCM(_ []byte) cipher.AEAD {
+	errExit()
+	return nil
+}
+
 func NewChacha20poly1305(_ []byte) cipher.AEAD {
 	errExit()
 	return nil
@@ -34,11 +34,57 @@ func OpenDirNofollow(baseDir string, relPath string) (fd int, err error) {
 	if relPath == "" {
 		return dirfd, nil
 	}
-	// Split the path into components
+	fd, err = OpenatNofollow(dirfd, relPath, syscall.O_DIRECTORY|O_PATH, 0)
+	syscall.Close(dirfd)
+	return fd, err
+}
+
+// OpenatNofollow opens "relPath" relative to "dirfd" without following
+// symlinks in any of its components, and without leaving the directory tree
+// below "dirfd". A symlink that is swapped in by somebody else who can
+// write to the directory tree makes it fail instead of opening something
+// else. Paths with ".." components are rejected with EXDEV. On Linux 5.6
+// and later, this is a single openat2(RESOLVE_BENEATH|RESOLVE_NO_SYMLINKS)
+// call, otherwise we walk the path with O_NOFOLLOW.
+// Like Openat, O_CREAT implies O_EXCL, so an existing file is never opened
+// for creation.
+// Retries on EINTR.
+func OpenatNofollow(dirfd int, relPath string, flags int, mode uint32) (fd int, err error) {
+	if filepath.IsAbs(relPath) {
+		tlog.Warn.Printf("BUG: OpenatNofollow called with absolute relPath=%q", relPath)
+		return -1, syscall.EINVAL
+	}
+	if relPath == "" {
+		relPath = "."
+	}
 	parts := strings.Split(relPath, "/")
-	// Walk the directory tree
-	var dirfd2 int
 	for _, name := range parts {
+		if name == ".." {
+			return -1, syscall.EXDEV
+		}
+	}
+	if flags&syscall.O_CREAT != 0 {
+		flags |= syscall.O_EXCL
+	}
+	fd, err = openat2Beneath(dirfd, relPath, flags, mode)
+	if err != syscall.ENOSYS {
+		return fd, err
+	}
+	// Walk the directory tree
+	dirfd, err = retryEINTR2(func() (int, error) {
+		return syscall.Dup(dirfd)
+	})
+	if err != nil {
+		return -1, err
+	}
+	for i, name := range parts {
+		if i == len(parts)-1 {
+			break
+		}
+		if name == "" || name == "." {
+			continue
+		}
+		var dirfd2 int
 		dirfd2, err = Openat(dirfd, name, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|O_PATH, 0)
 		syscall.Close(dirfd)
 		if err != nil {
@@ -46,6 +92,12 @@ func OpenDirNofollow(baseDir string, relPath string) (fd int, err error) {
 		}
 		dirfd = dirfd2
 	}
-	// Return fd to final directory
-	return dirfd, nil
+	last := parts[len(parts)-1]
+	if last == "" {
+		// Trailing slash
+		last = "."
+	}
+	fd, err = Openat(dirfd, last, flags|syscall.O_NOFOLLOW, mode)
+	syscall.Close(dirfd)
+	return fd, err
 }
@@ -47,3 +47,40 @@ func TestOpenNofollow(t *testing.T) {
 		syscall.Close(fd)
 	}
 }
+
+func TestOpenatNofollow(t *testing.T) {
+	base := tmpDir + "/" + t.Name()
+	err := os.MkdirAll(base+"/d1/d2", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(base+"/d1/d2/f", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Symlink("d1", base+"/link")
+	os.Symlink("f", base+"/d1/d2/flink")
+	dirfd, err := syscall.Open(base, syscall.O_DIRECTORY|O_PATH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	fd, err := OpenatNofollow(dirfd, "d1/d2/f", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+	fd, err = OpenatNofollow(dirfd, "", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+	for _, p := range []string{"link/d2/f", "d1/d2/flink", "d1/../d1/d2/f", "../" + t.Name() + "/d1/d2/f"} {
+		fd, err = OpenatNofollow(dirfd, p, syscall.O_RDONLY, 0)
+		if err == nil {
+			syscall.Close(fd)
+			t.Errorf("%q: should have failed", p)
+		} else if err != syscall.ELOOP && err != syscall.ENOTDIR && err != syscall.EXDEV {
+			t.Errorf("%q: expected ELOOP, ENOTDIR or EXDEV, got %v", p, err)
+		}
+	}
+}
@@ -15,6 +15,9 @@ const (
 	QuirkDuplicateIno1
 	// QuirkNoUserXattr means that user.* xattrs are not supported
 	QuirkNoUserXattr
+	// QuirkSlowFalloc means that preallocation works, but is slow or gains
+	// nothing, like on copy-on-write filesystems such as ZFS
+	QuirkSlowFalloc
 )
 
 func logQuirk(s string) {
@@ -6,6 +6,9 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
+// zfsSuperMagic is missing from golang.org/x/sys/unix
+const zfsSuperMagic = 0x2fc12fc1
+
 // DetectQuirks decides if there are known quirks on the backing filesystem
 // that need to be workarounded.
 //
@@ -23,10 +26,17 @@ func DetectQuirks(cipherdir string) (q uint64) {
 	//
 	// Cast to uint32 avoids compile error on arm: "constant 2435016766 overflows int32"
 	if uint32(st.Type) == unix.BTRFS_SUPER_MAGIC {
-		logQuirk("Btrfs detected, forcing -noprealloc. See https://github.com/rfjakob/gocryptfs/issues/395 for why.")
+		logQuirk("Btrfs detected, -prealloc=auto disables preallocation. See https://github.com/rfjakob/gocryptfs/issues/395 for why.")
 		q |= QuirkBrokenFalloc
 	}
 
+	// ZFS is copy-on-write, so preallocated space does not guarantee that
+	// the write finds free space, and fallocate is slow
+	if uint32(st.Type) == zfsSuperMagic {
+		logQuirk("ZFS detected, -prealloc=auto disables preallocation.")
+		q |= QuirkSlowFalloc
+	}
+
 	if uint32(st.Type) == unix.TMPFS_MAGIC {
 		logQuirk("tmpfs detected, no extended attributes except acls will work.")
 	}
@@ -21,6 +21,9 @@ const (
 	// O_PATH is only defined on Linux
 	O_PATH = 0
 
+	// O_NOATIME is only defined on Linux
+	O_NOATIME = 0
+
 	// Only exists on Linux. Define here to fix build failure, even though
 	// we will never see the flags.
 	RENAME_NOREPLACE = 1
@@ -64,7 +67,7 @@ func setattrlist(path *byte, list unsafe.Pointer, buf unsafe.Pointer, size uintp
 // fcntl F_PREALLOCATE is not accessible from Go.
 // See https://github.com/rfjakob/gocryptfs/issues/18 if you want to help.
 func EnospcPrealloc(fd int, off int64, len int64) error {
-	return nil
+	return syscall.EOPNOTSUPP
 }
 
 // See above.
@@ -72,6 +75,11 @@ func Fallocate(fd int, mode uint32, off int64, len int64) error {
 	return syscall.EOPNOTSUPP
 }
 
+// Syncfs is not available on Darwin, so we sync all filesystems instead.
+func Syncfs(fd int) (err error) {
+	return unix.Sync()
+}
+
 // Dup3 is not available on Darwin, so we use Dup2 instead.
 func Dup3(oldfd int, newfd int, flags int) (err error) {
 	if flags != 0 {
@@ -227,6 +235,11 @@ func GetdentsSpecial(fd int) (entries []fuse.DirEntry, entriesSpecial []fuse.Dir
 	return emulateGetdents(fd)
 }
 
+// openat2Beneath returns ENOSYS, openat2 is only available on Linux
+func openat2Beneath(dirfd int, path string, flags int, mode uint32) (int, error) {
+	return -1, syscall.ENOSYS
+}
+
 // Renameat2 does not exist on Darwin, so we call Renameat and ignore the flags.
 func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) (err error) {
 	return unix.Renameat(olddirfd, oldpath, newdirfd, newpath)
@@ -7,15 +7,13 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
-
-	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
 const (
@@ -28,17 +26,54 @@ const (
 	// O_PATH is only defined on Linux
 	O_PATH = unix.O_PATH
 
+	// O_NOATIME is only defined on Linux
+	O_NOATIME = syscall.O_NOATIME
+
 	// Only defined on Linux
 	RENAME_NOREPLACE = unix.RENAME_NOREPLACE
 	RENAME_WHITEOUT  = unix.RENAME_WHITEOUT
 	RENAME_EXCHANGE  = unix.RENAME_EXCHANGE
 )
 
-var preallocWarn sync.Once
+// ProcSelfFd is where we find the /proc/self/fd/N links that give access to
+// a file via its file descriptor. As /proc is outside of the chroot,
+// "-sandbox-user" changes it to a path relative to the working directory.
+var ProcSelfFd = "/proc/self/fd"
+
+// noOpenat2 is set when the kernel does not have openat2 (before Linux 5.6).
+// Use atomic ops to access it.
+var noOpenat2 uint32
+
+// openat2Beneath opens "path" relative to "dirfd" with
+// openat2(RESOLVE_BENEATH|RESOLVE_NO_SYMLINKS). Returns ENOSYS if the kernel
+// does not have openat2.
+func openat2Beneath(dirfd int, path string, flags int, mode uint32) (int, error) {
+	if atomic.LoadUint32(&noOpenat2) != 0 {
+		return -1, syscall.ENOSYS
+	}
+	how := unix.OpenHow{
+		Flags:   uint64(flags),
+		Mode:    uint64(mode),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	fd, err := retryEINTR2(func() (int, error) {
+		return unix.Openat2(dirfd, path, &how)
+	})
+	switch err {
+	case syscall.ENOSYS:
+		atomic.StoreUint32(&noOpenat2, 1)
+	case syscall.EAGAIN:
+		// A concurrent rename made the kernel give up. Let the caller walk
+		// the path instead.
+		err = syscall.ENOSYS
+	}
+	return fd, err
+}
 
 // EnospcPrealloc preallocates ciphertext space without changing the file
 // size. This guarantees that we don't run out of space while writing a
 // ciphertext block (that would corrupt the block).
+// ZFS, ext3, NFSv3 and exFAT do not support it and return EOPNOTSUPP.
 func EnospcPrealloc(fd int, off int64, len int64) (err error) {
 	for {
 		err = syscall.Fallocate(fd, _FALLOC_FL_KEEP_SIZE, off, len)
@@ -48,16 +83,6 @@ func EnospcPrealloc(fd int, off int64, len int64) (err error) {
 			// signal and we should try again.
 			continue
 		}
-		if err == syscall.EOPNOTSUPP {
-			// ZFS and ext3 do not support fallocate. Warn but continue anyway.
-			// https://github.com/rfjakob/gocryptfs/issues/22
-			preallocWarn.Do(func() {
-				tlog.Warn.Printf("Warning: The underlying filesystem " +
-					"does not support fallocate(2). gocryptfs will continue working " +
-					"but is no longer resistant against out-of-space errors.\n")
-			})
-			return nil
-		}
 		return err
 	}
 }
@@ -171,6 +196,11 @@ func Dup3(oldfd int, newfd int, flags int) (err error) {
 	return syscall.Dup3(oldfd, newfd, flags)
 }
 
+// Syncfs writes all pending changes of the filesystem containing "fd" to disk.
+func Syncfs(fd int) (err error) {
+	return unix.Syncfs(fd)
+}
+
 // FchmodatNofollow is like Fchmodat but never follows symlinks.
 //
 // This should be handled by the AT_SYMLINK_NOFOLLOW flag, but Linux
@@ -201,7 +231,7 @@ func FchmodatNofollow(dirfd int, path string, mode uint32) (err error) {
 
 	// Change mode of the actual file. Fchmod does not work with O_PATH,
 	// but Chmod via /proc/self/fd works.
-	procPath := fmt.Sprintf("/proc/self/fd/%d", fd)
+	procPath := fmt.Sprintf("%s/%d", ProcSelfFd, fd)
 	return syscall.Chmod(procPath, mode)
 }
 
@@ -257,7 +287,7 @@ func FutimesNano(fd int, a *time.Time, m *time.Time) (err error) {
 	ts := timesToTimespec(a, m)
 	// To avoid introducing a separate syscall wrapper for futimens()
 	// (as done in go-fuse, for example), we instead use the /proc/self/fd trick.
-	procPath := fmt.Sprintf("/proc/self/fd/%d", fd)
+	procPath := fmt.Sprintf("%s/%d", ProcSelfFd, fd)
 	return unix.UtimesNanoAt(unix.AT_FDCWD, procPath, ts, 0)
 }
 
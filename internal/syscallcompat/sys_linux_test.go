@@ -0,0 +1,43 @@
+package syscallcompat
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// O_CREAT implies O_EXCL, with openat2 and when walking the path
+func TestOpenatNofollowCreat(t *testing.T) {
+	base := tmpDir + "/" + t.Name()
+	if err := os.MkdirAll(base+"/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+"/d/f", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := syscall.Open(base, syscall.O_DIRECTORY|O_PATH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	for _, no := range []uint32{0, 1} {
+		old := atomic.SwapUint32(&noOpenat2, no)
+		fd, err := OpenatNofollow(dirfd, "d/f", syscall.O_RDWR|syscall.O_CREAT, 0600)
+		if err == nil {
+			syscall.Close(fd)
+		}
+		fd2, err2 := OpenatNofollow(dirfd, "d/new", syscall.O_RDWR|syscall.O_CREAT, 0600)
+		if err2 == nil {
+			syscall.Close(fd2)
+			syscall.Unlink(base + "/d/new")
+		}
+		atomic.StoreUint32(&noOpenat2, old)
+		if err != syscall.EEXIST {
+			t.Errorf("noOpenat2=%d: existing file: want EEXIST, have %v", no, err)
+		}
+		if err2 != nil {
+			t.Errorf("noOpenat2=%d: new file: %v", no, err2)
+		}
+	}
+}
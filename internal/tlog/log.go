@@ -72,17 +72,18 @@ func (l *toggledLogger) Printf(format string, v ...interface{}) {
 	if !l.Enabled {
 		return
 	}
-	msg := trimNewline(fmt.Sprintf(format, v...))
-	l.Logger.Printf(l.prefix + msg + l.postfix)
-	if l.Wpanic {
-		l.Logger.Panic(wpanicMsg + msg)
-	}
+	l.output(fmt.Sprintf(format, v...))
 }
 func (l *toggledLogger) Println(v ...interface{}) {
 	if !l.Enabled {
 		return
 	}
-	msg := trimNewline(fmt.Sprint(v...))
+	l.output(fmt.Sprint(v...))
+}
+
+// output prints "msg" regardless of l.Enabled
+func (l *toggledLogger) output(msg string) {
+	msg = trimNewline(msg)
 	l.Logger.Println(l.prefix + msg + l.postfix)
 	if l.Wpanic {
 		l.Logger.Panic(wpanicMsg + msg)
@@ -0,0 +1,162 @@
+package tlog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Log levels of a Module. LevelDefault follows the global settings ("-d",
+// "-q").
+const (
+	LevelDefault = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+)
+
+var levelNames = []string{"default", "debug", "info", "warn"}
+
+// Module is the logger of a subsystem whose log level can be set
+// independently of the others, also at runtime through the control socket.
+// Warnings are always printed, like with the global Warn logger.
+type Module struct {
+	name string
+	// level is accessed atomically
+	level int32
+	Debug *moduleLogger
+	Info  *moduleLogger
+	Warn  *moduleLogger
+}
+
+// moduleLogger prints to one of the global loggers if the module level
+// allows it
+type moduleLogger struct {
+	m        *Module
+	severity int32
+}
+
+// The modules. When adding one, also add it to the "-loglevel" section in
+// MANPAGE.md.
+var (
+	// FuseFrontend is the forward mode FUSE frontend
+	FuseFrontend = newModule("fusefrontend")
+	// NameTransform is file name encryption
+	NameTransform = newModule("nametransform")
+	// ContentEnc is file content encryption
+	ContentEnc = newModule("contentenc")
+	// Ctlsock is the control socket
+	Ctlsock = newModule("ctlsock")
+)
+
+var modules = map[string]*Module{}
+
+func newModule(name string) *Module {
+	m := &Module{name: name}
+	m.Debug = &moduleLogger{m, LevelDebug}
+	m.Info = &moduleLogger{m, LevelInfo}
+	m.Warn = &moduleLogger{m, LevelWarn}
+	modules[name] = m
+	return m
+}
+
+// global returns the global logger for this severity
+func (ml *moduleLogger) global() *toggledLogger {
+	switch ml.severity {
+	case LevelDebug:
+		return Debug
+	case LevelInfo:
+		return Info
+	default:
+		return Warn
+	}
+}
+
+// enabled decides if a message is printed
+func (ml *moduleLogger) enabled() bool {
+	l := ml.global()
+	level := atomic.LoadInt32(&ml.m.level)
+	// Warnings are only ever disabled temporarily, to silence expected
+	// errors, and that must work for all modules
+	if ml.severity == LevelWarn || level == LevelDefault {
+		return l.Enabled
+	}
+	return ml.severity >= level
+}
+
+func (ml *moduleLogger) Printf(format string, v ...interface{}) {
+	if !ml.enabled() {
+		return
+	}
+	ml.global().output(fmt.Sprintf(format, v...))
+}
+
+func (ml *moduleLogger) Println(v ...interface{}) {
+	if !ml.enabled() {
+		return
+	}
+	ml.global().output(fmt.Sprint(v...))
+}
+
+// ParseModuleLevels parses a comma-separated list of "module=level" pairs,
+// like "fusefrontend=debug,ctlsock=info", for SetModuleLevels
+func ParseModuleLevels(spec string) (map[string]string, error) {
+	levels := map[string]string{}
+	for _, kv := range strings.Split(spec, ",") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid log level setting %q, want MODULE=LEVEL", kv)
+		}
+		levels[parts[0]] = parts[1]
+	}
+	return levels, nil
+}
+
+// SetModuleLevels sets the log level of the modules given as keys to
+// "default", "debug", "info" or "warn". Nothing is changed if one of the
+// modules or levels is unknown.
+func SetModuleLevels(levels map[string]string) error {
+	parsed := map[*Module]int32{}
+	for name, levelName := range levels {
+		m, ok := modules[name]
+		if !ok {
+			return fmt.Errorf("unknown log module %q, known are: %s", name, strings.Join(moduleNames(), ", "))
+		}
+		level := -1
+		for i, n := range levelNames {
+			if n == levelName {
+				level = i
+			}
+		}
+		if level < 0 {
+			return fmt.Errorf("unknown log level %q, known are: %s", levelName, strings.Join(levelNames, ", "))
+		}
+		parsed[m] = int32(level)
+	}
+	for m, level := range parsed {
+		atomic.StoreInt32(&m.level, level)
+	}
+	return nil
+}
+
+// ModuleLevels returns the current log level of every module
+func ModuleLevels() map[string]string {
+	out := make(map[string]string, len(modules))
+	for name, m := range modules {
+		out[name] = levelNames[atomic.LoadInt32(&m.level)]
+	}
+	return out
+}
+
+func moduleNames() []string {
+	var names []string
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
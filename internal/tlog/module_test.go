@@ -0,0 +1,61 @@
+package tlog
+
+import (
+	"testing"
+)
+
+func TestModuleLevels(t *testing.T) {
+	defer func() {
+		for _, m := range modules {
+			m.level = LevelDefault
+		}
+		Debug.Enabled = false
+	}()
+	m := FuseFrontend
+	// Default follows the global loggers
+	Debug.Enabled = false
+	if m.Debug.enabled() || !m.Info.enabled() || !m.Warn.enabled() {
+		t.Error("default level does not follow the global loggers")
+	}
+	Debug.Enabled = true
+	if !m.Debug.enabled() {
+		t.Error("default level does not follow -d")
+	}
+	Debug.Enabled = false
+	if err := SetModuleLevels(map[string]string{"fusefrontend": "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Debug.enabled() || ContentEnc.Debug.enabled() {
+		t.Error("debug level not applied to exactly one module")
+	}
+	if err := SetModuleLevels(map[string]string{"fusefrontend": "warn"}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Debug.enabled() || m.Info.enabled() || !m.Warn.enabled() {
+		t.Error("warn level not applied")
+	}
+	// Temporarily silenced warnings stay silent
+	Warn.Enabled = false
+	if m.Warn.enabled() {
+		t.Error("warning printed although Warn is disabled")
+	}
+	Warn.Enabled = true
+	// Errors change nothing
+	err := SetModuleLevels(map[string]string{"fusefrontend": "debug", "ctlsock": "loud"})
+	if err == nil || ModuleLevels()["fusefrontend"] != "warn" {
+		t.Errorf("invalid level: err=%v, levels=%v", err, ModuleLevels())
+	}
+	if err := SetModuleLevels(map[string]string{"nosuchmodule": "debug"}); err == nil {
+		t.Error("unknown module accepted")
+	}
+}
+
+func TestParseModuleLevels(t *testing.T) {
+	levels, err := ParseModuleLevels("fusefrontend=debug,,ctlsock=info")
+	if err != nil || len(levels) != 2 || levels["fusefrontend"] != "debug" || levels["ctlsock"] != "info" {
+		t.Errorf("got %v, %v", levels, err)
+	}
+	if _, err = ParseModuleLevels("fusefrontend"); err == nil {
+		t.Error("missing level accepted")
+	}
+}
@@ -0,0 +1,126 @@
+// Package tpm2 seals secrets to the local TPM 2.0 chip ("-tpm2-enroll").
+// It calls the tpm2-tools programs, like package fido2 calls the fido2-tools.
+package tpm2
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// MaxPCR is the highest PCR index a TPM 2.0 chip has
+const MaxPCR = 23
+
+// ParsePCRs checks the comma-separated list of PCR indexes "list", like
+// "0,7", and returns it as a tpm2-tools PCR selection of the SHA-256 bank.
+// An empty list returns "".
+func ParsePCRs(list string) (string, error) {
+	if list == "" {
+		return "", nil
+	}
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || i < 0 || i > MaxPCR {
+			return "", fmt.Errorf("invalid PCR %q, possible values are 0-%d", s, MaxPCR)
+		}
+		out = append(out, strconv.Itoa(i))
+	}
+	return "sha256:" + strings.Join(out, ","), nil
+}
+
+// run executes a tpm2-tools program with "args" in "dir" and returns what it
+// writes to stdout
+func run(dir string, stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	tlog.Debug.Printf("tpm2: executing %q", cmd.Args)
+	var stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s failed with %v: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("%s failed with %v", name, err)
+	}
+	return out, nil
+}
+
+// createPrimary creates the storage primary key in "dir"/primary.ctx. The
+// TPM derives it from its owner seed, so it is the same every time.
+func createPrimary(dir string) error {
+	_, err := run(dir, nil, "tpm2_createprimary", "-Q", "-C", "o", "-g", "sha256", "-G", "ecc", "-c", "primary.ctx")
+	return err
+}
+
+// Seal seals "secret" to the TPM. If "pcrs" (see ParsePCRs) is not empty,
+// the TPM only unseals it while these PCRs have the values they have now.
+// The returned public and private parts of the sealed object can only be
+// loaded by this TPM.
+func Seal(secret []byte, pcrs string) (public []byte, private []byte, err error) {
+	dir, err := ioutil.TempDir("", "gocryptfs-tpm2-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err = createPrimary(dir); err != nil {
+		return nil, nil, err
+	}
+	args := []string{"-Q", "-C", "primary.ctx", "-g", "sha256", "-i", "-", "-u", "seal.pub", "-r", "seal.priv"}
+	if pcrs != "" {
+		if _, err = run(dir, nil, "tpm2_createpolicy", "-Q", "--policy-pcr", "-l", pcrs, "-L", "policy.dat"); err != nil {
+			return nil, nil, err
+		}
+		// Without "userwithauth", the policy is the only way to unseal
+		args = append(args, "-L", "policy.dat", "-a", "fixedtpm|fixedparent|noda")
+	} else {
+		args = append(args, "-a", "fixedtpm|fixedparent|userwithauth|noda")
+	}
+	if _, err = run(dir, secret, "tpm2_create", args...); err != nil {
+		return nil, nil, err
+	}
+	if public, err = ioutil.ReadFile(filepath.Join(dir, "seal.pub")); err != nil {
+		return nil, nil, err
+	}
+	if private, err = ioutil.ReadFile(filepath.Join(dir, "seal.priv")); err != nil {
+		return nil, nil, err
+	}
+	return public, private, nil
+}
+
+// Unseal returns the secret sealed by Seal. "pcrs" must be the same as for
+// Seal.
+func Unseal(public []byte, private []byte, pcrs string) (secret []byte, err error) {
+	dir, err := ioutil.TempDir("", "gocryptfs-tpm2-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "seal.pub"), public, 0600); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "seal.priv"), private, 0600); err != nil {
+		return nil, err
+	}
+	if err = createPrimary(dir); err != nil {
+		return nil, err
+	}
+	if _, err = run(dir, nil, "tpm2_load", "-Q", "-C", "primary.ctx", "-u", "seal.pub", "-r", "seal.priv",
+		"-c", "seal.ctx"); err != nil {
+		return nil, err
+	}
+	args := []string{"-Q", "-c", "seal.ctx"}
+	if pcrs != "" {
+		args = append(args, "-p", "pcr:"+pcrs)
+	}
+	return run(dir, nil, "tpm2_unseal", args...)
+}
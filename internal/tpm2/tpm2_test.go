@@ -0,0 +1,25 @@
+package tpm2
+
+import (
+	"testing"
+)
+
+func TestParsePCRs(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+		ok      bool
+	}{
+		{"", "", true},
+		{"7", "sha256:7", true},
+		{"0, 7,23", "sha256:0,7,23", true},
+		{"24", "", false},
+		{"-1", "", false},
+		{"0,,7", "", false},
+		{"sha1:0", "", false},
+	} {
+		out, err := ParsePCRs(tc.in)
+		if (err == nil) != tc.ok || out != tc.out {
+			t.Errorf("%q: want %q ok=%v, have %q %v", tc.in, tc.out, tc.ok, out, err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// newKeyEpoch handles "gocryptfs -new-key-epoch CIPHERDIR": new files are
+// encrypted with a new key from now on, existing files keep their key.
+// Does not return (calls os.Exit both on success and on error).
+func newKeyEpoch(args *argContainer) {
+	if args.masterkey != "" || args.zerokey {
+		// The new key is locked with the password
+		tlog.Fatal.Printf("-new-key-epoch needs the password and cannot be used with -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse {
+		tlog.Fatal.Printf("-new-key-epoch does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFlatLayout) {
+		// The blobs are not visible to -reencrypt
+		tlog.Fatal.Printf("-new-key-epoch does not work on filesystems created with -flat")
+		os.Exit(exitcodes.Usage)
+	}
+	pw, err := configPassword(args, cf)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	tlog.Info.Println("Decrypting master key")
+	masterkey, err := cf.DecryptMasterKey(pw)
+	hadKeySlots := cf.HasKeySlots()
+	if err == nil {
+		err = cf.AddKeyEpoch(masterkey, pw)
+	}
+	for i := range pw {
+		pw[i] = 0
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Key epoch %d added. New files are encrypted with its key."+tlog.ColorReset,
+		cf.KeyEpoch)
+	tlog.Info.Printf("Mounted filesystems keep using the old key until they are mounted again. " +
+		"The master key printed by -init only opens the files of epoch 0. " +
+		"Mount with -reencrypt to move the existing files to the new key in the background.")
+	if hadKeySlots {
+		tlog.Info.Printf("The -tpm2-enroll and -pkcs11-enroll key slots have been removed. Enroll them again to re-create them.")
+	}
+	os.Exit(0)
+}
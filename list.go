@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/moby/sys/mountinfo"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// mountEntry is a gocryptfs mount found in /proc/self/mountinfo
+type mountEntry struct {
+	mountpoint string
+	// source is what "df" shows in the first column. This is CIPHERDIR
+	// unless "-fsname" was used.
+	source  string
+	reverse bool
+	ro      bool
+}
+
+// gocryptfsMounts returns all gocryptfs mounts listed in
+// /proc/self/mountinfo.
+func gocryptfsMounts() ([]mountEntry, error) {
+	infos, err := mountinfo.GetMounts(mountinfo.FSTypeFilter("fuse.gocryptfs", "fuse.gocryptfs-reverse", "fuse.gocryptfs-encfs"))
+	if err != nil {
+		return nil, err
+	}
+	var mounts []mountEntry
+	for _, i := range infos {
+		m := mountEntry{
+			mountpoint: i.Mountpoint,
+			source:     i.Source,
+			reverse:    i.FSType == "fuse.gocryptfs-reverse",
+		}
+		// "ro" can be a mount option or a superblock option
+		for _, o := range strings.Split(i.Options+","+i.VFSOptions, ",") {
+			if o == "ro" {
+				m.ro = true
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// findCtlsocks returns the paths of the control sockets that the gocryptfs
+// processes we have access to listen on.
+func findCtlsocks() (socks []string) {
+	// Map socket inode numbers to the paths of listening unix sockets
+	paths := make(map[string]string)
+	f, err := os.Open("/proc/net/unix")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Num RefCount Protocol Flags Type St Inode Path
+		fields := strings.Fields(scanner.Text())
+		// Flag 0x10000 is __SO_ACCEPTCON, set for listening sockets
+		if len(fields) < 8 || fields[3] != "00010000" {
+			continue
+		}
+		paths[fields[6]] = fields[7]
+	}
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, proc := range procs {
+		comm, err := os.ReadFile(proc + "/comm")
+		if err != nil || strings.TrimSpace(string(comm)) != tlog.ProgramName {
+			continue
+		}
+		fds, _ := filepath.Glob(proc + "/fd/*")
+		for _, fd := range fds {
+			target, err := os.Readlink(fd)
+			if err != nil {
+				continue
+			}
+			// "socket:[12345]"
+			inode := strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")
+			if path, ok := paths[inode]; ok && inode != target {
+				socks = append(socks, path)
+			}
+		}
+	}
+	return socks
+}
+
+// queryInfo sends an Info request to the control socket "sock"
+func queryInfo(sock string) (*ctlsock.InfoStruct, error) {
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	resp, err := c.Query(&ctlsock.RequestStruct{Info: true})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Info == nil {
+		return nil, fmt.Errorf("%s: no Info in response", sock)
+	}
+	return resp.Info, nil
+}
+
+// ctlsockInfo is a control socket and the response to an Info request
+type ctlsockInfo struct {
+	sock string
+	info *ctlsock.InfoStruct
+}
+
+// ctlsockInfos queries the control sockets found by findCtlsocks() and
+// returns them indexed by mountpoint. The mountpoints have symlinks
+// resolved, like in /proc/self/mountinfo.
+func ctlsockInfos() map[string]ctlsockInfo {
+	infos := make(map[string]ctlsockInfo)
+	for _, sock := range findCtlsocks() {
+		info, err := queryInfo(sock)
+		if err != nil {
+			tlog.Debug.Printf("%s: %v", sock, err)
+			continue
+		}
+		infos[realPath(info.Mountpoint)] = ctlsockInfo{sock: sock, info: info}
+	}
+	return infos
+}
+
+// listMounts handles "gocryptfs -list". It prints all gocryptfs mounts.
+// The PID, uptime and idle time are only known for mounts that have a
+// "-ctlsock" we can access.
+func listMounts() int {
+	mounts, err := gocryptfsMounts()
+	if err != nil {
+		tlog.Fatal.Printf("-list: %v", err)
+		return exitcodes.Other
+	}
+	infos := ctlsockInfos()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MOUNTPOINT\tCIPHERDIR\tPID\tMODE\tUPTIME\tIDLE")
+	for _, m := range mounts {
+		cipherdir, pid, uptime, idle := m.source, "-", "-", "-"
+		if info := infos[m.mountpoint].info; info != nil {
+			cipherdir = info.Cipherdir
+			pid = strconv.Itoa(info.Pid)
+			uptime = time.Since(time.Unix(info.Started, 0)).Round(time.Second).String()
+			if info.LastAccess != 0 {
+				idle = time.Since(time.Unix(info.LastAccess, 0)).Round(time.Second).String()
+			}
+		}
+		mode := "rw"
+		if m.ro {
+			mode = "ro"
+		}
+		if m.reverse {
+			mode += ",reverse"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", m.mountpoint, cipherdir, pid, mode, uptime, idle)
+	}
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+// ctlsockUnlock returns the function that checks the password when a locked
+// filesystem is unlocked through the control socket, and creates new crypto
+// helpers with the master key. Like ctlsockChangePassword(), it reads the
+// config file again for every request. Returns nil if there is no password
+// that could unlock it, so that locking is refused.
+func ctlsockUnlock(args *argContainer, cryptoBackend cryptocore.AEADTypeEnum, IVBits int) fusefrontend.UnlockFunc {
+	if args._mountDefaultsKey == nil || args._mountConf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		// -masterkey, -zerokey, -fido2
+		return nil
+	}
+	return func(pw []byte) (*contentenc.ContentEnc, *nametransform.NameTransform, func(), error) {
+		cf, err := configfile.Load(args.config)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+			return nil, nil, nil, errors.New("unlocking is not supported on FIDO2-enabled filesystems")
+		}
+		masterkey, err := ctlsockDecryptMasterKey(args, cf, pw)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// The config file may have been replaced since the mount
+		if subtle.ConstantTimeCompare(cryptocore.MountDefaultsKey(masterkey), args._mountDefaultsKey) != 1 {
+			for i := range masterkey {
+				masterkey[i] = 0
+			}
+			return nil, nil, nil, errors.New("the config file does not contain the master key of this mount")
+		}
+		// Wipes masterkey
+		cCore, cEnc, nameTransform := newKeyCrypto(args, cf, masterkey, cryptoBackend, IVBits)
+		epochCores := initKeyEpochs(cf, cEnc, cryptoBackend, IVBits, cf.IsFeatureFlagSet(configfile.FlagHKDF))
+		wipe := func() {
+			cCore.Wipe()
+			for _, c := range epochCores {
+				c.Wipe()
+			}
+		}
+		return cEnc, nameTransform, wipe, nil
+	}
+}
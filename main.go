@@ -4,6 +4,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -15,9 +16,16 @@ import (
 
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/encfs"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/faultinject"
 	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_flat"
+	"github.com/rfjakob/gocryptfs/v2/internal/hybridkem"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/policy"
 	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/sandbox"
 	"github.com/rfjakob/gocryptfs/v2/internal/speed"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -31,25 +39,23 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 		tlog.Fatal.Printf("Cannot open config file: %v", err)
 		return nil, nil, err
 	}
+	cf.CacheDerivedKey(args.kdfcache)
 	// The user may have passed the master key on the command line (probably because
 	// he forgot the password).
 	masterkey = handleArgsMasterkey(args)
 	if masterkey != nil {
 		return masterkey, cf, nil
 	}
-	var pw []byte
-	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
-		if args.fido2 == "" {
-			tlog.Fatal.Printf("Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
-			return nil, nil, exitcodes.NewErr("", exitcodes.Usage)
-		}
-		pw = fido2.Secret(args.fido2, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
-	} else {
-		pw, err = readpassword.Once([]string(args.extpass), []string(args.passfile), "")
-		if err != nil {
-			tlog.Fatal.Println(err)
-			return nil, nil, exitcodes.NewErr("", exitcodes.ReadPassword)
-		}
+	if args.pkcs11 {
+		masterkey, err = unlockPKCS11(args, cf)
+		return masterkey, cf, err
+	}
+	if masterkey = unlockTPM2(args, cf); masterkey != nil {
+		return masterkey, cf, nil
+	}
+	pw, err := configPassword(args, cf)
+	if err != nil {
+		return nil, nil, err
 	}
 	tlog.Info.Println("Decrypting master key")
 	masterkey, err = cf.DecryptMasterKey(pw)
@@ -64,6 +70,58 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 	return masterkey, cf, nil
 }
 
+// unlockPQHybrid reads the "-pqkey" key file and decapsulates the secret
+// stored in the config file "cf". Does nothing if the filesystem has not
+// been created with "-pqkey".
+func unlockPQHybrid(args *argContainer, cf *configfile.ConfFile) error {
+	if !cf.IsFeatureFlagSet(configfile.FlagPQHybrid) {
+		return nil
+	}
+	if args.pqkey == "" {
+		tlog.Fatal.Printf("Masterkey protected by a -pqkey key file; need to use the -pqkey option.")
+		return exitcodes.NewErr("", exitcodes.Usage)
+	}
+	seed, err := hybridkem.ReadKeyFile(args.pqkey)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot read -pqkey key file: %v", err)
+		return exitcodes.NewErr("", exitcodes.PQKey)
+	}
+	err = cf.UnlockPQHybrid(seed)
+	for i := range seed {
+		seed[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return exitcodes.NewErr("", exitcodes.PQKey)
+	}
+	return nil
+}
+
+// configPassword unlocks the "-pqkey" secret of "cf" and returns the password,
+// or the FIDO2 secret, that decrypts its master key
+func configPassword(args *argContainer, cf *configfile.ConfFile) (pw []byte, err error) {
+	if err = unlockPQHybrid(args, cf); err != nil {
+		return nil, err
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		if args.fido2 == "" {
+			tlog.Fatal.Printf("Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
+			return nil, exitcodes.NewErr("", exitcodes.Usage)
+		}
+		return fido2.Secret(args.fido2, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt), nil
+	}
+	if args._password != nil {
+		// The caller wipes the password after use
+		return append([]byte(nil), args._password...), nil
+	}
+	pw, err = readpassword.Once([]string(args.extpass), []string(args.passfile), "")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return nil, exitcodes.NewErr("", exitcodes.ReadPassword)
+	}
+	return pw, nil
+}
+
 // changePassword - change the password of config file "filename"
 // Does not return (calls os.Exit both on success and on error).
 func changePassword(args *argContainer) {
@@ -82,6 +140,17 @@ func changePassword(args *argContainer) {
 			tlog.Fatal.Printf("Password change is not supported on FIDO2-enabled filesystems.")
 			os.Exit(exitcodes.Usage)
 		}
+		if args.masterkey != "" && confFile.KeyEpoch > 0 {
+			// The keys of the newer epochs can only be decrypted with the
+			// password
+			tlog.Fatal.Printf("The password of a filesystem with key epochs cannot be reset with -masterkey.")
+			os.Exit(exitcodes.Usage)
+		}
+		// With "-masterkey", loadConfig() has not looked at the key file yet,
+		// but EncryptKey() needs it.
+		if err = unlockPQHybrid(args, confFile); err != nil {
+			exitcodes.Exit(err)
+		}
 		tlog.Info.Println("Please enter your new password.")
 		newPw, err := readpassword.Twice([]string(args.extpass), []string(args.passfile))
 		if err != nil {
@@ -92,6 +161,24 @@ func changePassword(args *argContainer) {
 		if args._explicitScryptn {
 			logN = args.scryptn
 		}
+		if args._explicitScryptr {
+			confFile.ScryptObject.R = args.scryptr
+		}
+		if args._explicitScryptp {
+			confFile.ScryptObject.P = args.scryptp
+		}
+		if a := confFile.Argon2idObject; confFile.IsFeatureFlagSet(configfile.FlagArgon2id) {
+			if args._explicitArgon2idMemory {
+				a.Memory = uint32(args.argon2id_memory * 1024)
+			}
+			if args._explicitArgon2idTime {
+				a.Time = uint32(args.argon2id_time)
+			}
+			checkPasswordStrength(args, newPw, a.EquivalentLogN(),
+				fmt.Sprintf("-argon2id-memory=%d -argon2id-time=%d", a.Memory/1024, a.Time))
+		} else {
+			checkPasswordStrength(args, newPw, logN, fmt.Sprintf("-scryptn=%d", logN))
+		}
 		confFile.EncryptKey(masterkey, newPw, logN)
 		for i := range newPw {
 			newPw[i] = 0
@@ -138,9 +225,29 @@ func main() {
 	// Show microseconds in go-fuse debug output (-fusedebug)
 	log.SetFlags(log.Lmicroseconds)
 	var err error
+	// "gocryptfs completion SHELL"
+	if len(os.Args) >= 2 && os.Args[1] == "completion" {
+		os.Exit(completion(os.Args[2:]))
+	}
 	// Parse all command-line options (i.e. arguments starting with "-")
 	// into "args". Path arguments are parsed below.
-	args := parseCliOpts(os.Args)
+	osArgs := os.Args
+	args := parseCliOpts(osArgs)
+	// "-nodefaults": apply the defaults file and the environment variables
+	// unless disabled
+	if !args.nodefaults {
+		osArgs = prefixUserDefaults(osArgs)
+		args = parseCliOpts(osArgs)
+	}
+	// "-mount-defaults": apply the mount options saved in the config file
+	if flagSet.NArg() == 2 {
+		args = applyMountDefaults(args, osArgs)
+	}
+	// "-userns": mount in a new user and mount namespace. The forkChild()
+	// below then runs inside the namespace as well.
+	if args.userns && flagSet.NArg() == 2 && !inUserns() {
+		os.Exit(execUserns())
+	}
 	// Fork a child into the background if "-fg" is not set AND we are mounting
 	// a filesystem. The child will do all the work.
 	if !args.fg && flagSet.NArg() == 2 {
@@ -150,12 +257,32 @@ func main() {
 	if args.debug {
 		tlog.Debug.Enabled = true
 	}
+	// "-loglevel"
+	if args.loglevel != "" {
+		levels, err := tlog.ParseModuleLevels(args.loglevel)
+		if err == nil {
+			err = tlog.SetModuleLevels(levels)
+		}
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-loglevel\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	tlog.Debug.Printf("cli args: %q", os.Args)
+	// "-json"
+	if args.json && !args.version && !args.health && !args.changes && !args.fsck {
+		tlog.Fatal.Printf("-json only works together with -version, -health, -changes or -fsck")
+		os.Exit(exitcodes.Usage)
+	}
 	// "-v"
 	if args.version {
 		tlog.Debug.Printf("openssl=%v\n", args.openssl)
 		tlog.Debug.Printf("on-disk format %d\n", contentenc.CurrentVersion)
-		printVersion()
+		if args.json {
+			printVersionJSON()
+		} else {
+			printVersion()
+		}
 		os.Exit(0)
 	}
 	// "-hh"
@@ -173,6 +300,47 @@ func main() {
 		tlog.Warn.Wpanic = true
 		tlog.Debug.Printf("Panicking on warnings")
 	}
+	// "-unmount"
+	if args.unmount {
+		os.Exit(doUnmount(&args))
+	}
+	// "-list"
+	if args.list {
+		os.Exit(listMounts())
+	}
+	// "-health"
+	if args.health {
+		if args.seccomp {
+			// The watchdog talks to systemd over a socket
+			tlog.Fatal.Printf("-seccomp only works for mounting, and cannot be used together with -health")
+			os.Exit(exitcodes.Usage)
+		}
+		os.Exit(doHealth(&args))
+	}
+	// "-warmup"
+	if args.warmup {
+		os.Exit(doWarmup(&args))
+	}
+	// "-top"
+	if args.top {
+		os.Exit(doTop(&args))
+	}
+	// "-changes"
+	if args.since != "" && !args.changes {
+		tlog.Fatal.Printf("-since only works together with -changes")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.changes {
+		os.Exit(doChanges(&args))
+	}
+	// "-lock-subvolume", "-unlock-subvolume"
+	if args.lock_subvolume != "" || args.unlock_subvolume != "" {
+		os.Exit(doSubvolumeLock(&args))
+	}
+	// "-passwd -ctlsock"
+	if args.passwd && args.ctlsock != "" {
+		os.Exit(doPasswdCtlsock(&args))
+	}
 	// Every operation below requires CIPHERDIR. Exit if we don't have it.
 	if flagSet.NArg() == 0 {
 		if flagSet.NFlag() == 0 {
@@ -192,10 +360,388 @@ func main() {
 		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
 		os.Exit(exitcodes.CipherDir)
 	}
+	// "-union"
+	checkUnionArgs(&args)
+	// "-encfs"
+	if args.encfs {
+		if args.reverse || len(args.union) > 0 || countOpFlags(&args) > 0 ||
+			args.masterkey != "" || args.zerokey || args.ctlsock != "" || args.idle > 0 {
+			tlog.Fatal.Printf("-encfs only works for mounting, and cannot be used together with " +
+				"-reverse, -union, -masterkey, -zerokey, -ctlsock or -idle")
+			os.Exit(exitcodes.Usage)
+		}
+		// EncFS volumes are always mounted read-only
+		args.ro = true
+	}
+	// "-rescue"
+	if args.rescue {
+		if args.masterkey == "" || args.reverse || len(args.union) > 0 || countOpFlags(&args) > 0 ||
+			args.replica != "" || args.encfs || args.rw {
+			tlog.Fatal.Printf("-rescue only works for mounting with -masterkey, and cannot be used together " +
+				"with -reverse, -union, -replica, -encfs or -rw")
+			os.Exit(exitcodes.Usage)
+		}
+		// Never write to a damaged CIPHERDIR
+		args.ro = true
+	}
+	// "-append_only"
+	if args.append_only && args.reverse {
+		tlog.Fatal.Printf("-append_only does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-notify"
+	if args.notify && args.reverse {
+		tlog.Fatal.Printf("-notify does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-max_size", "-max_file_size"
+	if (args.max_size > 0 || args.max_file_size > 0) && args.reverse {
+		tlog.Fatal.Printf("-max_size and -max_file_size do not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-replica"
+	if args.replica != "" {
+		if args.reverse || len(args.union) > 0 {
+			tlog.Fatal.Printf("-replica cannot be used together with -reverse or -union")
+			os.Exit(exitcodes.Usage)
+		}
+		args.replica, _ = filepath.Abs(args.replica)
+		if err = isDir(args.replica); err != nil {
+			tlog.Fatal.Printf("Invalid -replica: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+	}
+	// "-cachedir"
+	if args.cachedir != "" {
+		if args.reverse || args.sharedstorage {
+			tlog.Fatal.Printf("-cachedir cannot be used together with -reverse or -sharedstorage")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.cachesize <= 0 {
+			tlog.Fatal.Printf("-cachesize must be greater than 0")
+			os.Exit(exitcodes.Usage)
+		}
+		args.cachedir, _ = filepath.Abs(args.cachedir)
+		if err = isDir(args.cachedir); err != nil {
+			tlog.Fatal.Printf("Invalid -cachedir: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-cachemem"
+	if args.cachemem <= 0 {
+		tlog.Fatal.Printf("-cachemem must be greater than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-threads", "-max_background", "-write_threads", "-max_queue"
+	if args.threads < 0 || args.max_background < 0 || args.write_threads < 0 || args.max_queue < 0 {
+		tlog.Fatal.Printf("-threads, -max_background, -write_threads and -max_queue must not be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.max_background > maxBackgroundLimit {
+		tlog.Fatal.Printf("-max_background must be at most %d", maxBackgroundLimit)
+		os.Exit(exitcodes.Usage)
+	}
+	// "-journal"
+	if args.journal && (args.reverse || args.sharedstorage || args.ro || len(args.union) > 0) {
+		tlog.Fatal.Printf("-journal cannot be used together with -reverse, -sharedstorage, -ro or -union")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-auditlog"
+	if args.auditlog && (args.reverse || args.sharedstorage || args.ro || len(args.union) > 0) {
+		tlog.Fatal.Printf("-auditlog cannot be used together with -reverse, -sharedstorage, -ro or -union")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-label", "-description"
+	if (args.label != "" || args.description != "") && !args.init {
+		tlog.Fatal.Printf("-label and -description only work together with -init")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-wizard"
+	if args.wizard {
+		if !args.init || args.reverse {
+			tlog.Fatal.Printf("-wizard only works together with -init, and not in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.plaintextnames || args.aessiv || args.xchacha || args.aegis || args.aes128 ||
+			args.hctr2 || args.deterministic_names || args.merkle || args.bindpath || args.flat ||
+			args.longnamemax != 255 || args.longnamehash != nametransform.LongNameHashSHA256 {
+			tlog.Fatal.Printf("-wizard picks the encryption and file name options itself and cannot be used " +
+				"together with them")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-scryptn", "-scryptr", "-scryptp"
+	if args.scryptn < 10 || args.scryptn > 28 {
+		tlog.Fatal.Printf("-scryptn: possible values are 10-28")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.scryptr < 8 || args.scryptr > 32 {
+		tlog.Fatal.Printf("-scryptr: possible values are 8-32")
+		os.Exit(exitcodes.Usage)
+	}
+	if uint64(128*args.scryptr)<<uint(args.scryptn) > 1<<38 {
+		tlog.Fatal.Printf("-scryptn=%d with -scryptr=%d needs more than 256 GiB of memory", args.scryptn, args.scryptr)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.scryptp < 1 || args.scryptp > 64 {
+		tlog.Fatal.Printf("-scryptp: possible values are 1-64")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-argon2id"
+	if args.argon2id && !args.init {
+		tlog.Fatal.Printf("-argon2id only works together with -init")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args._explicitArgon2idMemory || args._explicitArgon2idTime) && !args.argon2id && !args.passwd {
+		tlog.Fatal.Printf("-argon2id-memory and -argon2id-time only work together with -argon2id or -passwd")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.argon2id_memory < 1 || args.argon2id_memory > 4*1024*1024-1 || args.argon2id_time < 1 {
+		tlog.Fatal.Printf("-argon2id-memory: possible values are 1-4194303, -argon2id-time: 1 or more")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-tpm2-pcrs"
+	if args.tpm2_pcrs != "" && !args.tpm2_enroll {
+		tlog.Fatal.Printf("-tpm2-pcrs only works together with -tpm2-enroll")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-pkcs11-id", "-pkcs11"
+	if args.pkcs11_id != "" && args.pkcs11_enroll == "" {
+		tlog.Fatal.Printf("-pkcs11-id only works together with -pkcs11-enroll")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.pkcs11 && (args.init || args.fido2 != "") {
+		tlog.Fatal.Printf("-pkcs11 cannot be used together with -init or -fido2")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-repair"
+	if args.repair && !args.fsck {
+		tlog.Fatal.Printf("-repair only works together with -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-merkle"
+	if args.merkle && (!args.init && args.masterkey == "" && !args.zerokey || args.reverse) {
+		tlog.Fatal.Printf("-merkle only works together with -init, -masterkey or -zerokey, and not in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-bindpath"
+	if args.bindpath {
+		if !args.init && args.masterkey == "" && !args.zerokey {
+			tlog.Fatal.Printf("-bindpath only works together with -init, -masterkey or -zerokey")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse || args.plaintextnames || args.deterministic_names {
+			tlog.Fatal.Printf("-bindpath needs gocryptfs.diriv files and cannot be used together with -reverse, -plaintextnames or -deterministic-names")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-worm"
+	if args.worm {
+		if !args.init && args.masterkey == "" && !args.zerokey {
+			tlog.Fatal.Printf("-worm only works together with -init, -masterkey or -zerokey")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-worm does not work in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-immutable"
+	if args.immutable {
+		if !args.init && args.masterkey == "" && !args.zerokey {
+			tlog.Fatal.Printf("-immutable only works together with -init, -masterkey or -zerokey")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-immutable does not work in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-container" and "-size"
+	if args.container != "" || args.size > 0 {
+		if !args.init || args.container == "" || args.size == 0 {
+			tlog.Fatal.Printf("-container and -size only work together, and together with -init")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.image != "" || args.image_size > 0 {
+			tlog.Fatal.Printf("-container cannot be used together with -image or -image_size")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.size < fusefrontend_flat.MinImageSize {
+			tlog.Fatal.Printf("-size: the minimum is %d bytes", fusefrontend_flat.MinImageSize)
+			os.Exit(exitcodes.Usage)
+		}
+		args.flat = true
+	}
+	// "-flat"
+	if args.flat {
+		if !args.init && args.masterkey == "" && !args.zerokey {
+			tlog.Fatal.Printf("-flat only works together with -init, -masterkey or -zerokey")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse || args.plaintextnames || args.deterministic_names || args.merkle || args.bindpath || args.worm ||
+			args.immutable {
+			tlog.Fatal.Printf("-flat cannot be used together with -reverse, -plaintextnames, -deterministic-names, " +
+				"-merkle, -bindpath, -worm or -immutable")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-image" and "-image_size"
+	if args.image != "" || args.image_size > 0 {
+		if !args.init || !args.flat {
+			tlog.Fatal.Printf("-image and -image_size only work together with -init -flat")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.image != "" && args.image_size > 0 {
+			tlog.Fatal.Printf("-image and -image_size cannot be used together")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.image_size > 0 && args.image_size < fusefrontend_flat.MinImageSize {
+			tlog.Fatal.Printf("-image_size: the minimum is %d bytes", fusefrontend_flat.MinImageSize)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.worm_retention > 0 && !args.worm {
+		tlog.Fatal.Printf("-worm-retention only works together with -worm")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-hctr2"
+	if args.hctr2 && args.plaintextnames {
+		tlog.Fatal.Printf("-hctr2 cannot be used together with -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-longnamehash"
+	if args.longnamehash == nametransform.LongNameHashBLAKE3 && args.plaintextnames {
+		tlog.Fatal.Printf("-longnamehash=blake3 cannot be used together with -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-manifest", "-manifest_anchor"
+	if args.manifest && (args.reverse || args.sharedstorage || args.ro || len(args.union) > 0) {
+		tlog.Fatal.Printf("-manifest cannot be used together with -reverse, -sharedstorage, -ro or -union")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.manifest_anchor != "" {
+		if !args.manifest && !args.fsck {
+			tlog.Fatal.Printf("-manifest_anchor only works together with -manifest or -fsck")
+			os.Exit(exitcodes.Usage)
+		}
+		// We cd to / when daemonizing
+		args.manifest_anchor, _ = filepath.Abs(args.manifest_anchor)
+	}
+	// "-sync", "-fsync_on_close", "-fsync_interval"
+	if (args.sync || args.fsync_on_close || args.fsync_interval > 0) && args.reverse {
+		tlog.Fatal.Printf("-sync, -fsync_on_close and -fsync_interval do not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-reencrypt"
+	if args.reencrypt && (args.reverse || args.sharedstorage || args.ro || len(args.union) > 0) {
+		tlog.Fatal.Printf("-reencrypt cannot be used together with -reverse, -sharedstorage, -ro or -union")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-noatime", "-relatime"
+	if args.noatime && args.relatime {
+		tlog.Fatal.Printf("-noatime and -relatime cannot be used together")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.noatime || args.relatime) && args.reverse {
+		tlog.Fatal.Printf("-noatime and -relatime do not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-io_timeout"
+	if args.io_timeout > 0 && args.reverse {
+		tlog.Fatal.Printf("-io_timeout does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-fault_inject"
+	if args.fault_inject != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("-fault_inject does not work in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		args._faults, err = faultinject.Parse(args.fault_inject)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-fault_inject\" specification: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		tlog.Info.Printf("Injecting faults into backing storage accesses: %s", args.fault_inject)
+	}
+	// "-unlock"
+	if len(args.unlock) > 0 && (args.reverse || len(args.union) > 0) {
+		tlog.Fatal.Printf("-unlock cannot be used together with -reverse or -union")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-sandbox-user"
+	if args.sandbox_user != "" {
+		if os.Getuid() != 0 {
+			tlog.Fatal.Printf("-sandbox-user only works when running as root")
+			os.Exit(exitcodes.Usage)
+		}
+		// These keep using paths outside of CIPHERDIR, or need root to
+		// unmount
+		if len(args.union) > 0 || args.replica != "" || args.cachedir != "" || args.journal ||
+			args.fsync_interval > 0 || args.ctlsock != "" || args.idle > 0 || args.manifest {
+			tlog.Fatal.Printf("-sandbox-user cannot be used together with -union, -replica, -cachedir, " +
+				"-journal, -fsync_interval, -ctlsock, -idle or -manifest")
+			os.Exit(exitcodes.Usage)
+		}
+		args._sandboxUid, args._sandboxGid, err = sandbox.LookupUser(args.sandbox_user)
+		if err != nil {
+			tlog.Fatal.Printf("-sandbox-user: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-context", "-fscontext", "-defcontext", "-rootcontext"
+	for _, c := range []string{args.context, args.fscontext, args.defcontext, args.rootcontext} {
+		// go-fuse cannot pass commas inside a mount option
+		if strings.Contains(c, ",") {
+			tlog.Fatal.Printf("SELinux context %q contains a comma. Write category sets as ranges, "+
+				"like \"c0.c3\" instead of \"c0,c1,c2,c3\"", c)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	// "-q"
 	if args.quiet {
 		tlog.Info.Enabled = false
 	}
+	// "-aegis"
+	if args.aegis && (args.xchacha || args.aessiv || args.reverse) {
+		tlog.Fatal.Printf("-aegis cannot be used together with -xchacha, -aessiv or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-aes128"
+	if args.aes128 && (args.xchacha || args.aessiv || args.aegis || args.reverse) {
+		tlog.Fatal.Printf("-aes128 cannot be used together with -xchacha, -aessiv, -aegis or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-pqkey"
+	if args.pqkey != "" {
+		if !hybridkem.Supported {
+			tlog.Fatal.Printf("-pqkey is not supported by this build, it needs Go 1.24 or later")
+			os.Exit(exitcodes.Usage)
+		}
+		args.pqkey, err = filepath.Abs(args.pqkey)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-pqkey\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-export-fscrypt", "-fscrypt-key"
+	if (args.export_fscrypt != "") != (args.fscrypt_key != "") {
+		tlog.Fatal.Printf("-export-fscrypt and -fscrypt-key must be used together")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.export_fscrypt != "" {
+		args.export_fscrypt, _ = filepath.Abs(args.export_fscrypt)
+		args.fscrypt_key, _ = filepath.Abs(args.fscrypt_key)
+	}
+	// "-verify"
+	if args.verify != "" {
+		args.verify, _ = filepath.Abs(args.verify)
+	}
+	// "-downgrade"
+	if args.downgrade != "" {
+		args.downgrade, _ = filepath.Abs(args.downgrade)
+	}
 	// "-reverse" implies "-aessiv"
 	if args.reverse {
 		args.aessiv = true
@@ -205,6 +751,18 @@ func main() {
 			os.Exit(exitcodes.ExcludeError)
 		}
 	}
+	// "-policy"
+	if args.policy != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("-policy does not work in reverse mode")
+			os.Exit(exitcodes.PolicyError)
+		}
+		args._policy, err = policy.Load(args.policy)
+		if err != nil {
+			tlog.Fatal.Printf("Invalid \"-policy\" file: %v", err)
+			os.Exit(exitcodes.PolicyError)
+		}
+	}
 	// "-config"
 	if args.config != "" {
 		args.config, err = filepath.Abs(args.config)
@@ -216,6 +774,8 @@ func main() {
 		args._configCustom = true
 	} else if args.reverse {
 		args.config = filepath.Join(args.cipherdir, configfile.ConfReverseName)
+	} else if args.encfs {
+		args.config = filepath.Join(args.cipherdir, encfs.ConfDefaultName)
 	} else {
 		args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
 	}
@@ -273,11 +833,11 @@ func main() {
 		return
 	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck, -export-fscrypt, -mount-defaults, -new-key-epoch, -make-readonly, -compact, -verify, -migrate-config, -downgrade, -add-subvolume, -tpm2-enroll, -tpm2-remove, -pkcs11-enroll, -pkcs11-remove, -rekey is allowed")
 		os.Exit(exitcodes.Usage)
 	}
 	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck, -export-fscrypt, -mount-defaults, -new-key-epoch, -make-readonly, -compact, -verify, -migrate-config, -downgrade, -add-subvolume, -tpm2-enroll, -tpm2-remove, -pkcs11-enroll, -pkcs11-remove, -rekey take exactly one argument, %d given",
 			flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
@@ -301,4 +861,61 @@ func main() {
 		code := fsck(&args)
 		os.Exit(code)
 	}
+	// "-export-fscrypt"
+	if args.export_fscrypt != "" {
+		code := exportFscrypt(&args)
+		os.Exit(code)
+	}
+	// "-verify"
+	if args.verify != "" {
+		code := verify(&args)
+		os.Exit(code)
+	}
+	// "-downgrade"
+	if args.downgrade != "" {
+		code := downgrade(&args)
+		os.Exit(code)
+	}
+	// "-mount-defaults"
+	if args._mountDefaults {
+		setMountDefaults(&args)
+	}
+	// "-new-key-epoch"
+	if args.new_key_epoch {
+		newKeyEpoch(&args)
+	}
+	// "-make-readonly"
+	if args.make_readonly {
+		makeReadOnly(&args)
+	}
+	// "-compact"
+	if args.compact {
+		compactContainer(&args)
+	}
+	// "-migrate-config"
+	if args.migrate_config {
+		migrateConfig(&args)
+	}
+	// "-add-subvolume"
+	if args.add_subvolume != "" {
+		addSubvolume(&args)
+	}
+	// "-tpm2-enroll", "-tpm2-remove"
+	if args.tpm2_enroll {
+		tpm2Enroll(&args)
+	}
+	if args.tpm2_remove {
+		tpm2Remove(&args)
+	}
+	// "-pkcs11-enroll", "-pkcs11-remove"
+	if args.pkcs11_enroll != "" {
+		pkcs11Enroll(&args)
+	}
+	if args.pkcs11_remove {
+		pkcs11Remove(&args)
+	}
+	// "-rekey"
+	if args.rekey {
+		os.Exit(rekey(&args))
+	}
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/dirlock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/journal"
+	"github.com/rfjakob/gocryptfs/v2/internal/manifest"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// manifestInterval is how often "-manifest" is updated while mounted
+const manifestInterval = 10 * time.Minute
+
+// manifestSkip lists the files in the root of CIPHERDIR that change without
+// going through the filesystem and are left out of the manifest
+var manifestSkip = []string{configfile.ConfDefaultName, dirlock.FileName, journal.DirName}
+
+// manifestKeeper implements "-manifest": it checks the manifest at mount
+// time and keeps it up to date.
+type manifestKeeper struct {
+	cipherdir string
+	key       []byte
+	// anchor is the "-manifest_anchor" path or ""
+	anchor string
+	// mu serializes updates
+	mu sync.Mutex
+	// cur is the last manifest written, nil if there was none
+	cur  *manifest.Manifest
+	stop chan struct{}
+}
+
+// loadManifest loads the manifest of CIPHERDIR and checks it against the
+// "-manifest_anchor" file. A missing manifest is not an error unless the
+// anchor says there should be one.
+func loadManifest(args *argContainer) (*manifest.Manifest, error) {
+	m, err := manifest.Load(args.cipherdir, args._manifestKey)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if args.manifest_anchor == "" {
+		return m, nil
+	}
+	a, err := manifest.ReadAnchor(args.manifest_anchor)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = manifest.CheckAnchor(m, a); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// openManifest checks the manifest of CIPHERDIR and exits if it has been
+// tampered with or rolled back
+func openManifest(args *argContainer) *manifestKeeper {
+	m, err := loadManifest(args)
+	if err != nil {
+		tlog.Fatal.Printf("-manifest: %v", err)
+		os.Exit(exitcodes.Manifest)
+	}
+	if m != nil {
+		// Catch changes that were made while we were not mounted
+		cur, err := manifest.Build(args.cipherdir, manifestSkip, m)
+		if err != nil {
+			tlog.Fatal.Printf("-manifest: %v", err)
+			os.Exit(exitcodes.Manifest)
+		}
+		if diffs := manifest.Diff(m, cur); len(diffs) > 0 {
+			for _, d := range diffs {
+				tlog.Fatal.Printf("-manifest: %s", d)
+			}
+			tlog.Fatal.Printf("-manifest: CIPHERDIR has been changed since the last unmount. " +
+				"Run -fsck to see all differences, or delete the manifest to accept them.")
+			os.Exit(exitcodes.Manifest)
+		}
+	}
+	return &manifestKeeper{
+		cipherdir: args.cipherdir,
+		key:       args._manifestKey,
+		anchor:    args.manifest_anchor,
+		cur:       m,
+		stop:      make(chan struct{}),
+	}
+}
+
+// update writes a new manifest and anchor
+func (k *manifestKeeper) update() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	m, err := manifest.Build(k.cipherdir, manifestSkip, k.cur)
+	if err != nil {
+		return err
+	}
+	if k.cur != nil {
+		m.Generation = k.cur.Generation + 1
+	}
+	if err = m.Save(k.cipherdir, k.key); err != nil {
+		return err
+	}
+	if k.anchor != "" {
+		if err = manifest.WriteAnchor(k.anchor, m); err != nil {
+			return err
+		}
+	}
+	k.cur = m
+	return nil
+}
+
+// run updates the manifest every manifestInterval until close() is called
+func (k *manifestKeeper) run() {
+	t := time.NewTicker(manifestInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := k.update(); err != nil {
+				tlog.Warn.Printf("-manifest: update failed: %v", err)
+			}
+		case <-k.stop:
+			return
+		}
+	}
+}
+
+// close stops run() and writes the final manifest. Call it after unmount.
+func (k *manifestKeeper) close() {
+	close(k.stop)
+	if err := k.update(); err != nil {
+		tlog.Warn.Printf("-manifest: final update failed: %v", err)
+	}
+}
+
+// verifyManifest compares CIPHERDIR with its manifest and returns the
+// differences. The manifest is not required unless there is an anchor.
+func verifyManifest(args *argContainer) (diffs []string, m *manifest.Manifest, err error) {
+	m, err = loadManifest(args)
+	if err != nil || m == nil {
+		return nil, nil, err
+	}
+	// Hash everything instead of trusting the recorded mtimes
+	cur, err := manifest.Build(args.cipherdir, manifestSkip, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", manifest.FileName, err)
+	}
+	return manifest.Diff(m, cur), m, nil
+}
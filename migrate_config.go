@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// migrateConfig handles "gocryptfs -migrate-config CIPHERDIR": it writes the
+// schema upgrades that configfile.Load() applies in memory back to the
+// config file, after making a backup copy.
+// Does not return (calls os.Exit both on success and on error).
+func migrateConfig(args *argContainer) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	steps := cf.Migrations()
+	if len(steps) == 0 {
+		tlog.Info.Printf("The config file has the current schema %d already.", configfile.CurrentSchema)
+		os.Exit(0)
+	}
+	for _, s := range steps {
+		tlog.Info.Printf("Migrating %s", s)
+	}
+	bak := args.config + ".bak"
+	if err = os.Link(args.config, bak); err != nil {
+		tlog.Fatal.Printf("Could not create backup file: %v", err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Config file migrated to schema %d."+tlog.ColorReset, configfile.CurrentSchema)
+	tlog.Info.Printf(tlog.ColorGrey+
+		"A copy of the old config file has been created at %q.\n"+
+		"Delete it after you have verified that you can mount the filesystem."+
+		tlog.ColorReset, bak)
+	os.Exit(0)
+}
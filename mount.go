@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"log"
 	"log/syslog"
 	"math"
@@ -23,15 +24,24 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/aegis"
+	"github.com/rfjakob/gocryptfs/v2/internal/auditlog"
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/dirlock"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/v2/internal/fuselimit"
+	"github.com/rfjakob/gocryptfs/v2/internal/merkle"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/v2/internal/resources"
+	"github.com/rfjakob/gocryptfs/v2/internal/rootsquash"
+	"github.com/rfjakob/gocryptfs/v2/internal/sandbox"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -41,6 +51,71 @@ type AfterUnmounter interface {
 	AfterUnmount()
 }
 
+// Shutdowner is implemented by filesystems that want to prepare for
+// unmounting when we get SIGTERM or SIGINT.
+type Shutdowner interface {
+	Shutdown()
+}
+
+// Chrooter is implemented by filesystems that keep working after we have
+// chrooted into CIPHERDIR ("-sandbox-user").
+type Chrooter interface {
+	Chrooted()
+}
+
+// shutdownTimeout is how long handleSigint() waits for open files to be
+// closed before it falls back to lazy unmount.
+const shutdownTimeout = 10 * time.Second
+
+// lockTimeout is how long doMount() waits for the CIPHERDIR lock held by
+// another gocryptfs process
+const lockTimeout = time.Second
+
+// maxBackgroundLimit is the largest "-max_background". The FUSE protocol
+// carries it in 16 bits.
+const maxBackgroundLimit = math.MaxUint16
+
+// fuseThreads returns "-threads", or the auto-detected value: 8 requests per
+// CPU, but at least 16. Requests spend most of their time waiting for the
+// backing storage, so there should be more of them than CPUs, but not so
+// many that they overwhelm a small machine.
+func fuseThreads(args *argContainer) int {
+	if args.threads > 0 {
+		return args.threads
+	}
+	n := 8 * runtime.NumCPU()
+	if n < 16 {
+		n = 16
+	}
+	return n
+}
+
+// fuseMaxBackground returns "-max_background", or the auto-detected value:
+// 4 per CPU, between the go-fuse default of 12 and 256. The kernel stops
+// queueing readahead and other asynchronous requests when this many are in
+// flight, and considers the filesystem congested at 3/4 of it.
+func fuseMaxBackground(args *argContainer) int {
+	if args.max_background > 0 {
+		return args.max_background
+	}
+	n := 4 * runtime.NumCPU()
+	if n < 12 {
+		n = 12
+	} else if n > 256 {
+		n = 256
+	}
+	return n
+}
+
+// checkReservedNames exits if a user file in the root of "dir" has a name
+// that gocryptfs uses internally. Only possible with "-plaintextnames".
+func checkReservedNames(dir string) {
+	if err := fusefrontend.CheckReservedNames(dir); err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.ReservedName)
+	}
+}
+
 // doMount mounts an encrypted directory.
 // Called from main.
 func doMount(args *argContainer) {
@@ -51,19 +126,58 @@ func doMount(args *argContainer) {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
 	}
+	// Compare the paths with symlinks resolved, so that "/home/user/.cipher"
+	// also overlaps with "/home/user/link-to-.cipher".
+	realMountpoint := realPath(args.mountpoint)
+	realCipherdir := realPath(args.cipherdir)
 	// We cannot mount "/home/user/.cipher" at "/home/user" because the mount
 	// will hide ".cipher" also for us.
-	if args.cipherdir == args.mountpoint || strings.HasPrefix(args.cipherdir, args.mountpoint+"/") {
+	if isSubdir(realCipherdir, realMountpoint) {
 		tlog.Fatal.Printf("Mountpoint %q would shadow cipherdir %q, this is not supported",
 			args.mountpoint, args.cipherdir)
 		os.Exit(exitcodes.MountPoint)
 	}
-	// Reverse-mounting "/foo" at "/foo/mnt" means we would be recursively
-	// encrypting ourselves.
-	if strings.HasPrefix(args.mountpoint, args.cipherdir+"/") {
-		tlog.Fatal.Printf("Mountpoint %q is contained in cipherdir %q, this is not supported",
-			args.mountpoint, args.cipherdir)
-		os.Exit(exitcodes.MountPoint)
+	for _, dir := range args.union {
+		realDir := realPath(dir)
+		if isSubdir(realDir, realMountpoint) || isSubdir(realMountpoint, realDir) {
+			tlog.Fatal.Printf("Mountpoint %q overlaps -union cipherdir %q, this is not supported",
+				args.mountpoint, dir)
+			os.Exit(exitcodes.MountPoint)
+		}
+	}
+	if isSubdir(realMountpoint, realCipherdir) {
+		// Reverse-mounting "/foo" at "/foo/mnt" means we would be recursively
+		// encrypting ourselves.
+		if args.reverse {
+			tlog.Fatal.Printf("Mountpoint %q is contained in cipherdir %q, this is not supported",
+				args.mountpoint, args.cipherdir)
+			os.Exit(exitcodes.MountPoint)
+		}
+		// In forward mode, the mountpoint shows up inside the mount as a
+		// file with an undecryptable name.
+		if !args.force {
+			tlog.Fatal.Printf("Mountpoint %q is contained in cipherdir %q. Use -force to mount anyway.",
+				args.mountpoint, args.cipherdir)
+			os.Exit(exitcodes.MountPoint)
+		}
+		// Updating the manifest would walk into our own mount
+		if args.manifest {
+			tlog.Fatal.Printf("Mountpoint %q is contained in cipherdir %q, this is not supported with -manifest",
+				args.mountpoint, args.cipherdir)
+			os.Exit(exitcodes.MountPoint)
+		}
+	}
+	if args.create_mountpoint {
+		// Only the last path component is created. The mountpoint is private
+		// until the filesystem is mounted on top of it.
+		err = os.Mkdir(args.mountpoint, 0700)
+		if err == nil {
+			args._createdMountpoint = true
+			defer removeMountpoint(args)
+		} else if !os.IsExist(err) {
+			tlog.Fatal.Printf("Could not create mountpoint: %v", err)
+			os.Exit(exitcodes.MountPoint)
+		}
 	}
 	if args.nonempty {
 		err = isDir(args.mountpoint)
@@ -74,6 +188,9 @@ func doMount(args *argContainer) {
 		// and `drop_privileges` in `man mount.fuse3` for background.
 	} else {
 		err = isEmptyDir(args.mountpoint)
+		if err != nil && isDir(args.mountpoint) == nil {
+			err = fmt.Errorf("%v. Use -nonempty to mount over it anyway", err)
+		}
 		// OSXFuse will create the mountpoint for us ( https://github.com/rfjakob/gocryptfs/issues/194 )
 		if runtime.GOOS == "darwin" && os.IsNotExist(err) {
 			tlog.Info.Printf("Mountpoint %q does not exist, but should be created by OSXFuse",
@@ -85,6 +202,41 @@ func doMount(args *argContainer) {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
 	}
+	// An empty gocryptfs filesystem that is already mounted passes the
+	// check above. Mounting on top of it hides it, which is hardly ever
+	// intended.
+	if !args.force && !strings.HasPrefix(args.mountpoint, "/dev/fd/") && isMountpoint(args.mountpoint) {
+		tlog.Fatal.Printf("Mountpoint %q is already a mountpoint of another filesystem. Use -force to mount on top of it.",
+			args.mountpoint)
+		os.Exit(exitcodes.MountPoint)
+	}
+	if !args.reverse {
+		for _, dir := range append([]string{args.cipherdir}, args.union...) {
+			checkReservedNames(dir)
+		}
+	}
+	// An interrupted "-rekey" has moved part of the files to the new key
+	if _, err := os.Stat(filepath.Join(args.cipherdir, fusefrontend.RekeyDirName)); err == nil && !args.reverse {
+		tlog.Fatal.Printf("-rekey has been interrupted. Run it again to complete it before mounting.")
+		os.Exit(exitcodes.Rekey)
+	}
+	// Two read-write mounts of the same CIPHERDIR corrupt it. Check before
+	// asking the user for the password.
+	if !args.ro && !args.reverse && !args.sharedstorage && !args.force {
+		for _, dir := range append([]string{args.cipherdir}, args.union...) {
+			lock, err := dirlock.Lock(dir, lockTimeout)
+			if err == syscall.EWOULDBLOCK {
+				tlog.Fatal.Printf("%s is already mounted read-write by another gocryptfs process. "+
+					"Use -ro to mount it read-only, or -sharedstorage if this is intended.", dir)
+				os.Exit(exitcodes.Locked)
+			} else if err != nil {
+				// For example, a read-only CIPHERDIR
+				tlog.Info.Printf("Could not lock %s: %v", dir, err)
+				continue
+			}
+			defer lock.Unlock()
+		}
+	}
 	// Open control socket early so we can error out before asking the user
 	// for the password
 	if args.ctlsock != "" {
@@ -106,10 +258,23 @@ func doMount(args *argContainer) {
 			}
 		}()
 	}
+	// SIGHUP and ctlsock Reload requests are served once we are mounted
+	args._reloader = newReloader(args)
 	// Initialize gocryptfs (read config file, ask for password, ...)
 	fs, wipeKeys := initFuseFrontend(args)
 	// Try to wipe secret keys from memory after unmount
 	defer wipeKeys()
+	// "-manifest": check for tampering before anything changes
+	var mk *manifestKeeper
+	if args.manifest {
+		mk = openManifest(args)
+	}
+	// "-cgroup", "-memory_max", "-cpu_max": after the key derivation,
+	// which needs a lot of memory for a short time, but before the mount
+	if err = resources.Apply(args.cgroup, args.memory_max, args.cpu_max); err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.Resources)
+	}
 	// Initialize go-fuse FUSE server
 	srv := initGoFuse(fs, args)
 	if x, ok := fs.(AfterUnmounter); ok {
@@ -117,6 +282,10 @@ func doMount(args *argContainer) {
 	}
 
 	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
+	if inUserns() {
+		tlog.Info.Printf("The filesystem is only visible inside our user namespace. Enter it with:\n"+
+			"  nsenter --target %d --user --mount --preserve-credentials", os.Getpid())
+	}
 	// We have been forked into the background, as evidenced by the set
 	// "notifypid".
 	// Do what daemons should do: https://man7.org/linux/man-pages/man7/daemon.7.html
@@ -148,21 +317,110 @@ func doMount(args *argContainer) {
 	// Increase the open file limit to 4096. This is not essential, so do it after
 	// we have switched to syslog and don't bother the user with warnings.
 	setOpenFileLimit()
+	// "-sandbox-user": as we chroot, this must happen after we have
+	// switched to syslog. initGoFuse() has left serving requests to us.
+	if args.sandbox_user != "" {
+		if err = dropPrivileges(fs, args); err != nil {
+			tlog.Fatal.Printf("-sandbox-user: %v", err)
+			unmount(srv, args.mountpoint)
+			os.Exit(exitcodes.Sandbox)
+		}
+		// No srv.WaitMount(): its poll hack opens a file in the mountpoint,
+		// which is outside of the chroot. The hack prevents a deadlock when
+		// we access our own mount, which we cannot do any more anyway.
+		go srv.Serve()
+	}
+	// "-seccomp"
+	if args.seccomp {
+		if err = sandbox.Seccomp(args.notify); err != nil {
+			tlog.Fatal.Printf("-seccomp: %v", err)
+			unmount(srv, args.mountpoint)
+			os.Exit(exitcodes.Sandbox)
+		}
+	}
 	// Wait for SIGINT in the background and unmount ourselves if we get it.
 	// This prevents a dangling "Transport endpoint is not connected"
 	// mountpoint if the user hits CTRL-C.
-	handleSigint(srv, args.mountpoint)
+	handleSigint(srv, args.mountpoint, fs)
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
-	// Set up autounmount, if requested.
-	if args.idle > 0 && !args.reverse {
-		// Not being in reverse mode means we always have a forward file system.
-		fwdFs := fs.(*fusefrontend.RootNode)
-		go idleMonitor(args.idle, fwdFs, srv, args.mountpoint)
+	// Unmount when requested via the control socket ("-unmount -when-idle")
+	if rn, ok := fs.(*fusefrontend.RootNode); ok {
+		go handleIdleUnmount(srv, rn)
+	}
+	// Set up autounmount, if requested, and start serving reloads
+	args._reloader.start(fs, srv)
+	if mk != nil {
+		go mk.run()
 	}
 	// Wait for unmount.
 	srv.Wait()
+	// "-manifest": record the final state
+	if mk != nil {
+		mk.close()
+	}
+}
+
+// dropPrivileges implements "-sandbox-user": it chroots into CIPHERDIR and
+// switches to the sandbox user.
+func dropPrivileges(rootNode fs.InodeEmbedder, args *argContainer) error {
+	c, ok := rootNode.(Chrooter)
+	if !ok {
+		return fmt.Errorf("not supported by %T", rootNode)
+	}
+	if err := sandbox.DropPrivileges(args.cipherdir, args._sandboxUid, args._sandboxGid); err != nil {
+		return err
+	}
+	c.Chrooted()
+	tlog.Info.Printf("Chrooted into %s, running as uid=%d gid=%d",
+		args.cipherdir, args._sandboxUid, args._sandboxGid)
+	return nil
+}
+
+// realPath returns "path" with all symlinks resolved, or "path" itself if
+// it does not exist (yet).
+func realPath(path string) string {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return real
+}
+
+// isSubdir returns true if the absolute path "dir" is equal to or below
+// "parent". Everything is below "/", but as -one-file-system makes
+// reverse-mounting "/" useful, "/" is treated as a parent of nothing.
+func isSubdir(dir string, parent string) bool {
+	return dir == parent || strings.HasPrefix(dir, parent+"/")
+}
+
+// isMountpoint returns true if "dir" is the root directory of a mounted
+// filesystem. Bind mounts within the same filesystem are not detected.
+func isMountpoint(dir string) bool {
+	var st, stParent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return false
+	}
+	if err := syscall.Stat(filepath.Join(dir, ".."), &stParent); err != nil {
+		return false
+	}
+	// "/" is its own parent
+	return st.Dev != stParent.Dev || st.Ino == stParent.Ino
+}
+
+// removeMountpoint removes the mountpoint if it has been created by
+// "-create-mountpoint". This fails harmlessly if the mountpoint is not
+// empty, for example because the filesystem is still mounted.
+func removeMountpoint(args *argContainer) {
+	if !args._createdMountpoint {
+		return
+	}
+	if err := os.Remove(args.mountpoint); err != nil {
+		tlog.Warn.Printf("Could not remove mountpoint: %v", err)
+		return
+	}
+	args._createdMountpoint = false
 }
 
 // Based on the EncFS idle monitor:
@@ -171,30 +429,35 @@ func doMount(args *argContainer) {
 // filesystem idleness and unmounts if we've been idle for long enough.
 const checksDuringTimeoutPeriod = 4
 
-func idleMonitor(idleTimeout time.Duration, fs *fusefrontend.RootNode, srv *fuse.Server, mountpoint string) {
-	// sleepNs is the sleep time between checks, in nanoseconds.
-	sleepNs := contentenc.MinUint64(
-		uint64(idleTimeout/checksDuringTimeoutPeriod),
-		uint64(2*time.Minute))
-	timeoutCycles := int(math.Ceil(float64(idleTimeout) / float64(sleepNs)))
-	idleCount := 0
-	idleTime := func() time.Duration {
-		return time.Duration(sleepNs * uint64(idleCount))
-	}
+// idleMonitor reads the timeout from "idleTimeout" (nanoseconds, use atomic
+// ops) before every check, so that it can be changed on reload. Zero pauses
+// the monitor.
+func idleMonitor(idleTimeout *int64, fs *fusefrontend.RootNode, srv *fuse.Server, mountpoint string) {
+	var idleTime time.Duration
 	for {
+		timeout := time.Duration(atomic.LoadInt64(idleTimeout))
+		if timeout <= 0 {
+			idleTime = 0
+			time.Sleep(2 * time.Minute)
+			continue
+		}
+		// sleep is the time between checks
+		sleep := time.Duration(contentenc.MinUint64(
+			uint64(timeout/checksDuringTimeoutPeriod),
+			uint64(2*time.Minute)))
 		// Atomically check whether the flag is 0 and reset it to 1 if so.
 		isIdle := !atomic.CompareAndSwapUint32(&fs.IsIdle, 0, 1)
 		// Any form of current or recent access resets the idle counter.
 		openFileCount := openfiletable.CountOpenFiles()
 		if !isIdle || openFileCount > 0 {
-			idleCount = 0
+			idleTime = 0
 		} else {
-			idleCount++
+			idleTime += sleep
 		}
 		tlog.Debug.Printf(
-			"idleMonitor: idle for %v (idleCount = %d, isIdle = %t, open = %d)",
-			idleTime(), idleCount, isIdle, openFileCount)
-		if idleCount > 0 && idleCount%timeoutCycles == 0 {
+			"idleMonitor: idle for %v (isIdle = %t, open = %d)",
+			idleTime, isIdle, openFileCount)
+		if idleTime >= timeout {
 			tlog.Info.Printf("idleMonitor: filesystem idle; unmounting: %s", mountpoint)
 			err := srv.Unmount()
 			if err != nil {
@@ -203,10 +466,10 @@ func idleMonitor(idleTimeout time.Duration, fs *fusefrontend.RootNode, srv *fuse
 				// so the user finds out why their filesystem does not get
 				// unmounted.
 				tlog.Info.Printf("idleMonitor: unmount failed: %v. Resetting idle time.", err)
-				idleCount = 0
+				idleTime = 0
 			}
 		}
-		time.Sleep(time.Duration(sleepNs))
+		time.Sleep(sleep)
 	}
 }
 
@@ -233,6 +496,9 @@ func setOpenFileLimit() {
 // initFuseFrontend - initialize gocryptfs/internal/fusefrontend
 // Calls os.Exit on errors
 func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys func()) {
+	if args.encfs {
+		return initEncfsFrontend(args)
+	}
 	var err error
 	var confFile *configfile.ConfFile
 	// Get the masterkey from the command line if it was specified
@@ -246,8 +512,19 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 				// Close the socket file (which also deletes it)
 				args._ctlsockFd.Close()
 			}
+			removeMountpoint(args)
 			exitcodes.Exit(err)
 		}
+		// The saved options have already been applied by applyMountDefaults()
+		if err = confFile.VerifyMountDefaults(masterkey); err != nil {
+			tlog.Fatal.Println(err)
+			removeMountpoint(args)
+			os.Exit(exitcodes.LoadConf)
+		}
+		args._mountConf = confFile
+		args._mountDefaultsKey = cryptocore.MountDefaultsKey(masterkey)
+	} else if args.rescue {
+		confFile = loadRescueConfig(args)
 	}
 	// Reconciliate CLI and config file arguments into a fusefrontend.Args struct
 	// that is passed to the filesystem implementation
@@ -267,6 +544,17 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		}
 		IVBits = chacha20poly1305.NonceSizeX * 8
 	}
+	if args.aes128 {
+		if args.openssl {
+			cryptoBackend = cryptocore.BackendOpenSSL128
+		} else {
+			cryptoBackend = cryptocore.BackendGoGCM128
+		}
+	}
+	if args.aegis {
+		cryptoBackend = cryptocore.BackendAEGIS256
+		IVBits = aegis.NonceSize * 8
+	}
 	// forceOwner implies allow_other, as documented.
 	// Set this early, so args.allow_other can be relied on below this point.
 	if args._forceOwner != nil {
@@ -277,7 +565,7 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		PlaintextNames:     args.plaintextnames,
 		LongNames:          args.longnames,
 		ConfigCustom:       args._configCustom,
-		NoPrealloc:         args.noprealloc,
+		Prealloc:           args.prealloc,
 		ForceOwner:         args._forceOwner,
 		Exclude:            args.exclude,
 		ExcludeWildcard:    args.excludeWildcard,
@@ -287,6 +575,42 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		SharedStorage:      args.sharedstorage,
 		OneFileSystem:      args.one_file_system,
 		DeterministicNames: args.deterministic_names,
+		Policy:             args._policy,
+		UnionCreate:        args.union_create,
+		MaxSize:            args.max_size,
+		MaxFileSize:        args.max_file_size,
+		AppendOnly:         args.append_only,
+		Notify:             args.notify,
+		TrackChanges:       args.ctlsock != "",
+		Stats:              args.ctlsock != "",
+		BwLimit:            args.bwlimit,
+		IOPLimit:           args.ioplimit,
+		IOTimeout:          args.io_timeout,
+		RetryCount:         args.retry_count,
+		RetryInterval:      args.retry_interval,
+		Faults:             args._faults,
+		Rescue:             args.rescue,
+		Replica:            args.replica,
+		CacheDir:           args.cachedir,
+		CacheSize:          args.cachesize,
+		CacheMem:           args.cachemem,
+		Journal:            args.journal,
+		Sync:               args.sync,
+		FsyncOnClose:       args.fsync_on_close,
+		FsyncInterval:      args.fsync_interval,
+		NoAtime:            args.noatime,
+		RelAtime:           args.relatime,
+		BindPath:           args.bindpath,
+		Reencrypt:          args.reencrypt,
+		ReencryptIdle:      args.reencrypt_idle,
+		ReencryptRate:      args.reencrypt_rate,
+		WORM:               args.worm,
+		WORMRetention:      args.worm_retention,
+	}
+	// A daemonized mount has no terminal, and the "-progress-fd" of its
+	// parent is not passed on. Only report with "-fg".
+	if args.reencrypt && args.notifypid == 0 {
+		frontendArgs.ReencryptProgress = startProgress(args, "reencrypt")
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
@@ -295,8 +619,44 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		frontendArgs.DeterministicNames = !confFile.IsFeatureFlagSet(configfile.FlagDirIV)
 		// Things that don't have to be in frontendArgs are only in args
 		args.longnamemax = confFile.LongNameMax
+		args.hctr2 = confFile.IsFeatureFlagSet(configfile.FlagHCTR2Names)
+		args.longnamehash = nametransform.LongNameHashSHA256
+		if confFile.IsFeatureFlagSet(configfile.FlagLongNameBLAKE3) {
+			args.longnamehash = nametransform.LongNameHashBLAKE3
+		}
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
 		args.hkdf = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
+		args.merkle = confFile.IsFeatureFlagSet(configfile.FlagMerkleTree)
+		if args.merkle && (args.sharedstorage || len(args.union) > 0) {
+			// Other writers would not update our hash trees
+			tlog.Fatal.Printf("Filesystems created with -merkle cannot be mounted with -sharedstorage or -union")
+			os.Exit(exitcodes.Usage)
+		}
+		frontendArgs.BindPath = confFile.IsFeatureFlagSet(configfile.FlagBindPath)
+		if frontendArgs.BindPath && len(args.union) > 0 {
+			// The lower branches have their own settings
+			tlog.Fatal.Printf("Filesystems created with -bindpath cannot be mounted with -union")
+			os.Exit(exitcodes.Usage)
+		}
+		if confFile.IsFeatureFlagSet(configfile.FlagReadOnly) {
+			if args.reencrypt || args.journal || args.auditlog || args.manifest {
+				tlog.Fatal.Printf("This filesystem is read-only (-make-readonly) and cannot be mounted with " +
+					"-reencrypt, -journal, -auditlog or -manifest")
+				os.Exit(exitcodes.Usage)
+			}
+			// Whatever "-ro" and "-rw" say
+			args.ro = true
+		}
+		frontendArgs.WORM = confFile.IsFeatureFlagSet(configfile.FlagWORM)
+		args.immutable = confFile.IsFeatureFlagSet(configfile.FlagImmutable)
+		args.flat = confFile.IsFeatureFlagSet(configfile.FlagFlatLayout)
+		args._flatImage = confFile.IsFeatureFlagSet(configfile.FlagFlatImage)
+		args._imageMaxSize = confFile.ImageMaxSize
+		frontendArgs.WORMRetention, err = confFile.WORMRetentionDuration()
+		if err != nil {
+			tlog.Fatal.Printf("%v", err)
+			os.Exit(exitcodes.LoadConf)
+		}
 		// Note: this will always return the non-openssl variant
 		cryptoBackend, err = confFile.ContentEncryption()
 		if err != nil {
@@ -304,6 +664,11 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 			os.Exit(exitcodes.DeprecatedFS)
 		}
 		IVBits = cryptoBackend.NonceSize * 8
+		if cryptoBackend == cryptocore.BackendAEGIS256 && !aegis.Accelerated() {
+			tlog.Info.Printf(tlog.ColorYellow +
+				"Notice: Your CPU does not have AES acceleration. AEGIS-256 will be slow." +
+				tlog.ColorReset)
+		}
 		if cryptoBackend != cryptocore.BackendAESSIV && args.reverse {
 			tlog.Fatal.Printf("AES-SIV is required by reverse mode, but not enabled in the config file")
 			os.Exit(exitcodes.Usage)
@@ -313,22 +678,76 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 			switch cryptoBackend {
 			case cryptocore.BackendGoGCM:
 				cryptoBackend = cryptocore.BackendOpenSSL
+			case cryptocore.BackendGoGCM128:
+				cryptoBackend = cryptocore.BackendOpenSSL128
 			case cryptocore.BackendXChaCha20Poly1305:
 				cryptoBackend = cryptocore.BackendXChaCha20Poly1305OpenSSL
 			}
 		}
 	}
+	// merkleVolume is set when -rescue turns off the hash tree checks of a
+	// -merkle filesystem
+	var merkleVolume bool
+	if args.rescue {
+		if args.flat {
+			tlog.Fatal.Printf("-rescue does not support -flat filesystems")
+			os.Exit(exitcodes.Usage)
+		}
+		// Corrupt blocks would fail the hash tree check before they can be
+		// replaced with zeros
+		merkleVolume, args.merkle = args.merkle, false
+	}
 	// If allow_other is set and we run as root, try to give newly created files to
-	// the right user.
-	if args.allow_other && os.Getuid() == 0 {
+	// the right user. Not in a "-userns" namespace, where only our own uid is
+	// mapped, and setgroups(2) is not permitted.
+	if args.allow_other && os.Getuid() == 0 && !inUserns() {
 		frontendArgs.PreserveOwner = true
 	}
 
 	// Init crypto backend
 	cCore := cryptocore.New(masterkey, cryptoBackend, IVBits, args.hkdf)
 	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
-	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.longnamemax,
+	if args.write_threads > 0 {
+		cEnc.SetWriteThreads(args.write_threads)
+	}
+	if args.immutable {
+		cEnc.SetImmutable()
+	}
+	if args.merkle || merkleVolume {
+		// The hash tree state follows the file header
+		cEnc.SetHeaderExt(merkle.StateLen)
+	}
+	if args.flat {
+		return initFlatFrontend(args, cEnc, masterkey), cCore.Wipe
+	}
+	epochCores := initKeyEpochs(confFile, cEnc, cryptoBackend, IVBits, args.hkdf)
+	var nameCipher nametransform.WideBlockCipher = cCore.EMECipher
+	if args.hctr2 {
+		nameCipher = cryptocore.NewHCTR2(masterkey)
+	}
+	nameTransform := nametransform.New(nameCipher, frontendArgs.LongNames, args.longnamemax,
 		args.raw64, []string(args.badname), frontendArgs.DeterministicNames)
+	if args.longnamehash == nametransform.LongNameHashBLAKE3 {
+		nameTransform.SetLongNameKey(cryptocore.LongNameKey(masterkey))
+	}
+	// "-auditlog". "-fsck" verifies an existing log.
+	if args.auditlog || args.fsck {
+		args._auditLog = auditlog.New(args.cipherdir, cryptocore.AuditLogKey(masterkey))
+	}
+	if args.auditlog {
+		if err := args._auditLog.Open(); err != nil {
+			tlog.Fatal.Printf("-auditlog: %v", err)
+			os.Exit(exitcodes.AuditLog)
+		}
+		frontendArgs.AuditLog = args._auditLog
+	}
+	if args.merkle {
+		frontendArgs.MerkleKey = cryptocore.MerkleKey(masterkey)
+	}
+	// "-manifest". "-fsck" verifies an existing manifest.
+	if args.manifest || args.fsck {
+		args._manifestKey = cryptocore.ManifestKey(masterkey)
+	}
 	// After the crypto backend is initialized,
 	// we can purge the master key from memory.
 	for i := range masterkey {
@@ -336,21 +755,68 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 	}
 	masterkey = nil
 	// Spawn fusefrontend
+	var unionCores []*cryptocore.CryptoCore
+	wipePrimary := func() {
+		cCore.Wipe()
+		for _, c := range epochCores {
+			c.Wipe()
+		}
+	}
+	// Wipes wipePrimary's keys too, unless the filesystem is locked
+	var wipeFrontend func()
 	tlog.Debug.Printf("frontendArgs: %s", tlog.JSONDump(frontendArgs))
 	if args.reverse {
 		if cryptoBackend != cryptocore.BackendAESSIV {
 			log.Panic("reverse mode must use AES-SIV, everything else is insecure")
 		}
+		if confFile != nil && confFile.IsFeatureFlagSet(configfile.FlagSubvolumes) {
+			tlog.Fatal.Printf("Filesystems with subvolumes cannot be mounted in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
 		rootNode = fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
 	} else {
-		rootNode = fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+		if confFile != nil && confFile.IsFeatureFlagSet(configfile.FlagSubvolumes) && len(args.union) > 0 {
+			tlog.Fatal.Printf("Filesystems with subvolumes cannot be mounted with -union")
+			os.Exit(exitcodes.Usage)
+		}
+		rn := fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+		unionCores = initUnionBranches(args, confFile, cryptoBackend, IVBits, rn)
+		initSubvolumes(args, confFile, cryptoBackend, IVBits, rn)
+		rn.SetLockFunc(wipePrimary, ctlsockUnlock(args, cryptoBackend, IVBits))
+		wipeFrontend = rn.WipeKeys
+		rootNode = rn
 	}
 	// We have opened the socket early so that we cannot fail here after
 	// asking the user for the password
 	if args._ctlsockFd != nil {
-		go ctlsocksrv.Serve(args._ctlsockFd, rootNode.(ctlsocksrv.Interface))
+		info := ctlsock.InfoStruct{
+			Pid:        os.Getpid(),
+			Cipherdir:  args.cipherdir,
+			Mountpoint: args.mountpoint,
+			Reverse:    args.reverse,
+			ReadOnly:   args.ro || args.reverse,
+			Started:    time.Now().Unix(),
+		}
+		var reload ctlsocksrv.ReloadFunc
+		if args._reloader != nil {
+			reload = args._reloader.ctlsock
+		}
+		var changePassword ctlsocksrv.ChangePasswordFunc
+		if confFile != nil {
+			changePassword = ctlsockChangePassword(args)
+		}
+		go ctlsocksrv.Serve(args._ctlsockFd, rootNode.(ctlsocksrv.Interface), info, reload, changePassword)
+	}
+	return rootNode, func() {
+		if wipeFrontend != nil {
+			wipeFrontend()
+		} else {
+			wipePrimary()
+		}
+		for _, c := range unionCores {
+			c.Wipe()
+		}
 	}
-	return rootNode, func() { cCore.Wipe() }
 }
 
 // initGoFuse calls into go-fuse to mount `rootNode` on `args.mountpoint`.
@@ -376,6 +842,13 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 			EntryTimeout:    &sec,
 		}
 	}
+	if args._policy.HasUserDirs() {
+		// The kernel shares cached directory entries between users. Look
+		// them up every time so Lookup() can hide other users' entries in a
+		// "userdir".
+		fuseOpts.EntryTimeout = nil
+		fuseOpts.NegativeTimeout = nil
+	}
 	fuseOpts.NullPermissions = true
 	// Enable go-fuse warnings
 	fuseOpts.Logger = log.New(os.Stderr, "go-fuse: ", log.Lmicroseconds)
@@ -396,10 +869,18 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		// Setting SyncRead disables FUSE_CAP_ASYNC_READ. This makes the kernel
 		// do everything in-order without parallelism.
 		SyncRead: args.serialize_reads,
+		// "-max_background". go-fuse sets the congestion threshold to 3/4 of
+		// it.
+		MaxBackground: fuseMaxBackground(args),
 		// Attempt to directly call mount(2) before trying fusermount. This means we
 		// can do without fusermount if running as root.
 		DirectMount: true,
 	}
+	// fusermount does not work in a user namespace, so there is no point in
+	// falling back to it
+	if inUserns() {
+		fuseOpts.MountOptions.DirectMountStrict = true
+	}
 
 	mOpts := &fuseOpts.MountOptions
 	if args.allow_other {
@@ -433,6 +914,8 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	mOpts.Name = "gocryptfs"
 	if args.reverse {
 		mOpts.Name += "-reverse"
+	} else if args.encfs {
+		mOpts.Name += "-encfs"
 	}
 	// Add a volume name if running osxfuse. Otherwise the Finder will show it as
 	// something like "osxfuse Volume 0 (gocryptfs)".
@@ -464,6 +947,17 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	} else if args.exec {
 		mOpts.Options = append(mOpts.Options, "exec")
 	}
+	// SELinux labels. main() has made sure they do not contain commas.
+	for _, o := range [][2]string{
+		{"context", args.context},
+		{"fscontext", args.fscontext},
+		{"defcontext", args.defcontext},
+		{"rootcontext", args.rootcontext},
+	} {
+		if o[1] != "" {
+			mOpts.Options = append(mOpts.Options, o[0]+"="+o[1])
+		}
+	}
 	// Add additional mount options (if any) after the stock ones, so the user has
 	// a chance to override them.
 	if args.ko != "" {
@@ -471,12 +965,35 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		tlog.Debug.Printf("Adding -ko mount options: %v", parts)
 		mOpts.Options = append(mOpts.Options, parts...)
 	}
-	srv, err := fs.Mount(args.mountpoint, rootNode, fuseOpts)
+	rawFS := fs.NewNodeFS(rootNode, fuseOpts)
+	if args.root_squash {
+		rawFS = rootsquash.New(rawFS, rootsquash.Nobody, rootsquash.Nobody)
+	}
+	// The request limiter serializes every request on its mutex, so it is
+	// only used when asked for
+	if args.threads > 0 || args.max_queue > 0 {
+		threads := fuseThreads(args)
+		tlog.Debug.Printf("initGoFuse: threads=%d max_queue=%d", threads, args.max_queue)
+		limiter := fuselimit.New(rawFS, threads, args.max_queue)
+		if rn, ok := rootNode.(*fusefrontend.RootNode); ok {
+			rn.SetRequestQueue(limiter)
+		}
+		rawFS = limiter
+	}
+	tlog.Debug.Printf("initGoFuse: max_background=%d", mOpts.MaxBackground)
+	srv, err := fuse.NewServer(rawFS, args.mountpoint, &fuseOpts.MountOptions)
+	// With -sandbox-user, we do not serve requests before doMount() has
+	// chrooted into CIPHERDIR
+	if err == nil && args.sandbox_user == "" {
+		go srv.Serve()
+		err = srv.WaitMount()
+	}
 	if err != nil {
 		tlog.Fatal.Printf("fs.Mount failed: %s", strings.TrimSpace(err.Error()))
 		if runtime.GOOS == "darwin" {
 			tlog.Info.Printf("Maybe you should run: /Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse")
 		}
+		removeMountpoint(args)
 		os.Exit(exitcodes.FuseNewServer)
 	}
 
@@ -508,17 +1025,55 @@ func haveFusermount2() bool {
 	return strings.HasPrefix(v, "fusermount version")
 }
 
-func handleSigint(srv *fuse.Server, mountpoint string) {
-	ch := make(chan os.Signal, 1)
+// handleSigint unmounts gracefully on SIGINT or SIGTERM: new opens are
+// rejected, written data is synced to disk, and we wait up to
+// shutdownTimeout for open files to be closed. Once the unmount succeeds,
+// srv.Wait() returns and doMount() cleans up as usual. If files are still
+// open after that, or on a second signal, we unmount lazily and exit.
+func handleSigint(srv *fuse.Server, mountpoint string, rootNode fs.InodeEmbedder) {
+	ch := make(chan os.Signal, 2)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
 	go func() {
-		<-ch
+		sig := <-ch
+		tlog.Info.Printf("Got %v, unmounting %s", sig, mountpoint)
+		if x, ok := rootNode.(Shutdowner); ok {
+			x.Shutdown()
+		}
+		deadline := time.Now().Add(shutdownTimeout)
+		for {
+			// Fails with EBUSY while files are open
+			if srv.Unmount() == nil {
+				return
+			}
+			if time.Now().After(deadline) {
+				tlog.Warn.Printf("Files are still open after %v", shutdownTimeout)
+				break
+			}
+			select {
+			case <-ch:
+				// Second signal: stop waiting
+			case <-time.After(100 * time.Millisecond):
+				continue
+			}
+			break
+		}
 		unmount(srv, mountpoint)
 		os.Exit(exitcodes.SigInt)
 	}()
 }
 
+// handleIdleUnmount unmounts once rn.IdleUnmount is signaled. The unmount
+// can still fail, for example when a process has its working directory in
+// the mount, so keep retrying.
+func handleIdleUnmount(srv *fuse.Server, rn *fusefrontend.RootNode) {
+	<-rn.IdleUnmount
+	tlog.Info.Printf("Last open file closed, unmounting")
+	for srv.Unmount() != nil {
+		time.Sleep(time.Second)
+	}
+}
+
 // unmount() calls srv.Unmount(), and if that fails, calls "fusermount -u -z"
 // (lazy unmount).
 func unmount(srv *fuse.Server, mountpoint string) {
@@ -535,3 +1090,42 @@ func unmount(srv *fuse.Server, mountpoint string) {
 		}
 	}
 }
+
+// loadRescueConfig loads the config file for "-rescue", which has the master
+// key from "-masterkey". The config file is only needed for the feature
+// flags. If it is damaged, the filesystem is mounted with the feature flags
+// given on the command line, like "-aessiv" or "-plaintextnames".
+func loadRescueConfig(args *argContainer) *configfile.ConfFile {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Info.Printf(tlog.ColorYellow+"-rescue: ignoring config file: %v\n"+
+			"Using the feature flags from the command line."+tlog.ColorReset, err)
+		return nil
+	}
+	if cf.KeyEpoch > 0 {
+		tlog.Info.Printf(tlog.ColorYellow + "-rescue: -masterkey only decrypts the files " +
+			"created before the first -new-key-epoch" + tlog.ColorReset)
+	}
+	return cf
+}
+
+// initKeyEpochs adds the keys of the key epochs ("-new-key-epoch") to "cEnc".
+// "confFile" is nil with "-masterkey", which is only the key of epoch 0. The
+// returned crypto cores must be wiped after unmount.
+func initKeyEpochs(confFile *configfile.ConfFile, cEnc *contentenc.ContentEnc, cryptoBackend cryptocore.AEADTypeEnum,
+	IVBits int, hkdf bool) (cores []*cryptocore.CryptoCore) {
+	if confFile == nil {
+		return nil
+	}
+	for _, key := range confFile.EpochKeys() {
+		cores = append(cores, cryptocore.New(key, cryptoBackend, IVBits, hkdf))
+		for i := range key {
+			key[i] = 0
+		}
+	}
+	if len(cores) > 0 {
+		cEnc.SetKeyEpochs(cores)
+		tlog.Debug.Printf("Key epochs: new files are created in epoch %d", cEnc.CurrentKeyEpoch())
+	}
+	return cores
+}
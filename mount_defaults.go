@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// mountDefaultsAllowed are the options that can be saved with
+// "-mount-defaults". Options that affect the encryption or where the
+// password comes from are not allowed.
+var mountDefaultsAllowed = map[string]bool{
+	"acl":             true,
+	"allow_other":     true,
+	"append_only":     true,
+	"cachedir":        true,
+	"cachemem":        true,
+	"cachesize":       true,
+	"fsync_interval":  true,
+	"fsync_on_close":  true,
+	"i":               true,
+	"idle":            true,
+	"io_timeout":      true,
+	"kernel_cache":    true,
+	"max_background":  true,
+	"max_file_size":   true,
+	"max_size":        true,
+	"noatime":         true,
+	"nodev":           true,
+	"noexec":          true,
+	"noprealloc":      true,
+	"nosuid":          true,
+	"prealloc":        true,
+	"ro":              true,
+	"serialize_reads": true,
+	"sharedstorage":   true,
+	"threads":         true,
+	"write_threads":   true,
+}
+
+// parseMountDefaults checks the comma-separated "-mount-defaults" list, like
+// "allow_other,idle=30m", and returns the options without leading dashes.
+// Exits on errors.
+func parseMountDefaults(list string) (opts []string) {
+	var dashed []string
+	for _, o := range strings.Split(list, ",") {
+		if o == "" {
+			continue
+		}
+		o = strings.TrimLeft(o, "-")
+		name := strings.SplitN(o, "=", 2)[0]
+		if !mountDefaultsAllowed[name] {
+			var allowed []string
+			for a := range mountDefaultsAllowed {
+				allowed = append(allowed, a)
+			}
+			sort.Strings(allowed)
+			tlog.Fatal.Printf("-mount-defaults: %q cannot be saved, allowed are: %s", name, strings.Join(allowed, ", "))
+			os.Exit(exitcodes.Usage)
+		}
+		opts = append(opts, o)
+		dashed = append(dashed, "-"+o)
+	}
+	// Check the values by parsing them. parseCliOpts() exits on errors.
+	fs := flagSet
+	parseCliOpts(append([]string{os.Args[0]}, dashed...))
+	flagSet = fs
+	return opts
+}
+
+// applyMountDefaults puts the options saved in the config file of the
+// filesystem we are about to mount in front of the command line "osArgs",
+// so that all other options override them, and returns the parsed result.
+// They are checked against their MAC in initFuseFrontend().
+func applyMountDefaults(args argContainer, osArgs []string) argContainer {
+	if args.masterkey != "" || args.zerokey || args.encfs {
+		// The config file is not used
+		return args
+	}
+	config := args.config
+	if config == "" {
+		cipherdir, _ := filepath.Abs(flagSet.Arg(0))
+		config = filepath.Join(cipherdir, configfile.ConfDefaultName)
+		if args.reverse {
+			config = filepath.Join(cipherdir, configfile.ConfReverseName)
+		}
+	}
+	// A config file passed through a pipe, like "-config <(...)", can only
+	// be read once
+	if fi, err := os.Stat(config); err != nil || !fi.Mode().IsRegular() {
+		return args
+	}
+	cf, err := configfile.Load(config)
+	if err != nil || len(cf.MountDefaults) == 0 {
+		// Errors are reported when the config file is loaded for real
+		return args
+	}
+	newArgs := []string{osArgs[0]}
+	for _, o := range cf.MountDefaults {
+		newArgs = append(newArgs, "-"+o)
+	}
+	newArgs = append(newArgs, osArgs[1:]...)
+	return parseCliOpts(newArgs)
+}
+
+// setMountDefaults handles "gocryptfs -mount-defaults LIST CIPHERDIR".
+// Does not return (calls os.Exit both on success and on error).
+func setMountDefaults(args *argContainer) {
+	opts := parseMountDefaults(args.mount_defaults)
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	cf.SetMountDefaults(opts, masterkey)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	if len(opts) == 0 {
+		tlog.Info.Printf(tlog.ColorGreen + "Mount defaults removed." + tlog.ColorReset)
+	} else {
+		tlog.Info.Printf(tlog.ColorGreen+"Mount defaults saved: %s"+tlog.ColorReset, strings.Join(opts, ","))
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/hybridkem"
+	"github.com/rfjakob/gocryptfs/v2/internal/pwstrength"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// ctlsockChangePassword returns the handler for ctlsock ChangePassword
+// requests. Like "-passwd", it re-encrypts the master key in the config file
+// with the new password, but while the filesystem stays mounted. The config
+// file is read again for every request, so that changes made since the mount
+// (key epochs, key slots) are kept, and replaced atomically by WriteFile().
+func ctlsockChangePassword(args *argContainer) ctlsocksrv.ChangePasswordFunc {
+	// mu serializes password changes
+	var mu sync.Mutex
+	return func(oldPw []byte, newPw []byte) (warnText string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(newPw) == 0 {
+			return "", errors.New("the new password is empty")
+		}
+		cf, err := configfile.Load(args.config)
+		if err != nil {
+			return "", err
+		}
+		if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+			return "", errors.New("password change is not supported on FIDO2-enabled filesystems")
+		}
+		masterkey, err := ctlsockDecryptMasterKey(args, cf, oldPw)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			for i := range masterkey {
+				masterkey[i] = 0
+			}
+		}()
+		logN := cf.ScryptObject.LogN()
+		equivalentLogN := logN
+		if cf.IsFeatureFlagSet(configfile.FlagArgon2id) {
+			equivalentLogN = cf.Argon2idObject.EquivalentLogN()
+		}
+		bits := pwstrength.Entropy(newPw)
+		if args.require_entropy > 0 && bits < float64(args.require_entropy) {
+			return "", fmt.Errorf("password rejected: its estimated entropy is %.0f bits, -require-entropy demands %d bits",
+				bits, args.require_entropy)
+		}
+		if pwstrength.CrackSeconds(bits, equivalentLogN) < weakPasswordSeconds {
+			warnText = fmt.Sprintf("The new password is weak (about %.0f bits). "+
+				"Use a longer password, for example several random words.", bits)
+		}
+		cf.EncryptKey(masterkey, newPw, logN)
+		if err = cf.WriteFile(); err != nil {
+			return "", err
+		}
+		tlog.Info.Printf("ctlsock: password changed")
+		return warnText, nil
+	}
+}
+
+// ctlsockDecryptMasterKey decrypts the master key in "cf" with the password
+// from a control socket request. The caller must reject FIDO2-enabled
+// filesystems, as there is nobody to touch the token.
+func ctlsockDecryptMasterKey(args *argContainer, cf *configfile.ConfFile, pw []byte) ([]byte, error) {
+	if cf.IsFeatureFlagSet(configfile.FlagPQHybrid) {
+		seed, err := hybridkem.ReadKeyFile(args.pqkey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read -pqkey key file: %v", err)
+		}
+		err = cf.UnlockPQHybrid(seed)
+		for i := range seed {
+			seed[i] = 0
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cf.DecryptMasterKey(pw)
+}
+
+// doPasswdCtlsock handles "gocryptfs -passwd -ctlsock SOCKET": it asks for
+// the old and the new password and changes the password of the filesystem
+// mounted with this control socket, without unmounting it.
+// Returns the exit code.
+func doPasswdCtlsock(args *argContainer) int {
+	if flagSet.NArg() != 0 {
+		tlog.Fatal.Printf("Usage: %s -passwd -ctlsock SOCKET", tlog.ProgramName)
+		return exitcodes.Usage
+	}
+	if args.masterkey != "" || args.zerokey || args.fido2 != "" || args.pkcs11 || args._explicitScryptn ||
+		args._explicitScryptr || args._explicitScryptp || args._explicitArgon2idMemory || args._explicitArgon2idTime {
+		tlog.Fatal.Printf("-passwd -ctlsock keeps the KDF cost and only works with the old password. It cannot be " +
+			"used with -masterkey, -zerokey, -fido2, -pkcs11, -scryptn, -scryptr, -scryptp or -argon2id-*.")
+		return exitcodes.Usage
+	}
+	oldPw, err := readpassword.Once([]string(args.extpass), []string(args.passfile), "Old password")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return exitcodes.ReadPassword
+	}
+	tlog.Info.Println("Please enter your new password.")
+	newPw, err := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return exitcodes.ReadPassword
+	}
+	// The mount checks its own -require-entropy, this is ours
+	if bits := pwstrength.Entropy(newPw); args.require_entropy > 0 && bits < float64(args.require_entropy) {
+		tlog.Fatal.Printf("Password rejected: its estimated entropy is %.0f bits, -require-entropy demands %d bits.",
+			bits, args.require_entropy)
+		return exitcodes.PasswordWeak
+	}
+	req := ctlsock.RequestStruct{ChangePassword: true, Password: string(oldPw), NewPassword: string(newPw)}
+	for i := range oldPw {
+		oldPw[i] = 0
+	}
+	for i := range newPw {
+		newPw[i] = 0
+	}
+	c, err := ctlsock.New(args.ctlsock)
+	if err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		return exitcodes.CtlSock
+	}
+	defer c.Close()
+	resp, err := c.Query(&req)
+	if err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		return exitcodes.CtlSock
+	}
+	if resp.WarnText != "" {
+		tlog.Info.Printf(tlog.ColorYellow + resp.WarnText + tlog.ColorReset)
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "Password changed." + tlog.ColorReset)
+	return 0
+}
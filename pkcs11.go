@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/pkcs11"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// pkcs11Enroll handles "gocryptfs -pkcs11-enroll MODULE -pkcs11-id ID
+// CIPHERDIR": a random key is wrapped with the RSA key ID on a PKCS#11 token
+// and locks the master key in a second key slot, so that the token and its
+// PIN unlock the filesystem ("-pkcs11").
+// Does not return (calls os.Exit both on success and on error).
+func pkcs11Enroll(args *argContainer) {
+	if args.masterkey != "" || args.zerokey {
+		// A wrong master key would go unnoticed
+		tlog.Fatal.Printf("-pkcs11-enroll needs the password and cannot be used with -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.pkcs11_id == "" {
+		tlog.Fatal.Printf("-pkcs11-enroll needs the ID of the RSA key on the token (-pkcs11-id)")
+		os.Exit(exitcodes.Usage)
+	}
+	id, err := pkcs11.ParseKeyID(args.pkcs11_id)
+	if err != nil {
+		tlog.Fatal.Printf("-pkcs11-id: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagPQHybrid) {
+		// The token would replace the key file
+		tlog.Fatal.Printf("-pkcs11-enroll does not work on filesystems created with -pqkey")
+		os.Exit(exitcodes.Usage)
+	}
+	pw, err := configPassword(args, cf)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	tlog.Info.Println("Decrypting master key")
+	masterkey, err := cf.DecryptMasterKey(pw)
+	for i := range pw {
+		pw[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	slotKey := cryptocore.RandBytes(cryptocore.KeyLen)
+	p := configfile.PKCS11Params{Module: args.pkcs11_enroll, KeyID: id}
+	p.WrappedKey, err = pkcs11.Wrap(p.Module, id, slotKey)
+	if err == nil {
+		// Not every token supports RSA-OAEP with SHA-256. Find out now
+		// instead of on the next mount.
+		tlog.Info.Printf("Checking that the token can unwrap the key")
+		var pin, unwrapped []byte
+		pin, err = readpassword.Once(nil, nil, "PIN")
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.ReadPassword)
+		}
+		unwrapped, err = pkcs11.Unwrap(p.Module, id, pin, p.WrappedKey)
+		if err == nil && !bytes.Equal(unwrapped, slotKey) {
+			err = exitcodes.NewErr("the token has unwrapped a different key", exitcodes.PKCS11)
+		}
+	}
+	if err == nil {
+		err = cf.SetPKCS11(masterkey, slotKey, p)
+	}
+	for i := range slotKey {
+		slotKey[i] = 0
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-pkcs11-enroll: %v", err)
+		os.Exit(exitcodes.PKCS11)
+	}
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "PKCS#11 key slot added. Mount with -pkcs11 to unlock with the token." +
+		tlog.ColorReset)
+	os.Exit(0)
+}
+
+// pkcs11Remove handles "gocryptfs -pkcs11-remove CIPHERDIR": the PKCS#11 key
+// slot is removed, so that the token no longer unlocks the master key.
+// Does not return (calls os.Exit both on success and on error).
+func pkcs11Remove(args *argContainer) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	if cf.PKCS11 == nil {
+		tlog.Info.Printf("The filesystem has no PKCS#11 key slot.")
+		os.Exit(0)
+	}
+	cf.PKCS11 = nil
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "PKCS#11 key slot removed." + tlog.ColorReset)
+	os.Exit(0)
+}
+
+// unlockPKCS11 decrypts the master key with the PKCS#11 key slot of "cf"
+// ("-pkcs11"). The PIN is read like a password.
+func unlockPKCS11(args *argContainer, cf *configfile.ConfFile) (masterkey []byte, err error) {
+	if cf.PKCS11 == nil {
+		tlog.Fatal.Printf("-pkcs11: the filesystem has no PKCS#11 key slot, see -pkcs11-enroll")
+		return nil, exitcodes.NewErr("", exitcodes.Usage)
+	}
+	pin, err := readpassword.Once([]string(args.extpass), []string(args.passfile), "PIN")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return nil, exitcodes.NewErr("", exitcodes.ReadPassword)
+	}
+	tlog.Info.Println("Unwrapping the key on the PKCS#11 token")
+	slotKey, err := pkcs11.Unwrap(cf.PKCS11.Module, cf.PKCS11.KeyID, pin, cf.PKCS11.WrappedKey)
+	for i := range pin {
+		pin[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-pkcs11: %v", err)
+		return nil, exitcodes.NewErr("", exitcodes.PKCS11)
+	}
+	masterkey, err = cf.DecryptMasterKeyPKCS11(slotKey)
+	for i := range slotKey {
+		slotKey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return nil, err
+	}
+	return masterkey, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/progress"
+)
+
+// fdWriter writes to a file descriptor. Unlike an *os.File, it does not
+// close the descriptor when it is garbage collected.
+type fdWriter int
+
+func (fd fdWriter) Write(p []byte) (int, error) {
+	return syscall.Write(int(fd), p)
+}
+
+// startProgress starts reporting the progress of the operation "op" as set
+// by "-progress" and "-progress-fd". Returns nil if nothing is reported.
+func startProgress(args *argContainer, op string) *progress.Reporter {
+	switch args.progress {
+	case progress.ModeJSON:
+		return progress.New(op, fdWriter(args.progress_fd), true)
+	case progress.ModeAuto:
+		if args.quiet || !term.IsTerminal(int(os.Stderr.Fd())) {
+			return nil
+		}
+		return progress.New(op, os.Stderr, false)
+	}
+	return nil
+}
+
+// abortOnSignal sets "*abort" on SIGINT and SIGTERM, so that a long
+// operation like -fsck stops at its next check instead of being killed.
+// Call the returned function to restore the default signal handling.
+func abortOnSignal(abort *bool) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if _, ok := <-ch; ok {
+			*abort = true
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// makeReadOnly handles "gocryptfs -make-readonly CIPHERDIR": every mount is
+// read-only from now on, whatever the command line says.
+// Does not return (calls os.Exit both on success and on error).
+func makeReadOnly(args *argContainer) {
+	if args.masterkey != "" || args.zerokey {
+		// The flag is bound to the password-locked master key
+		tlog.Fatal.Printf("-make-readonly needs the password and cannot be used with -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse {
+		tlog.Fatal.Printf("-make-readonly does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagReadOnly) {
+		tlog.Info.Printf("The filesystem is read-only already.")
+		os.Exit(0)
+	}
+	pw, err := configPassword(args, cf)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	tlog.Info.Println("Decrypting master key")
+	masterkey, err := cf.DecryptMasterKey(pw)
+	hadKeySlots := cf.HasKeySlots()
+	if err == nil {
+		cf.SetReadOnly(masterkey, pw)
+	}
+	for i := range pw {
+		pw[i] = 0
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "The filesystem is read-only now." + tlog.ColorReset)
+	tlog.Info.Printf("Running mounts stay writable until they are mounted again. " +
+		"This cannot be undone. Mounts with -masterkey do not use the config file and are not affected.")
+	if hadKeySlots {
+		tlog.Info.Printf("The -tpm2-enroll and -pkcs11-enroll key slots have been removed. Enroll them again to re-create them.")
+	}
+	os.Exit(0)
+}
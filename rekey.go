@@ -0,0 +1,598 @@
+package main
+
+// Master key rotation (-rekey)
+//
+// A new filesystem with a new master key, and otherwise the settings of the
+// old one, is created in gocryptfs.rekey/new in CIPHERDIR. Both are mounted
+// on temporary mountpoints, and every file is copied from the old to the new
+// one and then deleted from the old one, so that the disk space needed
+// stays small. Once the old filesystem is empty, the new one is moved to
+// CIPHERDIR and replaces gocryptfs.conf.
+// gocryptfs.rekey/state records the phase and the hard links that have been
+// copied. Every step can be repeated, so that an interrupted -rekey
+// continues where it has stopped when it is run again. Mounting is refused
+// until then.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/dirlock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/progress"
+	"github.com/rfjakob/gocryptfs/v2/internal/reserveddir"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// rekeyNewName is the directory in gocryptfs.rekey that holds the new
+	// filesystem
+	rekeyNewName   = "new"
+	rekeyStateName = "state"
+	// xattrStorePrefix is the prefix of the encrypted extended attributes
+	// in CIPHERDIR, see fusefrontend
+	xattrStorePrefix = "user.gocryptfs."
+)
+
+// The phases of -rekey, in this order
+const (
+	// rekeyPhaseCopy: the files are copied to the new filesystem
+	rekeyPhaseCopy = "copy"
+	// rekeyPhaseClean: the internal files of the old filesystem are deleted
+	// from CIPHERDIR
+	rekeyPhaseClean = "clean"
+	// rekeyPhaseMove: the new filesystem is moved to CIPHERDIR
+	rekeyPhaseMove = "move"
+)
+
+// rekeyState is stored as JSON in gocryptfs.rekey/state
+type rekeyState struct {
+	Phase string
+	// Files and Bytes count the files, and the plaintext size of the regular
+	// files, that have been copied
+	Files uint64
+	Bytes uint64
+	// Hardlinks maps the inode numbers of hard-linked files in the old
+	// filesystem to the path of their first copy in the new one
+	Hardlinks map[uint64]string `json:",omitempty"`
+	// DirModes holds the original modes of the directories that have been
+	// made writable to delete their contents
+	DirModes map[string]uint32 `json:",omitempty"`
+}
+
+type rekeyObj struct {
+	// dir is gocryptfs.rekey in CIPHERDIR
+	rekeyDir string
+	// src and dst are the mountpoints of the old and the new filesystem
+	src, dst string
+	state    rekeyState
+	// Chown files to their original owner? Only possible as root.
+	chown bool
+	// Number of files that could not be copied
+	failed int
+	// abort the copy? Set on SIGINT and SIGTERM.
+	abort bool
+	// progress reports the files and bytes copied ("-progress")
+	progress *progress.Reporter
+}
+
+// loadState reads gocryptfs.rekey/state. Returns false if it does not exist.
+func (r *rekeyObj) loadState() (bool, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(r.rekeyDir, rekeyStateName))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(buf, &r.state); err != nil {
+		return false, fmt.Errorf("%s: %v", rekeyStateName, err)
+	}
+	return true, nil
+}
+
+// saveState writes gocryptfs.rekey/state. It replaces the old state
+// atomically and is durable when it returns.
+func (r *rekeyObj) saveState() error {
+	buf, err := json.MarshalIndent(&r.state, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(r.rekeyDir, rekeyStateName)
+	f, err := os.OpenFile(path+".new", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(path+".new", path)
+	}
+	return err
+}
+
+func (r *rekeyObj) fail(relPath string, err error) {
+	fmt.Printf("rekey: %q: %v\n", relPath, err)
+	r.failed++
+}
+
+// rekey handles "gocryptfs -rekey CIPHERDIR": it replaces the master key with
+// a new one and re-encrypts all file contents and names with it.
+// Returns the exit code.
+func rekey(args *argContainer) (exitcode int) {
+	if args.reverse || args.masterkey != "" || args.zerokey || args.pkcs11 || args._configCustom {
+		// The new master key is locked with the password
+		tlog.Fatal.Printf("-rekey needs the password and the config file in CIPHERDIR, and cannot be used with " +
+			"-reverse, -masterkey, -zerokey, -pkcs11 or -config")
+		return exitcodes.Usage
+	}
+	checkReservedNames(args.cipherdir)
+	if _, err := os.Stat(filepath.Join(args.cipherdir, fusefrontend.QuarantineDirName)); err == nil {
+		// The quarantined files would become unreadable with the old key
+		tlog.Fatal.Printf("%s contains %s from -fsck -repair. Salvage what you need from it and delete it "+
+			"before running -rekey.", args.cipherdir, fusefrontend.QuarantineDirName)
+		return exitcodes.Rekey
+	}
+	lock, err := dirlock.Lock(args.cipherdir, lockTimeout)
+	if err == syscall.EWOULDBLOCK {
+		tlog.Fatal.Printf("%s is mounted read-write. Unmount it before running -rekey.", args.cipherdir)
+		return exitcodes.Locked
+	} else if err != nil {
+		tlog.Fatal.Printf("-rekey: %v", err)
+		return exitcodes.Locked
+	}
+	defer lock.Unlock()
+	r := &rekeyObj{
+		rekeyDir: filepath.Join(args.cipherdir, fusefrontend.RekeyDirName),
+		chown:    os.Geteuid() == 0,
+	}
+	resume, err := r.loadState()
+	if err != nil {
+		tlog.Fatal.Printf("-rekey: %v", err)
+		return exitcodes.Rekey
+	}
+	if resume {
+		tlog.Info.Printf("Continuing the interrupted -rekey (phase %q)", r.state.Phase)
+	}
+	if !resume || r.state.Phase == rekeyPhaseCopy {
+		if exitcode = r.copyPhase(args, resume); exitcode != 0 {
+			return exitcode
+		}
+	}
+	if r.state.Phase == rekeyPhaseClean {
+		if err = r.clean(args.cipherdir); err == nil {
+			r.state.Phase = rekeyPhaseMove
+			err = r.saveState()
+		}
+		if err != nil {
+			tlog.Fatal.Printf("-rekey: %v", err)
+			return exitcodes.Rekey
+		}
+	}
+	if err = r.move(args); err != nil {
+		tlog.Fatal.Printf("-rekey: %v", err)
+		return exitcodes.Rekey
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Master key replaced, %d files re-encrypted."+tlog.ColorReset, r.state.Files)
+	tlog.Info.Printf("Key epochs and the -tpm2-enroll and -pkcs11-enroll key slots of the old key have been removed.")
+	return 0
+}
+
+// copyPhase creates the new filesystem, if it does not exist yet, and copies
+// the files to it. Returns the exit code.
+func (r *rekeyObj) copyPhase(args *argContainer, resume bool) (exitcode int) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		return exitcodes.LoadConf
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFlatLayout) || cf.IsFeatureFlagSet(configfile.FlagSubvolumes) ||
+		cf.IsFeatureFlagSet(configfile.FlagReadOnly) || cf.IsFeatureFlagSet(configfile.FlagWORM) {
+		tlog.Fatal.Printf("-rekey does not work on filesystems created with -flat, with subvolumes, " +
+			"or made read-only or write-once (-make-readonly, -worm)")
+		return exitcodes.Usage
+	}
+	pw, err := configPassword(args, cf)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	defer func() {
+		for i := range pw {
+			pw[i] = 0
+		}
+	}()
+	tlog.Info.Println("Decrypting master key")
+	masterkey, err := cf.DecryptMasterKey(pw)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	newDir := filepath.Join(r.rekeyDir, rekeyNewName)
+	if !resume {
+		if err = r.create(cf, newDir, pw); err != nil {
+			tlog.Fatal.Printf("-rekey: %v", err)
+			return exitcodes.Rekey
+		}
+	}
+	// Copying through the mounts encrypts the names, the contents and the
+	// extended attributes with the new key
+	args._password = pw
+	args.allow_other = false
+	dstArgs := *args
+	dstArgs.cipherdir = newDir
+	dstArgs.config = filepath.Join(newDir, configfile.ConfDefaultName)
+	var srcCleanup, dstCleanup func()
+	r.src, srcCleanup = mountTemp(args, "rekey")
+	defer srcCleanup()
+	r.dst, dstCleanup = mountTemp(&dstArgs, "rekey")
+	defer dstCleanup()
+	r.progress = startProgress(args, "rekey")
+	r.progress.ScanTotal(r.src, nil)
+	stopSignals := abortOnSignal(&r.abort)
+	r.walk("")
+	r.progress.Stop()
+	stopSignals()
+	if r.abort || r.failed > 0 {
+		if err = r.saveState(); err != nil {
+			tlog.Warn.Printf("-rekey: %v", err)
+		}
+		if r.abort {
+			tlog.Info.Printf("-rekey: aborted. Run it again to continue.")
+			return exitcodes.Other
+		}
+		tlog.Info.Printf("-rekey summary: %d files copied, %d failed. Fix the errors and run -rekey again.",
+			r.state.Files, r.failed)
+		return exitcodes.Rekey
+	}
+	// Everything has been copied. What is left in CIPHERDIR must be ours.
+	if err = r.checkEmpty(args.cipherdir); err != nil {
+		tlog.Fatal.Printf("-rekey: %v", err)
+		return exitcodes.Rekey
+	}
+	r.state.Phase = rekeyPhaseClean
+	if err = r.saveState(); err != nil {
+		tlog.Fatal.Printf("-rekey: %v", err)
+		return exitcodes.Rekey
+	}
+	return 0
+}
+
+// create creates the new filesystem in "newDir", with the settings of "cf"
+// and a new master key locked with "pw", and the state
+func (r *rekeyObj) create(cf *configfile.ConfFile, newDir string, pw []byte) error {
+	// Left over from an interrupted -rekey that has not saved a state yet
+	if err := os.RemoveAll(r.rekeyDir); err != nil {
+		return err
+	}
+	if err := reserveddir.Mkdir(r.rekeyDir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(newDir, 0700); err != nil {
+		return err
+	}
+	newKey := cryptocore.RandBytes(cryptocore.KeyLen)
+	defer func() {
+		for i := range newKey {
+			newKey[i] = 0
+		}
+	}()
+	if err := cf.Rekey(filepath.Join(newDir, configfile.ConfDefaultName), newKey, pw); err != nil {
+		return err
+	}
+	if err := cf.WriteFile(); err != nil {
+		return err
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagDirIV) {
+		dirfd, err := syscall.Open(newDir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		if err != nil {
+			return err
+		}
+		err = nametransform.WriteDirIVAt(dirfd)
+		syscall.Close(dirfd)
+		if err != nil {
+			return err
+		}
+	}
+	r.state = rekeyState{Phase: rekeyPhaseCopy}
+	if err := r.saveState(); err != nil {
+		return err
+	}
+	tlog.PrintMasterkeyReminder(newKey)
+	return nil
+}
+
+// walk copies the contents of the directory "relPath" to the new
+// filesystem
+func (r *rekeyObj) walk(relPath string) {
+	f, err := os.Open(filepath.Join(r.src, relPath))
+	if err != nil {
+		r.fail(relPath, err)
+		return
+	}
+	entries, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		r.fail(relPath, err)
+		return
+	}
+	// Sort alphabetically to make the order of hard links deterministic
+	sort.Strings(entries)
+	for _, entry := range entries {
+		if r.abort {
+			return
+		}
+		r.entry(filepath.Join(relPath, entry))
+	}
+}
+
+// entry copies a single directory entry to the new filesystem, and deletes
+// it from the old one
+func (r *rekeyObj) entry(relPath string) {
+	src := filepath.Join(r.src, relPath)
+	dst := filepath.Join(r.dst, relPath)
+	var st unix.Stat_t
+	if err := unix.Lstat(src, &st); err != nil {
+		r.fail(relPath, err)
+		return
+	}
+	var err error
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		r.dir(relPath, &st)
+		return
+	case syscall.S_IFREG:
+		if first, ok := r.state.Hardlinks[uint64(st.Ino)]; ok {
+			// Copied before, maybe by an earlier run
+			os.Remove(dst)
+			err = os.Link(filepath.Join(r.dst, first), dst)
+			if err == nil {
+				err = syscall.Unlink(src)
+			}
+			if err != nil {
+				r.fail(relPath, err)
+				return
+			}
+			r.state.Files++
+			return
+		}
+		err = r.file(src, dst)
+	case syscall.S_IFLNK:
+		var target string
+		target, err = os.Readlink(src)
+		if err == nil {
+			os.Remove(dst)
+			err = os.Symlink(target, dst)
+		}
+	default:
+		// Device nodes, FIFOs and sockets
+		os.Remove(dst)
+		err = syscall.Mknod(dst, uint32(st.Mode), int(st.Rdev))
+	}
+	if err == nil && st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		err = copyXattrs(src, dst)
+	}
+	if err == nil {
+		err = r.setAttr(dst, &st)
+	}
+	if err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFREG && st.Nlink > 1 {
+		// Record the copy before the first link is deleted
+		if r.state.Hardlinks == nil {
+			r.state.Hardlinks = make(map[uint64]string)
+		}
+		r.state.Hardlinks[uint64(st.Ino)] = relPath
+		err = r.saveState()
+	}
+	if err == nil {
+		err = syscall.Unlink(src)
+	}
+	if err != nil {
+		r.fail(relPath, err)
+		return
+	}
+	r.state.Files++
+}
+
+// dir copies the directory "relPath" with the stat data "st" and its
+// contents to the new filesystem, and deletes it from the old one
+func (r *rekeyObj) dir(relPath string, st *unix.Stat_t) {
+	src := filepath.Join(r.src, relPath)
+	dst := filepath.Join(r.dst, relPath)
+	if err := os.Mkdir(dst, 0700); err != nil && !os.IsExist(err) {
+		r.fail(relPath, err)
+		return
+	}
+	mode, restore := r.state.DirModes[relPath]
+	if !restore && st.Mode&0300 != 0300 && !r.chown {
+		// We need to delete the contents. Remember the mode before.
+		if r.state.DirModes == nil {
+			r.state.DirModes = make(map[string]uint32)
+		}
+		mode, restore = uint32(st.Mode), true
+		r.state.DirModes[relPath] = mode
+		err := r.saveState()
+		if err == nil {
+			err = os.Chmod(src, 0700)
+		}
+		if err != nil {
+			r.fail(relPath, err)
+			return
+		}
+	}
+	failed := r.failed
+	r.walk(relPath)
+	if r.abort || r.failed > failed {
+		return
+	}
+	err := copyXattrs(src, dst)
+	if err == nil {
+		// After the contents, which change the times
+		err = r.setAttr(dst, st)
+	}
+	if err == nil && restore {
+		err = os.Chmod(dst, os.FileMode(mode&07777)|modeBits(mode))
+	}
+	if err == nil {
+		err = syscall.Rmdir(src)
+	}
+	if err != nil {
+		r.fail(relPath, err)
+		return
+	}
+	delete(r.state.DirModes, relPath)
+	r.state.Files++
+}
+
+// file copies the contents of the regular file "src" to "dst", and makes
+// them durable before "src" is deleted
+func (r *rekeyObj) file(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Truncate what an earlier run has left
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, r.progress.Reader(in))
+	if err == nil {
+		err = out.Sync()
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		r.state.Bytes += uint64(n)
+		r.progress.Add(1, 0)
+	}
+	return err
+}
+
+// setAttr sets owner, mode and timestamps of "dst" from "st"
+func (r *rekeyObj) setAttr(dst string, st *unix.Stat_t) error {
+	ex := exportObj{chown: r.chown}
+	return ex.setAttr(dst, st)
+}
+
+// copyXattrs copies the extended attributes of "src" to "dst"
+func copyXattrs(src string, dst string) error {
+	names, err := syscallcompat.Llistxattr(src)
+	if err == syscall.ENOTSUP {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, name := range names {
+		val, err := syscallcompat.Lgetxattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err = unix.Lsetxattr(dst, name, val, 0); err != nil {
+			return fmt.Errorf("xattr %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkEmpty checks that only gocryptfs.diriv and the reserved names are
+// left in "cipherdir". Everything else could not be decrypted and would be
+// lost.
+func (r *rekeyObj) checkEmpty(cipherdir string) error {
+	entries, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() != nametransform.DirIVFilename && !fusefrontend.IsReservedName(e.Name()) {
+			return fmt.Errorf("%q is left in CIPHERDIR, but the old filesystem does not show it. "+
+				"Move it away and run -rekey again.", e.Name())
+		}
+	}
+	return nil
+}
+
+// clean deletes the internal files of the old filesystem from "cipherdir",
+// like gocryptfs.diriv, the -merkle hash trees and the encrypted extended
+// attributes of the root directory. The new filesystem has its own.
+func (r *rekeyObj) clean(cipherdir string) error {
+	entries, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if name == configfile.ConfDefaultName || name == dirlock.FileName || name == fusefrontend.RekeyDirName {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(cipherdir, name)); err != nil {
+			return err
+		}
+	}
+	names, err := syscallcompat.Llistxattr(cipherdir)
+	if err != nil && err != syscall.ENOTSUP {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, xattrStorePrefix) {
+			continue
+		}
+		if err = unix.Lremovexattr(cipherdir, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move moves the new filesystem to CIPHERDIR. Its config file comes last.
+// Then gocryptfs.rekey is deleted, the state at the very end.
+func (r *rekeyObj) move(args *argContainer) error {
+	newDir := filepath.Join(r.rekeyDir, rekeyNewName)
+	entries, err := ioutil.ReadDir(newDir)
+	if os.IsNotExist(err) {
+		// Moved and deleted before
+		return os.RemoveAll(r.rekeyDir)
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Name() == configfile.ConfDefaultName {
+			continue
+		}
+		if err = os.Rename(filepath.Join(newDir, e.Name()), filepath.Join(args.cipherdir, e.Name())); err != nil {
+			return err
+		}
+	}
+	if err = copyXattrs(newDir, args.cipherdir); err != nil {
+		return err
+	}
+	err = os.Rename(filepath.Join(newDir, configfile.ConfDefaultName), args.config)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = os.RemoveAll(newDir); err != nil {
+		return err
+	}
+	return os.RemoveAll(r.rekeyDir)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	flag "github.com/spf13/pflag"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// RateLimitSetter is implemented by filesystems that can change -bwlimit and
+// -ioplimit while mounted
+type RateLimitSetter interface {
+	SetRateLimits(bwLimit uint64, iopLimit uint64)
+}
+
+// CacheMemSetter is implemented by filesystems that can change -cachemem
+// while mounted
+type CacheMemSetter interface {
+	SetCacheMem(max int64)
+}
+
+// ExcludeSetter is implemented by filesystems that can change -exclude,
+// -exclude-wildcard and -exclude-from while mounted
+type ExcludeSetter interface {
+	SetExcludes(exclude []string, excludeWildcard []string, excludeFrom []string) error
+}
+
+// reloadOpts are the options that a reload can change. They are part of
+// argContainer, and addReloadFlags() registers them.
+type reloadOpts struct {
+	loglevel string
+	// -cachemem (memory budget of the caches in bytes)
+	cachemem int64
+	// Idle time before autounmount
+	idle time.Duration
+	// -bwlimit (bytes per second) and -ioplimit (operations per second)
+	bwlimit, ioplimit uint64
+	// For reverse mode, several ways to specify exclusions. All can be
+	// specified multiple times.
+	exclude, excludeWildcard, excludeFrom []string
+}
+
+// isReloadOpt returns true if "name" is one of the options in reloadOpts,
+// or an alias of one
+func isReloadOpt(name string) bool {
+	return reloadFlagSet(&reloadOpts{}).Lookup(name) != nil
+}
+
+// reloadFlagSet returns a flag set that parses the options in reloadOpts
+// into "o", and skips all other options.
+func reloadFlagSet(o *reloadOpts) *flag.FlagSet {
+	flags := flag.NewFlagSet(tlog.ProgramName, flag.ContinueOnError)
+	flags.Usage = func() {}
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	addReloadFlags(flags, o)
+	return flags
+}
+
+// reloader applies changes of the defaults file (see "-nodefaults") and of
+// the mount defaults in the config file ("-mount-defaults") to the mount,
+// on SIGHUP or a ctlsock Reload request. The options in reloadOpts take
+// effect right away. For the others, and for new key epochs and subvolumes
+// in the config file, we tell the user to remount.
+type reloader struct {
+	// mu serializes reloads
+	mu   sync.Mutex
+	args *argContainer
+	// cur are the settings in effect
+	cur reloadOpts
+	// mountArgs are the options we have been mounted with
+	mountArgs []string
+	fs        fs.InodeEmbedder
+	srv       *fuse.Server
+	// idle is the -idle timeout in nanoseconds, read by idleMonitor(). Use
+	// atomic ops.
+	idle        int64
+	idleStarted bool
+}
+
+func newReloader(args *argContainer) *reloader {
+	return &reloader{
+		args: args,
+		cur:  args.reloadOpts,
+		idle: int64(args.idle),
+	}
+}
+
+// start is called once "fs" is mounted. It starts the idle monitor if
+// -idle is set, and from then on reloads on SIGHUP and ctlsock requests.
+func (r *reloader) start(fs fs.InodeEmbedder, srv *fuse.Server) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fs = fs
+	r.srv = srv
+	var mountDefaults []string
+	if r.args._mountConf != nil {
+		mountDefaults = r.args._mountConf.MountDefaults
+	}
+	var err error
+	if r.mountArgs, err = r.readArgs(mountDefaults); err != nil {
+		// The defaults file has changed since we have read it
+		tlog.Debug.Printf("reloader: %v", err)
+	}
+	r.startIdleMonitor()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			tlog.Info.Printf("Got SIGHUP, reloading")
+			if _, _, err := r.reload(); err != nil {
+				tlog.Warn.Printf("reload: %v", err)
+			}
+		}
+	}()
+}
+
+// startIdleMonitor starts idleMonitor() if -idle is set, unless it runs
+// already. Reverse mode has no idle monitor. The caller must hold r.mu.
+func (r *reloader) startIdleMonitor() {
+	if r.idleStarted || atomic.LoadInt64(&r.idle) <= 0 || r.args.reverse {
+		return
+	}
+	fwdFs, ok := r.fs.(*fusefrontend.RootNode)
+	if !ok {
+		return
+	}
+	r.idleStarted = true
+	go idleMonitor(&r.idle, fwdFs, r.srv, r.args.mountpoint)
+}
+
+// ctlsock handles ctlsock Reload requests
+func (r *reloader) ctlsock() (string, string, error) {
+	changed, remount, err := r.reload()
+	if err != nil {
+		return "", "", err
+	}
+	var warnText string
+	if len(remount) > 0 {
+		warnText = "Remount to apply: " + strings.Join(remount, ", ")
+	}
+	return strings.Join(changed, ","), warnText, nil
+}
+
+// reload reads the defaults file and the config file again, and applies the
+// settings that have changed. Returns the names of the options that have been
+// changed, and the changes that need a remount.
+func (r *reloader) reload() (changed []string, remount []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fs == nil {
+		return nil, nil, errors.New("not mounted yet")
+	}
+	if r.args.sandbox_user != "" {
+		// The files are outside of the chroot
+		return nil, nil, errors.New("reload is not possible with -sandbox-user")
+	}
+	var mountDefaults []string
+	if r.args._mountConf != nil {
+		cf, err := configfile.Load(r.args.config)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = cf.VerifyMountDefaultsKey(r.args._mountDefaultsKey); err != nil {
+			return nil, nil, err
+		}
+		mountDefaults = cf.MountDefaults
+		remount = r.checkConf(cf)
+	}
+	args, err := r.readArgs(mountDefaults)
+	if err != nil {
+		return nil, nil, err
+	}
+	remount = append(remount, r.otherChanges(args)...)
+	var o reloadOpts
+	if err = reloadFlagSet(&o).Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if o.cachemem <= 0 {
+		return nil, nil, fmt.Errorf("-cachemem must be positive")
+	}
+	if o.idle < 0 {
+		return nil, nil, fmt.Errorf("-idle must not be negative")
+	}
+	changed, unsupported, err := r.apply(o)
+	if len(unsupported) > 0 {
+		tlog.Info.Printf("reload: this mount does not support %s", strings.Join(unsupported, ", "))
+	}
+	if len(changed) > 0 {
+		tlog.Info.Printf("reload: changed %s", strings.Join(changed, ", "))
+	} else if err == nil {
+		tlog.Info.Printf("reload: nothing changed")
+	}
+	if len(remount) > 0 {
+		tlog.Info.Printf(tlog.ColorYellow+"reload: remount to apply: %s"+tlog.ColorReset, strings.Join(remount, ", "))
+	}
+	return changed, remount, err
+}
+
+// readArgs returns our options in the order main() has applied them: the
+// mount defaults "mountDefaults" first, then the defaults file and the
+// environment, then the command line. Converted to pflag syntax, without
+// the program name.
+func (r *reloader) readArgs(mountDefaults []string) ([]string, error) {
+	osArgs, err := prefixOArgs(os.Args)
+	if err != nil {
+		return nil, err
+	}
+	osArgs = convertToDoubleDash(osArgs)[1:]
+	var out []string
+	for _, o := range mountDefaults {
+		out = append(out, "--"+o)
+	}
+	if !r.args.nodefaults {
+		// The defaults file and the environment do not override options that
+		// are given on the command line
+		var o reloadOpts
+		flags := reloadFlagSet(&o)
+		if err = flags.Parse(osArgs); err != nil {
+			return nil, err
+		}
+		cmdline := map[string]bool{}
+		flags.Visit(func(f *flag.Flag) {
+			name := f.Name
+			if long, ok := userDefaultsAliases[name]; ok {
+				name = long
+			}
+			cmdline[name] = true
+		})
+		defaults, err := userDefaultsArgs(cmdline)
+		if err != nil {
+			return nil, fmt.Errorf("defaults file: %v", err)
+		}
+		out = append(out, convertToDoubleDash(defaults)...)
+	}
+	return append(out, osArgs...), nil
+}
+
+// otherChanges returns the names of the options in "args" that are not in
+// reloadOpts and have changed since we were mounted
+func (r *reloader) otherChanges(args []string) (names []string) {
+	if r.mountArgs == nil {
+		return nil
+	}
+	count := func(args []string) map[string]int {
+		m := map[string]int{}
+		for _, a := range args {
+			if !strings.HasPrefix(a, "-") {
+				continue
+			}
+			name := strings.SplitN(strings.TrimLeft(a, "-"), "=", 2)[0]
+			if !isReloadOpt(name) {
+				m[a]++
+			}
+		}
+		return m
+	}
+	old := count(r.mountArgs)
+	cur := count(args)
+	seen := map[string]bool{}
+	for _, m := range []map[string]int{old, cur} {
+		for a := range m {
+			name := strings.SplitN(strings.TrimLeft(a, "-"), "=", 2)[0]
+			if old[a] != cur[a] && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkConf compares the config file "cf" with the one we have been mounted
+// with, and returns the changes that need a remount
+func (r *reloader) checkConf(cf *configfile.ConfFile) (remount []string) {
+	old := r.args._mountConf
+	if cf.KeyEpoch != old.KeyEpoch {
+		remount = append(remount, fmt.Sprintf("key epoch %d", cf.KeyEpoch))
+	}
+	for _, sv := range cf.Subvolumes {
+		if sv2 := old.Subvolume(sv.Path); sv2 == nil || sv2.Path != sv.Path {
+			remount = append(remount, fmt.Sprintf("subvolume %q", sv.Path))
+		}
+	}
+	return remount
+}
+
+// apply changes the settings that differ between "o" and r.cur. Returns
+// the names of the changed options, and of the options the filesystem does
+// not support changing. Stops at the first error.
+func (r *reloader) apply(o reloadOpts) (changed []string, unsupported []string, err error) {
+	if !reflect.DeepEqual(o.exclude, r.cur.exclude) || !reflect.DeepEqual(o.excludeWildcard, r.cur.excludeWildcard) ||
+		!reflect.DeepEqual(o.excludeFrom, r.cur.excludeFrom) || len(o.excludeFrom) > 0 {
+		// The -exclude-from files may have changed as well
+		if e, ok := r.fs.(ExcludeSetter); ok {
+			if err = e.SetExcludes(o.exclude, o.excludeWildcard, o.excludeFrom); err != nil {
+				return changed, unsupported, fmt.Errorf("-exclude-from: %v", err)
+			}
+			changed = append(changed, "exclude")
+		} else if len(o.exclude)+len(o.excludeWildcard)+len(o.excludeFrom) > 0 {
+			unsupported = append(unsupported, "exclude")
+		}
+		r.cur.exclude, r.cur.excludeWildcard, r.cur.excludeFrom = o.exclude, o.excludeWildcard, o.excludeFrom
+	}
+	if o.loglevel != r.cur.loglevel {
+		levels, err := tlog.ParseModuleLevels(o.loglevel)
+		if err != nil {
+			return changed, unsupported, fmt.Errorf("-loglevel: %v", err)
+		}
+		// Modules that are no longer listed go back to the default
+		all := tlog.ModuleLevels()
+		for name := range all {
+			all[name] = "default"
+		}
+		for name, level := range levels {
+			all[name] = level
+		}
+		if err = tlog.SetModuleLevels(all); err != nil {
+			return changed, unsupported, fmt.Errorf("-loglevel: %v", err)
+		}
+		r.cur.loglevel = o.loglevel
+		changed = append(changed, "loglevel")
+	}
+	if o.cachemem != r.cur.cachemem {
+		if c, ok := r.fs.(CacheMemSetter); ok {
+			c.SetCacheMem(o.cachemem)
+			changed = append(changed, "cachemem")
+		} else {
+			unsupported = append(unsupported, "cachemem")
+		}
+		r.cur.cachemem = o.cachemem
+	}
+	if o.bwlimit != r.cur.bwlimit || o.ioplimit != r.cur.ioplimit {
+		if l, ok := r.fs.(RateLimitSetter); ok {
+			l.SetRateLimits(o.bwlimit, o.ioplimit)
+			if o.bwlimit != r.cur.bwlimit {
+				changed = append(changed, "bwlimit")
+			}
+			if o.ioplimit != r.cur.ioplimit {
+				changed = append(changed, "ioplimit")
+			}
+		} else {
+			unsupported = append(unsupported, "bwlimit")
+		}
+		r.cur.bwlimit, r.cur.ioplimit = o.bwlimit, o.ioplimit
+	}
+	if o.idle != r.cur.idle {
+		if _, ok := r.fs.(*fusefrontend.RootNode); !ok || r.args.reverse {
+			unsupported = append(unsupported, "idle")
+		} else {
+			atomic.StoreInt64(&r.idle, int64(o.idle))
+			r.startIdleMonitor()
+			changed = append(changed, "idle")
+		}
+		r.cur.idle = o.idle
+	}
+	return changed, unsupported, nil
+}
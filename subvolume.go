@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// addSubvolume handles "gocryptfs -add-subvolume PATH CIPHERDIR": the
+// directory PATH gets its own key, which is locked with a new password.
+// PATH is created if it does not exist, and must be empty otherwise.
+// Does not return (calls os.Exit both on success and on error).
+func addSubvolume(args *argContainer) {
+	if args.masterkey != "" || args.zerokey {
+		// The directory is created through a mount, and the config file
+		// must be written
+		tlog.Fatal.Printf("-add-subvolume needs the password and cannot be used with -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse {
+		tlog.Fatal.Printf("-add-subvolume does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFlatLayout) {
+		tlog.Fatal.Printf("-add-subvolume does not work on filesystems created with -flat")
+		os.Exit(exitcodes.Usage)
+	}
+	p := configfile.NormalizeSubvolumePath(args.add_subvolume)
+	if err = cf.CheckNewSubvolume(p); err != nil {
+		tlog.Fatal.Printf("-add-subvolume: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	// Create the directory through a temporary mount, which asks for the
+	// password of the filesystem. Its name is encrypted with the key of the
+	// parent directory.
+	mntArgs := *args
+	mntArgs.allow_other = false
+	mntArgs.ro = false
+	mnt, cleanup := mountTemp(&mntArgs, "add-subvolume")
+	err = mkSubvolumeDir(filepath.Join(mnt, p))
+	cleanup()
+	if err != nil {
+		tlog.Fatal.Printf("-add-subvolume: %q: %v", p, err)
+		os.Exit(exitcodes.Usage)
+	}
+	if len(args.extpass) == 0 && len(args.passfile) == 0 {
+		tlog.Info.Printf("Choose a password for the subvolume %q.", p)
+	}
+	pw, err := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	err = cf.AddSubvolume(p, pw, args.scryptn)
+	for i := range pw {
+		pw[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Usage)
+	}
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Subvolume %q added. Mount with \"-unlock %s\" to access it."+tlog.ColorReset, p, p)
+	tlog.Info.Printf("Filesystems that are mounted right now must be mounted again before files are put into %q.", p)
+	os.Exit(0)
+}
+
+// mkSubvolumeDir creates the directory "dir", or checks that it is empty.
+// The errors do not contain the path, which is in the temporary mount.
+func mkSubvolumeDir(dir string) error {
+	err := syscall.Mkdir(dir, 0700)
+	if err != syscall.EEXIST {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	} else if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("directory is not empty")
+	}
+	return nil
+}
+
+// initSubvolumes adds the subvolumes of "cf" to the filesystem. The ones
+// named by "-unlock" are unlocked with their password and get crypto
+// helpers like a "-union" branch. The others stay locked until they are
+// unlocked through the control socket. The frontend wipes the keys.
+// Calls os.Exit on errors.
+func initSubvolumes(args *argContainer, cf *configfile.ConfFile, cryptoBackend cryptocore.AEADTypeEnum,
+	IVBits int, rn *fusefrontend.RootNode) {
+	if cf == nil {
+		// "-masterkey" or "-zerokey"
+		if len(args.unlock) > 0 {
+			tlog.Fatal.Printf("-unlock cannot be used together with -masterkey or -zerokey")
+			os.Exit(exitcodes.Usage)
+		}
+		return
+	}
+	unlock := make(map[string]bool)
+	for _, p := range args.unlock {
+		p = configfile.NormalizeSubvolumePath(p)
+		if sv := cf.Subvolume(p); sv == nil || sv.Path != p {
+			tlog.Fatal.Printf("-unlock: %q is not a subvolume", p)
+			os.Exit(exitcodes.Usage)
+		}
+		unlock[p] = true
+	}
+	if len(cf.Subvolumes) == 0 {
+		return
+	}
+	if args.reencrypt {
+		// The files in subvolumes are not in any key epoch
+		tlog.Fatal.Printf("Filesystems with subvolumes cannot be mounted with -reencrypt")
+		os.Exit(exitcodes.Usage)
+	}
+	// keyFunc is also used by the control socket to unlock subvolumes at
+	// runtime
+	keyFunc := func(p string, pw []byte) (*contentenc.ContentEnc, *nametransform.NameTransform, func(), error) {
+		sv := cf.Subvolume(p)
+		if sv == nil || sv.Path != p {
+			return nil, nil, nil, fmt.Errorf("%q is not a subvolume", p)
+		}
+		key, err := sv.DecryptKey(pw)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		cCore, cEnc, nameTransform := newKeyCrypto(args, cf, key, cryptoBackend, IVBits)
+		return cEnc, nameTransform, cCore.Wipe, nil
+	}
+	rn.SetSubvolumeKeyFunc(keyFunc)
+	for _, sv := range cf.Subvolumes {
+		if !unlock[sv.Path] {
+			tlog.Info.Printf("Subvolume %q is locked", sv.Path)
+			rn.AddSubvolume(sv.Path, nil, nil, nil)
+			continue
+		}
+		pw, err := readpassword.Once([]string(args.extpass), []string(args.passfile), "Password for subvolume "+sv.Path)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.ReadPassword)
+		}
+		tlog.Info.Printf("Decrypting key of subvolume %q", sv.Path)
+		cEnc, nameTransform, wipe, err := keyFunc(sv.Path, pw)
+		for i := range pw {
+			pw[i] = 0
+		}
+		if err != nil {
+			tlog.Fatal.Println(err)
+			exitcodes.Exit(err)
+		}
+		rn.AddSubvolume(sv.Path, cEnc, nameTransform, wipe)
+	}
+}
+
+// doSubvolumeLock handles "-lock-subvolume PATH" and "-unlock-subvolume PATH"
+// with {MOUNTPOINT | -ctlsock SOCKET}: it asks the gocryptfs process to lock
+// or unlock the subvolume at runtime. Returns the exit code.
+func doSubvolumeLock(args *argContainer) int {
+	usageErr := flagSet.NArg() != 1 || args.ctlsock != ""
+	if args.ctlsock != "" {
+		usageErr = flagSet.NArg() != 0
+	}
+	if args.lock_subvolume != "" && args.unlock_subvolume != "" {
+		usageErr = true
+	}
+	if usageErr {
+		tlog.Fatal.Printf("Usage: %s -lock-subvolume PATH {MOUNTPOINT | -ctlsock SOCKET}\n"+
+			"       %s -unlock-subvolume PATH {MOUNTPOINT | -ctlsock SOCKET}",
+			tlog.ProgramName, tlog.ProgramName)
+		return exitcodes.Usage
+	}
+	sock := args.ctlsock
+	if sock == "" {
+		var err error
+		_, sock, err = findMount(flagSet.Arg(0))
+		if err != nil {
+			tlog.Fatal.Printf("%v", err)
+			return exitcodes.MountPoint
+		}
+		if sock == "" {
+			tlog.Fatal.Printf("Could not find the control socket of %q. Locking subvolumes needs a mount with -ctlsock.",
+				flagSet.Arg(0))
+			return exitcodes.CtlSock
+		}
+	}
+	req := ctlsock.RequestStruct{LockSubvolume: args.lock_subvolume}
+	if args.unlock_subvolume != "" {
+		p := args.unlock_subvolume
+		pw, err := readpassword.Once([]string(args.extpass), []string(args.passfile), "Password for subvolume "+p)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			return exitcodes.ReadPassword
+		}
+		req = ctlsock.RequestStruct{UnlockSubvolume: p, Password: string(pw)}
+		for i := range pw {
+			pw[i] = 0
+		}
+	}
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		return exitcodes.CtlSock
+	}
+	defer c.Close()
+	if _, err = c.Query(&req); err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		if resp, ok := err.(*ctlsock.ResponseStruct); ok && resp.ErrNo == int32(syscall.EBUSY) {
+			tlog.Info.Printf("Close the files in the subvolume and try again.")
+		}
+		return exitcodes.CtlSock
+	}
+	if args.lock_subvolume != "" {
+		tlog.Info.Printf("Subvolume %q locked", args.lock_subvolume)
+	} else {
+		tlog.Info.Printf("Subvolume %q unlocked", args.unlock_subvolume)
+	}
+	return 0
+}
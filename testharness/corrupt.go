@@ -0,0 +1,109 @@
+package testharness
+
+// Corruption injectors. They modify files in CIPHERDIR to check that
+// gocryptfs detects the damage (EIO on read, "-fsck" errors). Use
+// ctlsock.RequestStruct.EncryptPath or a directory listing to find the
+// ciphertext path of a file.
+//
+// Mount() passes "-wpanic", which turns the warning about corrupted data
+// into a crash. Mount with "-wpanic=false" to test corruption.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+// CipherBlockSize is the size of a ciphertext block with the default
+// AES-GCM content encryption: 4096 bytes of data plus nonce and tag
+const CipherBlockSize = contentenc.DefaultBS + 32
+
+// FlipByte inverts the byte at offset "off" of the file "path"
+func FlipByte(path string, off int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		return fmt.Errorf("%s: cannot read offset %d: %v", path, off, err)
+	}
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, off)
+	return err
+}
+
+// CorruptHeader damages the file ID in the header of the encrypted file
+// "path". Reading any block of the file fails afterwards.
+func CorruptHeader(path string) error {
+	return FlipByte(path, contentenc.HeaderLen-1)
+}
+
+// CorruptBlock damages the data of block number "block" of the encrypted
+// file "path". Reading this block fails afterwards, the others still work.
+// It flips the byte in the middle of the block, which also hits the data
+// of the other content ciphers, whose blocks are a little larger.
+func CorruptBlock(path string, block int64) error {
+	off := contentenc.HeaderLen + block*CipherBlockSize
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// The last block may be short
+	end := off + CipherBlockSize
+	if end > fi.Size() {
+		end = fi.Size()
+	}
+	if end <= off {
+		return fmt.Errorf("%s: block %d does not exist", path, block)
+	}
+	return FlipByte(path, (off+end)/2)
+}
+
+// Truncate cuts "n" bytes off the end of the file "path", like an
+// interrupted write does
+func Truncate(path string, n int64) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if n > fi.Size() {
+		n = fi.Size()
+	}
+	return os.Truncate(path, fi.Size()-n)
+}
+
+// CorruptDirIV overwrites the gocryptfs.diriv file of the ciphertext
+// directory "dir" with a too short value. The names in the directory cannot
+// be decrypted afterwards.
+func CorruptDirIV(dir string) error {
+	path := filepath.Join(dir, nametransform.DirIVFilename)
+	return overwrite(path, []byte("corrupt"))
+}
+
+// CorruptLongName overwrites the ".name" file that belongs to the long name
+// file "path" (gocryptfs.longname.*) with the name of another file. The file
+// disappears from the directory listing afterwards.
+func CorruptLongName(path string) error {
+	return overwrite(path+nametransform.LongNameSuffix, []byte("c29tZXRoaW5nIGVsc2U"))
+}
+
+// overwrite replaces the content of the existing file "path" with "data",
+// keeping its permissions
+func overwrite(path string, data []byte) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// The file may be read-only, like gocryptfs.diriv
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	defer os.Chmod(path, fi.Mode().Perm())
+	return ioutil.WriteFile(path, data, 0)
+}
@@ -0,0 +1,80 @@
+package testharness
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+func TestCorruptBlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	// Header, one full block and a short one
+	size := contentenc.HeaderLen + CipherBlockSize + 100
+	orig := make([]byte, size)
+	if err := ioutil.WriteFile(path, orig, 0600); err != nil {
+		t.Fatal(err)
+	}
+	check := func(wantOff int) {
+		t.Helper()
+		have, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range have {
+			if want := byte(0); i == wantOff {
+				want = 0xff
+				if have[i] != want {
+					t.Errorf("offset %d should be flipped", i)
+				}
+			} else if have[i] != want {
+				t.Errorf("offset %d should not be flipped", i)
+			}
+		}
+		ioutil.WriteFile(path, orig, 0600)
+	}
+	if err := CorruptHeader(path); err != nil {
+		t.Fatal(err)
+	}
+	check(contentenc.HeaderLen - 1)
+	if err := CorruptBlock(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	check(contentenc.HeaderLen + CipherBlockSize/2)
+	if err := CorruptBlock(path, 1); err != nil {
+		t.Fatal(err)
+	}
+	check(contentenc.HeaderLen + CipherBlockSize + 50)
+	if err := CorruptBlock(path, 2); err == nil {
+		t.Error("block 2 does not exist")
+	}
+	if err := Truncate(path, 10); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != int64(size-10) {
+		t.Errorf("wrong size %d after Truncate", fi.Size())
+	}
+}
+
+func TestCorruptDirIV(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, nametransform.DirIVFilename)
+	iv := bytes.Repeat([]byte{1}, nametransform.DirIVLen)
+	if err := ioutil.WriteFile(path, iv, 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err := CorruptDirIV(dir); err != nil {
+		t.Fatal(err)
+	}
+	have, _ := ioutil.ReadFile(path)
+	if len(have) == nametransform.DirIVLen {
+		t.Error("the diriv should have the wrong length")
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0400 {
+		t.Errorf("the permissions should be kept, have %o", fi.Mode().Perm())
+	}
+}
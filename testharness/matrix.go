@@ -0,0 +1,77 @@
+package testharness
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Variant is a combination of gocryptfs options that RunMatrix() tests
+type Variant struct {
+	// Name is the name of the subtest
+	Name string
+	// InitArgs are passed to "gocryptfs -init"
+	InitArgs []string
+	// MountArgs are passed to gocryptfs when mounting
+	MountArgs []string
+}
+
+// DefaultMatrix covers the ciphers, the filename encryption modes and a
+// few mount options that change how files are accessed.
+var DefaultMatrix = []Variant{
+	{Name: "default"},
+	{Name: "openssl=false", MountArgs: []string{"-openssl=false"}},
+	{Name: "plaintextnames", InitArgs: []string{"-plaintextnames"}},
+	{Name: "aessiv", InitArgs: []string{"-aessiv"}},
+	{Name: "xchacha", InitArgs: []string{"-xchacha"}},
+	{Name: "raw64=false", InitArgs: []string{"-raw64=false"}},
+	{Name: "deterministic-names", InitArgs: []string{"-deterministic-names"}},
+	{Name: "serialize_reads", MountArgs: []string{"-serialize_reads"}},
+	{Name: "sharedstorage", MountArgs: []string{"-sharedstorage"}},
+}
+
+// WithMountArgs returns a copy of "variants" with "args" added to the
+// MountArgs of every variant
+func WithMountArgs(variants []Variant, args ...string) []Variant {
+	out := make([]Variant, len(variants))
+	for i, v := range variants {
+		out[i] = v
+		out[i].MountArgs = append(append([]string{}, v.MountArgs...), args...)
+	}
+	return out
+}
+
+// RunMatrix runs "f" as a subtest for every variant. Each subtest gets a new
+// filesystem in CIPHERDIR "cDir", created with the InitArgs of the variant
+// and mounted on "pDir" with its MountArgs. The filesystem is unmounted and
+// deleted when "f" returns.
+func RunMatrix(t *testing.T, variants []Variant, f func(t *testing.T, cDir string, pDir string)) {
+	for _, v := range variants {
+		v := v
+		t.Run(v.Name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "gocryptfs-matrix.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cDir := filepath.Join(parent, "cipher")
+			pDir := filepath.Join(parent, "plain")
+			if err := Init(cDir, v.InitArgs...); err != nil {
+				t.Fatalf("init: %v", err)
+			}
+			args := append(append([]string{}, PasswordArgs...), v.MountArgs...)
+			MountOrFatal(t, cDir, pDir, args...)
+			defer func() {
+				err := Unmount(pDir)
+				delete(Processes, pDir)
+				if err != nil {
+					// Do not delete files through a mount that is still there
+					t.Errorf("unmount: %v", err)
+					return
+				}
+				os.RemoveAll(parent)
+			}()
+			f(t, cDir, pDir)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Package testharness runs end-to-end tests against a gocryptfs binary: it
+// creates and mounts filesystems, runs tests for a matrix of options, and
+// corrupts ciphertext files to check that the damage is detected.
+//
+// It is meant for projects that package or embed gocryptfs and want to test
+// their build. The gocryptfs tests themselves use it through
+// tests/test_helpers. Mounting needs FUSE and, on Linux, fusermount.
+//
+// Example:
+//
+//	func TestMyBuild(t *testing.T) {
+//		testharness.Binary = "/usr/bin/gocryptfs"
+//		testharness.RunMatrix(t, testharness.DefaultMatrix, func(t *testing.T, cDir, pDir string) {
+//			// Use the filesystem mounted at pDir
+//		})
+//	}
+package testharness
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+)
+
+// Binary is the gocryptfs binary that is tested. It defaults to
+// $GOCRYPTFS_BINARY, or "gocryptfs" from $PATH if that is not set.
+var Binary = defaultBinary()
+
+func defaultBinary() string {
+	if b := os.Getenv("GOCRYPTFS_BINARY"); b != "" {
+		return b
+	}
+	return "gocryptfs"
+}
+
+// Password is the password of the filesystems created by Init(). Pass
+// PasswordArgs to gocryptfs to mount them.
+const Password = "test"
+
+// PasswordArgs are the gocryptfs options that supply Password
+var PasswordArgs = []string{"-extpass", "echo " + Password}
+
+// Init creates a gocryptfs filesystem in the empty or not yet existing
+// directory "dir" by calling
+//
+//	gocryptfs -q -init -extpass "echo test" -scryptn=10 $extraArgs $dir
+//
+// The low scrypt cost makes the tests fast, do not use it for real data.
+func Init(dir string, extraArgs ...string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	args := []string{"-q", "-init"}
+	args = append(args, PasswordArgs...)
+	args = append(args, "-scryptn=10")
+	args = append(args, extraArgs...)
+	args = append(args, dir)
+	cmd := exec.Command(Binary, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// InitFS creates a new filesystem in a temporary directory below "parent"
+// (os.TempDir() if empty) using Init(), and returns its path without a
+// trailing slash.
+//
+// If t is set, t.Fatal() is called on error, log.Panic() otherwise.
+func InitFS(t *testing.T, parent string, extraArgs ...string) string {
+	prefix := "x."
+	if t != nil {
+		t.Helper()
+		prefix = t.Name() + "."
+	}
+	dir, err := ioutil.TempDir(parent, prefix)
+	if err == nil {
+		err = Init(dir, extraArgs...)
+	}
+	if err != nil {
+		if t != nil {
+			t.Fatalf("InitFS with args %q failed: %v", extraArgs, err)
+		} else {
+			log.Panic(err)
+		}
+	}
+	return dir
+}
+
+// QueryCtlSock sends a request to the control socket at "socketPath" and
+// returns the response.
+func QueryCtlSock(t *testing.T, socketPath string, req ctlsock.RequestStruct) ctlsock.ResponseStruct {
+	t.Helper()
+	c, err := ctlsock.New(socketPath)
+	if err != nil {
+		// Connecting to the socket failed already. This is fatal.
+		t.Fatal(err)
+	}
+	defer c.Close()
+	resp, err := c.Query(&req)
+	if err != nil {
+		// If we got a response, try to extract it. This is not fatal here
+		// as the tests may expect error responses.
+		if resp2, ok := err.(*ctlsock.ResponseStruct); ok {
+			return *resp2
+		}
+		// Another error means that we did not even get a response. This is fatal.
+		t.Fatal(err)
+	}
+	return *resp
+}
+
+// ExtractCmdExitCode extracts the exit code from an error value that was
+// returned from exec / cmd.Run()
+func ExtractCmdExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	// OMG this is convoluted
+	if err2, ok := err.(*exec.ExitError); ok {
+		return err2.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+	if err2, ok := err.(*os.PathError); ok {
+		return int(err2.Err.(syscall.Errno))
+	}
+	log.Panicf("could not decode error %#v", err)
+	return 0
+}
@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"io/ioutil"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/aegis"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Create and mount "-aegis" fs, check the config file and see if we get the
+// expected file sizes (AEGIS-256 has 256-bit IVs).
+func TestAegis(t *testing.T) {
+	if !aegis.Accelerated() {
+		t.Skip("-aegis needs AES acceleration")
+	}
+	cDir := test_helpers.InitFS(t, "-aegis", "-plaintextnames")
+	_, c, err := configfile.LoadAndDecrypt(cDir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.IsFeatureFlagSet(configfile.FlagGCMIV128) {
+		t.Error("GCMIV128 flag should be off")
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagAEGIS256) {
+		t.Error("AEGIS256 flag should be on")
+	}
+
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := ioutil.WriteFile(pDir+"/1byte", []byte("x"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(cDir+"/1byte", &st); err != nil {
+		t.Fatal(err)
+	}
+	// 2 byte version header + 16 byte file id + 256 bit aegis iv + 1 byte payload + 16 byte mac
+	if st.Size != 2+16+32+1+16 {
+		t.Errorf("wrong size %d", st.Size)
+	}
+	content, err := ioutil.ReadFile(pDir + "/1byte")
+	if err != nil || string(content) != "x" {
+		t.Errorf("read back %q, %v", content, err)
+	}
+}
@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Create and mount "-aes128" fs, and check that the feature flag is set
+func TestAes128(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-aes128")
+	_, c, err := configfile.LoadAndDecrypt(cDir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagAES128) || !c.IsFeatureFlagSet(configfile.FlagGCMIV128) {
+		t.Errorf("wrong feature flags %v", c.FeatureFlags)
+	}
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err = ioutil.WriteFile(pDir+"/foo", []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	content, err := ioutil.ReadFile(pDir + "/foo")
+	test_helpers.UnmountPanic(pDir)
+	if err != nil || string(content) != "bar" {
+		t.Errorf("read back %q, %v", content, err)
+	}
+}
@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/dirlock"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// atimeTest sets the access and modification times of the only file in
+// cDir, unless "atime" is zero, reads it through a mount with "opts", and
+// returns the new access time.
+func atimeTest(t *testing.T, cDir string, atime time.Time, mtime time.Time, opts ...string) time.Time {
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cFile string
+	for _, e := range entries {
+		if e.Name() != configfile.ConfDefaultName && e.Name() != nametransform.DirIVFilename &&
+			e.Name() != dirlock.FileName {
+			cFile = filepath.Join(cDir, e.Name())
+		}
+	}
+	if !atime.IsZero() {
+		err = syscall.UtimesNano(cFile, []syscall.Timespec{
+			syscall.NsecToTimespec(atime.UnixNano()), syscall.NsecToTimespec(mtime.UnixNano())})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pDir := cDir + ".mnt"
+	opts = append([]string{"-extpass", "echo test"}, opts...)
+	test_helpers.MountOrFatal(t, cDir, pDir, opts...)
+	if _, err = ioutil.ReadFile(pDir + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	var st syscall.Stat_t
+	if err = syscall.Stat(cFile, &st); err != nil {
+		t.Fatal(err)
+	}
+	return time.Unix(st.Atim.Unix())
+}
+
+// Test that -noatime and -relatime control the access time of backing files
+func TestAtime(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := ioutil.WriteFile(pDir+"/file", []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	now := time.Now()
+	old := now.Add(-72 * time.Hour)
+	// The access time is older than the modification time, so a read on a
+	// relatime backing filesystem would update it
+	if have := atimeTest(t, cDir, old, old.Add(time.Hour), "-noatime"); !have.Equal(old) {
+		t.Errorf("-noatime: atime changed to %v", have)
+	}
+	recent := atimeTest(t, cDir, old, old.Add(time.Hour), "-relatime")
+	if recent.Before(now) {
+		t.Errorf("-relatime: atime not updated: %v", recent)
+	}
+	// The access time is now recent and newer than the modification and
+	// change time
+	if have := atimeTest(t, cDir, time.Time{}, time.Time{}, "-relatime"); !have.Equal(recent) {
+		t.Errorf("-relatime: atime changed to %v", have)
+	}
+}
@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/auditlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that -auditlog records destructive operations, and that -fsck and
+// the next mount detect tampering with the log
+func TestAuditLog(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-auditlog")
+	file := pDir + "/file"
+	if err := ioutil.WriteFile(file, []byte("12345"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(file, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(file, file+"2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(file + "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(pDir + "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	// The log is hidden
+	entries, err := ioutil.ReadDir(pDir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir: %d entries, %v", len(entries), err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	logPath := filepath.Join(cDir, auditlog.FileName)
+	content, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(content, []byte("\n")); n != 4 {
+		t.Errorf("want 4 records, have %d:\n%s", n, content)
+	}
+	fsck := func() int {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", cDir)
+		out, err := cmd.CombinedOutput()
+		t.Log(string(out))
+		return test_helpers.ExtractCmdExitCode(err)
+	}
+	if code := fsck(); code != 0 {
+		t.Errorf("fsck: exit code %d", code)
+	}
+	// Tamper with the first record
+	content = bytes.Replace(content, []byte(`"Op":"truncate"`), []byte(`"Op":"rmdir"`), 1)
+	if err = ioutil.WriteFile(logPath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := fsck(); code != exitcodes.FsckErrors {
+		t.Errorf("fsck: want exit code %d, have %d", exitcodes.FsckErrors, code)
+	}
+	err = test_helpers.Mount(cDir, pDir, false, "-extpass", "echo test", "-auditlog")
+	if test_helpers.ExtractCmdExitCode(err) != exitcodes.AuditLog {
+		t.Errorf("mount: want exit code %d, have %v", exitcodes.AuditLog, err)
+	}
+}
@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that -bindpath keeps the names of files and detects files that have
+// been swapped between directories
+func TestBindPath(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-bindpath")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	for _, d := range []string{"d1", "d2"} {
+		if err := os.Mkdir(pDir+"/"+d, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pDir+"/"+d+"/f", []byte(d), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isExdev := func(err error) bool {
+		le, ok := err.(*os.LinkError)
+		return ok && le.Err == syscall.EXDEV
+	}
+	// Renames re-encrypt the file for its new name
+	if err := os.Rename(pDir+"/d1/f", pDir+"/d2/g"); err != nil {
+		t.Errorf("rename to a different directory: %v", err)
+	}
+	if err := os.Rename(pDir+"/d2/g", pDir+"/d1/f"); err != nil {
+		t.Errorf("rename back: %v", err)
+	}
+	if err := os.Link(pDir+"/d1/f", pDir+"/d2/g"); !isExdev(err) {
+		t.Errorf("link to a different directory: want EXDEV, have %v", err)
+	}
+	if err := os.Link(pDir+"/d1/f", pDir+"/d1/g"); !isExdev(err) {
+		t.Errorf("link inside a directory: want EXDEV, have %v", err)
+	}
+	// Open files cannot be re-encrypted
+	fd, err := os.Open(pDir + "/d1/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(pDir+"/d1/f", pDir+"/d1/g"); !isExdev(err) {
+		t.Errorf("rename of an open file: want EXDEV, have %v", err)
+	}
+	fd.Close()
+	for _, d := range []string{"d1", "d2"} {
+		if content, err := ioutil.ReadFile(pDir + "/" + d + "/f"); err != nil || string(content) != d {
+			t.Errorf("%s/f: have %q, %v", d, content, err)
+		}
+	}
+	// Renames of directories work
+	if err := os.Mkdir(pDir+"/d3", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(pDir+"/d3", pDir+"/d1/d3"); err != nil {
+		t.Error(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// Swap the contents of d1/f and d2/f behind our back
+	swapBindPath(t, cDir, pDir, cDir+"/*/*", []string{"d1/f", "d2/f"})
+}
+
+// Test that -bindpath detects files that have been swapped inside a
+// directory
+func TestBindPathSameDir(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-bindpath")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := os.Mkdir(pDir+"/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(pDir+"/d/"+f, []byte(f), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(pDir)
+	swapBindPath(t, cDir, pDir, cDir+"/*/*", []string{"d/a", "d/b"})
+}
+
+// Test that renaming a file inside a directory with -bindpath keeps its
+// contents, also across a remount
+func TestBindPathRename(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-bindpath")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := os.Mkdir(pDir+"/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	// More than one block, with a hole
+	want := make([]byte, 3*4096+100)
+	copy(want, "start")
+	copy(want[len(want)-3:], "end")
+	for _, f := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(pDir+"/d/"+f, want, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Rename(pDir+"/d/a", pDir+"/d/c"); err != nil {
+		t.Fatal(err)
+	}
+	// Over an existing file
+	if err := os.Rename(pDir+"/d/b", pDir+"/d/c"); err != nil {
+		t.Fatal(err)
+	}
+	// Long name
+	long := pDir + "/d/" + strings.Repeat("x", 200)
+	if err := os.Rename(pDir+"/d/c", long); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	entries, err := ioutil.ReadDir(pDir + "/d")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ReadDir: %d entries, %v", len(entries), err)
+	}
+	if entries[0].Mode().Perm() != 0640 {
+		t.Errorf("mode: have %v", entries[0].Mode())
+	}
+	have, err := ioutil.ReadFile(long)
+	if err != nil || !bytes.Equal(have, want) {
+		t.Errorf("content does not match: %v", err)
+	}
+}
+
+// swapBindPath swaps the contents of the two ciphertext files that match
+// "pattern" in the unmounted "cDir", mounts it on "pDir", and checks that
+// reading the plaintext files "plain" fails with EIO
+func swapBindPath(t *testing.T, cDir string, pDir string, pattern string, plain []string) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, m := range matches {
+		fi, err := os.Lstat(m)
+		if err == nil && fi.Mode().IsRegular() && !strings.HasPrefix(filepath.Base(m), "gocryptfs.") {
+			files = append(files, m)
+		}
+	}
+	if len(files) != 2 {
+		t.Fatalf("want 2 files, have %v", files)
+	}
+	c0, _ := ioutil.ReadFile(files[0])
+	c1, _ := ioutil.ReadFile(files[1])
+	ioutil.WriteFile(files[0], c1, 0600)
+	ioutil.WriteFile(files[1], c0, 0600)
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-wpanic=false")
+	defer test_helpers.UnmountPanic(pDir)
+	for _, p := range plain {
+		_, err := ioutil.ReadFile(pDir + "/" + p)
+		if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EIO {
+			t.Errorf("%s: want EIO, have %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package cli
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that -bwlimit slows down writes
+func TestBwlimit(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-bwlimit", "1000000")
+	defer test_helpers.UnmountPanic(pDir)
+
+	// The first second worth of data is a free burst, the second one
+	// has to wait.
+	t0 := time.Now()
+	if err := ioutil.WriteFile(pDir+"/file", make([]byte, 2000000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(t0); d < 500*time.Millisecond {
+		t.Errorf("writing 2 MB at 1 MB/s took only %v", d)
+	}
+}
@@ -2,10 +2,13 @@
 package cli
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,6 +17,8 @@ import (
 	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/dirlock"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 
@@ -85,6 +90,33 @@ func TestInitAessiv(t *testing.T) {
 	}
 }
 
+// Test -init with -argon2id, and that -passwd and mounting use Argon2id
+func TestInitArgon2id(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-argon2id", "-argon2id-memory=8", "-argon2id-time=2")
+	conf := dir + "/" + configfile.ConfDefaultName
+	_, c, err := configfile.LoadAndDecrypt(conf, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagArgon2id) {
+		t.Error("Argon2id flag should be set but is not")
+	}
+	if a := c.Argon2idObject; a.Memory != 8*1024 || a.Time != 2 {
+		t.Errorf("wrong parameters: %+v", a)
+	}
+	testPasswd(t, dir, "-argon2id-time=1")
+	_, c, err = configfile.LoadAndDecrypt(conf, []byte("newpasswd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := c.Argon2idObject; a == nil || a.Memory != 8*1024 || a.Time != 1 {
+		t.Errorf("wrong parameters after -passwd: %+v", a)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo newpasswd")
+	test_helpers.UnmountPanic(mnt)
+}
+
 // Test -init with -reverse
 func TestInitReverse(t *testing.T) {
 	dir := test_helpers.InitFS(t, "-reverse")
@@ -305,6 +337,30 @@ func TestPasswdScryptn(t *testing.T) {
 	}
 }
 
+// Test -init with -scryptr, and that out-of-range cost parameters are
+// rejected
+func TestInitScryptr(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-scryptr=16")
+	cf, err := configfile.Load(dir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.ScryptObject.R != 16 {
+		t.Errorf("wrong R value %d", cf.ScryptObject.R)
+	}
+	for _, arg := range []string{"-scryptn=9", "-scryptn=29", "-scryptr=7", "-scryptr=33"} {
+		dir := test_helpers.TmpDir + "/TestInitScryptr" + arg
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo test", arg, dir)
+		err := cmd.Run()
+		if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+			t.Errorf("%s: want exit code %d, have %d", arg, exitcodes.Usage, exitCode)
+		}
+	}
+}
+
 // Test -init & -config flag
 func TestInitConfig(t *testing.T) {
 	config := test_helpers.TmpDir + "/TestInitConfig.conf"
@@ -397,6 +453,36 @@ func TestShadows(t *testing.T) {
 	}
 }
 
+// Test that a mountpoint inside the cipherdir, and a mountpoint that is
+// already mounted, are refused unless "-force" is passed
+func TestMountpointSanity(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	// Mountpoint inside cipherdir, reached through a symlink
+	link := cDir + ".link"
+	if err := os.Symlink(cDir, link); err != nil {
+		t.Fatal(err)
+	}
+	err := test_helpers.Mount(cDir, link+"/mnt", false, "-extpass=echo test", "-wpanic=false")
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.MountPoint {
+		t.Errorf("inside cipherdir: want=%d, got=%d", exitcodes.MountPoint, exitCode)
+	}
+	// test_helpers.Mount() has created the mountpoint, which is an invalid
+	// name in CIPHERDIR
+	if err = os.Remove(cDir + "/mnt"); err != nil {
+		t.Fatal(err)
+	}
+	// Mountpoint that is already mounted. The mounted filesystem is empty,
+	// so the emptiness check does not catch it.
+	mnt := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	cDir2 := test_helpers.InitFS(t)
+	err = test_helpers.Mount(cDir2, mnt, false, "-extpass=echo test", "-wpanic=false")
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.MountPoint {
+		t.Errorf("already mounted: want=%d, got=%d", exitcodes.MountPoint, exitCode)
+	}
+}
+
 // TestMountPasswordIncorrect makes sure the correct exit code is used when the password
 // was incorrect while mounting.
 // Also checks that we don't leave a socket file behind.
@@ -761,7 +847,7 @@ func TestBadname(t *testing.T) {
 		t.Fatal(err)
 	}
 	for _, ciphername := range ciphernames {
-		if ciphername != "gocryptfs.conf" && ciphername != "gocryptfs.diriv" {
+		if ciphername != "gocryptfs.conf" && ciphername != "gocryptfs.diriv" && ciphername != dirlock.FileName {
 			encryptedfilename = ciphername
 			// found cipher name of "file"
 			break
@@ -952,6 +1038,497 @@ func TestInitNotEmpty(t *testing.T) {
 	}
 }
 
+// TestRequireEntropy checks that -init and -passwd reject passwords that are
+// weaker than -require-entropy, with the right exit code
+func TestRequireEntropy(t *testing.T) {
+	dir := test_helpers.TmpDir + "/" + t.Name()
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-scryptn=10",
+		"-require-entropy=60", "-extpass", "echo test", dir)
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.PasswordWeak {
+		t.Fatalf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.PasswordWeak)
+	}
+	if _, err = os.Stat(dir + "/gocryptfs.conf"); err == nil {
+		t.Error("config file was created")
+	}
+	// A strong password is accepted
+	const strongPw = "Kx9#mQ2vLp7$wRz4"
+	passfile := dir + ".pw"
+	if err = ioutil.WriteFile(passfile, []byte(strongPw), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-scryptn=10",
+		"-require-entropy=60", "-passfile", passfile, dir)
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// -passwd checks the new password
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-require-entropy=60", dir)
+	cmd.Stdin = strings.NewReader(strongPw + "\npassword1\npassword1\n")
+	err = cmd.Run()
+	exitCode = test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.PasswordWeak {
+		t.Errorf("-passwd: wrong exit code: have=%d, want=%d", exitCode, exitcodes.PasswordWeak)
+	}
+}
+
+// TestInitWizard checks that "-init -wizard" reads the answers and the
+// password from stdin and records the result in the config file
+func TestInitWizard(t *testing.T) {
+	dir := test_helpers.TmpDir + "/" + t.Name()
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Cloud sync, performance
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-wizard", "-scryptn=10", dir)
+	cmd.Stdin = strings.NewReader("1\n1\ntest\n")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := configfile.Load(dir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagDirIV) || cf.LongNameMax != 143 {
+		t.Errorf("wrong options: %v, LongNameMax=%d", cf.FeatureFlags, cf.LongNameMax)
+	}
+	if !strings.HasPrefix(cf.Profile, "cloud sync, performance:") {
+		t.Errorf("wrong profile %q", cf.Profile)
+	}
+	// The password has been read after the answers
+	test_helpers.MountOrFatal(t, dir, dir+".mnt", "-extpass", "echo test")
+	test_helpers.UnmountPanic(dir + ".mnt")
+	// -wizard picks the options itself
+	dir2 := dir + "2"
+	if err := os.Mkdir(dir2, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-wizard", "-xchacha",
+		"-extpass", "echo test", dir2)
+	err = cmd.Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.Usage)
+	}
+}
+
+// TestInitLabel checks that "-label" and "-description" end up in the
+// config file together with the creation info, and are shown by "-info"
+func TestInitLabel(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-label", "photos", "-description", "Photos 2010-2020, backup on the NAS")
+	cf, err := configfile.Load(dir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.Label != "photos" || cf.Description != "Photos 2010-2020, backup on the NAS" {
+		t.Errorf("wrong label %q or description %q", cf.Label, cf.Description)
+	}
+	if _, err := time.Parse(time.RFC3339, cf.Created); err != nil {
+		t.Errorf("Created: %v", err)
+	}
+	if host, _ := os.Hostname(); cf.CreatorHost != host {
+		t.Errorf("CreatorHost: have=%q want=%q", cf.CreatorHost, host)
+	}
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-info", dir).CombinedOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Label:             photos\n", "Description:       Photos", "Created:", "CreatorHost:"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("%q missing in -info output:\n%s", want, out)
+		}
+	}
+	// -label only works with -init
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-label", "x", "-extpass", "echo test", dir, dir+".mnt")
+	err = cmd.Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.Usage)
+	}
+}
+
+// TestMountDefaults checks that the options saved with "-mount-defaults"
+// are applied to every mount, and that they cannot be changed without the
+// master key
+func TestMountDefaults(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-mount-defaults", "ro,idle=0")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	err := ioutil.WriteFile(mnt+"/foo", nil, 0600)
+	test_helpers.UnmountPanic(mnt)
+	if err == nil {
+		t.Fatal("saved -ro was not applied")
+	}
+	// Explicit options win
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-ro=false")
+	err = ioutil.WriteFile(mnt+"/foo", nil, 0600)
+	test_helpers.UnmountPanic(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Invalid options are rejected
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-mount-defaults", "zerokey", "-extpass", "echo test", dir)
+	if exitCode := test_helpers.ExtractCmdExitCode(cmd.Run()); exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.Usage)
+	}
+	// Remove the saved options
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-mount-defaults", "", "-extpass", "echo test", dir)
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := configfile.Load(dir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cf.MountDefaults) != 0 || len(cf.MountDefaultsMAC) != 0 {
+		t.Fatalf("options not removed: %q", cf.MountDefaults)
+	}
+	// Options added without the master key prevent mounting
+	cf.MountDefaults = []string{"kernel_cache"}
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	err = test_helpers.Mount(dir, mnt, false, "-extpass", "echo test")
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.LoadConf {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.LoadConf)
+	}
+}
+
+// TestUserDefaults checks the precedence of the defaults file, the
+// GOCRYPTFS_* environment variables and the command line
+func TestUserDefaults(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	confDir := dir + ".config"
+	if err := os.MkdirAll(confDir+"/gocryptfs", 0700); err != nil {
+		t.Fatal(err)
+	}
+	defaultsFile := confDir + "/gocryptfs/defaults"
+	if err := ioutil.WriteFile(defaultsFile, []byte("# comment\nro\nextpass=echo wrong\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passfile := dir + ".pass"
+	if err := ioutil.WriteFile(passfile, []byte("test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mount := func(env []string, args ...string) error {
+		args = append([]string{"-q", "-nosyslog"}, args...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(args, dir, mnt)...)
+		cmd.Env = append(os.Environ(), "XDG_CONFIG_HOME="+confDir)
+		cmd.Env = append(cmd.Env, env...)
+		return cmd.Run()
+	}
+	writable := func() bool {
+		err := ioutil.WriteFile(mnt+"/foo", nil, 0600)
+		test_helpers.UnmountPanic(mnt)
+		return err == nil
+	}
+	// The wrong password from the defaults file
+	if err := mount(nil); err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal("extpass from the defaults file was not used")
+	}
+	// The environment overrides the defaults file
+	if err := mount([]string{"GOCRYPTFS_EXTPASS=echo test"}); err != nil {
+		t.Fatal(err)
+	}
+	if writable() {
+		t.Error("ro from the defaults file was not applied")
+	}
+	// The command line overrides both, and -passfile replaces -extpass
+	if err := mount([]string{"GOCRYPTFS_EXTPASS=echo wrong"}, "-passfile", passfile, "-ro=false"); err != nil {
+		t.Fatal(err)
+	}
+	if !writable() {
+		t.Error("-ro=false on the command line did not override the defaults file")
+	}
+	// -nodefaults ignores both
+	if err := mount([]string{"GOCRYPTFS_RO=1"}, "-nodefaults", "-extpass", "echo test"); err != nil {
+		t.Fatal(err)
+	}
+	if !writable() {
+		t.Error("-nodefaults did not ignore the defaults")
+	}
+	// Operations cannot have defaults
+	if err := ioutil.WriteFile(defaultsFile, []byte("init\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := mount(nil, "-extpass", "echo test")
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.Usage)
+	}
+}
+
+// TestCompletion checks the shell completion scripts, and runs the bash
+// completion if bash is installed
+func TestCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		out, err := exec.Command(test_helpers.GocryptfsBinary, "completion", shell).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), "extpass") || !strings.Contains(string(out), "completion mountpoints") {
+			t.Errorf("%s: incomplete script:\n%s", shell, out)
+		}
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "completion", "tcsh")
+	if exitCode := test_helpers.ExtractCmdExitCode(cmd.Run()); exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.Usage)
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	binDir, _ := filepath.Abs(filepath.Dir(test_helpers.GocryptfsBinary))
+	complete := func(words string, cword int) string {
+		script := fmt.Sprintf(`source <(gocryptfs completion bash)
+COMP_WORDS=(%s); COMP_CWORD=%d; _gocryptfs; echo "${COMPREPLY[*]}"`, words, cword)
+		cmd := exec.Command("bash", "-c", script)
+		cmd.Env = append(os.Environ(), "PATH="+binDir+":"+os.Getenv("PATH"))
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if out := complete("gocryptfs -extp", 1); out != "-extpass" {
+		t.Errorf("option completion: %q", out)
+	}
+	if out := complete("gocryptfs completion ''", 2); out != "bash zsh fish" {
+		t.Errorf("shell completion: %q", out)
+	}
+	if out := complete("gocryptfs -unmount ''", 2); !strings.Contains(out, mnt) {
+		t.Errorf("-unmount completion: %q does not contain %q", out, mnt)
+	}
+}
+
+// TestHealth checks "-health -json" on a healthy mount and on a directory
+// that is not mounted
+func TestHealth(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	sock := dir + ".sock"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-ctlsock", sock)
+	defer test_helpers.UnmountPanic(mnt)
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-health", "-json", mnt).Output()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	var report struct {
+		Healthy bool
+		Checks  []struct {
+			Name   string
+			Status string
+		}
+	}
+	if err = json.Unmarshal(out, &report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy || len(report.Checks) != 4 {
+		t.Fatalf("unexpected report: %s", out)
+	}
+	for _, c := range report.Checks {
+		if c.Status != "ok" {
+			t.Errorf("check %q: %q", c.Name, c.Status)
+		}
+	}
+	// The probe file has been deleted
+	entries, err := ioutil.ReadDir(mnt)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("leftover entries: %v, %v", entries, err)
+	}
+	err = exec.Command(test_helpers.GocryptfsBinary, "-health", dir).Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Unhealthy {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.Unhealthy)
+	}
+}
+
+// TestWarmup checks that "-warmup" walks the whole tree, and only the
+// subdirectory if one is given
+func TestWarmup(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	long := strings.Repeat("x", 200)
+	for _, d := range []string{"a/b/c", "a/" + long, "d"} {
+		if err := os.MkdirAll(filepath.Join(mnt, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"a/file", "a/b/c/" + long, "d/file"} {
+		if err := ioutil.WriteFile(filepath.Join(mnt, f), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("/", mnt+"/a/root"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-warmup", mnt}, "warmup: 6 directories and 4 files"},
+		{[]string{"-warmup", mnt, "a/b"}, "warmup: 2 directories and 1 files"},
+	} {
+		out, err := exec.Command(test_helpers.GocryptfsBinary, tc.args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %v: %s", tc.args, err, out)
+		}
+		if !strings.Contains(string(out), tc.want) {
+			t.Errorf("%v: want %q, have:\n%s", tc.args, tc.want, out)
+		}
+	}
+	err := exec.Command(test_helpers.GocryptfsBinary, "-warmup", dir).Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.MountPoint {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.MountPoint)
+	}
+}
+
+// TestTop checks that "-top" shows the file we write to
+func TestTop(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	sock := dir + ".sock"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-ctlsock", sock)
+	defer test_helpers.UnmountPanic(mnt)
+	err := ioutil.WriteFile(mnt+"/busyfile", make([]byte, 100000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Output is not a terminal: prints one screen and exits
+	for _, args := range [][]string{{"-top", mnt}, {"-top", "-ctlsock", sock}} {
+		out, err := exec.Command(test_helpers.GocryptfsBinary, args...).Output()
+		if err != nil {
+			t.Fatalf("%v: %v: %s", args, err, out)
+		}
+		if !strings.Contains(string(out), "busyfile") {
+			t.Errorf("%v: busyfile is missing:\n%s", args, out)
+		}
+	}
+	err = exec.Command(test_helpers.GocryptfsBinary, "-top", mnt, "-ctlsock", sock).Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.Usage)
+	}
+}
+
+// TestNewKeyEpoch checks that "-new-key-epoch" encrypts new files with a new
+// key, while the old files stay readable
+func TestNewKeyEpoch(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	// Config with known master key
+	cp(t, "gocryptfs.conf.b9e5ba23", dir+"/gocryptfs.conf")
+	masterkey := "b9e5ba23-981a22b8-c8d790d8-627add29-f680513f-b7b7035f-d203fb83-21d82205"
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := ioutil.WriteFile(mnt+"/old", []byte("oldcontent"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-new-key-epoch", "-extpass", "echo test", dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := ioutil.WriteFile(mnt+"/new", []byte("newcontent"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(mnt + "/old"); err != nil || string(content) != "oldcontent" {
+		t.Errorf("old file: %q, %v", content, err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// The high byte of the header version is the key epoch
+	epochs := map[byte]int{}
+	entries, _ := ioutil.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() == "gocryptfs.conf" || e.Name() == "gocryptfs.diriv" || e.Size() == 0 {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		epochs[buf[0]]++
+	}
+	if epochs[0] != 1 || epochs[1] != 1 {
+		t.Errorf("wrong key epochs in the file headers: %v", epochs)
+	}
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-info", dir).CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "KeyEpoch:          1") {
+		t.Errorf("-info: %v: %s", err, out)
+	}
+	// The master key only opens the files of epoch 0. Reading the new file
+	// logs a warning.
+	test_helpers.MountOrFatal(t, dir, mnt, "-masterkey", masterkey, "-raw64=false", "-hkdf=false", "-wpanic=false")
+	if content, err := ioutil.ReadFile(mnt + "/old"); err != nil || string(content) != "oldcontent" {
+		t.Errorf("old file with -masterkey: %q, %v", content, err)
+	}
+	if _, err := ioutil.ReadFile(mnt + "/new"); err == nil {
+		t.Error("new file could be read with the master key of epoch 0")
+	}
+	test_helpers.UnmountPanic(mnt)
+	err = exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-masterkey", masterkey,
+		"-extpass", "echo newpasswd", dir).Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("-passwd -masterkey: wrong exit code: have=%d, want=%d", exitCode, exitcodes.Usage)
+	}
+	// Changing the password keeps all keys
+	testPasswd(t, dir)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo newpasswd")
+	for name, want := range map[string]string{"old": "oldcontent", "new": "newcontent"} {
+		if content, err := ioutil.ReadFile(mnt + "/" + name); err != nil || string(content) != want {
+			t.Errorf("%s after -passwd: %q, %v", name, content, err)
+		}
+	}
+	test_helpers.UnmountPanic(mnt)
+}
+
+// TestVersionJSON checks that "-version -json" prints valid JSON that lists
+// the feature flags
+func TestVersionJSON(t *testing.T) {
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-version", "-json").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct {
+		Program      string
+		OnDiskFormat uint16
+		FeatureFlags []string
+	}
+	if err = json.Unmarshal(out, &v); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if v.Program != "gocryptfs" || v.OnDiskFormat != contentenc.CurrentVersion {
+		t.Errorf("wrong output: %s", out)
+	}
+	found := false
+	for _, f := range v.FeatureFlags {
+		if f == "HKDF" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("HKDF missing from FeatureFlags: %v", v.FeatureFlags)
+	}
+	// -json needs -version
+	err = exec.Command(test_helpers.GocryptfsBinary, "-json").Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.Usage)
+	}
+}
+
 // TestSharedstorage checks that `-sharedstorage` shows stable inode numbers to
 // userspace despite having hard link tracking disabled
 func TestSharedstorage(t *testing.T) {
@@ -1018,3 +1595,334 @@ func TestMountCreat(t *testing.T) {
 		test_helpers.UnmountPanic(mnt)
 	}
 }
+
+// TestReencrypt checks that "-reencrypt" moves the files of an older key
+// epoch to the newest key, and keeps their content, mode and mtime
+func TestReencrypt(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	// More than one chunk, with a file hole in between
+	big := make([]byte, 300000)
+	copy(big, "start")
+	copy(big[len(big)-3:], "end")
+	files := map[string][]byte{"small": []byte("smallcontent"), "big": big, "empty": nil}
+	for name, content := range files {
+		if err := ioutil.WriteFile(mnt+"/"+name, content, 0400); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(mnt+"/subdir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/subdir/file", []byte("subdircontent"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	files["subdir/file"] = []byte("subdircontent")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(mnt+"/small", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-new-key-epoch", "-extpass", "echo test", dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	// headerEpochs counts the key epochs in the headers of the files in
+	// the ciphertext directory "d"
+	var headerEpochs func(d string, epochs map[byte]int)
+	headerEpochs = func(d string, epochs map[byte]int) {
+		entries, _ := ioutil.ReadDir(d)
+		for _, e := range entries {
+			p := filepath.Join(d, e.Name())
+			if e.IsDir() {
+				if e.Name() != "gocryptfs.reencrypt" {
+					headerEpochs(p, epochs)
+				}
+				continue
+			}
+			if e.Name() == "gocryptfs.conf" || e.Name() == "gocryptfs.diriv" || e.Size() == 0 {
+				continue
+			}
+			buf, err := ioutil.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			epochs[buf[0]]++
+		}
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-reencrypt", "-reencrypt-idle=1s")
+	var epochs map[byte]int
+	for i := 0; i < 100; i++ {
+		epochs = map[byte]int{}
+		headerEpochs(dir, epochs)
+		if epochs[0] == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if epochs[0] != 0 || epochs[1] != 3 {
+		t.Errorf("wrong key epochs in the file headers: %v", epochs)
+	}
+	for name, want := range files {
+		content, err := ioutil.ReadFile(mnt + "/" + name)
+		if err != nil || !bytes.Equal(content, want) {
+			t.Errorf("%s: wrong content after -reencrypt, len=%d, err=%v", name, len(content), err)
+		}
+	}
+	fi, err := os.Stat(mnt + "/small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0400 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("small: mode %v, mtime %v have not been kept", fi.Mode(), fi.ModTime())
+	}
+	test_helpers.UnmountPanic(mnt)
+	state, err := ioutil.ReadFile(dir + "/gocryptfs.reencrypt/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s struct {
+		KeyEpoch uint8
+		Done     bool
+		Files    uint64
+	}
+	if err = json.Unmarshal(state, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.KeyEpoch != 1 || !s.Done || s.Files != 3 {
+		t.Errorf("wrong state: %s", state)
+	}
+}
+
+// Test that files on a "-worm" volume are sealed when they are closed
+func TestWORM(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-worm", "-worm-retention=2s")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	f, err := os.Create(mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Still open, so it can be written and truncated
+	if _, err = f.Write([]byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("tent"), 3); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	content, err := ioutil.ReadFile(mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Errorf("wrong content: %q", content)
+	}
+	if _, err = os.OpenFile(mnt+"/file", os.O_WRONLY, 0); err == nil {
+		t.Error("opening a sealed file for writing should have failed")
+	}
+	if err = os.Truncate(mnt+"/file", 0); err == nil {
+		t.Error("truncating a sealed file should have failed")
+	}
+	if err = os.Rename(mnt+"/file", mnt+"/file2"); err == nil {
+		t.Error("renaming a sealed file should have failed")
+	}
+	if err = ioutil.WriteFile(mnt+"/file2", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(mnt+"/file2", mnt+"/file"); err == nil {
+		t.Error("replacing a sealed file should have failed")
+	}
+	if err = os.Remove(mnt + "/file"); err == nil {
+		t.Error("deleting a sealed file should have failed")
+	}
+	if err = os.Chmod(mnt+"/file", 0400); err != nil {
+		t.Error(err)
+	}
+	if err = os.Mkdir(mnt+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(mnt+"/dir", mnt+"/dir2"); err == nil {
+		t.Error("renaming a directory should have failed")
+	}
+	if err = os.Remove(mnt + "/dir"); err != nil {
+		t.Error(err)
+	}
+	// Retention time has passed
+	time.Sleep(2 * time.Second)
+	if err = os.Remove(mnt + "/file"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestImmutableFeatureFlag checks that files can only be marked immutable on
+// filesystems created with -immutable, so that older versions never see the
+// marker on their filesystems
+func TestImmutableFeatureFlag(t *testing.T) {
+	const attr = "user.gocryptfs.immutable"
+	for _, enabled := range []bool{false, true} {
+		var dir string
+		if enabled {
+			dir = test_helpers.InitFS(t, "-immutable")
+		} else {
+			dir = test_helpers.InitFS(t)
+		}
+		_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.IsFeatureFlagSet(configfile.FlagImmutable) != enabled {
+			t.Errorf("enabled=%v: wrong Immutable feature flag", enabled)
+		}
+		mnt := dir + ".mnt"
+		test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+		if err = ioutil.WriteFile(mnt+"/file", []byte("content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err = syscall.Setxattr(mnt+"/file", attr, []byte("1"), 0)
+		if enabled && err != nil {
+			t.Errorf("enabled=%v: %v", enabled, err)
+		} else if !enabled && err != syscall.EOPNOTSUPP {
+			t.Errorf("enabled=%v: want EOPNOTSUPP, have %v", enabled, err)
+		}
+		test_helpers.UnmountPanic(mnt)
+	}
+}
+
+// TestMakeReadOnly checks that a filesystem marked with "-make-readonly" is
+// mounted read-only even with "-rw"
+func TestMakeReadOnly(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := ioutil.WriteFile(mnt+"/file", []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-make-readonly", "-extpass", "echo test", dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-rw")
+	defer test_helpers.UnmountPanic(mnt)
+	if content, err := ioutil.ReadFile(mnt + "/file"); err != nil || string(content) != "content" {
+		t.Errorf("file: %q, %v", content, err)
+	}
+	if err := ioutil.WriteFile(mnt+"/file2", nil, 0600); err == nil {
+		t.Error("creating a file should have failed")
+	}
+}
+
+// TestAppendOnly checks that "-append_only" allows appending, but not
+// overwriting, truncating or deleting
+func TestAppendOnly(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-append_only")
+	defer test_helpers.UnmountPanic(mnt)
+	path := mnt + "/log"
+	if err := ioutil.WriteFile(path, []byte("line1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("line2\n")); err != nil {
+		t.Error(err)
+	}
+	if _, err = f.WriteAt([]byte("xxxxx"), 0); err == nil {
+		t.Error("overwriting should have failed")
+	}
+	if err = f.Truncate(3); err == nil {
+		t.Error("truncating should have failed")
+	}
+	f.Close()
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "line1\nline2\n" {
+		t.Errorf("wrong content: %q, %v", content, err)
+	}
+	if err = ioutil.WriteFile(path, nil, 0600); err == nil {
+		t.Error("O_TRUNC should have failed")
+	}
+	if err = os.Remove(path); err == nil {
+		t.Error("deleting should have failed")
+	}
+	if err = ioutil.WriteFile(mnt+"/log2", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(mnt+"/log2", path); err == nil {
+		t.Error("replacing should have failed")
+	}
+	if err = os.Rename(mnt+"/log2", mnt+"/log3"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMigrateConfig checks that "-migrate-config" leaves a config file of
+// the current schema alone, and that a newer schema is refused
+func TestMigrateConfig(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	conf := dir + "/" + configfile.ConfDefaultName
+	js, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-migrate-config", dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("-migrate-config: %v\n%s", err, out)
+	}
+	if js2, _ := ioutil.ReadFile(conf); !bytes.Equal(js2, js) {
+		t.Error("the config file was rewritten")
+	}
+	if _, err = os.Stat(conf + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("backup: want ENOENT, have %v", err)
+	}
+	// Make it look like a config file written by a newer gocryptfs
+	var m map[string]interface{}
+	if err = json.Unmarshal(js, &m); err != nil {
+		t.Fatal(err)
+	}
+	m["SchemaVersion"] = configfile.CurrentSchema + 1
+	if js, err = json.Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(conf, 0600)
+	if err = ioutil.WriteFile(conf, js, 0400); err != nil {
+		t.Fatal(err)
+	}
+	err = exec.Command(test_helpers.GocryptfsBinary, "-migrate-config", dir).Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.DeprecatedFS {
+		t.Errorf("newer schema: want exit code %d, have %d", exitcodes.DeprecatedFS, exitCode)
+	}
+}
+
+// TestCipherdirRenamed checks that the mount keeps working when CIPHERDIR
+// is renamed
+func TestCipherdirRenamed(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	if err := os.Mkdir(mnt+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(dir, dir+".renamed"); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mnt, &st); err != nil {
+		t.Error(err)
+	}
+	content := []byte("still here")
+	if err := ioutil.WriteFile(mnt+"/dir/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := ioutil.ReadFile(mnt + "/dir/file"); err != nil || !bytes.Equal(have, content) {
+		t.Errorf("read back %q, %v", have, err)
+	}
+}
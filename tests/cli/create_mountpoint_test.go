@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that "-create-mountpoint" creates the mountpoint and removes it after
+// unmount. test_helpers.Mount() creates the mountpoint itself, so we run
+// gocryptfs directly.
+func TestCreateMountpoint(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	// A failed mount removes the mountpoint
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo WRONG",
+		"-create-mountpoint", cDir, pDir)
+	if err := cmd.Run(); err == nil {
+		t.Fatal("mount with wrong password should have failed")
+	}
+	if _, err := os.Stat(pDir); !os.IsNotExist(err) {
+		t.Errorf("mountpoint was not removed: %v", err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-create-mountpoint", cDir, pDir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if _, err := os.Stat(pDir + "/"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	// The gocryptfs process exits asynchronously
+	for i := 0; ; i++ {
+		_, err := os.Stat(pDir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if i > 20 {
+			t.Fatalf("mountpoint was not removed: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
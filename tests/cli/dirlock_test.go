@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/dirlock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that a second read-write mount of the same CIPHERDIR is refused,
+// while -ro, -sharedstorage and -force mounts are allowed
+func TestDirLock(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+
+	err := test_helpers.Mount(cDir, cDir+".mnt2", false, "-extpass", "echo test", "-wpanic=false")
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Locked {
+		t.Errorf("want=%d, got=%d", exitcodes.Locked, exitCode)
+	}
+	for _, opt := range []string{"-ro", "-sharedstorage", "-force"} {
+		pDir2 := cDir + ".mnt" + opt
+		test_helpers.MountOrFatal(t, cDir, pDir2, "-extpass", "echo test", opt)
+		test_helpers.UnmountPanic(pDir2)
+	}
+	// The lock file is hidden
+	if _, err := os.Stat(pDir + "/" + dirlock.FileName); !os.IsNotExist(err) {
+		t.Errorf("want ENOENT, have %v", err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	// ... and deleted on unmount. The gocryptfs process exits asynchronously.
+	for i := 0; ; i++ {
+		_, err := os.Stat(cDir + "/" + dirlock.FileName)
+		if os.IsNotExist(err) {
+			break
+		}
+		if i > 20 {
+			t.Fatalf("lock file left behind: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// With -plaintextnames, a user file in CIPHERDIR can have the name of one of
+// the files gocryptfs uses internally. The mount must be refused and the
+// file left alone.
+func TestDirLockPlaintextNames(t *testing.T) {
+	for _, name := range []string{dirlock.FileName, "gocryptfs.journal", "gocryptfs.auditlog"} {
+		cDir := test_helpers.InitFS(t, "-plaintextnames")
+		path := cDir + "/" + name
+		if name == "gocryptfs.journal" {
+			if err := os.Mkdir(path, 0700); err != nil {
+				t.Fatal(err)
+			}
+			path += "/notes.txt"
+		}
+		content := []byte("user data\n")
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := test_helpers.Mount(cDir, cDir+".mnt", false, "-extpass", "echo test", "-wpanic=false")
+		if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.ReservedName {
+			t.Errorf("%s: want=%d, got=%d", name, exitcodes.ReservedName, exitCode)
+		}
+		have, err := ioutil.ReadFile(path)
+		if err != nil || !bytes.Equal(have, content) {
+			t.Errorf("%s: file was changed: %q, %v", name, have, err)
+		}
+	}
+}
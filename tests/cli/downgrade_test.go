@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that -downgrade copies a filesystem that uses newer feature flags
+// into one that only uses the baseline flags
+func TestDowngrade(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-xchacha", "-hctr2")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := ioutil.WriteFile(pDir+"/file", []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(pDir+"/dir", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/dir/x", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/x", pDir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	dDir := cDir + ".downgraded"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-downgrade", dDir, "-extpass", "echo test", cDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := configfile.Load(dDir + "/" + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305) || cf.IsFeatureFlagSet(configfile.FlagHCTR2Names) {
+		t.Errorf("flags were not dropped: %v", cf.FeatureFlags)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagEMENames) || !cf.IsFeatureFlagSet(configfile.FlagGCMIV128) {
+		t.Errorf("baseline flags missing: %v", cf.FeatureFlags)
+	}
+
+	test_helpers.MountOrFatal(t, dDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	if x, err := ioutil.ReadFile(pDir + "/file"); err != nil || string(x) != "hello" {
+		t.Errorf("file: %q, %v", x, err)
+	}
+	if fi, err := os.Stat(pDir + "/file"); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("file: wrong mode or error: %v", err)
+	}
+	if fi, err := os.Stat(pDir + "/dir"); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("dir: wrong mode or error: %v", err)
+	}
+	if x, err := ioutil.ReadFile(pDir + "/link"); err != nil || string(x) != "x" {
+		t.Errorf("link: %q, %v", x, err)
+	}
+	if target, err := os.Readlink(pDir + "/link"); err != nil || target != "dir/x" {
+		t.Errorf("link: target %q, %v", target, err)
+	}
+
+	// DEST must be empty
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-downgrade", dDir, "-extpass", "echo test", cDir)
+	if err = cmd.Run(); err == nil {
+		t.Error("-downgrade into a non-empty directory should fail")
+	}
+}
@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// writeBlocks writes "n" blocks to "path", one write call each
+func writeBlocks(path string, n int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, 4096)
+	for i := 0; i < n; i++ {
+		if _, err := f.WriteAt(buf, int64(i*len(buf))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Test that -fault_inject=eio_write fails writes, and that -retry_count
+// hides the failures. The failures and retries are logged as warnings, which
+// "-wpanic" would turn into a crash.
+func TestFaultInjectEIO(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-wpanic=false",
+		"-fault_inject", "eio_write=2")
+	err := writeBlocks(pDir+"/file", 4)
+	test_helpers.UnmountPanic(pDir)
+	if !errors.Is(err, syscall.EIO) {
+		t.Errorf("want EIO, have %v", err)
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-wpanic=false",
+		"-fault_inject", "eio_write=2", "-retry_count", "1", "-retry_interval", "1ms")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := writeBlocks(pDir+"/file", 4); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test that invalid -fault_inject specifications are rejected
+func TestFaultInjectInvalid(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	err := test_helpers.Mount(cDir, pDir, false, "-extpass", "echo test", "-fault_inject", "eio_write=0")
+	if err == nil {
+		test_helpers.UnmountPanic(pDir)
+		t.Fatal("mount should have failed")
+	}
+}
+
+// Test that writes and fallocate keep working when the backing filesystem
+// does not support fallocate: fallocate mode 0 writes zeros instead
+func TestFaultInjectNoFallocate(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-fault_inject", "no_fallocate=true")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := writeBlocks(pDir+"/file", 2); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(pDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	if err = syscallcompat.Fallocate(fd, 0, 5000, 20000); err != nil {
+		t.Fatalf("fallocate mode 0: %v", err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil || st.Size != 25000 {
+		t.Errorf("wrong size %d: %v", st.Size, err)
+	}
+	// The new part has been written, it is no file hole
+	if st.Blocks*512 < 25000 {
+		t.Errorf("only %d bytes allocated", st.Blocks*512)
+	}
+	buf := make([]byte, 25000)
+	if _, err = f.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, make([]byte, 25000)) {
+		t.Errorf("wrong content: %v", err)
+	}
+	// There is no way to allocate space without changing the size
+	if err = syscallcompat.Fallocate(fd, 1, 0, 50000); err != syscall.EOPNOTSUPP {
+		t.Errorf("fallocate keep size: want EOPNOTSUPP, have %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that -flat keeps the directory tree in the index, and that it
+// survives a remount
+func TestFlat(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-flat")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := os.MkdirAll(pDir+"/d1/d2", 0700); err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 100000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(pDir+"/d1/d2/big", big, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/small", []byte("small"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("d1/d2/big", pDir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(pDir+"/d1/d2", pDir+"/d3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(pDir+"/small", 3); err != nil {
+		t.Fatal(err)
+	}
+	// Replacing a file deletes its blob
+	if err := ioutil.WriteFile(pDir+"/replaced", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(pDir+"/replaced", pDir+"/small2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/gone", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(pDir+"/small2", pDir+"/gone"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// Only the config, the index and the blobs are in CIPHERDIR
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		switch e.Name() {
+		case "gocryptfs.conf", "gocryptfs.index", "gocryptfs.lock", "blobs":
+		default:
+			t.Errorf("unexpected file in CIPHERDIR: %q", e.Name())
+		}
+	}
+	blobs, err := filepath.Glob(cDir + "/blobs/*/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 3 {
+		t.Errorf("want 3 blobs, have %v", blobs)
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	content, err := ioutil.ReadFile(pDir + "/d3/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, big) {
+		t.Errorf("d3/big: wrong content")
+	}
+	if content, err = ioutil.ReadFile(pDir + "/small"); err != nil || string(content) != "sma" {
+		t.Errorf("small: have %q, %v", content, err)
+	}
+	if content, err = ioutil.ReadFile(pDir + "/gone"); err != nil || string(content) != "x" {
+		t.Errorf("gone: have %q, %v", content, err)
+	}
+	if target, err := os.Readlink(pDir + "/link"); err != nil || target != "d1/d2/big" {
+		t.Errorf("link: have %q, %v", target, err)
+	}
+	if _, err = os.Stat(pDir + "/d1/d2"); !os.IsNotExist(err) {
+		t.Errorf("d1/d2 should be gone: %v", err)
+	}
+}
+
+// Test that -image_size keeps everything in CIPHERDIR/gocryptfs.image, and
+// that deleting a file frees its space
+func TestFlatImage(t *testing.T) {
+	const size = 8 << 20
+	cDir := test_helpers.InitFS(t, "-flat", fmt.Sprintf("-image_size=%d", size))
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(pDir, &st); err != nil {
+		t.Fatal(err)
+	}
+	free := st.Bfree
+	big := make([]byte, 1000000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/dir/big", big, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/deleted", big, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(pDir+"/dir/big", 500000); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(pDir + "/deleted"); err != nil {
+		t.Fatal(err)
+	}
+	// Filling up the image fails with ENOSPC
+	err := ioutil.WriteFile(pDir+"/full", make([]byte, size), 0600)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.ENOSPC {
+		t.Errorf("want ENOSPC, have %v", err)
+	}
+	if err = os.Remove(pDir + "/full"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		switch e.Name() {
+		case "gocryptfs.conf", "gocryptfs.image", "gocryptfs.lock":
+		default:
+			t.Errorf("unexpected file in CIPHERDIR: %q", e.Name())
+		}
+	}
+	fi, err := os.Stat(cDir + "/gocryptfs.image")
+	if err != nil || fi.Size() != size {
+		t.Errorf("gocryptfs.image: %v, %v", fi, err)
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	content, err := ioutil.ReadFile(pDir + "/dir/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, big[:500000]) {
+		t.Errorf("dir/big: wrong content")
+	}
+	if err = syscall.Statfs(pDir, &st); err != nil {
+		t.Fatal(err)
+	}
+	// Only dir/big and the index remain
+	if used := (free - st.Bfree) * uint64(st.Bsize); used < 500000 || used > 600000 {
+		t.Errorf("%d bytes used, want about 500000", used)
+	}
+}
+
+// Test that a -container file grows on demand up to -size, and that
+// -compact shrinks it again
+func TestFlatContainer(t *testing.T) {
+	const limit = 16 << 20
+	container := test_helpers.TmpDir + "/" + t.Name() + ".gcfs"
+	defer os.Remove(container)
+	cDir := test_helpers.InitFS(t, "-container", container, fmt.Sprintf("-size=%d", limit))
+	containerSize := func() int64 {
+		fi, err := os.Stat(container)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	initial := containerSize()
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(pDir, &st); err != nil {
+		t.Fatal(err)
+	}
+	if total := st.Blocks * uint64(st.Bsize); total < limit*9/10 || total > limit {
+		t.Errorf("statfs should report the size limit, have %d bytes", total)
+	}
+	big := make([]byte, 3000000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(pDir+"/"+name, big, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(pDir+"/full", make([]byte, limit), 0600)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.ENOSPC {
+		t.Errorf("want ENOSPC, have %v", err)
+	}
+	for _, name := range []string{"full", "a", "b"} {
+		if err = os.Remove(pDir + "/" + name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grown := containerSize()
+	if grown <= initial || grown > limit {
+		t.Errorf("container has %d bytes, want between %d and %d", grown, initial, limit)
+	}
+
+	// The filesystem is mounted
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-compact", "-extpass", "echo test", cDir)
+	if err = cmd.Run(); test_helpers.ExtractCmdExitCode(err) != exitcodes.Locked {
+		t.Errorf("want exit code %d, have %v", exitcodes.Locked, err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-compact", "-extpass", "echo test", cDir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if compacted := containerSize(); compacted >= grown || compacted > 4000000 {
+		t.Errorf("container has %d bytes after -compact, had %d", compacted, grown)
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	content, err := ioutil.ReadFile(pDir + "/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, big) {
+		t.Errorf("c: wrong content")
+	}
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Create & test fs with -hctr2
+func TestHCTR2(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-hctr2")
+	pDir := cDir + ".mnt"
+	c, err := configfile.Load(cDir + "/" + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagHCTR2Names) || c.IsFeatureFlagSet(configfile.FlagEMENames) {
+		t.Errorf("wrong feature flags %v", c.FeatureFlags)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err = os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(pDir+"/dir/file", []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	content, err := ioutil.ReadFile(pDir + "/dir/file")
+	test_helpers.UnmountPanic(pDir)
+	if err != nil || string(content) != "foo" {
+		t.Errorf("read back %q, %v", content, err)
+	}
+	// The encrypted name of "dir" is the HCTR2 one
+	masterkey, _, err := configfile.LoadAndDecrypt(cDir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cCore := cryptocore.New(masterkey, cryptocore.BackendGoGCM, 128, true)
+	dirIV, err := ioutil.ReadFile(cDir + "/" + nametransform.DirIVFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		nameCipher nametransform.WideBlockCipher
+		exists     bool
+	}{
+		{cryptocore.NewHCTR2(masterkey), true},
+		{cCore.EMECipher, false},
+	} {
+		n := nametransform.New(tc.nameCipher, true, 0, true, nil, false)
+		cName, err := n.EncryptName("dir", dirIV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(cDir + "/" + cName); (err == nil) != tc.exists {
+			t.Errorf("%T: exists=%v, want %v", tc.nameCipher, err == nil, tc.exists)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/journal"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that overwrites and shrinking truncates work with -journal, and that
+// the journal is empty and hidden afterwards
+func TestJournal(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-journal")
+	defer test_helpers.UnmountPanic(pDir)
+
+	content := bytes.Repeat([]byte("x"), 10000)
+	path := pDir + "/file"
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read-modify-write in the middle of the second block
+	if _, err = f.WriteAt([]byte("yyy"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	copy(content[5000:], "yyy")
+	// Shrink into the middle of the second block
+	if err = f.Truncate(6000); err != nil {
+		t.Fatal(err)
+	}
+	content = content[:6000]
+	f.Close()
+	have, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(have, content) {
+		t.Errorf("wrong content: %v", err)
+	}
+	if n := journal.Pending(cDir); n != 0 {
+		t.Errorf("%d records left in the journal", n)
+	}
+	if _, err = os.Stat(filepath.Join(cDir, journal.DirName)); err != nil {
+		t.Error(err)
+	}
+	entries, err := ioutil.ReadDir(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only one entry, have %d", len(entries))
+	}
+}
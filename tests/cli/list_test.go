@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that "-list" shows our mounts, and the PID for mounts that have a
+// control socket
+func TestList(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only works on linux")
+	}
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-ctlsock", cDir+".sock")
+	defer test_helpers.UnmountPanic(pDir)
+	pDir2 := cDir + ".mnt2"
+	test_helpers.MountOrFatal(t, cDir, pDir2, "-extpass", "echo test", "-ro")
+	defer test_helpers.UnmountPanic(pDir2)
+
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-list").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	var line, line2 string
+	for _, l := range strings.Split(string(out), "\n") {
+		f := strings.Fields(l)
+		if len(f) == 0 {
+			continue
+		}
+		if f[0] == pDir {
+			line = l
+		} else if f[0] == pDir2 {
+			line2 = l
+		}
+	}
+	pid := test_helpers.MountInfo[pDir].Pid
+	if f := strings.Fields(line); len(f) != 6 || f[1] != cDir || f[2] != fmt.Sprint(pid) || f[3] != "rw" {
+		t.Errorf("wrong line for %s: %q\n%s", pDir, line, out)
+	}
+	if f := strings.Fields(line2); len(f) != 6 || f[2] != "-" || f[3] != "ro" {
+		t.Errorf("wrong line for %s: %q\n%s", pDir2, line2, out)
+	}
+}
@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Create & test fs with -longnamehash=blake3
+func TestLongnamehashBLAKE3(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-longnamehash=blake3")
+	pDir := cDir + ".mnt"
+	c, err := configfile.Load(cDir + "/" + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagLongNameBLAKE3) {
+		t.Error("FlagLongNameBLAKE3 should be on")
+	}
+	name := strings.Repeat("ö", 120)
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err = ioutil.WriteFile(pDir+"/"+name, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	// The hash is not SHA-256 of the encrypted name
+	matches, err := filepath.Glob(cDir + "/gocryptfs.longname.*.name")
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("want one longname, have %v, %v", matches, err)
+	}
+	cName, err := ioutil.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(cName)
+	if filepath.Base(matches[0]) == "gocryptfs.longname."+base64.RawURLEncoding.EncodeToString(h[:])+".name" {
+		t.Error("long name was hashed with SHA-256")
+	}
+	// The file can be found again after remounting
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	content, err := ioutil.ReadFile(pDir + "/" + name)
+	test_helpers.UnmountPanic(pDir)
+	if err != nil || string(content) != "foo" {
+		t.Errorf("read back %q, %v", content, err)
+	}
+}
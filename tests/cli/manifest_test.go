@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/manifest"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// unmountWait unmounts "dir" and waits for the gocryptfs process to exit,
+// which writes the manifest after the unmount
+func unmountWait(t *testing.T, dir string) {
+	pid := test_helpers.MountInfo[dir].Pid
+	test_helpers.UnmountPanic(dir)
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		if i > 500 {
+			t.Fatalf("pid %d did not exit", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test that -manifest and -fsck detect deleted files and a rollback of
+// CIPHERDIR
+func TestManifest(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	anchor := cDir + ".anchor"
+	mountOpts := []string{"-extpass", "echo test", "-manifest", "-manifest_anchor", anchor}
+	test_helpers.MountOrFatal(t, cDir, pDir, mountOpts...)
+	for _, f := range []string{"file1", "file2"} {
+		if err := ioutil.WriteFile(pDir+"/"+f, []byte(f), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unmountWait(t, pDir)
+	mPath := filepath.Join(cDir, manifest.FileName)
+	oldManifest, err := ioutil.ReadFile(mPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsck := func() int {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test",
+			"-manifest_anchor", anchor, cDir)
+		out, err := cmd.CombinedOutput()
+		t.Log(string(out))
+		return test_helpers.ExtractCmdExitCode(err)
+	}
+	if code := fsck(); code != 0 {
+		t.Errorf("fsck: exit code %d", code)
+	}
+	// A new generation
+	test_helpers.MountOrFatal(t, cDir, pDir, mountOpts...)
+	if err = os.Remove(pDir + "/file1"); err != nil {
+		t.Fatal(err)
+	}
+	unmountWait(t, pDir)
+	if code := fsck(); code != 0 {
+		t.Errorf("fsck: exit code %d", code)
+	}
+
+	// Delete a file behind our back
+	matches, err := filepath.Glob(cDir + "/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var victim string
+	for _, m := range matches {
+		if !strings.HasPrefix(filepath.Base(m), "gocryptfs.") {
+			victim = m
+		}
+	}
+	if victim == "" {
+		t.Fatalf("no encrypted file found in %v", matches)
+	}
+	victimContent, _ := ioutil.ReadFile(victim)
+	if err = os.Remove(victim); err != nil {
+		t.Fatal(err)
+	}
+	if code := fsck(); code != exitcodes.FsckErrors {
+		t.Errorf("fsck after delete: want exit code %d, have %d", exitcodes.FsckErrors, code)
+	}
+	err = test_helpers.Mount(cDir, pDir, false, mountOpts...)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Manifest {
+		t.Errorf("mount after delete: want exit code %d, have %d", exitcodes.Manifest, code)
+	}
+	if err = ioutil.WriteFile(victim, victimContent, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Roll back to the older manifest. It is authentic, but the anchor
+	// knows that there is a newer one.
+	if err = ioutil.WriteFile(mPath, oldManifest, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := fsck(); code != exitcodes.FsckErrors {
+		t.Errorf("fsck after rollback: want exit code %d, have %d", exitcodes.FsckErrors, code)
+	}
+	err = test_helpers.Mount(cDir, pDir, false, mountOpts...)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Manifest {
+		t.Errorf("mount after rollback: want exit code %d, have %d", exitcodes.Manifest, code)
+	}
+}
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that -max_size rejects growing files past the limit and that the usage
+// survives a remount
+func TestMaxSize(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-max_size", "10000")
+
+	if err := ioutil.WriteFile(pDir+"/a", make([]byte, 6000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(pDir+"/b", make([]byte, 6000), 0600)
+	if !isErrno(err, syscall.EDQUOT) {
+		t.Errorf("write past the limit should fail with EDQUOT, got %v", err)
+	}
+	if err := os.Truncate(pDir+"/a", 20000); !isErrno(err, syscall.EDQUOT) {
+		t.Errorf("truncate past the limit should fail with EDQUOT, got %v", err)
+	}
+	// Deleting frees the quota
+	if err := os.Remove(pDir + "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/b", make([]byte, 9000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// The usage must be picked up again on the next mount
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-max_size", "10000")
+	defer test_helpers.UnmountPanic(pDir)
+	err = ioutil.WriteFile(pDir+"/c", make([]byte, 2000), 0600)
+	if !isErrno(err, syscall.EDQUOT) {
+		t.Errorf("write past the limit after remount should fail with EDQUOT, got %v", err)
+	}
+}
+
+// Test that the stored usage is used on the next mount, that hard links
+// count once when the usage is computed again, and that a mount without
+// -max_size drops the stored usage
+func TestMaxSizeStored(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	usage := filepath.Join(cDir, "gocryptfs.quota", "usage")
+	mount := func(args ...string) {
+		test_helpers.MountOrFatal(t, cDir, pDir, append([]string{"-extpass", "echo test"}, args...)...)
+	}
+	// The usage is stored after the unmount, wait for gocryptfs to exit
+	unmount := func() {
+		pid := test_helpers.MountInfo[pDir].Pid
+		test_helpers.UnmountPanic(pDir)
+		for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+			if i > 50 {
+				t.Fatal("timeout waiting for gocryptfs to exit")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	mount("-max_size", "10000")
+	if err := ioutil.WriteFile(pDir+"/a", make([]byte, 6000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(pDir+"/a", pDir+"/b"); err != nil {
+		t.Fatal(err)
+	}
+	unmount()
+	buf, err := ioutil.ReadFile(usage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Used":6000,"Mounted":false}`; string(buf) != want {
+		t.Errorf("want %s, have %s", want, buf)
+	}
+
+	// A stale usage is taken as it is
+	if err = ioutil.WriteFile(usage, []byte(`{"Used":9000,"Mounted":false}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mount("-max_size", "10000")
+	err = ioutil.WriteFile(pDir+"/c", make([]byte, 2000), 0600)
+	if !isErrno(err, syscall.EDQUOT) {
+		t.Errorf("the stored usage has not been used: %v", err)
+	}
+	unmount()
+
+	// A usage that has been stored while mounted is computed again, with
+	// the hard link counted once
+	if err = ioutil.WriteFile(usage, []byte(`{"Used":9000,"Mounted":true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mount("-max_size", "10000")
+	if err = ioutil.WriteFile(pDir+"/c", make([]byte, 2000), 0600); err != nil {
+		t.Errorf("the usage has not been computed again: %v", err)
+	}
+	unmount()
+
+	mount()
+	unmount()
+	if _, err = os.Stat(usage); !os.IsNotExist(err) {
+		t.Errorf("the usage is still stored after a mount without -max_size: %v", err)
+	}
+}
+
+// Test that -max_file_size rejects growing a file past the limit with EFBIG
+func TestMaxFileSize(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-max_file_size", "10000")
+	defer test_helpers.UnmountPanic(pDir)
+
+	if err := ioutil.WriteFile(pDir+"/a", make([]byte, 10000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(pDir+"/b", make([]byte, 10001), 0600)
+	if !isErrno(err, syscall.EFBIG) {
+		t.Errorf("write past the limit should fail with EFBIG, got %v", err)
+	}
+	// Sparse files count with their apparent size
+	if err := os.Truncate(pDir+"/a", 1<<40); !isErrno(err, syscall.EFBIG) {
+		t.Errorf("truncate past the limit should fail with EFBIG, got %v", err)
+	}
+	if err := os.Truncate(pDir+"/a", 5000); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/merkle"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that a filesystem created with -merkle detects a file that has been
+// cut off at a block boundary
+func TestMerkle(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-merkle")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	content := bytes.Repeat([]byte("x"), 3*4096+100)
+	if err := ioutil.WriteFile(pDir+"/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Shrink, grow with a hole, and write to the hole
+	if err := os.Truncate(pDir+"/file", 2*4096+50); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(pDir+"/file", 5*4096); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(pDir+"/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(content[:10], 3*4096); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	want := make([]byte, 5*4096)
+	copy(want, content[:2*4096+50])
+	copy(want[3*4096:], content[:10])
+	// Deleting a file deletes its tree
+	if err = ioutil.WriteFile(pDir+"/deleteme", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(pDir + "/deleteme"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	trees, err := ioutil.ReadDir(filepath.Join(cDir, merkle.DirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One tree and the marker of the reserved directory
+	if len(trees) != 2 {
+		t.Errorf("want 1 tree, have %d", len(trees)-1)
+	}
+
+	fsck := func() int {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test", cDir)
+		out, err := cmd.CombinedOutput()
+		t.Log(string(out))
+		return test_helpers.ExtractCmdExitCode(err)
+	}
+	if code := fsck(); code != 0 {
+		t.Errorf("fsck: exit code %d", code)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	have, err := ioutil.ReadFile(pDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Error("content mismatch")
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// Cut off the last block behind our back
+	matches, err := filepath.Glob(cDir + "/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var victim string
+	for _, m := range matches {
+		if !strings.HasPrefix(filepath.Base(m), "gocryptfs.") {
+			victim = m
+		}
+	}
+	readEIO := func() {
+		test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-wpanic=false")
+		_, err := ioutil.ReadFile(pDir + "/file")
+		if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EIO {
+			t.Errorf("want EIO, have %v", err)
+		}
+		test_helpers.UnmountPanic(pDir)
+	}
+	// Zero a block, which makes it look like a file hole
+	const headerLen = 18 + merkle.StateLen
+	vf, err := os.OpenFile(victim, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := make([]byte, 4128)
+	vf.ReadAt(block, headerLen+4128)
+	if _, err = vf.WriteAt(make([]byte, 4128), headerLen+4128); err != nil {
+		t.Fatal(err)
+	}
+	readEIO()
+	vf.WriteAt(block, headerLen+4128)
+	vf.Close()
+	if err = os.Truncate(victim, headerLen+4*4128); err != nil {
+		t.Fatal(err)
+	}
+	readEIO()
+	if code := fsck(); code != exitcodes.FsckErrors {
+		t.Errorf("fsck: want exit code %d, have %d", exitcodes.FsckErrors, code)
+	}
+}
+
+// -merkle is a creation-time option
+func TestMerkleWithoutInit(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	err := test_helpers.Mount(cDir, pDir, false, "-extpass", "echo test", "-merkle")
+	if err == nil {
+		test_helpers.UnmountPanic(pDir)
+		t.Fatal("mount with -merkle should have failed")
+	}
+}
+
+// A crash leaves the hash tree state dirty. The tree is then rebuilt from
+// the file contents.
+func TestMerkleCrash(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-merkle")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	content := bytes.Repeat([]byte("x"), 3*4096+100)
+	if err := ioutil.WriteFile(pDir+"/clean", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(pDir+"/clean", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overwrite the second block and append
+	if _, err = f.WriteAt(content, 4096); err != nil {
+		t.Fatal(err)
+	}
+	want := append(content[:4096:4096], content...)
+	pid := test_helpers.MountInfo[pDir].Pid
+	if err = syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		if i > 50 {
+			t.Fatal("timeout waiting for gocryptfs to exit")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	f.Close()
+	test_helpers.UnmountPanic(pDir)
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	have, err := ioutil.ReadFile(pDir + "/clean")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Error("content mismatch")
+	}
+	test_helpers.UnmountPanic(pDir)
+}
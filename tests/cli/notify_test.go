@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// waitExists waits until the existence of "path" matches "want". The entry
+// cache timeout is one second, so a change must show up faster than that.
+func waitExists(t *testing.T, path string, want bool) {
+	t.Helper()
+	for i := 0; ; i++ {
+		_, err := os.Stat(path)
+		if (err == nil) == want {
+			return
+		}
+		if i > 25 {
+			t.Errorf("%q: want exists=%v, have %v", path, want, err)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Test that -notify makes changes done through another mount of the same
+// CIPHERDIR visible immediately
+func TestNotify(t *testing.T) {
+	testNotify(t)
+}
+
+// Test that -notify can still watch new directories with -seccomp
+func TestNotifySeccomp(t *testing.T) {
+	if runtime.GOOS != "linux" || (runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64") {
+		t.Skip("only works on linux/amd64 and linux/arm64")
+	}
+	testNotify(t, "-seccomp")
+}
+
+func testNotify(t *testing.T, extraArgs ...string) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, append([]string{"-extpass", "echo test", "-notify"}, extraArgs...)...)
+	defer test_helpers.UnmountPanic(pDir)
+	pDir2 := cDir + ".mnt2"
+	test_helpers.MountOrFatal(t, cDir, pDir2, "-extpass", "echo test", "-sharedstorage")
+	defer test_helpers.UnmountPanic(pDir2)
+
+	// Cache a negative entry, then create the file through the other mount
+	if _, err := os.Stat(pDir + "/foo"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir2+"/foo", []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitExists(t, pDir+"/foo", true)
+
+	// Subdirectories are watched once they have been listed
+	if err := os.Mkdir(pDir2+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	waitExists(t, pDir+"/dir", true)
+	if _, err := ioutil.ReadDir(pDir + "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", 200)
+	if _, err := os.Stat(pDir + "/dir/" + long); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir2+"/dir/"+long, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitExists(t, pDir+"/dir/"+long, true)
+
+	// Deletes and renames
+	if err := os.Remove(pDir2 + "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	waitExists(t, pDir+"/foo", false)
+	if err := os.Rename(pDir2+"/dir/"+long, pDir2+"/dir/short"); err != nil {
+		t.Fatal(err)
+	}
+	waitExists(t, pDir+"/dir/"+long, false)
+	waitExists(t, pDir+"/dir/short", true)
+}
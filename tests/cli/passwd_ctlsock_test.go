@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestPasswdCtlsock checks that "-passwd -ctlsock" changes the password while
+// the filesystem stays mounted
+func TestPasswdCtlsock(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	sock := dir + ".sock"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-ctlsock", sock)
+	file1 := mnt + "/file1"
+	if err := ioutil.WriteFile(file1, []byte("somecontent"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ChangePassword: true, Info: true})
+	if resp.ErrText != "Ambiguous" {
+		t.Errorf("ChangePassword with Info should be ambiguous, got %q", resp.ErrText)
+	}
+
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-ctlsock", sock)
+	cmd.Stdin = strings.NewReader("test\nnewpasswd\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if _, _, err := configfile.LoadAndDecrypt(dir+"/gocryptfs.conf", []byte("newpasswd")); err != nil {
+		t.Errorf("new password does not work: %v", err)
+	}
+	// Still mounted
+	if err := ioutil.WriteFile(mnt+"/file2", []byte("x"), 0600); err != nil {
+		t.Error(err)
+	}
+	if err := test_helpers.UnmountErr(mnt); err != nil {
+		t.Fatal(err)
+	}
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo newpasswd")
+	defer test_helpers.UnmountPanic(mnt)
+	content, err := ioutil.ReadFile(file1)
+	if err != nil {
+		t.Error(err)
+	} else if string(content) != "somecontent" {
+		t.Errorf("wrong content: %q", string(content))
+	}
+}
@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test the "plaintext", "readonly" and "exclude" actions of -policy
+func TestPolicy(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	policyFile := cDir + ".policy"
+	err := ioutil.WriteFile(policyFile, []byte(
+		"plaintext /pub\nreadonly /pub/ro\nexclude /hidden\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-policy", policyFile)
+	defer test_helpers.UnmountPanic(pDir)
+
+	// plaintext: name and content end up unencrypted in CIPHERDIR
+	if err := os.MkdirAll(pDir+"/pub/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("hello world")
+	if err := ioutil.WriteFile(pDir+"/pub/sub/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	have, err := ioutil.ReadFile(cDir + "/pub/sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(have) != string(content) {
+		t.Errorf("plaintext content mismatch: %q", have)
+	}
+	if _, err := os.Stat(cDir + "/pub/sub/gocryptfs.diriv"); err == nil {
+		t.Error("plaintext directory should not have a diriv")
+	}
+	if err := os.Symlink("target", pDir+"/pub/link"); err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := os.Readlink(cDir + "/pub/link"); target != "target" {
+		t.Errorf("plaintext symlink target mismatch: %q", target)
+	}
+	test_helpers.VerifySize(t, pDir+"/pub/sub/file", len(content))
+
+	// readonly
+	err = os.Mkdir(pDir+"/pub/ro", 0700)
+	if !isErrno(err, syscall.EROFS) {
+		t.Errorf("creating a readonly path should fail with EROFS, got %v", err)
+	}
+
+	// exclude
+	if err := os.Mkdir(pDir+"/hidden", 0700); !isErrno(err, syscall.EPERM) {
+		t.Errorf("creating an excluded path should fail with EPERM, got %v", err)
+	}
+	if _, err := os.Stat(pDir + "/hidden"); !os.IsNotExist(err) {
+		t.Errorf("excluded path should not exist, got %v", err)
+	}
+
+	// Renaming across the plaintext border
+	if err := ioutil.WriteFile(pDir+"/secret", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(pDir+"/secret", pDir+"/pub/secret")
+	if !isErrno(err, syscall.EXDEV) {
+		t.Errorf("renaming across the plaintext border should fail with EXDEV, got %v", err)
+	}
+
+	// Encrypted entries stay encrypted
+	matches, _ := filepath.Glob(cDir + "/secret")
+	if len(matches) != 0 {
+		t.Error("encrypted file name visible in CIPHERDIR")
+	}
+}
+
+// An invalid policy file must be rejected before mounting
+func TestPolicyInvalid(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	policyFile := cDir + ".policy"
+	if err := ioutil.WriteFile(policyFile, []byte("encrypt /foo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := test_helpers.Mount(cDir, pDir, false, "-extpass", "echo test", "-policy", policyFile)
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.PolicyError {
+		t.Errorf("wrong exit code: want=%d, have=%d", exitcodes.PolicyError, exitCode)
+	}
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == errno
+	}
+	if le, ok := err.(*os.LinkError); ok {
+		return le.Err == errno
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/hybridkem"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that a filesystem created with -pqkey needs both the password and the
+// key file
+func TestPQKey(t *testing.T) {
+	if !hybridkem.Supported {
+		t.Skip("built without ML-KEM support")
+	}
+	keyFile := test_helpers.TmpDir + "/TestPQKey.key"
+	cDir := test_helpers.InitFS(t, "-pqkey", keyFile)
+	c, err := configfile.Load(cDir + "/" + configfile.ConfDefaultName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagPQHybrid) || c.PQHybrid == nil {
+		t.Fatal("PQHybrid feature flag is not set")
+	}
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-pqkey", keyFile)
+	if err = ioutil.WriteFile(pDir+"/foo", []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	// Without the key file
+	err = test_helpers.Mount(cDir, pDir, false, "-extpass", "echo test")
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Usage {
+		t.Errorf("mount without -pqkey: want exit code %d, have %d", exitcodes.Usage, code)
+	}
+	// With the wrong key file
+	otherKey := test_helpers.TmpDir + "/TestPQKey.other.key"
+	if _, err = hybridkem.CreateKeyFile(otherKey); err != nil {
+		t.Fatal(err)
+	}
+	err = test_helpers.Mount(cDir, pDir, false, "-extpass", "echo test", "-pqkey", otherKey, "-wpanic=false")
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.PasswordIncorrect {
+		t.Errorf("mount with wrong -pqkey: want exit code %d, have %d", exitcodes.PasswordIncorrect, code)
+	}
+	// Change the password, the key file stays the same
+	testPasswd(t, cDir, "-pqkey", keyFile)
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo newpasswd", "-pqkey", keyFile)
+	content, err := ioutil.ReadFile(pDir + "/foo")
+	test_helpers.UnmountPanic(pDir)
+	if err != nil || string(content) != "bar" {
+		t.Errorf("read back %q, %v", content, err)
+	}
+}
@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that -rekey replaces the master key and that all files can be read
+// with the new one
+func TestRekey(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := ioutil.WriteFile(pDir+"/file", []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(pDir+"/file", pDir+"/hardlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(pDir+"/dir", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/dir/x", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/x", pDir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	// Read-only directory: -rekey must be able to empty it anyway
+	if err := os.Mkdir(pDir+"/ro", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/ro/y", []byte("y"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(pDir+"/ro", 0500); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	oldKey, _, err := configfile.LoadAndDecrypt(cDir+"/"+configfile.ConfDefaultName, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-rekey", "-extpass", "echo test", cDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	newKey, _, err := configfile.LoadAndDecrypt(cDir+"/"+configfile.ConfDefaultName, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(oldKey, newKey) {
+		t.Error("master key has not changed")
+	}
+	if _, err = os.Stat(cDir + "/gocryptfs.rekey"); !os.IsNotExist(err) {
+		t.Errorf("gocryptfs.rekey was not removed: %v", err)
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if x, err := ioutil.ReadFile(pDir + "/file"); err != nil || string(x) != "hello" {
+		t.Errorf("file: %q, %v", x, err)
+	}
+	if fi, err := os.Stat(pDir + "/file"); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("file: wrong mode or error: %v", err)
+	}
+	var st1, st2 syscall.Stat_t
+	if err = syscall.Stat(pDir+"/file", &st1); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Stat(pDir+"/hardlink", &st2); err != nil {
+		t.Fatal(err)
+	}
+	if st1.Ino != st2.Ino || st1.Nlink != 2 {
+		t.Errorf("hard link lost: ino %d/%d, nlink %d", st1.Ino, st2.Ino, st1.Nlink)
+	}
+	if fi, err := os.Stat(pDir + "/dir"); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("dir: wrong mode or error: %v", err)
+	}
+	if x, err := ioutil.ReadFile(pDir + "/dir/x"); err != nil || string(x) != "x" {
+		t.Errorf("dir/x: %q, %v", x, err)
+	}
+	if target, err := os.Readlink(pDir + "/link"); err != nil || target != "dir/x" {
+		t.Errorf("link: target %q, %v", target, err)
+	}
+	if fi, err := os.Stat(pDir + "/ro"); err != nil || fi.Mode().Perm() != 0500 {
+		t.Errorf("ro: wrong mode or error: %v", err)
+	}
+	if x, err := ioutil.ReadFile(pDir + "/ro/y"); err != nil || string(x) != "y" {
+		t.Errorf("ro/y: %q, %v", x, err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// An interrupted -rekey blocks the mount
+	if err = os.Mkdir(cDir+"/gocryptfs.rekey", 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test", cDir, pDir)
+	err = cmd.Run()
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Rekey {
+		t.Errorf("mount should fail with exit code %d, got %d", exitcodes.Rekey, code)
+	}
+	// Running -rekey again completes it
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-rekey", "-extpass", "echo test", cDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	if x, err := ioutil.ReadFile(pDir + "/file"); err != nil || string(x) != "hello" {
+		t.Errorf("file after resume: %q, %v", x, err)
+	}
+}
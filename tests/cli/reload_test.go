@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestReload checks that changed mount defaults are applied on a ctlsock
+// Reload request and on SIGHUP, without unmounting
+func TestReload(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-ctlsock", sock)
+	defer test_helpers.UnmountPanic(pDir)
+	setDefaults := func(list string) {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-mount-defaults", list, "-extpass", "echo test", cDir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+	}
+	cacheMem := func() uint64 {
+		return test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Stats: true}).Stats.CacheMemLimit
+	}
+
+	setDefaults("cachemem=1000000,idle=1h,kernel_cache")
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Reload: true})
+	if resp.ErrNo != 0 {
+		t.Fatalf("reload failed: %q", resp.ErrText)
+	}
+	if resp.Result != "cachemem,idle" {
+		t.Errorf("wrong changes %q", resp.Result)
+	}
+	if !strings.Contains(resp.WarnText, "kernel_cache") {
+		t.Errorf("kernel_cache needs a remount, but WarnText is %q", resp.WarnText)
+	}
+	if m := cacheMem(); m != 1000000 {
+		t.Errorf("cachemem not applied: %d", m)
+	}
+	// Nothing has changed since
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Reload: true})
+	if resp.ErrNo != 0 || resp.Result != "" {
+		t.Errorf("second reload: %q %q", resp.Result, resp.ErrText)
+	}
+
+	setDefaults("cachemem=2000000")
+	pid := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Info: true}).Info.Pid
+	if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; cacheMem() != 2000000; i++ {
+		if i > 50 {
+			t.Fatalf("SIGHUP did not reload, cachemem is %d", cacheMem())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Options changed without the master key are rejected
+	cf, err := configfile.Load(cDir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.MountDefaults = []string{"cachemem=3000000"}
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Reload: true})
+	if resp.ErrNo == 0 {
+		t.Error("reload should have failed")
+	}
+	if m := cacheMem(); m != 2000000 {
+		t.Errorf("cachemem changed to %d", m)
+	}
+	// Reload cannot be combined with other requests
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Reload: true, Sync: true})
+	if resp.ErrText != "Ambiguous" {
+		t.Errorf("want Ambiguous, have %q", resp.ErrText)
+	}
+}
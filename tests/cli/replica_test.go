@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/dirlock"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that -replica repairs a corrupt block
+func TestReplica(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	replica := cDir + ".replica"
+	content := bytes.Repeat([]byte("x"), 10000)
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := ioutil.WriteFile(pDir+"/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	if out, err := exec.Command("cp", "-a", cDir, replica).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	// Corrupt the second block of the only file in CIPHERDIR
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cFile string
+	for _, e := range entries {
+		if e.Name() != configfile.ConfDefaultName && e.Name() != nametransform.DirIVFilename &&
+			e.Name() != dirlock.FileName {
+			cFile = filepath.Join(cDir, e.Name())
+		}
+	}
+	f, err := os.OpenFile(cFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("corrupt"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-wpanic=false", "-replica", replica)
+	have, err := ioutil.ReadFile(pDir + "/file")
+	if err != nil || !bytes.Equal(have, content) {
+		t.Errorf("read through -replica failed: %v", err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// The primary copy must have been repaired
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	have, err = ioutil.ReadFile(pDir + "/file")
+	if err != nil || !bytes.Equal(have, content) {
+		t.Errorf("file was not repaired: %v", err)
+	}
+}
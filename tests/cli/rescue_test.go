@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/testharness"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that -rescue reads what is left of a CIPHERDIR with a destroyed config
+// file, a corrupt block and a corrupt directory
+func TestRescue(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	content := make([]byte, 3*4096)
+	for i := range content {
+		content[i] = byte(i/4096 + 1)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := ioutil.WriteFile(pDir+"/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"good", "bad"} {
+		if err := os.Mkdir(pDir+"/"+dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pDir+"/"+dir+"/x", []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// Find the ciphertext names and destroy things
+	conf := cDir + "/" + configfile.ConfDefaultName
+	masterkey, _, err := configfile.LoadAndDecrypt(conf, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cCore := cryptocore.New(masterkey, cryptocore.BackendGoGCM, 128, true)
+	dirIV, err := ioutil.ReadFile(cDir + "/" + nametransform.DirIVFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt := nametransform.New(cCore.EMECipher, true, 0, true, nil, false)
+	cFile, _ := nt.EncryptName("file", dirIV)
+	cBad, _ := nt.EncryptName("bad", dirIV)
+	if err = testharness.CorruptBlock(cDir+"/"+cFile, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = testharness.CorruptDirIV(cDir + "/" + cBad); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(conf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(conf, []byte("{ garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// -rescue needs -masterkey
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-rescue", "-extpass", "echo test", cDir, pDir)
+	if code := test_helpers.ExtractCmdExitCode(cmd.Run()); code != exitcodes.Usage {
+		t.Errorf("-rescue without -masterkey: exit code %d, want %d", code, exitcodes.Usage)
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-rescue", "-masterkey", hex.EncodeToString(masterkey),
+		"-wpanic=false")
+	defer test_helpers.UnmountPanic(pDir)
+	have, err := ioutil.ReadFile(pDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{}, content...)
+	copy(want[4096:2*4096], make([]byte, 4096))
+	if !bytes.Equal(have, want) {
+		t.Errorf("block 1 should read as zeros, the others should be intact")
+	}
+	if x, err := ioutil.ReadFile(pDir + "/good/x"); err != nil || string(x) != "x" {
+		t.Errorf("good/x: %q, %v", x, err)
+	}
+	entries, err := ioutil.ReadDir(pDir + "/bad")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("bad: want an empty directory, have %d entries, %v", len(entries), err)
+	}
+	// Read-only
+	if err = ioutil.WriteFile(pDir+"/new", nil, 0600); err == nil {
+		t.Error("-rescue mount should be read-only")
+	}
+}
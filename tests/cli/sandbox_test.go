@@ -0,0 +1,162 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// waitProcStatus waits until the value of "field" in /proc/PID/status
+// starts with "want". The gocryptfs process notifies us before it applies
+// the sandbox.
+func waitProcStatus(t *testing.T, pid int, field string, want string) {
+	var have string
+	for i := 0; i < 20; i++ {
+		content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.HasPrefix(line, field+":") {
+				have = strings.TrimSpace(strings.TrimPrefix(line, field+":"))
+			}
+		}
+		if strings.HasPrefix(have, want) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("%s: want %q, have %q", field, want, have)
+}
+
+// Test that the filesystem works with "-seccomp", and that the filter is
+// active
+func TestSeccomp(t *testing.T) {
+	if runtime.GOOS != "linux" || (runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64") {
+		t.Skip("only works on linux/amd64 and linux/arm64")
+	}
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-seccomp")
+	pid := test_helpers.MountInfo[pDir].Pid
+	defer unmountAndWait(t, pDir, pid)
+	// 2 = SECCOMP_MODE_FILTER
+	waitProcStatus(t, pid, "Seccomp", "2")
+	sandboxWorkload(t, pDir)
+}
+
+// Test that "-sandbox-user" chroots into CIPHERDIR and switches user
+func TestSandboxUser(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only works on linux")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("must run as root")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	// The sandbox user needs access to CIPHERDIR
+	err = filepath.Walk(cDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not together with options that need paths outside of CIPHERDIR
+	err = test_helpers.Mount(cDir, pDir, false, "-extpass", "echo test", "-sandbox-user", "nobody",
+		"-ctlsock", cDir+".sock")
+	if err == nil {
+		t.Fatal("-sandbox-user together with -ctlsock should have failed")
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-sandbox-user", "nobody")
+	pid := test_helpers.MountInfo[pDir].Pid
+	defer unmountAndWait(t, pDir, pid)
+	waitProcStatus(t, pid, "Uid", u.Uid+"\t")
+	root, err := os.Readlink(fmt.Sprintf("/proc/%d/root", pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != cDir {
+		t.Errorf("root: want %q, have %q", cDir, root)
+	}
+	sandboxWorkload(t, pDir)
+}
+
+// unmountAndWait unmounts "pDir" and waits for the gocryptfs process "pid"
+// to exit
+func unmountAndWait(t *testing.T, pDir string, pid int) {
+	test_helpers.UnmountPanic(pDir)
+	waitForExit(t, pid)
+}
+
+// sandboxWorkload exercises operations that need special syscalls or
+// access to /proc
+func sandboxWorkload(t *testing.T, pDir string) {
+	file := pDir + "/file"
+	if err := ioutil.WriteFile(file, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(file); err != nil || string(content) != "foo" {
+		t.Errorf("ReadFile: %q, %v", content, err)
+	}
+	if err := os.Chmod(file, 0640); err != nil {
+		t.Error(err)
+	}
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Error(err)
+	}
+	if err := os.Symlink("file", pDir+"/symlink"); err != nil {
+		t.Error(err)
+	}
+	if err := os.Rename(pDir+"/symlink", pDir+"/dir/symlink"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(pDir + "/dir/symlink"); !os.IsNotExist(err) {
+		t.Errorf("dangling symlink: want ENOENT, have %v", err)
+	}
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(10000); err != nil {
+		t.Error(err)
+	}
+	if err = f.Sync(); err != nil {
+		t.Error(err)
+	}
+	entries, err := ioutil.ReadDir(pDir)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("ReadDir: %d entries, %v", len(entries), err)
+	}
+}
+
+// Test that "-seccomp" is rejected for "-health", which does not mount
+// anything
+func TestSeccompHealth(t *testing.T) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-health", "-seccomp", test_helpers.TmpDir)
+	err := cmd.Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("want exit code %d, have %d", exitcodes.Usage, exitCode)
+	}
+}
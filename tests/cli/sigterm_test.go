@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that SIGTERM rejects new opens, waits for open files to be closed,
+// and then unmounts cleanly without losing data.
+func TestSigterm(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-wpanic=false")
+	pid := test_helpers.MountInfo[pDir].Pid
+
+	f, err := os.Create(pDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	// Still mounted, as "file" is open, but new opens fail
+	_, err = os.Create(pDir + "/file2")
+	if !isErrno(err, syscall.ESHUTDOWN) {
+		t.Errorf("want ESHUTDOWN, have %v", err)
+	}
+	if _, err = f.Write([]byte("bar")); err != nil {
+		t.Error(err)
+	}
+	f.Close()
+	// The process should exit once the file is closed
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		if i > 50 {
+			t.Fatal("timeout waiting for unmount")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	content, err := ioutil.ReadFile(pDir + "/file")
+	if err != nil || string(content) != "foobar" {
+		t.Errorf("have %q, %v", content, err)
+	}
+}
@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that a subvolume is only accessible with "-unlock", and that files
+// cannot be moved in or out of it
+func TestSubvolumes(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-add-subvolume", "work", "-extpass", "echo test", cDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// Nested subvolumes are rejected
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-add-subvolume", "work/x", "-extpass", "echo test", cDir)
+	if err := cmd.Run(); err == nil {
+		t.Error("nested subvolume was accepted")
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-unlock", "work")
+	if err := ioutil.WriteFile(pDir+"/work/file", []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/outside", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(pDir+"/outside", pDir+"/work/outside"); err == nil {
+		t.Error("rename into the subvolume should fail")
+	}
+	if err := os.Rename(pDir+"/work", pDir+"/work2"); err == nil {
+		t.Error("renaming the subvolume should fail")
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// Locked: the directory is visible, its contents are not
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if fi, err := os.Stat(pDir + "/work"); err != nil || !fi.IsDir() {
+		t.Errorf("work: %v", err)
+	}
+	if _, err := ioutil.ReadDir(pDir + "/work"); err == nil {
+		t.Error("ReadDir of a locked subvolume should fail")
+	}
+	if _, err := ioutil.ReadFile(pDir + "/work/file"); err == nil {
+		t.Error("reading from a locked subvolume should fail")
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-unlock", "work")
+	defer test_helpers.UnmountPanic(pDir)
+	if x, err := ioutil.ReadFile(pDir + "/work/file"); err != nil || string(x) != "secret" {
+		t.Errorf("work/file: %q, %v", x, err)
+	}
+}
+
+// Test locking and unlocking a subvolume at runtime through the control socket
+func TestSubvolumeRuntimeLock(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-add-subvolume", "work", "-extpass", "echo test", cDir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-unlock", "work", "-ctlsock", sock)
+	defer test_helpers.UnmountPanic(pDir)
+	if err := ioutil.WriteFile(pDir+"/work/file", []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Open files keep the subvolume from being locked
+	f, err := os.Open(pDir + "/work/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{LockSubvolume: "work"})
+	if resp.ErrNo != int32(syscall.EBUSY) {
+		t.Errorf("want EBUSY, have %d %q", resp.ErrNo, resp.ErrText)
+	}
+	f.Close()
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-lock-subvolume", "work", "-ctlsock", sock)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if _, err = ioutil.ReadFile(pDir + "/work/file"); !isErrno(err, syscall.EACCES) {
+		t.Errorf("want EACCES, have %v", err)
+	}
+	// The rest of the mount stays usable
+	if err = ioutil.WriteFile(pDir+"/outside", []byte("x"), 0600); err != nil {
+		t.Error(err)
+	}
+	// Wrong password
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{UnlockSubvolume: "work", Password: "wrong"})
+	if resp.ErrNo == 0 {
+		t.Error("wrong password was accepted")
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-unlock-subvolume", "work", "-extpass", "echo test", pDir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if x, err := ioutil.ReadFile(pDir + "/work/file"); err != nil || string(x) != "secret" {
+		t.Errorf("work/file: %q, %v", x, err)
+	}
+}
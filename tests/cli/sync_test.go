@@ -0,0 +1,35 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that the durability options do not break normal operation
+func TestSyncOptions(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test",
+		"-sync", "-fsync_on_close", "-fsync_interval", "10ms")
+	defer test_helpers.UnmountPanic(pDir)
+
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("x"), 10000)
+	path := pDir + "/dir/file"
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Give syncLoop a chance to run
+	time.Sleep(50 * time.Millisecond)
+	have, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(have, content) {
+		t.Errorf("wrong content: %v", err)
+	}
+}
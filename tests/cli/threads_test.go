@@ -0,0 +1,57 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"sync"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that the mount works when -threads, -max_background and
+// -write_threads allow less concurrency than the application uses
+func TestThreads(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test",
+		"-threads=1", "-max_background=1", "-write_threads=3")
+	defer test_helpers.UnmountPanic(pDir)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("%s/file%d", pDir, i)
+			if err := ioutil.WriteFile(path, content, 0600); err != nil {
+				t.Error(err)
+				return
+			}
+			have, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(have, content) {
+				t.Errorf("file%d: wrong content", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Test that negative values are rejected
+func TestThreadsInvalid(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	for _, opt := range []string{"-threads=-1", "-max_background=-1", "-max_background=70000", "-write_threads=-1"} {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-extpass", "echo test", opt, cDir, pDir)
+		err := cmd.Run()
+		if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Usage {
+			t.Errorf("%s: want exit code %d, have %d", opt, exitcodes.Usage, code)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that -union merges two CIPHERDIRs and creates new files in the first
+func TestUnion(t *testing.T) {
+	cDir1 := test_helpers.InitFS(t)
+	cDir2 := test_helpers.InitFS(t)
+	pDir := cDir1 + ".mnt"
+
+	// Put a file into the second CIPHERDIR only
+	test_helpers.MountOrFatal(t, cDir2, pDir, "-extpass", "echo test")
+	if err := ioutil.WriteFile(pDir+"/second", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	test_helpers.MountOrFatal(t, cDir1, pDir, "-extpass", "echo test", "-union", cDir2)
+	if err := ioutil.WriteFile(pDir+"/first", []byte("1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("want 2 entries, have %d", len(entries))
+	}
+	if have, err := ioutil.ReadFile(pDir + "/second"); err != nil || string(have) != "2" {
+		t.Errorf("reading file from second branch: %q, %v", have, err)
+	}
+	// Rename across branches must fail with EXDEV
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(pDir+"/second", pDir+"/dir/second")
+	if !isErrno(err, syscall.EXDEV) {
+		t.Errorf("cross-branch rename should fail with EXDEV, got %v", err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// The new file must have ended up in the first CIPHERDIR
+	test_helpers.MountOrFatal(t, cDir1, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	if _, err := os.Stat(pDir + "/first"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(pDir + "/second"); err == nil {
+		t.Error("file from second branch leaked into the first")
+	}
+}
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that "-unmount -when-idle" waits for the last open file to be closed
+func TestUnmountWhenIdle(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-ctlsock", sock)
+	pid := test_helpers.MountInfo[pDir].Pid
+
+	f, err := os.Create(pDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-unmount", "-when-idle", "-ctlsock", sock)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	// Still mounted, but new opens fail
+	_, err = os.Create(pDir + "/file2")
+	if !isErrno(err, syscall.ESHUTDOWN) {
+		t.Errorf("want ESHUTDOWN, have %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if syscall.Kill(pid, 0) != nil {
+		t.Fatal("unmounted although a file is open")
+	}
+	f.Close()
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		if i > 50 {
+			t.Fatal("timeout waiting for unmount")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// waitForExit waits for the process "pid" to exit
+func waitForExit(t *testing.T, pid int) {
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		if i > 50 {
+			t.Fatalf("timeout waiting for pid %d to exit", pid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Test "-unmount MOUNTPOINT" on an idle and on a busy filesystem
+func TestUnmount(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only works on linux")
+	}
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+
+	// Not mounted yet
+	err := exec.Command(test_helpers.GocryptfsBinary, "-q", "-unmount", cDir).Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.MountPoint {
+		t.Errorf("want=%d, got=%d", exitcodes.MountPoint, exitCode)
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-ctlsock", cDir+".sock")
+	pid := test_helpers.MountInfo[pDir].Pid
+	if err = ioutil.WriteFile(pDir+"/file", []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(test_helpers.GocryptfsBinary, "-unmount", pDir).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	waitForExit(t, pid)
+
+	// Busy: we have a file open
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-wpanic=false")
+	pid = test_helpers.MountInfo[pDir].Pid
+	f, err := os.Open(pDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-unmount", pDir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if !strings.Contains(string(out), fmt.Sprintf("pid %d ", os.Getpid())) {
+		t.Errorf("our process is not listed as a user:\n%s", out)
+	}
+	// Lazily unmounted. We can still read the file.
+	buf := make([]byte, 3)
+	if _, err = f.Read(buf); err != nil || string(buf) != "foo" {
+		t.Errorf("have %q, %v", buf, err)
+	}
+	f.Close()
+	waitForExit(t, pid)
+}
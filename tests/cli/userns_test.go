@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that a "-userns" mount is only visible inside the new namespace, and
+// that it can be entered using nsenter.
+func TestUserns(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only works on linux")
+	}
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		t.Skip("nsenter not found")
+	}
+	if err := exec.Command("unshare", "--user", "--map-root-user", "--mount", "true").Run(); err != nil {
+		t.Skipf("cannot create user namespaces: %v", err)
+	}
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-userns", "-ctlsock", sock)
+	// test_helpers only knows the pid of the process outside of the
+	// namespace. Ask the gocryptfs process inside.
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Query(&ctlsock.RequestStruct{Info: true})
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := resp.Info.Pid
+	defer syscall.Kill(pid, syscall.SIGTERM)
+
+	cmd := exec.Command("nsenter", "--target", strconv.Itoa(pid), "--user", "--mount", "--preserve-credentials",
+		"sh", "-c", "echo foo > "+pDir+"/file && cat "+pDir+"/file")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if string(out) != "foo\n" {
+		t.Errorf("wrong content: %q", out)
+	}
+	// Not visible outside
+	if _, err := os.Stat(pDir + "/file"); !os.IsNotExist(err) {
+		t.Errorf("want ENOENT, have %v", err)
+	}
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gocryptfs.conf, gocryptfs.diriv, gocryptfs.lock and the new file
+	if len(entries) < 4 {
+		t.Errorf("file was not written to CIPHERDIR: %d entries", len(entries))
+	}
+	// SIGTERM unmounts
+	syscall.Kill(pid, syscall.SIGTERM)
+	waitForExit(t, pid)
+}
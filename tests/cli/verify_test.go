@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test -verify against a copy of the ciphertext view of a reverse mount
+func TestVerify(t *testing.T) {
+	pDir := test_helpers.InitFS(t, "-reverse")
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/dir/file", []byte("hello world"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/"+strings.Repeat("x", 200), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", pDir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	// Back up the ciphertext view
+	mnt := pDir + ".mnt"
+	backup := pDir + ".backup"
+	test_helpers.MountOrFatal(t, pDir, mnt, "-reverse", "-extpass", "echo test")
+	out, err := exec.Command("cp", "-a", mnt, backup).CombinedOutput()
+	test_helpers.UnmountPanic(mnt)
+	if err != nil {
+		t.Fatalf("cp: %v\n%s", err, out)
+	}
+	runVerify := func() (string, int) {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test", "-verify", pDir, backup)
+		out, err := cmd.CombinedOutput()
+		return string(out), test_helpers.ExtractCmdExitCode(err)
+	}
+	if out, code := runVerify(); code != 0 {
+		t.Fatalf("the backup should match, exit code %d:\n%s", code, out)
+	}
+	// Change the content but not the size, add a file, delete a file
+	if err := ioutil.WriteFile(pDir+"/dir/file", []byte("hello WORLD"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/new", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(pDir + "/link"); err != nil {
+		t.Fatal(err)
+	}
+	report, code := runVerify()
+	if code != exitcodes.VerifyDiffers {
+		t.Errorf("want exit code %d, have %d", exitcodes.VerifyDiffers, code)
+	}
+	for _, want := range []string{`"dir/file": content differs`, `"new": missing in CIPHERDIR`, `"link": only in CIPHERDIR`} {
+		if !strings.Contains(report, want) {
+			t.Errorf("output should contain %q:\n%s", want, report)
+		}
+	}
+}
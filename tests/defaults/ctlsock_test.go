@@ -1,7 +1,11 @@
 package defaults
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -96,3 +100,284 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+// TestCtlSockLogLevels checks that log levels can be queried and set at
+// runtime
+func TestCtlSockLogLevels(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test",
+		"-loglevel", "nametransform=warn")
+	defer test_helpers.UnmountPanic(pDir)
+	// Query
+	req := ctlsock.RequestStruct{LogLevels: map[string]string{}}
+	response := test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo != 0 || response.LogLevels["nametransform"] != "warn" ||
+		response.LogLevels["fusefrontend"] != "default" {
+		t.Errorf("wrong levels: %+v", response)
+	}
+	// Set
+	req.LogLevels = map[string]string{"fusefrontend": "debug", "ctlsock": "info"}
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo != 0 || response.LogLevels["fusefrontend"] != "debug" ||
+		response.LogLevels["ctlsock"] != "info" || response.LogLevels["nametransform"] != "warn" {
+		t.Errorf("wrong levels: %+v", response)
+	}
+	// Unknown modules and levels are rejected, and nothing is changed
+	req.LogLevels = map[string]string{"fusefrontend": "default", "nosuchmodule": "debug"}
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo == 0 {
+		t.Errorf("unknown module accepted: %+v", response)
+	}
+	req.LogLevels = map[string]string{"fusefrontend": "loud"}
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo == 0 {
+		t.Errorf("unknown level accepted: %+v", response)
+	}
+	req.LogLevels = map[string]string{}
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	if response.LogLevels["fusefrontend"] != "debug" {
+		t.Errorf("failed request changed the levels: %+v", response)
+	}
+	// The mount still works with debug output on
+	if err := ioutil.WriteFile(pDir+"/foo", []byte("bar"), 0600); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestCtlSockStats checks that the Stats request reports the bytes read and
+// written per file and per process
+func TestCtlSockStats(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := ioutil.WriteFile(pDir+"/written", make([]byte, 10000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(pDir + "/written"); err != nil {
+		t.Fatal(err)
+	}
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Stats: true})
+	s := response.Stats
+	if response.ErrNo != 0 || s == nil {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if s.BytesWritten != 10000 || s.Ops["write"] == 0 || s.Ops["create"] != 1 {
+		t.Errorf("wrong counters: %+v", s)
+	}
+	if len(s.Files) != 1 || s.Files[0].Path != "written" || s.Files[0].BytesWritten != 10000 ||
+		s.Files[0].BytesRead != s.BytesRead {
+		t.Errorf("wrong files: %+v", s.Files)
+	}
+	if len(s.Processes) != 1 || s.Processes[0].Pid != uint32(os.Getpid()) ||
+		s.Processes[0].Comm == "" || s.Processes[0].BytesWritten != 10000 {
+		t.Errorf("wrong processes: %+v", s.Processes)
+	}
+	// Stats cannot be combined with other requests
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Stats: true, EncryptPath: "foo"})
+	if response.ErrNo == 0 {
+		t.Errorf("ambiguous request accepted: %+v", response)
+	}
+}
+
+// TestCtlSockCacheMem checks that the caches stay within "-cachemem" and that
+// the Stats request reports their memory use
+func TestCtlSockCacheMem(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	const limit = 3000
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test",
+		fmt.Sprintf("-cachemem=%d", limit))
+	defer test_helpers.UnmountPanic(pDir)
+	// Every long name is cached by OpenDir and takes about 500 bytes
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("%s/%03d%s", pDir, i, strings.Repeat("x", 200))
+		if err := ioutil.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ioutil.ReadDir(pDir)
+	if err != nil || len(entries) != 20 {
+		t.Fatalf("ReadDir: %d entries, err=%v", len(entries), err)
+	}
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Stats: true})
+	s := response.Stats
+	if response.ErrNo != 0 || s == nil {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if s.CacheMemLimit != limit {
+		t.Errorf("wrong limit %d", s.CacheMemLimit)
+	}
+	var total uint64
+	for _, m := range s.CacheMem {
+		total += m.Bytes
+	}
+	if total > limit {
+		t.Errorf("caches use %d bytes, more than the limit: %+v", total, s.CacheMem)
+	}
+	if m := s.CacheMem["longnames"]; m.Entries == 0 || m.Evictions == 0 {
+		t.Errorf("wrong long name cache accounting: %+v", m)
+	}
+}
+
+func TestCtlSockChanges(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	changes := func(seq uint64) *ctlsock.ChangesStruct {
+		response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Changes: true, ChangesSinceSeq: seq})
+		if response.ErrNo != 0 || response.Changes == nil {
+			t.Fatalf("got an error reply: %+v", response)
+		}
+		return response.Changes
+	}
+	if err := ioutil.WriteFile(pDir+"/old", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	first := changes(0)
+	if first.Complete {
+		t.Error("changes since before the mount should be incomplete")
+	}
+	if len(first.Changes) != 1 {
+		t.Errorf("want one change, have %+v", first.Changes)
+	}
+	if err := ioutil.WriteFile(pDir+"/new", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(pDir + "/old"); err != nil {
+		t.Fatal(err)
+	}
+	second := changes(first.Seq)
+	if !second.Complete {
+		t.Error("changes since the last query should be complete")
+	}
+	want := map[string]bool{}
+	for _, name := range []string{"new", "old"} {
+		cPath := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: name}).Result
+		want[cPath] = name == "old"
+	}
+	if len(second.Changes) != len(want) {
+		t.Fatalf("want %d changes, have %+v", len(want), second.Changes)
+	}
+	for _, c := range second.Changes {
+		if deleted, ok := want[c.Path]; !ok || deleted != c.Deleted {
+			t.Errorf("unexpected change %+v", c)
+		}
+	}
+	// A sequence number from an earlier mount is smaller than all of ours
+	if changes(1).Complete {
+		t.Error("changes since seq 1 should be incomplete")
+	}
+}
+
+// TestCtlSockLock checks that a locked filesystem cannot be accessed until
+// it is unlocked with the password
+func TestCtlSockLock(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := ioutil.WriteFile(pDir+"/foo", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Locking fails while a file is open
+	f, err := os.Open(pDir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Stats: true})
+	if response.Stats == nil || response.Stats.OpenFiles != 1 {
+		t.Errorf("want 1 open file: %+v", response)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Lock: true})
+	if response.ErrNo != int32(syscall.EBUSY) {
+		t.Errorf("want EBUSY, have %+v", response)
+	}
+	f.Close()
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Lock: true})
+	if response.ErrNo != 0 {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if _, err = ioutil.ReadFile(pDir + "/foo"); !os.IsPermission(err) {
+		t.Errorf("want EACCES while locked, have %v", err)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: "foo"})
+	if response.ErrNo != int32(syscall.EACCES) {
+		t.Errorf("EncryptPath: want EACCES while locked, have %+v", response)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Info: true})
+	if response.Info == nil || !response.Info.Locked {
+		t.Errorf("Info should report the lock: %+v", response)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Unlock: true, Password: "test"})
+	if response.ErrNo != 0 {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if content, err := ioutil.ReadFile(pDir + "/foo"); err != nil || string(content) != "hello" {
+		t.Errorf("after unlock: %q, %v", content, err)
+	}
+	if err = ioutil.WriteFile(pDir+"/bar", []byte("x"), 0600); err != nil {
+		t.Error(err)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Lock: true, Stats: true})
+	if response.ErrNo == 0 {
+		t.Errorf("ambiguous request accepted: %+v", response)
+	}
+	// Unmounting works while locked
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Lock: true})
+	if response.ErrNo != 0 {
+		t.Errorf("got an error reply: %+v", response)
+	}
+}
+
+// TestCtlSockReadOnly checks switching the mount to read-only and back
+func TestCtlSockReadOnly(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	f, err := os.OpenFile(pDir+"/foo", os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{SetReadOnly: true})
+	if response.ErrNo != 0 {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	// Also files that are already open
+	if _, err = f.Write([]byte("x")); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("Write: want EROFS, have %v", err)
+	}
+	if err = ioutil.WriteFile(pDir+"/bar", nil, 0600); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("Create: want EROFS, have %v", err)
+	}
+	if err = os.Remove(pDir + "/foo"); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("Remove: want EROFS, have %v", err)
+	}
+	if _, err = ioutil.ReadFile(pDir + "/foo"); err != nil {
+		t.Errorf("reading should still work: %v", err)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Info: true})
+	if response.Info == nil || !response.Info.ReadOnly {
+		t.Errorf("Info should report read-only: %+v", response)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{SetReadWrite: true})
+	if response.ErrNo != 0 {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if _, err = f.Write([]byte("x")); err != nil {
+		t.Error(err)
+	}
+	if err = ioutil.WriteFile(pDir+"/bar", nil, 0600); err != nil {
+		t.Error(err)
+	}
+}
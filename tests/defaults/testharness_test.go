@@ -0,0 +1,59 @@
+package defaults
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/testharness"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test that a corrupted block is detected in every variant of the default
+// matrix, and that the other blocks stay readable
+func TestHarnessCorruptBlock(t *testing.T) {
+	testharness.Binary = test_helpers.GocryptfsBinary
+	variants := testharness.WithMountArgs(testharness.DefaultMatrix, "-wpanic=false")
+	testharness.RunMatrix(t, variants, func(t *testing.T, cDir string, pDir string) {
+		content := bytes.Repeat([]byte("x"), 10000)
+		if err := ioutil.WriteFile(pDir+"/file", content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		// The file is the only entry that is not gocryptfs.conf or
+		// gocryptfs.diriv
+		entries, err := ioutil.ReadDir(cDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cFile string
+		for _, e := range entries {
+			if !strings.HasPrefix(e.Name(), "gocryptfs.") {
+				cFile = filepath.Join(cDir, e.Name())
+			}
+		}
+		if err := testharness.CorruptBlock(cFile, 1); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(pDir + "/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		buf := make([]byte, 4096)
+		if _, err := f.ReadAt(buf, 0); err != nil {
+			t.Errorf("block 0 should be readable: %v", err)
+		}
+		if _, err := f.ReadAt(buf, 4096); !errorIs(err, syscall.EIO) {
+			t.Errorf("block 1 should give EIO, have %v", err)
+		}
+	})
+}
+
+func errorIs(err error, errno syscall.Errno) bool {
+	pe, ok := err.(*os.PathError)
+	return ok && pe.Err == errno
+}
@@ -7,8 +7,10 @@ package example_filesystems
 // "-openssl=true".
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"syscall"
@@ -448,3 +450,47 @@ func TestExampleFSv22xchachaDeterministicNames(t *testing.T) {
 	checkExampleFSLongnames(t, pDir)
 	test_helpers.UnmountPanic(pDir)
 }
+
+// "-encfs" mounts EncFS volumes read-only. The "encfs-standard" volume uses
+// the EncFS standard mode settings (AES-192, block names, per-file IVs,
+// chained name IVs).
+func TestExampleFSEncfs(t *testing.T) {
+	cDir := "encfs-standard"
+	pDir := test_helpers.TmpDir + "/" + cDir
+	cDir = tmpFsPath + cDir
+	err := test_helpers.Mount(cDir, pDir, false, "-encfs", "-extpass", "echo wrong")
+	if err == nil {
+		t.Errorf("Mounting with the wrong password should fail")
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-encfs", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	checkExampleFS(t, pDir, false)
+	// Three blocks, the last one partial
+	content, err := ioutil.ReadFile(pDir + "/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, 3000)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	if !bytes.Equal(content, want) {
+		t.Errorf("dir/file: wrong content")
+	}
+	// Relative symlink in a subdirectory
+	target, err := os.Readlink(pDir + "/dir/up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "../status.txt" {
+		t.Errorf("Unexpected link target: %s", target)
+	}
+	// Read-only
+	err = ioutil.WriteFile(pDir+"/status.txt", []byte("foo"), 0600)
+	if err == nil {
+		t.Errorf("Writing to an -encfs mount should fail")
+	}
+	if err = os.Mkdir(pDir+"/newdir", 0700); err == nil {
+		t.Errorf("mkdir in an -encfs mount should fail")
+	}
+}
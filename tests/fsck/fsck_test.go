@@ -2,8 +2,11 @@ package fsck
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
@@ -12,7 +15,9 @@ import (
 
 	"github.com/pkg/xattr"
 
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/progress"
 	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
 )
 
@@ -69,6 +74,10 @@ func TestExampleFses(t *testing.T) {
 		if e.Name() == "content" {
 			continue
 		}
+		// Not a gocryptfs filesystem
+		if strings.HasPrefix(e.Name(), "encfs") {
+			continue
+		}
 		fsNames = append(fsNames, e.Name())
 	}
 	for _, n := range fsNames {
@@ -126,3 +135,268 @@ func TestTerabyteFile(t *testing.T) {
 	cmd.Wait()
 	timer.Stop()
 }
+
+// TestBrokenHardLink copies the .name file of one long name hard link over
+// another, which makes the second link unreachable. fsck must report it,
+// and "-repair" must delete it.
+func TestBrokenHardLink(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	long := strings.Repeat("x", 200)
+	if err := ioutil.WriteFile(pDir+"/"+long+"1", []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(pDir+"/"+long+"1", pDir+"/"+long+"2"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	nameFiles, err := filepath.Glob(cDir + "/gocryptfs.longname.*.name")
+	if err != nil || len(nameFiles) != 2 {
+		t.Fatalf("want 2 .name files, have %v, %v", nameFiles, err)
+	}
+	content, err := ioutil.ReadFile(nameFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(nameFiles[1], content, 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	fsck := func(args ...string) (string, int) {
+		args = append([]string{"-fsck", "-extpass", "echo test"}, args...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(args, cDir)...)
+		out, err := cmd.CombinedOutput()
+		return string(out), test_helpers.ExtractCmdExitCode(err)
+	}
+	out, code := fsck()
+	if code != exitcodes.FsckErrors || !strings.Contains(out, "is broken") {
+		t.Errorf("want a broken hard link and exit code %d, have %d:\n%s", exitcodes.FsckErrors, code, out)
+	}
+	if out, code = fsck("-repair"); code != exitcodes.FsckErrors || !strings.Contains(out, "repair: deleted") {
+		t.Errorf("-repair: have exit code %d:\n%s", code, out)
+	}
+	if out, code = fsck(); code != 0 {
+		t.Errorf("after -repair: have exit code %d:\n%s", code, out)
+	}
+	// One link is left, and its link count says so
+	var st syscall.Stat_t
+	matches, _ := filepath.Glob(cDir + "/gocryptfs.longname.*")
+	for _, m := range matches {
+		if strings.HasSuffix(m, ".name") {
+			continue
+		}
+		if err = syscall.Stat(m, &st); err != nil || st.Nlink != 1 {
+			t.Errorf("%q: want Nlink=1, have %d, %v", m, st.Nlink, err)
+		}
+	}
+	if len(matches) != 2 {
+		t.Errorf("want 1 link and its .name file, have %v", matches)
+	}
+}
+
+// TestProgressJSON checks the "-progress json" stream of -fsck
+func TestProgressJSON(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	os.Mkdir(pDir+"/dir", 0700)
+	for _, name := range []string{"a", "dir/b", "dir/c"} {
+		if err := ioutil.WriteFile(pDir+"/"+name, make([]byte, 10000), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	out, err := ioutil.TempFile("", "progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test",
+		"-progress", "json", "-progress-fd", "3", cDir)
+	cmd.ExtraFiles = []*os.File{out}
+	if o, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, o)
+	}
+	content, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	var s progress.Status
+	if err = json.Unmarshal([]byte(lines[len(lines)-1]), &s); err != nil {
+		t.Fatalf("%v: %q", err, content)
+	}
+	if !s.Done || s.Op != "fsck" || s.Files != 3 || s.Bytes != 30000 {
+		t.Errorf("wrong last status %#v", s)
+	}
+
+	// Without a valid -progress-fd, nothing happens
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-extpass", "echo test",
+		"-progress", "json", "-progress-fd", "99", cDir)
+	if err = cmd.Run(); test_helpers.ExtractCmdExitCode(err) != exitcodes.Usage {
+		t.Errorf("want exit code %d, have %v", exitcodes.Usage, err)
+	}
+}
+
+// TestReportJSON checks that "-fsck -json" classifies the problems
+func TestReportJSON(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := ioutil.WriteFile(pDir+"/file", []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	fsck := func() (report struct {
+		Files   uint64
+		Corrupt []struct{ Kind, Path string }
+	}, code int) {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-json", "-extpass", "echo test", cDir)
+		out, err := cmd.Output()
+		code = test_helpers.ExtractCmdExitCode(err)
+		if err := json.Unmarshal(out, &report); err != nil {
+			t.Fatalf("%v: %q", err, out)
+		}
+		return report, code
+	}
+	report, code := fsck()
+	if code != 0 || report.Files != 1 || len(report.Corrupt) != 0 {
+		t.Errorf("clean fs: exit code %d, report %+v", code, report)
+	}
+
+	// Zero the file header and delete the diriv of the directory
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "gocryptfs.") {
+			continue
+		}
+		path := filepath.Join(cDir, e.Name())
+		if e.IsDir() {
+			err = os.Remove(filepath.Join(path, "gocryptfs.diriv"))
+		} else {
+			var f *os.File
+			if f, err = os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+				_, err = f.Write(make([]byte, 18))
+				f.Close()
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, code = fsck()
+	if code != exitcodes.FsckErrors {
+		t.Errorf("want exit code %d, have %d", exitcodes.FsckErrors, code)
+	}
+	kinds := make(map[string]string)
+	for _, p := range report.Corrupt {
+		kinds[p.Path] = p.Kind
+	}
+	if kinds["file"] != "header" || kinds["dir"] != "diriv" {
+		t.Errorf("wrong problems: %+v", report.Corrupt)
+	}
+}
+
+// TestRepairQuarantine checks that "-fsck -repair" moves corrupt files into
+// gocryptfs.quarantine and fixes the diriv of empty directories
+func TestRepairQuarantine(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	for _, dir := range []string{"empty", "full"} {
+		if err := os.Mkdir(pDir+"/"+dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"good", "bad", "full/x"} {
+		if err := ioutil.WriteFile(pDir+"/"+file, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sock := cDir + ".sock"
+	test_helpers.UnmountPanic(pDir)
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-ctlsock", sock)
+	cPath := func(p string) string {
+		resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: p})
+		if resp.ErrNo != 0 {
+			t.Fatalf("EncryptPath %q: %+v", p, resp)
+		}
+		return filepath.Join(cDir, resp.Result)
+	}
+	bad, empty, full := cPath("bad"), cPath("empty"), cPath("full")
+	test_helpers.UnmountPanic(pDir)
+
+	// Zero the file header
+	f, err := os.OpenFile(bad, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(make([]byte, 18))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{empty, full} {
+		if err := os.Remove(dir + "/gocryptfs.diriv"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type report struct {
+		Corrupt    []struct{ Kind, Path string }
+		Quarantine []struct{ Name, Path, Kind string }
+	}
+	fsck := func(args ...string) (r report, code int) {
+		args = append([]string{"-fsck", "-json", "-extpass", "echo test"}, args...)
+		out, err := exec.Command(test_helpers.GocryptfsBinary, append(args, cDir)...).Output()
+		if err := json.Unmarshal(out, &r); err != nil {
+			t.Fatalf("%v: %q", err, out)
+		}
+		return r, test_helpers.ExtractCmdExitCode(err)
+	}
+	r, code := fsck("-repair")
+	if code != exitcodes.FsckErrors || len(r.Corrupt) != 3 {
+		t.Errorf("-repair: exit code %d, corrupt %+v", code, r.Corrupt)
+	}
+	r, code = fsck()
+	if code != 0 || len(r.Corrupt) != 0 {
+		t.Errorf("after -repair: exit code %d, corrupt %+v", code, r.Corrupt)
+	}
+	paths := make(map[string]string)
+	for _, q := range r.Quarantine {
+		paths[q.Path] = q.Kind
+		if _, err := os.Lstat(filepath.Join(cDir, "gocryptfs.quarantine", q.Name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(paths) != 2 || paths["bad"] != "header" || paths["full"] != "diriv" {
+		t.Errorf("wrong quarantine: %+v", r.Quarantine)
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	entries, err := ioutil.ReadDir(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, " ") != "empty good" {
+		t.Errorf("wrong entries: %v", names)
+	}
+	if err = ioutil.WriteFile(pDir+"/empty/new", nil, 0600); err != nil {
+		t.Error(err)
+	}
+}
@@ -161,6 +161,9 @@ func TestFallocate(t *testing.T) {
 		// xchacha has 24 byte ivs instead of 16. 8kiB are two blocks, so
 		// 2x8=16 bytes more.
 		plain = plain - 16
+	} else if testcase.isSet("-aegis") {
+		// aegis has 32 byte ivs, 2x16=32 bytes more
+		plain = plain - 32
 	}
 	err = syscallcompat.Fallocate(fd, FALLOC_DEFAULT, 0, plain)
 	if err != nil {
@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -67,9 +68,20 @@ var matrix = []testcaseMatrix{
 	{false, "auto", false, false, []string{"-serialize_reads"}},
 	{false, "auto", false, false, []string{"-sharedstorage"}},
 	{false, "auto", false, false, []string{"-deterministic-names"}},
+	// -cachedir with a small -cachesize to exercise eviction
+	{false, "auto", false, false, []string{"-cachedir", os.TempDir(), "-cachesize", "100000"}},
+	// -journal syncs every overwrite
+	{false, "auto", false, false, []string{"-journal"}},
 	// Test xchacha with and without openssl
 	{false, "true", false, true, []string{"-xchacha"}},
 	{false, "false", false, true, []string{"-xchacha"}},
+	{false, "auto", false, false, []string{"-aegis"}},
+	// AES-128-GCM with and without openssl
+	{false, "true", false, false, []string{"-aes128"}},
+	{false, "false", false, false, []string{"-aes128"}},
+	// HCTR2 filename encryption, also with long names hashed using BLAKE3
+	{false, "auto", false, false, []string{"-hctr2"}},
+	{false, "auto", false, false, []string{"-hctr2", "-longnamehash=blake3"}},
 }
 
 // This is the entry point for the tests
@@ -283,6 +295,49 @@ func TestTruncate(t *testing.T) {
 	}
 }
 
+// TestTruncateGrowSparse checks that growing a file with truncate only writes
+// the first and the last block, and leaves file holes in between, so that
+// "truncate -s 50G" does not encrypt gigabytes of zeros
+func TestTruncateGrowSparse(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestTruncateGrowSparse"
+	file, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	const sz = 50 << 30
+	if err = file.Truncate(sz + 100); err != nil {
+		t.Fatal(err)
+	}
+	// Not VerifySize(), which reads the whole file
+	if fi, err := file.Stat(); err != nil || fi.Size() != sz+100 {
+		t.Fatalf("wrong size: %v %v", fi, err)
+	}
+	if isWellKnownFS(test_helpers.DefaultCipherDir) {
+		if du := test_helpers.Du(t, int(file.Fd())); du > 1<<20 {
+			t.Errorf("file should be sparse, but uses %d bytes", du)
+		}
+	}
+	buf := make([]byte, 200)
+	n, err := file.ReadAt(buf, sz)
+	if n != 100 || err != io.EOF {
+		t.Fatalf("ReadAt: n=%d err=%v", n, err)
+	}
+	if !bytes.Equal(buf[:n], make([]byte, 100)) {
+		t.Error("the new end of the file should be zeros")
+	}
+	if n, err = file.ReadAt(buf[:5], 0); n != 5 || string(buf[:5]) != "hello" {
+		t.Errorf("old content lost: %q %v", buf[:n], err)
+	}
+	// Shrink again, so that the big file does not get in the way of other tests
+	if err = file.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestAppend(t *testing.T) {
 	fn := test_helpers.DefaultPlainDir + "/append"
 	file, err := os.Create(fn)
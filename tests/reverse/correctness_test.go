@@ -293,3 +293,38 @@ func TestSeekData(t *testing.T) {
 	}
 	f.Close()
 }
+
+// Hard links with long names have one .name file each. They used to share
+// the inode number, and all of them returned the name of the first link,
+// which made the other links disappear from the forward mount on top.
+func TestHardlinkedLongnames(t *testing.T) {
+	dir := filepath.Join(dirA, t.Name())
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"short", x240 + "1", x240 + "2"}
+	if err := ioutil.WriteFile(filepath.Join(dir, names[0]), []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range names[1:] {
+		if err := os.Link(filepath.Join(dir, names[0]), filepath.Join(dir, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dirC, t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(names) {
+		t.Fatalf("want %d entries, have %d", len(names), len(entries))
+	}
+	for i, e := range entries {
+		// ReadDir sorts by name, and so are the names
+		if e.Name() != names[i] {
+			t.Errorf("entry %d: want %q, have %q", i, names[i], e.Name())
+		}
+		if nlink := e.Sys().(*syscall.Stat_t).Nlink; nlink != 3 {
+			t.Errorf("%q: want Nlink=3, have %d", e.Name(), nlink)
+		}
+	}
+}
@@ -6,15 +6,21 @@
 package root_test
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 
 	"golang.org/x/sys/unix"
@@ -400,3 +406,350 @@ func TestOverlay(t *testing.T) {
 	}
 	defer syscall.Unmount(ovlMnt, 0)
 }
+
+// TestRootSquash checks that "-root_squash" makes root subject to the
+// permissions of "nobody"
+func TestRootSquash(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root")
+	}
+	cDir := test_helpers.InitFS(t)
+	os.Chmod(cDir, 0755)
+	pDir := cDir + ".mnt"
+	syscall.Umask(0000)
+
+	// Prepare files without -root_squash
+	test_helpers.MountOrFatal(t, cDir, pDir, "-allow_other", "-extpass=echo test")
+	if err := ioutil.WriteFile(pDir+"/secret", []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/public", []byte("public"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(pDir+"/shared", 0777); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-allow_other", "-root_squash", "-extpass=echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	if _, err := ioutil.ReadFile(pDir + "/secret"); !os.IsPermission(err) {
+		t.Errorf("reading secret: want EACCES, have %v", err)
+	}
+	if _, err := ioutil.ReadFile(pDir + "/public"); err != nil {
+		t.Error(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/public", nil, 0644); !os.IsPermission(err) {
+		t.Errorf("writing public: want EACCES, have %v", err)
+	}
+	if err := os.Chmod(pDir+"/secret", 0644); !os.IsPermission(err) {
+		t.Errorf("chmod: want EPERM, have %v", err)
+	}
+	if err := ioutil.WriteFile(pDir+"/new", nil, 0644); !os.IsPermission(err) {
+		t.Errorf("creating in root dir: want EACCES, have %v", err)
+	}
+	// Files created by root belong to nobody
+	if err := ioutil.WriteFile(pDir+"/shared/new", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(pDir+"/shared/new", &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Uid != 65534 || st.Gid != 65534 {
+		t.Errorf("want owner 65534:65534, have %d:%d", st.Uid, st.Gid)
+	}
+}
+
+// TestUserDir checks that a "userdir" policy rule hides the other users'
+// directories
+func TestUserDir(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root")
+	}
+	cDir := test_helpers.InitFS(t)
+	os.Chmod(cDir, 0755)
+	pDir := cDir + ".mnt"
+	policyFile := cDir + ".policy"
+	if err := ioutil.WriteFile(policyFile, []byte("userdir /users\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-allow_other", "-policy", policyFile, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	syscall.Umask(0000)
+
+	// Root sets up the directories
+	if err := os.Mkdir(pDir+"/users", 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []int{1234, 1235} {
+		dir := fmt.Sprintf("%s/users/%d", pDir, uid)
+		if err := os.Mkdir(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dir+"/file", nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// User 1234 sees its own directory only
+	err := asUser(1234, 1234, nil, func() error {
+		if _, err := os.Stat(pDir + "/users/1234/file"); err != nil {
+			return err
+		}
+		if _, err := os.Stat(pDir + "/users/1235/file"); !os.IsNotExist(err) {
+			return fmt.Errorf("stat other user's file: want ENOENT, have %v", err)
+		}
+		entries, err := ioutil.ReadDir(pDir + "/users")
+		if err != nil {
+			return err
+		}
+		if len(entries) != 1 || entries[0].Name() != "1234" {
+			return fmt.Errorf("ReadDir: have %d entries", len(entries))
+		}
+		if err := os.Mkdir(pDir+"/users/1236", 0777); !os.IsPermission(err) {
+			return fmt.Errorf("mkdir for other user: want EACCES, have %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	// Root still sees everything
+	entries, err := ioutil.ReadDir(pDir + "/users")
+	if err != nil || len(entries) != 2 {
+		t.Errorf("ReadDir as root: %d entries, %v", len(entries), err)
+	}
+}
+
+// TestExportFscrypt needs root permissions because it creates a loop disk
+// with the ext4 "encrypt" feature
+func TestExportFscrypt(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root")
+	}
+	img := filepath.Join(test_helpers.TmpDir, t.Name()+".ext4")
+	f, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(20 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("mkfs.ext4", "-q", "-O", "encrypt", img)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Log(string(out))
+		t.Fatal(err)
+	}
+	ext4mnt := img + ".mnt"
+	if err = os.Mkdir(ext4mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command("mount", img, ext4mnt)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Log(string(out))
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(img)
+	defer func() {
+		const MNT_DETACH = 2
+		if err := syscall.Unmount(ext4mnt, MNT_DETACH); err != nil {
+			t.Log(err)
+		}
+	}()
+
+	// Some plaintext to export
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass=echo test")
+	if err = os.Mkdir(pDir+"/dir", 0750); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("hello fscrypt")
+	if err = ioutil.WriteFile(pDir+"/dir/file", content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Link(pDir+"/dir/file", pDir+"/hardlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("dir/file", pDir+"/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	dest := ext4mnt + "/export"
+	keyFile := test_helpers.TmpDir + "/" + t.Name() + ".key"
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-export-fscrypt", dest,
+		"-fscrypt-key", keyFile, "-extpass", "echo test", cDir)
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Log(string(out))
+		t.Fatal(err)
+	}
+
+	// DEST must have an encryption policy
+	fd, err := unix.Open(dest, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arg := unix.FscryptGetPolicyExArg{Size: uint64(len(unix.FscryptGetPolicyExArg{}.Policy))}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.FS_IOC_GET_ENCRYPTION_POLICY_EX, uintptr(unsafe.Pointer(&arg)))
+	unix.Close(fd)
+	if errno != 0 {
+		t.Fatalf("FS_IOC_GET_ENCRYPTION_POLICY_EX: %v", errno)
+	}
+	if arg.Policy[0] != unix.FSCRYPT_POLICY_V2 {
+		t.Errorf("wrong policy version %d", arg.Policy[0])
+	}
+	// and the plaintext
+	have, err := ioutil.ReadFile(dest + "/dir/file")
+	if err != nil || string(have) != string(content) {
+		t.Errorf("read back %q, %v", have, err)
+	}
+	var st1, st2 syscall.Stat_t
+	if err = syscall.Stat(dest+"/dir/file", &st1); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Stat(dest+"/hardlink", &st2); err != nil {
+		t.Fatal(err)
+	}
+	if st1.Ino != st2.Ino || st1.Mode&0777 != 0640 {
+		t.Errorf("wrong hard link or mode: ino %d/%d, mode %o", st1.Ino, st2.Ino, st1.Mode)
+	}
+	if target, err := os.Readlink(dest + "/symlink"); err != nil || target != "dir/file" {
+		t.Errorf("symlink: %q, %v", target, err)
+	}
+	if fi, err := os.Stat(keyFile); err != nil || fi.Size() != 64 || fi.Mode().Perm() != 0400 {
+		t.Errorf("key file: %v, %v", fi, err)
+	}
+}
+
+// TestRenameCrossDevice checks that files and symlinks can be moved into a
+// ciphertext directory that is a bind mount, and that directories still
+// get EXDEV
+func TestRenameCrossDevice(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root")
+	}
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(pDir)
+
+	if err := os.Mkdir(pDir+"/bind", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Find the ciphertext directory of "bind": the first one after "dir"
+	// has been created does not tell us which is which, so compare inodes.
+	var want syscall.Stat_t
+	if err := syscall.Stat(pDir+"/bind", &want); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cBind string
+	for _, e := range entries {
+		if e.IsDir() && e.Sys().(*syscall.Stat_t).Ino == want.Ino {
+			cBind = filepath.Join(cDir, e.Name())
+		}
+	}
+	if cBind == "" {
+		t.Skip("could not find the ciphertext directory, -sharedstorage?")
+	}
+	if out, err := exec.Command("mount", "--bind", cBind, cBind).CombinedOutput(); err != nil {
+		t.Skipf("bind mount failed: %v: %s", err, out)
+	}
+	defer syscall.Unmount(cBind, syscall.MNT_DETACH)
+
+	content := []byte("hello cross-device world")
+	long := strings.Repeat("x", 200)
+	if err = ioutil.WriteFile(pDir+"/"+long, content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("some/target", pDir+"/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(pDir+"/"+long, pDir+"/bind/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(pDir+"/symlink", pDir+"/bind/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := ioutil.ReadFile(pDir + "/bind/file"); err != nil || !bytes.Equal(have, content) {
+		t.Errorf("read back %q, %v", have, err)
+	}
+	if fi, err := os.Stat(pDir + "/bind/file"); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("wrong mode: %v, %v", fi, err)
+	}
+	if target, err := os.Readlink(pDir + "/bind/symlink"); err != nil || target != "some/target" {
+		t.Errorf("symlink: %q, %v", target, err)
+	}
+	entries, err = ioutil.ReadDir(pDir)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("leftover entries: %v, %v", entries, err)
+	}
+	// Back out again, overwriting an existing file
+	if err = ioutil.WriteFile(pDir+"/old", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(pDir+"/bind/file", pDir+"/old"); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := ioutil.ReadFile(pDir + "/old"); err != nil || !bytes.Equal(have, content) {
+		t.Errorf("read back %q, %v", have, err)
+	}
+	err = os.Rename(pDir+"/dir", pDir+"/bind/dir")
+	if err == nil || err.(*os.LinkError).Err != syscall.EXDEV {
+		t.Errorf("moving a directory: want EXDEV, have %v", err)
+	}
+}
+
+// TestCgroup checks that "-cgroup" moves the daemon into the cgroup, and
+// that the ctlsock reports it
+func TestCgroup(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root")
+	}
+	var st syscall.Statfs_t
+	name := fmt.Sprintf("gocryptfs-test-%d", os.Getpid())
+	var path string
+	for _, root := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		if syscall.Statfs(root, &st) == nil && st.Type == unix.CGROUP2_SUPER_MAGIC {
+			path = filepath.Join(root, name)
+		}
+	}
+	if path == "" {
+		t.Skip("no cgroup v2 hierarchy")
+	}
+	defer func() {
+		// The daemon may still be exiting
+		for i := 0; syscall.Rmdir(path) == syscall.EBUSY && i < 50; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass=echo test", "-ctlsock", sock, "-cgroup", name)
+	defer test_helpers.UnmountPanic(pDir)
+
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Resources: true})
+	if resp.Resources == nil || resp.Resources.Cgroup != path {
+		t.Fatalf("wrong response %+v, %q", resp.Resources, resp.ErrText)
+	}
+	pid := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Info: true}).Info.Pid
+	procs, err := ioutil.ReadFile(path + "/cgroup.procs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(procs)) != fmt.Sprint(pid) {
+		t.Errorf("want pid %d in the cgroup, have %q", pid, procs)
+	}
+}
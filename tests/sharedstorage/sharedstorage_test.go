@@ -61,6 +61,9 @@ func mountSharedstorage(t *testing.T, cipherdir string, mnt string) {
 	args := []string{"-extpass=echo test"}
 	if flagSharestorage {
 		args = append(args, "-sharedstorage")
+	} else {
+		// Skip the CIPHERDIR lock that refuses the second mount
+		args = append(args, "-force")
 	}
 	test_helpers.MountOrFatal(t, cipherdir, mnt, args...)
 }
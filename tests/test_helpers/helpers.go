@@ -6,9 +6,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"syscall"
 	"testing"
@@ -16,6 +14,7 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/testharness"
 )
 
 // TmpDir will be created inside this directory, set in init() to
@@ -25,9 +24,6 @@ var testParentDir = ""
 // GocryptfsBinary is the assumed path to the gocryptfs build.
 const GocryptfsBinary = "../../gocryptfs"
 
-// UnmountScript is the fusermount/umount compatibility wrapper script
-const UnmountScript = "../../tests/fuse-unmount.bash"
-
 // X255 contains 255 uppercase "X". This can be used as a maximum-length filename.
 var X255 string
 
@@ -47,7 +43,7 @@ func init() {
 
 func doInit() {
 	X255 = string(bytes.Repeat([]byte("X"), 255))
-	MountInfo = make(map[string]mountInfo)
+	testharness.Binary = GocryptfsBinary
 	// Something like /tmp/gocryptfs-test-parent-1234
 	testParentDir = fmt.Sprintf("%s/gocryptfs-test-parent-%d", os.TempDir(), os.Getuid())
 	os.MkdirAll(testParentDir, 0755)
@@ -144,36 +140,10 @@ func isExt4(path string) bool {
 //
 // If t is set, t.Fatal() is called on error, log.Panic() otherwise.
 func InitFS(t *testing.T, extraArgs ...string) string {
-	prefix := "x."
 	if t != nil {
-		prefix = t.Name() + "."
-	}
-	dir, err := ioutil.TempDir(TmpDir, prefix)
-	if err != nil {
-		if t != nil {
-			t.Fatal(err)
-		} else {
-			log.Panic(err)
-		}
+		t.Helper()
 	}
-	args := []string{"-q", "-init", "-extpass", "echo test", "-scryptn=10"}
-	args = append(args, extraArgs...)
-	args = append(args, dir)
-
-	cmd := exec.Command(GocryptfsBinary, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err = cmd.Run()
-	if err != nil {
-		if t != nil {
-			t.Fatalf("InitFS with args %q failed: %v", args, err)
-		} else {
-			log.Panic(err)
-		}
-	}
-
-	return dir
+	return testharness.InitFS(t, TmpDir, extraArgs...)
 }
 
 // Md5fn returns an md5 string for file "filename"
@@ -372,38 +342,12 @@ func Du(t *testing.T, fd int) (nBytes int64) {
 // QueryCtlSock sends a request to the control socket at "socketPath" and
 // returns the response.
 func QueryCtlSock(t *testing.T, socketPath string, req ctlsock.RequestStruct) ctlsock.ResponseStruct {
-	c, err := ctlsock.New(socketPath)
-	if err != nil {
-		// Connecting to the socket failed already. This is fatal.
-		t.Fatal(err)
-	}
-	defer c.Close()
-	resp, err := c.Query(&req)
-	if err != nil {
-		// If we got a response, try to extract it. This is not fatal here
-		// as the tests may expect error responses.
-		if resp2, ok := err.(*ctlsock.ResponseStruct); ok {
-			return *resp2
-		}
-		// Another error means that we did not even get a response. This is fatal.
-		t.Fatal(err)
-	}
-	return *resp
+	t.Helper()
+	return testharness.QueryCtlSock(t, socketPath, req)
 }
 
 // ExtractCmdExitCode extracts the exit code from an error value that was
 // returned from exec / cmd.Run()
 func ExtractCmdExitCode(err error) int {
-	if err == nil {
-		return 0
-	}
-	// OMG this is convoluted
-	if err2, ok := err.(*exec.ExitError); ok {
-		return err2.Sys().(syscall.WaitStatus).ExitStatus()
-	}
-	if err2, ok := err.(*os.PathError); ok {
-		return int(err2.Err.(syscall.Errno))
-	}
-	log.Panicf("could not decode error %#v", err)
-	return 0
+	return testharness.ExtractCmdExitCode(err)
 }
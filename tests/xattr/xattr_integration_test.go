@@ -9,6 +9,7 @@ package xattr_tests
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -36,7 +37,7 @@ func TestMain(m *testing.M) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	test_helpers.MountOrExit(test_helpers.DefaultCipherDir, test_helpers.DefaultPlainDir, "-zerokey")
+	test_helpers.MountOrExit(test_helpers.DefaultCipherDir, test_helpers.DefaultPlainDir, "-zerokey", "-immutable")
 	r := m.Run()
 	test_helpers.UnmountPanic(test_helpers.DefaultPlainDir)
 	os.RemoveAll(test_helpers.TmpDir)
@@ -268,7 +269,7 @@ func TestBase64XattrRead(t *testing.T) {
 	// Remount with -wpanic=false so gocryptfs does not panics when it sees
 	// the broken xattrs
 	test_helpers.UnmountPanic(test_helpers.DefaultPlainDir)
-	test_helpers.MountOrExit(test_helpers.DefaultCipherDir, test_helpers.DefaultPlainDir, "-zerokey", "-wpanic=false")
+	test_helpers.MountOrExit(test_helpers.DefaultCipherDir, test_helpers.DefaultPlainDir, "-zerokey", "-immutable", "-wpanic=false")
 
 	brokenVals := []string{
 		"111",
@@ -383,3 +384,105 @@ func TestSlashInName(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestSELinuxPassthrough checks that the SELinux label is stored on the
+// backing file without encryption
+func TestSELinuxPassthrough(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/" + t.Name()
+	err := ioutil.WriteFile(fn, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	label := []byte("system_u:object_r:httpd_sys_content_t:s0")
+	err = xattr.LSet(fn, "security.selinux", label)
+	if err != nil {
+		// Needs CAP_SYS_ADMIN, and a host running SELinux may reject the
+		// label
+		t.Skip(err)
+	}
+	val, err := xattr.LGet(fn, "security.selinux")
+	if err != nil || !bytes.Equal(val, label) {
+		t.Errorf("LGet: have %q, %v", val, err)
+	}
+	// Exactly one backing file should carry the plaintext label
+	entries, err := ioutil.ReadDir(test_helpers.DefaultCipherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, e := range entries {
+		val, err = xattr.LGet(test_helpers.DefaultCipherDir+"/"+e.Name(), "security.selinux")
+		if err == nil && bytes.Equal(val, label) {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("label found on %d backing files, want 1", found)
+	}
+	list, err := xattr.LList(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0] != "security.selinux" {
+		t.Errorf("LList: have %q", list)
+	}
+	err = xattr.LRemove(fn, "security.selinux")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestImmutable checks that a file marked immutable through the
+// user.gocryptfs.immutable xattr cannot be written, truncated or renamed
+func TestImmutable(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/" + t.Name()
+	content := []byte("finished archive")
+	if err := ioutil.WriteFile(fn, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	const attr = "user.gocryptfs.immutable"
+	if err := xattr.LSet(fn, attr, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := xattr.LGet(fn, attr); err != nil || string(val) != "1" {
+		t.Errorf("LGet: have %q, %v", val, err)
+	}
+	if list, err := xattr.LList(fn); err != nil || len(list) != 0 {
+		t.Errorf("LList: have %q, %v", list, err)
+	}
+	if _, err := os.OpenFile(fn, os.O_WRONLY, 0); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("open for writing: want EPERM, have %v", err)
+	}
+	if _, err := os.OpenFile(fn, os.O_RDONLY|os.O_TRUNC, 0); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("open with O_TRUNC: want EPERM, have %v", err)
+	}
+	if err := os.Truncate(fn, 0); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("truncate: want EPERM, have %v", err)
+	}
+	if err := os.Rename(fn, fn+".renamed"); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("rename: want EPERM, have %v", err)
+	}
+	other := fn + ".other"
+	if err := ioutil.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(other, fn); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("rename over it: want EPERM, have %v", err)
+	}
+	if have, err := ioutil.ReadFile(fn); err != nil || !bytes.Equal(have, content) {
+		t.Errorf("wrong content: %q, %v", have, err)
+	}
+	// Clearing the marker makes it writable again
+	if err := xattr.LRemove(fn, attr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := xattr.LGet(fn, attr); err == nil {
+		t.Error("marker is still set")
+	}
+	if err := ioutil.WriteFile(fn, []byte("new"), 0666); err != nil {
+		t.Error(err)
+	}
+	if err := xattr.LSet(fn, attr, []byte("yes")); err == nil {
+		t.Error("invalid value has been accepted")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// topInterval is how often "-top" refreshes
+const topInterval = time.Second
+
+// queryStats sends a Stats request to the control socket "sock"
+func queryStats(sock string) (*ctlsock.StatsStruct, error) {
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	resp, err := c.Query(&ctlsock.RequestStruct{Stats: true})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Stats == nil {
+		return nil, fmt.Errorf("%s: no Stats in response", sock)
+	}
+	return resp.Stats, nil
+}
+
+// hitRatio formats the share of hits, or "-" if there were no lookups
+func hitRatio(hits, misses uint64) string {
+	if hits+misses == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(hits)/float64(hits+misses))
+}
+
+// megabytes formats "n" bytes per "seconds" as MB/s
+func megabytes(n uint64, seconds float64) string {
+	if seconds <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f MB/s", float64(n)/seconds/1e6)
+}
+
+// cacheMem formats the memory use of the caches and their evictions per
+// second, like "1.2 of 67.1 MB (dircache 0.0, longnames 1.2), 0 evictions/s"
+func cacheMem(prev, cur *ctlsock.StatsStruct, seconds float64) string {
+	var names []string
+	var bytes, evictions uint64
+	for name, m := range cur.CacheMem {
+		names = append(names, name)
+		bytes += m.Bytes
+		evictions += m.Evictions - prev.CacheMem[name].Evictions
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s %.1f", name, float64(cur.CacheMem[name].Bytes)/1e6))
+	}
+	rate := "-"
+	if seconds > 0 {
+		rate = fmt.Sprintf("%.0f", float64(evictions)/seconds)
+	}
+	return fmt.Sprintf("%.1f of %.1f MB (%s), %s evictions/s", float64(bytes)/1e6,
+		float64(cur.CacheMemLimit)/1e6, strings.Join(parts, ", "), rate)
+}
+
+// topScreen formats the difference between two Stats responses that were
+// taken "seconds" apart
+func topScreen(name string, prev, cur *ctlsock.StatsStruct, seconds float64) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "gocryptfs -top %s, every %v\n\n", name, topInterval)
+	type opRate struct {
+		name string
+		n    uint64
+	}
+	var ops []opRate
+	for op, n := range cur.Ops {
+		if d := n - prev.Ops[op]; d > 0 {
+			ops = append(ops, opRate{op, d})
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].n != ops[j].n {
+			return ops[i].n > ops[j].n
+		}
+		return ops[i].name < ops[j].name
+	})
+	b.WriteString("ops/s:")
+	if len(ops) == 0 {
+		b.WriteString(" idle")
+	}
+	for _, o := range ops {
+		fmt.Fprintf(&b, " %s %.0f", o.name, float64(o.n)/seconds)
+	}
+	fmt.Fprintf(&b, "\nread %s, write %s, %d open files\n",
+		megabytes(cur.BytesRead-prev.BytesRead, seconds),
+		megabytes(cur.BytesWritten-prev.BytesWritten, seconds), cur.OpenFiles)
+	fmt.Fprintf(&b, "cache hits: directories %s, blocks %s\n",
+		hitRatio(cur.DirCacheHits-prev.DirCacheHits, cur.DirCacheMisses-prev.DirCacheMisses),
+		hitRatio(cur.BlockCacheHits-prev.BlockCacheHits, cur.BlockCacheMisses-prev.BlockCacheMisses))
+	if cur.CacheMemLimit > 0 {
+		fmt.Fprintf(&b, "cache memory: %s\n", cacheMem(prev, cur, seconds))
+	}
+	fmt.Fprintf(&b, "requests: %d running, %d waiting, oldest %.1fs, %d rejected\n",
+		cur.RequestsRunning, cur.RequestsWaiting, cur.OldestRequestSeconds, cur.RequestsRejected)
+
+	fmt.Fprintf(&b, "\nBusiest files and processes in the last %.0fs:\n\n", cur.RecentSeconds)
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "READ\tWRITE\tFILE")
+	for _, f := range cur.Files {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", megabytes(f.BytesRead, cur.RecentSeconds),
+			megabytes(f.BytesWritten, cur.RecentSeconds), f.Path)
+	}
+	fmt.Fprintln(w, "\t\t")
+	fmt.Fprintln(w, "READ\tWRITE\tPID\tCOMMAND")
+	for _, p := range cur.Processes {
+		comm := p.Comm
+		if comm == "" {
+			comm = "?"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", megabytes(p.BytesRead, cur.RecentSeconds),
+			megabytes(p.BytesWritten, cur.RecentSeconds), p.Pid, comm)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// doTop handles "-top {MOUNTPOINT | -ctlsock SOCKET}": it shows the live
+// statistics of a mount until interrupted. If stdout is not a terminal, it
+// prints one screen and exits. Returns the exit code.
+func doTop(args *argContainer) int {
+	usageErr := flagSet.NArg() != 1 || args.ctlsock != ""
+	if args.ctlsock != "" {
+		usageErr = flagSet.NArg() != 0
+	}
+	if usageErr {
+		tlog.Fatal.Printf("Usage: %s -top {MOUNTPOINT | -ctlsock SOCKET}", tlog.ProgramName)
+		return exitcodes.Usage
+	}
+	sock, name := args.ctlsock, args.ctlsock
+	if sock == "" {
+		var err error
+		name, sock, err = findMount(flagSet.Arg(0))
+		if err != nil {
+			tlog.Fatal.Printf("%v", err)
+			return exitcodes.MountPoint
+		}
+		if sock == "" {
+			tlog.Fatal.Printf("Could not find the control socket of %q. -top needs a mount with -ctlsock.",
+				flagSet.Arg(0))
+			return exitcodes.CtlSock
+		}
+	}
+	interactive := term.IsTerminal(int(os.Stdout.Fd()))
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	prev, err := queryStats(sock)
+	if err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		return exitcodes.CtlSock
+	}
+	prevTime := time.Now()
+	for {
+		select {
+		case <-sigs:
+			return 0
+		case <-time.After(topInterval):
+		}
+		cur, err := queryStats(sock)
+		if err != nil {
+			tlog.Fatal.Printf("ctlsock: %v", err)
+			return exitcodes.CtlSock
+		}
+		now := time.Now()
+		screen := topScreen(name, prev, cur, now.Sub(prevTime).Seconds())
+		if !interactive {
+			fmt.Print(screen)
+			return 0
+		}
+		// Move the cursor home and clear the screen
+		fmt.Print("\033[H\033[2J" + screen)
+		prev, prevTime = cur, now
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/tpm2"
+)
+
+// tpm2Enroll handles "gocryptfs -tpm2-enroll CIPHERDIR": a random key is
+// sealed to the TPM of this machine and locks the master key in a second key
+// slot, so that mounting on this machine does not need the password.
+// Does not return (calls os.Exit both on success and on error).
+func tpm2Enroll(args *argContainer) {
+	if args.masterkey != "" || args.zerokey {
+		// A wrong master key would go unnoticed
+		tlog.Fatal.Printf("-tpm2-enroll needs the password and cannot be used with -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	pcrs, err := tpm2.ParsePCRs(args.tpm2_pcrs)
+	if err != nil {
+		tlog.Fatal.Printf("-tpm2-pcrs: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagPQHybrid) {
+		// The TPM would replace the key file
+		tlog.Fatal.Printf("-tpm2-enroll does not work on filesystems created with -pqkey")
+		os.Exit(exitcodes.Usage)
+	}
+	pw, err := configPassword(args, cf)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	tlog.Info.Println("Decrypting master key")
+	masterkey, err := cf.DecryptMasterKey(pw)
+	for i := range pw {
+		pw[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	sealedKey := cryptocore.RandBytes(cryptocore.KeyLen)
+	tlog.Info.Println("Sealing a key to the TPM")
+	pub, priv, err := tpm2.Seal(sealedKey, pcrs)
+	if err == nil {
+		err = cf.SetTPM2(masterkey, sealedKey, configfile.TPM2Params{Public: pub, Private: priv, PCRs: pcrs})
+	}
+	for i := range sealedKey {
+		sealedKey[i] = 0
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-tpm2-enroll: %v", err)
+		os.Exit(exitcodes.TPM2)
+	}
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "Key sealed to the TPM. Mounting on this machine no longer asks for the password." +
+		tlog.ColorReset)
+	if pcrs == "" {
+		tlog.Info.Printf("The key is not bound to PCRs: anyone who can use the TPM of this machine can unseal it. " +
+			"Use -tpm2-pcrs to bind it to the boot state.")
+	}
+	os.Exit(0)
+}
+
+// tpm2Remove handles "gocryptfs -tpm2-remove CIPHERDIR": the TPM2 key slot
+// is removed, so that only the password unlocks the master key.
+// Does not return (calls os.Exit both on success and on error).
+func tpm2Remove(args *argContainer) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	if cf.TPM2 == nil {
+		tlog.Info.Printf("The filesystem has no TPM2 key slot.")
+		os.Exit(0)
+	}
+	cf.TPM2 = nil
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "TPM2 key slot removed." + tlog.ColorReset)
+	os.Exit(0)
+}
+
+// unlockTPM2 decrypts the master key with the key sealed to the TPM, if "cf"
+// has a TPM2 key slot and no password has been given on the command line.
+// Returns nil if the slot cannot be used, and the caller asks for the
+// password instead.
+func unlockTPM2(args *argContainer, cf *configfile.ConfFile) (masterkey []byte) {
+	if cf.TPM2 == nil || args.passwd || len(args.extpass) > 0 || len(args.passfile) > 0 || args._password != nil {
+		return nil
+	}
+	sealedKey, err := tpm2.Unseal(cf.TPM2.Public, cf.TPM2.Private, cf.TPM2.PCRs)
+	if err == nil {
+		masterkey, err = cf.DecryptMasterKeyTPM2(sealedKey)
+		for i := range sealedKey {
+			sealedKey[i] = 0
+		}
+	}
+	if err != nil {
+		tlog.Info.Printf("Cannot unlock with the TPM, falling back to the password: %v", err)
+		return nil
+	}
+	tlog.Info.Println("Master key unlocked with the TPM")
+	return masterkey
+}
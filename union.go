@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// checkUnionArgs validates the "-union" arguments and makes the paths
+// absolute. Calls os.Exit on errors.
+func checkUnionArgs(args *argContainer) {
+	if len(args.union) == 0 {
+		return
+	}
+	if args.reverse {
+		tlog.Fatal.Printf("-union does not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.masterkey != "" || args.zerokey {
+		tlog.Fatal.Printf("-union cannot be used together with -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	for i, dir := range args.union {
+		dir, _ = filepath.Abs(dir)
+		if err := isDir(dir); err != nil {
+			tlog.Fatal.Printf("Invalid -union cipherdir: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		if dir == args.cipherdir {
+			tlog.Fatal.Printf("-union: %q is already the primary cipherdir", dir)
+			os.Exit(exitcodes.CipherDir)
+		}
+		args.union[i] = dir
+	}
+}
+
+// loadUnionConfig loads the config file of the "-union" CIPHERDIR
+// "cipherdir" and decrypts its master key. Works like loadConfig(), but
+// names the directory in the password prompt.
+func loadUnionConfig(args *argContainer, cipherdir string) (masterkey []byte, cf *configfile.ConfFile, err error) {
+	cf, err = configfile.Load(filepath.Join(cipherdir, configfile.ConfDefaultName))
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		return nil, nil, err
+	}
+	if err = unlockPQHybrid(args, cf); err != nil {
+		return nil, nil, err
+	}
+	var pw []byte
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		if args.fido2 == "" {
+			tlog.Fatal.Printf("%s: Masterkey encrypted using FIDO2 token; need to use the --fido2 option.", cipherdir)
+			return nil, nil, exitcodes.NewErr("", exitcodes.Usage)
+		}
+		pw = fido2.Secret(args.fido2, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
+	} else {
+		pw, err = readpassword.Once([]string(args.extpass), []string(args.passfile), "Password for "+cipherdir)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			return nil, nil, exitcodes.NewErr("", exitcodes.ReadPassword)
+		}
+	}
+	tlog.Info.Printf("Decrypting master key of %s", cipherdir)
+	masterkey, err = cf.DecryptMasterKey(pw)
+	for i := range pw {
+		pw[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return nil, nil, err
+	}
+	return masterkey, cf, nil
+}
+
+// initUnionBranches adds the "-union" CIPHERDIRs to the filesystem. Each
+// one must use the same feature flags as the primary CIPHERDIR, described
+// by "primary", and is opened with the primary's "cryptoBackend" and
+// "IVBits". The returned crypto cores must be wiped after unmount.
+// Calls os.Exit on errors.
+func initUnionBranches(args *argContainer, primary *configfile.ConfFile, cryptoBackend cryptocore.AEADTypeEnum,
+	IVBits int, rn *fusefrontend.RootNode) (cores []*cryptocore.CryptoCore) {
+	for _, dir := range args.union {
+		masterkey, cf, err := loadUnionConfig(args, dir)
+		if err != nil {
+			exitcodes.Exit(err)
+		}
+		if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) != primary.IsFeatureFlagSet(configfile.FlagPlaintextNames) ||
+			cf.IsFeatureFlagSet(configfile.FlagDirIV) != primary.IsFeatureFlagSet(configfile.FlagDirIV) {
+			tlog.Fatal.Printf("-union: %s: filename feature flags do not match the primary cipherdir", dir)
+			os.Exit(exitcodes.Usage)
+		}
+		backend, err := cf.ContentEncryption()
+		if err != nil {
+			tlog.Fatal.Printf("%v", err)
+			os.Exit(exitcodes.DeprecatedFS)
+		}
+		primaryBackend, _ := primary.ContentEncryption()
+		if backend != primaryBackend {
+			tlog.Fatal.Printf("-union: %s uses %s, but the primary cipherdir uses %s",
+				dir, backend.Algo, primaryBackend.Algo)
+			os.Exit(exitcodes.Usage)
+		}
+		if cf.IsFeatureFlagSet(configfile.FlagKeyEpochs) {
+			// The branch would need its own epoch keys
+			tlog.Fatal.Printf("-union: %s: filesystems with key epochs cannot be used as branches", dir)
+			os.Exit(exitcodes.Usage)
+		}
+		if cf.IsFeatureFlagSet(configfile.FlagSubvolumes) {
+			tlog.Fatal.Printf("-union: %s: filesystems with subvolumes cannot be used as branches", dir)
+			os.Exit(exitcodes.Usage)
+		}
+		cCore, cEnc, nameTransform := newKeyCrypto(args, cf, masterkey, cryptoBackend, IVBits)
+		rn.AddUnionBranch(dir, cEnc, nameTransform)
+		cores = append(cores, cCore)
+	}
+	return cores
+}
+
+// newKeyCrypto creates the content and filename encryption helpers for "key",
+// the master key of a "-union" CIPHERDIR or the key of a subvolume, with the
+// feature flags of "cf". Wipes the key. The returned crypto core must be
+// wiped after unmount.
+func newKeyCrypto(args *argContainer, cf *configfile.ConfFile, key []byte, cryptoBackend cryptocore.AEADTypeEnum,
+	IVBits int) (*cryptocore.CryptoCore, *contentenc.ContentEnc, *nametransform.NameTransform) {
+	cCore := cryptocore.New(key, cryptoBackend, IVBits, cf.IsFeatureFlagSet(configfile.FlagHKDF))
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
+	if args.write_threads > 0 {
+		cEnc.SetWriteThreads(args.write_threads)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagImmutable) {
+		cEnc.SetImmutable()
+	}
+	var nameCipher nametransform.WideBlockCipher = cCore.EMECipher
+	if cf.IsFeatureFlagSet(configfile.FlagHCTR2Names) {
+		nameCipher = cryptocore.NewHCTR2(key)
+	}
+	nameTransform := nametransform.New(nameCipher, args.longnames, cf.LongNameMax,
+		cf.IsFeatureFlagSet(configfile.FlagRaw64), []string(args.badname),
+		!cf.IsFeatureFlagSet(configfile.FlagDirIV))
+	if cf.IsFeatureFlagSet(configfile.FlagLongNameBLAKE3) {
+		nameTransform.SetLongNameKey(cryptocore.LongNameKey(key))
+	}
+	for i := range key {
+		key[i] = 0
+	}
+	return cCore, cEnc, nameTransform
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// doUnmount handles "-unmount". Returns the exit code.
+func doUnmount(args *argContainer) int {
+	// We need a MOUNTPOINT, or, with -when-idle, either a MOUNTPOINT or
+	// -ctlsock
+	usageErr := flagSet.NArg() != 1 || args.ctlsock != ""
+	if args.when_idle && args.ctlsock != "" {
+		usageErr = flagSet.NArg() != 0
+	}
+	if usageErr {
+		tlog.Fatal.Printf("Usage: %s -unmount MOUNTPOINT\n"+
+			"       %s -unmount -when-idle {MOUNTPOINT | -ctlsock SOCKET}",
+			tlog.ProgramName, tlog.ProgramName)
+		return exitcodes.Usage
+	}
+	if args.when_idle {
+		return unmountWhenIdle(args)
+	}
+	return unmountMountpoint(flagSet.Arg(0))
+}
+
+// findMount checks that "dir" is a gocryptfs mountpoint and returns it with
+// symlinks resolved, and its control socket, if we can find it.
+func findMount(dir string) (mountpoint string, sock string, err error) {
+	mountpoint, err = filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	mountpoint = realPath(mountpoint)
+	mounts, err := gocryptfsMounts()
+	if err != nil {
+		return "", "", err
+	}
+	for _, m := range mounts {
+		if m.mountpoint == mountpoint {
+			return mountpoint, ctlsockInfos()[mountpoint].sock, nil
+		}
+	}
+	return "", "", fmt.Errorf("%q is not a gocryptfs mountpoint", dir)
+}
+
+// unmountWhenIdle implements "-unmount -when-idle": it asks the gocryptfs
+// process that listens on "-ctlsock", or that serves MOUNTPOINT, to unmount
+// once the last open file is closed. Returns the exit code.
+func unmountWhenIdle(args *argContainer) int {
+	sock := args.ctlsock
+	if sock == "" {
+		var err error
+		_, sock, err = findMount(flagSet.Arg(0))
+		if err != nil {
+			tlog.Fatal.Printf("%v", err)
+			return exitcodes.MountPoint
+		}
+		if sock == "" {
+			tlog.Fatal.Printf("Could not find the control socket of %q. -when-idle needs a mount with -ctlsock.",
+				flagSet.Arg(0))
+			return exitcodes.CtlSock
+		}
+	}
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		return exitcodes.CtlSock
+	}
+	defer c.Close()
+	if _, err = c.Query(&ctlsock.RequestStruct{UnmountWhenIdle: true}); err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		return exitcodes.CtlSock
+	}
+	tlog.Info.Printf("The filesystem will be unmounted when the last open file is closed")
+	return 0
+}
+
+// unmountMountpoint implements "-unmount MOUNTPOINT". If the gocryptfs
+// process has a control socket, it is asked to write all data to disk
+// first. If files are still open, we list the processes that use them and
+// unmount lazily. Returns the exit code.
+func unmountMountpoint(dir string) int {
+	mountpoint, sock, err := findMount(dir)
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		return exitcodes.MountPoint
+	}
+	if sock != "" {
+		if err = syncViaCtlsock(sock); err != nil {
+			tlog.Warn.Printf("Could not sync %q before unmounting: %v", mountpoint, err)
+		}
+	} else {
+		tlog.Debug.Printf("No control socket found for %q, not syncing", mountpoint)
+	}
+	out, err := exec.Command("fusermount", "-u", mountpoint).CombinedOutput()
+	if err == nil {
+		return 0
+	}
+	tlog.Warn.Printf("fusermount -u %s: %s", mountpoint, strings.TrimSpace(string(out)))
+	users := mountUsers(mountpoint)
+	if len(users) > 0 {
+		tlog.Warn.Printf("The filesystem is in use by:\n  %s", strings.Join(users, "\n  "))
+	}
+	out, err = exec.Command("fusermount", "-u", "-z", mountpoint).CombinedOutput()
+	if err != nil {
+		tlog.Fatal.Printf("fusermount -u -z %s: %s", mountpoint, strings.TrimSpace(string(out)))
+		return exitcodes.MountPoint
+	}
+	tlog.Warn.Printf("Unmounted lazily. The gocryptfs process exits when the last open file is closed.")
+	return 0
+}
+
+// syncViaCtlsock sends a Sync request to the control socket "sock"
+func syncViaCtlsock(sock string) error {
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Query(&ctlsock.RequestStruct{Sync: true})
+	return err
+}
+
+// mountUsers returns a description of the processes that have files below
+// "mountpoint" open, or use it as their working directory, like lsof does.
+// Only processes we have access to are found.
+func mountUsers(mountpoint string) (users []string) {
+	below := func(path string) bool {
+		return path == mountpoint || strings.HasPrefix(path, mountpoint+"/")
+	}
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, proc := range procs {
+		pid := filepath.Base(proc)
+		if pid == fmt.Sprint(os.Getpid()) {
+			continue
+		}
+		comm, _ := os.ReadFile(proc + "/comm")
+		name := fmt.Sprintf("pid %s (%s)", pid, strings.TrimSpace(string(comm)))
+		if cwd, err := os.Readlink(proc + "/cwd"); err == nil && below(cwd) {
+			users = append(users, fmt.Sprintf("%s: working directory %s", name, cwd))
+		}
+		fds, _ := filepath.Glob(proc + "/fd/*")
+		for _, fd := range fds {
+			if target, err := os.Readlink(fd); err == nil && below(target) {
+				users = append(users, fmt.Sprintf("%s: fd %s %s", name, filepath.Base(fd), target))
+			}
+		}
+	}
+	return users
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// envDefaultsPrefix is the prefix of the environment variables that set
+// defaults for command line options, like GOCRYPTFS_IDLE=30m for "-idle 30m"
+const envDefaultsPrefix = "GOCRYPTFS_"
+
+// userDefaultsDenied are options that cannot have defaults, because they
+// select an operation or are used internally
+var userDefaultsDenied = map[string]bool{
+	"compact":        true,
+	"export-fscrypt": true,
+	"fsck":           true,
+	"h":              true,
+	"health":         true,
+	"help":           true,
+	"hh":             true,
+	"info":           true,
+	"init":           true,
+	"json":           true,
+	"list":           true,
+	"make-readonly":  true,
+	"mount-defaults": true,
+	"new-key-epoch":  true,
+	"nodefaults":     true,
+	"notifypid":      true,
+	"o":              true,
+	"passwd":         true,
+	"pkcs11-enroll":  true,
+	"pkcs11-remove":  true,
+	"rekey":          true,
+	"repair":         true,
+	"speed":          true,
+	"top":            true,
+	"tpm2-enroll":    true,
+	"tpm2-remove":    true,
+	"unmount":        true,
+	"version":        true,
+	"warmup":         true,
+	"when-idle":      true,
+	"wizard":         true,
+	"zerokey":        true,
+}
+
+// userDefaultsAliases maps short option names to the long ones, so that
+// "-i" on the command line overrides "idle" in the defaults
+var userDefaultsAliases = map[string]string{
+	"d":  "debug",
+	"e":  "exclude",
+	"ew": "exclude-wildcard",
+	"f":  "fg",
+	"i":  "idle",
+}
+
+// passwordSources are mutually exclusive. Setting one of them overrides the
+// others.
+var passwordSources = []string{"extpass", "passfile", "fido2", "masterkey", "zerokey"}
+
+// userDefault is an option from the defaults file or the environment
+type userDefault struct {
+	name  string
+	value string
+	// hasValue is false for a boolean option given without "=value"
+	hasValue bool
+}
+
+func (d userDefault) arg() string {
+	if d.hasValue {
+		return "-" + d.name + "=" + d.value
+	}
+	return "-" + d.name
+}
+
+// userDefaultsFile returns the path of the defaults file, usually
+// ~/.config/gocryptfs/defaults
+func userDefaultsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gocryptfs", "defaults")
+}
+
+// canonicalName checks "name" against the options in "fs" and returns its
+// long form
+func canonicalName(fs *flag.FlagSet, name string) (string, error) {
+	if fs.Lookup(name) == nil {
+		return "", fmt.Errorf("unknown option %q", name)
+	}
+	if userDefaultsDenied[name] {
+		return "", fmt.Errorf("option %q cannot have a default", name)
+	}
+	if long, ok := userDefaultsAliases[name]; ok {
+		name = long
+	}
+	return name, nil
+}
+
+// readUserDefaultsFile parses the defaults file. Each line contains an
+// option, like "allow_other" or "extpass=pass show gocryptfs", without the
+// leading dash. Empty lines and lines starting with "#" are ignored.
+func readUserDefaultsFile(fs *flag.FlagSet, path string) (defaults []userDefault, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		d := userDefault{name: strings.TrimLeft(line, "-")}
+		if i := strings.Index(d.name, "="); i >= 0 {
+			d.name, d.value, d.hasValue = strings.TrimSpace(d.name[:i]), strings.TrimSpace(d.name[i+1:]), true
+		}
+		if d.name, err = canonicalName(fs, d.name); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		defaults = append(defaults, d)
+	}
+	return defaults, scanner.Err()
+}
+
+// readUserDefaultsEnv parses the GOCRYPTFS_* environment variables. The rest
+// of the variable name is the option name in upper case, with "_" standing
+// for "_" or "-".
+func readUserDefaultsEnv(fs *flag.FlagSet) (defaults []userDefault) {
+	env := os.Environ()
+	sort.Strings(env)
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, envDefaultsPrefix) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, envDefaultsPrefix)
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		name := strings.ToLower(kv[:i])
+		if name == "userns" {
+			// Set internally, see envUserns
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			name = strings.Replace(name, "_", "-", -1)
+		}
+		name, err := canonicalName(fs, name)
+		if err != nil {
+			tlog.Warn.Printf("Ignoring environment variable %s%s: %v", envDefaultsPrefix, kv[:i], err)
+			continue
+		}
+		defaults = append(defaults, userDefault{name: name, value: kv[i+1:], hasValue: true})
+	}
+	return defaults
+}
+
+// mergeUserDefaults returns the options in "lower" that are not overridden
+// by the options named in "higher". Options that can be given several times,
+// like "-extpass", are replaced as a whole.
+func mergeUserDefaults(lower []userDefault, higher map[string]bool) (out []userDefault) {
+	overridden := func(name string) bool {
+		if higher[name] {
+			return true
+		}
+		for _, p := range passwordSources {
+			if name == p {
+				for _, p2 := range passwordSources {
+					if higher[p2] {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	for _, d := range lower {
+		if !overridden(d.name) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// prefixUserDefaults puts the options from the defaults file and the
+// GOCRYPTFS_* environment variables in front of the command line "osArgs",
+// which has been parsed into "flagSet" already. The precedence, from lowest to
+// highest, is: defaults file, environment, command line.
+// Exits on errors.
+func prefixUserDefaults(osArgs []string) []string {
+	cmdline := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		name := f.Name
+		if long, ok := userDefaultsAliases[name]; ok {
+			name = long
+		}
+		cmdline[name] = true
+	})
+	defaults, err := userDefaultsArgs(cmdline)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid defaults file: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if len(defaults) == 0 {
+		return osArgs
+	}
+	out := append([]string{osArgs[0]}, defaults...)
+	return append(out, osArgs[1:]...)
+}
+
+// userDefaultsArgs returns the options from the defaults file and the
+// environment as command line arguments, except for the ones that are
+// overridden by the options "cmdline" (long names) given on the command line.
+func userDefaultsArgs(cmdline map[string]bool) ([]string, error) {
+	fileDefaults, err := readUserDefaultsFile(flagSet, userDefaultsFile())
+	if err != nil {
+		return nil, err
+	}
+	envDefaults := readUserDefaultsEnv(flagSet)
+	names := func(defaults []userDefault) map[string]bool {
+		m := map[string]bool{}
+		for _, d := range defaults {
+			m[d.name] = true
+		}
+		return m
+	}
+	defaults := append(mergeUserDefaults(fileDefaults, names(envDefaults)), envDefaults...)
+	defaults = mergeUserDefaults(defaults, cmdline)
+	var out []string
+	for _, d := range defaults {
+		out = append(out, d.arg())
+	}
+	return out, nil
+}
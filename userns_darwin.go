@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// inUserns returns false as "-userns" is Linux-only
+func inUserns() bool {
+	return false
+}
+
+// execUserns reports that "-userns" is Linux-only
+func execUserns() int {
+	tlog.Fatal.Printf("-userns is only supported on Linux")
+	return exitcodes.Usage
+}
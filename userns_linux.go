@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// envUserns is set in the environment of gocryptfs processes that run
+// inside the namespace created for "-userns".
+const envUserns = "GOCRYPTFS_USERNS"
+
+// inUserns returns true if we run inside the namespace created for
+// "-userns".
+func inUserns() bool {
+	return os.Getenv(envUserns) != ""
+}
+
+// execUserns executes ourselves once again, this time in a new user and
+// mount namespace where our uid and gid are mapped to root. Root in the
+// namespace can mount FUSE filesystems using mount(2), so neither the
+// setuid fusermount helper nor "user_allow_other" in /etc/fuse.conf are
+// needed. The mount is only visible inside the namespace.
+// Returns the exit code.
+func execUserns() int {
+	name, err := os.Executable()
+	if err != nil {
+		name = os.Args[0]
+	}
+	c := exec.Command(name, os.Args[1:]...)
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Stdin = os.Stdin
+	c.Env = append(os.Environ(), envUserns+"=1")
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	err = c.Run()
+	if err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			if waitstat, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+				return waitstat.ExitStatus()
+			}
+		}
+		tlog.Fatal.Printf("-userns: starting %s in a new user namespace failed: %v", name, err)
+		return exitcodes.ForkChild
+	}
+	return 0
+}
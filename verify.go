@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/progress"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+type verifyObj struct {
+	// mnt is the mountpoint of the temporary mount of CIPHERDIR
+	mnt string
+	// plain is the plaintext directory that CIPHERDIR is compared against
+	plain string
+	// Number of entries compared, and of differences found
+	compared, differences int
+	// abort the running verification? Checked in a few long-running loops.
+	abort bool
+	// progress reports the files and bytes compared ("-progress")
+	progress *progress.Reporter
+}
+
+func (v *verifyObj) differ(relPath string, format string, a ...interface{}) {
+	fmt.Printf("verify: %q: %s\n", relPath, fmt.Sprintf(format, a...))
+	v.differences++
+}
+
+// readNames returns the sorted entries of the directory "dir"
+func readNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(0)
+	sort.Strings(names)
+	return names, err
+}
+
+// Recursively compare the directory "relPath"
+func (v *verifyObj) dir(relPath string) {
+	cNames, err := readNames(filepath.Join(v.mnt, relPath))
+	if err != nil {
+		v.differ(relPath, "cannot read directory in CIPHERDIR: %v", err)
+		return
+	}
+	pNames, err := readNames(filepath.Join(v.plain, relPath))
+	if err != nil {
+		v.differ(relPath, "cannot read directory in PLAINDIR: %v", err)
+		return
+	}
+	// The reverse mode config file shows up as gocryptfs.conf in the
+	// encrypted view, which the forward mount hides
+	if relPath == "" {
+		for i, name := range pNames {
+			if name == configfile.ConfReverseName {
+				pNames = append(pNames[:i], pNames[i+1:]...)
+				break
+			}
+		}
+	}
+	// Walk both sorted lists side by side
+	for len(cNames) > 0 || len(pNames) > 0 {
+		if v.abort {
+			return
+		}
+		switch {
+		case len(pNames) == 0 || (len(cNames) > 0 && cNames[0] < pNames[0]):
+			v.differ(filepath.Join(relPath, cNames[0]), "only in CIPHERDIR")
+			cNames = cNames[1:]
+		case len(cNames) == 0 || pNames[0] < cNames[0]:
+			v.differ(filepath.Join(relPath, pNames[0]), "missing in CIPHERDIR")
+			pNames = pNames[1:]
+		default:
+			v.entry(filepath.Join(relPath, cNames[0]))
+			cNames = cNames[1:]
+			pNames = pNames[1:]
+		}
+	}
+}
+
+// Compare a single directory entry that exists on both sides
+func (v *verifyObj) entry(relPath string) {
+	cPath := filepath.Join(v.mnt, relPath)
+	pPath := filepath.Join(v.plain, relPath)
+	var cSt, pSt unix.Stat_t
+	if err := unix.Lstat(cPath, &cSt); err != nil {
+		v.differ(relPath, "stat in CIPHERDIR: %v", err)
+		return
+	}
+	if err := unix.Lstat(pPath, &pSt); err != nil {
+		v.differ(relPath, "stat in PLAINDIR: %v", err)
+		return
+	}
+	if cSt.Mode&syscall.S_IFMT != pSt.Mode&syscall.S_IFMT {
+		v.differ(relPath, "file type differs")
+		return
+	}
+	v.compared++
+	switch pSt.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		v.dir(relPath)
+	case syscall.S_IFLNK:
+		cTarget, err := os.Readlink(cPath)
+		if err != nil {
+			v.differ(relPath, "readlink in CIPHERDIR: %v", err)
+			return
+		}
+		pTarget, err := os.Readlink(pPath)
+		if err != nil {
+			v.differ(relPath, "readlink in PLAINDIR: %v", err)
+			return
+		}
+		if cTarget != pTarget {
+			v.differ(relPath, "symlink target differs: %q vs %q", cTarget, pTarget)
+		}
+	case syscall.S_IFREG:
+		if cSt.Size != pSt.Size {
+			v.differ(relPath, "size differs: %d vs %d bytes", cSt.Size, pSt.Size)
+			return
+		}
+		cHash, err := hashFile(cPath, nil)
+		if err != nil {
+			v.differ(relPath, "read in CIPHERDIR: %v", err)
+			return
+		}
+		pHash, err := hashFile(pPath, v.progress)
+		if err != nil {
+			v.differ(relPath, "read in PLAINDIR: %v", err)
+			return
+		}
+		v.progress.Add(1, 0)
+		if !bytes.Equal(cHash, pHash) {
+			v.differ(relPath, "content differs")
+		}
+	}
+}
+
+// hashFile returns the SHA256 of the content of "path". The bytes read are
+// counted by "p", if not nil.
+func hashFile(path string, p *progress.Reporter) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, p.Reader(f)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// entrypoint from main()
+func verify(args *argContainer) (exitcode int) {
+	if args.reverse {
+		tlog.Fatal.Printf("-verify compares an encrypted CIPHERDIR against PLAINDIR and does not need -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if err := isDir(args.verify); err != nil {
+		tlog.Fatal.Printf("verify: invalid PLAINDIR: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	args.allow_other = false
+	args.ro = true
+	var err error
+	args.mountpoint, err = ioutil.TempDir("", "gocryptfs.verify.")
+	if err != nil {
+		tlog.Fatal.Printf("verify: TmpDir: %v", err)
+		os.Exit(exitcodes.MountPoint)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	v := verifyObj{
+		mnt:      args.mountpoint,
+		plain:    args.verify,
+		progress: startProgress(args, "verify"),
+	}
+	v.progress.ScanTotal(v.plain, nil)
+	// Mount
+	srv := initGoFuse(pfs, args)
+	defer abortOnSignal(&v.abort)()
+	defer func() {
+		err = srv.Unmount()
+		if err != nil {
+			tlog.Warn.Printf("failed to unmount %q: %v", v.mnt, err)
+		} else {
+			if err := syscall.Rmdir(v.mnt); err != nil {
+				tlog.Warn.Printf("cleaning up %q failed: %v", v.mnt, err)
+			}
+		}
+	}()
+	v.dir("")
+	v.progress.Stop()
+	wipeKeys()
+	if v.abort {
+		tlog.Info.Printf("verify: aborted")
+		return exitcodes.Other
+	}
+	if v.differences > 0 {
+		fmt.Printf("verify summary: %d entries compared, %d differences\n", v.compared, v.differences)
+		return exitcodes.VerifyDiffers
+	}
+	tlog.Info.Printf("verify summary: %d entries compared, CIPHERDIR matches %q", v.compared, v.plain)
+	return 0
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
 	"runtime"
 	"runtime/debug"
 	"strings"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/aegis"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/hybridkem"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -32,13 +43,19 @@ func init() {
 // raceDetector is set to true by race.go if we are compiled with "go build -race"
 var raceDetector bool
 
-// printVersion prints a version string like this:
-// gocryptfs v1.7-32-gcf99cfd; go-fuse v1.0.0-174-g22a9cb9; 2019-05-12 go1.12 linux/amd64
-func printVersion() {
+// buildTags returns the build tags that change what gocryptfs can do
+func buildTags() []string {
 	var tagsSlice []string
 	if stupidgcm.BuiltWithoutOpenssl {
 		tagsSlice = append(tagsSlice, "without_openssl")
 	}
+	return tagsSlice
+}
+
+// printVersion prints a version string like this:
+// gocryptfs v1.7-32-gcf99cfd; go-fuse v1.0.0-174-g22a9cb9; 2019-05-12 go1.12 linux/amd64
+func printVersion() {
+	tagsSlice := buildTags()
 	tags := ""
 	if tagsSlice != nil {
 		tags = " " + strings.Join(tagsSlice, " ")
@@ -52,6 +69,136 @@ func printVersion() {
 		runtime.GOOS, runtime.GOARCH)
 }
 
+// versionJSON is what "-version -json" prints. Install and orchestration
+// scripts use it to check compatibility before creating filesystems, so
+// fields must only be added, never renamed or removed.
+type versionJSON struct {
+	Program string
+	// Version is the gocryptfs version like "v2.4.0-12-gcf99cfd"
+	Version string
+	// Commit is the git commit hash, or empty if unknown
+	Commit    string
+	GoFuse    string
+	BuildDate string
+	GoVersion string
+	OS        string
+	Arch      string
+	BuildTags []string
+	Race      bool
+	// OnDiskFormat is the version of the on-disk format written by -init
+	OnDiskFormat uint16
+	Crypto       versionCrypto
+	// FeatureFlags are the gocryptfs.conf feature flags this binary
+	// understands
+	FeatureFlags []string
+	FUSE         versionFUSE
+}
+
+// versionCrypto describes the compiled-in crypto backends
+type versionCrypto struct {
+	OpenSSL bool
+	// CPUHasAES is true if the CPU has AES instructions
+	CPUHasAES bool
+	// AEGISAccelerated is true if "-aegis" runs with AES instructions
+	AEGISAccelerated bool
+	// PQKey is true if "-pqkey" is supported (needs Go 1.24)
+	PQKey bool
+	// ContentEncryption lists the content encryption backends, like
+	// "AES-GCM-256-OpenSSL"
+	ContentEncryption []string
+}
+
+// versionFUSE describes what is available for mounting
+type versionFUSE struct {
+	// Device is true if the FUSE device exists
+	Device bool
+	// Fusermount is the path of the fusermount helper, or empty if there
+	// is none in $PATH
+	Fusermount string
+	// DirectMount is true if we run as root and can mount without
+	// fusermount
+	DirectMount bool
+	// Userns is true if "-userns" is supported
+	Userns bool
+	// MaxWrite is the largest write request we accept from the kernel
+	MaxWrite int
+}
+
+// printVersionJSON prints version and capabilities as JSON ("-version -json")
+func printVersionJSON() {
+	backends := []cryptocore.AEADTypeEnum{cryptocore.BackendGoGCM, cryptocore.BackendGoGCM128}
+	if !stupidgcm.BuiltWithoutOpenssl {
+		backends = append(backends, cryptocore.BackendOpenSSL, cryptocore.BackendOpenSSL128,
+			cryptocore.BackendXChaCha20Poly1305OpenSSL)
+	}
+	backends = append(backends, cryptocore.BackendAESSIV, cryptocore.BackendXChaCha20Poly1305,
+		cryptocore.BackendAEGIS256)
+	var backendNames []string
+	for _, b := range backends {
+		backendNames = append(backendNames, b.String())
+	}
+	fusermount, _ := exec.LookPath("fusermount3")
+	if fusermount == "" {
+		fusermount, _ = exec.LookPath("fusermount")
+	}
+	fuseDevice := "/dev/fuse"
+	if runtime.GOOS == "darwin" {
+		fuseDevice = "/dev/macfuse0"
+	}
+	_, err := os.Stat(fuseDevice)
+	v := versionJSON{
+		Program:      tlog.ProgramName,
+		Version:      GitVersion,
+		Commit:       gitCommit(GitVersion),
+		GoFuse:       GitVersionFuse,
+		BuildDate:    BuildDate,
+		GoVersion:    runtime.Version(),
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		BuildTags:    buildTags(),
+		Race:         raceDetector,
+		OnDiskFormat: contentenc.CurrentVersion,
+		Crypto: versionCrypto{
+			OpenSSL:           !stupidgcm.BuiltWithoutOpenssl,
+			CPUHasAES:         stupidgcm.CpuHasAES(),
+			AEGISAccelerated:  aegis.Accelerated(),
+			PQKey:             hybridkem.Supported,
+			ContentEncryption: backendNames,
+		},
+		FeatureFlags: configfile.KnownFeatureFlags(),
+		FUSE: versionFUSE{
+			Device:      err == nil,
+			Fusermount:  fusermount,
+			DirectMount: os.Getuid() == 0,
+			Userns:      runtime.GOOS == "linux",
+			MaxWrite:    fuse.MAX_KERNEL_WRITE,
+		},
+	}
+	if v.BuildTags == nil {
+		v.BuildTags = []string{}
+	}
+	out, _ := json.MarshalIndent(v, "", "\t")
+	fmt.Println(string(out))
+}
+
+// gitCommit extracts the commit hash from a version string like
+// "v2.4.0-12-gcf99cfd" (git describe) or
+// "v2.0.0-20220102030405-cf99cfd0a1b2" (Go pseudo-version)
+func gitCommit(version string) string {
+	if m := gitDescribeRe.FindStringSubmatch(version); m != nil {
+		return m[1]
+	}
+	if m := pseudoVersionRe.FindStringSubmatch(version); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+var (
+	gitDescribeRe   = regexp.MustCompile(`-g([0-9a-f]{7,40})(-dirty)?$`)
+	pseudoVersionRe = regexp.MustCompile(`[-.][0-9]{14}-([0-9a-f]{12})(\+dirty)?$`)
+)
+
 // versionFromBuildInfo tries to get some information out of the information baked in
 // by the Go compiler. Does nothing when build.bash was used to build.
 func versionFromBuildInfo() {
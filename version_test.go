@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGitCommit(t *testing.T) {
+	tests := []struct {
+		version string
+		commit  string
+	}{
+		{"v2.4.0-12-gcf99cfd", "cf99cfd"},
+		{"v2.4.0-12-gcf99cfd-dirty", "cf99cfd"},
+		{"v2.0.0-20220102030405-cf99cfd0a1b2", "cf99cfd0a1b2"},
+		{"v2.0.0-20220102030405-cf99cfd0a1b2+dirty", "cf99cfd0a1b2"},
+		{"v2.4.1-0.20220102030405-cf99cfd0a1b2", "cf99cfd0a1b2"},
+		{"v2.4.0", ""},
+		{gitVersionNotSet, ""},
+	}
+	for _, tc := range tests {
+		if c := gitCommit(tc.version); c != tc.commit {
+			t.Errorf("%q: got %q, want %q", tc.version, c, tc.commit)
+		}
+	}
+}
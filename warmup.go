@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// warmupWorkers is how many directories "-warmup" reads at the same time.
+// Parallel requests hide the latency of network storage.
+const warmupWorkers = 8
+
+// warmer walks a directory tree in a gocryptfs mount. Every directory is
+// read and every entry is looked up, which makes gocryptfs read the
+// gocryptfs.diriv and gocryptfs.longname.*.name files, and fills the kernel
+// dentry and inode caches and the caches of the backing storage.
+type warmer struct {
+	// dev is the device of the mount. Other filesystems mounted inside it
+	// are skipped.
+	dev uint64
+	// sem limits the directories being read to warmupWorkers
+	sem chan struct{}
+	wg  sync.WaitGroup
+	// Counters. Use atomic ops to access them.
+	dirs, files, errors uint64
+}
+
+// dir reads the directory "path" and looks up its entries. Subdirectories
+// are walked in new goroutines.
+func (w *warmer) dir(path string) {
+	defer w.wg.Done()
+	w.sem <- struct{}{}
+	f, err := os.Open(path)
+	var names []string
+	if err == nil {
+		names, err = f.Readdirnames(-1)
+		f.Close()
+	}
+	<-w.sem
+	if err != nil {
+		tlog.Warn.Printf("warmup: %v", err)
+		atomic.AddUint64(&w.errors, 1)
+		return
+	}
+	atomic.AddUint64(&w.dirs, 1)
+	for _, name := range names {
+		p := filepath.Join(path, name)
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err != nil {
+			// Deleted in the meantime, or undecryptable
+			tlog.Debug.Printf("warmup: %q: %v", p, err)
+			continue
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR || uint64(st.Dev) != w.dev {
+			atomic.AddUint64(&w.files, 1)
+			continue
+		}
+		w.wg.Add(1)
+		go w.dir(p)
+	}
+}
+
+// doWarmup handles "gocryptfs -warmup MOUNTPOINT [PATH]": it walks the
+// directory PATH in the gocryptfs filesystem mounted at MOUNTPOINT, or all
+// of it, so that the first "ls -R" or indexing run is not slowed down by
+// cold caches. Returns the exit code.
+func doWarmup(args *argContainer) int {
+	if flagSet.NArg() < 1 || flagSet.NArg() > 2 {
+		tlog.Fatal.Printf("Usage: %s -warmup MOUNTPOINT [PATH]", tlog.ProgramName)
+		return exitcodes.Usage
+	}
+	mnt, _, err := findMount(flagSet.Arg(0))
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		return exitcodes.MountPoint
+	}
+	root := mnt
+	if flagSet.NArg() == 2 {
+		// PATH is relative to the root of the mount
+		root = filepath.Join(mnt, filepath.Clean("/"+flagSet.Arg(1)))
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(mnt, &st); err != nil {
+		tlog.Fatal.Printf("warmup: %v", err)
+		return exitcodes.MountPoint
+	}
+	w := &warmer{dev: uint64(st.Dev), sem: make(chan struct{}, warmupWorkers)}
+	t0 := time.Now()
+	w.wg.Add(1)
+	w.dir(root)
+	w.wg.Wait()
+	tlog.Info.Printf("warmup: %d directories and %d files in %v",
+		w.dirs, w.files, time.Since(t0).Round(time.Millisecond))
+	if w.errors > 0 {
+		tlog.Info.Printf("warmup: %d directories could not be read", w.errors)
+		return exitcodes.Other
+	}
+	return 0
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/aegis"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Where CIPHERDIR is stored, first question of "-init -wizard"
+const (
+	wizardCloud = iota
+	wizardLocal
+	wizardBackup
+)
+
+var wizardTargetNames = []string{"cloud sync", "local disk", "backup"}
+
+// wizardCPU is what the wizard needs to know about the CPU
+type wizardCPU struct {
+	hasAES    bool
+	fastAEGIS bool
+}
+
+// wizardChoice is an option the wizard has picked, and why
+type wizardChoice struct {
+	flag   string
+	reason string
+}
+
+// wizardChoose picks the options for "target" (wizardCloud, wizardLocal or
+// wizardBackup) and sets them in "args". With "hide", the options hide
+// more metadata at the cost of speed.
+func wizardChoose(args *argContainer, target int, hide bool, cpu wizardCPU) (choices []wizardChoice) {
+	add := func(flag string, reason string) {
+		choices = append(choices, wizardChoice{flag, reason})
+	}
+	// Backups have to be readable for many years, possibly by an older
+	// gocryptfs version, so they use the long-standing defaults.
+	switch {
+	case !cpu.hasAES:
+		args.xchacha = true
+		add("-xchacha", "your CPU has no AES acceleration, and XChaCha20-Poly1305 is much faster than AES-GCM there")
+	case !hide && target != wizardBackup && cpu.fastAEGIS:
+		args.aegis = true
+		add("-aegis", "AEGIS-256 is the fastest content encryption on your CPU")
+	default:
+		add("AES-256-GCM", "the default content encryption, accelerated by your CPU")
+	}
+	if !hide && target != wizardBackup {
+		args.hctr2 = true
+		add("-hctr2", "HCTR2 encrypts file names faster than EME")
+	}
+	switch target {
+	case wizardCloud:
+		if hide {
+			args.bindpath = true
+			add("-bindpath", "the storage provider cannot swap or rename files")
+			args.merkle = true
+			add("-merkle", "files that the storage provider cut off are detected")
+		} else {
+			args.deterministic_names = true
+			add("-deterministic-names", "no gocryptfs.diriv files, which avoids sync conflicts, "+
+				"but identical names in different directories are visible")
+		}
+	case wizardBackup:
+		args.merkle = true
+		add("-merkle", "files that were cut off in the backup are detected")
+	}
+	if hide {
+		args.longnamemax = 62
+		add("-longnamemax 62", "all but the shortest names are hashed, which hides their length")
+	} else if target == wizardCloud {
+		args.longnamemax = 143
+		add("-longnamemax 143", "online storage often limits the length of names")
+	}
+	if (target == wizardBackup || (target == wizardCloud && hide)) && !args._explicitScryptn {
+		args.scryptn++
+		add(fmt.Sprintf("-scryptn %d", args.scryptn), "the config file can be copied by others, "+
+			"so the password hash is made twice as expensive to brute-force")
+	}
+	return choices
+}
+
+// wizardAsk prints "question" and the numbered "options" and returns the
+// index of the answer. The answer is read without buffering, so that the
+// password can be read from stdin afterwards.
+func wizardAsk(in io.Reader, question string, options []string) int {
+	for {
+		fmt.Fprintf(os.Stderr, "%s\n", question)
+		for i, o := range options {
+			fmt.Fprintf(os.Stderr, "  %d) %s\n", i+1, o)
+		}
+		fmt.Fprintf(os.Stderr, "Choice [1-%d]: ", len(options))
+		var line []byte
+		b := make([]byte, 1)
+		for {
+			n, err := in.Read(b)
+			if err == io.EOF && len(line) == 0 {
+				fmt.Fprintf(os.Stderr, "\n")
+				tlog.Fatal.Printf("-wizard: no answer on stdin")
+				os.Exit(exitcodes.Usage)
+			}
+			if err != nil || (n == 1 && b[0] == '\n') {
+				break
+			}
+			line = append(line, b[:n]...)
+		}
+		answer := strings.TrimSpace(string(line))
+		for i := range options {
+			if answer == fmt.Sprint(i+1) {
+				return i
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Invalid choice %q\n\n", answer)
+	}
+}
+
+// initWizard handles "gocryptfs -init -wizard". It asks where CIPHERDIR will
+// be stored and what matters more, picks the options and explains them.
+// It returns a summary for the "Profile" field of the config file.
+func initWizard(args *argContainer) string {
+	target := wizardAsk(os.Stdin, "Where will the encrypted directory be stored?", []string{
+		"Cloud sync (Dropbox, Nextcloud, ...)",
+		"Local disk",
+		"Backup (external disk, backup server)",
+	})
+	hide := wizardAsk(os.Stdin, "What is more important?", []string{
+		"Performance",
+		"Hiding metadata (name lengths, directory structure) and detecting tampering",
+	}) == 1
+	cpu := wizardCPU{
+		hasAES:    stupidgcm.CpuHasAES(),
+		fastAEGIS: aegis.Accelerated(),
+	}
+	choices := wizardChoose(args, target, hide, cpu)
+	goal := "performance"
+	if hide {
+		goal = "hide metadata"
+	}
+	summary := wizardTargetNames[target] + ", " + goal
+	tlog.Info.Printf("The wizard picked these options for %s:", summary)
+	profile := summary + ":"
+	for _, c := range choices {
+		tlog.Info.Printf("  %-20s %s", c.flag, c.reason)
+		profile += " " + c.flag
+	}
+	return profile
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestWizardChoose checks that every answer results in a valid combination of
+// options
+func TestWizardChoose(t *testing.T) {
+	cpus := []wizardCPU{
+		{hasAES: true, fastAEGIS: true},
+		{hasAES: true},
+		{},
+	}
+	for _, cpu := range cpus {
+		for target := range wizardTargetNames {
+			for _, hide := range []bool{false, true} {
+				args := argContainer{longnamemax: 255, scryptn: 16}
+				choices := wizardChoose(&args, target, hide, cpu)
+				name := wizardTargetNames[target]
+				if len(choices) == 0 {
+					t.Errorf("%s: nothing chosen", name)
+				}
+				nCiphers := 0
+				for _, b := range []bool{args.xchacha, args.aegis} {
+					if b {
+						nCiphers++
+					}
+				}
+				if nCiphers > 1 {
+					t.Errorf("%s: more than one cipher: %+v", name, choices)
+				}
+				if !cpu.hasAES && nCiphers == 0 {
+					t.Errorf("%s: AES-GCM chosen on a CPU without AES", name)
+				}
+				if args.bindpath && args.deterministic_names {
+					t.Errorf("%s: -bindpath needs gocryptfs.diriv files", name)
+				}
+				if args.longnamemax < 62 {
+					t.Errorf("%s: invalid -longnamemax %d", name, args.longnamemax)
+				}
+				if target == wizardBackup && (args.aegis || args.hctr2) {
+					t.Errorf("%s: backups should use the long-standing defaults", name)
+				}
+				if hide && args.longnamemax == 255 {
+					t.Errorf("%s: name lengths are not hidden", name)
+				}
+				for _, c := range choices {
+					if c.reason == "" || strings.TrimSpace(c.flag) == "" {
+						t.Errorf("%s: incomplete choice %+v", name, c)
+					}
+				}
+			}
+		}
+	}
+	// An explicit -scryptn is kept
+	args := argContainer{longnamemax: 255, scryptn: 10, _explicitScryptn: true}
+	wizardChoose(&args, wizardBackup, true, wizardCPU{hasAES: true})
+	if args.scryptn != 10 {
+		t.Errorf("explicit -scryptn was changed to %d", args.scryptn)
+	}
+}